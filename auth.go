@@ -2,15 +2,20 @@ package kiroclient
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +41,7 @@ type AuthManager struct {
 
 	// ========== 负载均衡层 ==========
 	usageCache      map[string]*AccountUsageCache // 账号额度缓存
+	quotaExhausted  map[string]*QuotaExhaustion   // 上游报告额度耗尽的账号（usageMu 保护）
 	usageMu         sync.RWMutex                  // 额度缓存锁
 	roundRobinIndex uint64                        // 轮询索引
 	smoothWeights   map[string]int                // 平滑加权轮询的当前权重
@@ -46,6 +52,17 @@ type AuthManager struct {
 
 	// ========== 账号追踪 ==========
 	lastSelectedAccountID string // 上一次选中的账号ID（用于统计）
+
+	// ========== 会话粘性 ==========
+	stickySessions map[string]*list.Element // 会话 key -> stickyLRU 中的绑定
+	stickyLRU      *list.List               // 会话绑定按最近使用排序（队首最新），满了从队尾淘汰
+	stickyStats    StickinessStats          // 粘性命中统计
+	stickyMu       sync.Mutex               // 会话粘性锁（只保护上面三项，不在持锁时选择账号）
+
+	// ========== 认证失败自动停用 ==========
+	authFailures         map[string]int // 账号 -> 连续认证类刷新失败次数
+	authFailureThreshold int            // 达到该次数后自动停用账号（0=不自动停用）
+	authFailureMu        sync.Mutex
 }
 
 // NewAuthManager 创建 AuthManager
@@ -56,6 +73,10 @@ func NewAuthManager() *AuthManager {
 		circuitConfig:   DefaultCircuitBreakerConfig,
 		smoothWeights:   make(map[string]int),
 		usageCache:      make(map[string]*AccountUsageCache),
+		quotaExhausted:  make(map[string]*QuotaExhaustion),
+		stickySessions:  make(map[string]*list.Element),
+		stickyLRU:       list.New(),
+		authFailures:    make(map[string]int),
 	}
 }
 
@@ -109,13 +130,7 @@ func (m *AuthManager) refreshAllUsageCache() {
 			continue
 		}
 
-		// 提取 CREDIT 类型的额度
-		for _, u := range usage.UsageBreakdownList {
-			if u.ResourceType == "CREDIT" {
-				m.updateUsageCache(acc.ID, u.CurrentUsageWithPrecision, u.UsageLimitWithPrecision)
-				break
-			}
-		}
+		m.RecordUsageLimits(acc.ID, usage)
 	}
 }
 
@@ -216,6 +231,7 @@ func (m *AuthManager) recordSuccess(accountID string) {
 			cb.State = CircuitClosed
 			cb.FailureCount = 0
 			cb.SuccessCount = 0
+			cb.ProbesInFlight = 0
 		}
 	case CircuitClosed:
 		// 正常状态下成功，重置失败计数
@@ -261,6 +277,7 @@ func (m *AuthManager) recordFailure(accountID string) {
 		cb.State = CircuitOpen
 		cb.OpenedAt = now
 		cb.SuccessCount = 0
+		cb.ProbesInFlight = 0
 	}
 }
 
@@ -286,17 +303,76 @@ func (m *AuthManager) isAccountAvailable(accountID string) bool {
 			cb.State = CircuitHalfOpen
 			cb.HalfOpenAt = now
 			cb.SuccessCount = 0
+			cb.ProbesInFlight = 0
 			return true
 		}
 		return false
 
 	case CircuitHalfOpen:
-		return true
+		// 试探名额占满时视同熔断，其余请求选择其他账号
+		return m.hasHalfOpenProbeSlot(cb, now)
+	}
+
+	return true
+}
+
+// halfOpenProbeTimeout 试探名额未释放时的回收时间
+// 名额正常由 ReleaseHalfOpenProbe 释放，这里只是兜底（例如调用方漏了 defer）
+const halfOpenProbeTimeout = 5 * time.Minute
+
+// halfOpenMaxProbes 半开状态下同时放行的试探请求数（未配置时为 1）
+func (m *AuthManager) halfOpenMaxProbes() int {
+	if m.circuitConfig.HalfOpenMaxProbes <= 0 {
+		return 1
+	}
+	return m.circuitConfig.HalfOpenMaxProbes
+}
+
+// hasHalfOpenProbeSlot 半开账号是否还有试探名额（超时未回报的名额先回收），调用方必须持有 circuitMu 写锁
+func (m *AuthManager) hasHalfOpenProbeSlot(cb *CircuitBreaker, now time.Time) bool {
+	if cb.ProbesInFlight > 0 && now.Sub(cb.LastProbeAt) > halfOpenProbeTimeout {
+		cb.ProbesInFlight = 0
 	}
+	return cb.ProbesInFlight < m.halfOpenMaxProbes()
+}
 
+// acquireHalfOpenProbe 选中账号后占用试探名额：非半开账号直接放行，半开账号名额已满（被并发请求抢先占满）时返回 false
+// 名额由拿到账号的调用方 defer ReleaseHalfOpenProbe 释放
+func (m *AuthManager) acquireHalfOpenProbe(accountID string) bool {
+	m.circuitMu.Lock()
+	defer m.circuitMu.Unlock()
+
+	cb, exists := m.circuitBreakers[accountID]
+	if !exists || cb.State == CircuitClosed {
+		return true
+	}
+	if cb.State == CircuitOpen {
+		return false
+	}
+	now := time.Now()
+	if !m.hasHalfOpenProbeSlot(cb, now) {
+		return false
+	}
+	cb.ProbesInFlight++
+	cb.LastProbeAt = now
 	return true
 }
 
+// ReleaseHalfOpenProbe 释放选中账号时占用的试探名额（账号不在半开状态时什么也不做）
+// GetAccessTokenWithAccountID 等返回账号 ID 的方法拿到账号后，调用方应立即 defer 本方法
+// 为什么不在 RecordRequestResult 里释放：400、额度耗尽、客户端取消等结果不计入熔断、不会回报，
+// 名额一直占着的话，默认只有 1 个名额的半开账号要等 halfOpenProbeTimeout 才能继续恢复
+func (m *AuthManager) ReleaseHalfOpenProbe(accountID string) {
+	if accountID == "" {
+		return
+	}
+	m.circuitMu.Lock()
+	defer m.circuitMu.Unlock()
+	if cb, exists := m.circuitBreakers[accountID]; exists && cb.State == CircuitHalfOpen && cb.ProbesInFlight > 0 {
+		cb.ProbesInFlight--
+	}
+}
+
 // ========== 负载均衡层 ==========
 
 // updateUsageCache 更新账号额度缓存
@@ -312,6 +388,38 @@ func (m *AuthManager) updateUsageCache(accountID string, used, total float64) {
 	}
 }
 
+// RecordUsageLimits 用实时查询到的额度刷新缓存，同时保存完整响应（订阅、重置时间等）
+// 没有 CREDIT 额度项时不写入，避免把"无数据"当成 0 额度导致账号不可选
+func (m *AuthManager) RecordUsageLimits(accountID string, usage *UsageLimitsResponse) {
+	if usage == nil {
+		return
+	}
+	for _, u := range usage.UsageBreakdownList {
+		if u.ResourceType != "CREDIT" {
+			continue
+		}
+		m.usageMu.Lock()
+		m.usageCache[accountID] = &AccountUsageCache{
+			UsedCredits:  u.CurrentUsageWithPrecision,
+			TotalCredits: u.UsageLimitWithPrecision,
+			LastUpdated:  time.Now(),
+			Limits:       usage,
+		}
+		m.usageMu.Unlock()
+		return
+	}
+}
+
+// GetCachedUsage 返回账号最近一次成功获取的额度（副本），没有缓存时返回 false
+// 用于实时查询失败时展示上次的值，而不是把未知当成 0
+func (m *AuthManager) GetCachedUsage(accountID string) (AccountUsageCache, bool) {
+	cache := m.getUsageCache(accountID)
+	if cache == nil {
+		return AccountUsageCache{}, false
+	}
+	return *cache, true
+}
+
 // getUsageCache 获取账号额度缓存
 func (m *AuthManager) getUsageCache(accountID string) *AccountUsageCache {
 	m.usageMu.RLock()
@@ -320,9 +428,74 @@ func (m *AuthManager) getUsageCache(accountID string) *AccountUsageCache {
 	return m.usageCache[accountID]
 }
 
-// calculateWeight 计算账号权重（基于剩余额度）
-// 返回 0-100 的权重值，剩余额度越多权重越高
+// ========== 额度耗尽 ==========
+
+// quotaExhaustedFallback 没有额度重置时间时，额度耗尽标记的持续时间
+var quotaExhaustedFallback = time.Hour
+
+// QuotaExhaustion 上游报告的账号额度耗尽状态
+type QuotaExhaustion struct {
+	Until  time.Time `json:"until"`  // 标记到期时间（下个额度重置日，未知时为 quotaExhaustedFallback 后）
+	Hits   int64     `json:"hits"`   // 累计收到额度耗尽错误的次数
+	LastAt time.Time `json:"lastAt"` // 最近一次收到的时间
+}
+
+// MarkQuotaExhausted 上游返回额度耗尽时调用：到下个额度重置日之前不再选择该账号
+// 重置时间取自额度缓存中的 nextDateReset，已过期或未知时按 quotaExhaustedFallback 计算
+func (m *AuthManager) MarkQuotaExhausted(accountID string) {
+	if accountID == "" {
+		return
+	}
+	now := time.Now()
+	until := now.Add(quotaExhaustedFallback)
+
+	m.usageMu.Lock()
+	defer m.usageMu.Unlock()
+	if cache := m.usageCache[accountID]; cache != nil && cache.Limits != nil && cache.Limits.NextDateReset > 0 {
+		if reset := time.Unix(int64(cache.Limits.NextDateReset), 0); reset.After(now) {
+			until = reset
+		}
+	}
+	q := m.quotaExhausted[accountID]
+	if q == nil {
+		q = &QuotaExhaustion{}
+		m.quotaExhausted[accountID] = q
+	}
+	q.Until = until
+	q.Hits++
+	q.LastAt = now
+}
+
+// quotaExhaustedUntil 返回账号额度耗尽标记的到期时间，未标记或已到期时返回零值
+func (m *AuthManager) quotaExhaustedUntil(accountID string) time.Time {
+	m.usageMu.RLock()
+	defer m.usageMu.RUnlock()
+	q := m.quotaExhausted[accountID]
+	if q == nil || !time.Now().Before(q.Until) {
+		return time.Time{}
+	}
+	return q.Until
+}
+
+// GetQuotaExhaustions 返回所有收到过额度耗尽错误的账号（副本，含已到期的记录）
+func (m *AuthManager) GetQuotaExhaustions() map[string]QuotaExhaustion {
+	m.usageMu.RLock()
+	defer m.usageMu.RUnlock()
+	result := make(map[string]QuotaExhaustion, len(m.quotaExhausted))
+	for id, q := range m.quotaExhausted {
+		result[id] = *q
+	}
+	return result
+}
+
+// calculateWeight 计算账号权重：额度权重（0-100，剩余额度越多越高）× 配置的调度权重
 func (m *AuthManager) calculateWeight(account *AccountInfo) int {
+	return m.creditWeight(account) * account.EffectiveWeight()
+}
+
+// creditWeight 基于剩余额度的权重
+// 返回 0-100 的权重值，剩余额度越多权重越高
+func (m *AuthManager) creditWeight(account *AccountInfo) int {
 	cache := m.getUsageCache(account.ID)
 	if cache == nil || cache.TotalCredits <= 0 {
 		return 50 // 无额度信息，给默认权重
@@ -340,10 +513,42 @@ func (m *AuthManager) calculateWeight(account *AccountInfo) int {
 	return weight
 }
 
+// isAccountSelectable 判断账号当前能否承接请求
+// 跳过已停用、无 Token、已过期、熔断中、额度耗尽（缓存判断或上游报告）的账号
+func (m *AuthManager) isAccountSelectable(acc *AccountInfo) bool {
+	if acc.Disabled || acc.Token == nil || acc.Token.IsExpired() {
+		return false
+	}
+	if !m.isAccountAvailable(acc.ID) {
+		return false
+	}
+	if !m.quotaExhaustedUntil(acc.ID).IsZero() {
+		return false
+	}
+	cache := m.getUsageCache(acc.ID)
+	return cache == nil || cache.GetRemainingCredits() > 0
+}
+
 // selectAccount 选择一个可用账号（平滑加权轮询）
 // 使用 Nginx 的平滑加权轮询算法，既考虑权重又保证交替
 // 返回选中的账号，如果没有可用账号返回 nil
 func (m *AuthManager) selectAccount() (*AccountInfo, error) {
+	return m.selectAccountExcluding()
+}
+
+// selectAccountExcluding 同 selectAccount，但不选择 excludeIDs 中的账号
+func (m *AuthManager) selectAccountExcluding(excludeIDs ...string) (*AccountInfo, error) {
+	return m.selectAccountFromPool(excludeIDs, false)
+}
+
+// weightedAccount 参与加权轮询的候选账号
+type weightedAccount struct {
+	account *AccountInfo
+	weight  int
+}
+
+// selectAccountFromPool 在正常账号池（reserved=false）或预留账号池（reserved=true）中选择账号
+func (m *AuthManager) selectAccountFromPool(excludeIDs []string, reserved bool) (*AccountInfo, error) {
 	config := m.getAccountsFromCache()
 	if config == nil {
 		// 缓存未初始化，尝试加载
@@ -358,35 +563,12 @@ func (m *AuthManager) selectAccount() (*AccountInfo, error) {
 	}
 
 	// 构建可用账号列表（过滤掉过期、熔断、额度耗尽的账号）
-	type weightedAccount struct {
-		account *AccountInfo
-		weight  int
-	}
-
 	var candidates []weightedAccount
 	var totalWeight int
 
 	for i := range config.Accounts {
 		acc := &config.Accounts[i]
-
-		// 跳过无 Token 的账号
-		if acc.Token == nil {
-			continue
-		}
-
-		// 跳过已过期的账号
-		if acc.Token.IsExpired() {
-			continue
-		}
-
-		// 跳过熔断中的账号
-		if !m.isAccountAvailable(acc.ID) {
-			continue
-		}
-
-		// 跳过额度耗尽的账号
-		cache := m.getUsageCache(acc.ID)
-		if cache != nil && cache.GetRemainingCredits() <= 0 {
+		if slices.Contains(excludeIDs, acc.ID) || acc.Reserved != reserved || !m.isAccountSelectable(acc) {
 			continue
 		}
 
@@ -397,62 +579,78 @@ func (m *AuthManager) selectAccount() (*AccountInfo, error) {
 		}
 	}
 
-	if len(candidates) == 0 {
-		return nil, fmt.Errorf("没有可用账号（所有账号已过期、熔断或额度耗尽）")
+	for len(candidates) > 0 {
+		// 只有一个候选，直接使用；否则平滑加权轮询
+		i := 0
+		weighted := len(candidates) > 1
+		if weighted {
+			i = m.pickSmoothWeighted(candidates, totalWeight)
+		}
+		selected := candidates[i]
+
+		// 半开账号的试探名额被并发请求抢先占满时视同熔断，从候选中移除后重选
+		if !m.acquireHalfOpenProbe(selected.account.ID) {
+			totalWeight -= selected.weight
+			candidates = append(candidates[:i], candidates[i+1:]...)
+			continue
+		}
+		if weighted {
+			// 保存选中的账号ID（用于统计追踪）
+			m.usageMu.Lock()
+			m.lastSelectedAccountID = selected.account.ID
+			m.usageMu.Unlock()
+		}
+		return selected.account, nil
 	}
 
-	// 只有一个候选，直接返回
-	if len(candidates) == 1 {
-		return candidates[0].account, nil
+	if reserved {
+		return nil, fmt.Errorf("没有可用的预留账号（所有预留账号已过期、熔断或额度耗尽）")
 	}
+	return nil, fmt.Errorf("没有可用账号（所有账号已过期、熔断或额度耗尽）")
+}
 
-	// ========== 平滑加权轮询算法 (Nginx SWRR) ==========
-	// 1. 每个候选的 currentWeight += weight
-	// 2. 选择 currentWeight 最大的候选
-	// 3. 被选中的候选 currentWeight -= totalWeight
+// pickSmoothWeighted 平滑加权轮询算法 (Nginx SWRR)，返回选中候选的下标
+// 1. 每个候选的 currentWeight += weight
+// 2. 选择 currentWeight 最大的候选
+// 3. 被选中的候选 currentWeight -= totalWeight
+func (m *AuthManager) pickSmoothWeighted(candidates []weightedAccount, totalWeight int) int {
 	m.usageMu.Lock()
 	defer m.usageMu.Unlock()
 
-	var selected *weightedAccount
+	selected := 0
 	maxCurrent := -1 << 31 // 最小 int
 
-	for i := range candidates {
-		wa := &candidates[i]
+	for i, wa := range candidates {
 		accID := wa.account.ID
 
-		// 初始化或获取当前权重
-		if _, exists := m.smoothWeights[accID]; !exists {
-			m.smoothWeights[accID] = 0
-		}
-
-		// 步骤1: currentWeight += weight
+		// 步骤1: currentWeight += weight（首次出现时从 0 开始）
 		m.smoothWeights[accID] += wa.weight
 
 		// 找最大 currentWeight
 		if m.smoothWeights[accID] > maxCurrent {
 			maxCurrent = m.smoothWeights[accID]
-			selected = wa
+			selected = i
 		}
 	}
 
 	// 步骤3: 被选中的 currentWeight -= totalWeight
-	if selected != nil {
-		m.smoothWeights[selected.account.ID] -= totalWeight
-		// 保存选中的账号ID（用于统计追踪）
-		m.lastSelectedAccountID = selected.account.ID
-	}
-
-	return selected.account, nil
+	m.smoothWeights[candidates[selected].account.ID] -= totalWeight
+	return selected
 }
 
 // GetAccessToken 获取有效的 Access Token（加权轮询选择账号）
+// 不返回账号 ID，调用方无法释放试探名额，这里选中后立即释放
 func (m *AuthManager) GetAccessToken() (string, error) {
 	// 多账号加权轮询
 	account, err := m.selectAccount()
 	if err != nil {
 		return "", err
 	}
-	if account == nil || account.Token == nil {
+	if account == nil {
+		return "", fmt.Errorf("没有可用账号")
+	}
+	m.ReleaseHalfOpenProbe(account.ID)
+	if account.Token == nil {
 		return "", fmt.Errorf("没有可用账号")
 	}
 	return account.Token.AccessToken, nil
@@ -472,6 +670,216 @@ func (m *AuthManager) GetAccessTokenWithAccountID() (string, string, error) {
 	return account.Token.AccessToken, account.ID, nil
 }
 
+// GetAccessTokenExcluding 选择 excludeIDs 以外的账号（用于换账号重试）
+func (m *AuthManager) GetAccessTokenExcluding(excludeIDs ...string) (string, string, error) {
+	account, err := m.selectAccountExcluding(excludeIDs...)
+	if err != nil {
+		return "", "", err
+	}
+	if account == nil || account.Token == nil {
+		return "", "", fmt.Errorf("没有可用账号")
+	}
+	return account.Token.AccessToken, account.ID, nil
+}
+
+// GetReservedAccessToken 从预留账号中选择（自检诊断等运维探测使用）
+// 没有配置任何预留账号时退回正常账号池，保持原有行为；配置了但都不可用时返回错误，不占用生产账号
+func (m *AuthManager) GetReservedAccessToken() (string, string, error) {
+	if !m.hasReservedAccounts() {
+		return m.GetAccessTokenWithAccountID()
+	}
+	account, err := m.selectAccountFromPool(nil, true)
+	if err != nil {
+		return "", "", err
+	}
+	return account.Token.AccessToken, account.ID, nil
+}
+
+// hasReservedAccounts 是否配置了预留账号
+func (m *AuthManager) hasReservedAccounts() bool {
+	config := m.getAccountsFromCache()
+	if config == nil {
+		return false
+	}
+	for i := range config.Accounts {
+		if config.Accounts[i].Reserved {
+			return true
+		}
+	}
+	return false
+}
+
+// ========== 会话粘性 ==========
+
+const (
+	// stickySessionTTL 会话绑定的空闲过期时间（超过后按新会话重新选择账号）
+	stickySessionTTL = 1 * time.Hour
+	// maxStickySessions 最多保留的会话绑定数，超过时淘汰最久未使用的绑定
+	maxStickySessions = 10000
+)
+
+// stickyBinding 会话与账号的绑定关系
+type stickyBinding struct {
+	Key       string
+	AccountID string
+	LastUsed  time.Time
+}
+
+// StickinessStats 会话粘性命中统计
+type StickinessStats struct {
+	Hits      int64   `json:"hits"`      // 沿用已绑定账号
+	Misses    int64   `json:"misses"`    // 新会话，首次选择账号
+	Fallbacks int64   `json:"fallbacks"` // 绑定账号不可用（熔断等），重新选择
+	Sessions  int     `json:"sessions"`  // 当前绑定的会话数
+	HitRate   float64 `json:"hitRate"`   // hits / (hits + misses + fallbacks)
+}
+
+// GetAccessTokenForSession 按会话选择账号：同一会话的后续请求优先沿用已绑定账号
+// sessionKey 为空时等同于 GetAccessTokenWithAccountID（每次请求独立轮询）
+// 为什么要粘性：多轮对话在账号间来回切换会让上游的 prompt cache 失效，也不利于按账号排查问题
+func (m *AuthManager) GetAccessTokenForSession(sessionKey string) (string, string, error) {
+	if sessionKey == "" {
+		return m.GetAccessTokenWithAccountID()
+	}
+
+	now := time.Now()
+	m.stickyMu.Lock()
+	boundID, bound := m.lookupStickySession(sessionKey, now)
+	m.stickyMu.Unlock()
+
+	// 检查和选择账号都不持有 stickyMu，避免所有会话的请求在这里串行
+	if bound {
+		if acc := m.findAccount(boundID); acc != nil && !acc.Reserved && m.isAccountSelectable(acc) && m.acquireHalfOpenProbe(acc.ID) {
+			m.stickyMu.Lock()
+			m.stickyStats.Hits++
+			m.bindStickySession(sessionKey, acc.ID, now)
+			m.stickyMu.Unlock()
+			m.usageMu.Lock()
+			m.lastSelectedAccountID = acc.ID
+			m.usageMu.Unlock()
+			return acc.Token.AccessToken, acc.ID, nil
+		}
+	}
+
+	account, err := m.selectAccount()
+	if err != nil {
+		return "", "", err
+	}
+	if account == nil || account.Token == nil {
+		return "", "", fmt.Errorf("没有可用账号")
+	}
+
+	m.stickyMu.Lock()
+	if bound {
+		m.stickyStats.Fallbacks++
+	} else {
+		m.stickyStats.Misses++
+	}
+	// 同一新会话的并发请求各自选择账号时，以最后绑定的为准
+	m.bindStickySession(sessionKey, account.ID, now)
+	m.stickyMu.Unlock()
+	return account.Token.AccessToken, account.ID, nil
+}
+
+// CheckAccountSelectable 检查指定账号当前能否承接请求（不存在、预留、已停用、Token 过期、熔断中或额度耗尽时返回原因）
+func (m *AuthManager) CheckAccountSelectable(accountID string) error {
+	if m.getAccountsFromCache() == nil {
+		if err := m.InitAccountsCache(); err != nil {
+			return fmt.Errorf("加载账号缓存失败: %w", err)
+		}
+	}
+	acc := m.findAccount(accountID)
+	if acc == nil {
+		return fmt.Errorf("账号不存在: %s", accountID)
+	}
+	// 预留账号只供诊断探测使用，固定账号也不能让正常请求落到它上面
+	if acc.Reserved {
+		return fmt.Errorf("账号 %s 为预留账号，不承接正常请求", accountID)
+	}
+	if !m.isAccountSelectable(acc) {
+		return fmt.Errorf("账号 %s 当前不可用（已停用、Token 过期、熔断中或额度耗尽）", accountID)
+	}
+	return nil
+}
+
+// GetAccessTokenForAccount 只使用指定账号，不可用时直接返回错误，不回落到其他账号
+// 为什么不回落：固定账号用于排查单个账号的问题，换成别的账号会让排查结论失真
+func (m *AuthManager) GetAccessTokenForAccount(accountID string) (string, string, error) {
+	if err := m.CheckAccountSelectable(accountID); err != nil {
+		return "", "", err
+	}
+	acc := m.findAccount(accountID)
+	if acc == nil {
+		return "", "", fmt.Errorf("账号不存在: %s", accountID)
+	}
+	if !m.acquireHalfOpenProbe(accountID) {
+		return "", "", fmt.Errorf("账号 %s 处于半开状态，试探请求名额已满", accountID)
+	}
+	m.usageMu.Lock()
+	m.lastSelectedAccountID = acc.ID
+	m.usageMu.Unlock()
+	return acc.Token.AccessToken, acc.ID, nil
+}
+
+// lookupStickySession 返回会话当前绑定的账号，过期的绑定顺便删除，调用方必须持有 stickyMu 锁
+func (m *AuthManager) lookupStickySession(sessionKey string, now time.Time) (string, bool) {
+	elem := m.stickySessions[sessionKey]
+	if elem == nil {
+		return "", false
+	}
+	binding := elem.Value.(*stickyBinding)
+	if now.Sub(binding.LastUsed) > stickySessionTTL {
+		m.stickyLRU.Remove(elem)
+		delete(m.stickySessions, sessionKey)
+		return "", false
+	}
+	return binding.AccountID, true
+}
+
+// bindStickySession 绑定（或刷新）会话与账号并移到队首，超出 maxStickySessions 时淘汰最久未使用的绑定
+// 调用方必须持有 stickyMu 锁
+func (m *AuthManager) bindStickySession(sessionKey, accountID string, now time.Time) {
+	if elem := m.stickySessions[sessionKey]; elem != nil {
+		binding := elem.Value.(*stickyBinding)
+		binding.AccountID = accountID
+		binding.LastUsed = now
+		m.stickyLRU.MoveToFront(elem)
+		return
+	}
+	m.stickySessions[sessionKey] = m.stickyLRU.PushFront(&stickyBinding{Key: sessionKey, AccountID: accountID, LastUsed: now})
+	for m.stickyLRU.Len() > maxStickySessions {
+		oldest := m.stickyLRU.Back()
+		m.stickyLRU.Remove(oldest)
+		delete(m.stickySessions, oldest.Value.(*stickyBinding).Key)
+	}
+}
+
+// GetStickinessStats 获取会话粘性命中统计
+func (m *AuthManager) GetStickinessStats() StickinessStats {
+	m.stickyMu.Lock()
+	defer m.stickyMu.Unlock()
+	stats := m.stickyStats
+	stats.Sessions = len(m.stickySessions)
+	if total := stats.Hits + stats.Misses + stats.Fallbacks; total > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// findAccount 从缓存中按 ID 查找账号
+func (m *AuthManager) findAccount(accountID string) *AccountInfo {
+	config := m.getAccountsFromCache()
+	if config == nil {
+		return nil
+	}
+	for i := range config.Accounts {
+		if config.Accounts[i].ID == accountID {
+			return &config.Accounts[i]
+		}
+	}
+	return nil
+}
+
 // GetCurrentAccountInfo 获取当前选中账号的信息（用于 debug header）
 // 注意：此方法会递增轮询索引，应该在实际发送请求前调用一次
 func (m *AuthManager) GetCurrentAccountInfo() (userId string, accountID string) {
@@ -541,7 +949,11 @@ func (m *AuthManager) RecordRequestResult(accountID string, success bool) {
 func (m *AuthManager) GetRegion() string {
 	// 从多账号中获取 region，不再依赖旧的单 Token 文件
 	account, err := m.selectAccount()
-	if err != nil || account == nil || account.Token == nil {
+	if err != nil || account == nil {
+		return "us-east-1"
+	}
+	m.ReleaseHalfOpenProbe(account.ID)
+	if account.Token == nil {
 		return "us-east-1"
 	}
 	if account.Token.Region == "" {
@@ -643,11 +1055,61 @@ func (m *AuthManager) GetAvailableModels() []Model {
 	return models
 }
 
-// generateMachineID 生成机器 ID
+// ========== 机器 ID ==========
+
+// 机器 ID 相关环境变量
+const (
+	// MachineIDEnv 直接指定机器 ID（优先级最高）
+	MachineIDEnv = "KIRO_MACHINE_ID"
+	// MachineIDSeedEnv 由种子派生机器 ID（多实例共用同一种子即呈现同一个客户端身份）
+	MachineIDSeedEnv = "KIRO_MACHINE_ID_SEED"
+	// MachineIDFileEnv 机器 ID 持久化文件路径（默认与 kiro-accounts.json 同目录）
+	MachineIDFileEnv = "KIRO_MACHINE_ID_FILE"
+)
+
+// machineIDFileName 持久化的机器 ID 文件名
+const machineIDFileName = "kiro-machine-id"
+
+// machineIDPath 持久化的机器 ID 文件路径：KIRO_MACHINE_ID_FILE 优先，否则放在账号配置文件旁边
+// 注意账号配置路径本身相对于工作目录，默认位置随启动目录变化；需要固定位置时设置 KIRO_MACHINE_ID_FILE
+func machineIDPath() string {
+	if path := strings.TrimSpace(os.Getenv(MachineIDFileEnv)); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(accountsConfigFile), machineIDFileName)
+}
+
+// generateMachineID 获取机器 ID（作为 KiroIDE User-Agent 的一部分发给上游）
+// 优先级：KIRO_MACHINE_ID > KIRO_MACHINE_ID_SEED > 持久化文件 > hostname 派生（并写入持久化文件）
+// 为什么要持久化：容器每次重启 hostname 都会变，直接用 hostname 派生会让上游看到一个"新设备"，
+// 可能触发风控；固定下来后重启前后呈现同一个客户端身份。
+// 代价：固定 ID 让上游可以把所有账号的请求关联到同一台机器，不希望被关联时应给不同部署配置不同的种子
 func generateMachineID() string {
+	if id := strings.TrimSpace(os.Getenv(MachineIDEnv)); id != "" {
+		return id
+	}
+	if seed := os.Getenv(MachineIDSeedEnv); seed != "" {
+		return deriveMachineID(seed)
+	}
+	path := machineIDPath()
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id
+		}
+	}
+
+	// 首次启动：沿用 hostname 派生，老部署升级后机器 ID 保持不变
 	hostname, _ := os.Hostname()
+	id := deriveMachineID(hostname)
+	// 写入失败只影响下次重启的稳定性，不影响本次使用
+	_ = os.WriteFile(path, []byte(id+"\n"), 0600)
+	return id
+}
+
+// deriveMachineID 由种子派生 32 位十六进制机器 ID
+func deriveMachineID(seed string) string {
 	h := sha256.New()
-	h.Write([]byte(hostname))
+	h.Write([]byte(seed))
 	return hex.EncodeToString(h.Sum(nil))[:32]
 }
 
@@ -808,47 +1270,17 @@ func (m *AuthManager) GetUsageLimits() (*UsageLimitsResponse, error) {
 	// 获取区域
 	region := m.GetRegion()
 
-	// 构建 URL（带查询参数）
-	// isEmailRequired=true 让 API 返回用户邮箱
-	url := fmt.Sprintf(
-		"https://q.%s.amazonaws.com/getUsageLimits?profileArn=%s&origin=AI_EDITOR&isEmailRequired=true",
-		region,
-		profileArn,
-	)
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("创建请求失败: %w", err)
-	}
-
-	// 设置请求头
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	req.Header.Set("Content-Type", "application/json")
-
-	// 发送请求
-	resp, err := m.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("发送请求失败: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// 检查响应状态
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API 请求失败 [%d]: %s", resp.StatusCode, string(bodyBytes))
-	}
-
-	// 解析响应
-	var usageResp UsageLimitsResponse
-	if err := json.NewDecoder(resp.Body).Decode(&usageResp); err != nil {
-		return nil, fmt.Errorf("解析响应失败: %w", err)
-	}
-
-	return &usageResp, nil
+	return m.fetchUsageLimitsWithRetry(context.Background(), accessToken, region, profileArn)
 }
 
 // GetUsageLimitsWithToken 使用指定 Token 和 profileArn 获取额度（用于多账号场景）
 func (m *AuthManager) GetUsageLimitsWithToken(accessToken, region, profileArn string) (*UsageLimitsResponse, error) {
+	return m.GetUsageLimitsWithTokenContext(context.Background(), accessToken, region, profileArn)
+}
+
+// GetUsageLimitsWithTokenContext 同 GetUsageLimitsWithToken，ctx 结束时放弃请求和重试等待
+// 管理接口传入请求的 context，上游故障时不会在重试退避上挂住
+func (m *AuthManager) GetUsageLimitsWithTokenContext(ctx context.Context, accessToken, region, profileArn string) (*UsageLimitsResponse, error) {
 	if region == "" {
 		region = "us-east-1"
 	}
@@ -861,13 +1293,63 @@ func (m *AuthManager) GetUsageLimitsWithToken(accessToken, region, profileArn st
 		return nil, fmt.Errorf("profileArn 不可用")
 	}
 
+	return m.fetchUsageLimitsWithRetry(ctx, accessToken, region, profileArn)
+}
+
+// usageLimitsRetryDelays 额度查询遇到瞬时错误时每次重试前的等待时间（次数即重试次数）
+// 为什么要重试：管理面板直接展示查询结果，一次网络抖动就会显示成 0 额度，让人误以为账号耗尽
+var usageLimitsRetryDelays = []time.Duration{300 * time.Millisecond, time.Second}
+
+// usageLimitsStatusError 额度接口返回非 200 状态码
+type usageLimitsStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *usageLimitsStatusError) Error() string {
+	return fmt.Sprintf("API 请求失败 [%d]: %s", e.StatusCode, e.Body)
+}
+
+// isTransientUsageError 是否为值得重试的瞬时错误：网络错误、429 和 5xx
+// 401/403 等说明 Token 或权限有问题，重试也不会成功
+func isTransientUsageError(err error) bool {
+	var statusErr *usageLimitsStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// fetchUsageLimitsWithRetry 查询额度，瞬时错误时按 usageLimitsRetryDelays 退避重试
+// ctx 结束时立即返回，不再等待下一次重试
+func (m *AuthManager) fetchUsageLimitsWithRetry(ctx context.Context, accessToken, region, profileArn string) (*UsageLimitsResponse, error) {
+	usage, err := m.fetchUsageLimits(ctx, accessToken, region, profileArn)
+	for _, delay := range usageLimitsRetryDelays {
+		if err == nil || !isTransientUsageError(err) || ctx.Err() != nil {
+			break
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		usage, err = m.fetchUsageLimits(ctx, accessToken, region, profileArn)
+	}
+	return usage, err
+}
+
+// fetchUsageLimits 单次请求 getUsageLimits 接口
+func (m *AuthManager) fetchUsageLimits(ctx context.Context, accessToken, region, profileArn string) (*UsageLimitsResponse, error) {
 	// isEmailRequired=true 让 API 返回用户邮箱
 	url := fmt.Sprintf(
 		"https://q.%s.amazonaws.com/getUsageLimits?profileArn=%s&origin=AI_EDITOR&isEmailRequired=true",
 		region, profileArn,
 	)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -882,7 +1364,7 @@ func (m *AuthManager) GetUsageLimitsWithToken(accessToken, region, profileArn st
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("API 请求失败 [%d]: %s", resp.StatusCode, string(bodyBytes))
+		return nil, &usageLimitsStatusError{StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	var usageResp UsageLimitsResponse
@@ -894,9 +1376,12 @@ func (m *AuthManager) GetUsageLimitsWithToken(accessToken, region, profileArn st
 
 // ========== AWS SSO OIDC 登录流程 ==========
 
-// 多账号配置文件路径（保存到项目根目录）
+// accountsConfigFile 多账号配置文件路径（保存到项目根目录）
+const accountsConfigFile = "./kiro-accounts.json"
+
+// 多账号配置文件路径
 func (m *AuthManager) getAccountsConfigPath() string {
-	return "./kiro-accounts.json"
+	return accountsConfigFile
 }
 
 // LoadAccountsConfigFromFile 强制从文件加载账号配置（绕过缓存）
@@ -1320,6 +1805,13 @@ func (m *AuthManager) SwitchAccount(accountID string) error {
 
 // RefreshAccountToken 刷新指定账号的 Token
 func (m *AuthManager) RefreshAccountToken(accountID string) error {
+	err := m.refreshAccountToken(accountID)
+	m.recordRefreshResult(accountID, err)
+	return err
+}
+
+// refreshAccountToken 刷新指定账号的 Token（不做失败计数）
+func (m *AuthManager) refreshAccountToken(accountID string) error {
 	config, err := m.LoadAccountsConfig()
 	if err != nil {
 		return fmt.Errorf("加载账号配置失败: %w", err)
@@ -1389,7 +1881,7 @@ func (m *AuthManager) RefreshAccountToken(accountID string) error {
 
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("刷新 Token 失败 [%d]: %s", resp.StatusCode, string(bodyBytes))
+		return &tokenRefreshStatusError{StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 
 	var refreshResp TokenRefreshResponse
@@ -1429,6 +1921,163 @@ func (m *AuthManager) RefreshAccountToken(accountID string) error {
 	return nil
 }
 
+// tokenRefreshStatusError OIDC 刷新接口返回非 200 状态码
+type tokenRefreshStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *tokenRefreshStatusError) Error() string {
+	return fmt.Sprintf("刷新 Token 失败 [%d]: %s", e.StatusCode, e.Body)
+}
+
+// isAuthRefreshError 是否为凭证失效类的刷新失败（400 invalid_grant、401、403）
+// 网络错误、429 和 5xx 是临时问题，不计入自动停用
+func isAuthRefreshError(err error) bool {
+	var statusErr *tokenRefreshStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden:
+		return true
+	}
+	return false
+}
+
+// ========== 认证失败自动停用 ==========
+
+// SetAuthFailureThreshold 设置连续认证失败多少次后自动停用账号（0=不自动停用）
+func (m *AuthManager) SetAuthFailureThreshold(n int) {
+	m.authFailureMu.Lock()
+	defer m.authFailureMu.Unlock()
+	m.authFailureThreshold = n
+}
+
+// recordRefreshResult 记录刷新结果：成功清零；凭证失效类失败累加，达到阈值时停用账号
+// 为什么：凭证被吊销后刷新永远失败，账号却一直被选中、反复报错
+func (m *AuthManager) recordRefreshResult(accountID string, err error) {
+	m.authFailureMu.Lock()
+	if err == nil {
+		delete(m.authFailures, accountID)
+		m.authFailureMu.Unlock()
+		return
+	}
+	if !isAuthRefreshError(err) {
+		m.authFailureMu.Unlock()
+		return
+	}
+	m.authFailures[accountID]++
+	failures := m.authFailures[accountID]
+	threshold := m.authFailureThreshold
+	m.authFailureMu.Unlock()
+
+	if threshold <= 0 || failures < threshold {
+		return
+	}
+	_ = m.setAccountDisabled(accountID, true, fmt.Sprintf("连续 %d 次刷新 Token 失败: %v", failures, err))
+}
+
+// GetAuthFailureCount 获取账号当前的连续认证失败次数
+func (m *AuthManager) GetAuthFailureCount(accountID string) int {
+	m.authFailureMu.Lock()
+	defer m.authFailureMu.Unlock()
+	return m.authFailures[accountID]
+}
+
+// EnableAccount 重新启用被停用的账号，并清零连续失败计数
+func (m *AuthManager) EnableAccount(accountID string) error {
+	if err := m.setAccountDisabled(accountID, false, ""); err != nil {
+		return err
+	}
+	m.authFailureMu.Lock()
+	delete(m.authFailures, accountID)
+	m.authFailureMu.Unlock()
+	return nil
+}
+
+// SetAccountReserved 设置账号是否预留给诊断探测（预留账号不参与正常请求选择）
+func (m *AuthManager) SetAccountReserved(accountID string, reserved bool) error {
+	config, err := m.LoadAccountsConfig()
+	if err != nil {
+		return fmt.Errorf("加载账号配置失败: %w", err)
+	}
+	for i := range config.Accounts {
+		acc := &config.Accounts[i]
+		if acc.ID != accountID {
+			continue
+		}
+		if acc.Reserved == reserved {
+			return nil
+		}
+		acc.Reserved = reserved
+		return m.SaveAccountsConfig(config)
+	}
+	return fmt.Errorf("账号不存在: %s", accountID)
+}
+
+// GetAccountWeight 获取账号配置的调度权重（未设置时为 1）
+func (m *AuthManager) GetAccountWeight(accountID string) (int, error) {
+	config, err := m.LoadAccountsConfig()
+	if err != nil {
+		return 0, fmt.Errorf("加载账号配置失败: %w", err)
+	}
+	for i := range config.Accounts {
+		if config.Accounts[i].ID == accountID {
+			return config.Accounts[i].EffectiveWeight(), nil
+		}
+	}
+	return 0, fmt.Errorf("账号不存在: %s", accountID)
+}
+
+// SetAccountWeight 设置账号的调度权重（1-MaxAccountWeight）并保存到账号配置文件
+func (m *AuthManager) SetAccountWeight(accountID string, weight int) error {
+	if weight < 1 || weight > MaxAccountWeight {
+		return fmt.Errorf("权重必须在 1-%d 之间，收到 %d", MaxAccountWeight, weight)
+	}
+	config, err := m.LoadAccountsConfig()
+	if err != nil {
+		return fmt.Errorf("加载账号配置失败: %w", err)
+	}
+	for i := range config.Accounts {
+		acc := &config.Accounts[i]
+		if acc.ID != accountID {
+			continue
+		}
+		if acc.EffectiveWeight() == weight {
+			return nil
+		}
+		acc.Weight = weight
+		return m.SaveAccountsConfig(config)
+	}
+	return fmt.Errorf("账号不存在: %s", accountID)
+}
+
+// setAccountDisabled 修改账号停用状态并保存
+func (m *AuthManager) setAccountDisabled(accountID string, disabled bool, reason string) error {
+	config, err := m.LoadAccountsConfig()
+	if err != nil {
+		return fmt.Errorf("加载账号配置失败: %w", err)
+	}
+	for i := range config.Accounts {
+		acc := &config.Accounts[i]
+		if acc.ID != accountID {
+			continue
+		}
+		if acc.Disabled == disabled && reason == "" {
+			return nil
+		}
+		acc.Disabled = disabled
+		acc.DisabledReason = reason
+		acc.DisabledAt = ""
+		if disabled {
+			acc.DisabledAt = time.Now().Format(time.RFC3339)
+		}
+		return m.SaveAccountsConfig(config)
+	}
+	return fmt.Errorf("账号不存在: %s", accountID)
+}
+
 // ========== 保活机制 ==========
 
 // StartKeepAlive 启动后台保活 goroutine
@@ -1490,7 +2139,8 @@ func (m *AuthManager) RefreshAllAccounts() {
 
 	// 遍历所有账号，检查并刷新即将过期的 Token
 	for _, acc := range config.Accounts {
-		if acc.Token == nil {
+		// 已停用的账号不再刷新，避免持续产生失败请求
+		if acc.Token == nil || acc.Disabled {
 			continue
 		}
 
@@ -1536,31 +2186,46 @@ func (m *AuthManager) isTokenExpiringSoon(token *KiroAuthToken, threshold time.D
 	return time.Until(expiresAt) < threshold
 }
 
-// ImportAccount 导入账号（支持企业 SSO Token）
-// tokenJSON: Token JSON 字符串（必需）
-// clientRegJSON: ClientRegistration JSON 字符串（企业 SSO 必需，个人账号可选）
-func (m *AuthManager) ImportAccount(tokenJSON, clientRegJSON string) (*AccountInfo, error) {
-	// 解析 Token
-	var token KiroAuthToken
+// parseImportToken 解析导入的 Token JSON 和 ClientRegistration JSON（可选）
+// ImportAccount 和 ValidateImportToken 共用，不产生任何副作用
+func parseImportToken(tokenJSON, clientRegJSON string) (token KiroAuthToken, clientID, clientSecret string, err error) {
 	if err := json.Unmarshal([]byte(tokenJSON), &token); err != nil {
-		return nil, fmt.Errorf("解析 Token 失败: %w", err)
+		return token, "", "", fmt.Errorf("解析 Token 失败: %w", err)
 	}
 
 	// 验证必要字段
 	if token.AccessToken == "" {
-		return nil, fmt.Errorf("Token 缺少 accessToken 字段")
+		return token, "", "", fmt.Errorf("Token 缺少 accessToken 字段")
 	}
 
 	// 解析 ClientRegistration（可选）
-	var clientID, clientSecret string
 	if clientRegJSON != "" {
 		var clientReg ClientRegistration
 		if err := json.Unmarshal([]byte(clientRegJSON), &clientReg); err != nil {
-			return nil, fmt.Errorf("解析 ClientRegistration 失败: %w", err)
+			return token, "", "", fmt.Errorf("解析 ClientRegistration 失败: %w", err)
 		}
 		clientID = clientReg.ClientID
 		clientSecret = clientReg.ClientSecret
 	}
+	return token, clientID, clientSecret, nil
+}
+
+// importTokenRegion 导入 Token 使用的 region（未指定时为 us-east-1）
+func importTokenRegion(token KiroAuthToken) string {
+	if token.Region == "" {
+		return "us-east-1"
+	}
+	return token.Region
+}
+
+// ImportAccount 导入账号（支持企业 SSO Token）
+// tokenJSON: Token JSON 字符串（必需）
+// clientRegJSON: ClientRegistration JSON 字符串（企业 SSO 必需，个人账号可选）
+func (m *AuthManager) ImportAccount(tokenJSON, clientRegJSON string) (*AccountInfo, error) {
+	token, clientID, clientSecret, err := parseImportToken(tokenJSON, clientRegJSON)
+	if err != nil {
+		return nil, err
+	}
 
 	// 生成账号 ID（使用 clientIdHash 或 accessToken 的 hash）
 	var accountID string
@@ -1585,10 +2250,7 @@ func (m *AuthManager) ImportAccount(tokenJSON, clientRegJSON string) (*AccountIn
 	}
 
 	// 获取 profileArn（导入时自动获取）
-	region := token.Region
-	if region == "" {
-		region = "us-east-1"
-	}
+	region := importTokenRegion(token)
 	profileArn, err := m.ListAvailableProfiles(token.AccessToken, region)
 	if err == nil {
 		account.ProfileArn = profileArn
@@ -1620,6 +2282,56 @@ func (m *AuthManager) ImportAccount(tokenJSON, clientRegJSON string) (*AccountIn
 	return account, nil
 }
 
+// TokenValidation 导入前校验 Token 的结果
+type TokenValidation struct {
+	Valid     bool   `json:"valid"`
+	Email     string `json:"email,omitempty"`
+	Region    string `json:"region"`
+	ExpiresAt string `json:"expiresAt"`
+	Expired   bool   `json:"expired"` // accessToken 已过期（有 refreshToken 时导入后会自动刷新，仍视为有效）
+	Error     string `json:"error,omitempty"`
+}
+
+// ValidateImportToken 校验待导入的 Token，不保存任何数据
+// 为什么：ImportAccount 解析后直接落盘，无效 Token 要到第一次使用才失败；导入前先校验可以立即给出反馈
+// probe 为 true 且 accessToken 未过期时，调用 ListAvailableProfiles + GetUsageLimits 确认 Token 可用并取回邮箱
+func (m *AuthManager) ValidateImportToken(tokenJSON, clientRegJSON string, probe bool) TokenValidation {
+	token, _, _, err := parseImportToken(tokenJSON, clientRegJSON)
+	if err != nil {
+		return TokenValidation{Error: err.Error()}
+	}
+
+	result := TokenValidation{
+		Region:    importTokenRegion(token),
+		ExpiresAt: token.ExpiresAt,
+		Expired:   token.IsExpired(),
+	}
+	if result.Expired && token.RefreshToken == "" {
+		result.Error = "Token 已过期且缺少 refreshToken"
+		return result
+	}
+	if !probe || result.Expired {
+		result.Valid = true
+		return result
+	}
+
+	profileArn, err := m.ListAvailableProfiles(token.AccessToken, result.Region)
+	if err != nil {
+		result.Error = fmt.Sprintf("获取 profileArn 失败: %v", err)
+		return result
+	}
+	usage, err := m.GetUsageLimitsWithToken(token.AccessToken, result.Region, profileArn)
+	if err != nil {
+		result.Error = fmt.Sprintf("查询额度失败: %v", err)
+		return result
+	}
+	result.Valid = true
+	if usage != nil {
+		result.Email = usage.UserInfo.Email
+	}
+	return result
+}
+
 // GetAccountsStatus 获取所有账号的状态（用于前端显示）
 func (m *AuthManager) GetAccountsStatus() ([]map[string]interface{}, error) {
 	config, err := m.LoadAccountsConfig()
@@ -1635,6 +2347,21 @@ func (m *AuthManager) GetAccountsStatus() ([]map[string]interface{}, error) {
 			"lastUsedAt": acc.LastUsedAt,
 		}
 
+		if until := m.quotaExhaustedUntil(acc.ID); !until.IsZero() {
+			status["quotaExhausted"] = true
+			status["quotaExhaustedUntil"] = until.Format(time.RFC3339)
+		}
+
+		if acc.Reserved {
+			status["reserved"] = true
+		}
+
+		if acc.Disabled {
+			status["disabled"] = true
+			status["disabledReason"] = acc.DisabledReason
+			status["disabledAt"] = acc.DisabledAt
+		}
+
 		if acc.Token != nil {
 			status["region"] = acc.Token.Region
 			status["expiresAt"] = acc.Token.ExpiresAt
@@ -1668,9 +2395,20 @@ func (m *AuthManager) IsAccountHalfOpen(accountID string) bool {
 
 // GetCircuitConfig 获取熔断器配置（供 server 包读取阈值）
 func (m *AuthManager) GetCircuitConfig() CircuitBreakerConfig {
+	m.circuitMu.RLock()
+	defer m.circuitMu.RUnlock()
 	return m.circuitConfig
 }
 
+// SetCircuitConfig 更新熔断器配置（由 server 层在加载/修改配置时调用）
+// 只影响之后的状态判断：已熔断的账号按新的 OpenDuration 计算何时进入半开，
+// 半开中的账号按新的 HalfOpenMaxSuccess 判断何时关闭
+func (m *AuthManager) SetCircuitConfig(cfg CircuitBreakerConfig) {
+	m.circuitMu.Lock()
+	defer m.circuitMu.Unlock()
+	m.circuitConfig = cfg
+}
+
 // TryAutoTrip 尝试自动熔断(原子操作,消除TOCTOU竞态)
 // 在持有锁的情况下检查状态并触发熔断,避免竞态条件
 // 返回: 是否触发了熔断
@@ -1722,6 +2460,7 @@ func (m *AuthManager) ManualTrip(accountID string) error {
 	// 无论当前什么状态，都设为 Open 并刷新时间
 	cb.State = CircuitOpen
 	cb.OpenedAt = time.Now()
+	cb.ProbesInFlight = 0
 	return nil
 }
 
@@ -1745,9 +2484,35 @@ func (m *AuthManager) ManualReset(accountID string) error {
 	cb.State = CircuitClosed
 	cb.FailureCount = 0
 	cb.SuccessCount = 0
+	cb.ProbesInFlight = 0
 	return nil
 }
 
+// ManualHalfOpen 手动把熔断中的账号推进到半开状态，返回操作后的状态
+// 为什么：ManualReset 会直接关闭熔断器，若上游仍未恢复会立刻再次熔断；
+// 半开只放行试探请求，由 recordSuccess/recordFailure 的正常逻辑决定关闭还是重新熔断
+// 只对 Open 状态生效：HalfOpen 幂等返回，Closed 保持不变（返回 CircuitClosed）
+func (m *AuthManager) ManualHalfOpen(accountID string) (CircuitState, error) {
+	if !m.accountExists(accountID) {
+		return CircuitClosed, fmt.Errorf("账号不存在: %s", accountID)
+	}
+
+	m.circuitMu.Lock()
+	defer m.circuitMu.Unlock()
+
+	cb, exists := m.circuitBreakers[accountID]
+	if !exists {
+		return CircuitClosed, nil
+	}
+	if cb.State == CircuitOpen {
+		cb.State = CircuitHalfOpen
+		cb.HalfOpenAt = time.Now()
+		cb.SuccessCount = 0
+		cb.ProbesInFlight = 0
+	}
+	return cb.State, nil
+}
+
 // GetCircuitBreakerStates 获取所有账号的熔断器状态副本
 // 返回深拷贝，避免外部修改导致竞态
 func (m *AuthManager) GetCircuitBreakerStates() map[string]CircuitBreaker {
@@ -1764,6 +2529,8 @@ func (m *AuthManager) GetCircuitBreakerStates() map[string]CircuitBreaker {
 			LastFailureTime: cb.LastFailureTime,
 			OpenedAt:        cb.OpenedAt,
 			HalfOpenAt:      cb.HalfOpenAt,
+			ProbesInFlight:  cb.ProbesInFlight,
+			LastProbeAt:     cb.LastProbeAt,
 		}
 	}
 	return result
@@ -1779,9 +2546,15 @@ func (m *AuthManager) GetLoadDistribution() []AccountLoadInfo {
 
 	// 第一遍：收集所有账号的权重
 	type entry struct {
-		id     string
-		email  string
-		weight int
+		id               string
+		email            string
+		weight           int
+		tokenExpired     bool
+		disabled         bool
+		reserved         bool
+		creditsExhausted bool
+		quotaUntil       time.Time
+		eligible         bool
 	}
 	entries := make([]entry, 0, len(config.Accounts))
 	totalWeight := 0
@@ -1789,14 +2562,22 @@ func (m *AuthManager) GetLoadDistribution() []AccountLoadInfo {
 	for i := range config.Accounts {
 		acc := &config.Accounts[i]
 		w := m.calculateWeight(acc)
-		// 熔断中的账号权重归零，与 selectAccount 的过滤逻辑保持一致
-		if !m.isAccountAvailable(acc.ID) {
+		// 熔断中、已停用、预留、上游报告额度耗尽的账号权重归零，与 selectAccount 的过滤逻辑保持一致
+		quotaUntil := m.quotaExhaustedUntil(acc.ID)
+		if !m.isAccountAvailable(acc.ID) || acc.Disabled || acc.Reserved || !quotaUntil.IsZero() {
 			w = 0
 		}
+		cache := m.getUsageCache(acc.ID)
 		entries = append(entries, entry{
-			id:     acc.ID,
-			email:  acc.Email,
-			weight: w,
+			id:               acc.ID,
+			email:            acc.Email,
+			weight:           w,
+			tokenExpired:     acc.Token == nil || acc.Token.IsExpired(),
+			disabled:         acc.Disabled,
+			reserved:         acc.Reserved,
+			creditsExhausted: cache != nil && cache.GetRemainingCredits() <= 0,
+			quotaUntil:       quotaUntil,
+			eligible:         w > 0 && m.isAccountSelectable(acc),
 		})
 		totalWeight += w
 	}
@@ -1813,6 +2594,15 @@ func (m *AuthManager) GetLoadDistribution() []AccountLoadInfo {
 			Email:     e.email,
 			Weight:    e.weight,
 			Percent:   pct,
+
+			TokenExpired:     e.tokenExpired,
+			Disabled:         e.disabled,
+			Reserved:         e.reserved,
+			CreditsExhausted: e.creditsExhausted,
+			Eligible:         e.eligible,
+		}
+		if !e.quotaUntil.IsZero() {
+			result[i].QuotaExhaustedUntil = e.quotaUntil.Format(time.RFC3339)
 		}
 	}
 
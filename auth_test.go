@@ -1,9 +1,18 @@
 package kiroclient
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -305,6 +314,53 @@ func TestManualReset_ClosedAccountIdempotent(t *testing.T) {
 	}
 }
 
+// TestManualHalfOpen_OpenToHalfOpen 熔断中的账号手动半开后放行试探请求，由试探结果决定关闭或重新熔断
+func TestManualHalfOpen_OpenToHalfOpen(t *testing.T) {
+	accountID := "half-open-account"
+	m := newTestAuthManager(accountID)
+	m.circuitConfig.HalfOpenMaxSuccess = 2
+
+	// Closed 账号不变
+	if state, err := m.ManualHalfOpen(accountID); err != nil || state != CircuitClosed {
+		t.Fatalf("Closed 账号应保持 Closed, 得到 %v, %v", state, err)
+	}
+
+	if err := m.ManualTrip(accountID); err != nil {
+		t.Fatalf("ManualTrip 失败: %v", err)
+	}
+	if m.isAccountAvailable(accountID) {
+		t.Fatal("熔断后应不可用")
+	}
+
+	state, err := m.ManualHalfOpen(accountID)
+	if err != nil || state != CircuitHalfOpen {
+		t.Fatalf("期望 HalfOpen, 得到 %v, %v", state, err)
+	}
+	if !m.isAccountAvailable(accountID) || !m.IsAccountHalfOpen(accountID) {
+		t.Fatal("半开后应放行试探请求")
+	}
+
+	// 试探失败：重新熔断
+	m.recordFailure(accountID)
+	if m.GetCircuitBreakerStates()[accountID].State != CircuitOpen {
+		t.Fatal("半开试探失败应重新熔断")
+	}
+
+	// 再次半开，连续成功达到阈值后关闭
+	if state, _ := m.ManualHalfOpen(accountID); state != CircuitHalfOpen {
+		t.Fatalf("期望 HalfOpen, 得到 %v", state)
+	}
+	m.recordSuccess(accountID)
+	m.recordSuccess(accountID)
+	if m.GetCircuitBreakerStates()[accountID].State != CircuitClosed {
+		t.Fatal("半开试探成功应关闭熔断器")
+	}
+
+	if _, err := m.ManualHalfOpen("non-existent-account"); err == nil {
+		t.Error("不存在的账号应返回错误")
+	}
+}
+
 // TestGetLoadDistribution_PercentSumApprox100 负载占比之和约等于 100%
 // **Validates: Requirements 2.3**
 func TestGetLoadDistribution_PercentSumApprox100(t *testing.T) {
@@ -559,3 +615,636 @@ func TestGetLastSelectedAccountInfo_NoSelection(t *testing.T) {
 		t.Errorf("未选择时 email 应为空，实际: %s", email)
 	}
 }
+
+// TestMain 把机器 ID 持久化文件指向临时目录
+// 为什么：每个 NewChatService 都会生成并落盘机器 ID，不重定向的话测试会在工作目录留下 kiro-machine-id
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kiroclient-test-")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv(MachineIDFileEnv, filepath.Join(dir, machineIDFileName))
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// TestMachineID_StableAcrossInstances 测试相同配置下两个 ChatService 的机器 ID 一致
+func TestMachineID_StableAcrossInstances(t *testing.T) {
+	machineIDFile := filepath.Join(t.TempDir(), machineIDFileName)
+	t.Setenv(MachineIDFileEnv, machineIDFile)
+
+	t.Run("种子派生", func(t *testing.T) {
+		t.Setenv(MachineIDSeedEnv, "deploy-a")
+		a := NewChatService(NewAuthManager())
+		b := NewChatService(NewAuthManager())
+		if a.machineID != b.machineID || a.machineID != deriveMachineID("deploy-a") {
+			t.Errorf("同一种子应得到相同机器 ID: %s vs %s", a.machineID, b.machineID)
+		}
+		if len(a.machineID) != 32 {
+			t.Errorf("机器 ID 长度应为 32, 得到 %d", len(a.machineID))
+		}
+	})
+
+	t.Run("环境变量直接指定", func(t *testing.T) {
+		t.Setenv(MachineIDSeedEnv, "deploy-a")
+		t.Setenv(MachineIDEnv, "fixed-machine-id")
+		if id := NewChatService(NewAuthManager()).machineID; id != "fixed-machine-id" {
+			t.Errorf("KIRO_MACHINE_ID 应优先于种子, 得到 %s", id)
+		}
+	})
+
+	t.Run("持久化文件", func(t *testing.T) {
+		a := NewChatService(NewAuthManager())
+		data, err := os.ReadFile(machineIDFile)
+		if err != nil {
+			t.Fatalf("首次生成后应写入持久化文件: %v", err)
+		}
+		if strings.TrimSpace(string(data)) != a.machineID {
+			t.Errorf("持久化内容与机器 ID 不一致: %q vs %q", data, a.machineID)
+		}
+
+		// 模拟重启后 hostname 变化：已持久化的 ID 不受影响
+		if err := os.WriteFile(machineIDFile, []byte("persisted-id\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		b := NewChatService(NewAuthManager())
+		c := NewChatService(NewAuthManager())
+		if b.machineID != "persisted-id" || c.machineID != b.machineID {
+			t.Errorf("应使用持久化的机器 ID, 得到 %s / %s", b.machineID, c.machineID)
+		}
+	})
+}
+
+// TestMachineIDPath 测试机器 ID 文件默认放在账号配置文件旁边，KIRO_MACHINE_ID_FILE 可覆盖
+func TestMachineIDPath(t *testing.T) {
+	t.Setenv(MachineIDFileEnv, "")
+	if got, want := machineIDPath(), filepath.Join(filepath.Dir(accountsConfigFile), machineIDFileName); got != want {
+		t.Errorf("默认路径应为 %s, 得到 %s", want, got)
+	}
+
+	custom := filepath.Join(t.TempDir(), "machine-id")
+	t.Setenv(MachineIDFileEnv, custom)
+	if got := machineIDPath(); got != custom {
+		t.Errorf("应使用 KIRO_MACHINE_ID_FILE 指定的路径 %s, 得到 %s", custom, got)
+	}
+	NewChatService(NewAuthManager())
+	if _, err := os.Stat(custom); err != nil {
+		t.Errorf("机器 ID 应写入指定路径: %v", err)
+	}
+}
+
+// TestCircuitConfig_ConfiguredRecovery 测试按配置的熔断时长进入半开、按配置的成功次数关闭熔断
+func TestCircuitConfig_ConfiguredRecovery(t *testing.T) {
+	accountID := "recovery-test-account"
+	m := newTestAuthManager(accountID)
+
+	cfg := m.GetCircuitConfig()
+	cfg.HalfOpenMaxSuccess = 3
+	cfg.OpenDuration = time.Minute
+	m.SetCircuitConfig(cfg)
+
+	if err := m.ManualTrip(accountID); err != nil {
+		t.Fatalf("ManualTrip 失败: %v", err)
+	}
+
+	// 熔断 30 秒：未到配置的 1 分钟，仍不可用
+	setOpenedAt := func(ago time.Duration) {
+		m.circuitMu.Lock()
+		m.circuitBreakers[accountID].OpenedAt = time.Now().Add(-ago)
+		m.circuitMu.Unlock()
+	}
+	setOpenedAt(30 * time.Second)
+	if m.isAccountAvailable(accountID) {
+		t.Fatal("未到熔断时长不应进入半开")
+	}
+
+	// 超过 1 分钟：进入半开
+	setOpenedAt(61 * time.Second)
+	if !m.isAccountAvailable(accountID) || !m.IsAccountHalfOpen(accountID) {
+		t.Fatal("超过熔断时长应进入半开")
+	}
+
+	// 前 2 次成功仍处于半开，第 3 次关闭
+	for i := 1; i <= 3; i++ {
+		m.recordSuccess(accountID)
+		halfOpen := m.IsAccountHalfOpen(accountID)
+		if i < 3 && !halfOpen {
+			t.Fatalf("第 %d 次成功后不应关闭熔断", i)
+		}
+		if i == 3 && halfOpen {
+			t.Fatal("达到成功阈值后应关闭熔断")
+		}
+	}
+	if state := m.GetCircuitBreakerStates()[accountID].State; state != CircuitClosed {
+		t.Errorf("期望 Closed, 得到 %d", state)
+	}
+
+	// 缩短熔断时长对已熔断的账号立即生效
+	_ = m.ManualTrip(accountID)
+	setOpenedAt(30 * time.Second)
+	cfg.OpenDuration = 20 * time.Second
+	m.SetCircuitConfig(cfg)
+	if !m.isAccountAvailable(accountID) {
+		t.Error("缩短熔断时长后应按新值进入半开")
+	}
+}
+
+// TestGetAccessTokenForSession_Sticky 测试同一会话固定账号、熔断时重新选择并统计命中率
+func TestGetAccessTokenForSession_Sticky(t *testing.T) {
+	m := newTestAuthManager("acc-a", "acc-b", "acc-c")
+
+	_, first, err := m.GetAccessTokenForSession("conv-1")
+	if err != nil {
+		t.Fatalf("选择账号失败: %v", err)
+	}
+	// 同一会话的后续轮次沿用同一账号，不受轮询影响
+	for i := 0; i < 5; i++ {
+		_, id, _ := m.GetAccessTokenForSession("conv-1")
+		if id != first {
+			t.Fatalf("第 %d 轮应沿用账号 %s, 得到 %s", i+2, first, id)
+		}
+		if last := m.GetLastSelectedAccountID(); last != first {
+			t.Errorf("命中时应更新最近选中账号, 得到 %s", last)
+		}
+	}
+
+	// 绑定账号熔断后重新选择，且后续轮次绑定到新账号
+	_ = m.ManualTrip(first)
+	_, second, err := m.GetAccessTokenForSession("conv-1")
+	if err != nil || second == first {
+		t.Fatalf("熔断后应重新选择账号: id=%s err=%v", second, err)
+	}
+	if _, id, _ := m.GetAccessTokenForSession("conv-1"); id != second {
+		t.Errorf("重新选择后应绑定到新账号 %s, 得到 %s", second, id)
+	}
+
+	// 空会话 key 走普通轮询，不计入统计
+	_, _, _ = m.GetAccessTokenForSession("")
+
+	stats := m.GetStickinessStats()
+	if stats.Hits != 6 || stats.Misses != 1 || stats.Fallbacks != 1 || stats.Sessions != 1 {
+		t.Errorf("统计错误: %+v", stats)
+	}
+	if stats.HitRate != 0.75 {
+		t.Errorf("期望命中率 0.75, 得到 %v", stats.HitRate)
+	}
+}
+
+// TestStickySessions_EvictLeastRecentlyUsed 测试绑定数达到上限后淘汰最久未使用的会话，而不是无限增长
+func TestStickySessions_EvictLeastRecentlyUsed(t *testing.T) {
+	m := NewAuthManager()
+	now := time.Now()
+	for i := 0; i < maxStickySessions; i++ {
+		m.bindStickySession(fmt.Sprintf("conv-%d", i), "acc-a", now)
+	}
+	// conv-0 最早绑定，刷新后变为最近使用，下一个被淘汰的是 conv-1
+	m.bindStickySession("conv-0", "acc-a", now)
+	m.bindStickySession("conv-new", "acc-b", now)
+
+	if len(m.stickySessions) != maxStickySessions || m.stickyLRU.Len() != maxStickySessions {
+		t.Fatalf("绑定数应保持在 %d, map=%d list=%d", maxStickySessions, len(m.stickySessions), m.stickyLRU.Len())
+	}
+	if _, ok := m.lookupStickySession("conv-1", now); ok {
+		t.Error("最久未使用的 conv-1 应被淘汰")
+	}
+	if id, ok := m.lookupStickySession("conv-0", now); !ok || id != "acc-a" {
+		t.Error("刷新过的 conv-0 应保留")
+	}
+	if id, ok := m.lookupStickySession("conv-new", now); !ok || id != "acc-b" {
+		t.Error("新绑定应保存")
+	}
+	// 过期的绑定在查找时删除
+	if _, ok := m.lookupStickySession("conv-2", now.Add(stickySessionTTL+time.Second)); ok {
+		t.Error("过期的绑定不应返回")
+	}
+	if _, exists := m.stickySessions["conv-2"]; exists {
+		t.Error("过期的绑定应被删除")
+	}
+}
+
+// usageTestTransport 把额度查询请求改写到本地 mock 服务
+type usageTestTransport struct {
+	target *url.URL
+}
+
+func (rt usageTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newUsageTestManager 返回指向 mock 额度接口的 AuthManager，并关闭重试等待
+func newUsageTestManager(t *testing.T, handler http.HandlerFunc) *AuthManager {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+
+	oldDelays := usageLimitsRetryDelays
+	usageLimitsRetryDelays = []time.Duration{0, 0}
+	t.Cleanup(func() { usageLimitsRetryDelays = oldDelays })
+
+	m := NewAuthManager()
+	m.httpClient = &http.Client{Transport: usageTestTransport{target: target}}
+	return m
+}
+
+// TestGetUsageLimitsWithToken_RetryTransient 瞬时错误（5xx）重试后成功
+func TestGetUsageLimitsWithToken_RetryTransient(t *testing.T) {
+	calls := 0
+	m := newUsageTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"usageBreakdownList":[{"resourceType":"CREDIT","currentUsageWithPrecision":12.5,"usageLimitWithPrecision":50}]}`))
+	})
+
+	usage, err := m.GetUsageLimitsWithToken("token", "us-east-1", "arn:test")
+	if err != nil {
+		t.Fatalf("重试后应成功: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("期望请求 2 次, 实际 %d", calls)
+	}
+	if len(usage.UsageBreakdownList) != 1 || usage.UsageBreakdownList[0].CurrentUsageWithPrecision != 12.5 {
+		t.Errorf("额度解析错误: %+v", usage)
+	}
+}
+
+// TestGetUsageLimitsWithToken_NoRetryOnAuthError 403 等非瞬时错误不重试，重试次数用尽后返回最后一次错误
+func TestGetUsageLimitsWithToken_NoRetryOnAuthError(t *testing.T) {
+	status := http.StatusForbidden
+	calls := 0
+	m := newUsageTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+	})
+
+	if _, err := m.GetUsageLimitsWithToken("token", "us-east-1", "arn:test"); err == nil || calls != 1 {
+		t.Errorf("403 应直接失败且不重试, calls=%d err=%v", calls, err)
+	}
+
+	status, calls = http.StatusTooManyRequests, 0
+	if _, err := m.GetUsageLimitsWithToken("token", "us-east-1", "arn:test"); err == nil || calls != 1+len(usageLimitsRetryDelays) {
+		t.Errorf("429 应重试到次数用尽, calls=%d err=%v", calls, err)
+	}
+}
+
+// TestGetUsageLimitsWithTokenContext_StopsOnCancel context 结束后不再等待重试退避，立即返回
+func TestGetUsageLimitsWithTokenContext_StopsOnCancel(t *testing.T) {
+	var calls atomic.Int32
+	m := newUsageTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	usageLimitsRetryDelays = []time.Duration{time.Second, time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := m.GetUsageLimitsWithTokenContext(ctx, "token", "us-east-1", "arn:test")
+	if err == nil {
+		t.Fatal("上游持续 503 时应返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("context 超时后应立即返回, 实际耗时 %v", elapsed)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("context 结束后不应再重试, 请求 %d 次", n)
+	}
+}
+
+// TestValidateImportToken 导入前校验：解析错误、过期、探测成功/失败，且不写入账号
+func TestValidateImportToken(t *testing.T) {
+	probeStatus := http.StatusOK
+	m := newUsageTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/ListAvailableProfiles") {
+			_, _ = w.Write([]byte(`{"profiles":[{"arn":"arn:test","name":"default"}]}`))
+			return
+		}
+		w.WriteHeader(probeStatus)
+		_, _ = w.Write([]byte(`{"userInfo":{"email":"user@example.com","userId":"u-1"}}`))
+	})
+
+	valid := `{"accessToken":"access-token","refreshToken":"refresh-token","expiresAt":"2099-12-31T23:59:59Z","region":"us-west-2"}`
+
+	tests := []struct {
+		name      string
+		tokenJSON string
+		clientReg string
+		probe     bool
+		wantValid bool
+		wantEmail string
+	}{
+		{name: "JSON 错误", tokenJSON: `{`},
+		{name: "缺少 accessToken", tokenJSON: `{"refreshToken":"r"}`},
+		{name: "ClientRegistration 错误", tokenJSON: valid, clientReg: `{`},
+		{name: "过期且无 refreshToken", tokenJSON: `{"accessToken":"a","expiresAt":"2000-01-01T00:00:00Z"}`},
+		{name: "过期但可刷新", tokenJSON: `{"accessToken":"a","refreshToken":"r","expiresAt":"2000-01-01T00:00:00Z"}`, probe: true, wantValid: true},
+		{name: "不探测", tokenJSON: valid, wantValid: true},
+		{name: "探测成功", tokenJSON: valid, probe: true, wantValid: true, wantEmail: "user@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := m.ValidateImportToken(tt.tokenJSON, tt.clientReg, tt.probe)
+			if got.Valid != tt.wantValid || got.Email != tt.wantEmail {
+				t.Errorf("期望 valid=%v email=%q, 得到 %+v", tt.wantValid, tt.wantEmail, got)
+			}
+			if !got.Valid && got.Error == "" {
+				t.Error("无效时应返回错误原因")
+			}
+		})
+	}
+
+	if got := m.ValidateImportToken(valid, "", false); got.Region != "us-west-2" || got.ExpiresAt != "2099-12-31T23:59:59Z" {
+		t.Errorf("region/expiresAt 错误: %+v", got)
+	}
+
+	probeStatus = http.StatusForbidden
+	if got := m.ValidateImportToken(valid, "", true); got.Valid || got.Error == "" {
+		t.Errorf("探测失败应返回无效: %+v", got)
+	}
+
+	if m.accountsCache != nil {
+		t.Error("校验不应写入账号")
+	}
+}
+
+// TestAutoDisableAfterAuthFailures 连续刷新失败（400）达到阈值后自动停用，手动启用后恢复
+func TestAutoDisableAfterAuthFailures(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("切换工作目录失败: %v", err)
+	}
+	defer func() { _ = os.Chdir(oldWd) }()
+
+	calls := 0
+	m := newUsageTestManager(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+	})
+	m.SetAuthFailureThreshold(3)
+
+	config := &AccountsConfig{Accounts: []AccountInfo{{
+		ID:           "acc-revoked",
+		ClientID:     "cid",
+		ClientSecret: "secret",
+		Token: &KiroAuthToken{
+			AccessToken:  "token",
+			RefreshToken: "refresh",
+			ExpiresAt:    time.Now().Add(time.Hour).Format(time.RFC3339),
+		},
+	}}}
+	if err := m.SaveAccountsConfig(config); err != nil {
+		t.Fatalf("保存账号配置失败: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if err := m.RefreshAccountToken("acc-revoked"); err == nil {
+			t.Fatalf("第 %d 次刷新应失败", i)
+		}
+		disabled := accountDisabledForTest(t, m, "acc-revoked")
+		if i < 3 && disabled {
+			t.Fatalf("第 %d 次失败后不应停用", i)
+		}
+		if i == 3 && !disabled {
+			t.Fatal("连续 3 次失败后应自动停用")
+		}
+	}
+	if calls != 3 {
+		t.Errorf("期望请求 3 次, 实际 %d", calls)
+	}
+
+	// 停用状态已持久化到文件
+	fromFile, err := m.LoadAccountsConfigFromFile()
+	if err != nil || len(fromFile.Accounts) != 1 || !fromFile.Accounts[0].Disabled || fromFile.Accounts[0].DisabledReason == "" {
+		t.Fatalf("停用状态应写入账号文件: %+v, err=%v", fromFile, err)
+	}
+	if m.isAccountSelectable(&fromFile.Accounts[0]) {
+		t.Error("已停用的账号不应参与选择")
+	}
+	if dist := m.GetLoadDistribution(); len(dist) != 1 || !dist[0].Disabled || dist[0].Weight != 0 {
+		t.Errorf("负载分布中已停用账号权重应为 0: %+v", dist)
+	}
+
+	if err := m.EnableAccount("acc-revoked"); err != nil {
+		t.Fatalf("启用失败: %v", err)
+	}
+	if accountDisabledForTest(t, m, "acc-revoked") || m.GetAuthFailureCount("acc-revoked") != 0 {
+		t.Error("启用后应清除停用状态和失败计数")
+	}
+	if err := m.EnableAccount("missing"); err == nil {
+		t.Error("启用不存在的账号应返回错误")
+	}
+}
+
+// TestAutoDisable_IgnoresTransientErrors 5xx 等临时错误不计入连续失败
+func TestAutoDisable_IgnoresTransientErrors(t *testing.T) {
+	m := NewAuthManager()
+	m.SetAuthFailureThreshold(1)
+	m.recordRefreshResult("acc", &tokenRefreshStatusError{StatusCode: http.StatusServiceUnavailable})
+	m.recordRefreshResult("acc", fmt.Errorf("发送请求失败: timeout"))
+	if n := m.GetAuthFailureCount("acc"); n != 0 {
+		t.Errorf("临时错误不应计数, 得到 %d", n)
+	}
+}
+
+// accountDisabledForTest 从缓存读取账号的停用状态
+func accountDisabledForTest(t *testing.T, m *AuthManager, accountID string) bool {
+	t.Helper()
+	config, err := m.LoadAccountsConfig()
+	if err != nil {
+		t.Fatalf("加载账号配置失败: %v", err)
+	}
+	for _, acc := range config.Accounts {
+		if acc.ID == accountID {
+			return acc.Disabled
+		}
+	}
+	t.Fatalf("账号不存在: %s", accountID)
+	return false
+}
+
+// TestMarkQuotaExhausted_UntilNextReset 额度耗尽标记到下个重置日，未知或已过期时按兜底时长，到期后恢复
+func TestMarkQuotaExhausted_UntilNextReset(t *testing.T) {
+	m := NewAuthManager()
+	acc := &AccountInfo{ID: "acc", Token: &KiroAuthToken{AccessToken: "t", ExpiresAt: time.Now().Add(time.Hour).Format(time.RFC3339)}}
+
+	reset := time.Now().Add(72 * time.Hour).Truncate(time.Second)
+	m.RecordUsageLimits("acc", &UsageLimitsResponse{
+		NextDateReset:      float64(reset.Unix()),
+		UsageBreakdownList: []UsageBreakdown{{ResourceType: "CREDIT", CurrentUsageWithPrecision: 10, UsageLimitWithPrecision: 50}},
+	})
+	m.MarkQuotaExhausted("acc")
+	if got := m.GetQuotaExhaustions()["acc"].Until; !got.Equal(reset) {
+		t.Errorf("应标记到下个重置日 %v, 得到 %v", reset, got)
+	}
+	if m.isAccountSelectable(acc) {
+		t.Error("额度耗尽的账号不应被选中")
+	}
+
+	// 没有重置时间：按兜底时长；到期后自动恢复
+	oldFallback := quotaExhaustedFallback
+	quotaExhaustedFallback = -time.Second
+	defer func() { quotaExhaustedFallback = oldFallback }()
+	m.MarkQuotaExhausted("other")
+	if q := m.GetQuotaExhaustions()["other"]; q.Hits != 1 || !m.quotaExhaustedUntil("other").IsZero() {
+		t.Errorf("标记到期后应恢复可选: %+v", q)
+	}
+
+	if !IsQuotaExhaustedError(fmt.Errorf("请求失败 [429]: {\"reason\":\"MONTHLY_REQUEST_COUNT\"}")) || IsQuotaExhaustedError(fmt.Errorf("请求失败 [429]: INSUFFICIENT_MODEL_CAPACITY")) {
+		t.Error("IsQuotaExhaustedError 分类错误")
+	}
+}
+
+// TestReservedAccounts_Selection 预留账号不参与正常选择；未配置预留账号时诊断退回正常账号池
+func TestReservedAccounts_Selection(t *testing.T) {
+	m := NewAuthManager()
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	m.SetAccountsCacheForTest(&AccountsConfig{Accounts: []AccountInfo{
+		{ID: "prod", Token: &KiroAuthToken{AccessToken: "p", ExpiresAt: expiresAt}},
+	}})
+	if _, id, err := m.GetReservedAccessToken(); err != nil || id != "prod" {
+		t.Errorf("未配置预留账号时应退回正常账号池, 得到 %s, %v", id, err)
+	}
+
+	m.SetAccountsCacheForTest(&AccountsConfig{Accounts: []AccountInfo{
+		{ID: "prod", Token: &KiroAuthToken{AccessToken: "p", ExpiresAt: expiresAt}},
+		{ID: "probe", Reserved: true, Token: &KiroAuthToken{AccessToken: "r", ExpiresAt: time.Now().Add(-time.Hour).Format(time.RFC3339)}},
+	}})
+	for i := 0; i < 5; i++ {
+		if acc, err := m.selectAccount(); err != nil || acc.ID != "prod" {
+			t.Fatalf("正常选择不应选中预留账号: %v, %v", acc, err)
+		}
+	}
+	// 预留账号全部不可用时报错，而不是占用生产账号
+	if _, _, err := m.GetReservedAccessToken(); err == nil {
+		t.Error("预留账号不可用时应返回错误")
+	}
+}
+
+// TestWeightedSelection_Distribution 配置的调度权重按比例分配请求，设置后持久化到账号文件
+func TestWeightedSelection_Distribution(t *testing.T) {
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("切换工作目录失败: %v", err)
+	}
+	defer func() { _ = os.Chdir(oldWd) }()
+
+	m := newTestAuthManager("w1", "w2", "w3")
+	for id, weight := range map[string]int{"w2": 2, "w3": 3} {
+		if err := m.SetAccountWeight(id, weight); err != nil {
+			t.Fatalf("设置权重失败: %v", err)
+		}
+	}
+
+	counts := make(map[string]int)
+	const total = 1000
+	for i := 0; i < total; i++ {
+		acc, err := m.selectAccount()
+		if err != nil {
+			t.Fatalf("选择账号失败: %v", err)
+		}
+		counts[acc.ID]++
+	}
+	for id, weight := range map[string]int{"w1": 1, "w2": 2, "w3": 3} {
+		want := float64(total) * float64(weight) / 6
+		if got := float64(counts[id]); got < want*0.95 || got > want*1.05 {
+			t.Errorf("账号 %s 权重 %d 期望约 %.0f 次, 实际 %d", id, weight, want, counts[id])
+		}
+	}
+
+	fromFile, err := m.LoadAccountsConfigFromFile()
+	if err != nil || len(fromFile.Accounts) != 3 || fromFile.Accounts[2].Weight != 3 {
+		t.Fatalf("权重应写入账号文件: %+v, err=%v", fromFile, err)
+	}
+	if w, _ := m.GetAccountWeight("w1"); w != 1 {
+		t.Errorf("未设置权重的账号应按 1 处理, 得到 %d", w)
+	}
+	if err := m.SetAccountWeight("w1", 0); err == nil {
+		t.Error("权重 0 应被拒绝")
+	}
+	if err := m.SetAccountWeight("missing", 2); err == nil {
+		t.Error("设置不存在账号的权重应返回错误")
+	}
+}
+
+// TestHalfOpenProbes_ConcurrentLimit 半开账号只放行 HalfOpenMaxProbes 个并发试探请求，释放后空出名额
+func TestHalfOpenProbes_ConcurrentLimit(t *testing.T) {
+	const probes = 2
+	m := newTestAuthManager("half-open")
+	cfg := DefaultCircuitBreakerConfig
+	cfg.HalfOpenMaxProbes = probes
+	m.SetCircuitConfig(cfg)
+	if err := m.ManualTrip("half-open"); err != nil {
+		t.Fatalf("熔断失败: %v", err)
+	}
+	if state, _ := m.ManualHalfOpen("half-open"); state != CircuitHalfOpen {
+		t.Fatalf("期望半开状态, 得到 %v", state)
+	}
+
+	var passed atomic.Int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, _, err := m.GetAccessTokenWithAccountID(); err == nil {
+				passed.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if got := passed.Load(); got != probes {
+		t.Fatalf("半开账号应只放行 %d 个试探请求, 实际 %d", probes, got)
+	}
+	if got := m.GetCircuitBreakerStates()["half-open"].ProbesInFlight; got != probes {
+		t.Errorf("进行中的试探请求应为 %d, 得到 %d", probes, got)
+	}
+
+	// 释放后空出一个名额
+	m.ReleaseHalfOpenProbe("half-open")
+	if _, _, err := m.GetAccessTokenWithAccountID(); err != nil {
+		t.Errorf("释放名额后应可再放行一个试探请求: %v", err)
+	}
+	if _, _, err := m.GetAccessTokenWithAccountID(); err == nil {
+		t.Error("名额已满时应视同熔断")
+	}
+
+	// 长时间未回报结果的名额会被回收
+	m.circuitMu.Lock()
+	m.circuitBreakers["half-open"].LastProbeAt = time.Now().Add(-halfOpenProbeTimeout - time.Second)
+	m.circuitMu.Unlock()
+	if !m.IsAccountAvailable("half-open") {
+		t.Error("超时未回报的试探名额应被回收")
+	}
+}
+
+// TestHalfOpenProbes_RedirectToOtherAccounts 半开账号名额占满时请求落到其他账号
+func TestHalfOpenProbes_RedirectToOtherAccounts(t *testing.T) {
+	m := newTestAuthManager("probe-acc", "healthy-acc")
+	_ = m.ManualTrip("probe-acc")
+	_, _ = m.ManualHalfOpen("probe-acc")
+
+	counts := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		_, id, err := m.GetAccessTokenWithAccountID()
+		if err != nil {
+			t.Fatalf("有健康账号时不应失败: %v", err)
+		}
+		counts[id]++
+	}
+	if counts["probe-acc"] != 1 || counts["healthy-acc"] != 19 {
+		t.Errorf("未回报结果前半开账号只应承接 1 个试探请求: %v", counts)
+	}
+}
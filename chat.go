@@ -1,11 +1,16 @@
 package kiroclient
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -30,6 +35,137 @@ type TraceLogger interface {
 // 当消息中包含 OneDayAI_Start_Debug 关键字时，设置为 true
 const DebugModeKey = "debugMode"
 
+// ToolInputDeltaKey context key，用于开启 tool_use input 的增量回调
+// 开启后 toolUseEvent 的每个字符串片段都会以 IsPartial=true 的 KiroToolUse 回调出去，
+// 未开启时保持原行为（只在工具调用完成时回调一次），非流式调用方无需感知
+const ToolInputDeltaKey = "toolInputDelta"
+
+// isToolInputDeltaEnabled 判断当前请求是否开启了 tool_use input 增量回调
+func isToolInputDeltaEnabled(ctx context.Context) bool {
+	if v, ok := ctx.Value(ToolInputDeltaKey).(bool); ok {
+		return v
+	}
+	return false
+}
+
+// AuxiliaryEventTypes 会被转成文本（🔗/📚/💡 等）注入输出的辅助事件类型
+// 只有这些类型可以关闭转发，正文、thinking、工具调用等事件始终处理
+var AuxiliaryEventTypes = []string{
+	"supplementaryWebLinksEvent",
+	"codeReferenceEvent",
+	"followupPromptEvent",
+	"citationEvent",
+	"contextUsageEvent",
+	"invalidStateEvent",
+}
+
+// IsAuxiliaryEventType 判断事件类型是否为可关闭转发的辅助事件
+func IsAuxiliaryEventType(eventType string) bool {
+	for _, t := range AuxiliaryEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// isEventForwarded 判断事件是否需要转发给客户端
+func isEventForwarded(forwarded map[string]bool, eventType string) bool {
+	if !IsAuxiliaryEventType(eventType) {
+		return true
+	}
+	enabled, ok := forwarded[eventType]
+	return !ok || enabled
+}
+
+// DefaultAgentMode 未配置时发往 Kiro 的 x-amzn-kiro-agent-mode
+const DefaultAgentMode = "chat"
+
+// ResolveAgentMode 返回实际生效的 agent mode（空值回落到 DefaultAgentMode）
+func ResolveAgentMode(mode string) string {
+	if mode = strings.TrimSpace(mode); mode != "" {
+		return mode
+	}
+	return DefaultAgentMode
+}
+
+// protectedUpstreamHeaders 不允许通过 UpstreamHeaders 覆盖的请求头（小写）
+// 为什么：鉴权、请求体格式和 EventStream 解析都依赖这些 header，被覆盖会导致请求失败或账号串用
+var protectedUpstreamHeaders = map[string]bool{
+	"authorization":  true,
+	"content-type":   true,
+	"content-length": true,
+	"host":           true,
+	"accept":         true,
+}
+
+// IsProtectedUpstreamHeader 判断 header 是否受保护（大小写不敏感）
+func IsProtectedUpstreamHeader(name string) bool {
+	return protectedUpstreamHeaders[strings.ToLower(strings.TrimSpace(name))]
+}
+
+// applyUpstreamHeaders 把配置的自定义 header 合并到上游请求，跳过受保护的 header
+func applyUpstreamHeaders(req *http.Request, headers map[string]string) {
+	for name, value := range headers {
+		if name == "" || IsProtectedUpstreamHeader(name) {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+}
+
+// SessionKeyKey context key，携带会话 key 用于账号粘性选择
+// 为空或未设置时每次请求独立轮询账号
+const SessionKeyKey = "sessionKey"
+
+// sessionKeyFromContext 读取会话 key（未设置时返回空字符串）
+func sessionKeyFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(SessionKeyKey).(string)
+	return v
+}
+
+// ReservedAccountsKey context key，为 true 时从预留账号中选择（自检诊断等运维探测）
+const ReservedAccountsKey = "reservedAccounts"
+
+// useReservedAccounts 判断请求是否使用预留账号
+func useReservedAccounts(ctx context.Context) bool {
+	v, _ := ctx.Value(ReservedAccountsKey).(bool)
+	return v
+}
+
+// PinnedAccountKey context key，值为账号 ID：只使用该账号处理请求，不可用时返回错误而不是回落到负载均衡
+// 用于排查单个账号的问题；空响应重试时同样沿用该账号
+const PinnedAccountKey = "pinnedAccount"
+
+// pinnedAccountFromContext 读取固定的账号 ID（未设置时返回空字符串）
+func pinnedAccountFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(PinnedAccountKey).(string)
+	return v
+}
+
+// AccountObserverKey context key，值为 func(accountID string)，每次选中账号后回调（换账号重试时会回调多次）
+// server 用它在请求进行中就展示处理账号，而不必等到上游调用返回
+const AccountObserverKey = "accountObserver"
+
+// notifyAccountSelected 回调 AccountObserverKey（未设置时不做任何事）
+func notifyAccountSelected(ctx context.Context, accountID string) {
+	if observe, ok := ctx.Value(AccountObserverKey).(func(string)); ok && accountID != "" {
+		observe(accountID)
+	}
+}
+
+// ReasoningTokensObserverKey context key，值为 func(reasoningTokens int)，reasoning token 累计值变化时回调
+// 每个 reasoningContentEvent 后回调本地估算的累计值，messageMetadataEvent 带精确值时再回调一次校正，
+// server 用它在流式响应中增量展示推理消耗
+const ReasoningTokensObserverKey = "reasoningTokensObserver"
+
+// notifyReasoningTokens 回调 ReasoningTokensObserverKey（未设置时不做任何事）
+func notifyReasoningTokens(ctx context.Context, reasoningTokens int) {
+	if observe, ok := ctx.Value(ReasoningTokensObserverKey).(func(int)); ok {
+		observe(reasoningTokens)
+	}
+}
+
 // IsDebugMode 从 context 中判断是否开启了 debug 模式
 // 导出给 server 包使用
 func IsDebugMode(ctx context.Context) bool {
@@ -680,11 +816,13 @@ type ChatMessage struct {
 
 // ChatService 聊天服务
 type ChatService struct {
-	authManager *AuthManager
-	httpClient  *http.Client
-	machineID   string
-	version     string
-	logger      TraceLogger // 链路日志（可选，由 server 层注入）
+	authManager  *AuthManager
+	httpClient   *http.Client
+	machineID    string
+	version      string
+	logger       TraceLogger          // 链路日志（可选，由 server 层注入）
+	eventStats   eventTypeCounter     // EventStream 事件类型计数
+	payloadStats payloadSizeHistogram // 上游请求体大小分布
 }
 
 // NewChatService 创建聊天服务
@@ -693,7 +831,7 @@ type ChatService struct {
 func NewChatService(authManager *AuthManager) *ChatService {
 	return &ChatService{
 		authManager: authManager,
-		httpClient:  &http.Client{Timeout: 120 * time.Second},
+		httpClient:  &http.Client{}, // 不设整体超时：每次上游调用的超时由 context 控制，可按模型配置（见 upstreamTimeout）
 		machineID:   generateMachineID(),
 		version:     "0.8.140",
 	}
@@ -736,10 +874,15 @@ func generateConversationID() string {
 //  8. service temporarily unavailable - 服务临时不可用（503）
 //  9. 502 Bad Gateway - 网关错误
 //  10. unexpected error - 服务端未捕获异常
+//
+// C. 账号额度耗尽（IsQuotaExhaustedError）：账号级状态而非故障，由 MarkQuotaExhausted 单独处理
 func IsNonCircuitBreakingError(err error) bool {
 	if err == nil {
 		return false
 	}
+	if IsQuotaExhaustedError(err) {
+		return true
+	}
 	msg := err.Error()
 
 	// A. 客户端问题
@@ -782,6 +925,128 @@ func IsNonCircuitBreakingError(err error) bool {
 	return false
 }
 
+// quotaExhaustedReasons Kiro 额度耗尽时错误响应中的 reason
+var quotaExhaustedReasons = []string{
+	"MONTHLY_REQUEST_COUNT",
+	"OVERAGE_REQUEST_LIMIT_EXCEEDED",
+	"INSUFFICIENT_CREDITS",
+}
+
+// IsQuotaExhaustedError 判断是否为账号额度耗尽（402 或额度类 reason）
+// 为什么单独分类：额度耗尽要到下个重置日才恢复，按普通失败处理会触发熔断、半开后又被反复选中
+func IsQuotaExhaustedError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "请求失败 [402]") {
+		return true
+	}
+	for _, reason := range quotaExhaustedReasons {
+		if strings.Contains(msg, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsImproperlyFormedRequestError 判断是否为 Kiro 返回的请求格式错误
+// 这类错误说明我们构造的 conversationState 不合法（或客户端请求本身有问题），不是服务端故障
+func IsImproperlyFormedRequestError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), "Improperly formed request")
+}
+
+// describeConversationState 提取发给 Kiro 的 conversationState 结构摘要，用于排查请求格式错误
+// 只记录数量、长度和角色顺序，不记录任何消息内容、图片数据和工具参数
+func describeConversationState(body []byte) map[string]any {
+	var req struct {
+		ConversationState struct {
+			ConversationID  string           `json:"conversationId"`
+			ChatTriggerType string           `json:"chatTriggerType"`
+			CurrentMessage  map[string]any   `json:"currentMessage"`
+			History         []map[string]any `json:"history"`
+		} `json:"conversationState"`
+	}
+	info := map[string]any{"bodyBytes": len(body)}
+	if err := json.Unmarshal(body, &req); err != nil {
+		info["parseError"] = err.Error()
+		return info
+	}
+	state := req.ConversationState
+
+	// 角色顺序：U=userInputMessage，A=assistantResponseMessage，?=其他
+	// 为什么：连续同角色、以 assistant 开头等顺序问题是最常见的格式错误来源
+	var roles strings.Builder
+	emptyContent, historyImages, historyToolUses, historyToolResults := 0, 0, 0, 0
+	totalContentLen, maxContentLen := 0, 0
+	for _, entry := range state.History {
+		var msg map[string]any
+		if m, ok := entry["userInputMessage"].(map[string]any); ok {
+			roles.WriteByte('U')
+			msg = m
+		} else if m, ok := entry["assistantResponseMessage"].(map[string]any); ok {
+			roles.WriteByte('A')
+			msg = m
+		} else {
+			roles.WriteByte('?')
+			continue
+		}
+		content, _ := msg["content"].(string)
+		if content == "" {
+			emptyContent++
+		}
+		totalContentLen += len(content)
+		if len(content) > maxContentLen {
+			maxContentLen = len(content)
+		}
+		historyImages += jsonArrayLen(msg["images"])
+		historyToolUses += jsonArrayLen(msg["toolUses"])
+		if msgCtx, ok := msg["userInputMessageContext"].(map[string]any); ok {
+			historyToolResults += jsonArrayLen(msgCtx["toolResults"])
+		}
+	}
+
+	info["conversationId"] = state.ConversationID
+	info["chatTriggerType"] = state.ChatTriggerType
+	info["historyCount"] = len(state.History)
+	info["historyRoles"] = roles.String()
+	info["historyEmptyContent"] = emptyContent
+	info["historyContentLen"] = totalContentLen
+	info["historyMaxContentLen"] = maxContentLen
+	info["historyImages"] = historyImages
+	info["historyToolUses"] = historyToolUses
+	info["historyToolResults"] = historyToolResults
+
+	current, _ := state.CurrentMessage["userInputMessage"].(map[string]any)
+	info["hasCurrentMessage"] = current != nil
+	if current != nil {
+		content, _ := current["content"].(string)
+		info["currentContentLen"] = len(content)
+		info["currentModelId"] = current["modelId"]
+		info["currentOrigin"] = current["origin"]
+		info["currentImages"] = jsonArrayLen(current["images"])
+		if msgCtx, ok := current["userInputMessageContext"].(map[string]any); ok {
+			info["currentTools"] = jsonArrayLen(msgCtx["tools"])
+			info["currentToolResults"] = jsonArrayLen(msgCtx["toolResults"])
+			if tools, err := json.Marshal(msgCtx["tools"]); err == nil {
+				info["currentToolsBytes"] = len(tools)
+			}
+		}
+	}
+	return info
+}
+
+// jsonArrayLen 返回 JSON 解码后数组的长度，非数组返回 0
+func jsonArrayLen(v any) int {
+	if arr, ok := v.([]any); ok {
+		return len(arr)
+	}
+	return 0
+}
+
 // IsErrorLog 观测日志
 func IsErrorLog(err error) bool {
 	if err == nil {
@@ -806,26 +1071,261 @@ func toJSONString(v interface{}) string {
 	return string(data)
 }
 
+// ========== 账号选择与重试 ==========
+
+// accountExclusion 重试时不再使用的账号
+type accountExclusion struct {
+	ids []string
+	// strict 为 true 时（失败换账号）没有其他可用账号直接返回错误；否则（空响应重试）按常规选择
+	strict bool
+}
+
+// acquireToken 选择本次请求使用的账号
+// exclude.ids 非空时优先换一个账号，没有其他可用账号时按 exclude.strict 决定失败还是按常规选择
+func (s *ChatService) acquireToken(ctx context.Context, exclude accountExclusion) (string, string, error) {
+	if accountID := pinnedAccountFromContext(ctx); accountID != "" {
+		return s.authManager.GetAccessTokenForAccount(accountID)
+	}
+	if useReservedAccounts(ctx) {
+		return s.authManager.GetReservedAccessToken()
+	}
+
+	if len(exclude.ids) > 0 {
+		token, accountID, err := s.authManager.GetAccessTokenExcluding(exclude.ids...)
+		if err == nil || exclude.strict {
+			return token, accountID, err
+		}
+	}
+
+	// 使用带账号ID的方法，便于熔断器追踪；携带会话 key 时优先沿用该会话绑定的账号
+	token, accountID, err := s.authManager.GetAccessTokenForSession(sessionKeyFromContext(ctx))
+	if err != nil {
+		// 降级：使用旧方法
+		token, err = s.authManager.GetAccessToken()
+		if err != nil {
+			return "", "", err
+		}
+		accountID = ""
+	}
+	return token, accountID, nil
+}
+
+// emptyResponseGuard 跟踪一次上游调用是否向调用方输出过内容，并扣留 done 回调
+// 为什么扣留 done：流结束后才能判断是否要重试，提前透传 done 会让调用方结束响应
+type emptyResponseGuard struct {
+	produced bool // 是否已转发过内容或工具调用
+	done     bool // 上游流是否已正常结束
+}
+
+// forward 转发一次回调：done 只记录不转发，其余原样转发
+func (g *emptyResponseGuard) forward(hasOutput, done bool, emit func()) {
+	if done {
+		g.done = true
+		return
+	}
+	if hasOutput {
+		g.produced = true
+	}
+	emit()
+}
+
+// shouldRetryEmpty 判断是否对空响应重试：流正常结束、没有输出任何内容且 usage 全为零
+// 已经输出过内容时绝不重试（调用方可能已经把内容写给客户端）
+// 需要重试时把该账号记为一次软失败；调用方已取消（客户端断开、处理出错）时不再发起新一轮请求
+func (s *ChatService) shouldRetryEmpty(ctx context.Context, guard *emptyResponseGuard, usage *KiroUsage, accountID string, err error) bool {
+	if err != nil || ctx.Err() != nil || guard.produced || !guard.done || !usage.IsZero() {
+		return false
+	}
+	s.authManager.RecordRequestResult(accountID, false)
+	if s.logger != nil {
+		s.logger.Warn(getMsgIdFromCtx(ctx), "上游返回空响应，换账号重试", map[string]any{
+			"accountId": accountID,
+		})
+	}
+	return true
+}
+
+// shouldFailover 判断上游调用失败后是否换一个账号重试
+// 只在还没有向调用方输出任何内容时重试（已经写给客户端的内容无法撤回）；
+// 请求本身的问题、超时、取消、额度耗尽等不触发熔断的错误换账号也无济于事，不重试；
+// 指定了账号（X-Kiro-Account-Id、预留账号）时没有别的账号可换
+func (s *ChatService) shouldFailover(ctx context.Context, guard *emptyResponseGuard, accountID string, err error) bool {
+	if err == nil || accountID == "" || ctx.Err() != nil || guard.produced || guard.done {
+		return false
+	}
+	if IsNonCircuitBreakingError(err) || pinnedAccountFromContext(ctx) != "" || useReservedAccounts(ctx) {
+		return false
+	}
+	if s.logger != nil {
+		s.logger.Warn(getMsgIdFromCtx(ctx), "上游请求失败，换账号重试", map[string]any{
+			"accountId": accountID,
+			"error":     err.Error(),
+		})
+	}
+	return true
+}
+
+// streamWithRetries 发起上游调用，按 opts 在流开始输出前重试：
+// 空响应换一个账号重试一次（opts.RetryOnEmpty），失败时换账号重试最多 opts.MaxRetries 次，已试过的账号不再选择
+// attempt 发起一次上游调用并通过 guard 转发回调；返回最终结果以及上游流是否正常结束（调用方据此补发 done）
+func (s *ChatService) streamWithRetries(
+	ctx context.Context,
+	opts ChatOptions,
+	attempt func(exclude accountExclusion, guard *emptyResponseGuard) (*KiroUsage, string, error),
+) (*KiroUsage, bool, error) {
+	var (
+		exclude      accountExclusion
+		tried        []string
+		emptyRetried bool
+		failovers    int
+		lastUsage    *KiroUsage
+		lastErr      error
+	)
+	for {
+		guard := &emptyResponseGuard{}
+		usage, accountID, err := attempt(exclude, guard)
+		if exclude.strict && accountID == "" {
+			// 没有其他可用账号可换，返回上一次失败的结果
+			return lastUsage, false, lastErr
+		}
+		if accountID != "" {
+			tried = append(tried, accountID)
+		}
+		lastUsage, lastErr = usage, err
+
+		switch {
+		case opts.RetryOnEmpty && !emptyRetried && s.shouldRetryEmpty(ctx, guard, usage, accountID, err):
+			emptyRetried = true
+			exclude = accountExclusion{ids: []string{accountID}}
+		case failovers < opts.MaxRetries && s.shouldFailover(ctx, guard, accountID, err):
+			failovers++
+			exclude = accountExclusion{ids: tried, strict: true}
+		default:
+			return usage, guard.done, err
+		}
+	}
+}
+
 // ChatStreamWithModel 流式聊天（支持指定模型）
 // 向后兼容版本，不返回 usage 信息
 func (s *ChatService) ChatStreamWithModel(ctx context.Context, messages []ChatMessage, model string, callback func(content string, done bool)) error {
-	_, err := s.ChatStreamWithModelAndUsage(ctx, messages, model, callback)
+	_, err := s.ChatStreamWithModelAndUsage(ctx, messages, model, ChatOptions{}, callback)
 	return err
 }
 
+// logIgnoredGenerationParams Kiro API 不接受生成参数，客户端设置了时记一条日志说明已忽略
+// 为什么：不转发也不报错会让客户端以为参数生效了，至少要能在日志里查到
+func (s *ChatService) logIgnoredGenerationParams(ctx context.Context, opts ChatOptions) {
+	if s.logger == nil {
+		return
+	}
+	ignored := make(map[string]any)
+	if opts.Temperature != nil {
+		ignored["temperature"] = *opts.Temperature
+	}
+	if opts.TopP != nil {
+		ignored["topP"] = *opts.TopP
+	}
+	if opts.TopK != nil {
+		ignored["topK"] = *opts.TopK
+	}
+	if len(opts.StopSequences) > 0 {
+		ignored["stopSequences"] = opts.StopSequences
+	}
+	if len(ignored) > 0 {
+		s.logger.Info(getMsgIdFromCtx(ctx), "Kiro API 不支持生成参数，已忽略", ignored)
+	}
+}
+
+// DefaultUpstreamTimeout 未按模型配置时，一次上游调用（含读完整个响应流）的超时
+const DefaultUpstreamTimeout = 120 * time.Second
+
+// upstreamTimeout 模型的上游调用超时：opts.ModelTimeouts 中配置了正数秒数时使用，否则为 DefaultUpstreamTimeout
+func upstreamTimeout(model string, opts ChatOptions) time.Duration {
+	if seconds := opts.ModelTimeouts[model]; seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return DefaultUpstreamTimeout
+}
+
+// withUpstreamTimeout 给上游调用加上按模型配置的超时
+// 返回的 finish 在调用结束时执行：释放 context，因超时失败时给错误补充模型和超时时长
+func withUpstreamTimeout(ctx context.Context, model string, opts ChatOptions) (context.Context, func(error) error) {
+	timeout := upstreamTimeout(model, opts)
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
+	return timeoutCtx, func(err error) error {
+		cancel()
+		// 调用方自身的 context 已结束（MaxRequestSeconds、客户端断开）时由调用方处理，不算上游超时
+		if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("上游请求超时（模型 %s 超过 %s）: %w", model, timeout, err)
+		}
+		return err
+	}
+}
+
 // ChatStreamWithModelAndUsage 流式聊天（支持指定模型，返回精确 usage）
 // 返回 KiroUsage 包含从 Kiro API EventStream 解析的精确 token 使用量
-func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages []ChatMessage, model string, callback func(content string, done bool)) (*KiroUsage, error) {
-	// 使用带账号ID的方法，便于熔断器追踪
-	token, accountID, err := s.authManager.GetAccessTokenWithAccountID()
-	if err != nil {
-		// 降级：使用旧方法
-		token, err = s.authManager.GetAccessToken()
-		if err != nil {
-			return nil, err
+// opts.RetryOnEmpty 开启时，上游返回空响应会换一个账号重试一次；opts.MaxRetries 大于 0 时，
+// 输出开始前失败会换账号重试（重试与首次请求共用 upstreamTimeout 超时）
+func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages []ChatMessage, model string, opts ChatOptions, callback func(content string, done bool)) (usage *KiroUsage, err error) {
+	ctx, finish := withUpstreamTimeout(ctx, model, opts)
+	defer func() { err = finish(err) }()
+	s.logIgnoredGenerationParams(ctx, opts)
+
+	// opts.MaxTokens 大于 0 时在本地截断输出（见 output_limit.go）
+	ctx, limiter := newOutputLimiter(ctx, opts.MaxTokens)
+	if limiter != nil {
+		emit := callback
+		callback = func(content string, done bool) {
+			if content = limiter.take(content); content == "" && !done {
+				return
+			}
+			if !done || limiter.observeDone() {
+				emit(content, done)
+			}
 		}
-		accountID = ""
+		defer func() {
+			var sendDone bool
+			if sendDone, err = limiter.finish(err); sendDone {
+				emit("", true)
+			}
+		}()
+	}
+
+	if !opts.RetryOnEmpty && opts.MaxRetries <= 0 {
+		usage, _, err := s.chatStreamWithModelOnce(ctx, messages, model, opts, accountExclusion{}, callback)
+		return usage, err
+	}
+
+	usage, done, err := s.streamWithRetries(ctx, opts, func(exclude accountExclusion, guard *emptyResponseGuard) (*KiroUsage, string, error) {
+		return s.chatStreamWithModelOnce(ctx, messages, model, opts, exclude, func(content string, done bool) {
+			guard.forward(content != "", done, func() { callback(content, done) })
+		})
+	})
+	if done {
+		callback("", true)
+	}
+	return usage, err
+}
+
+// chatStreamWithModelOnce 发起一次上游请求（不含重试）
+// exclude 为重试时不再使用的账号；返回实际使用的账号 ID
+func (s *ChatService) chatStreamWithModelOnce(ctx context.Context, messages []ChatMessage, model string, opts ChatOptions, exclude accountExclusion, callback func(content string, done bool)) (*KiroUsage, string, error) {
+	// 兜底校验：modelId 会原样写进上游请求体，只允许空或已知模型
+	if model != "" && !IsValidModel(model) {
+		return nil, "", fmt.Errorf("无效的模型 ID: %q", model)
+	}
+
+	timing := RequestTimingFrom(ctx)
+	selectStart := time.Now()
+	token, accountID, err := s.acquireToken(ctx, exclude)
+	timing.addAccountSelect(time.Since(selectStart))
+	if err != nil {
+		return nil, "", err
 	}
+	// 半开账号的试探名额在本次上游调用结束时释放，无论成功、失败、400 还是客户端取消
+	defer s.authManager.ReleaseHalfOpenProbe(accountID)
+	notifyAccountSelected(ctx, accountID)
 
 	// 打印使用的账号（用于调试轮询）
 	// 线上环境已禁用调试日志
@@ -916,12 +1416,16 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 
 	body, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, err
+		return nil, accountID, err
 	}
 
+	s.recordPayloadSize(ctx, body, len(messages), len(history), opts)
+	PayloadCaptureFrom(ctx).record(body)
+
 	// 【包2】记录发给 Kiro API 的请求 body
 	DebugLog(ctx, s.logger, "【包2】发给Kiro API", map[string]any{
-		"body": string(body),
+		"body":      string(body),
+		"agentMode": ResolveAgentMode(opts.AgentMode),
 	})
 
 	// 确定 endpoint
@@ -935,9 +1439,12 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 
 	url := endpoint + "/generateAssistantResponse"
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	// 每一轮上游请求单独可取消：本轮结束（含中途出错提前返回）时立即取消，上游连接随之断开，不会与下一轮或错误收尾并存
+	roundCtx, cancelRound := context.WithCancel(ctx)
+	defer cancelRound()
+	req, err := http.NewRequestWithContext(roundCtx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, accountID, err
 	}
 
 	// 设置请求头
@@ -948,8 +1455,11 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 	req.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
 	req.Header.Set("Accept", "application/vnd.amazon.eventstream")
 	req.Header.Set("x-amzn-codewhisperer-optout", "true")
-	req.Header.Set("x-amzn-kiro-agent-mode", "chat")
+	req.Header.Set("x-amzn-kiro-agent-mode", ResolveAgentMode(opts.AgentMode))
+	applyUpstreamHeaders(req, opts.UpstreamHeaders)
 
+	sentAt := time.Now()
+	defer timing.finishUpstream(sentAt)
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		// 【包3】HTTP 请求失败
@@ -962,8 +1472,9 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 		if !IsNonCircuitBreakingError(err) {
 			s.authManager.RecordRequestResult(accountID, false)
 		}
-		return nil, err
+		return nil, accountID, err
 	}
+	timing.markFirstByte(sentAt)
 	defer func() {
 		_ = resp.Body.Close()
 	}()
@@ -979,11 +1490,19 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 				"body":       string(bodyBytes),
 			})
 		}
+		// 请求格式错误：记录发出的 conversationState 结构摘要（已脱敏），定位是哪部分 payload 不合法
+		if IsImproperlyFormedRequestError(reqErr) && s.logger != nil {
+			s.logger.Error(getMsgIdFromCtx(ctx), "Kiro API 拒绝请求格式", describeConversationState(body))
+		}
+		// 额度耗尽：标记到下个重置日，不计入熔断
+		if IsQuotaExhaustedError(reqErr) {
+			s.authManager.MarkQuotaExhausted(accountID)
+		}
 		// 客户端参数错误（400）不触发熔断
 		if !IsNonCircuitBreakingError(reqErr) {
 			s.authManager.RecordRequestResult(accountID, false)
 		}
-		return nil, reqErr
+		return nil, accountID, reqErr
 	}
 
 	// 记录请求成功（headers）
@@ -1005,10 +1524,16 @@ func (s *ChatService) ChatStreamWithModelAndUsage(ctx context.Context, messages
 	// 记录请求成功
 	s.authManager.RecordRequestResult(accountID, true)
 
+	// 上游启用压缩时先解压（identity 原样返回）
+	streamBody, err := decodeResponseBody(resp)
+	if err != nil {
+		return nil, accountID, err
+	}
+
 	// 解析 EventStream（每个事件的 payload 在 parseEventStream 内逐条记录）
-	usage, parseErr := s.parseEventStream(ctx, resp.Body, callback)
+	usage, parseErr := s.parseEventStream(ctx, streamBody, callback)
 
-	return usage, parseErr
+	return usage, accountID, parseErr
 }
 
 // UTF8Buffer 处理跨消息边界的 UTF-8 字符
@@ -1175,6 +1700,10 @@ func (s *ChatService) parseEventStream(ctx context.Context, body io.Reader, call
 	utf8Buffer := &UTF8Buffer{} // UTF-8 缓冲处理器
 
 	for {
+		// 请求已取消（客户端断开、被中止或超时）时不再读取上游，返回已累计的部分 usage
+		if err := ctx.Err(); err != nil {
+			return usage, err
+		}
 		msg, err := s.readEventStreamMessage(body)
 		if err != nil {
 			if err == io.EOF {
@@ -1198,6 +1727,7 @@ func (s *ChatService) parseEventStream(ctx context.Context, body io.Reader, call
 		}
 
 		eventType := msg.Headers[":event-type"]
+		s.recordEventType(ctx, eventType, msg.Payload)
 
 		// 【包3】记录每个 EventStream 事件的原始 payload
 		// 先检查 payload 是否为合法 JSON，是则直接嵌入（避免双重转义），否则用 string 降级
@@ -1230,6 +1760,7 @@ func (s *ChatService) parseEventStream(ctx context.Context, body io.Reader, call
 		// 参考 Kiro-account-manager kiroApi.ts 第 680-720 行
 		if eventType == "messageMetadataEvent" {
 			var event struct {
+				ModelID    string `json:"modelId"` // 实际提供服务的模型（上游替换模型时与请求不同）
 				TokenUsage *struct {
 					UncachedInputTokens   int `json:"uncachedInputTokens"`
 					CacheReadInputTokens  int `json:"cacheReadInputTokens"`
@@ -1238,14 +1769,22 @@ func (s *ChatService) parseEventStream(ctx context.Context, body io.Reader, call
 					ReasoningTokens       int `json:"reasoningTokens"`
 				} `json:"tokenUsage"`
 			}
-			if err := json.Unmarshal(msg.Payload, &event); err == nil && event.TokenUsage != nil {
+			err := json.Unmarshal(msg.Payload, &event)
+			if err == nil && event.ModelID != "" {
+				usage.ModelID = event.ModelID
+			}
+			if err == nil && event.TokenUsage != nil {
 				tu := event.TokenUsage
 				// inputTokens = uncached + cacheRead + cacheWrite
 				usage.InputTokens = tu.UncachedInputTokens + tu.CacheReadInputTokens + tu.CacheWriteInputTokens
 				usage.OutputTokens = tu.OutputTokens
 				usage.CacheReadTokens = tu.CacheReadInputTokens
 				usage.CacheWriteTokens = tu.CacheWriteInputTokens
-				usage.ReasoningTokens = tu.ReasoningTokens
+				// 上游给出精确值时校正本地估算的累计值（没有该字段时保留估算值）
+				if tu.ReasoningTokens > 0 {
+					usage.ReasoningTokens = tu.ReasoningTokens
+					notifyReasoningTokens(ctx, usage.ReasoningTokens)
+				}
 			}
 		}
 
@@ -1259,6 +1798,14 @@ func (s *ChatService) parseEventStream(ctx context.Context, body io.Reader, call
 				usage.Credits += event.Usage
 			}
 		}
+
+		// 解析 reasoningContentEvent：无工具路径不输出推理内容，只累计 reasoning tokens
+		if eventType == "reasoningContentEvent" {
+			if textBytes, ok := extractTextFromPayload(msg.Payload); ok && len(textBytes) > 0 {
+				usage.ReasoningTokens += len(textBytes) / 3
+				notifyReasoningTokens(ctx, usage.ReasoningTokens)
+			}
+		}
 	}
 }
 
@@ -1268,6 +1815,29 @@ type EventStreamMessage struct {
 	Payload []byte
 }
 
+// decodeResponseBody 按 Content-Encoding 解压上游响应体
+// 为什么：EventStream 按原始字节解析，上游一旦启用压缩就会被当成损坏的消息；
+// identity（或未声明）时原样返回，保持默认路径不变
+func decodeResponseBody(resp *http.Response) (io.Reader, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		// HTTP 的 deflate 按规范是 zlib 封装，但部分服务端发的是裸 deflate，按 zlib 头判断
+		br := bufio.NewReader(resp.Body)
+		header, err := br.Peek(2)
+		if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("不支持的上游 Content-Encoding: %s", encoding)
+	}
+}
+
 // readEventStreamMessage 读取 EventStream 消息
 func (s *ChatService) readEventStreamMessage(r io.Reader) (*EventStreamMessage, error) {
 	// 读取前言
@@ -1437,6 +2007,7 @@ type ToolUseCallback func(content string, toolUse *KiroToolUse, done bool, isThi
 type ThinkingTextProcessor struct {
 	buffer          string               // 文本缓冲区
 	inThinkingBlock bool                 // 是否在 thinking 块内
+	thinkingTagOpen bool                 // 标签格式下是否已输出开始标签（增量输出时只输出一次）
 	format          ThinkingOutputFormat // 输出格式
 	Callback        func(text string, isThinking bool)
 }
@@ -1496,6 +2067,7 @@ func (p *ThinkingTextProcessor) ProcessText(text string, forceFlush bool) {
 				if thinkingContent != "" {
 					p.outputThinkingContent(thinkingContent)
 				}
+				p.closeThinkingContent()
 				p.buffer = p.buffer[thinkingEnd+11:] // 移除 </thinking>
 				p.inThinkingBlock = false
 			} else if forceFlush {
@@ -1504,27 +2076,79 @@ func (p *ThinkingTextProcessor) ProcessText(text string, forceFlush bool) {
 					p.outputThinkingContent(p.buffer)
 					p.buffer = ""
 				}
+				p.closeThinkingContent()
 				break
 			} else {
+				// 增量输出：只扣留可能是 </thinking> 前缀的尾部，其余立即输出
+				// 为什么：长 thinking 不再憋到结束标签才一次性吐出，且扣留部分不会被重复输出
+				safeLen := len(p.buffer) - partialTagSuffixLen(p.buffer, "</thinking>")
+				if safeLen > 0 {
+					p.outputThinkingContent(p.buffer[:safeLen])
+					p.buffer = p.buffer[safeLen:]
+				}
 				break
 			}
 		}
 	}
 }
 
-// outputThinkingContent 根据格式输出 thinking 内容
-func (p *ThinkingTextProcessor) outputThinkingContent(content string) {
+// partialTagSuffixLen 返回 s 末尾与 tag 前缀重合的最大长度
+// 例如 s="abc</thi"、tag="</thinking>" 时返回 5；tag 为 ASCII，切分点不会落在多字节字符中间
+func partialTagSuffixLen(s, tag string) int {
+	maxLen := len(tag) - 1
+	if maxLen > len(s) {
+		maxLen = len(s)
+	}
+	for n := maxLen; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// thinkingTags 返回标签格式下的开始/结束标签，reasoning_content 格式返回空
+func (p *ThinkingTextProcessor) thinkingTags() (string, string) {
 	switch p.format {
 	case ThinkingFormatThinking:
 		// 保持原始 <thinking> 标签
-		p.Callback("<thinking>"+content+"</thinking>", false)
+		return "<thinking>", "</thinking>"
 	case ThinkingFormatThink:
 		// 转换为 <think> 标签
-		p.Callback("<think>"+content+"</think>", false)
+		return "<think>", "</think>"
 	default:
+		return "", ""
+	}
+}
+
+// outputThinkingContent 根据格式输出 thinking 内容（可多次调用，增量输出）
+func (p *ThinkingTextProcessor) outputThinkingContent(content string) {
+	if p.format == ThinkingFormatNone {
+		// none 格式：丢弃 thinking 内容
+		return
+	}
+	openTag, _ := p.thinkingTags()
+	if openTag == "" {
 		// reasoning_content 格式：标记为 thinking 内容
 		p.Callback(content, true)
+		return
+	}
+	// 标签格式：开始标签只在第一段内容前输出一次
+	if !p.thinkingTagOpen {
+		content = openTag + content
+		p.thinkingTagOpen = true
 	}
+	p.Callback(content, false)
+}
+
+// closeThinkingContent thinking 块结束，标签格式下补上结束标签
+func (p *ThinkingTextProcessor) closeThinkingContent() {
+	if !p.thinkingTagOpen {
+		return
+	}
+	_, closeTag := p.thinkingTags()
+	p.Callback(closeTag, false)
+	p.thinkingTagOpen = false
 }
 
 // Flush 刷新缓冲区中剩余的内容
@@ -1571,7 +2195,7 @@ func (s *ChatService) ChatStreamWithTools(
 	toolResults []KiroToolResult,
 	callback ToolUseCallback,
 ) error {
-	_, err := s.ChatStreamWithToolsAndUsage(ctx, messages, model, tools, toolResults, callback)
+	_, err := s.ChatStreamWithToolsAndUsage(ctx, messages, model, tools, toolResults, ChatOptions{}, callback)
 	return err
 }
 
@@ -1583,43 +2207,94 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 	model string,
 	tools []KiroToolWrapper,
 	toolResults []KiroToolResult,
+	opts ChatOptions,
 	callback ToolUseCallback,
-) (*KiroUsage, error) {
-	token, accountID, err := s.authManager.GetAccessTokenWithAccountID()
-	if err != nil {
-		token, err = s.authManager.GetAccessToken()
-		if err != nil {
-			return nil, err
+) (usage *KiroUsage, err error) {
+	ctx, finish := withUpstreamTimeout(ctx, model, opts)
+	defer func() { err = finish(err) }()
+	s.logIgnoredGenerationParams(ctx, opts)
+
+	// opts.MaxTokens 大于 0 时在本地截断输出（见 output_limit.go）
+	ctx, limiter := newOutputLimiter(ctx, opts.MaxTokens)
+	if limiter != nil {
+		emit := callback
+		callback = func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+			content = limiter.take(content)
+			toolUse = limiter.takeToolUse(toolUse)
+			if content == "" && toolUse == nil && !done {
+				return
+			}
+			if !done || limiter.observeDone() {
+				emit(content, toolUse, done, isThinking)
+			}
 		}
-		accountID = ""
+		defer func() {
+			var sendDone bool
+			if sendDone, err = limiter.finish(err); sendDone {
+				emit("", nil, true, false)
+			}
+		}()
 	}
 
-	// 线上环境已禁用调试日志
+	if !opts.RetryOnEmpty && opts.MaxRetries <= 0 {
+		usage, _, err := s.chatStreamWithToolsOnce(ctx, messages, model, tools, toolResults, opts, accountExclusion{}, callback)
+		return usage, err
+	}
 
-	conversationID := generateConversationID()
+	usage, done, err := s.streamWithRetries(ctx, opts, func(exclude accountExclusion, guard *emptyResponseGuard) (*KiroUsage, string, error) {
+		return s.chatStreamWithToolsOnce(ctx, messages, model, tools, toolResults, opts, exclude, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+			guard.forward(content != "" || toolUse != nil, done, func() { callback(content, toolUse, done, isThinking) })
+		})
+	})
+	if done {
+		callback("", nil, true, false)
+	}
+	return usage, err
+}
 
-	// 构建 Kiro API 格式的历史消息和当前消息
-	history, currentMessage := s.buildKiroMessages(messages, model, tools, toolResults)
+// chatStreamWithToolsOnce 发起一次上游请求（不含重试）
+// exclude 为重试时不再使用的账号；返回实际使用的账号 ID
+func (s *ChatService) chatStreamWithToolsOnce(
+	ctx context.Context,
+	messages []ChatMessage,
+	model string,
+	tools []KiroToolWrapper,
+	toolResults []KiroToolResult,
+	opts ChatOptions,
+	exclude accountExclusion,
+	callback ToolUseCallback,
+) (*KiroUsage, string, error) {
+	// 兜底校验：modelId 会原样写进上游请求体，只允许空或已知模型
+	if model != "" && !IsValidModel(model) {
+		return nil, "", fmt.Errorf("无效的模型 ID: %q", model)
+	}
 
-	// 注意：customizationArn 需要 ARN 格式，简单模型 ID 不被接受
-	// Kiro API 会根据账号配置自动选择模型，暂不传递 customizationArn
-	reqBody := map[string]any{
-		"conversationState": map[string]any{
-			"conversationId":  conversationID,
-			"currentMessage":  currentMessage,
-			"history":         history,
-			"chatTriggerType": "MANUAL",
-		},
+	timing := RequestTimingFrom(ctx)
+	selectStart := time.Now()
+	token, accountID, err := s.acquireToken(ctx, exclude)
+	timing.addAccountSelect(time.Since(selectStart))
+	if err != nil {
+		return nil, "", err
 	}
+	// 半开账号的试探名额在本次上游调用结束时释放，无论成功、失败、400 还是客户端取消
+	defer s.authManager.ReleaseHalfOpenProbe(accountID)
+	notifyAccountSelected(ctx, accountID)
 
-	body, err := json.Marshal(reqBody)
+	// 线上环境已禁用调试日志
+
+	body, historyLen, err := s.buildToolsRequestBody(generateConversationID(), messages, model, tools, toolResults)
 	if err != nil {
-		return nil, err
+		return nil, accountID, err
 	}
 
+	s.recordPayloadSize(ctx, body, len(messages), historyLen, opts)
+	PayloadCaptureFrom(ctx).record(body)
+
 	// 【包2】记录发给 Kiro API 的请求 body
 	DebugLog(ctx, s.logger, "【包2】发给Kiro API(Tools)", map[string]any{
-		"body": string(body),
+		"body":      string(body),
+		"options":   opts,
+		"agentMode": ResolveAgentMode(opts.AgentMode),
 	})
 
 	region := s.authManager.GetRegion()
@@ -1632,9 +2307,12 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 
 	url := endpoint + "/generateAssistantResponse"
 
-	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	// 每一轮上游请求单独可取消：本轮结束（含中途出错提前返回）时立即取消，上游连接随之断开，不会与下一轮或错误收尾并存
+	roundCtx, cancelRound := context.WithCancel(ctx)
+	defer cancelRound()
+	req, err := http.NewRequestWithContext(roundCtx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, accountID, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
@@ -1644,8 +2322,11 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 	req.Header.Set("X-Amz-Date", time.Now().UTC().Format("20060102T150405Z"))
 	req.Header.Set("Accept", "application/vnd.amazon.eventstream")
 	req.Header.Set("x-amzn-codewhisperer-optout", "true")
-	req.Header.Set("x-amzn-kiro-agent-mode", "chat")
+	req.Header.Set("x-amzn-kiro-agent-mode", ResolveAgentMode(opts.AgentMode))
+	applyUpstreamHeaders(req, opts.UpstreamHeaders)
 
+	sentAt := time.Now()
+	defer timing.finishUpstream(sentAt)
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		// 【包3】HTTP 请求失败
@@ -1657,8 +2338,9 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 		if !IsNonCircuitBreakingError(err) {
 			s.authManager.RecordRequestResult(accountID, false)
 		}
-		return nil, err
+		return nil, accountID, err
 	}
+	timing.markFirstByte(sentAt)
 	defer func() {
 		_ = resp.Body.Close()
 	}()
@@ -1674,10 +2356,17 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 				"body":       string(bodyBytes),
 			})
 		}
+		// 请求格式错误：记录发出的 conversationState 结构摘要（已脱敏），定位是哪部分 payload 不合法
+		if IsImproperlyFormedRequestError(reqErr) && s.logger != nil {
+			s.logger.Error(getMsgIdFromCtx(ctx), "Kiro API 拒绝请求格式(Tools)", describeConversationState(body))
+		}
+		if IsQuotaExhaustedError(reqErr) {
+			s.authManager.MarkQuotaExhausted(accountID)
+		}
 		if !IsNonCircuitBreakingError(reqErr) {
 			s.authManager.RecordRequestResult(accountID, false)
 		}
-		return nil, reqErr
+		return nil, accountID, reqErr
 	}
 
 	// 记录请求成功（headers）
@@ -1698,15 +2387,55 @@ func (s *ChatService) ChatStreamWithToolsAndUsage(
 
 	s.authManager.RecordRequestResult(accountID, true)
 
+	// 上游启用压缩时先解压（identity 原样返回）
+	streamBody, err := decodeResponseBody(resp)
+	if err != nil {
+		return nil, accountID, err
+	}
+
 	// 解析 EventStream（每个事件的 payload 在 parseEventStreamWithTools 内逐条记录）
-	usage, parseErr := s.parseEventStreamWithTools(ctx, resp.Body, callback)
+	usage, parseErr := s.parseEventStreamWithTools(ctx, streamBody, opts, callback)
 
-	return usage, parseErr
+	return usage, accountID, parseErr
+}
+
+// BuildToolsRequestBody 构建 ChatStreamWithToolsAndUsage 发往上游的请求体，但不发送
+// 用于 dry-run 计数：与真实请求走同一套 sanitize/buildKiroMessages 流程，只有 conversationId 不同
+func (s *ChatService) BuildToolsRequestBody(messages []ChatMessage, model string, tools []KiroToolWrapper, toolResults []KiroToolResult) ([]byte, error) {
+	if model != "" && !IsValidModel(model) {
+		return nil, fmt.Errorf("无效的模型 ID: %q", model)
+	}
+	body, _, err := s.buildToolsRequestBody(generateConversationID(), messages, model, tools, toolResults)
+	return body, err
+}
+
+// buildToolsRequestBody 构建 conversationState 请求体，同时返回 history 条数
+func (s *ChatService) buildToolsRequestBody(conversationID string, messages []ChatMessage, model string, tools []KiroToolWrapper, toolResults []KiroToolResult) ([]byte, int, error) {
+	// 构建 Kiro API 格式的历史消息和当前消息
+	history, currentMessage := s.buildKiroMessages(messages, model, tools, toolResults)
+
+	// 注意：customizationArn 需要 ARN 格式，简单模型 ID 不被接受
+	// Kiro API 会根据账号配置自动选择模型，暂不传递 customizationArn
+	reqBody := map[string]any{
+		"conversationState": map[string]any{
+			"conversationId":  conversationID,
+			"currentMessage":  currentMessage,
+			"history":         history,
+			"chatTriggerType": "MANUAL",
+		},
+	}
+
+	body, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, len(history), nil
 }
 
 // parseEventStreamWithTools 解析 EventStream（支持工具调用）
 // 返回 KiroUsage 包含从 API 获取的精确 token 使用量
-func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Reader, callback ToolUseCallback) (*KiroUsage, error) {
+// opts 控制 thinking 和辅助事件的输出，零值保持原行为
+func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Reader, opts ChatOptions, callback ToolUseCallback) (*KiroUsage, error) {
 	usage := &KiroUsage{}
 	utf8Buffer := &UTF8Buffer{} // UTF-8 缓冲处理器
 
@@ -1717,8 +2446,13 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 		InputBuffer string
 	}
 	processedIds := make(map[string]bool)
+	toolInputDelta := isToolInputDeltaEnabled(ctx)
 
 	for {
+		// 请求已取消（客户端断开、被中止或超时）时不再读取上游，返回已累计的部分 usage
+		if err := ctx.Err(); err != nil {
+			return usage, err
+		}
 		msg, err := s.readEventStreamMessage(body)
 		if err != nil {
 			if err == io.EOF {
@@ -1735,6 +2469,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 							Name:      currentToolUse.Name,
 							Input:     input,
 							Truncated: truncated,
+							RawInput:  currentToolUse.InputBuffer,
 						}, false, false)
 					} else {
 						// 无法解析，发送跳过通知并记录日志
@@ -1777,6 +2512,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 		}
 
 		eventType := msg.Headers[":event-type"]
+		s.recordEventType(ctx, eventType, msg.Payload)
 
 		// 【包3】记录每个 EventStream 事件的原始 payload
 		// 先检查 payload 是否为合法 JSON，是则直接嵌入（避免双重转义），否则用 string 降级
@@ -1793,6 +2529,11 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 			})
 		}
 
+		// 已关闭转发的辅助事件直接跳过（只影响注入到输出的文本，原始事件仍会记录日志）
+		if !isEventForwarded(opts.ForwardedEvents, eventType) {
+			continue
+		}
+
 		// 解析 assistantResponseEvent（文本内容）
 		if eventType == "assistantResponseEvent" {
 			// 直接从原始 payload 提取 content 字节，避免 json.Unmarshal 损坏 UTF-8
@@ -1809,6 +2550,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 		// 参考 Kiro-account-manager kiroApi.ts 第 680-720 行
 		if eventType == "messageMetadataEvent" {
 			var event struct {
+				ModelID    string `json:"modelId"` // 实际提供服务的模型（上游替换模型时与请求不同）
 				TokenUsage *struct {
 					UncachedInputTokens   int `json:"uncachedInputTokens"`
 					CacheReadInputTokens  int `json:"cacheReadInputTokens"`
@@ -1817,14 +2559,22 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 					ReasoningTokens       int `json:"reasoningTokens"`
 				} `json:"tokenUsage"`
 			}
-			if err := json.Unmarshal(msg.Payload, &event); err == nil && event.TokenUsage != nil {
+			err := json.Unmarshal(msg.Payload, &event)
+			if err == nil && event.ModelID != "" {
+				usage.ModelID = event.ModelID
+			}
+			if err == nil && event.TokenUsage != nil {
 				tu := event.TokenUsage
 				// inputTokens = uncached + cacheRead + cacheWrite
 				usage.InputTokens = tu.UncachedInputTokens + tu.CacheReadInputTokens + tu.CacheWriteInputTokens
 				usage.OutputTokens = tu.OutputTokens
 				usage.CacheReadTokens = tu.CacheReadInputTokens
 				usage.CacheWriteTokens = tu.CacheWriteInputTokens
-				usage.ReasoningTokens = tu.ReasoningTokens
+				// 上游给出精确值时校正本地估算的累计值（没有该字段时保留估算值）
+				if tu.ReasoningTokens > 0 {
+					usage.ReasoningTokens = tu.ReasoningTokens
+					notifyReasoningTokens(ctx, usage.ReasoningTokens)
+				}
 			}
 		}
 
@@ -1846,12 +2596,13 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 			if textBytes, ok := extractTextFromPayload(msg.Payload); ok && len(textBytes) > 0 {
 				// 使用 UTF-8 缓冲处理器处理原始字节
 				processed := utf8Buffer.ProcessBytes(textBytes)
-				if processed != "" {
+				if processed != "" && opts.ThinkingFormat != ThinkingFormatNone {
 					// isThinking=true 标记这是思考内容
 					callback(processed, nil, false, true)
 				}
-				// 累计 reasoning tokens
+				// 累计 reasoning tokens（不输出 thinking 时同样计入）
 				usage.ReasoningTokens += len(textBytes) / 3
+				notifyReasoningTokens(ctx, usage.ReasoningTokens)
 			}
 		}
 
@@ -1999,6 +2750,11 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 			if err := json.Unmarshal(msg.Payload, &event); err != nil {
 				continue
 			}
+			// 已完成的工具调用的迟到事件直接忽略
+			// 为什么：一轮中有多个工具调用时，迟到事件的 ID 与当前工具不同，会被误当成新工具而提前结束当前工具
+			if event.ToolUseId != "" && processedIds[event.ToolUseId] {
+				continue
+			}
 
 			// 新的工具调用开始（只有当 currentToolUse 为空或 ID 不同时才创建）
 			if event.ToolUseId != "" && event.Name != "" {
@@ -2012,6 +2768,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 								Name:      currentToolUse.Name,
 								Input:     input,
 								Truncated: truncated,
+								RawInput:  currentToolUse.InputBuffer,
 							}, false, false)
 						} else {
 							// 无法解析，发送跳过通知并记录日志
@@ -2035,11 +2792,20 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 				}
 			}
 
-			// 累积输入片段
-			if currentToolUse != nil {
+			// 累积输入片段（只累积到 ID 匹配的工具，不带 ID 的片段视为当前工具的续写）
+			if currentToolUse != nil && (event.ToolUseId == "" || event.ToolUseId == currentToolUse.ToolUseId) {
 				switch v := event.Input.(type) {
 				case string:
 					currentToolUse.InputBuffer += v
+					// 开启增量回调时，原样转发片段，让客户端尽早看到大体积 input 的生成进度
+					if v != "" && toolInputDelta {
+						callback("", &KiroToolUse{
+							ToolUseId:    currentToolUse.ToolUseId,
+							Name:         currentToolUse.Name,
+							PartialInput: v,
+							IsPartial:    true,
+						}, false, false)
+					}
 				case map[string]interface{}:
 					data, _ := json.Marshal(v)
 					currentToolUse.InputBuffer = string(data)
@@ -2047,7 +2813,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 			}
 
 			// 工具调用完成
-			if event.Stop && currentToolUse != nil {
+			if event.Stop && currentToolUse != nil && (event.ToolUseId == "" || event.ToolUseId == currentToolUse.ToolUseId) {
 				input, ok, truncated := parseToolInput(currentToolUse.InputBuffer)
 				if ok {
 					callback("", &KiroToolUse{
@@ -2055,6 +2821,7 @@ func (s *ChatService) parseEventStreamWithTools(ctx context.Context, body io.Rea
 						Name:      currentToolUse.Name,
 						Input:     input,
 						Truncated: truncated,
+						RawInput:  currentToolUse.InputBuffer,
 					}, false, false)
 				} else {
 					// 无法解析，发送跳过通知并记录日志
@@ -2085,8 +2852,7 @@ func parseToolInput(buffer string) (map[string]interface{}, bool, bool) {
 	}
 
 	// 尝试标准 JSON 解析
-	var input map[string]interface{}
-	if err := json.Unmarshal([]byte(buffer), &input); err == nil {
+	if input, err := decodeToolInput(buffer); err == nil {
 		// 解析成功，原始 JSON 完整
 		return input, true, false
 	}
@@ -2107,8 +2873,8 @@ func parseToolInput(buffer string) (map[string]interface{}, bool, bool) {
 	}
 
 	// 修复成功，解析修复后的 JSON
-	var fixedInput map[string]interface{}
-	if err := json.Unmarshal([]byte(fixed), &fixedInput); err != nil {
+	fixedInput, err := decodeToolInput(fixed)
+	if err != nil {
 		// 修复后仍无法解析，返回 nil 表示跳过
 		return nil, false, false
 	}
@@ -2117,6 +2883,23 @@ func parseToolInput(buffer string) (map[string]interface{}, bool, bool) {
 	return fixedInput, true, true
 }
 
+// decodeToolInput 把工具输入解析为 map，数字保留为 json.Number
+// 为什么：json.Unmarshal 把数字都解成 float64，64 位 ID 和高精度小数转发给客户端时会丢精度；
+// json.Number 重新序列化时原样输出
+func decodeToolInput(data string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	var input map[string]interface{}
+	if err := dec.Decode(&input); err != nil {
+		return nil, err
+	}
+	// 与 json.Unmarshal 保持一致：对象之后不允许还有其他内容
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("工具输入 JSON 之后存在多余内容")
+	}
+	return input, nil
+}
+
 // logToolSkipped 记录工具调用被跳过的日志
 // 用于调试和监控截断问题
 // Requirements: 5.1, 5.2, 5.3
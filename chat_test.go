@@ -1,10 +1,19 @@
 package kiroclient
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"math/rand"
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
@@ -1848,7 +1857,7 @@ func TestProperty9_BackwardCompatibility(t *testing.T) {
 		MaxCount: 100,
 	}
 
-	// 属性：对于有效的完整 JSON，parseToolInput 返回与 json.Unmarshal 相同的结果
+	// 属性：对于有效的完整 JSON，parseToolInput 返回与 json.Unmarshal（UseNumber）相同的结果
 	property := func(seed int64) bool {
 		r := rand.New(rand.NewSource(seed))
 
@@ -1861,9 +1870,9 @@ func TestProperty9_BackwardCompatibility(t *testing.T) {
 
 		jsonStr := jsonValueToString(v)
 
-		// 使用标准 json.Unmarshal 解析
+		// 使用标准解码（UseNumber）解析
 		var expected map[string]any
-		if err := json.Unmarshal([]byte(jsonStr), &expected); err != nil {
+		if err := unmarshalUseNumber(jsonStr, &expected); err != nil {
 			// 如果标准解析失败，跳过此测试用例
 			return true
 		}
@@ -1877,7 +1886,7 @@ func TestProperty9_BackwardCompatibility(t *testing.T) {
 			return false
 		}
 
-		// 核心属性2：结果应与 json.Unmarshal 相同
+		// 核心属性2：结果应与 json.Unmarshal（UseNumber）相同
 		if !reflect.DeepEqual(result, expected) {
 			t.Logf("Property 9 违反: 结果与 json.Unmarshal 不同")
 			t.Logf("  输入: %s", jsonStr)
@@ -1913,6 +1922,13 @@ func TestProperty9_EmptyInputCompatibility(t *testing.T) {
 	}
 }
 
+// unmarshalUseNumber 与 parseToolInput 一致，数字解析为 json.Number
+func unmarshalUseNumber(data string, v any) error {
+	dec := json.NewDecoder(strings.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
 // TestProperty9_ValidJSONTypes 测试各种有效 JSON 类型的向后兼容性
 // **Feature: tool-input-json-fix, Property 9: 向后兼容性 - 各种类型**
 func TestProperty9_ValidJSONTypes(t *testing.T) {
@@ -1941,9 +1957,9 @@ func TestProperty9_ValidJSONTypes(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			// 使用标准 json.Unmarshal 解析
+			// 使用标准解码（UseNumber）解析
 			var expected map[string]any
-			if err := json.Unmarshal([]byte(tc.input), &expected); err != nil {
+			if err := unmarshalUseNumber(tc.input, &expected); err != nil {
 				t.Fatalf("标准 JSON 解析失败: %v", err)
 			}
 
@@ -1968,7 +1984,7 @@ func TestProperty9_ComplexNestedStructures(t *testing.T) {
 		MaxCount: 100,
 	}
 
-	// 属性：复杂嵌套结构的解析结果应与 json.Unmarshal 相同
+	// 属性：复杂嵌套结构的解析结果应与 json.Unmarshal（UseNumber）相同
 	property := func(seed int64) bool {
 		r := rand.New(rand.NewSource(seed))
 
@@ -1988,7 +2004,7 @@ func TestProperty9_ComplexNestedStructures(t *testing.T) {
 		jsonStr := jsonValueToString(v)
 
 		var expected map[string]any
-		if json.Unmarshal([]byte(jsonStr), &expected) != nil {
+		if unmarshalUseNumber(jsonStr, &expected) != nil {
 			return true
 		}
 
@@ -2019,7 +2035,7 @@ func TestProperty9_LargeJSONObjects(t *testing.T) {
 		MaxCount: 50, // 大型对象测试次数减少
 	}
 
-	// 属性：大型 JSON 对象的解析结果应与 json.Unmarshal 相同
+	// 属性：大型 JSON 对象的解析结果应与 json.Unmarshal（UseNumber）相同
 	property := func(seed int64) bool {
 		r := rand.New(rand.NewSource(seed))
 
@@ -2036,7 +2052,7 @@ func TestProperty9_LargeJSONObjects(t *testing.T) {
 		jsonStr := jsonValueToString(v)
 
 		var expected map[string]any
-		if json.Unmarshal([]byte(jsonStr), &expected) != nil {
+		if unmarshalUseNumber(jsonStr, &expected) != nil {
 			return true
 		}
 
@@ -2082,7 +2098,7 @@ func TestProperty9_SpecialCharacters(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			var expected map[string]any
-			if err := json.Unmarshal([]byte(tc.input), &expected); err != nil {
+			if err := unmarshalUseNumber(tc.input, &expected); err != nil {
 				t.Fatalf("标准 JSON 解析失败: %v", err)
 			}
 
@@ -2260,7 +2276,7 @@ func TestProperty6_FailureThenSuccess(t *testing.T) {
 			name:          "语法错误后有效JSON",
 			failedInput:   `{"a":1}}`,
 			successInput:  `{"b":2}`,
-			successExpect: map[string]any{"b": float64(2)},
+			successExpect: map[string]any{"b": json.Number("2")},
 		},
 		{
 			name:          "纯文本后有效JSON",
@@ -2272,7 +2288,7 @@ func TestProperty6_FailureThenSuccess(t *testing.T) {
 			name:          "括号不匹配后有效JSON",
 			failedInput:   `{"a":[1,2}`,
 			successInput:  `{"arr":[1,2,3]}`,
-			successExpect: map[string]any{"arr": []any{float64(1), float64(2), float64(3)}},
+			successExpect: map[string]any{"arr": []any{json.Number("1"), json.Number("2"), json.Number("3")}},
 		},
 	}
 
@@ -2862,6 +2878,8 @@ type mockLogger struct {
 	forceDebugCalled bool
 	lastMsgId        string
 	lastMessage      string
+	infoData         []map[string]any
+	warnData         []map[string]any
 }
 
 func (m *mockLogger) Debug(msgId, message string, data map[string]any) {
@@ -2869,8 +2887,12 @@ func (m *mockLogger) Debug(msgId, message string, data map[string]any) {
 	m.lastMsgId = msgId
 	m.lastMessage = message
 }
-func (m *mockLogger) Info(msgId, message string, data map[string]any)  {}
-func (m *mockLogger) Warn(msgId, message string, data map[string]any)  {}
+func (m *mockLogger) Info(msgId, message string, data map[string]any) {
+	m.infoData = append(m.infoData, data)
+}
+func (m *mockLogger) Warn(msgId, message string, data map[string]any) {
+	m.warnData = append(m.warnData, data)
+}
 func (m *mockLogger) Error(msgId, message string, data map[string]any) {}
 func (m *mockLogger) ForceDebug(msgId, message string, data map[string]any) {
 	m.forceDebugCalled = true
@@ -2915,3 +2937,479 @@ func TestDebugLog_NilLogger(t *testing.T) {
 	ctx := context.Background()
 	DebugLog(ctx, nil, "不应panic", nil)
 }
+
+// buildEventStreamMessage 构造一条 AWS EventStream 二进制消息（测试辅助函数）
+func buildEventStreamMessage(eventType string, payload string) []byte {
+	var headers bytes.Buffer
+	writeHeader := func(name, value string) {
+		headers.WriteByte(byte(len(name)))
+		headers.WriteString(name)
+		headers.WriteByte(7) // string 类型
+		_ = binary.Write(&headers, binary.BigEndian, uint16(len(value)))
+		headers.WriteString(value)
+	}
+	writeHeader(":message-type", "event")
+	writeHeader(":event-type", eventType)
+
+	totalLen := uint32(12 + headers.Len() + len(payload) + 4)
+	var msg bytes.Buffer
+	_ = binary.Write(&msg, binary.BigEndian, totalLen)
+	_ = binary.Write(&msg, binary.BigEndian, uint32(headers.Len()))
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()[0:8]))
+	msg.Write(headers.Bytes())
+	msg.WriteString(payload)
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	return msg.Bytes()
+}
+
+// toolUseFragmentsStream 构造一个分三段返回 tool_use input 的 EventStream
+func toolUseFragmentsStream() []byte {
+	var stream bytes.Buffer
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"write","input":"{\"path\":"}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"write","input":"\"a.txt\","}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"write","input":"\"content\":\"hi\"}","stop":true}`))
+	return stream.Bytes()
+}
+
+func TestParseEventStreamWithTools_ToolInputDelta(t *testing.T) {
+	s := &ChatService{}
+	ctx := context.WithValue(context.Background(), ToolInputDeltaKey, true)
+
+	var partials []string
+	var final *KiroToolUse
+	_, err := s.parseEventStreamWithTools(ctx, bytes.NewReader(toolUseFragmentsStream()), ChatOptions{}, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+		if toolUse == nil {
+			return
+		}
+		if toolUse.IsPartial {
+			partials = append(partials, toolUse.PartialInput)
+			return
+		}
+		final = toolUse
+	})
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+
+	if len(partials) != 3 {
+		t.Fatalf("期望 3 个增量片段, got %d", len(partials))
+	}
+	if final == nil {
+		t.Fatal("应在 stop 时回调完整的工具调用")
+	}
+	if strings.Join(partials, "") != final.RawInput {
+		t.Errorf("增量片段拼接结果应等于 RawInput: %q vs %q", strings.Join(partials, ""), final.RawInput)
+	}
+	if final.Input["path"] != "a.txt" || final.Input["content"] != "hi" {
+		t.Errorf("最终 input 解析错误: %v", final.Input)
+	}
+}
+
+func TestParseEventStreamWithTools_ToolInputDeltaDisabled(t *testing.T) {
+	// 未开启增量回调时保持原行为：只回调一次完整工具调用
+	s := &ChatService{}
+	calls := 0
+	_, err := s.parseEventStreamWithTools(context.Background(), bytes.NewReader(toolUseFragmentsStream()), ChatOptions{}, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+		if toolUse != nil {
+			calls++
+			if toolUse.IsPartial {
+				t.Error("未开启时不应回调增量片段")
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("期望回调 1 次, got %d", calls)
+	}
+}
+
+// TestParseEventStreamWithTools_ForwardedEvents 测试关闭转发的辅助事件不再注入文本，其余保持原行为
+func TestParseEventStreamWithTools_ForwardedEvents(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"hello"}`))
+	stream.Write(buildEventStreamMessage("followupPromptEvent", `{"followupPrompt":{"content":"next?"}}`))
+	stream.Write(buildEventStreamMessage("citationEvent", `{"citations":[{"title":"doc","url":"https://example.com"}]}`))
+	data := stream.Bytes()
+
+	parse := func(opts ChatOptions) string {
+		s := &ChatService{}
+		var out strings.Builder
+		_, err := s.parseEventStreamWithTools(context.Background(), bytes.NewReader(data), opts, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+			out.WriteString(content)
+		})
+		if err != nil {
+			t.Fatalf("解析失败: %v", err)
+		}
+		return out.String()
+	}
+
+	// 默认全部转发
+	out := parse(ChatOptions{})
+	if !strings.Contains(out, "Suggested follow-up") || !strings.Contains(out, "Citations") {
+		t.Errorf("默认应转发辅助事件: %q", out)
+	}
+
+	// 关闭 followup；正文事件即使配置为 false 也不受影响
+	out = parse(ChatOptions{ForwardedEvents: map[string]bool{
+		"followupPromptEvent":    false,
+		"citationEvent":          true,
+		"assistantResponseEvent": false,
+	}})
+	if strings.Contains(out, "Suggested follow-up") {
+		t.Errorf("已关闭的事件不应注入: %q", out)
+	}
+	if !strings.HasPrefix(out, "hello") || !strings.Contains(out, "Citations") {
+		t.Errorf("正文和未关闭的事件应保留: %q", out)
+	}
+}
+
+// TestParseEventStreamWithTools_ThinkingFormatNone 测试 none 格式下不回调 reasoning 内容，但仍累计 reasoning tokens
+func TestParseEventStreamWithTools_ThinkingFormatNone(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(buildEventStreamMessage("reasoningContentEvent", `{"text":"let me think about it"}`))
+	stream.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"answer"}`))
+	data := stream.Bytes()
+
+	for _, format := range []ThinkingOutputFormat{ThinkingFormatReasoningContent, ThinkingFormatNone} {
+		s := &ChatService{}
+		thinking := ""
+		usage, err := s.parseEventStreamWithTools(context.Background(), bytes.NewReader(data), ChatOptions{ThinkingFormat: format}, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+			if isThinking {
+				thinking += content
+			}
+		})
+		if err != nil {
+			t.Fatalf("解析失败: %v", err)
+		}
+		if format == ThinkingFormatNone && thinking != "" {
+			t.Errorf("none 格式不应输出 thinking: %q", thinking)
+		}
+		if format != ThinkingFormatNone && thinking != "let me think about it" {
+			t.Errorf("%s 格式应输出 thinking, 得到 %q", format, thinking)
+		}
+		if usage.ReasoningTokens == 0 {
+			t.Errorf("%s 格式应累计 reasoning tokens", format)
+		}
+	}
+}
+
+// collectThinkingOutput 把文本按切分点分块喂给 ThinkingTextProcessor，收集 thinking 与普通文本输出
+func collectThinkingOutput(format ThinkingOutputFormat, chunks []string) (thinking string, text string, thinkingCalls int) {
+	p := NewThinkingTextProcessor(format, func(s string, isThinking bool) {
+		if isThinking {
+			thinking += s
+			thinkingCalls++
+		} else {
+			text += s
+		}
+	})
+	for _, chunk := range chunks {
+		p.ProcessText(chunk, false)
+	}
+	p.Flush()
+	return thinking, text, thinkingCalls
+}
+
+func TestThinkingTextProcessor_TagStraddlesChunks(t *testing.T) {
+	before := strings.Repeat("前文内容", 20)
+	thinkingText := "逐步思考：先分析问题，再给出结论 </thinkin 不是结束标签"
+	after := "最终回答"
+	full := before + "<thinking>" + thinkingText + "</thinking>" + after
+
+	// 在每个字节边界切成两块（跳过 UTF-8 字符中间，上游事件不会切在字符中间）
+	for i := 1; i < len(full); i++ {
+		if !utf8.RuneStart(full[i]) {
+			continue
+		}
+		thinking, text, _ := collectThinkingOutput(ThinkingFormatReasoningContent, []string{full[:i], full[i:]})
+		if thinking != thinkingText {
+			t.Fatalf("切分点 %d: thinking 输出错误: %q", i, thinking)
+		}
+		if text != before+after {
+			t.Fatalf("切分点 %d: 文本输出错误: %q", i, text)
+		}
+	}
+}
+
+func TestThinkingTextProcessor_IncrementalThinking(t *testing.T) {
+	// thinking 内容应随输入增量输出，而不是等到结束标签才一次性输出
+	chunks := []string{"<thinking>第一段思考", "，第二段思考", "，第三段</thin", "king>回答"}
+	thinking, text, calls := collectThinkingOutput(ThinkingFormatReasoningContent, chunks)
+	if thinking != "第一段思考，第二段思考，第三段" {
+		t.Errorf("thinking 输出错误: %q", thinking)
+	}
+	if text != "回答" {
+		t.Errorf("文本输出错误: %q", text)
+	}
+	if calls < 3 {
+		t.Errorf("thinking 应增量输出, 实际回调 %d 次", calls)
+	}
+}
+
+func TestThinkingTextProcessor_IncrementalTagFormat(t *testing.T) {
+	// 标签格式增量输出时，开始/结束标签各只出现一次
+	chunks := []string{"<thinking>第一段", "第二段</thinking>", "回答"}
+	_, text, _ := collectThinkingOutput(ThinkingFormatThink, chunks)
+	if text != "<think>第一段第二段</think>回答" {
+		t.Errorf("标签格式输出错误: %q", text)
+	}
+
+	// 未闭合的 thinking 块在 Flush 时补上结束标签
+	_, text, _ = collectThinkingOutput(ThinkingFormatThinking, []string{"<thinking>没有结束"})
+	if text != "<thinking>没有结束</thinking>" {
+		t.Errorf("未闭合块输出错误: %q", text)
+	}
+}
+
+func TestThinkingTextProcessor_NoneFormat(t *testing.T) {
+	// none 格式丢弃 thinking 内容，只保留正文
+	chunks := []string{"前文<thinking>第一段", "第二段</thinking>", "回答"}
+	thinking, text, _ := collectThinkingOutput(ThinkingFormatNone, chunks)
+	if thinking != "" {
+		t.Errorf("none 格式不应输出 thinking: %q", thinking)
+	}
+	if text != "前文回答" {
+		t.Errorf("none 格式正文输出错误: %q", text)
+	}
+}
+
+func TestPartialTagSuffixLen(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"abc", 0},
+		{"abc<", 1},
+		{"abc</thi", 5},
+		{"abc</thinking", 10},
+		{"</thinkin", 9},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := partialTagSuffixLen(tt.s, "</thinking>"); got != tt.want {
+			t.Errorf("partialTagSuffixLen(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestDescribeConversationState_Redacted(t *testing.T) {
+	secret := "用户的私密内容-secret"
+	body, _ := json.Marshal(map[string]any{
+		"conversationState": map[string]any{
+			"conversationId":  "conv-1",
+			"chatTriggerType": "MANUAL",
+			"history": []any{
+				map[string]any{"userInputMessage": map[string]any{"content": secret, "origin": "AI_EDITOR"}},
+				map[string]any{"assistantResponseMessage": map[string]any{"content": "", "toolUses": []any{map[string]any{"toolUseId": "t1"}}}},
+			},
+			"currentMessage": map[string]any{
+				"userInputMessage": map[string]any{
+					"content": secret,
+					"modelId": "claude-sonnet-4.5",
+					"images":  []any{map[string]any{"format": "png", "source": map[string]any{"bytes": secret}}},
+					"userInputMessageContext": map[string]any{
+						"tools":       []any{map[string]any{"toolSpecification": map[string]any{"name": "Read"}}},
+						"toolResults": []any{map[string]any{"toolUseId": "t1", "content": secret}},
+					},
+				},
+			},
+		},
+	})
+
+	info := describeConversationState(body)
+	if data, _ := json.Marshal(info); strings.Contains(string(data), secret) {
+		t.Fatalf("诊断信息不应包含消息内容: %s", data)
+	}
+
+	want := map[string]any{
+		"historyCount":        2,
+		"historyRoles":        "UA",
+		"historyEmptyContent": 1,
+		"historyToolUses":     1,
+		"currentContentLen":   len(secret),
+		"currentImages":       1,
+		"currentTools":        1,
+		"currentToolResults":  1,
+		"hasCurrentMessage":   true,
+	}
+	for k, v := range want {
+		if info[k] != v {
+			t.Errorf("%s = %v, want %v", k, info[k], v)
+		}
+	}
+}
+
+func TestIsImproperlyFormedRequestError(t *testing.T) {
+	err := errors.New(`请求失败 [400]: {"message":"Improperly formed request."}`)
+	if !IsImproperlyFormedRequestError(err) {
+		t.Error("应识别请求格式错误")
+	}
+	if !IsNonCircuitBreakingError(err) {
+		t.Error("请求格式错误不应触发熔断")
+	}
+	if IsImproperlyFormedRequestError(errors.New("请求失败 [500]: internal")) || IsImproperlyFormedRequestError(nil) {
+		t.Error("其他错误不应识别为请求格式错误")
+	}
+}
+
+func TestDecodeResponseBody_CompressedEventStream(t *testing.T) {
+	var raw bytes.Buffer
+	raw.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"你好，"}`))
+	raw.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"压缩的事件流"}`))
+
+	compress := map[string]func([]byte) []byte{
+		"": func(b []byte) []byte { return b },
+		"gzip": func(b []byte) []byte {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			_, _ = w.Write(b)
+			_ = w.Close()
+			return buf.Bytes()
+		},
+		"deflate": func(b []byte) []byte {
+			var buf bytes.Buffer
+			w := zlib.NewWriter(&buf)
+			_, _ = w.Write(b)
+			_ = w.Close()
+			return buf.Bytes()
+		},
+	}
+
+	for encoding, fn := range compress {
+		t.Run("encoding="+encoding, func(t *testing.T) {
+			resp := &http.Response{
+				Header: http.Header{},
+				Body:   io.NopCloser(bytes.NewReader(fn(raw.Bytes()))),
+			}
+			if encoding != "" {
+				resp.Header.Set("Content-Encoding", encoding)
+			}
+			body, err := decodeResponseBody(resp)
+			if err != nil {
+				t.Fatalf("解压失败: %v", err)
+			}
+
+			var text string
+			s := &ChatService{}
+			if _, err := s.parseEventStream(context.Background(), body, func(content string, done bool) {
+				text += content
+			}); err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if text != "你好，压缩的事件流" {
+				t.Errorf("解析结果错误: %q", text)
+			}
+		})
+	}
+
+	// 裸 deflate（无 zlib 头）同样能解压
+	var rawDeflate bytes.Buffer
+	fw, _ := flate.NewWriter(&rawDeflate, flate.DefaultCompression)
+	_, _ = fw.Write(raw.Bytes())
+	_ = fw.Close()
+	body, err := decodeResponseBody(&http.Response{
+		Header: http.Header{"Content-Encoding": {"deflate"}},
+		Body:   io.NopCloser(&rawDeflate),
+	})
+	if err != nil {
+		t.Fatalf("裸 deflate 解压失败: %v", err)
+	}
+	if decoded, _ := io.ReadAll(body); !bytes.Equal(decoded, raw.Bytes()) {
+		t.Error("裸 deflate 解压结果不一致")
+	}
+
+	resp := &http.Response{Header: http.Header{"Content-Encoding": {"br"}}, Body: io.NopCloser(bytes.NewReader(nil))}
+	if _, err := decodeResponseBody(resp); err == nil {
+		t.Error("不支持的编码应返回错误")
+	}
+}
+
+// TestParseEventStreamWithTools_MultipleToolUses 测试一轮中多个工具调用各自独立回调，迟到事件不影响当前工具
+func TestParseEventStreamWithTools_MultipleToolUses(t *testing.T) {
+	var stream bytes.Buffer
+	// 第一个工具带 stop，第二个工具不带 stop（由下一个工具开始时结束），第三个工具在流结束时收尾
+	stream.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"先读两个文件"}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"read","input":"{\"path\":\"a.txt\"}"}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"read","stop":true}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t2","name":"read","input":"{\"path\":"}`))
+	// t1 的迟到事件：不应结束 t2，也不应把内容拼进 t2
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t1","name":"read","input":"junk","stop":true}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t2","name":"read","input":"\"b.txt\"}"}`))
+	stream.Write(buildEventStreamMessage("toolUseEvent", `{"toolUseId":"t3","name":"write","input":"{\"path\":\"c.txt\"}"}`))
+
+	s := &ChatService{}
+	var toolUses []*KiroToolUse
+	_, err := s.parseEventStreamWithTools(context.Background(), bytes.NewReader(stream.Bytes()), ChatOptions{}, func(content string, toolUse *KiroToolUse, done bool, isThinking bool) {
+		if toolUse != nil {
+			toolUses = append(toolUses, toolUse)
+		}
+	})
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+
+	expect := []struct{ id, path string }{{"t1", "a.txt"}, {"t2", "b.txt"}, {"t3", "c.txt"}}
+	if len(toolUses) != len(expect) {
+		t.Fatalf("期望 %d 个工具调用, 得到 %d", len(expect), len(toolUses))
+	}
+	for i, e := range expect {
+		if toolUses[i].ToolUseId != e.id || toolUses[i].Input["path"] != e.path || toolUses[i].Truncated {
+			t.Errorf("第 %d 个工具调用错误: %+v", i, toolUses[i])
+		}
+	}
+}
+
+// TestParseToolInput_NumberPrecision 大整数和高精度小数解析后重新序列化保持原样
+func TestParseToolInput_NumberPrecision(t *testing.T) {
+	input := `{"id":9007199254740993123,"ratio":0.12345678901234567890123,"nested":{"ids":[18446744073709551615]}}`
+	result, ok, truncated := parseToolInput(input)
+	if !ok || truncated {
+		t.Fatalf("有效 JSON 应解析成功, ok=%v truncated=%v", ok, truncated)
+	}
+	if _, isNumber := result["id"].(json.Number); !isNumber {
+		t.Fatalf("数字应保留为 json.Number, 得到 %T", result["id"])
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		t.Fatalf("序列化失败: %v", err)
+	}
+	want := `{"id":9007199254740993123,"nested":{"ids":[18446744073709551615]},"ratio":0.12345678901234567890123}`
+	if string(out) != want {
+		t.Errorf("数字精度丢失\n期望: %s\n实际: %s", want, out)
+	}
+
+	// 截断修复后的输入同样保留精度
+	result, ok, truncated = parseToolInput(`{"id":9007199254740993123,"path":"/tmp/a`)
+	if !ok || !truncated {
+		t.Fatalf("截断 JSON 应修复成功, ok=%v truncated=%v", ok, truncated)
+	}
+	if id, _ := result["id"].(json.Number); id.String() != "9007199254740993123" {
+		t.Errorf("截断修复后 id 精度丢失: %v", result["id"])
+	}
+}
+
+// TestLogIgnoredGenerationParams 只记录客户端设置了的生成参数，零值也算设置，全部未设置时不记录
+func TestLogIgnoredGenerationParams(t *testing.T) {
+	ml := &mockLogger{}
+	s := &ChatService{logger: ml}
+
+	s.logIgnoredGenerationParams(context.Background(), ChatOptions{MaxTokens: 100})
+	if len(ml.infoData) != 0 {
+		t.Fatalf("未设置生成参数时不应记录: %v", ml.infoData)
+	}
+
+	temperature, topK := 0.0, 0
+	s.logIgnoredGenerationParams(context.Background(), ChatOptions{Temperature: &temperature, TopK: &topK})
+	if len(ml.infoData) != 1 {
+		t.Fatalf("应记录 1 条日志, 得到 %d", len(ml.infoData))
+	}
+	data := ml.infoData[0]
+	if data["temperature"] != 0.0 || data["topK"] != 0 {
+		t.Errorf("显式传入的 0 也应记录: %v", data)
+	}
+	if _, ok := data["topP"]; ok {
+		t.Errorf("未设置的 topP 不应出现: %v", data)
+	}
+}
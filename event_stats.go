@@ -0,0 +1,111 @@
+package kiroclient
+
+import (
+	"context"
+	"sync"
+)
+
+// ========== EventStream 事件类型统计 ==========
+
+// KnownEventTypes 解析器能识别的 EventStream 事件类型（含辅助事件）
+// 新增事件处理时在这里登记，否则会被统计为未知类型
+var KnownEventTypes = append([]string{
+	"assistantResponseEvent",
+	"reasoningContentEvent",
+	"toolUseEvent",
+	"messageMetadataEvent",
+	"meteringEvent",
+}, AuxiliaryEventTypes...)
+
+// UnknownEventTypeKey 未识别事件类型在 Counts 中的汇总 key
+const UnknownEventTypeKey = "unknown"
+
+const (
+	maxUnknownEventTypes = 100  // 未知类型明细最多记录的种类数，防止异常上游撑爆内存
+	maxEventSampleLen    = 1000 // 首次出现日志中 payload 样本的最大长度
+)
+
+// EventTypeStats EventStream 事件类型计数快照
+type EventTypeStats struct {
+	Counts  map[string]int64 `json:"counts"`  // 已知类型按名称计数，未知类型统一计入 "unknown"
+	Unknown map[string]int64 `json:"unknown"` // 未识别事件类型的明细
+}
+
+// eventTypeCounter 事件类型计数器（零值可用）
+type eventTypeCounter struct {
+	mu      sync.Mutex
+	counts  map[string]int64
+	unknown map[string]int64
+}
+
+// isKnownEventType 判断事件类型是否能被解析器识别
+func isKnownEventType(eventType string) bool {
+	for _, t := range KnownEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// record 计数一次事件，返回 true 表示这是首次出现的未知类型
+func (c *eventTypeCounter) record(eventType string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+		c.unknown = make(map[string]int64)
+	}
+	if isKnownEventType(eventType) {
+		c.counts[eventType]++
+		return false
+	}
+	c.counts[UnknownEventTypeKey]++
+	if _, seen := c.unknown[eventType]; seen {
+		c.unknown[eventType]++
+		return false
+	}
+	if len(c.unknown) >= maxUnknownEventTypes {
+		return false
+	}
+	c.unknown[eventType] = 1
+	return true
+}
+
+// snapshot 返回计数快照
+func (c *eventTypeCounter) snapshot() EventTypeStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := EventTypeStats{
+		Counts:  make(map[string]int64, len(c.counts)),
+		Unknown: make(map[string]int64, len(c.unknown)),
+	}
+	for k, v := range c.counts {
+		stats.Counts[k] = v
+	}
+	for k, v := range c.unknown {
+		stats.Unknown[k] = v
+	}
+	return stats
+}
+
+// recordEventType 统计解析到的事件类型，未知类型首次出现时记录 INFO 日志和 payload 样本
+// 为什么：Kiro 新增的事件类型会被解析器静默忽略，计数和首次日志用于及早发现上游协议变化
+func (s *ChatService) recordEventType(ctx context.Context, eventType string, payload []byte) {
+	if !s.eventStats.record(eventType) || s.logger == nil {
+		return
+	}
+	sample := []rune(string(payload))
+	if len(sample) > maxEventSampleLen {
+		sample = append(sample[:maxEventSampleLen], []rune("...")...)
+	}
+	s.logger.Info(getMsgIdFromCtx(ctx), "EventStream: 发现未识别的事件类型", map[string]any{
+		"eventType": eventType,
+		"sample":    string(sample),
+	})
+}
+
+// GetEventTypeStats 返回 EventStream 事件类型计数
+func (s *ChatService) GetEventTypeStats() EventTypeStats {
+	return s.eventStats.snapshot()
+}
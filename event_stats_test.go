@@ -0,0 +1,48 @@
+package kiroclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestEventTypeStats_UnknownEvent 测试未知事件类型计入 unknown 汇总，且只在首次出现时记录日志
+func TestEventTypeStats_UnknownEvent(t *testing.T) {
+	var stream bytes.Buffer
+	stream.Write(buildEventStreamMessage("assistantResponseEvent", `{"content":"hi"}`))
+	stream.Write(buildEventStreamMessage("brandNewEvent", `{"foo":"bar"}`))
+	stream.Write(buildEventStreamMessage("brandNewEvent", `{"foo":"baz"}`))
+	stream.Write(buildEventStreamMessage("meteringEvent", `{"usage":0.1}`))
+
+	ml := &mockLogger{}
+	s := &ChatService{logger: ml}
+	var content string
+	_, err := s.parseEventStreamWithTools(context.Background(), bytes.NewReader(stream.Bytes()), ChatOptions{}, func(c string, toolUse *KiroToolUse, done bool, isThinking bool) {
+		content += c
+	})
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if content != "hi" {
+		t.Errorf("未知事件不应影响正文输出: %q", content)
+	}
+
+	stats := s.GetEventTypeStats()
+	if stats.Counts["assistantResponseEvent"] != 1 || stats.Counts["meteringEvent"] != 1 {
+		t.Errorf("已知事件计数错误: %v", stats.Counts)
+	}
+	if stats.Counts[UnknownEventTypeKey] != 2 || stats.Unknown["brandNewEvent"] != 2 {
+		t.Errorf("未知事件应计入汇总和明细: %+v", stats)
+	}
+	if _, ok := stats.Counts["brandNewEvent"]; ok {
+		t.Errorf("未知事件不应出现在已知计数中: %v", stats.Counts)
+	}
+
+	// 首次出现记录一次 INFO，带 payload 样本
+	if len(ml.infoData) != 1 {
+		t.Fatalf("期望 1 条 INFO 日志, 得到 %d", len(ml.infoData))
+	}
+	if ml.infoData[0]["eventType"] != "brandNewEvent" || ml.infoData[0]["sample"] != `{"foo":"bar"}` {
+		t.Errorf("INFO 日志内容错误: %v", ml.infoData[0])
+	}
+}
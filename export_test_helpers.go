@@ -1,5 +1,7 @@
 package kiroclient
 
+import "net/http"
+
 // SetAccountsCacheForTest 仅供外部包测试使用
 // 为什么需要：server 包的测试需要注入测试账号到 AuthManager，
 // 但 accountsCache 是未导出字段，无法从外部包直接访问
@@ -9,3 +11,28 @@ func (m *AuthManager) SetAccountsCacheForTest(config *AccountsConfig) {
 	m.accountsCache = config
 	m.accountsLoaded = true
 }
+
+// SetHTTPClientForTest 仅供外部包测试使用
+// 为什么需要：server 包的测试需要把上游请求指向本地 mock 服务，
+// 但 httpClient 是未导出字段，无法从外部包直接替换
+func (s *ChatService) SetHTTPClientForTest(hc *http.Client) {
+	s.httpClient = hc
+}
+
+// SetUsageCacheForTest 仅供外部包测试使用
+// 为什么需要：server 包的测试需要模拟额度耗尽的账号，usageCache 是未导出字段
+func (m *AuthManager) SetUsageCacheForTest(accountID string, used, total float64) {
+	m.updateUsageCache(accountID, used, total)
+}
+
+// SetHTTPClientForTest 仅供外部包测试使用
+// 为什么需要：server 包的自检诊断测试需要把 MCP 请求也指向本地 mock 服务
+func (c *MCPClient) SetHTTPClientForTest(hc *http.Client) {
+	c.httpClient = hc
+}
+
+// SetHTTPClientForTest 仅供外部包测试使用
+// 为什么需要：server 包的测试需要把额度查询等认证相关请求指向本地 mock 服务
+func (m *AuthManager) SetHTTPClientForTest(hc *http.Client) {
+	m.httpClient = hc
+}
@@ -0,0 +1,132 @@
+package kiroclient
+
+import (
+	"context"
+	"errors"
+)
+
+// ========== 客户端侧 max_tokens 截断 ==========
+// Kiro API 不接受 max_tokens，ChatOptions.MaxTokens 大于 0 时由 ChatService 在本地截断：
+// 按 CountTokens 逐段估算累计输出（正文、thinking 和工具调用 input，分段计数相加，与整段计数略有出入），
+// 达到上限后丢弃之后的内容、取消上游请求，再以正常结束（done 回调、无错误）收尾
+
+// MaxTokensObserverKey context key，值为 func()：输出因 ChatOptions.MaxTokens 被截断时回调一次（在 done 回调之前）
+// server 据此把 stop_reason 设为 max_tokens
+const MaxTokensObserverKey = "maxTokensObserver"
+
+// outputLimiter 单次调用的输出截断状态（调用链内同步使用，不需要加锁）
+type outputLimiter struct {
+	parent   context.Context
+	limit    int
+	used     int
+	reached  bool
+	doneSent bool
+	cancel   context.CancelFunc
+	streamed map[string]bool // 已按增量片段计数的工具调用，完成时不再重复计数
+}
+
+// newOutputLimiter limit 大于 0 时返回挂了取消函数的 context 和截断器，否则原样返回 ctx 和 nil（所有方法可在 nil 上调用）
+func newOutputLimiter(ctx context.Context, limit int) (context.Context, *outputLimiter) {
+	if limit <= 0 {
+		return ctx, nil
+	}
+	limited, cancel := context.WithCancel(ctx)
+	return limited, &outputLimiter{parent: ctx, limit: limit, cancel: cancel, streamed: make(map[string]bool)}
+}
+
+// take 返回 text 中还能输出的部分：超出剩余额度时按 rune 截到额度内并标记截断，截断后总是返回空串
+func (l *outputLimiter) take(text string) string {
+	if l == nil || text == "" {
+		return text
+	}
+	if l.reached {
+		return ""
+	}
+	tokens := CountTokens(text)
+	if l.used+tokens <= l.limit {
+		l.used += tokens
+		return text
+	}
+	// 二分找出估算 token 数不超过剩余额度的最长前缀
+	remaining := l.limit - l.used
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if CountTokens(string(runes[:mid])) <= remaining {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	l.markReached()
+	return string(runes[:lo])
+}
+
+// takeToolUse 工具调用计入输出：增量片段按文本截断，完整调用超出额度时整体丢弃（返回 nil）
+func (l *outputLimiter) takeToolUse(toolUse *KiroToolUse) *KiroToolUse {
+	if l == nil || toolUse == nil {
+		return toolUse
+	}
+	if l.reached {
+		return nil
+	}
+	if toolUse.IsPartial {
+		l.streamed[toolUse.ToolUseId] = true
+		partial := l.take(toolUse.PartialInput)
+		if partial == "" {
+			return nil
+		}
+		clipped := *toolUse
+		clipped.PartialInput = partial
+		return &clipped
+	}
+	if l.streamed[toolUse.ToolUseId] {
+		return toolUse
+	}
+	tokens := CountTokens(toolUse.RawInput)
+	if l.used+tokens > l.limit {
+		l.markReached()
+		return nil
+	}
+	l.used += tokens
+	return toolUse
+}
+
+// markReached 达到上限：取消上游请求并通知 MaxTokensObserverKey
+func (l *outputLimiter) markReached() {
+	l.used = l.limit
+	l.reached = true
+	l.cancel()
+	if observe, ok := l.parent.Value(MaxTokensObserverKey).(func()); ok {
+		observe()
+	}
+}
+
+// observeDone 记录 done 是否已经回调过，返回 false 表示截断后上游又送来了 done（已补发过，不再重复）
+func (l *outputLimiter) observeDone() bool {
+	if l == nil {
+		return true
+	}
+	if l.doneSent {
+		return false
+	}
+	l.doneSent = true
+	return true
+}
+
+// finish 调用结束时收尾：因截断取消上游导致的错误视为正常结束，返回是否需要补发 done 回调
+// 调用方自身的 context 已结束（客户端断开、超时）时保持原错误
+func (l *outputLimiter) finish(err error) (bool, error) {
+	if l == nil {
+		return false, err
+	}
+	defer l.cancel()
+	if !l.reached || l.parent.Err() != nil {
+		return false, err
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		return false, err
+	}
+	return !l.doneSent, nil
+}
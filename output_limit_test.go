@@ -0,0 +1,83 @@
+package kiroclient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestOutputLimiter_Take 达到上限时截断到额度内、取消上游并只通知一次，之后的内容全部丢弃
+func TestOutputLimiter_Take(t *testing.T) {
+	observed := 0
+	parent := context.WithValue(context.Background(), MaxTokensObserverKey, func() { observed++ })
+	ctx, limiter := newOutputLimiter(parent, 10)
+
+	first := limiter.take("hello")
+	if first != "hello" {
+		t.Fatalf("额度内的文本应原样返回, 得到 %q", first)
+	}
+	long := strings.Repeat("word ", 50)
+	clipped := limiter.take(long)
+	if clipped == "" || !strings.HasPrefix(long, clipped) || len(clipped) == len(long) {
+		t.Fatalf("超出额度时应返回截断后的前缀, 得到 %q", clipped)
+	}
+	if got := CountTokens(first) + CountTokens(clipped); got > 10 {
+		t.Errorf("输出估算 token 数 %d 超过上限 10", got)
+	}
+	if ctx.Err() == nil {
+		t.Error("达到上限后应取消上游请求的 context")
+	}
+	if limiter.take("more") != "" || limiter.takeToolUse(&KiroToolUse{ToolUseId: "t1", RawInput: "{}"}) != nil {
+		t.Error("达到上限后的内容和工具调用都应丢弃")
+	}
+	if observed != 1 {
+		t.Errorf("截断回调应只触发一次, 实际 %d", observed)
+	}
+
+	// 上游因取消而返回的错误视为正常结束，需要补发 done
+	sendDone, err := limiter.finish(context.Canceled)
+	if err != nil || !sendDone {
+		t.Errorf("截断导致的取消应视为正常结束并补发 done, sendDone=%v err=%v", sendDone, err)
+	}
+}
+
+// TestOutputLimiter_ToolUse 增量片段计入额度后，完成的工具调用不再重复计数；超出额度的完整调用整体丢弃
+func TestOutputLimiter_ToolUse(t *testing.T) {
+	_, limiter := newOutputLimiter(context.Background(), 20)
+	partial := &KiroToolUse{ToolUseId: "t1", IsPartial: true, PartialInput: `{"a":1}`}
+	if got := limiter.takeToolUse(partial); got == nil || got.PartialInput != partial.PartialInput {
+		t.Fatalf("额度内的片段应原样返回, 得到 %+v", got)
+	}
+	used := limiter.used
+	complete := &KiroToolUse{ToolUseId: "t1", RawInput: `{"a":1}`}
+	if limiter.takeToolUse(complete) != complete || limiter.used != used {
+		t.Error("已按片段计数的工具调用完成时应原样返回且不重复计数")
+	}
+
+	big := &KiroToolUse{ToolUseId: "t2", RawInput: `{"text":"` + strings.Repeat("word ", 100) + `"}`}
+	if limiter.takeToolUse(big) != nil || !limiter.reached {
+		t.Error("超出额度的完整工具调用应整体丢弃并标记截断")
+	}
+}
+
+// TestOutputLimiter_Finish 未截断或调用方自身 context 已结束时保持原错误
+func TestOutputLimiter_Finish(t *testing.T) {
+	if ctx, limiter := newOutputLimiter(context.Background(), 0); limiter != nil || ctx != context.Background() {
+		t.Error("MaxTokens 为 0 时不应启用截断")
+	}
+
+	upstreamErr := errors.New("upstream failed")
+	_, limiter := newOutputLimiter(context.Background(), 100)
+	if sendDone, err := limiter.finish(upstreamErr); sendDone || err != upstreamErr {
+		t.Errorf("未截断时应保持原错误, sendDone=%v err=%v", sendDone, err)
+	}
+
+	parent, cancel := context.WithCancel(context.Background())
+	_, limiter = newOutputLimiter(parent, 1)
+	limiter.take(strings.Repeat("word ", 10))
+	cancel()
+	if sendDone, err := limiter.finish(context.Canceled); sendDone || !errors.Is(err, context.Canceled) {
+		t.Errorf("调用方 context 已结束时应保持取消错误, sendDone=%v err=%v", sendDone, err)
+	}
+}
@@ -0,0 +1,56 @@
+package kiroclient
+
+import (
+	"context"
+	"sync"
+)
+
+// ========== 上游请求体捕获（支持包） ==========
+// server 对带 X-Kiro-Capture 的请求给 context 挂上 *PayloadCapture，ChatService 每次发往 Kiro 前记录请求体，
+// 用于生成可复现问题的支持包；没有挂 PayloadCapture 时记录是空操作
+
+// payloadCaptureKey PayloadCapture 的 context key
+type payloadCaptureKey struct{}
+
+// maxCapturedPayloads 单个请求最多记录的上游请求体数（空响应重试、账号降级会产生多次请求）
+const maxCapturedPayloads = 5
+
+// PayloadCapture 单个请求发往 Kiro 的请求体（方法均可在 nil 上调用）
+type PayloadCapture struct {
+	mu       sync.Mutex
+	payloads []string
+}
+
+// WithPayloadCapture 创建 PayloadCapture 并挂到 context 上
+func WithPayloadCapture(ctx context.Context) (context.Context, *PayloadCapture) {
+	p := &PayloadCapture{}
+	return context.WithValue(ctx, payloadCaptureKey{}, p), p
+}
+
+// PayloadCaptureFrom 从 context 取出 PayloadCapture（没有时返回 nil）
+func PayloadCaptureFrom(ctx context.Context) *PayloadCapture {
+	p, _ := ctx.Value(payloadCaptureKey{}).(*PayloadCapture)
+	return p
+}
+
+// record 记录一次上游请求体，超过上限的不再记录
+func (p *PayloadCapture) record(body []byte) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.payloads) < maxCapturedPayloads {
+		p.payloads = append(p.payloads, string(body))
+	}
+}
+
+// Payloads 返回已记录的上游请求体（按发送顺序）
+func (p *PayloadCapture) Payloads() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.payloads...)
+}
@@ -0,0 +1,113 @@
+package kiroclient
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ========== 上游请求体大小统计 ==========
+// 为什么：CONTENT_LENGTH_EXCEEDS_THRESHOLD 只有发出去之后才知道，记录每次构造的 conversationState 大小，
+// 便于按实际分布设置上下文裁剪阈值，并在超过阈值时提前告警
+
+// payloadSizeBounds 直方图各桶的上界（字节），超过最后一个上界的计入 "+Inf"
+var payloadSizeBounds = []int{16 << 10, 64 << 10, 256 << 10, 512 << 10, 1 << 20, 2 << 20}
+
+// PayloadSizeBucket 直方图的一个桶
+type PayloadSizeBucket struct {
+	Le    string `json:"le"`    // 上界（如 64KB、+Inf）
+	Count int64  `json:"count"` // 落在 (上一个上界, Le] 内的请求数
+}
+
+// PayloadSizeStats 上游请求体大小统计快照
+type PayloadSizeStats struct {
+	Count      int64               `json:"count"`
+	TotalBytes int64               `json:"totalBytes"`
+	MaxBytes   int                 `json:"maxBytes"`
+	Buckets    []PayloadSizeBucket `json:"buckets"`
+}
+
+// payloadSizeHistogram 请求体大小直方图（零值可用）
+type payloadSizeHistogram struct {
+	mu         sync.Mutex
+	counts     []int64 // 与 payloadSizeBounds 对应，最后一个为 +Inf
+	count      int64
+	totalBytes int64
+	maxBytes   int
+}
+
+// record 记录一次请求体大小
+func (h *payloadSizeHistogram) record(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]int64, len(payloadSizeBounds)+1)
+	}
+	i := 0
+	for i < len(payloadSizeBounds) && size > payloadSizeBounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.count++
+	h.totalBytes += int64(size)
+	if size > h.maxBytes {
+		h.maxBytes = size
+	}
+}
+
+// snapshot 返回统计快照
+func (h *payloadSizeHistogram) snapshot() PayloadSizeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := PayloadSizeStats{
+		Count:      h.count,
+		TotalBytes: h.totalBytes,
+		MaxBytes:   h.maxBytes,
+		Buckets:    make([]PayloadSizeBucket, 0, len(payloadSizeBounds)+1),
+	}
+	for i := 0; i <= len(payloadSizeBounds); i++ {
+		le := "+Inf"
+		if i < len(payloadSizeBounds) {
+			le = formatPayloadBound(payloadSizeBounds[i])
+		}
+		var n int64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		stats.Buckets = append(stats.Buckets, PayloadSizeBucket{Le: le, Count: n})
+	}
+	return stats
+}
+
+// formatPayloadBound 把字节上界格式化为 KB/MB
+func formatPayloadBound(n int) string {
+	if n >= 1<<20 {
+		return fmt.Sprintf("%dMB", n>>20)
+	}
+	return fmt.Sprintf("%dKB", n>>10)
+}
+
+// recordPayloadSize 统计发往上游的请求体大小
+// 超过 opts.PayloadWarnBytes（>0 时）记录 WARN 日志，否则只在 DEBUG 日志中输出
+func (s *ChatService) recordPayloadSize(ctx context.Context, body []byte, messageCount, historyCount int, opts ChatOptions) {
+	s.payloadStats.record(len(body))
+	if s.logger == nil {
+		return
+	}
+	data := map[string]any{
+		"payloadBytes": len(body),
+		"messageCount": messageCount,
+		"historyCount": historyCount,
+	}
+	if opts.PayloadWarnBytes > 0 && len(body) > opts.PayloadWarnBytes {
+		data["thresholdBytes"] = opts.PayloadWarnBytes
+		s.logger.Warn(getMsgIdFromCtx(ctx), "上游请求体超过告警阈值", data)
+		return
+	}
+	DebugLog(ctx, s.logger, "上游请求体大小", data)
+}
+
+// GetPayloadSizeStats 返回上游请求体大小统计
+func (s *ChatService) GetPayloadSizeStats() PayloadSizeStats {
+	return s.payloadStats.snapshot()
+}
@@ -0,0 +1,49 @@
+package kiroclient
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestRecordPayloadSize 测试请求体大小计入直方图，超过阈值时记录 WARN 日志，未超过只输出 DEBUG
+func TestRecordPayloadSize(t *testing.T) {
+	ml := &mockLogger{}
+	s := &ChatService{logger: ml}
+	ctx := context.Background()
+	opts := ChatOptions{PayloadWarnBytes: 100 << 10}
+
+	s.recordPayloadSize(ctx, bytes.Repeat([]byte("a"), 10<<10), 3, 2, opts)
+	if len(ml.warnData) != 0 || !ml.debugCalled {
+		t.Fatalf("未超过阈值只应输出 DEBUG: warn=%d debug=%v", len(ml.warnData), ml.debugCalled)
+	}
+
+	s.recordPayloadSize(ctx, bytes.Repeat([]byte("a"), 300<<10), 40, 39, opts)
+	if len(ml.warnData) != 1 {
+		t.Fatalf("超过阈值应输出 1 条 WARN, 得到 %d", len(ml.warnData))
+	}
+	warn := ml.warnData[0]
+	if warn["payloadBytes"] != 300<<10 || warn["messageCount"] != 40 || warn["historyCount"] != 39 || warn["thresholdBytes"] != 100<<10 {
+		t.Errorf("WARN 日志内容错误: %v", warn)
+	}
+
+	// 阈值为 0 时不告警
+	s.recordPayloadSize(ctx, bytes.Repeat([]byte("a"), 3<<20), 1, 0, ChatOptions{})
+	if len(ml.warnData) != 1 {
+		t.Errorf("阈值为 0 时不应告警, 共 %d 条", len(ml.warnData))
+	}
+
+	stats := s.GetPayloadSizeStats()
+	if stats.Count != 3 || stats.MaxBytes != 3<<20 || stats.TotalBytes != int64(10<<10+300<<10+3<<20) {
+		t.Errorf("汇总统计错误: %+v", stats)
+	}
+	want := map[string]int64{"16KB": 1, "512KB": 1, "+Inf": 1}
+	for _, b := range stats.Buckets {
+		if b.Count != want[b.Le] {
+			t.Errorf("桶 %s 期望 %d, 得到 %d", b.Le, want[b.Le], b.Count)
+		}
+	}
+	if len(stats.Buckets) != len(payloadSizeBounds)+1 {
+		t.Errorf("桶数量错误: %d", len(stats.Buckets))
+	}
+}
@@ -0,0 +1,94 @@
+package kiroclient
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ========== 请求耗时分解（debug 模式） ==========
+// server 在 debug 模式下给请求 context 挂上 *RequestTiming，ChatService 记录选账号和上游各阶段耗时，
+// 请求结束时由 server 输出【包5】耗时分解；没有挂 RequestTiming 时所有记录都是空操作
+
+// requestTimingKey RequestTiming 的 context key
+type requestTimingKey struct{}
+
+// RequestTiming 单个请求在 ChatService 内的阶段耗时（方法均可在 nil 上调用）
+type RequestTiming struct {
+	mu                sync.Mutex
+	accountSelect     time.Duration // 选择账号（含获取/刷新 Token）累计耗时
+	upstreamFirstByte time.Duration // 最后一次尝试：发出请求到收到响应头
+	upstream          time.Duration // 发出请求到 EventStream 解析结束，多次尝试累计
+	upstreamDoneAt    time.Time     // 最后一次上游请求结束时间
+	attempts          int           // 上游请求次数（含空响应重试、账号降级）
+}
+
+// RequestTimingSnapshot RequestTiming 的只读快照
+type RequestTimingSnapshot struct {
+	AccountSelect     time.Duration
+	UpstreamFirstByte time.Duration
+	Upstream          time.Duration
+	UpstreamDoneAt    time.Time
+	Attempts          int
+}
+
+// WithRequestTiming 创建 RequestTiming 并挂到 context 上
+func WithRequestTiming(ctx context.Context) (context.Context, *RequestTiming) {
+	t := &RequestTiming{}
+	return context.WithValue(ctx, requestTimingKey{}, t), t
+}
+
+// RequestTimingFrom 从 context 取出 RequestTiming（没有时返回 nil）
+func RequestTimingFrom(ctx context.Context) *RequestTiming {
+	t, _ := ctx.Value(requestTimingKey{}).(*RequestTiming)
+	return t
+}
+
+// addAccountSelect 累加选择账号的耗时
+func (t *RequestTiming) addAccountSelect(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.accountSelect += d
+	t.mu.Unlock()
+}
+
+// markFirstByte 记录本次尝试收到上游响应头的耗时
+func (t *RequestTiming) markFirstByte(sentAt time.Time) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.upstreamFirstByte = time.Since(sentAt)
+	t.mu.Unlock()
+}
+
+// finishUpstream 记录一次上游请求结束（无论成功与否）
+func (t *RequestTiming) finishUpstream(sentAt time.Time) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	t.upstream += now.Sub(sentAt)
+	t.upstreamDoneAt = now
+	t.attempts++
+	t.mu.Unlock()
+}
+
+// Snapshot 返回当前记录的耗时
+func (t *RequestTiming) Snapshot() RequestTimingSnapshot {
+	if t == nil {
+		return RequestTimingSnapshot{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return RequestTimingSnapshot{
+		AccountSelect:     t.accountSelect,
+		UpstreamFirstByte: t.upstreamFirstByte,
+		Upstream:          t.upstream,
+		UpstreamDoneAt:    t.upstreamDoneAt,
+		Attempts:          t.attempts,
+	}
+}
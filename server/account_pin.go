@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 固定账号 ==========
+// 为什么：排查某个账号的问题时需要让单个请求确定落在该账号上，而不是靠负载均衡碰运气
+// 请求带 X-Kiro-Account-Id 时只使用该账号；账号不存在或不可用（预留、停用、熔断等）时返回 409，不回落到其他账号
+// 只对 accountPinApiKeyIds 中的 API-KEY 生效：其他 key、未配置 API-KEY 或未认证的请求忽略该 header
+
+// HeaderXKiroAccountID 指定本次请求使用的账号 ID
+const HeaderXKiroAccountID = "X-Kiro-Account-Id"
+
+// applyAccountPin 把 X-Kiro-Account-Id 指定的账号写入 context
+// 账号不可用时已写出 409 响应并返回 false，调用方直接返回
+func applyAccountPin(c *gin.Context) bool {
+	accountID := strings.TrimSpace(c.GetHeader(HeaderXKiroAccountID))
+	if accountID == "" || !accountPinAllowed(getAPIKeyID(c)) {
+		return true
+	}
+	if err := client.Auth.CheckAccountSelectable(accountID); err != nil {
+		// 具体原因只写日志：返回给客户端会暴露哪些账号 ID 存在
+		if logger != nil {
+			logger.Warn(GetMsgID(c), "固定账号不可用", map[string]any{
+				"accountId": accountID,
+				"error":     err.Error(),
+			})
+		}
+		errorJSONWithMsgId(c, 409, "指定的账号不可用")
+		return false
+	}
+	ctx := context.WithValue(c.Request.Context(), kiroclient.PinnedAccountKey, accountID)
+	c.Request = c.Request.WithContext(ctx)
+	return true
+}
+
+// accountPinAllowed 判断通过验证的 API-KEY 是否在固定账号白名单中
+func accountPinAllowed(keyID string) bool {
+	return keyID != "" && slices.Contains(proxyConfig.AccountPinApiKeyIds, keyID)
+}
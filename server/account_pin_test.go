@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestAccountPin 白名单中的 API-KEY 带 X-Kiro-Account-Id 时只使用该账号，账号不可用（含预留）时返回 409，其他 key 和未认证时忽略
+func TestAccountPin(t *testing.T) {
+	var tokens []string // 请求依次发出，上游回调不会并发
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	accounts := []kiroclient.AccountInfo{}
+	for _, id := range []string{"pin-acc-1", "pin-acc-2", "pin-acc-3"} {
+		accounts = append(accounts, kiroclient.AccountInfo{ID: id, Reserved: id == "pin-acc-3", Token: &kiroclient.KiroAuthToken{
+			AccessToken: "token-" + id,
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		}})
+		defer removeAccountStats(id)
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: accounts})
+
+	oldKeys, oldConfig := apiKeys, proxyConfig
+	apiKeys = []string{"sk-pin-test-key", "sk-other-key"}
+	proxyConfig.AccountPinApiKeyIds = []string{apiKeyID("sk-pin-test-key")}
+	defer func() { apiKeys, proxyConfig = oldKeys, oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", apiKeyAuthMiddleware(), handleClaudeChat)
+	send := func(apiKey, accountID string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			req.Header.Set("X-Api-Key", apiKey)
+		}
+		req.Header.Set(HeaderXKiroAccountID, accountID)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := send("sk-pin-test-key", "pin-acc-2"); w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+	}
+	for _, token := range tokens {
+		if token != "token-pin-acc-2" {
+			t.Fatalf("固定账号的请求应全部使用该账号, 得到 %v", tokens)
+		}
+	}
+
+	// 不在白名单中的 key 忽略 header，照常负载均衡（预留账号不会被选中）
+	tokens = nil
+	if w := send("sk-other-key", "pin-acc-3"); w.Code != 200 {
+		t.Fatalf("白名单外的 key 应忽略 X-Kiro-Account-Id, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if len(tokens) != 1 || tokens[0] == "token-pin-acc-3" {
+		t.Errorf("白名单外的 key 不应落到指定的预留账号: %v", tokens)
+	}
+
+	// 熔断中、预留或不存在的账号返回 409，不回落到其他账号；响应不区分原因，避免枚举账号
+	if err := client.Auth.ManualTrip("pin-acc-2"); err != nil {
+		t.Fatalf("熔断失败: %v", err)
+	}
+	calls := len(tokens)
+	var bodies []string
+	for _, id := range []string{"pin-acc-2", "pin-acc-3", "missing"} {
+		w := send("sk-pin-test-key", id)
+		if w.Code != 409 {
+			t.Errorf("账号 %s 不可用时期望 409, 得到 %d: %s", id, w.Code, w.Body.String())
+		}
+		if strings.Contains(w.Body.String(), id) {
+			t.Errorf("409 响应不应包含账号 ID: %s", w.Body.String())
+		}
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		bodies = append(bodies, fmt.Sprint(resp["error"]))
+	}
+	if bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+		t.Errorf("不同原因应返回相同的错误信息: %v", bodies)
+	}
+	if len(tokens) != calls {
+		t.Error("固定账号不可用时不应请求上游")
+	}
+
+	// 未配置 API-KEY（未认证）时忽略 header
+	apiKeys = nil
+	if w := send("", "missing"); w.Code != 200 {
+		t.Errorf("未认证请求应忽略 X-Kiro-Account-Id, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
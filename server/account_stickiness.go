@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 会话粘性 ==========
+
+// HeaderXSessionID 客户端指定会话 ID 的请求 header
+const HeaderXSessionID = "X-Session-Id"
+
+// maxSessionKeyLen 会话 key 的最大长度，超长的值直接忽略（防止滥用内存）
+const maxSessionKeyLen = 256
+
+// resolveSessionKey 从请求中提取稳定的会话 ID
+// 优先 X-Session-Id header，其次 Claude 请求的 metadata.user_id（Claude Code 会在其中带上 session）
+func resolveSessionKey(c *gin.Context, metadata any) string {
+	key := strings.TrimSpace(c.GetHeader(HeaderXSessionID))
+	if key == "" {
+		if m, ok := metadata.(map[string]any); ok {
+			key, _ = m["user_id"].(string)
+			key = strings.TrimSpace(key)
+		}
+	}
+	if len(key) > maxSessionKeyLen {
+		return ""
+	}
+	return key
+}
+
+// applyAccountStickiness 开启 AccountStickiness 时把会话 key 写入 context
+// 同一会话的后续请求会优先路由到已绑定账号，账号熔断时由 AuthManager 回落到重新选择
+func applyAccountStickiness(c *gin.Context, metadata any) {
+	if !proxyConfig.AccountStickiness {
+		return
+	}
+	key := resolveSessionKey(c, metadata)
+	if key == "" {
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), kiroclient.SessionKeyKey, key)
+	c.Request = c.Request.WithContext(ctx)
+}
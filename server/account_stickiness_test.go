@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestApplyAccountStickiness 测试会话 key 的提取优先级和开关
+func TestApplyAccountStickiness(t *testing.T) {
+	oldCfg := proxyConfig
+	defer func() { proxyConfig = oldCfg }()
+
+	run := func(header string, metadata any) string {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("POST", "/v1/messages", nil)
+		if header != "" {
+			c.Request.Header.Set(HeaderXSessionID, header)
+		}
+		applyAccountStickiness(c, metadata)
+		key, _ := c.Request.Context().Value(kiroclient.SessionKeyKey).(string)
+		return key
+	}
+	metadata := map[string]any{"user_id": "user_abc_session_123"}
+
+	proxyConfig.AccountStickiness = false
+	if key := run("conv-1", metadata); key != "" {
+		t.Errorf("未开启粘性时不应写入会话 key, 得到 %q", key)
+	}
+
+	proxyConfig.AccountStickiness = true
+	if key := run("conv-1", metadata); key != "conv-1" {
+		t.Errorf("header 应优先, 得到 %q", key)
+	}
+	if key := run("", metadata); key != "user_abc_session_123" {
+		t.Errorf("无 header 时应使用 metadata.user_id, 得到 %q", key)
+	}
+	if key := run("", nil); key != "" {
+		t.Errorf("无会话信息时不应写入, 得到 %q", key)
+	}
+	if key := run(strings.Repeat("x", maxSessionKeyLen+1), nil); key != "" {
+		t.Errorf("超长会话 key 应被忽略, 得到 %q", key)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 单账号额度查询 ==========
+
+// AccountUsageResponse 单个账号的额度（GET /api/accounts/:id/usage）
+type AccountUsageResponse struct {
+	AccountID        string                      `json:"accountId"`
+	UsedCredits      float64                     `json:"usedCredits"`
+	TotalCredits     float64                     `json:"totalCredits"`
+	Breakdown        []kiroclient.UsageBreakdown `json:"breakdown"` // CREDIT 类型的额度明细
+	SubscriptionName string                      `json:"subscriptionName"`
+	DaysUntilReset   int                         `json:"daysUntilReset"`
+	NextResetDate    string                      `json:"nextResetDate"`
+	UsageFreshness
+}
+
+// fillUsage 从额度接口响应填充 CREDIT 明细、订阅和重置时间
+func (r *AccountUsageResponse) fillUsage(usage *kiroclient.UsageLimitsResponse) {
+	r.Breakdown = []kiroclient.UsageBreakdown{}
+	for _, u := range usage.UsageBreakdownList {
+		if u.ResourceType != "CREDIT" {
+			continue
+		}
+		if len(r.Breakdown) == 0 {
+			r.UsedCredits = u.CurrentUsageWithPrecision
+			r.TotalCredits = u.UsageLimitWithPrecision
+		}
+		r.Breakdown = append(r.Breakdown, u)
+	}
+
+	subName := usage.SubscriptionInfo.SubscriptionTitle
+	if len(subName) > 5 && subName[:5] == "KIRO " {
+		subName = subName[5:]
+	}
+	r.SubscriptionName = subName
+
+	// 用 nextDateReset 计算剩余天数（API 的 daysUntilReset 返回 0 是已知 bug）
+	if usage.NextDateReset > 0 {
+		resetTime := time.Unix(int64(usage.NextDateReset), 0)
+		days := int(time.Until(resetTime).Hours() / 24)
+		if days < 0 {
+			days = 0
+		}
+		r.DaysUntilReset = days
+		r.NextResetDate = resetTime.Format("2006-01-02")
+	}
+}
+
+// handleAccountUsage 查询单个账号的额度，不拉取整个账号列表
+// 默认优先使用未过期（10 分钟内）的额度缓存；forceRefresh=true 时跳过缓存直接查询上游
+// 上游查询失败时：forceRefresh 返回 502，否则回落到缓存值并标记 usageStale
+func handleAccountUsage(c *gin.Context) {
+	accountID := c.Param("id")
+	forceRefresh, _ := strconv.ParseBool(c.Query("forceRefresh"))
+
+	config, err := client.Auth.LoadAccountsConfig()
+	if err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, accountID)
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	var account *kiroclient.AccountInfo
+	for i := range config.Accounts {
+		if config.Accounts[i].ID == accountID {
+			account = &config.Accounts[i]
+			break
+		}
+	}
+	if account == nil {
+		c.JSON(404, gin.H{"error": "账号不存在"})
+		return
+	}
+
+	resp := AccountUsageResponse{AccountID: accountID, Breakdown: []kiroclient.UsageBreakdown{}}
+	cache, cached := client.Auth.GetCachedUsage(accountID)
+	if !forceRefresh && cached && cache.Limits != nil && !cache.IsStale() {
+		resp.fillUsage(cache.Limits)
+		resp.UsageFreshness = UsageFreshness{
+			UsageStatus:    usageStatusCached,
+			UsageUpdatedAt: cache.LastUpdated.Format(time.RFC3339),
+		}
+		c.JSON(200, resp)
+		return
+	}
+
+	var usage *kiroclient.UsageLimitsResponse
+	if account.Token == nil || account.Token.AccessToken == "" {
+		err = fmt.Errorf("账号没有可用 Token")
+	} else {
+		usage, err = client.Auth.GetUsageLimitsWithTokenContext(c.Request.Context(), account.Token.AccessToken, account.Token.Region, account.ProfileArn)
+	}
+	if err == nil {
+		client.Auth.RecordUsageLimits(accountID, usage)
+		resp.fillUsage(usage)
+		resp.UsageStatus = usageStatusLive
+		c.JSON(200, resp)
+		return
+	}
+
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "账号获取额度失败", map[string]any{
+			"accountId":    accountID,
+			"forceRefresh": forceRefresh,
+			"error":        err.Error(),
+		})
+	}
+	if forceRefresh || !cached {
+		c.JSON(502, gin.H{"error": "获取额度失败: " + err.Error()})
+		return
+	}
+
+	if cache.Limits != nil {
+		resp.fillUsage(cache.Limits)
+	}
+	resp.UsedCredits, resp.TotalCredits, resp.UsageFreshness = cachedUsageFallback(accountID)
+	c.JSON(200, resp)
+}
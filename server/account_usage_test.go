@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// setupAccountUsageTest 初始化一个账号和 mock 额度接口，返回路由和上游调用计数
+// failing 为 true 时上游返回 403
+func setupAccountUsageTest(t *testing.T, failing *atomic.Bool) (*gin.Engine, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// 用调用次数作为已用额度，便于区分缓存值和新值
+		fmt.Fprintf(w, `{"nextDateReset":4102444800,"subscriptionInfo":{"subscriptionTitle":"KIRO POWER"},`+
+			`"usageBreakdownList":[{"resourceType":"CREDIT","currentUsageWithPrecision":%d,"usageLimitWithPrecision":100}]}`, calls.Load())
+	}))
+	t.Cleanup(srv.Close)
+	target, _ := url.Parse(srv.URL)
+
+	oldClient := client
+	t.Cleanup(func() { client = oldClient })
+	client = kiroclient.NewKiroClient()
+	client.Auth.SetHTTPClientForTest(&http.Client{Transport: rewriteTransport{target: target}})
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: []kiroclient.AccountInfo{{
+		ID:         "acc-1",
+		ProfileArn: "arn:acc-1",
+		Token: &kiroclient.KiroAuthToken{
+			AccessToken: "token",
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		},
+	}}})
+
+	router := gin.New()
+	router.GET("/api/accounts/:id/usage", handleAccountUsage)
+	return router, &calls
+}
+
+// getAccountUsage 请求单账号额度接口
+func getAccountUsage(router *gin.Engine, path string) (int, AccountUsageResponse) {
+	req, _ := http.NewRequest("GET", path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp AccountUsageResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// TestAccountUsage_CacheAndForceRefresh 测试首次实时查询、之后命中缓存、forceRefresh 跳过缓存
+func TestAccountUsage_CacheAndForceRefresh(t *testing.T) {
+	var failing atomic.Bool
+	router, calls := setupAccountUsageTest(t, &failing)
+
+	code, resp := getAccountUsage(router, "/api/accounts/acc-1/usage")
+	if code != 200 || resp.UsageStatus != usageStatusLive || resp.UsedCredits != 1 || calls.Load() != 1 {
+		t.Fatalf("首次应实时查询: code=%d resp=%+v calls=%d", code, resp, calls.Load())
+	}
+	if resp.SubscriptionName != "POWER" || resp.NextResetDate == "" || len(resp.Breakdown) != 1 {
+		t.Errorf("应返回订阅、重置时间和 CREDIT 明细: %+v", resp)
+	}
+
+	code, resp = getAccountUsage(router, "/api/accounts/acc-1/usage")
+	if code != 200 || resp.UsageStatus != usageStatusCached || resp.UsageStale || resp.UsedCredits != 1 || calls.Load() != 1 {
+		t.Errorf("缓存未过期时不应再查询上游: code=%d resp=%+v calls=%d", code, resp, calls.Load())
+	}
+	if resp.SubscriptionName != "POWER" {
+		t.Errorf("缓存命中时也应返回订阅信息: %+v", resp)
+	}
+
+	code, resp = getAccountUsage(router, "/api/accounts/acc-1/usage?forceRefresh=true")
+	if code != 200 || resp.UsageStatus != usageStatusLive || resp.UsedCredits != 2 || calls.Load() != 2 {
+		t.Errorf("forceRefresh 应跳过缓存: code=%d resp=%+v calls=%d", code, resp, calls.Load())
+	}
+
+	if code, _ := getAccountUsage(router, "/api/accounts/missing/usage"); code != 404 {
+		t.Errorf("不存在的账号应返回 404, 得到 %d", code)
+	}
+}
+
+// TestAccountUsage_UpstreamFailure 测试上游失败时：forceRefresh 返回 502，否则回落到缓存并标记过期
+func TestAccountUsage_UpstreamFailure(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	router, _ := setupAccountUsageTest(t, &failing)
+
+	if code, _ := getAccountUsage(router, "/api/accounts/acc-1/usage"); code != 502 {
+		t.Errorf("没有缓存且查询失败应返回 502, 得到 %d", code)
+	}
+
+	client.Auth.SetUsageCacheForTest("acc-1", 30, 100)
+	if code, _ := getAccountUsage(router, "/api/accounts/acc-1/usage?forceRefresh=1"); code != 502 {
+		t.Errorf("forceRefresh 查询失败应返回 502, 得到 %d", code)
+	}
+	code, resp := getAccountUsage(router, "/api/accounts/acc-1/usage")
+	if code != 200 || resp.UsageStatus != usageStatusCached || !resp.UsageStale || resp.UsedCredits != 30 {
+		t.Errorf("查询失败时应回落到缓存并标记过期: code=%d resp=%+v", code, resp)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 进行中的流式请求 ==========
+// 为什么：故障处理时需要知道哪些流还在跑、跑了多久、在哪个账号上，必要时手动中止个别卡住或失控的流
+// 流式处理函数入口注册，结束时注销；中止通过取消请求 context 实现，上游请求随之结束
+// 登记按服务端生成的流 ID 索引（响应头 X-Kiro-Stream-Id 返回）：msgId 可以由客户端通过 X-Request-ID 指定，
+// 多个请求用同一个值时会互相覆盖，按 msgId 中止可能误伤别人的流
+
+// HeaderXKiroStreamID 响应中返回的流 ID，用于 /api/requests/active/:id 中止
+const HeaderXKiroStreamID = "X-Kiro-Stream-Id"
+
+// activeStream 一个进行中的流式请求
+type activeStream struct {
+	id        string
+	msgID     string
+	model     string
+	path      string
+	startedAt time.Time
+	accountID atomic.Value // string，选中账号后更新
+	bytes     atomic.Int64 // 已写给客户端的字节数
+	cancel    context.CancelFunc
+}
+
+// ActiveStreamInfo 进行中的流式请求快照（/api/requests/active）
+type ActiveStreamInfo struct {
+	ID            string    `json:"id"`
+	MsgID         string    `json:"msgId"`
+	Model         string    `json:"model"`
+	AccountID     string    `json:"accountId"`
+	Path          string    `json:"path"`
+	StartedAt     time.Time `json:"startedAt"`
+	DurationMs    int64     `json:"durationMs"`
+	BytesStreamed int64     `json:"bytesStreamed"`
+}
+
+// activeStreamRegistry 按流 ID 索引的进行中流式请求
+type activeStreamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*activeStream
+}
+
+// activeStreams 全局进行中流式请求登记表
+var activeStreams = &activeStreamRegistry{}
+
+func (r *activeStreamRegistry) add(s *activeStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.streams == nil {
+		r.streams = make(map[string]*activeStream)
+	}
+	r.streams[s.id] = s
+}
+
+// remove 注销流
+func (r *activeStreamRegistry) remove(s *activeStream) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.streams, s.id)
+}
+
+// cancel 中止指定的流，不存在时返回 (nil, false)
+func (r *activeStreamRegistry) cancel(id string) (*activeStream, bool) {
+	r.mu.Lock()
+	s, ok := r.streams[id]
+	r.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	s.cancel()
+	return s, true
+}
+
+// list 返回所有进行中流式请求的快照（按开始时间排序，最早的在前）
+func (r *activeStreamRegistry) list() []ActiveStreamInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	result := make([]ActiveStreamInfo, 0, len(r.streams))
+	for _, s := range r.streams {
+		accountID, _ := s.accountID.Load().(string)
+		result = append(result, ActiveStreamInfo{
+			ID:            s.id,
+			MsgID:         s.msgID,
+			Model:         s.model,
+			AccountID:     accountID,
+			Path:          s.path,
+			StartedAt:     s.startedAt,
+			DurationMs:    now.Sub(s.startedAt).Milliseconds(),
+			BytesStreamed: s.bytes.Load(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].StartedAt.Before(result[j].StartedAt) })
+	return result
+}
+
+// countingResponseWriter 统计写给客户端的字节数，写失败（客户端已断开）时中止流
+// 为什么：连接断开后服务端不一定马上感知，继续读上游只会白白消耗账号额度
+type countingResponseWriter struct {
+	gin.ResponseWriter
+	stream *activeStream
+}
+
+func (w *countingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.track(n, err)
+	return n, err
+}
+
+func (w *countingResponseWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+	w.track(n, err)
+	return n, err
+}
+
+// track 累加已写字节数；写失败时取消请求 context，上游读取随之停止
+func (w *countingResponseWriter) track(n int, err error) {
+	w.stream.bytes.Add(int64(n))
+	if err != nil {
+		w.stream.cancel()
+	}
+}
+
+// streamedBytes 已写给客户端的字节数（未登记为流式请求时返回 0）
+func streamedBytes(c *gin.Context) int64 {
+	if w, ok := c.Writer.(*countingResponseWriter); ok {
+		return w.stream.bytes.Load()
+	}
+	return 0
+}
+
+// registerActiveStream 登记一个流式请求：挂上可取消的 context、账号回调和字节计数，返回注销函数
+// 调用方在流式处理函数入口（写出响应之前）defer 注销函数，正常结束、出错或被中止时都会清理
+func registerActiveStream(c *gin.Context, model string) func() {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	s := &activeStream{
+		id:        generateID("stream"),
+		msgID:     GetMsgID(c),
+		model:     model,
+		path:      c.Request.URL.Path,
+		startedAt: time.Now(),
+		cancel:    cancel,
+	}
+	c.Header(HeaderXKiroStreamID, s.id)
+	ctx = context.WithValue(ctx, kiroclient.AccountObserverKey, func(accountID string) {
+		s.accountID.Store(accountID)
+	})
+	c.Request = c.Request.WithContext(ctx)
+	c.Writer = &countingResponseWriter{ResponseWriter: c.Writer, stream: s}
+
+	activeStreams.add(s)
+	return func() {
+		activeStreams.remove(s)
+		cancel()
+	}
+}
+
+// handleListActiveRequests 列出进行中的流式请求
+func handleListActiveRequests(c *gin.Context) {
+	streams := activeStreams.list()
+	c.JSON(200, gin.H{"count": len(streams), "requests": streams})
+}
+
+// handleCancelActiveRequest 按流 ID 中止指定的流式请求（取消其 context，上游请求随之结束）
+func handleCancelActiveRequest(c *gin.Context) {
+	id := c.Param("id")
+	s, ok := activeStreams.cancel(id)
+	if !ok {
+		c.JSON(404, gin.H{"error": "未找到进行中的流式请求: " + id})
+		return
+	}
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "流式请求已被手动中止", map[string]any{
+			"streamId":    id,
+			"targetMsgId": s.msgID,
+		})
+	}
+	c.JSON(200, gin.H{"message": "已中止", "id": id, "msgId": s.msgID})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// newActiveRequestsRouter 聊天接口 + 进行中请求管理接口
+func newActiveRequestsRouter() *gin.Engine {
+	router := gin.New()
+	router.POST("/v1/messages", TraceMiddleware(nil), handleClaudeChat)
+	router.GET("/api/requests/active", handleListActiveRequests)
+	router.DELETE("/api/requests/active/:id", handleCancelActiveRequest)
+	return router
+}
+
+// listActiveRequests 调用 GET /api/requests/active
+func listActiveRequests(t *testing.T, router *gin.Engine) []ActiveStreamInfo {
+	t.Helper()
+	req, _ := http.NewRequest("GET", "/api/requests/active", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp struct {
+		Requests []ActiveStreamInfo `json:"requests"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	return resp.Requests
+}
+
+// TestActiveRequests_RegisterListCancel 流式请求进行中可见（账号、字节数），可按流 ID 中止，结束后自动注销
+func TestActiveRequests_RegisterListCancel(t *testing.T) {
+	release := make(chan struct{})
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"partial"}`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	defer cleanup()
+	defer close(release)
+
+	oldConfig, oldRegistry := proxyConfig, activeStreams
+	proxyConfig = kiroclient.DefaultProxyConfig
+	activeStreams = &activeStreamRegistry{}
+	defer func() { proxyConfig, activeStreams = oldConfig, oldRegistry }()
+
+	router := newActiveRequestsRouter()
+	// 两个请求使用相同的 X-Request-ID，登记不应互相覆盖
+	done := make(chan *httptest.ResponseRecorder, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(HeaderXRequestID, "shared-request-id")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			done <- w
+		}()
+	}
+
+	// 等待两个流都开始输出上游内容
+	var active []ActiveStreamInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		active = listActiveRequests(t, router)
+		if len(active) == 2 && active[0].BytesStreamed > 0 && active[1].BytesStreamed > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(active) != 2 {
+		t.Fatalf("相同 msgId 的两个流都应可见, 得到 %+v", active)
+	}
+	info := active[0]
+	if info.AccountID != "mock-account" || info.Model != "claude-sonnet-4.5" || info.BytesStreamed <= 0 || info.MsgID != "shared-request-id" {
+		t.Errorf("进行中的流信息不完整: %+v", info)
+	}
+	if info.ID == "" || info.ID == active[1].ID {
+		t.Fatalf("每个流应有服务端生成的独立 ID: %+v", active)
+	}
+
+	// 按 msgId 不能中止（可能属于别人的流）
+	req, _ := http.NewRequest("DELETE", "/api/requests/active/shared-request-id", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("按 msgId 中止应返回 404, 得到 %d", w.Code)
+	}
+
+	// 不存在的流 ID
+	req, _ = http.NewRequest("DELETE", "/api/requests/active/stream_unknown", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("中止不存在的流应返回 404, 得到 %d", w.Code)
+	}
+
+	// 按流 ID 中止后只有该请求结束并注销，另一个流不受影响
+	req, _ = http.NewRequest("DELETE", "/api/requests/active/"+info.ID, nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("中止期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	var cancelled *httptest.ResponseRecorder
+	select {
+	case cancelled = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("中止后流式请求应结束")
+	}
+	if got := cancelled.Header().Get(HeaderXKiroStreamID); got != info.ID {
+		t.Errorf("响应头应返回被中止的流 ID %s, 得到 %q", info.ID, got)
+	}
+	remaining := listActiveRequests(t, router)
+	if len(remaining) != 1 || remaining[0].ID == info.ID {
+		t.Fatalf("只应注销被中止的流, 剩余 %+v", remaining)
+	}
+
+	// 等另一个流也结束，避免它在测试返回后继续读写全局状态
+	activeStreams.cancel(remaining[0].ID)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("中止后流式请求应结束")
+	}
+}
+
+// TestActiveRequests_CleanupOnCompletion 正常结束的流自动注销
+func TestActiveRequests_CleanupOnCompletion(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig, oldRegistry := proxyConfig, activeStreams
+	proxyConfig = kiroclient.DefaultProxyConfig
+	activeStreams = &activeStreamRegistry{}
+	defer func() { proxyConfig, activeStreams = oldConfig, oldRegistry }()
+
+	router := newActiveRequestsRouter()
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d", w.Code)
+	}
+	if active := listActiveRequests(t, router); len(active) != 0 {
+		t.Errorf("正常结束后应注销, 仍有 %+v", active)
+	}
+}
+
+// brokenPipeRecorder 模拟客户端中途断开：写出包含 marker 的内容后返回写错误
+type brokenPipeRecorder struct {
+	*httptest.ResponseRecorder
+	marker string
+}
+
+func (w *brokenPipeRecorder) Write(data []byte) (int, error) {
+	n, _ := w.ResponseRecorder.Write(data)
+	if bytes.Contains(data, []byte(w.marker)) {
+		return n, errors.New("write: broken pipe")
+	}
+	return n, nil
+}
+
+// TestStreamClientDisconnect_StopsUpstream 写给客户端失败时中止上游读取，按 499 记账并计入已消耗的部分 usage
+func TestStreamClientDisconnect_StopsUpstream(t *testing.T) {
+	upstreamClosed := make(chan struct{})
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"partial answer before the client disconnects, long enough to pass the thinking tag buffer"}`))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(upstreamClosed)
+		case <-time.After(5 * time.Second):
+		}
+	})
+	defer cleanup()
+	// 两个账号走加权选择，才会记录最后选中的账号
+	accounts := []kiroclient.AccountInfo{}
+	for _, id := range []string{"disconnect-acc-1", "disconnect-acc-2"} {
+		accounts = append(accounts, kiroclient.AccountInfo{ID: id, Token: &kiroclient.KiroAuthToken{
+			AccessToken: "mock-token",
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		}})
+		defer removeAccountStats(id)
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: accounts})
+
+	oldConfig, oldRegistry := proxyConfig, activeStreams
+	proxyConfig = kiroclient.DefaultProxyConfig
+	activeStreams = &activeStreamRegistry{}
+	defer func() { proxyConfig, activeStreams = oldConfig, oldRegistry }()
+	for len(tokenStatsChan) > 0 {
+		<-tokenStatsChan
+	}
+
+	router := newActiveRequestsRouter()
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(&brokenPipeRecorder{ResponseRecorder: httptest.NewRecorder(), marker: "partial answer"}, req)
+
+	select {
+	case <-upstreamClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("客户端断开后应中止上游请求")
+	}
+
+	accountID, _ := client.Auth.GetLastSelectedAccountInfo()
+	if stats := getAccountStats()[accountID]; stats == nil || stats.StatusCodes[StatusClientClosedRequest] != 1 {
+		t.Errorf("断开的请求应按 499 记入账号统计: %+v", stats)
+	}
+	select {
+	case delta := <-tokenStatsChan:
+		if delta.Input <= 0 || delta.Output <= 0 {
+			t.Errorf("应计入已消耗的部分 usage: %+v", delta)
+		}
+	default:
+		t.Error("断开的请求应计入 Token 统计")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// ========== API-KEY 哈希存储 ==========
+// 为什么：api-keys.json 明文保存 key，文件泄露即等于 key 泄露
+// 开启 hashApiKeys 后保存时把明文 key 转成加盐 SHA-256（sha256$盐$哈希$前缀），文件中不再出现完整 key；
+// 前缀即 apiKeyID，用量、配额、维护模式等按 key 标识归属的功能不受影响
+// 验证时两种格式都接受，已有的明文 key 在下一次保存时才转换，开关随时可以打开或关闭
+
+const (
+	// hashedApiKeyScheme 哈希格式 key 的前缀
+	hashedApiKeyScheme = "sha256$"
+	// apiKeySaltSize 盐的字节数
+	apiKeySaltSize = 16
+)
+
+// apiKeyCompare 比较 key 或哈希使用的函数（常量时间，避免按耗时逐字节猜出 key；测试中替换以确认调用）
+var apiKeyCompare = subtle.ConstantTimeCompare
+
+// hashedApiKey 解析后的哈希格式 key
+type hashedApiKey struct {
+	salt   []byte
+	sum    []byte
+	prefix string
+}
+
+// parseHashedApiKey 解析 sha256$盐$哈希$前缀 格式，不是该格式时 ok 为 false
+func parseHashedApiKey(entry string) (hashedApiKey, bool) {
+	rest, ok := strings.CutPrefix(entry, hashedApiKeyScheme)
+	if !ok {
+		return hashedApiKey{}, false
+	}
+	parts := strings.SplitN(rest, "$", 3)
+	if len(parts) != 3 {
+		return hashedApiKey{}, false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil || len(salt) != apiKeySaltSize {
+		return hashedApiKey{}, false
+	}
+	sum, err := hex.DecodeString(parts[1])
+	if err != nil || len(sum) != sha256.Size {
+		return hashedApiKey{}, false
+	}
+	return hashedApiKey{salt: salt, sum: sum, prefix: parts[2]}, true
+}
+
+// hashApiKey 把明文 key 转成哈希格式
+// 前缀与 apiKeyID 一致（前 8 位）；key 不超过 8 位时只保留一半，避免前缀就是完整 key
+func hashApiKey(key string) (string, error) {
+	salt := make([]byte, apiKeySaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	prefix := apiKeyID(key)
+	if prefix == key {
+		prefix = key[:len(key)/2]
+	}
+	return hashedApiKeyScheme + hex.EncodeToString(salt) + "$" + hex.EncodeToString(saltedApiKeySum(salt, key)) + "$" + prefix, nil
+}
+
+// saltedApiKeySum 计算 SHA-256(盐 + key)
+func saltedApiKeySum(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
+// apiKeyMatches 判断请求携带的 key 是否对应存储的条目（明文或哈希格式），均使用常量时间比较
+func apiKeyMatches(entry, key string) bool {
+	if hashed, ok := parseHashedApiKey(entry); ok {
+		return apiKeyCompare(saltedApiKeySum(hashed.salt, key), hashed.sum) == 1
+	}
+	return apiKeyCompare([]byte(entry), []byte(key)) == 1
+}
+
+// findApiKeyEntry 查找请求携带的 key 对应的存储条目
+// 比较完所有条目再返回，耗时不随命中位置变化
+func findApiKeyEntry(key string) (string, bool) {
+	found := ""
+	for _, entry := range apiKeys {
+		if apiKeyMatches(entry, key) && found == "" {
+			found = entry
+		}
+	}
+	return found, found != ""
+}
+
+// storedApiKey 返回 key 保存到文件时使用的条目：
+// 已经是哈希格式的原样保留；与现有条目对应的明文 key 沿用该条目（避免每次保存重新加盐，key 级策略跟着失效）；
+// 开启 hashApiKeys 时其余明文 key 转成哈希格式，否则保持明文
+func storedApiKey(key string, existing []string) (string, error) {
+	if _, ok := parseHashedApiKey(key); ok {
+		return key, nil
+	}
+	if !proxyConfig.HashApiKeys {
+		return key, nil
+	}
+	for _, entry := range existing {
+		if _, ok := parseHashedApiKey(entry); ok && apiKeyMatches(entry, key) {
+			return entry, nil
+		}
+	}
+	return hashApiKey(key)
+}
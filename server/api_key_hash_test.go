@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestHashedApiKey_Auth 哈希格式的 key：正确的 key 通过并按前缀归属，错误的 key 返回 401，比较走常量时间实现
+func TestHashedApiKey_Auth(t *testing.T) {
+	const key = "sk-hashed-key-123456"
+	entry, err := hashApiKey(key)
+	if err != nil {
+		t.Fatalf("哈希失败: %v", err)
+	}
+	if strings.Contains(entry, key) {
+		t.Fatalf("哈希条目不应包含完整 key: %s", entry)
+	}
+	router := setupApiKeyRotationTest(t, entry, "sk-plain-key-654321")
+
+	calls := 0
+	oldCompare := apiKeyCompare
+	apiKeyCompare = func(x, y []byte) int {
+		calls++
+		return oldCompare(x, y)
+	}
+	defer func() { apiKeyCompare = oldCompare }()
+
+	ping := func(k string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/ping", nil)
+		req.Header.Set("X-API-Key", k)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := ping(key)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"keyId":"sk-hashe"`) {
+		t.Errorf("正确的 key 应通过并按前缀归属: %d %s", w.Code, w.Body.String())
+	}
+	if calls != 2 {
+		t.Errorf("每个存储条目都应经过常量时间比较, 调用 %d 次", calls)
+	}
+	if w := ping("sk-plain-key-654321"); w.Code != 200 {
+		t.Errorf("明文条目仍应可用, 得到 %d", w.Code)
+	}
+	for _, wrong := range []string{"sk-hashed-key-123457", "sk-hashe", entry} {
+		if w := ping(wrong); w.Code != 401 {
+			t.Errorf("%s: 期望 401, 得到 %d", wrong, w.Code)
+		}
+	}
+}
+
+// TestHashApiKeys_MigrateOnSave 开启 hashApiKeys 后保存时明文 key 转成哈希（策略随之迁移），
+// 再次提交同一明文 key 沿用原条目；关闭时保持明文
+func TestHashApiKeys_MigrateOnSave(t *testing.T) {
+	mem := useMemoryStorage(t)
+	const key = "sk-plain-key-abcdef"
+	router := setupApiKeyRotationTest(t, key)
+	router.GET("/api/settings/api-keys", handleGetApiKeys)
+	router.POST("/api/settings/api-keys", handleUpdateApiKeys)
+
+	apiKeyPoliciesMutex.Lock()
+	oldPolicies := apiKeyPolicies
+	apiKeyPolicies = map[string]ApiKeyPolicy{apiKeyUsageID(key): {AllowedIPs: []string{"10.0.0.0/8"}}}
+	apiKeyPoliciesMutex.Unlock()
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() {
+		proxyConfig = oldConfig
+		apiKeyPoliciesMutex.Lock()
+		apiKeyPolicies = oldPolicies
+		apiKeyPoliciesMutex.Unlock()
+	}()
+
+	save := func(keys ...string) {
+		t.Helper()
+		body, _ := json.Marshal(map[string]any{"keys": keys})
+		req, _ := http.NewRequest("POST", "/api/settings/api-keys", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("保存期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	// 未开启：保持明文
+	save(key)
+	if apiKeys[0] != key {
+		t.Fatalf("未开启 hashApiKeys 时应保持明文: %v", apiKeys)
+	}
+
+	// 开启：下一次保存时转成哈希，文件中不再有明文，策略跟随
+	proxyConfig.HashApiKeys = true
+	save(key)
+	entry := apiKeys[0]
+	if _, ok := parseHashedApiKey(entry); !ok {
+		t.Fatalf("开启后应以哈希格式保存: %v", apiKeys)
+	}
+	data, _ := mem.Get(apiKeysFile)
+	if strings.Contains(string(data), key) {
+		t.Errorf("文件中不应出现明文 key: %s", data)
+	}
+	if got := apiKeyAllowedIPs(entry); len(got) != 1 || got[0] != "10.0.0.0/8" {
+		t.Errorf("策略应迁移到哈希条目: %v", got)
+	}
+	if got := apiKeyAllowedIPs(key); got != nil {
+		t.Errorf("明文 key 的策略记录应删除: %v", got)
+	}
+
+	// 管理页面回传哈希条目或同一明文 key 都沿用原条目
+	save(entry)
+	save(key)
+	if apiKeys[0] != entry {
+		t.Errorf("同一个 key 不应重新加盐: %s -> %s", entry, apiKeys[0])
+	}
+
+	req, _ := http.NewRequest("GET", "/api/settings/api-keys", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), key) || !strings.Contains(w.Body.String(), `"prefix":"sk-plain"`) {
+		t.Errorf("列表应只返回前缀: %s", w.Body.String())
+	}
+}
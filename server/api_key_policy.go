@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== API-KEY 来源 IP 绑定 ==========
+// 为什么：CORS 只约束浏览器，IP 黑名单只能事后封禁；把 key 绑定到固定的出口 IP/网段后，
+// 即使 key 泄露，从其他网络也无法使用
+// 策略单独保存在 api-key-policies.json（apiKeyUsageID -> 策略，与用量同一归属 ID，文件中不出现 key 本身），
+// api-keys.json 保持字符串列表格式不变；key 被删除或替换后对应的策略随之删除
+
+// ApiKeyPolicy 单个 API-KEY 的访问策略
+type ApiKeyPolicy struct {
+	AllowedIPs        []string `json:"allowedIPs"`                  // 允许的来源 IP 或 CIDR（空=不限制）
+	MonthlyTokenQuota int64    `json:"monthlyTokenQuota,omitempty"` // 每自然月（UTC）input+output token 上限（0=不限制）
+}
+
+// isEmpty 策略没有任何限制时不必保存
+func (p ApiKeyPolicy) isEmpty() bool {
+	return len(p.AllowedIPs) == 0 && p.MonthlyTokenQuota == 0
+}
+
+var apiKeyPoliciesFile = "api-key-policies.json"
+var apiKeyPolicies = make(map[string]ApiKeyPolicy) // apiKeyUsageID -> 策略
+var apiKeyPoliciesMutex sync.RWMutex
+
+// validateAllowedIPs 校验并规范化 IP/CIDR 列表（去掉空项和首尾空白）
+func validateAllowedIPs(list []string) ([]string, error) {
+	var result []string
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			if _, _, err := net.ParseCIDR(item); err != nil {
+				return nil, fmt.Errorf("allowedIPs 中的 CIDR 无效: %s", item)
+			}
+		} else if net.ParseIP(item) == nil {
+			return nil, fmt.Errorf("allowedIPs 中的 IP 无效: %s", item)
+		}
+		result = append(result, item)
+	}
+	return result, nil
+}
+
+// ipAllowed 检查 IP 是否命中允许列表（列表为空表示不限制）
+func ipAllowed(clientIP string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, item := range allowed {
+		if strings.Contains(item, "/") {
+			if _, network, err := net.ParseCIDR(item); err == nil && network.Contains(ip) {
+				return true
+			}
+		} else if allowedIP := net.ParseIP(item); allowedIP != nil && allowedIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyAllowedIPs 获取 key 存储条目的来源 IP 允许列表
+func apiKeyAllowedIPs(entry string) []string {
+	apiKeyPoliciesMutex.RLock()
+	defer apiKeyPoliciesMutex.RUnlock()
+	return apiKeyPolicies[apiKeyUsageID(entry)].AllowedIPs
+}
+
+// apiKeyMonthlyQuota 获取 key 存储条目的月度 token 配额（0=不限制）
+func apiKeyMonthlyQuota(entry string) int64 {
+	apiKeyPoliciesMutex.RLock()
+	defer apiKeyPoliciesMutex.RUnlock()
+	return apiKeyPolicies[apiKeyUsageID(entry)].MonthlyTokenQuota
+}
+
+// renameApiKeyPolicy key 换了存储条目（轮换、明文转哈希）时把策略转到新的归属 ID，并删除旧 ID 的记录
+// 轮换宽限期内旧 key 的请求按新 key 的条目检查策略（见 lookupApiKeyEntry），旧记录不再需要
+func renameApiKeyPolicy(oldEntry, newEntry string) {
+	oldID, newID := apiKeyUsageID(oldEntry), apiKeyUsageID(newEntry)
+	if oldID == newID {
+		return
+	}
+	apiKeyPoliciesMutex.Lock()
+	policy, ok := apiKeyPolicies[oldID]
+	if ok {
+		apiKeyPolicies[newID] = policy
+		delete(apiKeyPolicies, oldID)
+	}
+	apiKeyPoliciesMutex.Unlock()
+	if ok {
+		if err := saveApiKeyPolicies(); err != nil && logger != nil {
+			logger.Error("", "保存 API-KEY 策略失败", map[string]any{"error": err.Error()})
+		}
+	}
+}
+
+// pruneApiKeyPolicies 删除不属于 entries 中任何 key 的策略（key 已从列表中删除或被替换）
+// 为什么：策略不删除的话，同一个 key 以后被重新加入时会意外带回旧的 IP 绑定和配额
+func pruneApiKeyPolicies(entries []string) {
+	keep := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		keep[apiKeyUsageID(entry)] = true
+	}
+	apiKeyPoliciesMutex.Lock()
+	removed := 0
+	for id := range apiKeyPolicies {
+		if !keep[id] {
+			delete(apiKeyPolicies, id)
+			removed++
+		}
+	}
+	apiKeyPoliciesMutex.Unlock()
+	if removed == 0 {
+		return
+	}
+	if err := saveApiKeyPolicies(); err != nil && logger != nil {
+		logger.Error("", "保存 API-KEY 策略失败", map[string]any{"error": err.Error()})
+	}
+	if logger != nil {
+		logger.Info("", "已删除失效 API-KEY 的策略", map[string]any{"count": removed})
+	}
+}
+
+// loadApiKeyPolicies 从文件加载 API-KEY 策略
+func loadApiKeyPolicies() {
+	data, err := storage.Get(apiKeyPoliciesFile)
+	if err != nil {
+		return
+	}
+	var policies map[string]ApiKeyPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		if logger != nil {
+			logger.Warn("", "API-KEY 策略文件无效，已忽略", map[string]any{"error": err.Error()})
+		}
+		return
+	}
+	if policies == nil {
+		policies = make(map[string]ApiKeyPolicy)
+	}
+	// 旧版本以 key 存储条目为索引，按当前 key 列表迁移到归属 ID
+	migrated := 0
+	for _, entry := range apiKeys {
+		if policy, ok := policies[entry]; ok {
+			delete(policies, entry)
+			policies[apiKeyUsageID(entry)] = policy
+			migrated++
+		}
+	}
+	apiKeyPoliciesMutex.Lock()
+	apiKeyPolicies = policies
+	apiKeyPoliciesMutex.Unlock()
+	if migrated > 0 {
+		if err := saveApiKeyPolicies(); err != nil && logger != nil {
+			logger.Error("", "保存 API-KEY 策略失败", map[string]any{"error": err.Error()})
+		}
+	}
+	// 需要在 loadApiKeys 之后调用：不属于当前任何 key 的记录（包括无法迁移的旧记录）直接删除
+	// key 列表为空时不清理：可能是 api-keys.json 读取失败，不能因此丢掉全部策略
+	if len(apiKeys) > 0 {
+		pruneApiKeyPolicies(apiKeys)
+	}
+	if logger != nil {
+		apiKeyPoliciesMutex.RLock()
+		count := len(apiKeyPolicies)
+		apiKeyPoliciesMutex.RUnlock()
+		logger.Info("", "已加载 API-KEY 策略", map[string]any{
+			"count":    count,
+			"migrated": migrated,
+		})
+	}
+}
+
+// saveApiKeyPolicies 保存 API-KEY 策略到文件
+func saveApiKeyPolicies() error {
+	apiKeyPoliciesMutex.RLock()
+	data, err := json.MarshalIndent(apiKeyPolicies, "", "  ")
+	apiKeyPoliciesMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return storage.Put(apiKeyPoliciesFile, data)
+}
+
+// handleGetApiKeyPolicies 获取各 API-KEY 的策略（按 key 标识返回，不暴露完整 key）
+func handleGetApiKeyPolicies(c *gin.Context) {
+	apiKeyPoliciesMutex.RLock()
+	defer apiKeyPoliciesMutex.RUnlock()
+	policies := make([]gin.H, 0, len(apiKeys))
+	for _, k := range apiKeys {
+		policy := apiKeyPolicies[apiKeyUsageID(k)]
+		allowed := policy.AllowedIPs
+		if allowed == nil {
+			allowed = []string{}
+		}
+		policies = append(policies, gin.H{"id": apiKeyID(k), "allowedIPs": allowed, "monthlyTokenQuota": policy.MonthlyTokenQuota})
+	}
+	c.JSON(200, gin.H{"policies": policies})
+}
+
+// handleUpdateApiKeyPolicy 设置单个 API-KEY 的来源 IP 允许列表和月度 token 配额
+// id 可以是完整 key 或前 8 位；allowedIPs 为空表示取消 IP 限制；monthlyTokenQuota 不传时保持不变，0 表示取消配额
+func handleUpdateApiKeyPolicy(c *gin.Context) {
+	var req struct {
+		ID                string   `json:"id"`
+		AllowedIPs        []string `json:"allowedIPs"`
+		MonthlyTokenQuota *int64   `json:"monthlyTokenQuota"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	allowed, err := validateAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.MonthlyTokenQuota != nil && *req.MonthlyTokenQuota < 0 {
+		c.JSON(400, gin.H{"error": "monthlyTokenQuota 不能为负数"})
+		return
+	}
+	index, code, msg := findApiKeyIndex(req.ID)
+	if index == -1 {
+		c.JSON(code, gin.H{"error": msg})
+		return
+	}
+	key := apiKeys[index]
+	id := apiKeyUsageID(key)
+
+	apiKeyPoliciesMutex.Lock()
+	old, existed := apiKeyPolicies[id]
+	policy := ApiKeyPolicy{AllowedIPs: allowed, MonthlyTokenQuota: old.MonthlyTokenQuota}
+	if req.MonthlyTokenQuota != nil {
+		policy.MonthlyTokenQuota = *req.MonthlyTokenQuota
+	}
+	if policy.isEmpty() {
+		delete(apiKeyPolicies, id)
+	} else {
+		apiKeyPolicies[id] = policy
+	}
+	apiKeyPoliciesMutex.Unlock()
+
+	if err := saveApiKeyPolicies(); err != nil {
+		apiKeyPoliciesMutex.Lock()
+		if existed {
+			apiKeyPolicies[id] = old
+		} else {
+			delete(apiKeyPolicies, id)
+		}
+		apiKeyPoliciesMutex.Unlock()
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+
+	if allowed == nil {
+		allowed = []string{}
+	}
+	c.JSON(200, gin.H{"message": "API-KEY 策略已更新", "id": apiKeyID(key), "allowedIPs": allowed, "monthlyTokenQuota": policy.MonthlyTokenQuota})
+}
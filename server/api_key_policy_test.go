@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupApiKeyPolicyTest 在轮换测试的基础上隔离策略文件，并挂载策略接口
+func setupApiKeyPolicyTest(t *testing.T, keys ...string) *gin.Engine {
+	t.Helper()
+	router := setupApiKeyRotationTest(t, keys...)
+	apiKeyPoliciesMutex.Lock()
+	oldPolicies, oldFile := apiKeyPolicies, apiKeyPoliciesFile
+	apiKeyPolicies = make(map[string]ApiKeyPolicy)
+	apiKeyPoliciesFile = filepath.Join(t.TempDir(), "api-key-policies.json")
+	apiKeyPoliciesMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeyPoliciesMutex.Lock()
+		apiKeyPolicies, apiKeyPoliciesFile = oldPolicies, oldFile
+		apiKeyPoliciesMutex.Unlock()
+	})
+	router.POST("/api/settings/api-keys/policies", handleUpdateApiKeyPolicy)
+	return router
+}
+
+// setApiKeyPolicy 调用策略接口
+func setApiKeyPolicy(router *gin.Engine, id string, allowedIPs []string) int {
+	body, _ := json.Marshal(map[string]any{"id": id, "allowedIPs": allowedIPs})
+	req, _ := http.NewRequest("POST", "/api/settings/api-keys/policies", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// authFromIP 用指定 key 从指定来源地址访问需要鉴权的接口，返回状态码
+func authFromIP(router *gin.Engine, key, remoteAddr string) int {
+	req, _ := http.NewRequest("GET", "/v1/ping", nil)
+	req.Header.Set("X-API-Key", key)
+	req.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// TestApiKeyPolicy_AllowedIPs 测试绑定来源 IP 后，列表内的 IP/网段放行，其他地址返回 403，未绑定的 key 不受影响
+func TestApiKeyPolicy_AllowedIPs(t *testing.T) {
+	router := setupApiKeyPolicyTest(t, "sk-aaaa-key-one", "sk-bbbb-key-two")
+
+	if code := setApiKeyPolicy(router, "sk-aaaa-", []string{"203.0.113.7", "10.0.0.0/8"}); code != 200 {
+		t.Fatalf("设置策略期望 200, 得到 %d", code)
+	}
+
+	tests := []struct {
+		name       string
+		key        string
+		remoteAddr string
+		wantCode   int
+	}{
+		{"精确 IP 命中", "sk-aaaa-key-one", "203.0.113.7:5000", 200},
+		{"CIDR 命中", "sk-aaaa-key-one", "10.1.2.3:5000", 200},
+		{"不在列表中", "sk-aaaa-key-one", "198.51.100.1:5000", 403},
+		{"未绑定的 key 不限制", "sk-bbbb-key-two", "198.51.100.1:5000", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := authFromIP(router, tt.key, tt.remoteAddr); code != tt.wantCode {
+				t.Errorf("期望 %d, 得到 %d", tt.wantCode, code)
+			}
+		})
+	}
+
+	// 清空列表即取消限制
+	if code := setApiKeyPolicy(router, "sk-aaaa-", nil); code != 200 {
+		t.Fatalf("清空策略期望 200, 得到 %d", code)
+	}
+	if code := authFromIP(router, "sk-aaaa-key-one", "198.51.100.1:5000"); code != 200 {
+		t.Errorf("清空后应不限制来源, 得到 %d", code)
+	}
+}
+
+// TestApiKeyPolicy_Validation 测试非法 IP/CIDR 和不存在的 key 被拒绝
+func TestApiKeyPolicy_Validation(t *testing.T) {
+	router := setupApiKeyPolicyTest(t, "sk-aaaa-key-one")
+
+	if code := setApiKeyPolicy(router, "sk-aaaa-", []string{"not-an-ip"}); code != 400 {
+		t.Errorf("非法 IP 期望 400, 得到 %d", code)
+	}
+	if code := setApiKeyPolicy(router, "sk-aaaa-", []string{"10.0.0.0/99"}); code != 400 {
+		t.Errorf("非法 CIDR 期望 400, 得到 %d", code)
+	}
+	if code := setApiKeyPolicy(router, "sk-zzzz-", []string{"10.0.0.1"}); code != 404 {
+		t.Errorf("不存在的 key 期望 404, 得到 %d", code)
+	}
+}
+
+// TestApiKeyPolicy_FollowsRotation 测试轮换后新 key 继承策略，宽限期内的旧 key 同样受限，旧 key 的记录删除
+func TestApiKeyPolicy_FollowsRotation(t *testing.T) {
+	router := setupApiKeyPolicyTest(t, "sk-aaaa-old-key")
+	if code := setApiKeyPolicy(router, "sk-aaaa-", []string{"203.0.113.7"}); code != 200 {
+		t.Fatalf("设置策略期望 200, 得到 %d", code)
+	}
+
+	code, resp := rotateApiKey(router, "sk-aaaa-", 60)
+	if code != 200 {
+		t.Fatalf("轮换期望 200, 得到 %d", code)
+	}
+	newKey, _ := resp["key"].(string)
+
+	for _, key := range []string{newKey, "sk-aaaa-old-key"} {
+		if code := authFromIP(router, key, "203.0.113.7:5000"); code != 200 {
+			t.Errorf("%s 从允许的 IP 访问期望 200, 得到 %d", key, code)
+		}
+		if code := authFromIP(router, key, "198.51.100.1:5000"); code != 403 {
+			t.Errorf("%s 从其他 IP 访问期望 403, 得到 %d", key, code)
+		}
+	}
+	apiKeyPoliciesMutex.RLock()
+	_, oldKept := apiKeyPolicies[apiKeyUsageID("sk-aaaa-old-key")]
+	apiKeyPoliciesMutex.RUnlock()
+	if oldKept {
+		t.Error("轮换后旧 key 的策略记录应删除（宽限期内按新 key 的策略检查）")
+	}
+}
+
+// TestApiKeyPolicy_RemovedWithKey 测试策略按归属 ID 保存（文件中不出现 key），key 被删除或替换后策略随之删除
+func TestApiKeyPolicy_RemovedWithKey(t *testing.T) {
+	mem := useMemoryStorage(t)
+	router := setupApiKeyPolicyTest(t, "sk-aaaa-key-one", "sk-bbbb-key-two")
+	router.POST("/api/settings/api-keys", handleUpdateApiKeys)
+	for _, id := range []string{"sk-aaaa-", "sk-bbbb-"} {
+		if code := setApiKeyPolicy(router, id, []string{"203.0.113.7"}); code != 200 {
+			t.Fatalf("设置策略期望 200, 得到 %d", code)
+		}
+	}
+	data, _ := mem.Get(apiKeyPoliciesFile)
+	if strings.Contains(string(data), "sk-aaaa-key-one") || !strings.Contains(string(data), apiKeyUsageID("sk-aaaa-key-one")) {
+		t.Errorf("策略文件应按归属 ID 保存, 不应出现 key: %s", data)
+	}
+
+	// 删除第一个 key，第二个 key 替换成新 key
+	body, _ := json.Marshal(map[string]any{"keys": []string{"sk-cccc-key-three"}})
+	req, _ := http.NewRequest("POST", "/api/settings/api-keys", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("保存 key 列表期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	apiKeyPoliciesMutex.RLock()
+	remaining := len(apiKeyPolicies)
+	apiKeyPoliciesMutex.RUnlock()
+	if remaining != 0 {
+		t.Errorf("删除和替换掉的 key 的策略应删除, 剩余 %d 条", remaining)
+	}
+	// 旧 key 重新加入时不应带回原来的 IP 绑定
+	if got := apiKeyAllowedIPs("sk-aaaa-key-one"); got != nil {
+		t.Errorf("重新加入的 key 不应继承旧策略: %v", got)
+	}
+}
+
+// TestLoadApiKeyPolicies_MigratesLegacyEntries 测试旧版本按 key 存储条目保存的策略加载时迁移到归属 ID，不属于任何 key 的记录删除
+func TestLoadApiKeyPolicies_MigratesLegacyEntries(t *testing.T) {
+	mem := useMemoryStorage(t)
+	setupApiKeyPolicyTest(t, "sk-aaaa-key-one")
+	legacy, _ := json.Marshal(map[string]ApiKeyPolicy{
+		"sk-aaaa-key-one":  {AllowedIPs: []string{"10.0.0.0/8"}},
+		"sk-gone-key-zzzz": {MonthlyTokenQuota: 100},
+	})
+	if err := mem.Put(apiKeyPoliciesFile, legacy); err != nil {
+		t.Fatalf("写入策略文件失败: %v", err)
+	}
+
+	loadApiKeyPolicies()
+
+	if got := apiKeyAllowedIPs("sk-aaaa-key-one"); len(got) != 1 || got[0] != "10.0.0.0/8" {
+		t.Errorf("旧策略应迁移到归属 ID: %v", got)
+	}
+	data, _ := mem.Get(apiKeyPoliciesFile)
+	if strings.Contains(string(data), "sk-aaaa-key-one") || strings.Contains(string(data), "sk-gone-key-zzzz") {
+		t.Errorf("迁移后策略文件中不应出现 key: %s", data)
+	}
+	if apiKeyMonthlyQuota("sk-gone-key-zzzz") != 0 {
+		t.Error("已删除 key 的旧策略应清理")
+	}
+}
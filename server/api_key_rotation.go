@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== API-KEY 轮换 ==========
+
+// maxApiKeyGraceSeconds 旧 key 宽限期上限（7 天）
+const maxApiKeyGraceSeconds = 7 * 24 * 3600
+
+// retiredApiKey 轮换后仍在宽限期内的旧 key
+type retiredApiKey struct {
+	ExpiresAt  time.Time
+	ReplacedBy string // 替换它的新 key 的存储条目，宽限期内的请求按新 key 的标识归属
+}
+
+// retiredApiKeys 旧 key 的存储条目 -> 宽限信息（仅保存在内存中，重启后宽限期结束）
+var retiredApiKeys = make(map[string]retiredApiKey)
+var retiredApiKeysMutex sync.Mutex
+
+// generateApiKey 生成新的随机 API-KEY
+func generateApiKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(b), nil
+}
+
+// retiredApiKeyReplacement 请求携带的旧 key 仍在宽限期内时返回替换它的新 key 条目；过期的顺便清理
+func retiredApiKeyReplacement(key string) (string, bool) {
+	retiredApiKeysMutex.Lock()
+	defer retiredApiKeysMutex.Unlock()
+	now := time.Now()
+	for entry, retired := range retiredApiKeys {
+		if now.After(retired.ExpiresAt) {
+			delete(retiredApiKeys, entry)
+			continue
+		}
+		if apiKeyMatches(entry, key) {
+			return retired.ReplacedBy, true
+		}
+	}
+	return "", false
+}
+
+// findApiKeyIndex 按完整 key 或前缀（管理页面展示的前 8 位）查找 API-KEY（存储条目可以是哈希格式）
+// 找不到返回 -1 和 404；前缀命中多个时返回 -1 和 409，避免操作错 key
+func findApiKeyIndex(id string) (index int, code int, msg string) {
+	index = -1
+	for i, k := range apiKeys {
+		if k == id || apiKeyMatches(k, id) {
+			return i, 200, ""
+		}
+		if apiKeyID(k) == id {
+			if index != -1 {
+				return -1, 409, "前缀匹配到多个 API-KEY，请使用完整 key"
+			}
+			index = i
+		}
+	}
+	if index == -1 {
+		return -1, 404, "API-KEY 不存在"
+	}
+	return index, 200, ""
+}
+
+// handleRotateApiKey 轮换单个 API-KEY：原位替换为新生成的 key，新 key 明文只在响应中返回一次
+// id 可以是完整 key 或管理页面展示的前 8 位；graceSeconds > 0 时旧 key 在宽限期内仍然有效
+func handleRotateApiKey(c *gin.Context) {
+	var req struct {
+		ID           string `json:"id"`
+		GraceSeconds int    `json:"graceSeconds"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ID == "" {
+		c.JSON(400, gin.H{"error": "id 不能为空"})
+		return
+	}
+	if req.GraceSeconds < 0 || req.GraceSeconds > maxApiKeyGraceSeconds {
+		c.JSON(400, gin.H{"error": "graceSeconds 必须在 0-604800 之间"})
+		return
+	}
+
+	index, code, msg := findApiKeyIndex(req.ID)
+	if index == -1 {
+		c.JSON(code, gin.H{"error": msg})
+		return
+	}
+
+	newKey, err := generateApiKey()
+	if err != nil {
+		c.JSON(500, gin.H{"error": "生成 API-KEY 失败: " + err.Error()})
+		return
+	}
+
+	// 开启 hashApiKeys 时新 key 以哈希格式保存，明文只出现在本次响应中
+	newEntry, err := storedApiKey(newKey, nil)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "API-KEY 哈希失败: " + err.Error()})
+		return
+	}
+
+	oldKey := apiKeys[index]
+	apiKeys[index] = newEntry
+	if err := saveApiKeys(); err != nil {
+		apiKeys[index] = oldKey
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+
+	// IP 绑定、配额等 key 级策略跟随到新 key
+	renameApiKeyPolicy(oldKey, newEntry)
+	// 用量跟随到新 key，月度配额不因轮换清零
+	renameApiKeyUsage(oldKey, newEntry)
+
+	resp := gin.H{"message": "API-KEY 已轮换", "key": newKey, "id": apiKeyID(newEntry)}
+	if req.GraceSeconds > 0 {
+		expiresAt := time.Now().Add(time.Duration(req.GraceSeconds) * time.Second)
+		retiredApiKeysMutex.Lock()
+		retiredApiKeys[oldKey] = retiredApiKey{ExpiresAt: expiresAt, ReplacedBy: newEntry}
+		retiredApiKeysMutex.Unlock()
+		resp["oldKeyValidUntil"] = expiresAt.Unix()
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "API-KEY 已轮换", map[string]any{
+			"oldId":        apiKeyID(oldKey),
+			"newId":        apiKeyID(newEntry),
+			"graceSeconds": req.GraceSeconds,
+		})
+	}
+
+	newData, _ := json.Marshal(apiKeys)
+	resp["hash"] = computeHash(newData)
+	c.JSON(200, resp)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupApiKeyRotationTest 使用临时文件和给定的 key 列表，返回挂载了轮换接口和鉴权接口的路由
+func setupApiKeyRotationTest(t *testing.T, keys ...string) *gin.Engine {
+	t.Helper()
+	oldKeys, oldFile := apiKeys, apiKeysFile
+	apiKeys = keys
+	apiKeysFile = filepath.Join(t.TempDir(), "api-keys.json")
+	retiredApiKeysMutex.Lock()
+	oldRetired := retiredApiKeys
+	retiredApiKeys = make(map[string]retiredApiKey)
+	retiredApiKeysMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeys, apiKeysFile = oldKeys, oldFile
+		retiredApiKeysMutex.Lock()
+		retiredApiKeys = oldRetired
+		retiredApiKeysMutex.Unlock()
+	})
+
+	router := gin.New()
+	router.POST("/api/settings/api-keys/rotate", handleRotateApiKey)
+	router.GET("/v1/ping", apiKeyAuthMiddleware(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"keyId": getAPIKeyID(c)})
+	})
+	return router
+}
+
+// rotateApiKey 调用轮换接口
+func rotateApiKey(router *gin.Engine, id string, graceSeconds int) (int, map[string]any) {
+	body, _ := json.Marshal(map[string]any{"id": id, "graceSeconds": graceSeconds})
+	req, _ := http.NewRequest("POST", "/api/settings/api-keys/rotate", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+// authWithKey 用指定 key 访问需要鉴权的接口，返回状态码
+func authWithKey(router *gin.Engine, key string) int {
+	req, _ := http.NewRequest("GET", "/v1/ping", nil)
+	req.Header.Set("X-API-Key", key)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code
+}
+
+// TestRotateApiKey_NoGrace 测试按前缀轮换后原位替换，旧 key 立即失效，其他 key 不受影响
+func TestRotateApiKey_NoGrace(t *testing.T) {
+	router := setupApiKeyRotationTest(t, "sk-aaaa-old-key", "sk-bbbb-other-key")
+
+	code, resp := rotateApiKey(router, "sk-aaaa-", 0)
+	if code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %v", code, resp)
+	}
+	newKey, _ := resp["key"].(string)
+	if newKey == "" || newKey == "sk-aaaa-old-key" {
+		t.Fatalf("应返回新的 key: %v", resp)
+	}
+	if apiKeys[0] != newKey || apiKeys[1] != "sk-bbbb-other-key" {
+		t.Errorf("应原位替换且不影响其他 key: %v", apiKeys)
+	}
+
+	if got := authWithKey(router, "sk-aaaa-old-key"); got != 401 {
+		t.Errorf("无宽限期时旧 key 应立即失效, 得到 %d", got)
+	}
+	if got := authWithKey(router, newKey); got != 200 {
+		t.Errorf("新 key 应可用, 得到 %d", got)
+	}
+	if got := authWithKey(router, "sk-bbbb-other-key"); got != 200 {
+		t.Errorf("其他 key 应不受影响, 得到 %d", got)
+	}
+}
+
+// TestRotateApiKey_WithGrace 测试宽限期内旧 key 仍可用（按新 key 归属），过期后失效
+func TestRotateApiKey_WithGrace(t *testing.T) {
+	router := setupApiKeyRotationTest(t, "sk-aaaa-old-key")
+
+	code, resp := rotateApiKey(router, "sk-aaaa-old-key", 3600)
+	if code != 200 || resp["oldKeyValidUntil"] == nil {
+		t.Fatalf("期望 200 且返回宽限截止时间, 得到 %d: %v", code, resp)
+	}
+	newKey := resp["key"].(string)
+
+	if got := authWithKey(router, "sk-aaaa-old-key"); got != 200 {
+		t.Errorf("宽限期内旧 key 应可用, 得到 %d", got)
+	}
+	if replacement, ok := retiredApiKeyReplacement("sk-aaaa-old-key"); !ok || replacement != newKey {
+		t.Errorf("旧 key 应归属到新 key: %s", replacement)
+	}
+
+	// 模拟宽限期已过
+	retiredApiKeysMutex.Lock()
+	retired := retiredApiKeys["sk-aaaa-old-key"]
+	retired.ExpiresAt = time.Now().Add(-time.Second)
+	retiredApiKeys["sk-aaaa-old-key"] = retired
+	retiredApiKeysMutex.Unlock()
+
+	if got := authWithKey(router, "sk-aaaa-old-key"); got != 401 {
+		t.Errorf("宽限期过后旧 key 应失效, 得到 %d", got)
+	}
+}
+
+// TestRotateApiKey_Errors 测试不存在、前缀歧义和宽限期越界
+func TestRotateApiKey_Errors(t *testing.T) {
+	router := setupApiKeyRotationTest(t, "sk-aaaa-key-one", "sk-aaaa-key-two")
+
+	if code, _ := rotateApiKey(router, "sk-zzzz-", 0); code != 404 {
+		t.Errorf("不存在的 key 应返回 404, 得到 %d", code)
+	}
+	if code, _ := rotateApiKey(router, "sk-aaaa-", 0); code != 409 {
+		t.Errorf("前缀匹配多个 key 应返回 409, 得到 %d", code)
+	}
+	if code, _ := rotateApiKey(router, "sk-aaaa-key-one", -1); code != 400 {
+		t.Errorf("宽限期为负应返回 400, 得到 %d", code)
+	}
+	if apiKeys[0] != "sk-aaaa-key-one" || apiKeys[1] != "sk-aaaa-key-two" {
+		t.Errorf("失败时不应修改 key 列表: %v", apiKeys)
+	}
+}
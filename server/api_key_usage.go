@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== API-KEY 用量与月度配额 ==========
+// 为什么：共享部署需要知道每个 key 用了多少 token，并能给单个 key 设上限，避免一个调用方耗尽所有账号额度
+// 用量按 key 的哈希（apiKeyUsageID）归属，文件中不出现 key 本身；配额在 API-KEY 策略中配置（monthlyTokenQuota），
+// 按自然月（UTC）统计，每月 1 日 0 点重新计算
+
+// APIKeyUsageIDKey 通过验证的 API-KEY 用量归属 ID 的 context key
+const APIKeyUsageIDKey = "apiKeyUsageId"
+
+// ApiKeyUsage 单个 API-KEY 的累计用量和当月用量
+type ApiKeyUsage struct {
+	Prefix            string `json:"prefix"` // key 前缀（apiKeyID），key 删除后仍可辨认
+	InputTokens       int64  `json:"inputTokens"`
+	OutputTokens      int64  `json:"outputTokens"`
+	RequestCount      int64  `json:"requestCount"`
+	Month             string `json:"month"` // 当月用量所属月份（UTC，2006-01）
+	MonthInputTokens  int64  `json:"monthInputTokens"`
+	MonthOutputTokens int64  `json:"monthOutputTokens"`
+	MonthRequestCount int64  `json:"monthRequestCount"`
+	UpdatedAt         int64  `json:"updatedAt"`
+}
+
+// monthTokens 指定月份的 token 用量（input+output），记录不属于该月时为 0
+func (u *ApiKeyUsage) monthTokens(month string) int64 {
+	if u == nil || u.Month != month {
+		return 0
+	}
+	return u.MonthInputTokens + u.MonthOutputTokens
+}
+
+var apiKeyUsageFile = "api-key-usage.json"
+var apiKeyUsage = make(map[string]*ApiKeyUsage) // apiKeyUsageID -> 用量
+var apiKeyUsageMutex sync.RWMutex
+
+// usageMonth 用量统计的月份（UTC）
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// nextUsageMonthStart 下一个统计月的开始时间（配额重置时间）
+func nextUsageMonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// apiKeyUsageID key 存储条目对应的用量归属 ID（API-KEY 策略也按它索引）
+// 哈希格式直接取保存的哈希，明文取 SHA-256；只保留前 16 位十六进制，足以区分又不暴露完整哈希
+func apiKeyUsageID(entry string) string {
+	if hashed, ok := parseHashedApiKey(entry); ok {
+		return hex.EncodeToString(hashed.sum)[:16]
+	}
+	sum := sha256.Sum256([]byte(entry))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+// recordApiKeyUsage 把一次请求的 token 计入调用方 API-KEY 的用量（未配置 API-KEY 时不记录）
+// 在每个 addTokenStats 调用处一起调用，两者口径一致
+func recordApiKeyUsage(c *gin.Context, input, output int) {
+	usageID := c.GetString(APIKeyUsageIDKey)
+	if usageID == "" {
+		return
+	}
+	addApiKeyUsage(usageID, getAPIKeyID(c), input, output, time.Now())
+}
+
+// addApiKeyUsage 累加用量，跨月时先把当月用量清零
+func addApiKeyUsage(usageID, prefix string, input, output int, now time.Time) {
+	month := usageMonth(now)
+	apiKeyUsageMutex.Lock()
+	defer apiKeyUsageMutex.Unlock()
+	u, ok := apiKeyUsage[usageID]
+	if !ok {
+		u = &ApiKeyUsage{}
+		apiKeyUsage[usageID] = u
+	}
+	if u.Month != month {
+		u.Month = month
+		u.MonthInputTokens, u.MonthOutputTokens, u.MonthRequestCount = 0, 0, 0
+	}
+	u.Prefix = prefix
+	u.InputTokens += int64(input)
+	u.OutputTokens += int64(output)
+	u.RequestCount++
+	u.MonthInputTokens += int64(input)
+	u.MonthOutputTokens += int64(output)
+	u.MonthRequestCount++
+	u.UpdatedAt = now.Unix()
+}
+
+// renameApiKeyUsage key 换了存储条目（轮换、明文转哈希）时把用量转到新的归属 ID，月度配额不因此清零
+func renameApiKeyUsage(oldEntry, newEntry string) {
+	oldID, newID := apiKeyUsageID(oldEntry), apiKeyUsageID(newEntry)
+	if oldID == newID {
+		return
+	}
+	apiKeyUsageMutex.Lock()
+	defer apiKeyUsageMutex.Unlock()
+	if u, ok := apiKeyUsage[oldID]; ok {
+		u.Prefix = apiKeyID(newEntry)
+		apiKeyUsage[newID] = u
+		delete(apiKeyUsage, oldID)
+	}
+}
+
+// apiKeyQuotaStatus 判断 key 当月是否已用完配额，返回当月用量和配额（未配置配额时 quota 为 0）
+func apiKeyQuotaStatus(entry string, now time.Time) (used, quota int64, exceeded bool) {
+	quota = apiKeyMonthlyQuota(entry)
+	if quota <= 0 {
+		return 0, 0, false
+	}
+	apiKeyUsageMutex.RLock()
+	used = apiKeyUsage[apiKeyUsageID(entry)].monthTokens(usageMonth(now))
+	apiKeyUsageMutex.RUnlock()
+	return used, quota, used >= quota
+}
+
+// rejectApiKeyOverQuota key 当月用量达到配额时返回 429（quota_exceeded），Retry-After 为距下月重置的秒数
+func rejectApiKeyOverQuota(c *gin.Context, entry string) bool {
+	now := time.Now()
+	used, quota, exceeded := apiKeyQuotaStatus(entry, now)
+	if !exceeded {
+		return false
+	}
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "API-KEY 已用完当月 token 配额", map[string]any{
+			"apiKeyId": apiKeyID(entry),
+			"used":     used,
+			"quota":    quota,
+		})
+	}
+	retryAfter := int(nextUsageMonthStart(now).Sub(now).Seconds()) + 1
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(429, gin.H{"error": map[string]any{
+		"message": fmt.Sprintf("Monthly token quota exceeded for this API key (%d/%d)", used, quota),
+		"type":    "quota_exceeded",
+	}, "msgId": GetMsgID(c)})
+	c.Abort()
+	return true
+}
+
+// loadApiKeyUsage 启动时加载 API-KEY 用量
+func loadApiKeyUsage() {
+	var usage map[string]*ApiKeyUsage
+	if !loadStatsFile("apiKeyUsage", apiKeyUsageFile, &usage) || usage == nil {
+		return
+	}
+	apiKeyUsageMutex.Lock()
+	apiKeyUsage = usage
+	apiKeyUsageMutex.Unlock()
+	if logger != nil {
+		logger.Info("", "API-KEY 用量: 已加载", map[string]any{"count": len(usage)})
+	}
+}
+
+// saveApiKeyUsage 保存 API-KEY 用量
+func saveApiKeyUsage() error {
+	apiKeyUsageMutex.RLock()
+	data, _ := json.MarshalIndent(apiKeyUsage, "", "  ")
+	apiKeyUsageMutex.RUnlock()
+	return writeStatsFile("apiKeyUsage", apiKeyUsageFile, data)
+}
+
+// apiKeyUsageWorker 后台协程定期落盘 API-KEY 用量
+func apiKeyUsageWorker() {
+	ticker := time.NewTicker(30 * time.Second)
+	for range ticker.C {
+		saveApiKeyUsage()
+	}
+}
+
+// ApiKeyUsageInfo /api/stats/keys 中单个 key 的用量（只返回前缀，不暴露 key）
+type ApiKeyUsageInfo struct {
+	ID                string `json:"id"`
+	Key               string `json:"key"`
+	UsageID           string `json:"usageId"`
+	InputTokens       int64  `json:"inputTokens"`
+	OutputTokens      int64  `json:"outputTokens"`
+	RequestCount      int64  `json:"requestCount"`
+	Month             string `json:"month"`
+	MonthTokens       int64  `json:"monthTokens"`
+	MonthRequestCount int64  `json:"monthRequestCount"`
+	MonthlyTokenQuota int64  `json:"monthlyTokenQuota,omitempty"`
+	Configured        bool   `json:"configured"` // key 是否仍在 API-KEY 列表中
+}
+
+// handleGetApiKeyUsage 按 API-KEY 返回累计和当月 token 用量（按当月用量从高到低排序）
+func handleGetApiKeyUsage(c *gin.Context) {
+	month := usageMonth(time.Now())
+	entries := make(map[string]string, len(apiKeys)) // 用量归属 ID -> 存储条目
+	for _, entry := range apiKeys {
+		entries[apiKeyUsageID(entry)] = entry
+	}
+
+	apiKeyUsageMutex.RLock()
+	result := make([]ApiKeyUsageInfo, 0, len(apiKeyUsage))
+	for usageID, u := range apiKeyUsage {
+		info := ApiKeyUsageInfo{
+			ID:           u.Prefix,
+			Key:          u.Prefix + "...",
+			UsageID:      usageID,
+			InputTokens:  u.InputTokens,
+			OutputTokens: u.OutputTokens,
+			RequestCount: u.RequestCount,
+			Month:        month,
+			MonthTokens:  u.monthTokens(month),
+		}
+		if u.Month == month {
+			info.MonthRequestCount = u.MonthRequestCount
+		}
+		if entry, ok := entries[usageID]; ok {
+			info.Configured = true
+			info.MonthlyTokenQuota = apiKeyMonthlyQuota(entry)
+		}
+		result = append(result, info)
+	}
+	apiKeyUsageMutex.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MonthTokens != result[j].MonthTokens {
+			return result[i].MonthTokens > result[j].MonthTokens
+		}
+		return result[i].UsageID < result[j].UsageID
+	})
+	c.JSON(200, gin.H{"month": month, "keys": result, "count": len(result)})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// useApiKeyUsageState 隔离 API-KEY 用量和策略的全局状态
+func useApiKeyUsageState(t *testing.T) {
+	t.Helper()
+	apiKeyUsageMutex.Lock()
+	oldUsage := apiKeyUsage
+	apiKeyUsage = make(map[string]*ApiKeyUsage)
+	apiKeyUsageMutex.Unlock()
+	apiKeyPoliciesMutex.Lock()
+	oldPolicies := apiKeyPolicies
+	apiKeyPolicies = make(map[string]ApiKeyPolicy)
+	apiKeyPoliciesMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeyUsageMutex.Lock()
+		apiKeyUsage = oldUsage
+		apiKeyUsageMutex.Unlock()
+		apiKeyPoliciesMutex.Lock()
+		apiKeyPolicies = oldPolicies
+		apiKeyPoliciesMutex.Unlock()
+	})
+}
+
+// TestApiKeyUsage_AccumulateAndQuota 聊天请求的 token 计入调用方 key，用量达到月度配额后返回 429
+func TestApiKeyUsage_AccumulateAndQuota(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+		_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"tokenUsage":{"uncachedInputTokens":100,"outputTokens":20}}`))
+	})
+	defer cleanup()
+	useApiKeyUsageState(t)
+	const key, other = "sk-usage-key-111111", "sk-other-key-222222"
+	router := setupApiKeyRotationTest(t, key, other)
+	router.POST("/v1/messages", apiKeyAuthMiddleware(), handleClaudeChat)
+	router.GET("/api/stats/keys", handleGetApiKeyUsage)
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	send := func(k string) *httptest.ResponseRecorder {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", k)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := send(key); w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+	}
+	req, _ := http.NewRequest("GET", "/api/stats/keys", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), key) {
+		t.Errorf("用量接口不应返回完整 key: %s", w.Body.String())
+	}
+	var resp struct {
+		Keys []ApiKeyUsageInfo `json:"keys"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Keys) != 1 {
+		t.Fatalf("只有发过请求的 key 有用量: %s", w.Body.String())
+	}
+	got := resp.Keys[0]
+	if got.ID != "sk-usage" || got.InputTokens != 200 || got.OutputTokens != 40 || got.RequestCount != 2 || got.MonthTokens != 240 || !got.Configured {
+		t.Errorf("用量累加错误: %+v", got)
+	}
+
+	// 配额 240：当月已用 240，再请求返回 429；其他 key 不受影响
+	apiKeyPoliciesMutex.Lock()
+	apiKeyPolicies[apiKeyUsageID(key)] = ApiKeyPolicy{MonthlyTokenQuota: 240}
+	apiKeyPoliciesMutex.Unlock()
+	w = send(key)
+	if w.Code != 429 || !strings.Contains(w.Body.String(), "quota_exceeded") {
+		t.Fatalf("超出配额期望 429 quota_exceeded, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("超出配额应返回 Retry-After")
+	}
+	if w := send(other); w.Code != 200 {
+		t.Errorf("其他 key 不应受配额影响, 得到 %d", w.Code)
+	}
+
+	// 用量属于上个月时（跨月重置）不再拦截
+	apiKeyUsageMutex.Lock()
+	apiKeyUsage[apiKeyUsageID(key)].Month = usageMonth(time.Now().AddDate(0, -1, -1))
+	apiKeyUsageMutex.Unlock()
+	if w := send(key); w.Code != 200 {
+		t.Errorf("跨月后配额应重新计算, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestAddApiKeyUsage_MonthBoundary 跨月（UTC）时当月用量清零、累计用量保留，配额按当月用量判断
+func TestAddApiKeyUsage_MonthBoundary(t *testing.T) {
+	useApiKeyUsageState(t)
+	const entry = "sk-boundary-key-1234"
+	id := apiKeyUsageID(entry)
+	apiKeyPolicies[id] = ApiKeyPolicy{MonthlyTokenQuota: 100}
+
+	endOfJan := time.Date(2026, 1, 31, 23, 59, 59, 0, time.UTC)
+	startOfFeb := endOfJan.Add(time.Second)
+
+	addApiKeyUsage(id, "sk-bound", 80, 30, endOfJan)
+	if used, _, exceeded := apiKeyQuotaStatus(entry, endOfJan); used != 110 || !exceeded {
+		t.Errorf("1 月应已超出配额: used=%d exceeded=%v", used, exceeded)
+	}
+	if used, _, exceeded := apiKeyQuotaStatus(entry, startOfFeb); used != 0 || exceeded {
+		t.Errorf("2 月 1 日 0 点应重置: used=%d exceeded=%v", used, exceeded)
+	}
+
+	addApiKeyUsage(id, "sk-bound", 5, 5, startOfFeb)
+	u := apiKeyUsage[id]
+	if u.Month != "2026-02" || u.monthTokens("2026-02") != 10 || u.MonthRequestCount != 1 {
+		t.Errorf("跨月后当月用量应从 0 开始: %+v", u)
+	}
+	if u.InputTokens != 85 || u.OutputTokens != 35 || u.RequestCount != 2 {
+		t.Errorf("累计用量应保留: %+v", u)
+	}
+	if got := nextUsageMonthStart(time.Date(2026, 12, 15, 0, 0, 0, 0, time.UTC)); !got.Equal(time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("12 月的下一个重置时间应为次年 1 月 1 日: %v", got)
+	}
+}
+
+// TestApiKeyUsage_FollowsRotation 轮换 key 后用量跟随到新 key，配额不因轮换清零
+func TestApiKeyUsage_FollowsRotation(t *testing.T) {
+	useApiKeyUsageState(t)
+	useMemoryStorage(t)
+	const key = "sk-rotate-usage-0001"
+	router := setupApiKeyRotationTest(t, key)
+	addApiKeyUsage(apiKeyUsageID(key), apiKeyID(key), 50, 50, time.Now())
+
+	body, _ := json.Marshal(map[string]any{"id": key})
+	req, _ := http.NewRequest("POST", "/api/settings/api-keys/rotate", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("轮换期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	u := apiKeyUsage[apiKeyUsageID(apiKeys[0])]
+	if u == nil || u.monthTokens(usageMonth(time.Now())) != 100 {
+		t.Errorf("用量应跟随到新 key: %+v", u)
+	}
+	if _, ok := apiKeyUsage[apiKeyUsageID(key)]; ok {
+		t.Error("旧 key 的用量记录应移除")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 熔断恢复配置 ==========
+
+// 熔断恢复参数的取值范围
+const (
+	minHalfOpenSuccessThreshold = 1
+	maxHalfOpenSuccessThreshold = 100
+	minOpenDurationSeconds      = 10
+	maxOpenDurationSeconds      = 24 * 3600
+	minHalfOpenMaxProbes        = 1
+	maxHalfOpenMaxProbes        = 100
+)
+
+var circuitConfigFile = "circuit-config.json"
+var circuitConfigMutex sync.Mutex
+
+// CircuitRecoveryConfig 熔断恢复配置（控制账号熔断后多快恢复）
+type CircuitRecoveryConfig struct {
+	HalfOpenSuccessThreshold int `json:"halfOpenSuccessThreshold"` // 半开状态下连续成功多少次后关闭熔断
+	OpenDurationSeconds      int `json:"openDurationSeconds"`      // 熔断多少秒后进入半开状态
+	HalfOpenMaxProbes        int `json:"halfOpenMaxProbes"`        // 半开状态下同时放行的试探请求数，其余请求视同熔断
+}
+
+// defaultCircuitRecoveryConfig 默认值与 kiroclient.DefaultCircuitBreakerConfig 保持一致
+func defaultCircuitRecoveryConfig() CircuitRecoveryConfig {
+	def := kiroclient.DefaultCircuitBreakerConfig
+	return CircuitRecoveryConfig{
+		HalfOpenSuccessThreshold: def.HalfOpenMaxSuccess,
+		OpenDurationSeconds:      int(def.OpenDuration / time.Second),
+		HalfOpenMaxProbes:        def.HalfOpenMaxProbes,
+	}
+}
+
+// validateCircuitRecoveryConfig 校验熔断恢复配置
+func validateCircuitRecoveryConfig(cfg CircuitRecoveryConfig) error {
+	if cfg.HalfOpenSuccessThreshold < minHalfOpenSuccessThreshold || cfg.HalfOpenSuccessThreshold > maxHalfOpenSuccessThreshold {
+		return fmt.Errorf("halfOpenSuccessThreshold 必须在 %d-%d 之间", minHalfOpenSuccessThreshold, maxHalfOpenSuccessThreshold)
+	}
+	if cfg.OpenDurationSeconds < minOpenDurationSeconds || cfg.OpenDurationSeconds > maxOpenDurationSeconds {
+		return fmt.Errorf("openDurationSeconds 必须在 %d-%d 之间", minOpenDurationSeconds, maxOpenDurationSeconds)
+	}
+	if cfg.HalfOpenMaxProbes < minHalfOpenMaxProbes || cfg.HalfOpenMaxProbes > maxHalfOpenMaxProbes {
+		return fmt.Errorf("halfOpenMaxProbes 必须在 %d-%d 之间", minHalfOpenMaxProbes, maxHalfOpenMaxProbes)
+	}
+	return nil
+}
+
+// currentCircuitRecoveryConfig 从 AuthManager 读取当前生效的熔断恢复配置
+func currentCircuitRecoveryConfig() CircuitRecoveryConfig {
+	cfg := client.Auth.GetCircuitConfig()
+	return CircuitRecoveryConfig{
+		HalfOpenSuccessThreshold: cfg.HalfOpenMaxSuccess,
+		OpenDurationSeconds:      int(cfg.OpenDuration / time.Second),
+		HalfOpenMaxProbes:        cfg.HalfOpenMaxProbes,
+	}
+}
+
+// applyCircuitRecoveryConfig 把熔断恢复配置写入 AuthManager（其余熔断参数保持不变）
+func applyCircuitRecoveryConfig(cfg CircuitRecoveryConfig) {
+	full := client.Auth.GetCircuitConfig()
+	full.HalfOpenMaxSuccess = cfg.HalfOpenSuccessThreshold
+	full.OpenDuration = time.Duration(cfg.OpenDurationSeconds) * time.Second
+	full.HalfOpenMaxProbes = cfg.HalfOpenMaxProbes
+	client.Auth.SetCircuitConfig(full)
+}
+
+// loadCircuitConfig 加载熔断恢复配置并应用到 AuthManager
+func loadCircuitConfig() {
+	data, err := storage.Get(circuitConfigFile)
+	if err != nil {
+		return
+	}
+	cfg := defaultCircuitRecoveryConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return
+	}
+	if err := validateCircuitRecoveryConfig(cfg); err != nil {
+		if logger != nil {
+			logger.Warn("", "熔断恢复配置无效，使用默认值", map[string]any{
+				"error": err.Error(),
+			})
+		}
+		return
+	}
+	applyCircuitRecoveryConfig(cfg)
+	if logger != nil {
+		logger.Info("", "熔断恢复配置已加载", map[string]any{
+			"halfOpenSuccessThreshold": cfg.HalfOpenSuccessThreshold,
+			"openDurationSeconds":      cfg.OpenDurationSeconds,
+			"halfOpenMaxProbes":        cfg.HalfOpenMaxProbes,
+		})
+	}
+}
+
+// saveCircuitConfig 保存熔断恢复配置
+func saveCircuitConfig(cfg CircuitRecoveryConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(circuitConfigFile, data)
+}
+
+// handleGetCircuitConfig 获取熔断恢复配置
+func handleGetCircuitConfig(c *gin.Context) {
+	cfg := currentCircuitRecoveryConfig()
+	data, _ := json.Marshal(cfg)
+	c.JSON(200, gin.H{
+		"config": cfg,
+		"hash":   computeHash(data),
+	})
+}
+
+// handleUpdateCircuitConfig 更新熔断恢复配置
+func handleUpdateCircuitConfig(c *gin.Context) {
+	var req struct {
+		Config CircuitRecoveryConfig `json:"config"`
+		Hash   string                `json:"hash"`
+	}
+	// 未传的字段使用默认值（兼容不带 halfOpenMaxProbes 的旧客户端）
+	req.Config = defaultCircuitRecoveryConfig()
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateCircuitRecoveryConfig(req.Config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	circuitConfigMutex.Lock()
+	defer circuitConfigMutex.Unlock()
+
+	// 乐观锁校验
+	if req.Hash != "" {
+		currentData, _ := json.Marshal(currentCircuitRecoveryConfig())
+		if req.Hash != computeHash(currentData) {
+			c.JSON(409, gin.H{"error": "配置已被修改，请刷新后重试"})
+			return
+		}
+	}
+
+	if err := saveCircuitConfig(req.Config); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+	applyCircuitRecoveryConfig(req.Config)
+
+	newData, _ := json.Marshal(req.Config)
+	c.JSON(200, gin.H{"message": "熔断恢复配置已更新", "hash": computeHash(newData)})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestCircuitConfig_UpdateAndStatus 测试更新熔断恢复配置后生效并在状态接口中返回
+func TestCircuitConfig_UpdateAndStatus(t *testing.T) {
+	router := setupCircuitBreakerTestRouter("acc-1")
+	router.GET("/api/circuit-breaker/config", handleGetCircuitConfig)
+	router.POST("/api/circuit-breaker/config", handleUpdateCircuitConfig)
+
+	oldFile := circuitConfigFile
+	circuitConfigFile = filepath.Join(t.TempDir(), "circuit-config.json")
+	defer func() { circuitConfigFile = oldFile }()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/circuit-breaker/config", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 超出范围的值被拒绝
+	for _, body := range []string{
+		`{"config":{"halfOpenSuccessThreshold":0,"openDurationSeconds":60}}`,
+		`{"config":{"halfOpenSuccessThreshold":3,"openDurationSeconds":1}}`,
+		`{"config":{"halfOpenSuccessThreshold":101,"openDurationSeconds":60}}`,
+	} {
+		if w := post(body); w.Code != 400 {
+			t.Errorf("%s: 期望 400, 得到 %d", body, w.Code)
+		}
+	}
+
+	// 旧 hash 冲突返回 409
+	if w := post(`{"config":{"halfOpenSuccessThreshold":3,"openDurationSeconds":60},"hash":"stale"}`); w.Code != 409 {
+		t.Errorf("hash 不一致应返回 409, 得到 %d", w.Code)
+	}
+
+	if w := post(`{"config":{"halfOpenSuccessThreshold":3,"openDurationSeconds":60,"halfOpenMaxProbes":0}}`); w.Code != 400 {
+		t.Errorf("halfOpenMaxProbes 为 0 应返回 400, 得到 %d", w.Code)
+	}
+
+	if w := post(`{"config":{"halfOpenSuccessThreshold":3,"openDurationSeconds":60,"halfOpenMaxProbes":2}}`); w.Code != 200 {
+		t.Fatalf("合法配置应更新成功, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	cfg := client.Auth.GetCircuitConfig()
+	if cfg.HalfOpenMaxSuccess != 3 || cfg.OpenDuration != time.Minute || cfg.HalfOpenMaxProbes != 2 {
+		t.Errorf("配置未应用到 AuthManager: %+v", cfg)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/circuit-breaker/status", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var status struct {
+		Config CircuitRecoveryConfig `json:"config"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("解析状态响应失败: %v", err)
+	}
+	if status.Config.HalfOpenSuccessThreshold != 3 || status.Config.OpenDurationSeconds != 60 || status.Config.HalfOpenMaxProbes != 2 {
+		t.Errorf("状态接口应返回生效配置: %+v", status.Config)
+	}
+
+	// 重新加载持久化的配置
+	client.Auth.SetCircuitConfig(kiroclient.DefaultCircuitBreakerConfig)
+	loadCircuitConfig()
+	if got := currentCircuitRecoveryConfig(); got.HalfOpenSuccessThreshold != 3 || got.OpenDurationSeconds != 60 || got.HalfOpenMaxProbes != 2 {
+		t.Errorf("应从文件加载配置: %+v", got)
+	}
+}
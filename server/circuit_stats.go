@@ -88,6 +88,48 @@ func (cs *CircuitStats) ClearAccount(accountID string) {
 	cs.mu.Unlock()
 }
 
+// AccountIDs 返回当前有统计数据的账号 ID 列表
+// 用于清理已删除账号的残留统计
+func (cs *CircuitStats) AccountIDs() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	ids := make([]string, 0, len(cs.accounts))
+	for id := range cs.accounts {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Snapshot 导出所有账号的时间桶副本（用于落盘）
+func (cs *CircuitStats) Snapshot() map[string][]TimeBucket {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	result := make(map[string][]TimeBucket, len(cs.accounts))
+	for id, acct := range cs.accounts {
+		acct.mu.Lock()
+		if len(acct.Buckets) > 0 {
+			result[id] = append([]TimeBucket(nil), acct.Buckets...)
+		}
+		acct.mu.Unlock()
+	}
+	return result
+}
+
+// Restore 从快照恢复时间桶（用于重启后加载）
+// 已过期的桶直接丢弃，因此只有重启间隔小于统计窗口时才会恢复出数据
+func (cs *CircuitStats) Restore(snapshot map[string][]TimeBucket) {
+	now := time.Now().Unix()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for id, buckets := range snapshot {
+		acct := &AccountCircuitStats{Buckets: append([]TimeBucket(nil), buckets...)}
+		cs.cleanupAccount(acct, now)
+		if len(acct.Buckets) > 0 {
+			cs.accounts[id] = acct
+		}
+	}
+}
+
 // ========== 核心方法 ==========
 
 // alignToBucket 将时间戳对齐到10秒边界
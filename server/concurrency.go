@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 全局并发限制 ==========
+
+// concurrencyQueueTimeout 并发已满时排队等待的最长时间，超时返回 503
+const concurrencyQueueTimeout = 10 * time.Second
+
+// concurrencyRetryAfterSeconds 503 响应中建议客户端的重试间隔
+const concurrencyRetryAfterSeconds = 1
+
+// concurrencyLimiter 全局并发限制器（信号量 + 有界等待队列）
+// 与按 IP 限流、按账号熔断相互独立，只负责保护进程本身不被流量尖峰压垮
+type concurrencyLimiter struct {
+	mu  sync.Mutex
+	sem chan struct{} // 容量 = MaxConcurrentRequests，配置变化时重建
+
+	inFlight atomic.Int64 // 正在处理的请求数
+	queued   atomic.Int64 // 正在排队的请求数
+	rejected atomic.Int64 // 累计拒绝（503）次数
+}
+
+var requestLimiter = &concurrencyLimiter{}
+
+// ConcurrencyStats 并发限制的实时状态
+type ConcurrencyStats struct {
+	MaxConcurrent int   `json:"maxConcurrent"` // 0 表示不限制
+	MaxQueued     int   `json:"maxQueued"`
+	InFlight      int64 `json:"inFlight"`
+	Queued        int64 `json:"queued"`
+	Rejected      int64 `json:"rejected"`
+}
+
+// semaphore 返回与当前上限匹配的信号量
+// 上限变化时重建：已持有旧信号量的请求仍释放回旧信号量，切换瞬间实际并发可能短暂超过新上限
+func (l *concurrencyLimiter) semaphore(limit int) chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sem == nil || cap(l.sem) != limit {
+		l.sem = make(chan struct{}, limit)
+	}
+	return l.sem
+}
+
+// acquire 获取一个并发名额：有空位直接进入，否则在队列未满时排队等待
+// 返回 false 表示队列已满、等待超时或客户端已断开
+func (l *concurrencyLimiter) acquire(c *gin.Context, sem chan struct{}, maxQueued int) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	if l.queued.Add(1) > int64(maxQueued) {
+		l.queued.Add(-1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(concurrencyQueueTimeout)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// stats 返回当前并发状态
+func (l *concurrencyLimiter) stats() ConcurrencyStats {
+	return ConcurrencyStats{
+		MaxConcurrent: proxyConfig.MaxConcurrentRequests,
+		MaxQueued:     proxyConfig.MaxQueuedRequests,
+		InFlight:      l.inFlight.Load(),
+		Queued:        l.queued.Load(),
+		Rejected:      l.rejected.Load(),
+	}
+}
+
+// concurrencyLimitMiddleware 全局并发限制中间件（ProxyConfig.MaxConcurrentRequests <= 0 时不限制）
+// 满载时最多 MaxQueuedRequests 个请求排队，其余直接返回 503 + Retry-After
+func concurrencyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := proxyConfig.MaxConcurrentRequests
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+
+		sem := requestLimiter.semaphore(limit)
+		if !requestLimiter.acquire(c, sem, proxyConfig.MaxQueuedRequests) {
+			requestLimiter.rejected.Add(1)
+			c.Header("Retry-After", strconv.Itoa(concurrencyRetryAfterSeconds))
+			errorJSONWithMsgId(c, 503, map[string]any{
+				"message": "Server is busy, please retry later",
+				"type":    "overloaded_error",
+			})
+			c.Abort()
+			return
+		}
+
+		requestLimiter.inFlight.Add(1)
+		defer func() {
+			requestLimiter.inFlight.Add(-1)
+			<-sem
+		}()
+		c.Next()
+	}
+}
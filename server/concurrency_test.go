@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupConcurrencyTest 构造带并发限制的路由，处理函数会记录峰值并发数
+func setupConcurrencyTest(t *testing.T, maxConcurrent, maxQueued int, hold time.Duration) (*gin.Engine, *atomic.Int64) {
+	t.Helper()
+	oldCfg, oldLimiter := proxyConfig, requestLimiter
+	proxyConfig.MaxConcurrentRequests = maxConcurrent
+	proxyConfig.MaxQueuedRequests = maxQueued
+	requestLimiter = &concurrencyLimiter{}
+	t.Cleanup(func() {
+		proxyConfig, requestLimiter = oldCfg, oldLimiter
+	})
+
+	var current, peak atomic.Int64
+	router := gin.New()
+	router.POST("/v1/messages", concurrencyLimitMiddleware(), func(c *gin.Context) {
+		n := current.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(hold)
+		current.Add(-1)
+		c.JSON(200, gin.H{"ok": true})
+	})
+	return router, &peak
+}
+
+// fireConcurrent 并发发送 n 个请求，返回各请求的响应
+func fireConcurrent(router *gin.Engine, n int) []*httptest.ResponseRecorder {
+	results := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest("POST", "/v1/messages", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			results[i] = w
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// TestConcurrencyLimit_CapHolds 测试并发峰值不超过上限，排队的请求最终都能完成
+func TestConcurrencyLimit_CapHolds(t *testing.T) {
+	router, peak := setupConcurrencyTest(t, 5, 100, 20*time.Millisecond)
+
+	for i, w := range fireConcurrent(router, 50) {
+		if w.Code != 200 {
+			t.Errorf("请求 %d 期望 200, 得到 %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	if p := peak.Load(); p > 5 || p == 0 {
+		t.Errorf("峰值并发应在 (0, 5] 内, 实际 %d", p)
+	}
+	stats := requestLimiter.stats()
+	if stats.InFlight != 0 || stats.Queued != 0 || stats.Rejected != 0 {
+		t.Errorf("请求结束后计数应归零: %+v", stats)
+	}
+}
+
+// TestConcurrencyLimit_RejectWhenQueueFull 测试不允许排队时超出上限的请求返回 503 + Retry-After
+func TestConcurrencyLimit_RejectWhenQueueFull(t *testing.T) {
+	router, peak := setupConcurrencyTest(t, 2, 0, 100*time.Millisecond)
+
+	ok, rejected := 0, 0
+	for _, w := range fireConcurrent(router, 10) {
+		switch w.Code {
+		case 200:
+			ok++
+		case 503:
+			rejected++
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("503 响应应带 Retry-After")
+			}
+		default:
+			t.Errorf("意外状态码 %d", w.Code)
+		}
+	}
+	if rejected == 0 || ok == 0 {
+		t.Errorf("应同时有成功与拒绝: ok=%d rejected=%d", ok, rejected)
+	}
+	if peak.Load() > 2 {
+		t.Errorf("峰值并发超过上限: %d", peak.Load())
+	}
+	if got := requestLimiter.stats().Rejected; got != int64(rejected) {
+		t.Errorf("拒绝计数不一致: stats=%d 实际=%d", got, rejected)
+	}
+}
+
+// TestConcurrencyLimit_Disabled 测试上限为 0 时不做限制
+func TestConcurrencyLimit_Disabled(t *testing.T) {
+	router, peak := setupConcurrencyTest(t, 0, 0, 50*time.Millisecond)
+
+	for _, w := range fireConcurrent(router, 10) {
+		if w.Code != 200 {
+			t.Fatalf("未启用限制时不应拒绝, 得到 %d", w.Code)
+		}
+	}
+	if peak.Load() < 2 {
+		t.Errorf("未启用限制时请求应并发执行, 峰值 %d", peak.Load())
+	}
+}
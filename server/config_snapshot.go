@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 生效配置快照 ==========
+
+// accountSelectionStrategy 账号选择策略（AuthManager 固定使用平滑加权轮询 + 熔断过滤）
+const accountSelectionStrategy = "smooth-weighted-round-robin"
+
+// configSection 单项配置的快照：当前值 + 与默认值不同的字段
+type configSection struct {
+	Value     any      `json:"value"`
+	Overrides []string `json:"overrides"` // 与默认值不同的 JSON 字段名（为空表示全部为默认值）
+}
+
+// newConfigSection 构建配置快照，按 JSON 字段对比当前值和默认值
+func newConfigSection(current, def any) configSection {
+	return configSection{Value: current, Overrides: configOverrides(current, def)}
+}
+
+// configOverrides 返回 current 中与 def 不同的 JSON 字段名（已排序）
+// 用 JSON 往返比较：字段名与配置文件/接口一致，零值与缺省字段的处理也和加载时一致
+func configOverrides(current, def any) []string {
+	toMap := func(v any) map[string]any {
+		m := map[string]any{}
+		data, _ := json.Marshal(v)
+		_ = json.Unmarshal(data, &m)
+		return m
+	}
+	cur, base := toMap(current), toMap(def)
+
+	overrides := []string{}
+	for k, v := range cur {
+		if !reflect.DeepEqual(v, base[k]) {
+			overrides = append(overrides, k)
+		}
+	}
+	for k := range base {
+		if _, ok := cur[k]; !ok {
+			overrides = append(overrides, k)
+		}
+	}
+	sort.Strings(overrides)
+	return overrides
+}
+
+// redactProxyConfig 返回脱敏后的代理配置副本：上游请求头只保留名字，参考模型列表地址去掉用户信息和查询参数
+// 为什么：这两项常用来携带上游凭证（Authorization 头、URL 中的 token），快照接口不应把它们原样返回
+func redactProxyConfig(cfg kiroclient.ProxyConfig) kiroclient.ProxyConfig {
+	if len(cfg.UpstreamHeaders) > 0 {
+		headers := make(map[string]string, len(cfg.UpstreamHeaders))
+		for name := range cfg.UpstreamHeaders {
+			headers[name] = redactedValue
+		}
+		cfg.UpstreamHeaders = headers
+	}
+	cfg.ModelMappingBootstrapURL = redactURL(cfg.ModelMappingBootstrapURL)
+	return cfg
+}
+
+// redactURL 去掉 URL 中的用户信息、查询参数和片段；无法解析时整体脱敏
+func redactURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedValue
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// handleGetEffectiveConfig 汇总当前内存中生效的全部配置（只读，敏感信息只返回数量或脱敏后的值）
+func handleGetEffectiveConfig(c *gin.Context) {
+	rateLimitMutex.RLock()
+	rateCfg := rateLimitConfig
+	rateLimitMutex.RUnlock()
+
+	notificationMutex.RLock()
+	notifCfg := notificationConfig
+	notificationMutex.RUnlock()
+
+	ipBlacklistMutex.RLock()
+	blacklistSize := len(ipBlacklist)
+	ipBlacklistMutex.RUnlock()
+
+	ipAllowlistMutex.RLock()
+	allowlistSize := len(ipAllowlist)
+	ipAllowlistMutex.RUnlock()
+
+	telemetryMutex.RLock()
+	telemetryCfg := telemetryConfig
+	telemetryMutex.RUnlock()
+
+	logLevel := DefaultLogLevel
+	if logger != nil {
+		logLevel = logger.GetLevel()
+	}
+
+	c.JSON(200, gin.H{
+		"proxyConfig": newConfigSection(redactProxyConfig(proxyConfig), kiroclient.DefaultProxyConfig),
+		"rateLimit":   newConfigSection(rateCfg, defaultRateLimitConfig()),
+		"telemetry":   newConfigSection(telemetryCfg, defaultTelemetryConfig()),
+		"circuitBreaker": gin.H{
+			"strategy": accountSelectionStrategy,
+			"recovery": newConfigSection(currentCircuitRecoveryConfig(), defaultCircuitRecoveryConfig()),
+		},
+		"notification": gin.H{
+			"enabled":    notifCfg.Enabled,
+			"hasMessage": notifCfg.Message != "",
+		},
+		"logLevel": gin.H{
+			"level":      logLevel.String(),
+			"default":    DefaultLogLevel.String(),
+			"overridden": logLevel != DefaultLogLevel,
+		},
+		"apiKeys": gin.H{
+			"count":       len(apiKeys),
+			"authEnabled": len(apiKeys) > 0,
+		},
+		"ipBlacklist": gin.H{
+			"count": blacklistSize,
+		},
+		"ipAllowlist": gin.H{
+			"count":   allowlistSize,
+			"enabled": allowlistSize > 0,
+		},
+		"modelMapping": gin.H{
+			"count": len(modelMapping),
+		},
+		"agentMode": gin.H{
+			"default":   agentModeFor(false),
+			"withTools": agentModeFor(true),
+		},
+	})
+}
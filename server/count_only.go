@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== dry-run 计数 ==========
+// /v1/messages?count_only=true 走完整的转换流程（system 注入、工具转换、sanitize、buildKiroMessages），
+// 只估算实际上游请求体的输入 token 数，不调用 Kiro
+// 为什么：count_tokens 只数原始消息，代理注入和补齐的内容会让实际 token 数明显偏高
+
+// wantsCountOnly 客户端是否要求 dry-run 计数
+func wantsCountOnly(c *gin.Context) bool {
+	countOnly, _ := strconv.ParseBool(c.Query("count_only"))
+	return countOnly
+}
+
+// handleCountOnly 构建上游请求体并返回估算的输入 token 数（响应格式与 count_tokens 兼容）
+func handleCountOnly(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper, toolResults []kiroclient.KiroToolResult, model string) {
+	body, err := client.Chat.BuildToolsRequestBody(messages, model, tools, toolResults)
+	if err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+	tokens, images, err := kiroclient.EstimatePayloadTokens(body, proxyConfig.ImageTokenCost)
+	if err != nil {
+		errorJSONWithMsgId(c, 500, err.Error())
+		return
+	}
+	c.JSON(200, gin.H{
+		"input_tokens":  tokens,
+		"payload_bytes": len(body),
+		"images":        images.Images,
+		"image_tokens":  images.Tokens,
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestCountOnly 测试 count_only 不调用上游，且估算结果与真实请求发往上游的请求体一致
+func TestCountOnly(t *testing.T) {
+	var upstreamBodies [][]byte
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBodies = append(upstreamBodies, body)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	reqBody := `{"model":"claude-sonnet-4.5","max_tokens":100,"system":"You are a careful assistant.",` +
+		`"tools":[{"name":"search","description":"Search the web","input_schema":{"type":"object","properties":{"query":{"type":"string","description":"search terms"}},"required":["query"]}}],` +
+		`"messages":[{"role":"user","content":"find the latest Go release"}]}`
+	post := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := post("/v1/messages?count_only=true")
+	if len(upstreamBodies) != 0 {
+		t.Fatalf("count_only 不应调用上游, 实际调用 %d 次", len(upstreamBodies))
+	}
+	var counted struct {
+		InputTokens  int `json:"input_tokens"`
+		PayloadBytes int `json:"payload_bytes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &counted); err != nil {
+		t.Fatalf("响应解析失败: %v", err)
+	}
+
+	// 真实请求：用同样的估算方法计算实际发往上游的请求体
+	post("/v1/messages")
+	if len(upstreamBodies) != 1 {
+		t.Fatalf("真实请求应调用上游 1 次, 实际 %d 次", len(upstreamBodies))
+	}
+	want, _, err := kiroclient.EstimatePayloadTokens(upstreamBodies[0], proxyConfig.ImageTokenCost)
+	if err != nil {
+		t.Fatalf("估算上游请求体失败: %v", err)
+	}
+	if counted.InputTokens != want {
+		t.Errorf("count_only 应与实际请求体一致: 期望 %d, 得到 %d", want, counted.InputTokens)
+	}
+	if counted.PayloadBytes != len(upstreamBodies[0]) {
+		t.Errorf("payload_bytes 应与实际请求体大小一致: 期望 %d, 得到 %d", len(upstreamBodies[0]), counted.PayloadBytes)
+	}
+
+	// 包含工具定义和 system 注入，应明显多于只数原始消息
+	raw := kiroclient.CountMessagesTokens([]kiroclient.ChatMessage{{Role: "user", Content: "find the latest Go release"}})
+	if counted.InputTokens <= raw {
+		t.Errorf("count_only 应计入转换后的内容: %d <= %d", counted.InputTokens, raw)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 自检诊断 ==========
+
+// 诊断请求使用的模型和提示词：选最便宜的模型 + 极短输入输出，尽量少消耗额度
+const (
+	diagnosticsModel     = "claude-haiku-4.5"
+	diagnosticsPrompt    = "Reply with OK."
+	diagnosticsMaxTokens = 16
+	diagnosticsTimeout   = 60 * time.Second
+)
+
+// diagnosticStep 一个诊断步骤，返回简要说明（成功时展示）或错误
+type diagnosticStep struct {
+	Name string
+	Run  func(ctx context.Context, router *gin.Engine) (string, error)
+}
+
+// diagnosticSteps 按顺序执行的诊断步骤
+// 聊天类步骤走进程内路由调用真实 handler，覆盖格式转换、上游请求和响应组装的完整链路
+var diagnosticSteps = []diagnosticStep{
+	{Name: "accountToken", Run: diagnoseAccountToken},
+	{Name: "chat", Run: diagnoseChat},
+	{Name: "chatStream", Run: diagnoseChatStream},
+	{Name: "countTokens", Run: diagnoseCountTokens},
+	{Name: "toolsList", Run: diagnoseToolsList},
+}
+
+// DiagnosticResult 单个诊断步骤的结果
+type DiagnosticResult struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	DurationMs int64  `json:"durationMs"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// newDiagnosticsRouter 构造进程内路由，只挂载诊断需要的真实 handler（不经过 API-KEY 和限流）
+// 诊断请求使用预留账号（配置了预留账号时），不消耗生产账号的额度
+func newDiagnosticsRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), kiroclient.ReservedAccountsKey, true)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	})
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/messages/count_tokens", handleCountTokens)
+	router.GET("/api/tools", handleToolsList)
+	return router
+}
+
+// runDiagnostics 依次执行所有诊断步骤（某一步失败不影响后续步骤）
+func runDiagnostics(ctx context.Context) []DiagnosticResult {
+	router := newDiagnosticsRouter()
+	results := make([]DiagnosticResult, 0, len(diagnosticSteps))
+	for _, step := range diagnosticSteps {
+		start := time.Now()
+		detail, err := step.Run(ctx, router)
+		result := DiagnosticResult{
+			Name:       step.Name,
+			Passed:     err == nil,
+			DurationMs: time.Since(start).Milliseconds(),
+			Detail:     detail,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// handleDiagnostics 一键自检：全部通过返回 200，否则返回 503，body 中包含每一步的结果和耗时
+func handleDiagnostics(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), diagnosticsTimeout)
+	defer cancel()
+
+	results := runDiagnostics(ctx)
+	passed := true
+	for _, r := range results {
+		if !r.Passed {
+			passed = false
+		}
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "自检诊断完成", map[string]any{
+			"passed":  passed,
+			"results": results,
+		})
+	}
+
+	status := 200
+	if !passed {
+		status = 503
+	}
+	c.JSON(status, gin.H{"passed": passed, "steps": results})
+}
+
+// serveDiagnostic 向进程内路由发送一个请求，非 200 时把响应体作为错误返回
+func serveDiagnostic(ctx context.Context, router *gin.Engine, method, path string, body any) (*httptest.ResponseRecorder, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		return w, fmt.Errorf("HTTP %d: %s", w.Code, truncateDiagnostic(w.Body.String(), 500))
+	}
+	return w, nil
+}
+
+// diagnosticChatRequest 构造最小的 Claude 请求
+func diagnosticChatRequest(stream bool) map[string]any {
+	return map[string]any{
+		"model":      diagnosticsModel,
+		"max_tokens": diagnosticsMaxTokens,
+		"stream":     stream,
+		"messages":   []map[string]any{{"role": "user", "content": diagnosticsPrompt}},
+	}
+}
+
+// diagnoseAccountToken 确认至少有一个账号可用且 Token 有效（配置了预留账号时检查预留账号）
+func diagnoseAccountToken(ctx context.Context, router *gin.Engine) (string, error) {
+	token, accountID, err := client.Auth.GetReservedAccessToken()
+	if err != nil {
+		return "", err
+	}
+	client.Auth.ReleaseHalfOpenProbe(accountID)
+	if token == "" {
+		return "", fmt.Errorf("账号 %s 的 Token 为空", accountID)
+	}
+	return "account=" + accountID, nil
+}
+
+// diagnoseChat 非流式聊天，要求返回非空文本
+func diagnoseChat(ctx context.Context, router *gin.Engine) (string, error) {
+	w, err := serveDiagnostic(ctx, router, "POST", "/v1/messages", diagnosticChatRequest(false))
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Content []struct {
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("解析响应失败: %w", err)
+	}
+	var text strings.Builder
+	for _, block := range resp.Content {
+		text.WriteString(block.Text)
+	}
+	if strings.TrimSpace(text.String()) == "" {
+		return "", fmt.Errorf("响应内容为空")
+	}
+	return truncateDiagnostic(text.String(), 100), nil
+}
+
+// diagnoseChatStream 流式聊天，要求收到文本增量和 message_stop
+func diagnoseChatStream(ctx context.Context, router *gin.Engine) (string, error) {
+	w, err := serveDiagnostic(ctx, router, "POST", "/v1/messages", diagnosticChatRequest(true))
+	if err != nil {
+		return "", err
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, "content_block_delta") {
+		return "", fmt.Errorf("流式响应没有文本增量: %s", truncateDiagnostic(body, 500))
+	}
+	if !strings.Contains(body, "message_stop") {
+		return "", fmt.Errorf("流式响应没有 message_stop: %s", truncateDiagnostic(body, 500))
+	}
+	return fmt.Sprintf("%d bytes", len(body)), nil
+}
+
+// diagnoseCountTokens token 计数接口
+func diagnoseCountTokens(ctx context.Context, router *gin.Engine) (string, error) {
+	req := map[string]any{
+		"model":    diagnosticsModel,
+		"messages": []map[string]any{{"role": "user", "content": diagnosticsPrompt}},
+	}
+	w, err := serveDiagnostic(ctx, router, "POST", "/v1/messages/count_tokens", req)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		InputTokens int `json:"input_tokens"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("解析响应失败: %w", err)
+	}
+	if resp.InputTokens <= 0 {
+		return "", fmt.Errorf("input_tokens 应大于 0: %s", w.Body.String())
+	}
+	return fmt.Sprintf("input_tokens=%d", resp.InputTokens), nil
+}
+
+// diagnoseToolsList MCP 工具列表（搜索等工具经由 MCP 提供）
+func diagnoseToolsList(ctx context.Context, router *gin.Engine) (string, error) {
+	w, err := serveDiagnostic(ctx, router, "GET", "/api/tools", nil)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Tools []json.RawMessage `json:"tools"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		return "", fmt.Errorf("解析响应失败: %w", err)
+	}
+	return fmt.Sprintf("%d tools", len(resp.Tools)), nil
+}
+
+// truncateDiagnostic 截断过长的响应片段（按 rune，避免截断中文）
+func truncateDiagnostic(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return string(r[:max]) + "..."
+}
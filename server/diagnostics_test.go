@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// runDiagnosticsEndpoint 调用自检接口并解析结果
+func runDiagnosticsEndpoint(t *testing.T) (int, map[string]DiagnosticResult) {
+	t.Helper()
+	router := gin.New()
+	router.POST("/api/diagnostics", handleDiagnostics)
+	req, _ := http.NewRequest("POST", "/api/diagnostics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp struct {
+		Passed bool               `json:"passed"`
+		Steps  []DiagnosticResult `json:"steps"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v, body=%s", err, w.Body.String())
+	}
+	if len(resp.Steps) != len(diagnosticSteps) {
+		t.Fatalf("期望 %d 个步骤, 得到 %d", len(diagnosticSteps), len(resp.Steps))
+	}
+	steps := make(map[string]DiagnosticResult, len(resp.Steps))
+	for _, s := range resp.Steps {
+		steps[s.Name] = s
+	}
+	return w.Code, steps
+}
+
+// TestDiagnostics_AllPass 测试上游正常时所有步骤通过，且聊天请求使用最小提示词
+func TestDiagnostics_AllPass(t *testing.T) {
+	var mu sync.Mutex
+	var chatBodies []string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mcp" {
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":"1","result":{"tools":[{"name":"web_search"}]}}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		chatBodies = append(chatBodies, string(body))
+		mu.Unlock()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"OK"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	code, steps := runDiagnosticsEndpoint(t)
+	if code != 200 {
+		t.Errorf("全部通过应返回 200, 得到 %d: %+v", code, steps)
+	}
+	for name, s := range steps {
+		if !s.Passed {
+			t.Errorf("步骤 %s 应通过: %s", name, s.Error)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(chatBodies) != 2 {
+		t.Fatalf("应发起流式和非流式两次聊天, 实际 %d 次", len(chatBodies))
+	}
+	for _, body := range chatBodies {
+		if !strings.Contains(body, diagnosticsPrompt) {
+			t.Errorf("聊天请求应使用最小提示词: %s", body)
+		}
+	}
+}
+
+// TestDiagnostics_UpstreamFailure 测试上游失败时对应步骤失败、其余步骤继续执行，整体返回 503
+func TestDiagnostics_UpstreamFailure(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+		_, _ = w.Write([]byte(`{"message":"internal error"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	code, steps := runDiagnosticsEndpoint(t)
+	if code != 503 {
+		t.Errorf("有步骤失败应返回 503, 得到 %d", code)
+	}
+	if !steps["accountToken"].Passed || !steps["countTokens"].Passed {
+		t.Errorf("不依赖上游的步骤应通过: %+v", steps)
+	}
+	for _, name := range []string{"chat", "chatStream", "toolsList"} {
+		if steps[name].Passed || steps[name].Error == "" {
+			t.Errorf("步骤 %s 应失败并带错误信息: %+v", name, steps[name])
+		}
+	}
+}
+
+// TestDiagnostics_UsesReservedAccount 预留账号不承接正常聊天请求，自检诊断只使用预留账号
+func TestDiagnostics_UsesReservedAccount(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/mcp" {
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":"1","result":{"tools":[{"name":"web_search"}]}}`))
+			return
+		}
+		mu.Lock()
+		tokens = append(tokens, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		mu.Unlock()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"OK"}`))
+	})
+	defer cleanup()
+
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: []kiroclient.AccountInfo{
+		{ID: "prod", Token: &kiroclient.KiroAuthToken{AccessToken: "prod-token", ExpiresAt: expiresAt}},
+		{ID: "probe", Reserved: true, Token: &kiroclient.KiroAuthToken{AccessToken: "probe-token", ExpiresAt: expiresAt}},
+	}})
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	// 正常聊天只使用生产账号
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	for i := 0; i < 4; i++ {
+		req, _ := http.NewRequest("POST", "/v1/messages", strings.NewReader(`{"model":"claude-sonnet-4.5","max_tokens":10,"messages":[{"role":"user","content":"hi"}]}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+	}
+	mu.Lock()
+	for _, tok := range tokens {
+		if tok != "prod-token" {
+			t.Errorf("正常请求不应使用预留账号, 得到 %s", tok)
+		}
+	}
+	tokens = nil
+	mu.Unlock()
+
+	// 自检诊断只使用预留账号
+	code, steps := runDiagnosticsEndpoint(t)
+	if code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %+v", code, steps)
+	}
+	if steps["accountToken"].Detail != "account=probe" {
+		t.Errorf("accountToken 应检查预留账号, 得到 %s", steps["accountToken"].Detail)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) == 0 {
+		t.Fatal("诊断应发出聊天请求")
+	}
+	for _, tok := range tokens {
+		if tok != "probe-token" {
+			t.Errorf("诊断请求应使用预留账号, 得到 %s", tok)
+		}
+	}
+
+	for _, info := range client.Auth.GetLoadDistribution() {
+		if info.AccountID == "probe" && (info.Eligible || info.Weight != 0 || !info.Reserved) {
+			t.Errorf("预留账号不应出现在负载分配中: %+v", info)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 内存状态落盘 ==========
+
+// 关闭/手动落盘的超时时间
+const (
+	shutdownTimeout = 10 * time.Second // 等待进行中的请求结束
+	flushTimeout    = 5 * time.Second  // 落盘所有内存状态
+)
+
+var circuitStatsFile = "circuit-stats.json"
+
+// flushStep 一个需要落盘的子系统
+type flushStep struct {
+	Name string
+	Run  func() error
+}
+
+// flushSteps 按顺序执行的落盘步骤
+// 新增持有内存状态的子系统时在这里注册，SIGTERM 和 /api/admin/flush 会一起覆盖
+var flushSteps = []flushStep{
+	{Name: "tokenStats", Run: flushTokenStats},
+	{Name: "accountStats", Run: saveAccountStats},
+	{Name: "apiKeyUsage", Run: saveApiKeyUsage},
+	{Name: "circuitStats", Run: saveCircuitStats},
+}
+
+// FlushResult 单个落盘步骤的结果
+type FlushResult struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// flushAll 依次执行所有落盘步骤，超过 timeout 后不再等待
+// 返回已完成步骤的结果；超时时返回错误（未完成的步骤仍会在后台继续执行）
+func flushAll(timeout time.Duration) ([]FlushResult, error) {
+	resultCh := make(chan FlushResult, len(flushSteps))
+	go func() {
+		for _, step := range flushSteps {
+			result := FlushResult{Name: step.Name}
+			if err := step.Run(); err != nil {
+				result.Error = err.Error()
+			}
+			resultCh <- result
+		}
+		close(resultCh)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	results := make([]FlushResult, 0, len(flushSteps))
+	for {
+		select {
+		case result, ok := <-resultCh:
+			if !ok {
+				return results, nil
+			}
+			results = append(results, result)
+		case <-timer.C:
+			return results, fmt.Errorf("落盘超时（%v），已完成 %d/%d 步", timeout, len(results), len(flushSteps))
+		}
+	}
+}
+
+// flushTokenStats 把通道中尚未处理的 Token 增量合并后立即落盘
+// 为什么要先排空通道：tokenStatsWorker 每 10 秒才落盘一次，关闭时通道里的增量会丢失
+func flushTokenStats() error {
+	for {
+		select {
+		case delta := <-tokenStatsChan:
+			applyTokenDelta(delta)
+		default:
+			return saveTokenStats()
+		}
+	}
+}
+
+// saveCircuitStats 保存熔断错误率时间桶
+func saveCircuitStats() error {
+	if circuitStats == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(circuitStats.Snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(circuitStatsFile, data)
+}
+
+// loadCircuitStats 启动时恢复熔断错误率时间桶（过期的桶会被丢弃）
+func loadCircuitStats() {
+	data, err := storage.Get(circuitStatsFile)
+	if err != nil || circuitStats == nil {
+		return
+	}
+	var snapshot map[string][]TimeBucket
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return
+	}
+	circuitStats.Restore(snapshot)
+	if logger != nil {
+		logger.Info("", "熔断统计: 已恢复", map[string]any{
+			"accountCount": len(circuitStats.AccountIDs()),
+		})
+	}
+}
+
+// handleAdminFlush 手动落盘所有内存状态（计划重启前调用）
+func handleAdminFlush(c *gin.Context) {
+	results, err := flushAll(flushTimeout)
+	if err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(504, gin.H{"error": err.Error(), "results": results})
+		return
+	}
+	c.JSON(200, gin.H{"message": "已落盘", "results": results})
+}
+
+// runServer 启动 HTTP 服务，收到 SIGTERM/SIGINT 后停止接收新请求、等待进行中的请求并落盘
+// tlsConfig 非 nil 时以 HTTPS 监听（证书已在 tlsConfig 中加载）
+func runServer(handler http.Handler, addr string, tlsConfig *tls.Config) {
+	srv := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			if logger != nil {
+				logger.Error("", "HTTP 服务异常退出", map[string]any{"error": err.Error()})
+			}
+			quit <- syscall.SIGTERM
+		}
+	}()
+
+	sig := <-quit
+	if logger != nil {
+		logger.Info("", "收到退出信号，开始关闭", map[string]any{"signal": sig.String()})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	_ = srv.Shutdown(ctx)
+
+	results, err := flushAll(flushTimeout)
+	if logger != nil {
+		data := map[string]any{"results": results}
+		if err != nil {
+			data["error"] = err.Error()
+			logger.Error("", "关闭前落盘未完成", data)
+		} else {
+			logger.Info("", "关闭前落盘完成", data)
+		}
+	}
+}
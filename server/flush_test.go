@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupFlushTest 把落盘文件指向临时目录，返回恢复函数
+func setupFlushTest(t *testing.T) func() {
+	t.Helper()
+	useTempStatsFiles(t)
+	oldStats, oldCS := tokenStats, circuitStats
+	tokenStats = TokenStats{}
+	circuitStats = NewCircuitStats()
+	// 丢弃其他测试请求遗留在通道中的增量
+	for len(tokenStatsChan) > 0 {
+		<-tokenStatsChan
+	}
+	return func() {
+		circuitStats.Close()
+		tokenStats, circuitStats = oldStats, oldCS
+	}
+}
+
+// TestFlushAll_PersistsState 测试落盘会排空 Token 通道并写出所有统计文件
+func TestFlushAll_PersistsState(t *testing.T) {
+	defer setupFlushTest(t)()
+
+	addTokenStats(100, 20, true)
+	addTokenStats(50, 10, false)
+	circuitStats.Record("acc-1", true)
+	circuitStats.Record("acc-1", false)
+
+	results, err := flushAll(flushTimeout)
+	if err != nil {
+		t.Fatalf("落盘失败: %v", err)
+	}
+	if len(results) != len(flushSteps) {
+		t.Fatalf("期望 %d 个步骤结果, 得到 %d", len(flushSteps), len(results))
+	}
+	for _, r := range results {
+		if r.Error != "" {
+			t.Errorf("步骤 %s 失败: %s", r.Name, r.Error)
+		}
+	}
+
+	var saved TokenStats
+	data, _ := os.ReadFile(tokenStatsFile)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("读取 Token 统计失败: %v", err)
+	}
+	if saved.InputTokens != 150 || saved.OutputTokens != 30 || saved.RequestCount != 2 {
+		t.Errorf("通道中的增量应已合并落盘: %+v", saved)
+	}
+	if _, err := os.Stat(accountStatsFile); err != nil {
+		t.Errorf("账号统计应已落盘: %v", err)
+	}
+
+	// 熔断统计可以恢复到新的统计器
+	circuitStats.Close()
+	circuitStats = NewCircuitStats()
+	loadCircuitStats()
+	if rate, total := circuitStats.GetErrorRate("acc-1", 5); total != 2 || rate != 0.5 {
+		t.Errorf("恢复后的错误率统计错误: rate=%v total=%d", rate, total)
+	}
+}
+
+// TestFlushAll_Timeout 测试落盘步骤卡住时按超时返回
+func TestFlushAll_Timeout(t *testing.T) {
+	oldSteps := flushSteps
+	release := make(chan struct{})
+	flushSteps = []flushStep{
+		{Name: "fast", Run: func() error { return nil }},
+		{Name: "stuck", Run: func() error { <-release; return nil }},
+	}
+	defer func() {
+		close(release)
+		flushSteps = oldSteps
+	}()
+
+	start := time.Now()
+	results, err := flushAll(50 * time.Millisecond)
+	if err == nil {
+		t.Fatal("卡住的步骤应导致超时错误")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("超时后应立即返回, 实际耗时 %v", time.Since(start))
+	}
+	if len(results) != 1 || results[0].Name != "fast" {
+		t.Errorf("应返回已完成的步骤: %+v", results)
+	}
+}
+
+// TestAdminFlush_Endpoint 测试手动落盘接口
+func TestAdminFlush_Endpoint(t *testing.T) {
+	defer setupFlushTest(t)()
+
+	router := gin.New()
+	router.POST("/api/admin/flush", handleAdminFlush)
+	req, _ := http.NewRequest("POST", "/api/admin/flush", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "circuitStats") {
+		t.Errorf("响应应包含各步骤结果: %s", w.Body.String())
+	}
+}
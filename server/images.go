@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 图片内容转换 ==========
+
+// imageBlockFromContent 把 OpenAI image_url / Claude image 内容块转换为 Kiro 图片块
+// 无法处理时返回原因（不支持的格式、非 base64 来源、数据为空或不是合法 base64）
+func imageBlockFromContent(itemType string, m map[string]interface{}) (kiroclient.ImageBlock, error) {
+	var format, data string
+	switch itemType {
+	case "image_url":
+		// {"type": "image_url", "image_url": {"url": "data:image/png;base64,..."}}
+		imgObj, _ := m["image_url"].(map[string]interface{})
+		url, _ := imgObj["url"].(string)
+		if url == "" {
+			return kiroclient.ImageBlock{}, fmt.Errorf("missing image url")
+		}
+		var ok bool
+		format, data, ok = kiroclient.ParseDataURL(url)
+		if !ok {
+			if !strings.HasPrefix(url, "data:") {
+				return kiroclient.ImageBlock{}, fmt.Errorf("remote image urls are not supported")
+			}
+			return kiroclient.ImageBlock{}, fmt.Errorf("invalid data url")
+		}
+	case "image":
+		// {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "..."}}
+		source, _ := m["source"].(map[string]interface{})
+		sourceType, _ := source["type"].(string)
+		if sourceType != "base64" {
+			return kiroclient.ImageBlock{}, fmt.Errorf("unsupported source type %q", sourceType)
+		}
+		mediaType, _ := source["media_type"].(string)
+		data, _ = source["data"].(string)
+		format = strings.TrimPrefix(mediaType, "image/")
+		if format == mediaType {
+			format = ""
+		}
+		if format == "" {
+			return kiroclient.ImageBlock{}, fmt.Errorf("missing or invalid media_type %q", mediaType)
+		}
+		if data == "" {
+			return kiroclient.ImageBlock{}, fmt.Errorf("empty image data")
+		}
+	}
+
+	format = strings.ToLower(format)
+	// jpg 统一为 jpeg
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if !kiroclient.SupportedImageFormats[format] {
+		return kiroclient.ImageBlock{}, fmt.Errorf("unsupported format %s", format)
+	}
+	data, ok := normalizeBase64(data)
+	if !ok {
+		return kiroclient.ImageBlock{}, fmt.Errorf("image data is not valid base64")
+	}
+	return kiroclient.ImageBlock{
+		Format: format,
+		Source: kiroclient.ImageSource{Bytes: data},
+	}, nil
+}
+
+// normalizeBase64 把图片数据规整为 Kiro 接受的标准 base64（StdEncoding，带 padding）
+// 兼容客户端常见的两种写法：按行折断（含空白和换行）、URL-safe 字母表（-_，通常省略 padding）
+// 已经是标准格式的数据原样返回，不产生拷贝
+func normalizeBase64(data string) (string, bool) {
+	if isLikelyBase64(data) {
+		return data, true
+	}
+	data = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+			return -1
+		}
+		return r
+	}, data)
+	if strings.ContainsAny(data, "-_") {
+		// 两种字母表混用不是合法数据
+		if strings.ContainsAny(data, "+/") {
+			return "", false
+		}
+		data = strings.NewReplacer("-", "+", "_", "/").Replace(data)
+	}
+	if !strings.HasSuffix(data, "=") {
+		switch len(data) % 4 {
+		case 2:
+			data += "=="
+		case 3:
+			data += "="
+		}
+	}
+	return data, isLikelyBase64(data)
+}
+
+// isLikelyBase64 校验是否为标准 base64 的长度和字符集（不实际解码，避免大图重复分配内存）
+func isLikelyBase64(data string) bool {
+	if len(data)%4 != 0 {
+		return false
+	}
+	trimmed := strings.TrimRight(data, "=")
+	if len(data)-len(trimmed) > 2 {
+		return false
+	}
+	return strings.IndexFunc(trimmed, func(r rune) bool {
+		return !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '+' || r == '/')
+	}) == -1
+}
+
+// imageLimiter 按 MaxImagesPerRequest 统计整个请求（跨消息）已保留的图片数
+type imageLimiter struct {
+	max   int
+	count int
+}
+
+// newImageLimiter 读取当前配置的图片上限（0=不限制）
+func newImageLimiter() *imageLimiter {
+	return &imageLimiter{max: proxyConfig.MaxImagesPerRequest}
+}
+
+// admit 还有名额时计数并返回 true
+func (l *imageLimiter) admit() bool {
+	if l.max > 0 && l.count >= l.max {
+		return false
+	}
+	l.count++
+	return true
+}
+
+// imageLimitMarker 超出图片上限被丢弃时插入的文本标记
+func imageLimitMarker(max int) string {
+	return fmt.Sprintf("[image omitted: request exceeds the limit of %d images]", max)
+}
+
+// imageErrorMarker 图片被丢弃时插入到消息中的文本标记，让模型和用户知道有内容被省略
+func imageErrorMarker(err error) string {
+	return fmt.Sprintf("[image could not be processed: %s]", err.Error())
+}
+
+// isImageContent 是否为图片内容块
+func isImageContent(itemType string) bool {
+	return itemType == "image_url" || itemType == "image"
+}
+
+// collectImageErrors 找出请求中所有无法处理的图片（按出现顺序），同时返回可用图片总数
+// 用于 strict 模式拒绝请求，以及 lenient 模式记录告警日志
+func collectImageErrors(messages []map[string]any) ([]string, int) {
+	var errs []string
+	valid := 0
+	for i, msg := range messages {
+		items, _ := msg["content"].([]interface{})
+		for _, item := range items {
+			m, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			itemType, _ := m["type"].(string)
+			if !isImageContent(itemType) {
+				continue
+			}
+			if _, err := imageBlockFromContent(itemType, m); err != nil {
+				errs = append(errs, fmt.Sprintf("messages[%d]: %s", i, err.Error()))
+			} else {
+				valid++
+			}
+		}
+	}
+	return errs, valid
+}
+
+// checkImageErrors 按 ImageErrorMode 处理无法转换的图片和超出 MaxImagesPerRequest 的图片：
+// strict 返回错误，lenient 记录告警（转换时插入标记）
+func checkImageErrors(msgID string, messages []map[string]any) error {
+	errs, count := collectImageErrors(messages)
+	if max := proxyConfig.MaxImagesPerRequest; max > 0 && count > max {
+		errs = append(errs, fmt.Sprintf("请求包含 %d 张图片，超过上限 %d", count, max))
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if proxyConfig.ImageErrorMode == kiroclient.ImageErrorModeStrict {
+		return fmt.Errorf("图片无法处理: %s", strings.Join(errs, "; "))
+	}
+	if logger != nil {
+		logger.Warn(msgID, "图片无法处理，已替换为文本标记", map[string]any{
+			"errors": errs,
+		})
+	}
+	return nil
+}
+
+// HeaderXKiroWarning 请求被接受但存在潜在问题时返回的告警说明
+const HeaderXKiroWarning = "X-Kiro-Warning"
+
+// imagesWithToolsWarning 图片与工具同时出现时的说明
+const imagesWithToolsWarning = "request contains both images and tools; some Kiro model/agent mode combinations may not support this"
+
+// checkImagesWithTools 按 ImagesWithToolsPolicy 处理同时带图片和工具定义的请求：reject 返回错误，warn 记录告警并设置 X-Kiro-Warning
+func checkImagesWithTools(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper) error {
+	policy := proxyConfig.ImagesWithToolsPolicy
+	if policy == "" || policy == kiroclient.ImagesWithToolsAllow || len(tools) == 0 {
+		return nil
+	}
+	images := 0
+	for _, msg := range messages {
+		images += len(msg.Images)
+	}
+	if images == 0 {
+		return nil
+	}
+	if policy == kiroclient.ImagesWithToolsReject {
+		return fmt.Errorf("请求同时包含 %d 张图片和 %d 个工具定义，当前配置不允许图片与工具同时使用（imagesWithToolsPolicy=reject）", images, len(tools))
+	}
+	c.Header(HeaderXKiroWarning, imagesWithToolsWarning)
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "请求同时包含图片和工具定义", map[string]any{
+			"images": images,
+			"tools":  len(tools),
+		})
+	}
+	return nil
+}
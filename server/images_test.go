@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// validPNG 最小的合法 base64 数据
+const validPNG = "iVBORw0KGgo="
+
+// TestImageBlockFromContent 覆盖合法图片和各种无法处理的情况
+func TestImageBlockFromContent(t *testing.T) {
+	claudeImage := func(sourceType, mediaType, data string) map[string]interface{} {
+		return map[string]interface{}{"type": "image", "source": map[string]interface{}{
+			"type": sourceType, "media_type": mediaType, "data": data,
+		}}
+	}
+	openAIImage := func(url string) map[string]interface{} {
+		return map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": url}}
+	}
+
+	tests := []struct {
+		name       string
+		itemType   string
+		item       map[string]interface{}
+		wantFormat string
+		wantErr    string
+	}{
+		{"Claude png", "image", claudeImage("base64", "image/png", validPNG), "png", ""},
+		{"Claude jpg 统一为 jpeg", "image", claudeImage("base64", "image/jpg", validPNG), "jpeg", ""},
+		{"OpenAI data url", "image_url", openAIImage("data:image/webp;base64," + validPNG), "webp", ""},
+		{"不支持的格式", "image", claudeImage("base64", "image/bmp", validPNG), "", "unsupported format bmp"},
+		{"OpenAI 不支持的格式", "image_url", openAIImage("data:image/tiff;base64," + validPNG), "", "unsupported format tiff"},
+		{"非 base64 来源", "image", claudeImage("url", "image/png", ""), "", "unsupported source type"},
+		{"media_type 缺失", "image", claudeImage("base64", "", validPNG), "", "media_type"},
+		{"数据为空", "image", claudeImage("base64", "image/png", ""), "", "empty image data"},
+		{"base64 损坏", "image", claudeImage("base64", "image/png", "not*base64!"), "", "not valid base64"},
+		{"远程 URL", "image_url", openAIImage("https://example.com/cat.png"), "", "remote image urls"},
+		{"data url 非法", "image_url", openAIImage("data:text/plain;base64,aGVsbG8gd29ybGQ="), "", "invalid data url"},
+		{"url 缺失", "image_url", map[string]interface{}{"type": "image_url"}, "", "missing image url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, err := imageBlockFromContent(tt.itemType, tt.item)
+			if tt.wantErr == "" {
+				if err != nil || img.Format != tt.wantFormat || img.Source.Bytes != validPNG {
+					t.Errorf("期望格式 %s, 得到 %+v, err=%v", tt.wantFormat, img, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("期望错误包含 %q, 得到 %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestImageBlockFromContent_NormalizesBase64 测试按行折断和 URL-safe 的 base64 被规整为标准格式转发，而不是当作损坏数据丢弃
+func TestImageBlockFromContent_NormalizesBase64(t *testing.T) {
+	raw := bytes.Repeat([]byte{0xfb, 0xff, 0xbf, 0x00, 0x10}, 40)
+	std := base64.StdEncoding.EncodeToString(raw)
+	if !strings.ContainsAny(std, "+/") {
+		t.Fatal("测试数据应包含 +/ 字符")
+	}
+	var wrapped strings.Builder
+	for i := 0; i < len(std); i += 76 {
+		wrapped.WriteString(std[i:min(i+76, len(std))])
+		wrapped.WriteString("\r\n")
+	}
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"标准", std},
+		{"按行折断", wrapped.String()},
+		{"带空格和制表符", " " + std[:20] + "\t" + std[20:] + " "},
+		{"URL-safe 带 padding", base64.URLEncoding.EncodeToString(raw)},
+		{"URL-safe 无 padding", base64.RawURLEncoding.EncodeToString(raw[:len(raw)-1])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			item := map[string]interface{}{"type": "image", "source": map[string]interface{}{
+				"type": "base64", "media_type": "image/png", "data": tt.data,
+			}}
+			img, err := imageBlockFromContent("image", item)
+			if err != nil {
+				t.Fatalf("应接受该数据, 得到 %v", err)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(img.Source.Bytes)
+			if err != nil {
+				t.Fatalf("转发的数据应为标准 base64: %v", err)
+			}
+			if !bytes.HasPrefix(raw, decoded) || len(decoded) < len(raw)-1 {
+				t.Errorf("规整后内容不一致: %x", decoded)
+			}
+		})
+	}
+
+	// 混用两种字母表或字符非法时仍然拒绝
+	for _, data := range []string{"ab+-cd==", "ab*d", "a"} {
+		if _, ok := normalizeBase64(data); ok {
+			t.Errorf("%q 不应被当作合法 base64", data)
+		}
+	}
+}
+
+// TestConvertMessages_ImageMarker 测试无法处理的图片在两种转换路径中都被替换为文本标记，合法图片照常保留
+func TestConvertMessages_ImageMarker(t *testing.T) {
+	messages := []map[string]any{{
+		"role": "user",
+		"content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "看看这两张图"},
+			map[string]interface{}{"type": "image", "source": map[string]interface{}{
+				"type": "base64", "media_type": "image/bmp", "data": validPNG,
+			}},
+			map[string]interface{}{"type": "image", "source": map[string]interface{}{
+				"type": "base64", "media_type": "image/png", "data": validPNG,
+			}},
+		},
+	}}
+
+	plain := convertToKiroMessages(messages)
+	withSystem, _, _, _ := convertToKiroMessagesWithSystem(messages, nil, nil)
+	for name, msgs := range map[string][]kiroclient.ChatMessage{"convertToKiroMessages": plain, "convertToKiroMessagesWithSystem": withSystem} {
+		if len(msgs) != 1 {
+			t.Fatalf("%s: 期望 1 条消息, 得到 %d", name, len(msgs))
+		}
+		if !strings.Contains(msgs[0].Content, "[image could not be processed: unsupported format bmp]") {
+			t.Errorf("%s: 应插入文本标记: %q", name, msgs[0].Content)
+		}
+		if len(msgs[0].Images) != 1 || msgs[0].Images[0].Format != "png" {
+			t.Errorf("%s: 合法图片应保留: %+v", name, msgs[0].Images)
+		}
+	}
+}
+
+// TestImageErrorMode_Strict 测试 strict 模式拒绝带无法处理图片的请求，lenient 模式照常转发
+func TestImageErrorMode_Strict(t *testing.T) {
+	var upstreamBody string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r.Body)
+		upstreamBody = buf.String()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	bodies := map[string]string{
+		"/v1/messages":         `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image","source":{"type":"base64","media_type":"image/bmp","data":"` + validPNG + `"}}]}]}`,
+		"/v1/chat/completions": `{"model":"claude-sonnet-4.5","messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]}]}`,
+	}
+	send := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(bodies[path]))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for path := range bodies {
+		proxyConfig.ImageErrorMode = kiroclient.ImageErrorModeStrict
+		upstreamBody = ""
+		if w := send(path); w.Code != 400 || !strings.Contains(w.Body.String(), "messages[0]") {
+			t.Errorf("%s strict: 期望 400 并指出出错位置, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		if upstreamBody != "" {
+			t.Errorf("%s strict: 被拒绝的请求不应发往上游", path)
+		}
+
+		proxyConfig.ImageErrorMode = kiroclient.ImageErrorModeLenient
+		if w := send(path); w.Code != 200 {
+			t.Errorf("%s lenient: 期望 200, 得到 %d", path, w.Code)
+		}
+		if !strings.Contains(upstreamBody, "image could not be processed") {
+			t.Errorf("%s lenient: 上游请求应包含文本标记: %s", path, upstreamBody)
+		}
+	}
+}
+
+// TestMaxImagesPerRequest 测试跨消息统计图片数：lenient 保留前 N 张并为其余插入标记，strict 拒绝请求
+func TestMaxImagesPerRequest(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.MaxImagesPerRequest = 2
+	defer func() { proxyConfig = oldConfig }()
+
+	image := map[string]interface{}{"type": "image", "source": map[string]interface{}{
+		"type": "base64", "media_type": "image/png", "data": validPNG,
+	}}
+	messages := []map[string]any{
+		{"role": "user", "content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "第一批"}, image, image,
+		}},
+		{"role": "assistant", "content": "收到"},
+		{"role": "user", "content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "第二批"}, image,
+		}},
+	}
+
+	proxyConfig.ImageErrorMode = kiroclient.ImageErrorModeLenient
+	if err := checkImageErrors("test", messages); err != nil {
+		t.Fatalf("lenient 模式不应拒绝: %v", err)
+	}
+	plain := convertToKiroMessages(messages)
+	withSystem, _, _, _ := convertToKiroMessagesWithSystem(messages, nil, nil)
+	for name, msgs := range map[string][]kiroclient.ChatMessage{"convertToKiroMessages": plain, "convertToKiroMessagesWithSystem": withSystem} {
+		if len(msgs) != 3 {
+			t.Fatalf("%s: 期望 3 条消息, 得到 %d", name, len(msgs))
+		}
+		if len(msgs[0].Images) != 2 {
+			t.Errorf("%s: 前 2 张图片应保留, 得到 %d", name, len(msgs[0].Images))
+		}
+		if len(msgs[2].Images) != 0 || !strings.Contains(msgs[2].Content, imageLimitMarker(2)) {
+			t.Errorf("%s: 超出上限的图片应替换为标记: %q, %d 张", name, msgs[2].Content, len(msgs[2].Images))
+		}
+	}
+
+	proxyConfig.ImageErrorMode = kiroclient.ImageErrorModeStrict
+	if err := checkImageErrors("test", messages); err == nil || !strings.Contains(err.Error(), "超过上限 2") {
+		t.Errorf("strict 模式应拒绝超出上限的请求, 得到 %v", err)
+	}
+
+	proxyConfig.MaxImagesPerRequest = 0
+	if err := checkImageErrors("test", messages); err != nil {
+		t.Errorf("0 表示不限制, 得到 %v", err)
+	}
+}
+
+// TestImagesWithToolsPolicy 同时带图片和工具的请求按 allow/warn/reject 处理；只带图片时不受影响
+func TestImagesWithToolsPolicy(t *testing.T) {
+	var upstreamCalls int32
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	const png = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	send := func(withTools bool) *httptest.ResponseRecorder {
+		payload := map[string]any{
+			"model": "claude-sonnet-4.5", "max_tokens": 100,
+			"messages": []any{map[string]any{"role": "user", "content": []any{
+				map[string]any{"type": "text", "text": "what is this"},
+				map[string]any{"type": "image", "source": map[string]any{"type": "base64", "media_type": "image/png", "data": png}},
+			}}},
+		}
+		if withTools {
+			payload["tools"] = []any{map[string]any{"name": "lookup", "description": "look up", "input_schema": map[string]any{"type": "object"}}}
+		}
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		policy     string
+		withTools  bool
+		wantCode   int
+		wantHeader bool
+	}{
+		{"", true, 200, false},
+		{kiroclient.ImagesWithToolsAllow, true, 200, false},
+		{kiroclient.ImagesWithToolsWarn, true, 200, true},
+		{kiroclient.ImagesWithToolsReject, true, 400, false},
+		{kiroclient.ImagesWithToolsReject, false, 200, false},
+	}
+	for _, tt := range tests {
+		proxyConfig = kiroclient.DefaultProxyConfig
+		proxyConfig.ImagesWithToolsPolicy = tt.policy
+		before := atomic.LoadInt32(&upstreamCalls)
+		w := send(tt.withTools)
+		if w.Code != tt.wantCode {
+			t.Errorf("policy=%q tools=%v: 期望 %d, 得到 %d: %s", tt.policy, tt.withTools, tt.wantCode, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get(HeaderXKiroWarning) != ""; got != tt.wantHeader {
+			t.Errorf("policy=%q tools=%v: X-Kiro-Warning 期望 %v, 得到 %q", tt.policy, tt.withTools, tt.wantHeader, w.Header().Get(HeaderXKiroWarning))
+		}
+		if called := atomic.LoadInt32(&upstreamCalls) > before; called != (tt.wantCode == 200) {
+			t.Errorf("policy=%q tools=%v: 上游调用 %v 与预期不符", tt.policy, tt.withTools, called)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 输入 token 预算 ==========
+// 为什么：单个超大请求（粘贴整个仓库、海量工具定义、大量图片）会产生失控的成本；
+// 与上下文裁剪不同，这里是硬上限，在调用上游之前直接拒绝
+
+// checkInputTokenBudget 估算输入 token（消息文本 + 图片 + 工具定义），超过 MaxInputTokens 时返回错误
+// MaxInputTokens 为 0 时不估算，避免给每个请求增加 tokenizer 开销
+func checkInputTokenBudget(messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper) error {
+	limit := proxyConfig.MaxInputTokens
+	if limit <= 0 {
+		return nil
+	}
+	estimated, _ := estimateInputTokens(messages)
+	if len(tools) > 0 {
+		if data, err := json.Marshal(tools); err == nil {
+			estimated += kiroclient.CountTokens(string(data))
+		}
+	}
+	if estimated > limit {
+		return fmt.Errorf("请求估算输入 token 数 %d 超过上限 %d", estimated, limit)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestInputTokenBudget 超过 MaxInputTokens 的请求在调用上游之前返回 400，未超出的正常转发
+func TestInputTokenBudget(t *testing.T) {
+	var upstreamCalls int32
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.MaxInputTokens = 200
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	post := func(path string, payload map[string]any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest("POST", path, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	huge := strings.Repeat("lorem ipsum dolor sit amet ", 200)
+
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		w := post(path, map[string]any{
+			"model": "claude-sonnet-4.5", "max_tokens": 100,
+			"messages": []any{map[string]any{"role": "user", "content": huge}},
+		})
+		if w.Code != 400 || !strings.Contains(w.Body.String(), "200") {
+			t.Errorf("%s 超出预算应返回包含上限的 400, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	// 工具定义同样计入预算
+	tools := make([]any, 0, 20)
+	for i := 0; i < 20; i++ {
+		tools = append(tools, map[string]any{"name": "tool", "description": "a tool with a fairly long description text", "input_schema": map[string]any{"type": "object"}})
+	}
+	if w := post("/v1/messages", map[string]any{
+		"model": "claude-sonnet-4.5", "max_tokens": 100,
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+		"tools":    tools,
+	}); w.Code != 400 {
+		t.Errorf("工具定义超出预算应返回 400, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if n := atomic.LoadInt32(&upstreamCalls); n != 0 {
+		t.Fatalf("超出预算的请求不应调用上游, 调用了 %d 次", n)
+	}
+
+	if w := post("/v1/messages", map[string]any{
+		"model": "claude-sonnet-4.5", "max_tokens": 100,
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+	}); w.Code != 200 {
+		t.Errorf("预算内的请求应正常转发, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if n := atomic.LoadInt32(&upstreamCalls); n != 1 {
+		t.Errorf("预算内的请求应调用上游一次, 调用了 %d 次", n)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== IP 白名单 ==========
+// 为什么：有些部署只对固定的几台机器开放，逐个拉黑其他来源不现实
+// 白名单为空时放行所有 IP；非空时只放行名单内的 IP 或网段。与黑名单同时命中时以黑名单为准（黑名单中间件先执行）
+// 注意：管理页面走同一个端口，开启白名单前先把自己的 IP 加进去
+
+var ipAllowlistFile = "ip-allowlist.json"
+var ipAllowlist []string
+var ipAllowlistMatcher = compileIpList(nil) // 由 ipAllowlist 预编译，随其一起更新
+var ipAllowlistMutex sync.RWMutex
+
+// loadIpAllowlist 从文件加载 IP 白名单（文件不存在、损坏或没有有效条目时为空，即不限制）
+func loadIpAllowlist() {
+	ipAllowlistMutex.Lock()
+	defer ipAllowlistMutex.Unlock()
+	ipAllowlist = []string{}
+	ipAllowlistMatcher = compileIpList(nil)
+
+	data, err := storage.Get(ipAllowlistFile)
+	if err != nil {
+		return
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return
+	}
+	matcher := compileIpList(list)
+	// 手改的文件里全是无效条目时按未开启白名单处理，否则所有来源（包括管理页面）都会被拒绝
+	if len(list) > 0 && matcher.empty() {
+		if logger != nil {
+			logger.Warn("", "白名单中没有有效条目，按未开启白名单处理", map[string]any{
+				"entries": list,
+			})
+		}
+		return
+	}
+	ipAllowlist = list
+	ipAllowlistMatcher = matcher
+	if logger != nil {
+		logger.Info("", "已加载白名单 IP", map[string]any{
+			"count": len(ipAllowlist),
+		})
+	}
+}
+
+// saveIpAllowlist 保存 IP 白名单到文件（调用方需持有 ipAllowlistMutex）
+func saveIpAllowlist() error {
+	data, err := json.MarshalIndent(ipAllowlist, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(ipAllowlistFile, data)
+}
+
+// ipAllowlistMiddleware IP 白名单中间件：白名单非空且客户端 IP 不在其中时返回 403
+func ipAllowlistMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		clientIP := c.ClientIP()
+
+		ipAllowlistMutex.RLock()
+		blocked := len(ipAllowlist) > 0 && !ipAllowlistMatcher.contains(clientIP)
+		ipAllowlistMutex.RUnlock()
+
+		if blocked {
+			errorJSONWithMsgId(c, 403, map[string]any{
+				"message": "IP not allowed",
+				"type":    "forbidden",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleGetIpAllowlist 获取 IP 白名单
+func handleGetIpAllowlist(c *gin.Context) {
+	ipAllowlistMutex.RLock()
+	list := make([]string, len(ipAllowlist))
+	copy(list, ipAllowlist)
+	data, _ := json.Marshal(ipAllowlist)
+	hash := computeHash(data)
+	ipAllowlistMutex.RUnlock()
+
+	c.JSON(200, gin.H{"ips": list, "count": len(list), "hash": hash})
+}
+
+// handleUpdateIpAllowlist 更新 IP 白名单（传空列表即关闭白名单）
+func handleUpdateIpAllowlist(c *gin.Context) {
+	var req struct {
+		IPs  []string `json:"ips"`
+		Hash string   `json:"hash"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ipAllowlistMutex.Lock()
+	defer ipAllowlistMutex.Unlock()
+
+	// 乐观锁校验
+	if req.Hash != "" {
+		currentData, _ := json.Marshal(ipAllowlist)
+		if req.Hash != computeHash(currentData) {
+			c.JSON(409, gin.H{"error": "配置已被修改，请刷新后重试"})
+			return
+		}
+	}
+
+	validIPs, err := normalizeIpList(req.IPs)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	ipAllowlist = validIPs
+	ipAllowlistMatcher = compileIpList(validIPs)
+	if err := saveIpAllowlist(); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+
+	newData, _ := json.Marshal(ipAllowlist)
+	c.JSON(200, gin.H{"message": "IP 白名单已更新", "count": len(ipAllowlist), "hash": computeHash(newData)})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestIpAllowlist 白名单为空时放行所有 IP；非空时只放行名单内的 IP/网段；黑名单优先；更新带乐观锁
+func TestIpAllowlist(t *testing.T) {
+	mem := useMemoryStorage(t)
+	ipBlacklistMutex.Lock()
+	oldBlacklist, oldBlacklistMatcher := ipBlacklist, ipBlacklistMatcher
+	ipBlacklist, ipBlacklistMatcher = nil, compileIpList(nil)
+	ipBlacklistMutex.Unlock()
+	defer func() {
+		ipBlacklistMutex.Lock()
+		ipBlacklist, ipBlacklistMatcher = oldBlacklist, oldBlacklistMatcher
+		ipBlacklistMutex.Unlock()
+		loadIpAllowlist()
+	}()
+	loadIpAllowlist()
+
+	router := gin.New()
+	router.Use(ipBlacklistMiddleware())
+	router.Use(ipAllowlistMiddleware())
+	router.GET("/ping", func(c *gin.Context) { c.String(200, "pong") })
+	router.GET("/api/settings/ip-allowlist", handleGetIpAllowlist)
+	router.POST("/api/settings/ip-allowlist", handleUpdateIpAllowlist)
+
+	request := func(method, path, body, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 空白名单：所有 IP 都放行
+	for _, ip := range []string{"127.0.0.1", "203.0.113.9"} {
+		if w := request("GET", "/ping", "", ip); w.Code != 200 {
+			t.Errorf("空白名单应放行 %s, 得到 %d", ip, w.Code)
+		}
+	}
+
+	// 非法条目拒绝
+	if w := request("POST", "/api/settings/ip-allowlist", `{"ips":["10.0.0.0/40"]}`, "127.0.0.1"); w.Code != 400 {
+		t.Errorf("非法 CIDR 期望 400, 得到 %d", w.Code)
+	}
+
+	if w := request("POST", "/api/settings/ip-allowlist", `{"ips":["127.0.0.1","10.1.0.0/16"]}`, "127.0.0.1"); w.Code != 200 {
+		t.Fatalf("更新白名单期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := mem.Get(ipAllowlistFile); err != nil {
+		t.Errorf("白名单应落盘: %v", err)
+	}
+	for ip, want := range map[string]int{
+		"127.0.0.1":   200,
+		"10.1.200.3":  200, // 网段内
+		"10.2.0.1":    403, // 网段外
+		"203.0.113.9": 403,
+	} {
+		if w := request("GET", "/ping", "", ip); w.Code != want {
+			t.Errorf("%s: 期望 %d, 得到 %d", ip, want, w.Code)
+		}
+	}
+
+	// 同时在黑名单中时以黑名单为准
+	ipBlacklistMutex.Lock()
+	ipBlacklist = []string{"10.1.200.3"}
+	ipBlacklistMatcher = compileIpList(ipBlacklist)
+	ipBlacklistMutex.Unlock()
+	if w := request("GET", "/ping", "", "10.1.200.3"); w.Code != 403 || !bytes.Contains(w.Body.Bytes(), []byte("IP blocked")) {
+		t.Errorf("黑名单应优先于白名单: %d %s", w.Code, w.Body.String())
+	}
+
+	// 乐观锁：过期 hash 返回 409，带当前 hash 可清空白名单
+	w := request("GET", "/api/settings/ip-allowlist", "", "127.0.0.1")
+	var current struct {
+		Hash string `json:"hash"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &current)
+	if w := request("POST", "/api/settings/ip-allowlist", `{"ips":[],"hash":"stale"}`, "127.0.0.1"); w.Code != 409 {
+		t.Errorf("过期 hash 期望 409, 得到 %d", w.Code)
+	}
+	if w := request("POST", "/api/settings/ip-allowlist", `{"ips":[],"hash":"`+current.Hash+`"}`, "127.0.0.1"); w.Code != 200 {
+		t.Fatalf("清空白名单期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/ping", "", "203.0.113.9"); w.Code != 200 {
+		t.Errorf("清空白名单后应放行所有 IP, 得到 %d", w.Code)
+	}
+}
+
+// TestLoadIpAllowlist_OnlyInvalidEntries 手改的文件中全是无效条目时按未开启白名单处理，不会把所有来源拒之门外
+func TestLoadIpAllowlist_OnlyInvalidEntries(t *testing.T) {
+	mem := useMemoryStorage(t)
+	defer func() {
+		_ = mem.Put(ipAllowlistFile, []byte(`[]`))
+		loadIpAllowlist()
+	}()
+	if err := mem.Put(ipAllowlistFile, []byte(`["10.0.0.0/40","not-an-ip"]`)); err != nil {
+		t.Fatalf("写入白名单文件失败: %v", err)
+	}
+	loadIpAllowlist()
+
+	router := gin.New()
+	router.Use(ipAllowlistMiddleware())
+	router.GET("/ping", func(c *gin.Context) { c.String(200, "pong") })
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Errorf("没有有效条目时应放行所有 IP, 得到 %d", w.Code)
+	}
+
+	// 有效条目和无效条目混合时仍按有效条目限制
+	if err := mem.Put(ipAllowlistFile, []byte(`["not-an-ip","127.0.0.1"]`)); err != nil {
+		t.Fatalf("写入白名单文件失败: %v", err)
+	}
+	loadIpAllowlist()
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("存在有效条目时名单外的 IP 应返回 403, 得到 %d", w.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// ========== 登录会话清理 ==========
+
+// defaultLoginSessionSweepInterval 过期登录会话的默认清理间隔
+const defaultLoginSessionSweepInterval = time.Minute
+
+// loginSessionSweepInterval 读取清理间隔（环境变量 LOGIN_SESSION_SWEEP_SECONDS，非法或未设置时用默认值）
+func loginSessionSweepInterval() time.Duration {
+	if v := os.Getenv("LOGIN_SESSION_SWEEP_SECONDS"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultLoginSessionSweepInterval
+}
+
+// sweepExpiredLoginSessions 删除已过期的登录会话，返回删除数量
+// 为什么需要：会话只在轮询时检查过期，用户放弃登录后不再轮询的会话会一直留在内存里
+func sweepExpiredLoginSessions(now time.Time) int {
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	removed := 0
+	for id, session := range loginSessions {
+		if now.Unix() > session.ExpiresAt {
+			delete(loginSessions, id)
+			removed++
+		}
+	}
+	return removed
+}
+
+// loginSessionSweeper 后台协程定期清理过期的登录会话（与轮询无关），stop 关闭时退出（为 nil 时一直运行）
+func loginSessionSweeper(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if removed := sweepExpiredLoginSessions(time.Now()); removed > 0 && logger != nil {
+				logger.Info("", "登录会话: 已清理过期会话", map[string]any{
+					"removed": removed,
+				})
+			}
+		case <-stop:
+			return
+		}
+	}
+}
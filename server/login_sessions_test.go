@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestLoginSessionSweeper 测试从未轮询的过期会话会被后台清理，未过期的保留
+func TestLoginSessionSweeper(t *testing.T) {
+	sessionMutex.Lock()
+	old := loginSessions
+	loginSessions = map[string]*kiroclient.LoginSession{
+		"expired": {SessionID: "expired", ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+		"active":  {SessionID: "active", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+	}
+	sessionMutex.Unlock()
+	defer func() {
+		sessionMutex.Lock()
+		loginSessions = old
+		sessionMutex.Unlock()
+	}()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go loginSessionSweeper(10*time.Millisecond, stop)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sessionMutex.RLock()
+		_, expiredLeft := loginSessions["expired"]
+		_, activeLeft := loginSessions["active"]
+		sessionMutex.RUnlock()
+		if !expiredLeft {
+			if !activeLeft {
+				t.Fatal("未过期的会话不应被清理")
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("过期会话未被清理")
+}
+
+// TestLoginSessionSweepInterval 测试清理间隔的环境变量配置
+func TestLoginSessionSweepInterval(t *testing.T) {
+	t.Setenv("LOGIN_SESSION_SWEEP_SECONDS", "5")
+	if got := loginSessionSweepInterval(); got != 5*time.Second {
+		t.Errorf("期望 5s, 得到 %v", got)
+	}
+	t.Setenv("LOGIN_SESSION_SWEEP_SECONDS", "abc")
+	if got := loginSessionSweepInterval(); got != defaultLoginSessionSweepInterval {
+		t.Errorf("非法值应回落到默认值, 得到 %v", got)
+	}
+}
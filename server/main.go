@@ -6,12 +6,19 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/gin-contrib/pprof"
 	"github.com/gin-gonic/gin"
@@ -86,17 +93,234 @@ func generateID(prefix string) string {
 	return fmt.Sprintf("%s_%d_%s", prefix, time.Now().UnixNano(), hex.EncodeToString(b))
 }
 
-// ctxKeyInjectNotification 通知注入标记的 context key
+// claudeStreamUsage 构建 Claude message_delta 的 usage（与 Anthropic 字段一致）
+// 上游返回了有效 usage 时使用精确值，否则降级为本地估算值（缓存字段为 0）
+// 有推理内容时附带 reasoning_tokens（上游精确值优先，否则为本地估算的累计值）
+func claudeStreamUsage(usage *kiroclient.KiroUsage, estimatedInputTokens, estimatedOutputTokens int) map[string]any {
+	var result map[string]any
+	if usage != nil && usage.InputTokens > 0 {
+		result = map[string]any{
+			"input_tokens":                usage.InputTokens,
+			"cache_creation_input_tokens": usage.CacheWriteTokens,
+			"cache_read_input_tokens":     usage.CacheReadTokens,
+			"output_tokens":               usage.OutputTokens,
+			"service_tier":                claudeServiceTier(),
+		}
+	} else {
+		result = map[string]any{
+			"input_tokens":                estimatedInputTokens,
+			"cache_creation_input_tokens": 0,
+			"cache_read_input_tokens":     0,
+			"output_tokens":               estimatedOutputTokens,
+			"service_tier":                claudeServiceTier(),
+		}
+	}
+	if usage != nil && usage.ReasoningTokens > 0 {
+		result["reasoning_tokens"] = usage.ReasoningTokens
+	}
+	return result
+}
+
+// claudeServiceTier Claude usage.service_tier 的值（兼容字段，Kiro 不区分服务等级）
+func claudeServiceTier() string {
+	if proxyConfig.ClaudeServiceTier != "" {
+		return proxyConfig.ClaudeServiceTier
+	}
+	return kiroclient.DefaultClaudeServiceTier
+}
+
+// writeClaudeMessageEnd 写出 Claude 流的 message_delta 和 message_stop
+// 在上游调用返回后调用，usage 才能使用精确值
+func writeClaudeMessageEnd(w io.Writer, stopReason string, usage map[string]any) {
+	msgDelta := map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   stopReason,
+			"stop_sequence": nil,
+		},
+		"usage": usage,
+	}
+	data, _ := json.Marshal(msgDelta)
+	_, _ = fmt.Fprintf(w, "event: message_delta\ndata: %s\n\n", string(data))
+
+	msgStop := map[string]any{"type": "message_stop"}
+	data, _ = json.Marshal(msgStop)
+	_, _ = fmt.Fprintf(w, "event: message_stop\ndata: %s\n\n", string(data))
+}
+
+// writeClaudeNotificationBlock 以独立的 text content block 写出系统通知（start/delta/stop 完整三段）
+// 为什么独立成块：通知不混进模型回答的 text block，客户端可以区分代理通知和模型输出；
+// 调用方需先关闭当前 block，写完后把 block 索引加一
+func writeClaudeNotificationBlock(w io.Writer, index int, noticeText string) {
+	blockStart := map[string]any{
+		"type":          "content_block_start",
+		"index":         index,
+		"content_block": map[string]any{"type": "text", "text": ""},
+	}
+	bdata, _ := json.Marshal(blockStart)
+	_, _ = fmt.Fprintf(w, "event: content_block_start\ndata: %s\n\n", string(bdata))
+	noticeDelta := map[string]any{
+		"type":  "content_block_delta",
+		"index": index,
+		"delta": map[string]string{
+			"type": "text_delta",
+			"text": noticeText,
+		},
+	}
+	ndata, _ := json.Marshal(noticeDelta)
+	_, _ = fmt.Fprintf(w, "event: content_block_delta\ndata: %s\n\n", string(ndata))
+	blockStop := map[string]any{
+		"type":  "content_block_stop",
+		"index": index,
+	}
+	sdata, _ := json.Marshal(blockStop)
+	_, _ = fmt.Fprintf(w, "event: content_block_stop\ndata: %s\n\n", string(sdata))
+}
+
+// ctxKey 请求 context 的 key 类型
 // 用标准 context.Context 传递，不依赖 gin.Context 的 KV 存储
+// 所有 key 集中在这里按 iota 声明，分散在各文件里手工编号容易撞值（撞值时两个 key 会互相覆盖）
 type ctxKey int
 
-const ctxKeyInjectNotification ctxKey = 1
+const (
+	ctxKeyInjectNotification ctxKey = iota + 1 // 通知注入标记
+	ctxKeyThinkingVariant                      // thinking 实验分组（thinking_ab.go）
+	ctxKeyRequestMetrics                       // 请求延迟和用量信息（slow_request.go）
+	ctxKeyRequestedModel                       // 客户端原始请求的模型，映射前（served_model.go）
+	ctxKeyMaxTokens                            // 本次请求生效的 max_tokens（max_tokens.go）
+	ctxKeyIncludeUsage                         // OpenAI 请求的 stream_options.include_usage（reasoning_usage.go）
+)
+
+// maxModelTimeoutSeconds ProxyConfig.ModelTimeouts 单个模型的上游超时上限（秒）
+const maxModelTimeoutSeconds = 3600
+
+// maxUpstreamRetries ProxyConfig.MaxRetries 的上限（每次重试都会多占用一个账号）
+const maxUpstreamRetries = 5
+
+// applyRequestTimeout 按 ProxyConfig.MaxRequestSeconds 给请求 context 加上总时长上限
+// 返回的 cancel 必须由调用方 defer 调用；未配置时返回空操作
+func applyRequestTimeout(c *gin.Context) context.CancelFunc {
+	if proxyConfig.MaxRequestSeconds <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), time.Duration(proxyConfig.MaxRequestSeconds)*time.Second)
+	c.Request = c.Request.WithContext(ctx)
+	return cancel
+}
+
+// isRequestTimeout 判断请求是否因总时长上限到期而终止
+// 入站请求的 context 自身没有 deadline（客户端断开是 Canceled），出现 DeadlineExceeded 只可能来自 applyRequestTimeout
+func isRequestTimeout(c *gin.Context) bool {
+	return errors.Is(c.Request.Context().Err(), context.DeadlineExceeded)
+}
+
+// StatusClientClosedRequest 客户端中途断开的请求在账号统计和请求日志中的状态码（沿用 nginx 的 499）
+// 为什么：断开既不是成功也不是账号故障，单独计数才能在看板上区分放弃请求和真实结果
+const StatusClientClosedRequest = 499
+
+// ClientCancelledKey Gin context 中标记请求因客户端断开而终止
+const ClientCancelledKey = "clientCancelled"
+
+// isClientCancelled 判断请求是否因客户端断开（或在 /api/requests/active 被手动中止）而终止
+func isClientCancelled(c *gin.Context) bool {
+	return errors.Is(c.Request.Context().Err(), context.Canceled)
+}
+
+// recordClientCancelled 按 499 记录客户端断开的请求（不计成功/失败，不计入熔断），请求日志同样按 499 输出
+func recordClientCancelled(c *gin.Context, accountID, email string) {
+	c.Set(ClientCancelledKey, true)
+	recordAccountRequest(accountID, email, StatusClientClosedRequest, "")
+}
+
+// recordCancelledStreamUsage 客户端中途断开的流式请求：把已消耗的部分 usage 计入 Token 统计，并记录提前结束时已写出的字节数
+// 为什么：断开前上游已经生成（并计费）了部分内容，不计入会让统计偏低；上游返回了精确 usage 时优先使用
+// 返回计入统计的 input/output tokens
+func recordCancelledStreamUsage(c *gin.Context, accountID string, usage *kiroclient.KiroUsage, estimatedInput int, partialOutput, format, model string) (int, int) {
+	inputTokens, outputTokens := estimatedInput, kiroclient.CountTokens(partialOutput)
+	exactUsage := usage != nil && usage.InputTokens > 0
+	if exactUsage {
+		inputTokens, outputTokens = usage.InputTokens, usage.OutputTokens
+	}
+	addTokenStats(inputTokens, outputTokens, exactUsage)
+	recordApiKeyUsage(c, inputTokens, outputTokens)
+
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "客户端断开，流式响应提前结束", map[string]any{
+			"format":        format,
+			"model":         model,
+			"accountId":     accountID,
+			"bytesStreamed": streamedBytes(c),
+			"inputTokens":   inputTokens,
+			"outputTokens":  outputTokens,
+			"exactUsage":    exactUsage,
+		})
+	}
+	return inputTokens, outputTokens
+}
+
+// upstreamErrorStatus 上游错误返回给客户端的状态码
+// Kiro 报请求格式错误时返回 400：是请求本身（或我们构造的 payload）有问题，不是服务端故障
+func upstreamErrorStatus(err error) int {
+	if kiroclient.IsImproperlyFormedRequestError(err) {
+		return 400
+	}
+	// 账号额度耗尽：该账号已暂停选择，客户端稍后重试会换到其他账号
+	if kiroclient.IsQuotaExhaustedError(err) {
+		return 429
+	}
+	return 500
+}
+
+// requestTimeoutMessage 请求总时长超限的错误信息
+func requestTimeoutMessage() string {
+	return fmt.Sprintf("request exceeded max duration of %ds", proxyConfig.MaxRequestSeconds)
+}
+
+// writeStreamTimeoutError 请求总时长超限时写入错误帧，结束 SSE 流
+func writeStreamTimeoutError(c *gin.Context, format string) {
+	writeStreamError(c, format, "timeout_error", requestTimeoutMessage())
+}
+
+// writeStreamError 写入错误帧，结束 SSE 流
+// Claude 格式使用 error 事件，OpenAI 格式写入 error 对象后补 [DONE]
+// 调用方需先关闭已打开的 content block；上游出错时由调用方在之后补发 message_delta/message_stop，超时截断不补发
+func writeStreamError(c *gin.Context, format, errType, message string) {
+	errObj := map[string]any{
+		"type":    errType,
+		"message": message,
+	}
+	if format == "claude" {
+		data, _ := json.Marshal(map[string]any{"type": "error", "error": errObj})
+		_, _ = fmt.Fprintf(c.Writer, "event: error\ndata: %s\n\n", string(data))
+		return
+	}
+	// OpenAI 的 error 对象固定带 param/code 字段，SDK 按该结构解析
+	errObj["param"] = nil
+	errObj["code"] = nil
+	data, _ := json.Marshal(map[string]any{"error": errObj})
+	_, _ = fmt.Fprintf(c.Writer, "data: %s\n\ndata: [DONE]\n\n", string(data))
+}
+
+// streamErrorType 上游错误在流式错误帧中的类型，与 upstreamErrorStatus 的状态码对应
+func streamErrorType(err error) string {
+	switch upstreamErrorStatus(err) {
+	case 400:
+		return "invalid_request_error"
+	case 429:
+		return "rate_limit_error"
+	default:
+		return "api_error"
+	}
+}
 
 // OpenAI 格式请求
 type OpenAIChatRequest struct {
-	Model    string           `json:"model"`
-	Messages []map[string]any `json:"messages"`
-	Stream   bool             `json:"stream"`
+	Model               string               `json:"model"`
+	Messages            []map[string]any     `json:"messages"`
+	Stream              bool                 `json:"stream"`
+	MaxTokens           int                  `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                  `json:"max_completion_tokens,omitempty"` // 新版 OpenAI 字段，优先于 max_tokens
+	StreamOptions       *OpenAIStreamOptions `json:"stream_options,omitempty"`
 }
 
 // Claude 格式请求（完整版，支持 MCP tools 透传）
@@ -109,8 +333,8 @@ type ClaudeChatRequest struct {
 	Tools         any              `json:"tools,omitempty"`
 	ToolChoice    any              `json:"tool_choice,omitempty"`
 	Temperature   *float64         `json:"temperature,omitempty"`
-	TopP          float64          `json:"top_p,omitempty"`
-	TopK          int              `json:"top_k,omitempty"`
+	TopP          *float64         `json:"top_p,omitempty"`
+	TopK          *int             `json:"top_k,omitempty"`
 	StopSequences []string         `json:"stop_sequences,omitempty"`
 	Metadata      any              `json:"metadata,omitempty"`
 	OutputConfig  any              `json:"output_config,omitempty"`
@@ -180,6 +404,7 @@ type TokenStatusResponse struct {
 	DaysUntilReset   int     `json:"daysUntilReset"`
 	NextResetDate    string  `json:"nextResetDate"`
 	SubscriptionName string  `json:"subscriptionName"`
+	UsageFreshness
 	// 用户信息
 	UserId    string `json:"userId"`
 	TokenData string `json:"tokenData"` // 完整的token JSON数据
@@ -208,33 +433,65 @@ var logger *StructuredLogger
 // ========== IP 黑名单 ==========
 var ipBlacklistFile = "ip-blacklist.json"
 var ipBlacklist []string
+var ipBlacklistMatcher = compileIpList(nil) // 由 ipBlacklist 预编译，随其一起更新
 var ipBlacklistMutex sync.RWMutex
 
 // ========== 限流器 ==========
 var rateLimitFile = "rate-limit.json"
 var rateLimitConfig RateLimitConfig
 var rateLimitMutex sync.RWMutex
-var requestCounts = make(map[string]*RequestCounter) // IP -> 计数器
+var requestCounts = make(map[string]*RequestCounter) // 限流 key（IP 或 API-KEY 标识）-> 计数器
 var requestCountsMutex sync.RWMutex
+var requestCountsPrunedAt time.Time // 上次清理空闲计数器的时间，受 requestCountsMutex 保护
+
+// requestCountsPruneInterval 清理空闲限流计数器的间隔
+// 为什么：按 IP 计数时每个来源地址都会留下一个计数器，不清理的话 map 随访问过的地址数无限增长
+const requestCountsPruneInterval = time.Minute
 
 // RateLimitConfig 限流配置
 type RateLimitConfig struct {
 	Enabled        bool `json:"enabled"`
 	RequestsPerMin int  `json:"requestsPerMin"` // 每分钟最大请求数
 	PenaltySeconds int  `json:"penaltySeconds"` // 超限惩罚延迟秒数
+	// KeyBy 限流维度：ip（默认）或 apiKey
+	// 为什么：大量客户端在同一 NAT/网关后共用一个出口 IP 时，按 IP 限流会让它们互相挤占配额
+	KeyBy string `json:"keyBy,omitempty"`
+	// Mode 限流算法：window（默认，固定 60 秒窗口）或 bucket（令牌桶）
+	// 为什么：固定窗口在窗口边界前后可以连续打满两个窗口，短时间内放过 2 倍请求；令牌桶按速率匀速补充，没有边界突发
+	Mode string `json:"mode,omitempty"`
+	// Burst 令牌桶容量（允许的最大突发请求数），<=0 时等于 RequestsPerMin，仅 bucket 模式生效
+	Burst int `json:"burst,omitempty"`
 }
 
-// RequestCounter 请求计数器（滑动窗口）
+// 限流算法（RateLimitConfig.Mode）
+const (
+	RateLimitModeWindow = "window"
+	RateLimitModeBucket = "bucket"
+)
+
+// 限流维度（RateLimitConfig.KeyBy）
+const (
+	RateLimitKeyByIP     = "ip"
+	RateLimitKeyByAPIKey = "apiKey"
+)
+
+// HeaderXRateLimitRemaining 当前窗口剩余可用请求数，客户端可据此自行降速
+const HeaderXRateLimitRemaining = "X-RateLimit-Remaining"
+
+// RequestCounter 请求计数器（window 模式用 Count/WindowEnd，bucket 模式用 Tokens/LastRefill）
 type RequestCounter struct {
 	Count     int
 	WindowEnd int64 // 窗口结束时间戳
+
+	Tokens     float64   // 令牌桶中剩余的令牌数
+	LastRefill time.Time // 上次补充令牌的时间
 }
 
 // ========== 全局 Token 统计 ==========
 var tokenStatsFile = "token-stats.json"
 var tokenStats TokenStats
 var tokenStatsMutex sync.RWMutex
-var tokenStatsChan = make(chan TokenDelta, 1000) // 异步写入通道
+var tokenStatsChan = make(chan TokenDelta, defaultTokenStatsQueueSize) // 异步写入通道，启动时按 TOKEN_STATS_QUEUE_SIZE 重建
 
 // ========== 熔断错误率统计 ==========
 var circuitStats *CircuitStats
@@ -250,6 +507,38 @@ type NotificationConfig struct {
 	Enabled bool   `json:"enabled"`
 	Message string `json:"message"`
 	Hash    string `json:"hash"`
+	// 可选过滤条件：只对匹配的请求注入（空=全部，各条件之间为"且"）
+	// 为什么：免费/付费分层部署时，公告只需要出现在部分模型或部分 API-KEY 上
+	Models    []string `json:"models,omitempty"`    // 映射后的模型 ID
+	Formats   []string `json:"formats,omitempty"`   // 请求格式：openai / claude
+	ApiKeyIds []string `json:"apiKeyIds,omitempty"` // API-KEY 标识（前 8 位，与管理页面展示的 prefix 一致）
+}
+
+// notificationScope 注入判断所需的请求信息
+type notificationScope struct {
+	Model    string
+	Format   string
+	ApiKeyID string
+}
+
+// matches 检查请求是否命中通知的过滤条件
+func (cfg NotificationConfig) matches(scope notificationScope) bool {
+	return matchesFilter(cfg.Models, scope.Model) &&
+		matchesFilter(cfg.Formats, scope.Format) &&
+		matchesFilter(cfg.ApiKeyIds, scope.ApiKeyID)
+}
+
+// matchesFilter 过滤列表为空表示不限制，否则要求值在列表中
+func matchesFilter(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if f == value {
+			return true
+		}
+	}
+	return false
 }
 
 // ========== 账号调用统计 ==========
@@ -276,27 +565,45 @@ type TokenStats struct {
 	TotalTokens  int64 `json:"totalTokens"`
 	RequestCount int64 `json:"requestCount"`
 	UpdatedAt    int64 `json:"updatedAt"`
+	// 按来源拆分的合计（两者之和等于上面的总数；升级前累计的数据不在拆分中）
+	// 为什么：按总数计费时混合了上游精确 usage 和本地估算，需要知道其中多少是可靠的
+	Exact     TokenSourceStats `json:"exact"`     // 来自上游精确 usage
+	Estimated TokenSourceStats `json:"estimated"` // 上游未返回 usage，使用本地估算
+}
+
+// TokenSourceStats 单一来源的 Token 合计
+type TokenSourceStats struct {
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+	RequestCount int64 `json:"requestCount"`
+}
+
+// add 累加一次请求
+func (s *TokenSourceStats) add(input, output int) {
+	s.InputTokens += int64(input)
+	s.OutputTokens += int64(output)
+	s.RequestCount++
 }
 
 // TokenDelta 单次请求的 Token 增量
 type TokenDelta struct {
 	Input  int
 	Output int
+	Exact  bool // 是否来自上游精确 usage
 }
 
 // loadTokenStats 启动时加载统计数据
+// 文件不存在时新建；读取失败或文件损坏见 loadStatsFile
 func loadTokenStats() {
-	data, err := os.ReadFile(tokenStatsFile)
-	if err != nil {
+	var loaded TokenStats
+	if !loadStatsFile("tokenStats", tokenStatsFile, &loaded) {
 		tokenStats = TokenStats{}
 		if logger != nil {
 			logger.Info("", "Token 统计: 新建", nil)
 		}
 		return
 	}
-	if err := json.Unmarshal(data, &tokenStats); err != nil {
-		tokenStats = TokenStats{}
-	}
+	tokenStats = loaded
 	if logger != nil {
 		logger.Info("", "Token 统计: 已加载", map[string]any{
 			"inputTokens":  tokenStats.InputTokens,
@@ -306,21 +613,43 @@ func loadTokenStats() {
 	}
 }
 
-// saveTokenStats 保存统计数据到文件
-func saveTokenStats() {
+// saveTokenStats 保存统计数据到文件（失败时记录并返回错误，内存统计不受影响）
+func saveTokenStats() error {
 	tokenStatsMutex.RLock()
 	data, _ := json.MarshalIndent(tokenStats, "", "  ")
 	tokenStatsMutex.RUnlock()
-	os.WriteFile(tokenStatsFile, data, 0644)
+	return writeStatsFile("tokenStats", tokenStatsFile, data)
 }
 
-// addTokenStats 累加 Token 统计（异步）
-func addTokenStats(input, output int) {
+// addTokenStats 累加 Token 统计（异步），exact 表示数值来自上游精确 usage
+func addTokenStats(input, output int, exact bool) {
 	select {
-	case tokenStatsChan <- TokenDelta{Input: input, Output: output}:
+	case tokenStatsChan <- TokenDelta{Input: input, Output: output, Exact: exact}:
 	default:
-		// 通道满了直接丢弃，避免阻塞
+		// 通道满了不阻塞请求：按配置直接累加或丢弃计数
+		handleTokenStatsQueueFull(TokenDelta{Input: input, Output: output, Exact: exact})
+	}
+}
+
+// applyTokenDelta 把单次请求的增量累加到全局统计
+func applyTokenDelta(delta TokenDelta) {
+	tokenStatsMutex.Lock()
+	applyTokenDeltaLocked(delta)
+	tokenStatsMutex.Unlock()
+}
+
+// applyTokenDeltaLocked 同 applyTokenDelta，调用方需持有 tokenStatsMutex
+func applyTokenDeltaLocked(delta TokenDelta) {
+	tokenStats.InputTokens += int64(delta.Input)
+	tokenStats.OutputTokens += int64(delta.Output)
+	tokenStats.TotalTokens += int64(delta.Input + delta.Output)
+	tokenStats.RequestCount++
+	if delta.Exact {
+		tokenStats.Exact.add(delta.Input, delta.Output)
+	} else {
+		tokenStats.Estimated.add(delta.Input, delta.Output)
 	}
+	tokenStats.UpdatedAt = time.Now().Unix()
 }
 
 // tokenStatsWorker 后台协程处理统计写入
@@ -330,16 +659,10 @@ func tokenStatsWorker() {
 	for {
 		select {
 		case delta := <-tokenStatsChan:
-			tokenStatsMutex.Lock()
-			tokenStats.InputTokens += int64(delta.Input)
-			tokenStats.OutputTokens += int64(delta.Output)
-			tokenStats.TotalTokens += int64(delta.Input + delta.Output)
-			tokenStats.RequestCount++
-			tokenStats.UpdatedAt = time.Now().Unix()
-			tokenStatsMutex.Unlock()
+			applyTokenDelta(delta)
 			dirty = true
 		case <-ticker.C:
-			if dirty {
+			if tokenStatsDirectDirty.Swap(false) || dirty {
 				saveTokenStats()
 				dirty = false
 			}
@@ -357,18 +680,15 @@ func getTokenStats() TokenStats {
 // ========== 账号统计函数 ==========
 
 // loadAccountStats 启动时加载账号统计数据
+// 文件不存在时新建；读取失败或文件损坏见 loadStatsFile
 func loadAccountStats() {
-	data, err := os.ReadFile(accountStatsFile)
-	if err != nil {
+	var stats map[string]*AccountStats
+	if !loadStatsFile("accountStats", accountStatsFile, &stats) || stats == nil {
 		if logger != nil {
 			logger.Info("", "账号统计: 新建", nil)
 		}
 		return
 	}
-	var stats map[string]*AccountStats
-	if err := json.Unmarshal(data, &stats); err != nil {
-		return
-	}
 	accountStatsMutex.Lock()
 	accountStats = stats
 	accountStatsMutex.Unlock()
@@ -379,22 +699,24 @@ func loadAccountStats() {
 	}
 }
 
-// saveAccountStats 保存账号统计数据
-func saveAccountStats() {
+// saveAccountStats 保存账号统计数据（失败时记录并返回错误，内存统计不受影响）
+func saveAccountStats() error {
 	accountStatsMutex.RLock()
 	data, _ := json.MarshalIndent(accountStats, "", "  ")
 	accountStatsMutex.RUnlock()
-	os.WriteFile(accountStatsFile, data, 0644)
+	return writeStatsFile("accountStats", accountStatsFile, data)
 }
 
 // recordAccountRequest 记录账号请求（状态码和错误）
+// statusCode 为 StatusClientClosedRequest 时只计入 StatusCodes，不计请求数、成功/失败，也不计入熔断
 func recordAccountRequest(accountID, email string, statusCode int, errMsg string) {
 	if accountID == "" {
 		return
 	}
+	cancelled := statusCode == StatusClientClosedRequest
 
 	// 记录到熔断错误率统计器（用于实时错误率计算）
-	if circuitStats != nil {
+	if circuitStats != nil && !cancelled {
 		circuitStats.Record(accountID, statusCode >= 200 && statusCode < 300)
 
 		// 错误率过高时自动熔断(使用原子操作TryAutoTrip消除TOCTOU竞态)
@@ -425,7 +747,6 @@ func recordAccountRequest(accountID, email string, statusCode int, errMsg string
 		stats.Email = email
 	}
 
-	stats.RequestCount++
 	stats.UpdatedAt = time.Now().Unix()
 
 	// 记录状态码
@@ -433,6 +754,10 @@ func recordAccountRequest(accountID, email string, statusCode int, errMsg string
 		stats.StatusCodes = make(map[int]int64)
 	}
 	stats.StatusCodes[statusCode]++
+	if cancelled {
+		return
+	}
+	stats.RequestCount++
 
 	// 成功/失败计数
 	if statusCode >= 200 && statusCode < 300 {
@@ -487,6 +812,50 @@ func circuitStateToLabel(state kiroclient.CircuitState) string {
 	}
 }
 
+// CircuitPoolSummary 账号池健康汇总（仪表盘红绿灯）
+type CircuitPoolSummary struct {
+	Closed           int    `json:"closed"`           // 熔断关闭（正常）
+	HalfOpen         int    `json:"halfOpen"`         // 半开（试探中）
+	Open             int    `json:"open"`             // 熔断中
+	TokenExpired     int    `json:"tokenExpired"`     // Token 缺失或已过期
+	CreditsExhausted int    `json:"creditsExhausted"` // 额度已耗尽
+	Eligible         int    `json:"eligible"`         // 当前可被选中承接请求
+	Health           string `json:"health"`           // green=全部可用 yellow=部分可用 red=无可用账号
+}
+
+// add 把单个账号计入汇总
+func (s *CircuitPoolSummary) add(state string, info kiroclient.AccountLoadInfo) {
+	switch state {
+	case "open":
+		s.Open++
+	case "half_open":
+		s.HalfOpen++
+	default:
+		s.Closed++
+	}
+	if info.TokenExpired {
+		s.TokenExpired++
+	}
+	if info.CreditsExhausted {
+		s.CreditsExhausted++
+	}
+	if info.Eligible {
+		s.Eligible++
+	}
+}
+
+// finish 根据可用账号数计算红绿灯状态
+func (s *CircuitPoolSummary) finish(total int) {
+	switch {
+	case s.Eligible == 0:
+		s.Health = "red"
+	case s.Eligible < total:
+		s.Health = "yellow"
+	default:
+		s.Health = "green"
+	}
+}
+
 // handleCircuitBreakerStatus 获取所有账号的熔断状态、错误率、负载比例
 // 聚合三个数据源：熔断器状态 + 错误率统计 + 负载分布
 func handleCircuitBreakerStatus(c *gin.Context) {
@@ -503,14 +872,16 @@ func handleCircuitBreakerStatus(c *gin.Context) {
 	}
 
 	// 聚合所有账号数据（以负载分布为基准，因为它包含所有配置中的账号）
+	// 负载分布按账号配置顺序返回，输出顺序本身就是稳定的，无需再排序
 	accounts := make([]map[string]any, 0, len(loadDist))
+	summary := CircuitPoolSummary{}
 	for _, info := range loadDist {
 		// 熔断器状态（可能不存在，默认 Closed）
 		cb, hasCB := cbStates[info.AccountID]
 
 		stateStr := "closed"
 		stateLabel := "正常"
-		var failureCount, successCount int
+		var failureCount, successCount, probesInFlight int
 		var lastFailureTime, openedAt int64
 
 		if hasCB {
@@ -518,6 +889,9 @@ func handleCircuitBreakerStatus(c *gin.Context) {
 			stateLabel = circuitStateToLabel(cb.State)
 			failureCount = cb.FailureCount
 			successCount = cb.SuccessCount
+			if cb.State == kiroclient.CircuitHalfOpen {
+				probesInFlight = cb.ProbesInFlight
+			}
 			// 时间字段转 Unix 时间戳，零值时返回 0
 			if !cb.LastFailureTime.IsZero() {
 				lastFailureTime = cb.LastFailureTime.Unix()
@@ -536,26 +910,34 @@ func handleCircuitBreakerStatus(c *gin.Context) {
 		}
 
 		accounts = append(accounts, map[string]any{
-			"accountId":       info.AccountID,
-			"email":           info.Email,
-			"state":           stateStr,
-			"stateLabel":      stateLabel,
-			"failureCount":    failureCount,
-			"successCount":    successCount,
-			"lastFailureTime": lastFailureTime,
-			"openedAt":        openedAt,
-			"errorRate1m":     errorRate1m,
-			"errorRate5m":     errorRate5m,
-			"totalRequests1m": totalReq1m,
-			"totalRequests5m": totalReq5m,
-			"weight":          info.Weight,
-			"loadPercent":     info.Percent,
+			"accountId":        info.AccountID,
+			"email":            info.Email,
+			"state":            stateStr,
+			"stateLabel":       stateLabel,
+			"failureCount":     failureCount,
+			"successCount":     successCount,
+			"probesInFlight":   probesInFlight,
+			"lastFailureTime":  lastFailureTime,
+			"openedAt":         openedAt,
+			"errorRate1m":      errorRate1m,
+			"errorRate5m":      errorRate5m,
+			"totalRequests1m":  totalReq1m,
+			"totalRequests5m":  totalReq5m,
+			"weight":           info.Weight,
+			"loadPercent":      info.Percent,
+			"tokenExpired":     info.TokenExpired,
+			"creditsExhausted": info.CreditsExhausted,
+			"eligible":         info.Eligible,
 		})
+		summary.add(stateStr, info)
 	}
+	summary.finish(len(accounts))
 
 	c.JSON(200, gin.H{
 		"accounts":      accounts,
 		"totalAccounts": len(accounts),
+		"summary":       summary,
+		"config":        currentCircuitRecoveryConfig(), // 当前生效的熔断恢复配置
 	})
 }
 
@@ -609,6 +991,72 @@ func handleCircuitBreakerReset(c *gin.Context) {
 	})
 }
 
+// handleCircuitBreakerHalfOpen 手动把熔断中的账号推进到半开状态，放行试探请求
+// 为什么：不清除 circuitStats，也不直接关闭熔断器，是否恢复交给半开试探结果决定
+func handleCircuitBreakerHalfOpen(c *gin.Context) {
+	var req struct {
+		AccountID string `json:"accountId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数格式错误"})
+		return
+	}
+
+	state, err := client.Auth.ManualHalfOpen(req.AccountID)
+	if err != nil {
+		// ManualHalfOpen 返回错误说明账号不存在
+		c.JSON(404, gin.H{"error": "账号不存在"})
+		return
+	}
+	if state == kiroclient.CircuitClosed {
+		c.JSON(409, gin.H{"error": "账号未熔断，无需半开", "state": circuitStateToString(state)})
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "账号已进入半开状态",
+		"state":   circuitStateToString(state),
+	})
+}
+
+// handleCircuitBreakerClearStats 只清除账号的错误率统计，不改变熔断器状态
+// 为什么：上游短暂故障后想清掉错误率历史，但不想强制解除仍在熔断/半开中的账号
+func handleCircuitBreakerClearStats(c *gin.Context) {
+	var req struct {
+		AccountID string `json:"accountId"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": "参数格式错误"})
+		return
+	}
+
+	config, err := client.Auth.LoadAccountsConfig()
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	found := false
+	for _, acc := range config.Accounts {
+		if acc.ID == req.AccountID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.JSON(404, gin.H{"error": "账号不存在"})
+		return
+	}
+
+	if circuitStats != nil {
+		circuitStats.ClearAccount(req.AccountID)
+	}
+
+	c.JSON(200, gin.H{
+		"message":   "错误率统计已清除",
+		"accountId": req.AccountID,
+	})
+}
+
 // handleGetAccountStats 获取账号统计 API
 func handleGetAccountStats(c *gin.Context) {
 	stats := getAccountStats()
@@ -619,9 +1067,23 @@ func handleGetAccountStats(c *gin.Context) {
 		totalRequests += s.RequestCount
 	}
 
+	// 按请求数降序、账号 ID 升序排列，保证多次调用顺序一致（map 遍历顺序随机，面板会跳动）
+	ids := make([]string, 0, len(stats))
+	for id := range stats {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := stats[ids[i]], stats[ids[j]]
+		if a.RequestCount != b.RequestCount {
+			return a.RequestCount > b.RequestCount
+		}
+		return ids[i] < ids[j]
+	})
+
 	// 构建响应数据（email 已在写入时记录，无需动态查询）
-	accounts := make([]map[string]any, 0)
-	for id, s := range stats {
+	accounts := make([]map[string]any, 0, len(ids))
+	for _, id := range ids {
+		s := stats[id]
 		percent := float64(0)
 		if totalRequests > 0 {
 			percent = float64(s.RequestCount) / float64(totalRequests) * 100
@@ -645,6 +1107,68 @@ func handleGetAccountStats(c *gin.Context) {
 	})
 }
 
+// removeAccountStats 删除指定账号的统计数据（账号统计 + 熔断错误率统计）并立即落盘
+// 为什么立即落盘：否则重启前 30 秒内的定时保存窗口里，已删除账号的统计会从文件里复活
+func removeAccountStats(accountIDs ...string) {
+	if len(accountIDs) == 0 {
+		return
+	}
+	accountStatsMutex.Lock()
+	for _, id := range accountIDs {
+		delete(accountStats, id)
+	}
+	accountStatsMutex.Unlock()
+
+	if circuitStats != nil {
+		for _, id := range accountIDs {
+			circuitStats.ClearAccount(id)
+		}
+	}
+	saveAccountStats()
+}
+
+// handlePruneAccountStats 清理已不在账号配置中的账号统计
+// 账号被删除后（包括直接改 kiro-accounts.json 的情况），其统计会一直残留在面板里并影响占比计算
+func handlePruneAccountStats(c *gin.Context) {
+	config, err := client.Auth.LoadAccountsConfig()
+	if err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+
+	existing := make(map[string]bool, len(config.Accounts))
+	for _, acc := range config.Accounts {
+		existing[acc.ID] = true
+	}
+
+	// 账号统计和熔断错误率统计的 key 可能不完全一致，两边都要检查
+	staleSet := make(map[string]bool)
+	for id := range getAccountStats() {
+		if !existing[id] {
+			staleSet[id] = true
+		}
+	}
+	if circuitStats != nil {
+		for _, id := range circuitStats.AccountIDs() {
+			if !existing[id] {
+				staleSet[id] = true
+			}
+		}
+	}
+
+	removed := make([]string, 0, len(staleSet))
+	for id := range staleSet {
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	removeAccountStats(removed...)
+
+	c.JSON(200, gin.H{"message": "账号统计已清理", "removed": removed})
+}
+
 // accountStatsWorker 后台协程定期保存账号统计
 func accountStatsWorker() {
 	ticker := time.NewTicker(30 * time.Second)
@@ -662,12 +1186,28 @@ func handleGetStats(c *gin.Context) {
 		"totalTokens":  stats.TotalTokens,
 		"requestCount": stats.RequestCount,
 		"updatedAt":    stats.UpdatedAt,
+		// 按来源拆分：exact 来自上游精确 usage，estimated 为本地估算
+		"exact":       stats.Exact,
+		"estimated":   stats.Estimated,
+		"thinkingAB":  getThinkingABStats(),
+		"stickiness":  client.Auth.GetStickinessStats(),
+		"concurrency": requestLimiter.stats(),
+		"eventTypes":  client.Chat.GetEventTypeStats(),
+		// 发往上游的请求体大小分布
+		"payloadSizes": client.Chat.GetPayloadSizeStats(),
+		// 统计文件读写失败次数（磁盘满/只读时非 0，内存统计仍在继续）
+		"persistenceFailures":        getPersistenceFailures(),
+		"toolDescriptionTruncations": toolDescriptionTruncations.Load(),
+		// 统计通道满被丢弃的增量数（非 0 说明用量少计，见 TOKEN_STATS_QUEUE_SIZE）
+		"droppedDeltas": droppedTokenDeltas.Load(),
+		// 上游报告额度耗尽的账号（until 之前不参与选择）
+		"quotaExhausted": client.Auth.GetQuotaExhaustions(),
 	})
 }
 
 // loadApiKeys 从文件加载 API-KEY 配置
 func loadApiKeys() {
-	data, err := os.ReadFile(apiKeysFile)
+	data, err := storage.Get(apiKeysFile)
 	if err != nil {
 		apiKeys = []string{}
 		return
@@ -691,12 +1231,12 @@ func saveApiKeys() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(apiKeysFile, data, 0644)
+	return storage.Put(apiKeysFile, data)
 }
 
 // loadIpBlacklist 从文件加载 IP 黑名单
 func loadIpBlacklist() {
-	data, err := os.ReadFile(ipBlacklistFile)
+	data, err := storage.Get(ipBlacklistFile)
 	if err != nil {
 		ipBlacklist = []string{}
 		return
@@ -707,6 +1247,7 @@ func loadIpBlacklist() {
 		return
 	}
 	ipBlacklist = list
+	ipBlacklistMatcher = compileIpList(list)
 	if logger != nil {
 		logger.Info("", "已加载黑名单 IP", map[string]any{
 			"count": len(ipBlacklist),
@@ -714,13 +1255,92 @@ func loadIpBlacklist() {
 	}
 }
 
+// ipMatchSet 预编译的 IP 名单（黑名单/白名单）：精确 IP（规范化后的字符串）和 CIDR 网段
+type ipMatchSet struct {
+	ips  map[string]bool
+	nets []*net.IPNet
+}
+
+// parseIpEntry 解析一条名单条目：含 / 的按 CIDR 解析，否则按单个 IP 解析
+func parseIpEntry(entry string) (net.IP, *net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, nil, fmt.Errorf("无效的 CIDR: %s", entry)
+		}
+		return nil, ipNet, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("无效的 IP: %s", entry)
+	}
+	return ip, nil, nil
+}
+
+// normalizeIpList 去掉首尾空白并过滤空值，其余每条必须是合法的 IP 或 CIDR
+func normalizeIpList(entries []string) ([]string, error) {
+	var list []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, _, err := parseIpEntry(entry); err != nil {
+			return nil, err
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// compileIpList 把名单编译成 ipMatchSet，无法解析的条目跳过（更新接口会拒绝这类条目，只可能来自手改的文件）
+func compileIpList(list []string) *ipMatchSet {
+	set := &ipMatchSet{ips: make(map[string]bool)}
+	for _, entry := range list {
+		ip, ipNet, err := parseIpEntry(entry)
+		switch {
+		case err != nil:
+			if logger != nil {
+				logger.Warn("", "忽略无效的 IP 名单条目", map[string]any{"entry": entry})
+			}
+		case ipNet != nil:
+			set.nets = append(set.nets, ipNet)
+		default:
+			set.ips[ip.String()] = true
+		}
+	}
+	return set
+}
+
+// empty 名单中没有任何可用条目（为空或全部无效）
+func (s *ipMatchSet) empty() bool {
+	return len(s.ips) == 0 && len(s.nets) == 0
+}
+
+// contains 判断 IP 是否命中精确 IP 或任一网段
+func (s *ipMatchSet) contains(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	if s.ips[ip.String()] {
+		return true
+	}
+	for _, ipNet := range s.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // saveIpBlacklist 保存 IP 黑名单到文件
 func saveIpBlacklist() error {
 	data, err := json.MarshalIndent(ipBlacklist, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(ipBlacklistFile, data, 0644)
+	return storage.Put(ipBlacklistFile, data)
 }
 
 // ipBlacklistMiddleware IP 黑名单中间件
@@ -729,13 +1349,7 @@ func ipBlacklistMiddleware() gin.HandlerFunc {
 		clientIP := c.ClientIP()
 
 		ipBlacklistMutex.RLock()
-		blocked := false
-		for _, ip := range ipBlacklist {
-			if ip == clientIP {
-				blocked = true
-				break
-			}
-		}
+		blocked := ipBlacklistMatcher.contains(clientIP)
 		ipBlacklistMutex.RUnlock()
 
 		if blocked {
@@ -786,15 +1400,14 @@ func handleUpdateIpBlacklist(c *gin.Context) {
 		}
 	}
 
-	// 过滤空值
-	var validIPs []string
-	for _, ip := range req.IPs {
-		if ip != "" {
-			validIPs = append(validIPs, ip)
-		}
+	validIPs, err := normalizeIpList(req.IPs)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
 
 	ipBlacklist = validIPs
+	ipBlacklistMatcher = compileIpList(validIPs)
 	if err := saveIpBlacklist(); err != nil {
 		if logger != nil {
 			RecordErrorFromGin(c, logger, err, "")
@@ -808,15 +1421,20 @@ func handleUpdateIpBlacklist(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "IP 黑名单已更新", "count": len(ipBlacklist), "hash": newHash})
 }
 
+// defaultRateLimitConfig 默认限流配置（关闭）
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{Enabled: false, RequestsPerMin: 60}
+}
+
 // loadRateLimitConfig 加载限流配置
 func loadRateLimitConfig() {
-	data, err := os.ReadFile(rateLimitFile)
+	data, err := storage.Get(rateLimitFile)
 	if err != nil {
-		rateLimitConfig = RateLimitConfig{Enabled: false, RequestsPerMin: 60}
+		rateLimitConfig = defaultRateLimitConfig()
 		return
 	}
 	if err := json.Unmarshal(data, &rateLimitConfig); err != nil {
-		rateLimitConfig = RateLimitConfig{Enabled: false, RequestsPerMin: 60}
+		rateLimitConfig = defaultRateLimitConfig()
 		return
 	}
 	if logger != nil {
@@ -833,7 +1451,7 @@ func saveRateLimitConfig() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(rateLimitFile, data, 0644)
+	return storage.Put(rateLimitFile, data)
 }
 
 // ========== 系统通知配置函数 ==========
@@ -841,7 +1459,7 @@ func saveRateLimitConfig() error {
 // loadNotificationConfig 加载系统通知配置
 // 加载后预算 hash，兼容旧配置文件没有 hash 字段的情况
 func loadNotificationConfig() {
-	data, err := os.ReadFile(notificationFile)
+	data, err := storage.Get(notificationFile)
 	if err != nil {
 		notificationConfig = NotificationConfig{Enabled: false, Message: ""}
 		return
@@ -867,7 +1485,7 @@ func saveNotificationConfig() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(notificationFile, data, 0644)
+	return storage.Put(notificationFile, data)
 }
 
 // getNotificationMessage 获取当前通知消息和预算好的 hash（线程安全）
@@ -935,13 +1553,13 @@ func stripNotificationFromText(content string, hashTag string) string {
 
 // shouldInjectNotification 检查是否应该注入通知
 // 用预存的 hash 做对比，不重算 MD5
-// 历史消息中已有通知则跳过（一个 session 只注入一次）
-func shouldInjectNotification(messages []map[string]any) bool {
+// 请求不满足过滤条件（模型/格式/API-KEY）时不注入；历史消息中已有通知则跳过（一个 session 只注入一次）
+func shouldInjectNotification(messages []map[string]any, scope notificationScope) bool {
 	notificationMutex.RLock()
 	cfg := notificationConfig
 	notificationMutex.RUnlock()
 
-	if !cfg.Enabled || cfg.Hash == "" {
+	if !cfg.Enabled || cfg.Hash == "" || !cfg.matches(scope) {
 		return false
 	}
 
@@ -978,8 +1596,11 @@ func handleGetNotification(c *gin.Context) {
 	cfg := notificationConfig
 	notificationMutex.RUnlock()
 	c.JSON(200, gin.H{
-		"enabled": cfg.Enabled,
-		"message": cfg.Message,
+		"enabled":   cfg.Enabled,
+		"message":   cfg.Message,
+		"models":    cfg.Models,
+		"formats":   cfg.Formats,
+		"apiKeyIds": cfg.ApiKeyIds,
 	})
 }
 
@@ -987,17 +1608,29 @@ func handleGetNotification(c *gin.Context) {
 // 保存时预算 hash，运行时只做对比
 func handleUpdateNotification(c *gin.Context) {
 	var req struct {
-		Enabled bool   `json:"enabled"`
-		Message string `json:"message"`
+		Enabled   bool     `json:"enabled"`
+		Message   string   `json:"message"`
+		Models    []string `json:"models"`
+		Formats   []string `json:"formats"`
+		ApiKeyIds []string `json:"apiKeyIds"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	for _, f := range req.Formats {
+		if f != "openai" && f != "claude" {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("formats 只支持 openai、claude，收到 %q", f)})
+			return
+		}
+	}
 
 	notificationMutex.Lock()
 	notificationConfig.Enabled = req.Enabled
 	notificationConfig.Message = req.Message
+	notificationConfig.Models = req.Models
+	notificationConfig.Formats = req.Formats
+	notificationConfig.ApiKeyIds = req.ApiKeyIds
 	// 保存时预算 hash，后续运行时直接用，不重复计算
 	if req.Message != "" {
 		notificationConfig.Hash = notifHash(req.Message)
@@ -1023,6 +1656,9 @@ func rateLimitMiddleware() gin.HandlerFunc {
 		enabled := rateLimitConfig.Enabled
 		limit := rateLimitConfig.RequestsPerMin
 		penalty := rateLimitConfig.PenaltySeconds
+		keyBy := rateLimitConfig.KeyBy
+		mode := rateLimitConfig.Mode
+		burst := rateLimitConfig.Burst
 		rateLimitMutex.RUnlock()
 
 		if !enabled || limit <= 0 {
@@ -1030,22 +1666,25 @@ func rateLimitMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		clientIP := c.ClientIP()
-		now := time.Now().Unix()
+		key := rateLimitKey(c, keyBy)
+		now := time.Now()
 
+		var allowed bool
+		var remaining int
 		requestCountsMutex.Lock()
-		counter, exists := requestCounts[clientIP]
-		if !exists || now >= counter.WindowEnd {
-			// 新窗口
-			requestCounts[clientIP] = &RequestCounter{Count: 1, WindowEnd: now + 60}
-			requestCountsMutex.Unlock()
-			c.Next()
-			return
+		if now.Sub(requestCountsPrunedAt) >= requestCountsPruneInterval {
+			pruneRequestCounts(limit, burst, now)
+			requestCountsPrunedAt = now
+		}
+		if mode == RateLimitModeBucket {
+			allowed, remaining = takeBucketToken(key, limit, burst, now)
+		} else {
+			allowed, remaining = countWindowRequest(key, limit, now)
 		}
+		requestCountsMutex.Unlock()
 
-		counter.Count++
-		if counter.Count > limit {
-			requestCountsMutex.Unlock()
+		c.Header(HeaderXRateLimitRemaining, strconv.Itoa(remaining))
+		if !allowed {
 			// 惩罚延迟
 			if penalty > 0 {
 				time.Sleep(time.Duration(penalty) * time.Second)
@@ -1057,11 +1696,85 @@ func rateLimitMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
-		requestCountsMutex.Unlock()
 		c.Next()
 	}
 }
 
+// countWindowRequest 固定窗口计数：窗口内第 limit+1 个请求起拒绝，返回是否放行和窗口剩余请求数
+// 调用方需持有 requestCountsMutex
+func countWindowRequest(key string, limit int, now time.Time) (bool, int) {
+	ts := now.Unix()
+	counter, exists := requestCounts[key]
+	if !exists || ts >= counter.WindowEnd {
+		// 新窗口
+		requestCounts[key] = &RequestCounter{Count: 1, WindowEnd: ts + 60}
+		return true, limit - 1
+	}
+	counter.Count++
+	return counter.Count <= limit, max(limit-counter.Count, 0)
+}
+
+// takeBucketToken 令牌桶：按 limit/60 个每秒补充令牌，最多 burst 个（<=0 时为 limit），取到令牌才放行
+// 返回是否放行和桶中剩余的完整令牌数；调用方需持有 requestCountsMutex
+func takeBucketToken(key string, limit, burst int, now time.Time) (bool, int) {
+	capacity := float64(burst)
+	if burst <= 0 {
+		capacity = float64(limit)
+	}
+	counter, exists := requestCounts[key]
+	if !exists {
+		counter = &RequestCounter{}
+		requestCounts[key] = counter
+	}
+	if counter.LastRefill.IsZero() {
+		// 新的 key（或刚从 window 模式切换过来）从满桶开始
+		counter.Tokens = capacity
+	} else if elapsed := now.Sub(counter.LastRefill).Seconds(); elapsed > 0 {
+		counter.Tokens = min(capacity, counter.Tokens+elapsed*float64(limit)/60)
+	}
+	counter.LastRefill = now
+
+	if counter.Tokens < 1 {
+		return false, 0
+	}
+	counter.Tokens--
+	return true, int(counter.Tokens)
+}
+
+// pruneRequestCounts 删除已经空闲的计数器：窗口已结束的，或令牌桶已经补满的（与新建计数器等价）
+// 调用方需持有 requestCountsMutex
+func pruneRequestCounts(limit, burst int, now time.Time) {
+	capacity := burst
+	if capacity <= 0 {
+		capacity = limit
+	}
+	refillFull := time.Duration(float64(capacity) * 60 / float64(limit) * float64(time.Second))
+	ts := now.Unix()
+	for key, counter := range requestCounts {
+		if counter.LastRefill.IsZero() {
+			if ts >= counter.WindowEnd {
+				delete(requestCounts, key)
+			}
+		} else if now.Sub(counter.LastRefill) >= refillFull {
+			delete(requestCounts, key)
+		}
+	}
+}
+
+// rateLimitKey 计算限流 key：按 apiKey 限流且请求带了有效 API-KEY 时按 key 标识计数，否则按客户端 IP
+// 限流在 API-KEY 验证之前执行（未通过验证的请求同样要限流），这里自行验证 key
+// 为什么：直接用请求头里的值，攻击者每次换一个随机 key 就能绕过限流，还会让 map 存下任意多的明文串
+func rateLimitKey(c *gin.Context, keyBy string) string {
+	if keyBy == RateLimitKeyByAPIKey {
+		if apiKey := extractAPIKey(c); apiKey != "" {
+			if entry, ok := lookupApiKeyEntry(apiKey); ok {
+				return "key:" + apiKeyID(entry)
+			}
+		}
+	}
+	return "ip:" + c.ClientIP()
+}
+
 // handleGetRateLimit 获取限流配置
 func handleGetRateLimit(c *gin.Context) {
 	rateLimitMutex.RLock()
@@ -1071,20 +1784,42 @@ func handleGetRateLimit(c *gin.Context) {
 		"enabled":        cfg.Enabled,
 		"requestsPerMin": cfg.RequestsPerMin,
 		"penaltySeconds": cfg.PenaltySeconds,
+		"keyBy":          cfg.KeyBy,
+		"mode":           cfg.Mode,
+		"burst":          cfg.Burst,
 	})
 }
 
 // handleUpdateRateLimit 更新限流配置
 func handleUpdateRateLimit(c *gin.Context) {
 	var req struct {
-		Enabled        bool `json:"enabled"`
-		RequestsPerMin int  `json:"requestsPerMin"`
-		PenaltySeconds int  `json:"penaltySeconds"`
+		Enabled        bool   `json:"enabled"`
+		RequestsPerMin int    `json:"requestsPerMin"`
+		PenaltySeconds int    `json:"penaltySeconds"`
+		KeyBy          string `json:"keyBy"`
+		Mode           string `json:"mode"`
+		Burst          int    `json:"burst"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	switch req.KeyBy {
+	case "", RateLimitKeyByIP, RateLimitKeyByAPIKey:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("keyBy 只支持 ip、apiKey，收到 %q", req.KeyBy)})
+		return
+	}
+	switch req.Mode {
+	case "", RateLimitModeWindow, RateLimitModeBucket:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("mode 只支持 window、bucket，收到 %q", req.Mode)})
+		return
+	}
+	if req.Burst < 0 {
+		c.JSON(400, gin.H{"error": "burst 不能为负数"})
+		return
+	}
 
 	rateLimitMutex.Lock()
 	rateLimitConfig.Enabled = req.Enabled
@@ -1094,6 +1829,13 @@ func handleUpdateRateLimit(c *gin.Context) {
 	if req.PenaltySeconds >= 0 {
 		rateLimitConfig.PenaltySeconds = req.PenaltySeconds
 	}
+	if req.KeyBy != "" {
+		rateLimitConfig.KeyBy = req.KeyBy
+	}
+	if req.Mode != "" {
+		rateLimitConfig.Mode = req.Mode
+	}
+	rateLimitConfig.Burst = req.Burst
 	rateLimitMutex.Unlock()
 
 	if err := saveRateLimitConfig(); err != nil {
@@ -1151,6 +1893,21 @@ func handleUpdateLogLevel(c *gin.Context) {
 	})
 }
 
+// extractAPIKey 从请求头提取 API-KEY：先 X-API-Key（Claude 格式），再 Authorization: Bearer（OpenAI 格式）
+func extractAPIKey(c *gin.Context) string {
+	apiKey := c.GetHeader("X-API-Key")
+	if apiKey == "" {
+		apiKey = c.GetHeader("x-api-key")
+	}
+	if apiKey == "" {
+		auth := c.GetHeader("Authorization")
+		if len(auth) > 7 && auth[:7] == "Bearer " {
+			apiKey = auth[7:]
+		}
+	}
+	return apiKey
+}
+
 // apiKeyAuthMiddleware API-KEY 验证中间件
 // 支持两种格式：
 // 1. Claude 格式: X-API-Key: sk-xxx
@@ -1164,19 +1921,7 @@ func apiKeyAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 尝试从 X-API-Key 获取（Claude 格式）
-		apiKey := c.GetHeader("X-API-Key")
-		if apiKey == "" {
-			apiKey = c.GetHeader("x-api-key")
-		}
-
-		// 尝试从 Authorization 获取（OpenAI 格式）
-		if apiKey == "" {
-			auth := c.GetHeader("Authorization")
-			if len(auth) > 7 && auth[:7] == "Bearer " {
-				apiKey = auth[7:]
-			}
-		}
+		apiKey := extractAPIKey(c)
 
 		// 验证 API-KEY
 		if apiKey == "" {
@@ -1193,14 +1938,9 @@ func apiKeyAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// 检查 API-KEY 是否有效
-		valid := false
-		for _, k := range apiKeys {
-			if k == apiKey {
-				valid = true
-				break
-			}
-		}
+		// 检查 API-KEY 是否有效（存储条目可能是明文或哈希格式，key 级策略按存储条目查找）
+		policyKey, valid := lookupApiKeyEntry(apiKey)
+		keyID := apiKeyID(policyKey)
 
 		if !valid {
 			resp := gin.H{"error": map[string]any{
@@ -1216,16 +1956,75 @@ func apiKeyAuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// key 绑定了来源 IP 时，其他地址的请求返回 403
+		if !ipAllowed(c.ClientIP(), apiKeyAllowedIPs(policyKey)) {
+			if logger != nil {
+				logger.Warn(GetMsgID(c), "API-KEY 来源 IP 不在允许列表中", map[string]any{
+					"apiKeyId": keyID,
+					"clientIp": c.ClientIP(),
+				})
+			}
+			c.JSON(403, gin.H{"error": map[string]any{
+				"message": "API key is not allowed from this IP address",
+				"type":    "permission_error",
+			}, "msgId": GetMsgID(c)})
+			c.Abort()
+			return
+		}
+
+		// 当月 token 用量达到配额时拒绝（用量按 key 存储条目的哈希归属，轮换宽限期内的旧 key 计入新 key）
+		if rejectApiKeyOverQuota(c, policyKey) {
+			return
+		}
+
+		c.Set(APIKeyIDKey, keyID)
+		c.Set(APIKeyUsageIDKey, apiKeyUsageID(policyKey))
 		c.Next()
 	}
 }
 
+// lookupApiKeyEntry 查找请求携带的 key 对应的存储条目
+// 轮换后仍在宽限期内的旧 key 同样有效，返回替换它的新 key 条目（按新 key 归属）
+func lookupApiKeyEntry(key string) (string, bool) {
+	if entry, ok := findApiKeyEntry(key); ok {
+		return entry, true
+	}
+	return retiredApiKeyReplacement(key)
+}
+
+// apiKeyID API-KEY 的标识（前 8 位，与管理页面展示的 prefix 一致），不暴露完整 key
+// 哈希格式的条目返回保存时记录的前缀
+func apiKeyID(key string) string {
+	if hashed, ok := parseHashedApiKey(key); ok {
+		return hashed.prefix
+	}
+	if len(key) > 8 {
+		return key[:8]
+	}
+	return key
+}
+
+// getAPIKeyID 获取本次请求通过验证的 API-KEY 标识（未配置 API-KEY 时为空）
+func getAPIKeyID(c *gin.Context) string {
+	id, _ := c.Get(APIKeyIDKey)
+	s, _ := id.(string)
+	return s
+}
+
 // handleGetApiKeys 获取 API-KEY 列表
 func handleGetApiKeys(c *gin.Context) {
 	// 返回脱敏的 API-KEY 列表
 	masked := make([]map[string]string, len(apiKeys))
 	for i, k := range apiKeys {
-		if len(k) > 8 {
+		if hashed, ok := parseHashedApiKey(k); ok {
+			// 哈希格式无法还原完整 key，full 返回存储条目本身（原样提交回来即保持不变）
+			masked[i] = map[string]string{
+				"key":    hashed.prefix + "...",
+				"full":   k,
+				"prefix": hashed.prefix,
+				"hashed": "true",
+			}
+		} else if len(k) > 8 {
 			masked[i] = map[string]string{
 				"key":    k[:4] + "..." + k[len(k)-4:],
 				"full":   k,
@@ -1266,22 +2065,40 @@ func handleUpdateApiKeys(c *gin.Context) {
 		}
 	}
 
-	// 过滤空值
+	// 过滤空值；开启 hashApiKeys 时明文 key 转成哈希格式保存
 	var validKeys []string
+	migrated := make(map[string]string) // 明文 -> 哈希条目，key 级策略随之迁移
 	for _, k := range req.Keys {
-		if k != "" {
-			validKeys = append(validKeys, k)
+		if k == "" {
+			continue
+		}
+		entry, err := storedApiKey(k, apiKeys)
+		if err != nil {
+			c.JSON(500, gin.H{"error": "API-KEY 哈希失败: " + err.Error()})
+			return
+		}
+		if entry != k {
+			migrated[k] = entry
 		}
+		validKeys = append(validKeys, entry)
 	}
 
+	oldKeys := apiKeys
 	apiKeys = validKeys
 	if err := saveApiKeys(); err != nil {
+		apiKeys = oldKeys
 		if logger != nil {
 			RecordErrorFromGin(c, logger, err, "")
 		}
 		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
 		return
 	}
+	for plain, entry := range migrated {
+		renameApiKeyPolicy(plain, entry)
+		renameApiKeyUsage(plain, entry)
+	}
+	// 被删除或替换掉的 key 的策略一并删除
+	pruneApiKeyPolicies(apiKeys)
 
 	// 返回新的 hash
 	newData, _ := json.Marshal(apiKeys)
@@ -1289,7 +2106,7 @@ func handleUpdateApiKeys(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "API-KEY 配置已更新", "count": len(apiKeys), "hash": newHash})
 }
 
-// 登录会话缓存（内存中保存，用于轮询）
+// 登录会话缓存（内存中保存，用于轮询；过期会话由 loginSessionSweeper 定期清理）
 var loginSessions = make(map[string]*kiroclient.LoginSession)
 var sessionMutex sync.RWMutex
 
@@ -1334,9 +2151,14 @@ func main() {
 
 	// 加载 API-KEY 配置
 	loadApiKeys()
+	loadApiKeyPolicies()
+
+	// 加载维护模式配置
+	loadMaintenanceConfig()
 
-	// 加载 IP 黑名单
+	// 加载 IP 黑名单和白名单
 	loadIpBlacklist()
+	loadIpAllowlist()
 
 	// 加载限流配置
 	loadRateLimitConfig()
@@ -1344,17 +2166,36 @@ func main() {
 	// 加载系统通知配置
 	loadNotificationConfig()
 
+	// 加载遥测端点配置
+	loadTelemetryConfig()
+
 	// 加载 Token 统计数据并启动后台写入协程
+	tokenStatsChan = make(chan TokenDelta, tokenStatsQueueSize())
 	loadTokenStats()
 	go tokenStatsWorker()
 
 	// 初始化熔断错误率统计器
 	circuitStats = NewCircuitStats()
+	loadCircuitStats()
+
+	// 加载熔断恢复配置（半开成功阈值、熔断时长）
+	loadCircuitConfig()
+
+	// 加载 SLO 告警配置并启动定期评估
+	loadSLOConfig()
+	go sloWorker(nil)
 
 	// 加载账号统计数据并启动后台写入协程
 	loadAccountStats()
 	go accountStatsWorker()
 
+	// 加载 API-KEY 用量并启动后台写入协程
+	loadApiKeyUsage()
+	go apiKeyUsageWorker()
+
+	// 定期清理放弃登录后残留的过期会话
+	go loginSessionSweeper(loginSessionSweepInterval(), nil)
+
 	// 启动保活机制（后台自动刷新所有账号的 Token）
 	client.Auth.StartKeepAlive()
 	if logger != nil {
@@ -1365,9 +2206,21 @@ func main() {
 
 	r := gin.Default()
 
+	// 可信代理：决定 ClientIP 是否采用 X-Forwarded-For/X-Real-IP（限流和黑名单依赖它）
+	if err := configureTrustedProxies(r); err != nil {
+		if logger != nil {
+			logger.Error("", "可信代理配置无效", map[string]any{"error": err.Error()})
+		}
+		fmt.Fprintln(os.Stderr, "可信代理配置无效:", err)
+		os.Exit(1)
+	}
+
 	// 注册 pprof 路由
 	pprof.Register(r)
 
+	// Prometheus 指标（与 pprof 一样不经过 API-KEY 认证，供内网抓取）
+	r.GET("/metrics", handleMetrics)
+
 	// 注册请求追踪中间件（必须在其他中间件之前）
 	if logger != nil {
 		r.Use(TraceMiddleware(logger))
@@ -1385,8 +2238,9 @@ func main() {
 		c.Next()
 	})
 
-	// IP 黑名单中间件（全局生效）
+	// IP 黑名单、白名单中间件（全局生效，黑名单先执行，同时命中时以黑名单为准）
 	r.Use(ipBlacklistMiddleware())
+	r.Use(ipAllowlistMiddleware())
 
 	// 静态文件服务 - 支持从 server 目录或项目根目录启动
 	staticPath := "./static"
@@ -1412,28 +2266,41 @@ func main() {
 		// 模型映射管理
 		api.GET("/model-mapping", handleGetModelMapping)
 		api.POST("/model-mapping", handleUpdateModelMapping)
+		api.POST("/model-mapping/bootstrap", handleBootstrapModelMapping)
 
 		// 代理配置管理（thinking 模式等）
 		api.GET("/proxy-config", handleGetProxyConfig)
 		api.POST("/proxy-config", handleUpdateProxyConfig)
+		api.GET("/config/effective", handleGetEffectiveConfig)
 
 		// 账号管理（登录流程）
 		api.POST("/auth/start", handleStartLogin)
 		api.GET("/auth/poll/:sessionId", handlePollLogin)
 		api.POST("/auth/import", handleImportAccount)
 		api.GET("/accounts", handleListAccounts)
+		api.POST("/accounts/validate-token", handleValidateToken)
 		api.POST("/accounts/refresh-all", handleRefreshAllAccounts)
 		api.DELETE("/accounts/:id", handleDeleteAccount)
 		api.POST("/accounts/:id/refresh", handleRefreshAccount)
+		api.POST("/accounts/:id/enable", handleEnableAccount)
+		api.POST("/accounts/:id/reserved", handleSetAccountReserved)
+		api.GET("/accounts/:id/weight", handleGetAccountWeight)
+		api.POST("/accounts/:id/weight", handleSetAccountWeight)
 		api.GET("/accounts/:id/detail", handleAccountDetail)
+		api.GET("/accounts/:id/usage", handleAccountUsage)
 
 		// API-KEY 管理
 		api.GET("/settings/api-keys", handleGetApiKeys)
 		api.POST("/settings/api-keys", handleUpdateApiKeys)
+		api.POST("/settings/api-keys/rotate", handleRotateApiKey)
+		api.GET("/settings/api-keys/policies", handleGetApiKeyPolicies)
+		api.POST("/settings/api-keys/policies", handleUpdateApiKeyPolicy)
 
 		// IP 黑名单管理
 		api.GET("/settings/ip-blacklist", handleGetIpBlacklist)
 		api.POST("/settings/ip-blacklist", handleUpdateIpBlacklist)
+		api.GET("/settings/ip-allowlist", handleGetIpAllowlist)
+		api.POST("/settings/ip-allowlist", handleUpdateIpAllowlist)
 
 		// 限流配置
 		api.GET("/settings/rate-limit", handleGetRateLimit)
@@ -1447,16 +2314,53 @@ func main() {
 		api.GET("/notification", handleGetNotification)
 		api.POST("/notification", handleUpdateNotification)
 
+		// 维护模式（开启后 /v1 和 /anthropic 直接返回固定响应）
+		api.GET("/settings/maintenance", handleGetMaintenance)
+		api.POST("/settings/maintenance", handleUpdateMaintenance)
+
+		// 遥测端点配置
+		api.GET("/settings/telemetry", handleGetTelemetryConfig)
+		api.POST("/settings/telemetry", handleUpdateTelemetryConfig)
+		api.GET("/telemetry/events", handleGetTelemetryEvents)
+
 		// Token 统计
 		api.GET("/stats", handleGetStats)
 
 		// 账号统计
 		api.GET("/stats/accounts", handleGetAccountStats)
+		api.GET("/stats/keys", handleGetApiKeyUsage)
+		api.POST("/stats/accounts/prune", handlePruneAccountStats)
+		api.POST("/stats/reset", handleResetStats)
+		api.POST("/admin/flush", handleAdminFlush)
+		api.GET("/stats/token-ratios", handleGetTokenRatios)
+
+		// 自检诊断：依次验证账号、聊天（流式/非流式）、计数和工具列表
+		api.POST("/diagnostics", handleDiagnostics)
+
+		// 进行中的流式请求（查看、手动中止）
+		api.GET("/requests/active", handleListActiveRequests)
+		api.DELETE("/requests/active/:id", handleCancelActiveRequest)
+
+		// 请求重放（需开启 captureRequestBodies）
+		api.GET("/requests/:id", handleGetCapturedRequest)
+		api.POST("/requests/:id/replay", handleReplayRequest)
+
+		// 支持包（需开启 allowCaptureHeader，客户端带 X-Kiro-Capture: true）
+		api.GET("/captures/:id", handleGetSupportCapture)
 
 		// 熔断管理
 		api.GET("/circuit-breaker/status", handleCircuitBreakerStatus)
 		api.POST("/circuit-breaker/trip", handleCircuitBreakerTrip)
 		api.POST("/circuit-breaker/reset", handleCircuitBreakerReset)
+		api.POST("/circuit-breaker/clear-stats", handleCircuitBreakerClearStats)
+		api.POST("/circuit-breaker/half-open", handleCircuitBreakerHalfOpen)
+		api.GET("/circuit-breaker/config", handleGetCircuitConfig)
+		api.POST("/circuit-breaker/config", handleUpdateCircuitConfig)
+
+		// SLO 告警（账号成功率低于阈值时推送 webhook）
+		api.GET("/slo/status", handleSLOStatus)
+		api.GET("/slo/config", handleGetSLOConfig)
+		api.POST("/slo/config", handleUpdateSLOConfig)
 
 		// Chat 接口
 		api.POST("/chat", handleChat)
@@ -1469,22 +2373,23 @@ func main() {
 		api.POST("/tools/call", handleToolsCall)
 	}
 
-	// OpenAI 格式接口（兼容）- 需要 API-KEY 验证 + 限流
-	r.POST("/v1/chat/completions", rateLimitMiddleware(), apiKeyAuthMiddleware(), handleOpenAIChat)
+	// OpenAI 格式接口（兼容）- 需要 API-KEY 验证 + 限流 + 全局并发限制
+	r.POST("/v1/chat/completions", rateLimitMiddleware(), apiKeyAuthMiddleware(), maintenanceMiddleware(), concurrencyLimitMiddleware(), requestCaptureMiddleware(), supportCaptureMiddleware(), requestFingerprintMiddleware(), handleOpenAIChat)
+
+	// Claude 格式接口（兼容）- 需要 API-KEY 验证 + 限流 + 全局并发限制
+	r.POST("/v1/messages", rateLimitMiddleware(), apiKeyAuthMiddleware(), maintenanceMiddleware(), concurrencyLimitMiddleware(), requestCaptureMiddleware(), supportCaptureMiddleware(), requestFingerprintMiddleware(), handleClaudeChat)
 
-	// Claude 格式接口（兼容）- 需要 API-KEY 验证 + 限流
-	r.POST("/v1/messages", rateLimitMiddleware(), apiKeyAuthMiddleware(), handleClaudeChat)
+	// OpenAI 兼容模型列表 - 需要 API-KEY 验证
+	r.GET("/v1/models", apiKeyAuthMiddleware(), handleOpenAIModels)
 
 	// Claude Code token 计数端点（模拟响应）
-	r.POST("/v1/messages/count_tokens", apiKeyAuthMiddleware(), handleCountTokens)
+	r.POST("/v1/messages/count_tokens", apiKeyAuthMiddleware(), maintenanceMiddleware(), handleCountTokens)
 
-	// Claude Code 遥测端点（直接返回 200 OK）
-	r.POST("/api/event_logging/batch", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "ok"})
-	})
+	// Claude Code 遥测端点（默认直接返回 200 OK，可配置记录 payload 和自定义响应）
+	r.POST("/api/event_logging/batch", apiKeyAuthMiddleware(), handleEventLogging)
 
-	// Anthropic 原生格式接口（兼容）- 需要 API-KEY 验证 + 限流
-	r.POST("/anthropic/v1/messages", rateLimitMiddleware(), apiKeyAuthMiddleware(), handleClaudeChat)
+	// Anthropic 原生格式接口（兼容）- 需要 API-KEY 验证 + 限流 + 全局并发限制
+	r.POST("/anthropic/v1/messages", rateLimitMiddleware(), apiKeyAuthMiddleware(), maintenanceMiddleware(), concurrencyLimitMiddleware(), requestCaptureMiddleware(), supportCaptureMiddleware(), requestFingerprintMiddleware(), handleClaudeChat)
 
 	// 从环境变量读取端口，默认 8080
 	port := os.Getenv("PORT")
@@ -1492,18 +2397,38 @@ func main() {
 		port = "8080"
 	}
 
+	// 配置了 TLS_CERT/TLS_KEY 时以 HTTPS 监听；证书无法加载时拒绝启动，避免静默退回明文 HTTP
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		if logger != nil {
+			logger.Error("", "TLS 配置无效", map[string]any{"error": err.Error()})
+		}
+		fmt.Fprintln(os.Stderr, "TLS 配置无效:", err)
+		os.Exit(1)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+	}
+
 	if logger != nil {
-		logger.Info("", "Kiro API Proxy 启动成功", map[string]any{
+		startData := map[string]any{
 			"port":      port,
-			"webUI":     "http://localhost:" + port,
+			"webUI":     scheme + "://localhost:" + port,
 			"openai":    "POST /v1/chat/completions",
+			"models":    "GET /v1/models",
 			"claude":    "POST /v1/messages",
 			"anthropic": "POST /anthropic/v1/messages",
-			"pprof":     "http://localhost:" + port + "/debug/pprof/",
-		})
+			"pprof":     scheme + "://localhost:" + port + "/debug/pprof/",
+			"metrics":   scheme + "://localhost:" + port + "/metrics",
+		}
+		if tlsConfig != nil {
+			startData["tlsMinVersion"] = tlsVersionName(tlsConfig.MinVersion)
+		}
+		logger.Info("", "Kiro API Proxy 启动成功", startData)
 	}
 
-	_ = r.Run(":" + port)
+	runServer(r, ":"+port, tlsConfig)
 }
 
 // handleTokenStatus 获取 Token 状态（从多账号中获取当前账号信息）
@@ -1530,9 +2455,11 @@ func handleTokenStatus(c *gin.Context) {
 
 	// 查找当前账号的 Token
 	var currentToken *kiroclient.KiroAuthToken
+	var profileArn string
 	for _, acc := range config.Accounts {
 		if acc.ID == accountID && acc.Token != nil {
 			currentToken = acc.Token
+			profileArn = acc.ProfileArn
 			break
 		}
 	}
@@ -1558,20 +2485,23 @@ func handleTokenStatus(c *gin.Context) {
 	resp.TokenData = string(tokenBytes)
 	resp.Email = email
 
-	// 获取额度信息
-	usage, err := client.Auth.GetUsageLimits()
+	// 获取额度信息（查询当前展示的账号，失败时回落到该账号的额度缓存）
+	resp.UsageStatus = usageStatusLive
+	usage, err := client.Auth.GetUsageLimitsWithTokenContext(c.Request.Context(), currentToken.AccessToken, currentToken.Region, profileArn)
 	if err != nil {
 		if logger != nil {
 			logger.Warn(GetMsgID(c), "获取额度信息失败", map[string]any{
 				"error": err.Error(),
 			})
 		}
+		resp.UsedCredits, resp.TotalCredits, resp.UsageFreshness = cachedUsageFallback(accountID)
 	} else if len(usage.UsageBreakdownList) > 0 {
 		// 查找 CREDIT 类型的额度
 		for _, item := range usage.UsageBreakdownList {
 			if item.ResourceType == "CREDIT" {
 				resp.UsedCredits = item.CurrentUsageWithPrecision
 				resp.TotalCredits = item.UsageLimitWithPrecision
+				client.Auth.RecordUsageLimits(accountID, usage)
 				break
 			}
 		}
@@ -1619,7 +2549,7 @@ func handleTokenConfig(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "Token 配置成功"})
 }
 
-// handleChat 处理聊天请求
+// handleChat 处理聊天请求（内置 playground 使用，响应附带 usage：非流式在 body 中，流式在 [DONE] 前单独一条）
 func handleChat(c *gin.Context) {
 	var req struct {
 		Messages []kiroclient.ChatMessage `json:"messages"`
@@ -1632,18 +2562,13 @@ func handleChat(c *gin.Context) {
 		return
 	}
 
-	// 应用模型映射（标准化模型ID）
-	if req.Model != "" {
-		req.Model = kiroclient.NormalizeModelID(req.Model, modelMapping)
-	}
-
-	// 验证模型参数（如果提供）
-	if req.Model != "" && !kiroclient.IsValidModel(req.Model) {
-		c.JSON(400, gin.H{
-			"error": fmt.Sprintf("无效的模型 ID: %s", req.Model),
-		})
+	// 未指定模型时使用 DefaultModel，再应用模型映射并校验最终模型 ID（映射目标同样必须是已知模型）
+	model, err := kiroclient.ResolveModelID(defaultModelFor(req.Model), modelMapping)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
+	req.Model = model
 
 	if req.Stream {
 		// 流式响应
@@ -1661,13 +2586,16 @@ func handleChat(c *gin.Context) {
 			return
 		}
 
-		err := client.Chat.ChatStreamWithModel(c.Request.Context(), req.Messages, req.Model, func(content string, done bool) {
+		var output strings.Builder
+		streamDone := false
+		usage, err := client.Chat.ChatStreamWithModelAndUsage(c.Request.Context(), req.Messages, req.Model, baseChatOptions(c), func(content string, done bool) {
 			if done {
-				_, _ = c.Writer.WriteString("data: [DONE]\n\n")
-				flusher.Flush()
+				// [DONE] 等调用返回、拿到 usage 后再发送
+				streamDone = true
 				return
 			}
 
+			output.WriteString(content)
 			data := map[string]string{"content": content}
 			jsonData, _ := json.Marshal(data)
 			_, _ = c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(jsonData)))
@@ -1675,24 +2603,54 @@ func handleChat(c *gin.Context) {
 		})
 
 		if err != nil {
-			_, _ = c.Writer.WriteString(fmt.Sprintf("data: {\"error\": \"%s\"}\n\n", err.Error()))
+			// 错误信息可能带引号、换行（上游错误 body），必须经 json.Marshal 转义
+			errData, _ := json.Marshal(gin.H{"error": err.Error()})
+			_, _ = c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(errData)))
+			flusher.Flush()
+		}
+		if streamDone {
+			usage, estimated := chatUsageOrEstimate(usage, req.Messages, output.String())
+			usageData, _ := json.Marshal(gin.H{"usage": usage, "usageEstimated": estimated})
+			_, _ = c.Writer.WriteString(fmt.Sprintf("data: %s\n\n", string(usageData)))
+			_, _ = c.Writer.WriteString("data: [DONE]\n\n")
 			flusher.Flush()
 		}
 	} else {
 		// 非流式响应
-		response, err := client.Chat.ChatWithModel(c.Request.Context(), req.Messages, req.Model)
+		var output strings.Builder
+		usage, err := client.Chat.ChatStreamWithModelAndUsage(c.Request.Context(), req.Messages, req.Model, baseChatOptions(c), func(content string, done bool) {
+			if !done {
+				output.WriteString(content)
+			}
+		})
 		if err != nil {
 			if logger != nil {
 				RecordErrorFromGin(c, logger, err, "")
 			}
-			c.JSON(500, gin.H{"error": err.Error()})
+			c.JSON(upstreamErrorStatus(err), gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(200, gin.H{"content": response})
+		usage, estimated := chatUsageOrEstimate(usage, req.Messages, output.String())
+		c.JSON(200, gin.H{"content": output.String(), "usage": usage, "usageEstimated": estimated})
 	}
 }
 
+// chatUsageOrEstimate 返回上游的精确 usage；上游没有返回 token 用量时用本地估算的 input/output 兜底（保留 credits）
+// 与 /v1 接口一致，以 InputTokens > 0 判断精确值是否可用；第二个返回值表示 token 数是否为估算值
+func chatUsageOrEstimate(usage *kiroclient.KiroUsage, messages []kiroclient.ChatMessage, output string) (*kiroclient.KiroUsage, bool) {
+	if usage != nil && usage.InputTokens > 0 {
+		return usage, false
+	}
+	estimated := &kiroclient.KiroUsage{}
+	if usage != nil {
+		*estimated = *usage
+	}
+	estimated.InputTokens, _ = estimateInputTokens(messages)
+	estimated.OutputTokens = kiroclient.CountTokens(output)
+	return estimated, true
+}
+
 // handleSearch 处理搜索请求
 func handleSearch(c *gin.Context) {
 	var req SearchRequest
@@ -1776,6 +2734,7 @@ func handleOpenAIChat(c *gin.Context) {
 	// 扫描消息，检测 OneDayAI_Start_Debug 关键字，开启 per-request debug 模式
 	if containsDebugKeyword(req.Messages) {
 		ctx := context.WithValue(c.Request.Context(), kiroclient.DebugModeKey, true)
+		ctx, _ = kiroclient.WithRequestTiming(ctx) // 请求结束时输出【包5】耗时分解
 		c.Request = c.Request.WithContext(ctx)
 	}
 
@@ -1787,26 +2746,68 @@ func handleOpenAIChat(c *gin.Context) {
 		})
 	}
 
-	// 应用模型映射（标准化模型ID）
-	if req.Model != "" {
-		req.Model = kiroclient.NormalizeModelID(req.Model, modelMapping)
+	// 未指定模型时使用 DefaultModel，再应用模型映射并校验最终模型 ID（映射目标同样必须是已知模型）
+	model, err := kiroclient.ResolveModelID(defaultModelFor(req.Model), modelMapping)
+	if err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+	withRequestedModel(c, req.Model)
+	req.Model = model
+
+	// 客户端未传 max_tokens 时使用按格式配置的默认值
+	maxTokens := req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		maxTokens = req.MaxCompletionTokens
+	}
+	withMaxTokens(c, maxTokensFormatOpenAI, maxTokens)
+
+	// 全局禁用的模型直接拒绝（按映射后的模型 ID 判断）
+	if isModelDisabled(req.Model) {
+		errorJSONWithMsgId(c, 403, fmt.Sprintf("模型 %s 已被管理员禁用", req.Model))
+		return
+	}
+
+	// thinking A/B 实验分组（未开启实验时不做任何事），并返回最终生效的 thinking 决策
+	assignThinkingVariant(c)
+	exposeThinkingDecision(c)
+
+	// 会话粘性：同一会话固定使用同一账号（未开启时不做任何事）
+	applyAccountStickiness(c, nil)
+
+	// 固定账号：已认证的请求可用 X-Kiro-Account-Id 指定处理账号（排查单个账号问题）
+	if !applyAccountPin(c) {
+		return
 	}
 
-	// 验证模型参数
-	if req.Model != "" && !kiroclient.IsValidModel(req.Model) {
-		errorJSONWithMsgId(c, 400, fmt.Sprintf("无效的模型 ID: %s", req.Model))
+	// 无法处理的图片：strict 模式直接拒绝，lenient 模式记录告警并在转换时插入文本标记
+	if err := checkImageErrors(GetMsgID(c), req.Messages); err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
 		return
 	}
 
 	// 转换消息格式
 	messages := convertToKiroMessages(req.Messages)
 
+	// 输入 token 硬上限（MaxInputTokens），超出时不调用上游
+	if err := checkInputTokenBudget(messages, nil); err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+
 	// 检查本 session 是否需要注入通知（历史消息中已有则跳过）
 	// 用标准 context.Context 传递，不污染 gin.Context
-	ctx := context.WithValue(c.Request.Context(), ctxKeyInjectNotification, shouldInjectNotification(req.Messages))
+	scope := notificationScope{Model: req.Model, Format: "openai", ApiKeyID: getAPIKeyID(c)}
+	ctx := context.WithValue(c.Request.Context(), ctxKeyInjectNotification, shouldInjectNotification(req.Messages, scope))
+	ctx = context.WithValue(ctx, ctxKeyIncludeUsage, req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
 	c.Request = c.Request.WithContext(ctx)
 
-	if req.Stream {
+	// 请求总时长上限（MaxRequestSeconds），到期后上游请求随 context 一起取消
+	cancel := applyRequestTimeout(c)
+	defer cancel()
+
+	// 不支持 SSE 的客户端可用 ?collect=true 把流式请求聚合成单个 JSON 响应
+	if applyStreamCollect(c, req.Stream) {
 		handleStreamResponse(c, messages, "openai", req.Model)
 	} else {
 		handleNonStreamResponse(c, messages, "openai", req.Model)
@@ -1883,6 +2884,7 @@ func handleClaudeChat(c *gin.Context) {
 	// 扫描消息，检测 OneDayAI_Start_Debug 关键字，开启 per-request debug 模式
 	if containsDebugKeyword(req.Messages) {
 		ctx := context.WithValue(c.Request.Context(), kiroclient.DebugModeKey, true)
+		ctx, _ = kiroclient.WithRequestTiming(ctx) // 请求结束时输出【包5】耗时分解
 		c.Request = c.Request.WithContext(ctx)
 	}
 
@@ -1893,29 +2895,89 @@ func handleClaudeChat(c *gin.Context) {
 		})
 	}
 
-	// 应用模型映射（标准化模型ID）
-	if req.Model != "" {
-		req.Model = kiroclient.NormalizeModelID(req.Model, modelMapping)
+	// 未指定模型时使用 DefaultModel，再应用模型映射并校验最终模型 ID（映射目标同样必须是已知模型）
+	model, err := kiroclient.ResolveModelID(defaultModelFor(req.Model), modelMapping)
+	if err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+	withRequestedModel(c, req.Model)
+	req.Model = model
+
+	// 全局禁用的模型直接拒绝（按映射后的模型 ID 判断）
+	if isModelDisabled(req.Model) {
+		errorJSONWithMsgId(c, 403, fmt.Sprintf("模型 %s 已被管理员禁用", req.Model))
+		return
+	}
+
+	// thinking A/B 实验分组（未开启实验时不做任何事），并返回最终生效的 thinking 决策
+	assignThinkingVariant(c)
+	exposeThinkingDecision(c)
+
+	// 会话粘性：同一会话固定使用同一账号（未开启时不做任何事）
+	applyAccountStickiness(c, req.Metadata)
+
+	// 固定账号：已认证的请求可用 X-Kiro-Account-Id 指定处理账号（排查单个账号问题）
+	if !applyAccountPin(c) {
+		return
+	}
+
+	// 校验工具定义：明显无效的直接 400，不规范的记录警告后继续
+	toolWarnings, err := validateClaudeTools(req.Tools)
+	if err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+	if len(toolWarnings) > 0 && logger != nil {
+		logger.Warn(GetMsgID(c), "工具定义不规范", map[string]any{
+			"warnings": toolWarnings,
+		})
 	}
 
-	// 验证模型参数
-	if req.Model != "" && !kiroclient.IsValidModel(req.Model) {
-		errorJSONWithMsgId(c, 400, fmt.Sprintf("无效的模型 ID: %s", req.Model))
+	// 无法处理的图片：strict 模式直接拒绝，lenient 模式记录告警并在转换时插入文本标记
+	if err := checkImageErrors(GetMsgID(c), req.Messages); err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
 		return
 	}
 
 	// 转换消息格式（支持 system、tools、tool_use、tool_result）
 	messages, tools, toolResults, toolNameMap := convertToKiroMessagesWithSystem(req.Messages, req.System, req.Tools)
 
+	// ?count_only=true：只估算实际上游请求体的 token 数，不调用 Kiro
+	if wantsCountOnly(c) {
+		handleCountOnly(c, messages, tools, toolResults, req.Model)
+		return
+	}
+
+	// 输入 token 硬上限（MaxInputTokens），超出时不调用上游
+	if err := checkInputTokenBudget(messages, tools); err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+
+	// 图片与工具同时出现：按 ImagesWithToolsPolicy 放行、告警或拒绝
+	if err := checkImagesWithTools(c, messages, tools); err != nil {
+		errorJSONWithMsgId(c, 400, err.Error())
+		return
+	}
+
 	// 检查本 session 是否需要注入通知（历史消息中已有则跳过）
 	// 用标准 context.Context 传递，不污染 gin.Context
-	ctx := context.WithValue(c.Request.Context(), ctxKeyInjectNotification, shouldInjectNotification(req.Messages))
+	scope := notificationScope{Model: req.Model, Format: "claude", ApiKeyID: getAPIKeyID(c)}
+	ctx := context.WithValue(c.Request.Context(), ctxKeyInjectNotification, shouldInjectNotification(req.Messages, scope))
 	c.Request = c.Request.WithContext(ctx)
 
-	if req.Stream {
-		handleStreamResponseWithTools(c, messages, tools, toolResults, "claude", req.Model, toolNameMap)
+	// 请求总时长上限（MaxRequestSeconds），到期后上游请求随 context 一起取消
+	cancel := applyRequestTimeout(c)
+	defer cancel()
+
+	opts := buildChatOptions(c, &req)
+	opts.AgentMode = agentModeFor(len(tools) > 0)
+	// 不支持 SSE 的客户端可用 ?collect=true 把流式请求聚合成单个 JSON 响应
+	if applyStreamCollect(c, req.Stream) {
+		handleStreamResponseWithTools(c, messages, tools, toolResults, "claude", req.Model, toolNameMap, opts)
 	} else {
-		handleNonStreamResponseWithTools(c, messages, tools, toolResults, "claude", req.Model, toolNameMap)
+		handleNonStreamResponseWithTools(c, messages, tools, toolResults, "claude", req.Model, toolNameMap, opts)
 	}
 }
 
@@ -1926,6 +2988,8 @@ func convertToKiroMessages(messages []map[string]any) []kiroclient.ChatMessage {
 	// 获取当前通知内容（用于从历史消息中过滤）
 	// 只有通知开启时才需要过滤，关闭时不干预历史消息
 	notifEnabled, _, notifHashTag := getNotificationMessage()
+	// 图片数量上限跨所有消息统计
+	imgLimiter := newImageLimiter()
 
 	for _, msg := range messages {
 		role, _ := msg["role"].(string)
@@ -1964,60 +3028,20 @@ func convertToKiroMessages(messages []map[string]any) []kiroclient.ChatMessage {
 						content += text
 					}
 
-				case "image_url":
-					// OpenAI 格式图片
-					// {"type": "image_url", "image_url": {"url": "data:image/png;base64,..."}}
-					if imgObj, ok := m["image_url"].(map[string]interface{}); ok {
-						if url, ok := imgObj["url"].(string); ok {
-							format, data, ok := kiroclient.ParseDataURL(url)
-							if ok {
-								// jpg 统一为 jpeg
-								if format == "jpg" {
-									format = "jpeg"
-								}
-								images = append(images, kiroclient.ImageBlock{
-									Format: format,
-									Source: kiroclient.ImageSource{Bytes: data},
-								})
-							}
-						}
+				case "image_url", "image":
+					// OpenAI 格式 {"type": "image_url", "image_url": {"url": "data:image/png;base64,..."}}
+					// Claude 格式 {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "..."}}
+					// 无法处理或超出数量上限的图片在原位置插入文本标记（strict 模式已在 handler 中提前拒绝）
+					img, err := imageBlockFromContent(itemType, m)
+					if err != nil {
+						content += imageErrorMarker(err)
+						continue
 					}
-
-				case "image":
-					// Claude 格式图片
-					// {"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "..."}}
-					if source, ok := m["source"].(map[string]interface{}); ok {
-						sourceType, _ := source["type"].(string)
-						if sourceType != "base64" {
-							continue
-						}
-
-						mediaType, _ := source["media_type"].(string)
-						data, _ := source["data"].(string)
-
-						if mediaType == "" || data == "" {
-							continue
-						}
-
-						// 从 media_type 提取格式（image/png -> png）
-						format := ""
-						if len(mediaType) > 6 && mediaType[:6] == "image/" {
-							format = mediaType[6:]
-						}
-						if format == "" {
-							continue
-						}
-
-						// jpg 统一为 jpeg
-						if format == "jpg" {
-							format = "jpeg"
-						}
-
-						images = append(images, kiroclient.ImageBlock{
-							Format: format,
-							Source: kiroclient.ImageSource{Bytes: data},
-						})
+					if !imgLimiter.admit() {
+						content += imageLimitMarker(imgLimiter.max)
+						continue
 					}
+					images = append(images, img)
 				}
 			}
 		}
@@ -2049,6 +3073,8 @@ func convertToKiroMessagesWithSystem(messages []map[string]any, system any, tool
 	// 获取当前通知内容（用于从历史消息中过滤）
 	// 只有通知开启时才需要过滤，关闭时不干预历史消息
 	notifEnabled2, _, notifHashTag2 := getNotificationMessage()
+	// 图片数量上限跨所有消息统计
+	imgLimiter := newImageLimiter()
 
 	for _, msg := range messages {
 		role, _ := msg["role"].(string)
@@ -2086,48 +3112,17 @@ func convertToKiroMessagesWithSystem(messages []map[string]any, system any, tool
 						content += text
 					}
 
-				case "image_url":
-					if imgObj, ok := m["image_url"].(map[string]interface{}); ok {
-						if url, ok := imgObj["url"].(string); ok {
-							format, data, ok := kiroclient.ParseDataURL(url)
-							if ok {
-								if format == "jpg" {
-									format = "jpeg"
-								}
-								images = append(images, kiroclient.ImageBlock{
-									Format: format,
-									Source: kiroclient.ImageSource{Bytes: data},
-								})
-							}
-						}
+				case "image_url", "image":
+					img, err := imageBlockFromContent(itemType, m)
+					if err != nil {
+						content += imageErrorMarker(err)
+						continue
 					}
-
-				case "image":
-					if source, ok := m["source"].(map[string]interface{}); ok {
-						sourceType, _ := source["type"].(string)
-						if sourceType != "base64" {
-							continue
-						}
-						mediaType, _ := source["media_type"].(string)
-						data, _ := source["data"].(string)
-						if mediaType == "" || data == "" {
-							continue
-						}
-						format := ""
-						if len(mediaType) > 6 && mediaType[:6] == "image/" {
-							format = mediaType[6:]
-						}
-						if format == "" {
-							continue
-						}
-						if format == "jpg" {
-							format = "jpeg"
-						}
-						images = append(images, kiroclient.ImageBlock{
-							Format: format,
-							Source: kiroclient.ImageSource{Bytes: data},
-						})
+					if !imgLimiter.admit() {
+						content += imageLimitMarker(imgLimiter.max)
+						continue
 					}
+					images = append(images, img)
 
 				case "tool_result":
 					// Claude 格式的工具结果（在 user 消息中）
@@ -2179,23 +3174,8 @@ func convertToKiroMessagesWithSystem(messages []map[string]any, system any, tool
 		})
 	}
 
-	// 对齐 kiro.rs 方案：system prompt 作为 history 首条 user+assistant 配对注入
-	// 不加任何标记，避免模型在回复中引用标记暴露降级痕迹
 	if systemPrompt != "" {
-		systemPair := []kiroclient.ChatMessage{
-			{Role: "user", Content: systemPrompt},
-			{Role: "assistant", Content: "I will follow these instructions."},
-		}
-		if len(kiroMessages) > 0 {
-			// 有消息时：system 配对插入到 history 最前面
-			kiroMessages = append(systemPair, kiroMessages...)
-		} else {
-			// 无消息时：system 配对 + 一条 Continue 的 user 消息
-			kiroMessages = append(systemPair, kiroclient.ChatMessage{
-				Role:    "user",
-				Content: "Continue",
-			})
-		}
+		kiroMessages = injectSystemPrompt(kiroMessages, systemPrompt)
 	}
 
 	// 关键修复：只返回最后一条 user 消息的 toolResults
@@ -2211,6 +3191,49 @@ func convertToKiroMessagesWithSystem(messages []map[string]any, system any, tool
 	return kiroMessages, kiroTools, lastToolResults, toolNameMap
 }
 
+// injectSystemPrompt 按 SystemInjectionMode 把 system prompt 注入 Kiro 消息
+// 不加任何标记，避免模型在回复中引用标记暴露降级痕迹
+func injectSystemPrompt(kiroMessages []kiroclient.ChatMessage, systemPrompt string) []kiroclient.ChatMessage {
+	// first_user/last_user：拼到对应 user 消息开头；找不到合适的 user 消息时回落到 pair
+	target := -1
+	switch proxyConfig.SystemInjectionMode {
+	case kiroclient.SystemInjectionFirstUser:
+		for i, msg := range kiroMessages {
+			if msg.Role == "user" {
+				target = i
+				break
+			}
+		}
+	case kiroclient.SystemInjectionLastUser:
+		if n := len(kiroMessages); n > 0 && kiroMessages[n-1].Role == "user" {
+			target = n - 1
+		}
+	}
+	if target >= 0 {
+		kiroMessages[target].Content = systemPrompt + "\n\n" + kiroMessages[target].Content
+		return kiroMessages
+	}
+
+	// pair：对齐 kiro.rs 方案，system prompt 作为 history 首条 user+assistant 配对注入
+	ackText := proxyConfig.SystemAckText
+	if ackText == "" {
+		ackText = kiroclient.DefaultSystemAckText
+	}
+	systemPair := []kiroclient.ChatMessage{
+		{Role: "user", Content: systemPrompt},
+		{Role: "assistant", Content: ackText},
+	}
+	if len(kiroMessages) > 0 {
+		// 有消息时：system 配对插入到 history 最前面
+		return append(systemPair, kiroMessages...)
+	}
+	// 无消息时：system 配对 + 一条 Continue 的 user 消息
+	return append(systemPair, kiroclient.ChatMessage{
+		Role:    "user",
+		Content: "Continue",
+	})
+}
+
 // extractSystemPrompt 提取 system prompt
 func extractSystemPrompt(system any) string {
 	if system == nil {
@@ -2247,6 +3270,80 @@ func sanitizeToolName(name string) string {
 	return result
 }
 
+// defaultToolInputSchema 工具未提供 input_schema 时使用的空 object schema
+func defaultToolInputSchema() map[string]any {
+	return map[string]any{"type": "object", "properties": map[string]any{}}
+}
+
+// validateClaudeTools 在转换前校验工具定义
+// 明显无效的定义（非数组、非对象、缺少 name、input_schema 不是对象）和超出 MaxTools/MaxTotalToolSchemaBytes 的请求返回错误，由调用方返回 400；
+// 可以继续处理但不规范的 schema 返回警告
+// 为什么需要：convertClaudeTools 会静默跳过这些工具，导致后续 tool_use 校验变成空操作，问题难以排查
+func validateClaudeTools(tools any) (warnings []string, err error) {
+	if tools == nil {
+		return nil, nil
+	}
+	toolsSlice, ok := tools.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tools 必须是数组")
+	}
+	if limit := proxyConfig.MaxTools; limit > 0 && len(toolsSlice) > limit {
+		return nil, fmt.Errorf("tools 数量 %d 超过上限 %d", len(toolsSlice), limit)
+	}
+	schemaBytes := 0 // 所有 input_schema 序列化后的总字节数（只在配置了上限时统计）
+	for i, t := range toolsSlice {
+		tool, ok := t.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tools[%d] 必须是对象", i)
+		}
+		name, _ := tool["name"].(string)
+		if strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("tools[%d] 缺少 name", i)
+		}
+		if description, _ := tool["description"].(string); len(description) > maxToolDescriptionLength {
+			if proxyConfig.ToolDescriptionOverflow == kiroclient.ToolDescriptionReject {
+				return nil, fmt.Errorf("tools[%d] (%s) 的 description 长度 %d 超过上限 %d", i, name, len(description), maxToolDescriptionLength)
+			}
+			warnings = append(warnings, fmt.Sprintf("%s: description 长度 %d 超过上限 %d，已截断", name, len(description), maxToolDescriptionLength))
+		}
+		raw, exists := tool["input_schema"]
+		if !exists || raw == nil {
+			continue
+		}
+		schema, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("tools[%d] (%s) 的 input_schema 必须是对象", i, name)
+		}
+		if proxyConfig.MaxTotalToolSchemaBytes > 0 {
+			data, _ := json.Marshal(schema)
+			schemaBytes += len(data)
+		}
+		if typ, ok := schema["type"]; ok && typ != "object" {
+			warnings = append(warnings, fmt.Sprintf("%s: input_schema.type 应为 object, 实际为 %v", name, typ))
+		}
+		if props, ok := schema["properties"]; ok {
+			if _, isMap := props.(map[string]interface{}); !isMap {
+				warnings = append(warnings, fmt.Sprintf("%s: input_schema.properties 不是对象", name))
+			}
+		}
+		if req, ok := schema["required"]; ok {
+			if _, isSlice := req.([]interface{}); !isSlice {
+				warnings = append(warnings, fmt.Sprintf("%s: input_schema.required 不是数组，必填字段校验将被跳过", name))
+			}
+		}
+	}
+	if limit := proxyConfig.MaxTotalToolSchemaBytes; limit > 0 && schemaBytes > limit {
+		return nil, fmt.Errorf("tools 的 input_schema 总大小 %d 字节超过上限 %d 字节", schemaBytes, limit)
+	}
+	return warnings, nil
+}
+
+// maxToolDescriptionLength Kiro API 允许的工具描述长度上限（超出部分截断后追加 "..."）
+const maxToolDescriptionLength = 10237
+
+// toolDescriptionTruncations 累计被截断的工具描述数（/api/stats 可见）
+var toolDescriptionTruncations atomic.Int64
+
 // convertClaudeTools 转换 Claude tools 到 Kiro 格式
 // 返回：kiroTools, toolNameMap（sanitized -> original）
 func convertClaudeTools(tools any) ([]kiroclient.KiroToolWrapper, map[string]string) {
@@ -2271,14 +3368,19 @@ func convertClaudeTools(tools any) ([]kiroclient.KiroToolWrapper, map[string]str
 		originalName, _ := tool["name"].(string)
 		description, _ := tool["description"].(string)
 		inputSchema, _ := tool["input_schema"].(map[string]interface{})
+		if inputSchema == nil {
+			// 缺失或为 null 时补一个空 object schema，保证下游 required 校验有明确的定义可依
+			inputSchema = defaultToolInputSchema()
+		}
 
 		if originalName == "" {
 			continue
 		}
 
-		// 截断过长的描述（Kiro API 限制）
-		if len(description) > 10237 {
-			description = description[:10237] + "..."
+		// 截断过长的描述（Kiro API 限制；reject 模式已在 validateClaudeTools 中拒绝）
+		if len(description) > maxToolDescriptionLength {
+			description = description[:maxToolDescriptionLength] + "..."
+			toolDescriptionTruncations.Add(1)
 		}
 
 		// 清理工具名（替换点号为下划线）
@@ -2427,28 +3529,133 @@ func patchMissingFields(input map[string]any, missingFields []string, tools []ki
 	}
 }
 
-// handleStreamResponse 处理流式响应
-// 使用 ChatStreamWithModelAndUsage 获取 Kiro API 返回的精确 token 使用量
-func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, format string, model string) {
-	c.Header("Content-Type", "text/event-stream; charset=utf-8")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
+// ========== tool_use input 增量转发 ==========
 
-	// 在函数入口提前取出通知注入标记，闭包里不再碰 gin.Context
-	shouldInjectNotif, _ := c.Request.Context().Value(ctxKeyInjectNotification).(bool)
+// toolInputStream 跟踪一个正在增量转发 input_json_delta 的 tool_use
+// 为什么要扣留末尾字符：工具调用完成后可能需要补齐缺失字段（patchMissingFields），
+// 扣留最后一个非空白字符（正常情况下就是收尾的 '}'）后，仍能在它前面插入补齐字段，
+// 保证客户端拼接出的 partial_json 始终是一个合法 JSON
+type toolInputStream struct {
+	ToolUseId string
+	sent      string // 已经发给客户端的部分
+	pending   string // 扣留未发的尾部
+}
 
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		err := fmt.Errorf("streaming not supported")
-		if logger != nil {
-			RecordErrorFromGin(c, logger, err, "")
+// push 追加一个片段，返回本次可以安全发出的部分（可能为空）
+func (s *toolInputStream) push(fragment string) string {
+	s.pending += fragment
+	cut := strings.LastIndexFunc(s.pending, func(r rune) bool { return !unicode.IsSpace(r) })
+	if cut <= 0 {
+		return ""
+	}
+	out := s.pending[:cut]
+	s.pending = s.pending[cut:]
+	s.sent += out
+	return out
+}
+
+// finish 根据工具调用的最终结果，计算还需要发出的剩余片段
+// raw 为 Kiro 返回的原始 input 文本，input 为解析（及补齐）后的结果，patchedFields 为补齐的字段
+// 返回 ok=false 表示已发出的片段无法与最终结果对齐（此时返回扣留的尾部，客户端拿到的 JSON 可能不完整）
+func (s *toolInputStream) finish(raw string, input map[string]any, patchedFields []string) (string, bool) {
+	// 还没发过任何片段，直接发完整结果
+	if s.sent == "" {
+		data, _ := json.Marshal(input)
+		return string(data), true
+	}
+
+	if len(patchedFields) == 0 {
+		if strings.HasPrefix(raw, s.sent) {
+			return raw[len(s.sent):], true
+		}
+		return s.pending, false
+	}
+
+	// 需要补齐字段：在原始 JSON 的收尾 '}' 之前插入补齐的字段
+	trimmed := strings.TrimRightFunc(raw, unicode.IsSpace)
+	if !strings.HasSuffix(trimmed, "}") || !strings.HasPrefix(trimmed, s.sent) {
+		return s.pending, false
+	}
+	body := trimmed[:len(trimmed)-1]
+	var sb strings.Builder
+	sb.WriteString(body)
+	sep := ","
+	if strings.HasSuffix(strings.TrimRightFunc(body, unicode.IsSpace), "{") {
+		sep = ""
+	}
+	for _, field := range patchedFields {
+		key, _ := json.Marshal(field)
+		val, _ := json.Marshal(input[field])
+		sb.WriteString(sep)
+		sb.Write(key)
+		sb.WriteString(":")
+		sb.Write(val)
+		sep = ","
+	}
+	sb.WriteString("}")
+	return sb.String()[len(s.sent):], true
+}
+
+// ========== 停止原因 ==========
+
+// Claude stop_reason 取值
+const (
+	stopReasonEndTurn   = "end_turn"
+	stopReasonToolUse   = "tool_use"
+	stopReasonMaxTokens = "max_tokens"
+)
+
+// computeStopReason 计算 Claude 格式的 stop_reason（四个响应处理函数共用）
+// 截断优先于工具调用：有截断的 tool_use 时返回 max_tokens，让客户端知道输出不完整
+// hasTool 必须是真正发出了工具调用，不能用 content block 序号判断（文本块也会递增序号）
+func computeStopReason(hasTool, hasTruncated bool) string {
+	if hasTruncated {
+		return stopReasonMaxTokens
+	}
+	if hasTool {
+		return stopReasonToolUse
+	}
+	return stopReasonEndTurn
+}
+
+// openAIFinishReason 把 Claude stop_reason 转换为 OpenAI finish_reason
+func openAIFinishReason(stopReason string) string {
+	switch stopReason {
+	case stopReasonToolUse:
+		return "tool_calls"
+	case stopReasonMaxTokens:
+		return "length"
+	default:
+		return "stop"
+	}
+}
+
+// handleStreamResponse 处理流式响应
+// 使用 ChatStreamWithModelAndUsage 获取 Kiro API 返回的精确 token 使用量
+func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, format string, model string) {
+	c.Header("Content-Type", "text/event-stream; charset=utf-8")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	// 在函数入口提前取出通知注入标记，闭包里不再碰 gin.Context
+	shouldInjectNotif, _ := c.Request.Context().Value(ctxKeyInjectNotification).(bool)
+	metrics := requestMetricsFrom(c.Request.Context())
+	metrics.setModel(model)
+	// 登记为进行中的流，可通过 /api/requests/active 查看和中止
+	defer registerActiveStream(c, model)()
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		err := fmt.Errorf("streaming not supported")
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
 		}
 		errorJSONWithMsgId(c, 500, "Streaming not supported")
 		return
 	}
 
 	// 本地估算的 inputTokens（用于 message_start 事件，因为此时还没有 API 返回值）
-	estimatedInputTokens := kiroclient.CountMessagesTokens(messages)
+	estimatedInputTokens, imageEstimate := estimateInputTokens(messages)
 	var outputBuilder strings.Builder
 	msgID := generateID("msg")
 	chatcmplID := generateID("chatcmpl")
@@ -2465,9 +3672,10 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 				"type":  "message",
 				"role":  "assistant",
 				"model": model,
-				"usage": map[string]int{
+				"usage": map[string]any{
 					"input_tokens":  estimatedInputTokens,
 					"output_tokens": 0,
+					"service_tier":  claudeServiceTier(),
 				},
 			},
 		}
@@ -2476,6 +3684,31 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 		flusher.Flush()
 	}
 
+	// OpenAI 格式：与官方一致，首个 chunk 只带 role（content 为空），部分严格客户端依赖它识别消息开始
+	if format == "openai" {
+		roleChunk := map[string]any{
+			"id":                 chatcmplID,
+			"object":             "chat.completion.chunk",
+			"created":            time.Now().Unix(),
+			"model":              model,
+			"system_fingerprint": nil,
+			"choices": []map[string]any{
+				{
+					"index": 0,
+					"delta": map[string]any{
+						"role":    "assistant",
+						"content": "",
+					},
+					"logprobs":      nil,
+					"finish_reason": nil,
+				},
+			},
+		}
+		data, _ := json.Marshal(roleChunk)
+		_, _ = fmt.Fprintf(c.Writer, "data: %s\n\n", string(data))
+		flusher.Flush()
+	}
+
 	// Claude 格式的 content block 状态管理
 	// 用于跟踪当前打开的 block 类型，实现 thinking/text block 切换
 	claudeBlockIndex := 0       // 当前 block index
@@ -2525,16 +3758,25 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 
 	// 创建 thinking 文本处理器
 	// 检测普通文本中的 <thinking> 标签并根据配置转换输出格式
-	thinkingProcessor := kiroclient.NewThinkingTextProcessor(proxyConfig.ThinkingOutputFormat, func(text string, isThinking bool) {
+	thinkingFormat := thinkingFormatFor(c.Request.Context()) // 参与 A/B 实验时由分组决定
+	leadingTrimmer := newStreamLeadingTrimmer()              // 开启 TrimResponseWhitespace 时去掉首段空白/BOM
+	// 文本增量先经过合并器（StreamFlushBytes>0 时按字节数/最长等待合并成较大的帧）再输出
+	coalescer := newStreamCoalescerFromConfig(func(text string, isThinking bool) {
 		if text == "" {
 			return
 		}
+		// thinking 内容原样输出，只清理正文开头
+		if !isThinking {
+			if text = leadingTrimmer.trim(text); text == "" {
+				return
+			}
+		}
 
 		outputBuilder.WriteString(text)
 
 		if format == "openai" {
 			// OpenAI SSE 格式
-			if isThinking && proxyConfig.ThinkingOutputFormat == kiroclient.ThinkingFormatReasoningContent {
+			if isThinking && thinkingFormat == kiroclient.ThinkingFormatReasoningContent {
 				chunk := map[string]any{
 					"id":                 chatcmplID,
 					"object":             "chat.completion.chunk",
@@ -2577,7 +3819,7 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 			}
 		} else {
 			// Claude SSE 格式：使用标准 thinking/text content block
-			if isThinking && proxyConfig.ThinkingOutputFormat == kiroclient.ThinkingFormatReasoningContent {
+			if isThinking && thinkingFormat == kiroclient.ThinkingFormatReasoningContent {
 				// 确保 thinking block 已打开
 				claudeEnsureBlock("thinking")
 				chunk := map[string]any{
@@ -2607,12 +3849,36 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 		}
 		flusher.Flush()
 	})
+	thinkingProcessor := kiroclient.NewThinkingTextProcessor(thinkingFormat, coalescer.add)
+
+	// reasoning token 增量推送：OpenAI 需客户端开启 include_usage，Claude 通过流中间的 message_delta
+	var emitReasoning func(int)
+	if format == "claude" || includeUsageFrom(c.Request.Context()) {
+		emitReasoning = func(reasoningTokens int) {
+			defer coalescer.enter()()
+			if format == "openai" {
+				writeOpenAIReasoningUsageChunk(c.Writer, chatcmplID, model, estimatedInputTokens, reasoningTokens)
+			} else {
+				writeClaudeReasoningUsageDelta(c.Writer, reasoningTokens)
+			}
+			flusher.Flush()
+		}
+	}
+	streamCtx, reasoning := watchReasoningUsage(c.Request.Context(), emitReasoning)
+	streamCtx, maxTokens := watchMaxTokens(streamCtx)
 
 	// 使用 ChatStreamWithModelAndUsage 获取精确 usage
-	usage, err := client.Chat.ChatStreamWithModelAndUsage(c.Request.Context(), messages, model, func(content string, done bool) {
+	claudeStreamDone := false // Claude 格式：上游流已正常结束，待发送 message_delta
+	usage, err := client.Chat.ChatStreamWithModelAndUsage(streamCtx, messages, model, baseChatOptions(c), func(content string, done bool) {
+		// 整个回调持有合并器的锁，避免与 maxWait 计时器同时写响应
+		defer coalescer.enter()()
+		if content != "" {
+			metrics.markFirstToken()
+		}
 		if done {
-			// 刷新 thinking 处理器缓冲区（与 handleStreamResponseWithTools 对齐）
+			// 刷新 thinking 处理器和合并器缓冲区（与 handleStreamResponseWithTools 对齐）
 			thinkingProcessor.Flush()
+			coalescer.flush()
 
 			// 使用本地估算值发送 SSE 事件（因为此时 usage 还未返回）
 			estimatedOutputTokens = kiroclient.CountTokens(outputBuilder.String())
@@ -2647,41 +3913,16 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 				} else {
 					// Claude 格式：关闭当前 text block，开一个新的独立 text block 承载通知
 					claudeCloseCurrentBlock()
-					// 开新 block
-					blockStart := map[string]any{
-						"type":          "content_block_start",
-						"index":         claudeBlockIndex,
-						"content_block": map[string]any{"type": "text", "text": ""},
-					}
-					bdata, _ := json.Marshal(blockStart)
-					_, _ = fmt.Fprintf(c.Writer, "event: content_block_start\ndata: %s\n\n", string(bdata))
-					// 发送通知内容
-					noticeDelta := map[string]any{
-						"type":  "content_block_delta",
-						"index": claudeBlockIndex,
-						"delta": map[string]string{
-							"type": "text_delta",
-							"text": noticeText,
-						},
-					}
-					ndata, _ := json.Marshal(noticeDelta)
-					_, _ = fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", string(ndata))
-					// 关闭通知 block
-					blockStop := map[string]any{
-						"type":  "content_block_stop",
-						"index": claudeBlockIndex,
-					}
-					sdata, _ := json.Marshal(blockStop)
-					_, _ = fmt.Fprintf(c.Writer, "event: content_block_stop\ndata: %s\n\n", string(sdata))
+					writeClaudeNotificationBlock(c.Writer, claudeBlockIndex, noticeText)
 					claudeBlockIndex++
-					claudeBlockStarted = false
 					flusher.Flush()
 				}
 			}
 
 			if format == "openai" {
-				// OpenAI 流式结束前发送带 usage 的 chunk（使用估算值）
-				stopReason := "stop"
+				// OpenAI 流式结束前发送带 usage 的 chunk（使用估算值，reasoning tokens 已用上游精确值校正）
+				stopReason := openAIFinishReason(computeStopReason(false, maxTokens.reached))
+				reasoningTokens := reasoning.tokens()
 				finalChunk := map[string]any{
 					"id":                 chatcmplID,
 					"object":             "chat.completion.chunk",
@@ -2698,8 +3939,8 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 					},
 					"usage": map[string]any{
 						"prompt_tokens":     estimatedInputTokens,
-						"completion_tokens": estimatedOutputTokens,
-						"total_tokens":      estimatedInputTokens + estimatedOutputTokens,
+						"completion_tokens": estimatedOutputTokens + reasoningTokens,
+						"total_tokens":      estimatedInputTokens + estimatedOutputTokens + reasoningTokens,
 						"prompt_tokens_details": map[string]int{
 							"cached_tokens": 0,
 							"text_tokens":   estimatedInputTokens,
@@ -2709,7 +3950,7 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 						"completion_tokens_details": map[string]int{
 							"text_tokens":      estimatedOutputTokens,
 							"audio_tokens":     0,
-							"reasoning_tokens": 0,
+							"reasoning_tokens": reasoningTokens,
 						},
 					},
 				}
@@ -2718,28 +3959,9 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 				_, _ = fmt.Fprint(c.Writer, "data: [DONE]\n\n")
 			} else {
 				// Claude 流式结束：关闭当前打开的 content block（可能是 thinking 或 text）
+				// message_delta 等调用返回、拿到精确 usage 后再发送
 				claudeCloseCurrentBlock()
-
-				// 发送 message_delta 事件（使用估算值）
-				msgDelta := map[string]any{
-					"type": "message_delta",
-					"delta": map[string]any{
-						"stop_reason":   "end_turn",
-						"stop_sequence": nil,
-					},
-					"usage": map[string]int{
-						"output_tokens": estimatedOutputTokens,
-					},
-				}
-				data, _ := json.Marshal(msgDelta)
-				_, _ = fmt.Fprintf(c.Writer, "event: message_delta\ndata: %s\n\n", string(data))
-
-				// 发送 message_stop 事件
-				msgStop := map[string]any{
-					"type": "message_stop",
-				}
-				data, _ = json.Marshal(msgStop)
-				_, _ = fmt.Fprintf(c.Writer, "event: message_stop\ndata: %s\n\n", string(data))
+				claudeStreamDone = true
 			}
 			flusher.Flush()
 			return
@@ -2749,11 +3971,28 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 		// 与 handleStreamResponseWithTools 对齐
 		thinkingProcessor.ProcessText(content, false)
 	})
+	coalescer.close()
 
-	if err != nil {
+	if claudeStreamDone {
+		writeClaudeMessageEnd(c.Writer, computeStopReason(false, maxTokens.reached), claudeStreamUsage(usage, estimatedInputTokens, estimatedOutputTokens))
+		flusher.Flush()
+	}
+
+	if err != nil && isClientCancelled(c) {
+		// 客户端中途断开：上游读取已随 context 取消停止，按已消耗的部分 usage 记账，不再向断开的连接写错误帧
+		accountID, email := client.Auth.GetLastSelectedAccountInfo()
+		recordClientCancelled(c, accountID, email)
+		inputTokens, outputTokens := recordCancelledStreamUsage(c, accountID, usage, estimatedInputTokens, outputBuilder.String(), format, model)
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, inputTokens, outputTokens)
+	} else if err != nil {
 		// 客户端错误（超时/格式错误/输入过长）不记为账号失败，不触发降级
+		// 请求总时长超限是代理自身的限制，同样不计入账号失败
+		timedOut := isRequestTimeout(c)
 		accountID, email := client.Auth.GetLastSelectedAccountInfo()
-		if !kiroclient.IsNonCircuitBreakingError(err) {
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, 0, 0)
+		if !timedOut && !kiroclient.IsNonCircuitBreakingError(err) {
 			recordAccountRequest(accountID, email, 500, err.Error())
 		}
 		// 记录流式响应错误（与非流式对齐，记录完整错误上下文）
@@ -2766,7 +4005,20 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 				"accountId": accountID,
 			})
 		}
-		_, _ = fmt.Fprintf(c.Writer, "data: {\"error\": \"%s\"}\n\n", err.Error())
+		// 中途出错时先把已输出的内容收尾：刷新缓冲文本并关闭打开的 block，避免客户端收到悬空的 content_block
+		if !claudeStreamDone {
+			thinkingProcessor.Flush()
+			claudeCloseCurrentBlock()
+		}
+		if timedOut {
+			writeStreamTimeoutError(c, format)
+		} else {
+			writeStreamError(c, format, streamErrorType(err), err.Error())
+			// 上游出错时 Claude 消息仍以 message_delta/message_stop 收尾，usage 按已输出的部分估算
+			if format == "claude" && !claudeStreamDone {
+				writeClaudeMessageEnd(c.Writer, computeStopReason(false, false), claudeStreamUsage(usage, estimatedInputTokens, kiroclient.CountTokens(outputBuilder.String())))
+			}
+		}
 		flusher.Flush()
 	} else {
 		// 记录账号请求成功
@@ -2777,13 +4029,19 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 		// 注意：usage 可能非 nil 但 InputTokens 为 0（Kiro API 未返回有效 usage）
 		inputTokens := estimatedInputTokens
 		outputTokens := estimatedOutputTokens
-		if usage != nil && usage.InputTokens > 0 {
+		recordImageTokenSource(imageEstimate, usage)
+		exactUsage := usage != nil && usage.InputTokens > 0 // 上游返回了有效 usage
+		if exactUsage {
+			recordTokenRatio(model, inputTokens, outputTokens, usage)
 			inputTokens = usage.InputTokens
 			outputTokens = usage.OutputTokens
 		}
 
 		// 累加全局统计（使用精确值）
-		addTokenStats(inputTokens, outputTokens)
+		addTokenStats(inputTokens, outputTokens, exactUsage)
+		recordApiKeyUsage(c, inputTokens, outputTokens)
+		recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+		metrics.setResult(accountID, inputTokens, outputTokens)
 
 		// 【包4】记录返回给客户端的响应内容
 		if logger != nil {
@@ -2798,18 +4056,22 @@ func handleStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, for
 // handleNonStreamResponse 处理非流式响应
 // 使用 ChatStreamWithModelAndUsage 获取 Kiro API 返回的精确 token 使用量
 func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage, format string, model string) {
+	metrics := requestMetricsFrom(c.Request.Context())
+	metrics.setModel(model)
+
 	// 本地估算的 inputTokens（降级使用）
-	estimatedInputTokens := kiroclient.CountMessagesTokens(messages)
+	estimatedInputTokens, imageEstimate := estimateInputTokens(messages)
 
 	// 分离 thinking 和 text 内容（与流式对齐）
 	var responseBuilder strings.Builder
 	var thinkingBuilder strings.Builder
 
-	thinkingProcessor := kiroclient.NewThinkingTextProcessor(proxyConfig.ThinkingOutputFormat, func(text string, isThinking bool) {
+	thinkingFormat := thinkingFormatFor(c.Request.Context()) // 参与 A/B 实验时由分组决定
+	thinkingProcessor := kiroclient.NewThinkingTextProcessor(thinkingFormat, func(text string, isThinking bool) {
 		if text == "" {
 			return
 		}
-		if isThinking && proxyConfig.ThinkingOutputFormat == kiroclient.ThinkingFormatReasoningContent {
+		if isThinking && thinkingFormat == kiroclient.ThinkingFormatReasoningContent {
 			// reasoning_content 格式：thinking 内容单独存储
 			thinkingBuilder.WriteString(text)
 		} else {
@@ -2819,7 +4081,11 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 	})
 
 	// 使用 ChatStreamWithModelAndUsage 获取精确 usage
-	usage, err := client.Chat.ChatStreamWithModelAndUsage(c.Request.Context(), messages, model, func(content string, done bool) {
+	ctx, maxTokens := watchMaxTokens(c.Request.Context())
+	usage, err := client.Chat.ChatStreamWithModelAndUsage(ctx, messages, model, baseChatOptions(c), func(content string, done bool) {
+		if content != "" {
+			metrics.markFirstToken()
+		}
 		if done {
 			thinkingProcessor.Flush()
 			return
@@ -2830,8 +4096,14 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 
 	if err != nil {
 		// 客户端错误（超时/格式错误/输入过长）不记为账号失败，不触发降级
+		// 请求总时长超限是代理自身的限制，同样不计入账号失败
+		timedOut := isRequestTimeout(c)
 		accountID, email := client.Auth.GetLastSelectedAccountInfo()
-		if !kiroclient.IsNonCircuitBreakingError(err) {
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, 0, 0)
+		if isClientCancelled(c) {
+			recordClientCancelled(c, accountID, email)
+		} else if !timedOut && !kiroclient.IsNonCircuitBreakingError(err) {
 			recordAccountRequest(accountID, email, 500, err.Error())
 		}
 		if logger != nil {
@@ -2843,12 +4115,17 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 				"accountId": accountID,
 			})
 		}
-		errorJSONWithMsgId(c, 500, err.Error())
+		if timedOut {
+			errorJSONWithMsgId(c, 504, requestTimeoutMessage())
+			return
+		}
+		errorJSONWithMsgId(c, upstreamErrorStatus(err), err.Error())
 		return
 	}
 
-	response := responseBuilder.String()
+	response := trimResponseText(responseBuilder.String())
 	thinkingContent := thinkingBuilder.String()
+	servedModel := resolveServedModel(c, model, usage)
 
 	// 检查是否需要注入通知（一个 session 只注入一次）
 	shouldInject, _ := c.Request.Context().Value(ctxKeyInjectNotification).(bool)
@@ -2870,7 +4147,10 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 	cacheReadTokens := 0
 	cacheWriteTokens := 0
 	reasoningTokens := 0
-	if usage != nil && usage.InputTokens > 0 {
+	recordImageTokenSource(imageEstimate, usage)
+	exactUsage := usage != nil && usage.InputTokens > 0 // 上游返回了有效 usage
+	if exactUsage {
+		recordTokenRatio(model, inputTokens, outputTokens, usage)
 		inputTokens = usage.InputTokens
 		outputTokens = usage.OutputTokens
 		cacheReadTokens = usage.CacheReadTokens
@@ -2886,6 +4166,7 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 		})
 	}
 
+	stopReason := computeStopReason(false, maxTokens.reached)
 	if format == "openai" {
 		// OpenAI 格式响应：通知拼接到 content 字符串末尾
 		openaiContent := response
@@ -2901,13 +4182,13 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 			ID:                generateID("chatcmpl"),
 			Object:            "chat.completion",
 			Created:           time.Now().Unix(),
-			Model:             model,
+			Model:             servedModel,
 			SystemFingerprint: nil,
 			Choices: []OpenAIChatChoice{
 				{
 					Index:        0,
 					Message:      msg,
-					FinishReason: "stop",
+					FinishReason: openAIFinishReason(stopReason),
 				},
 			},
 			Usage: &kiroclient.OpenAIUsage{
@@ -2944,15 +4225,21 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 							"content":           openaiContent,
 							"reasoning_content": thinkingContent,
 						},
-						"finish_reason": "stop",
+						"finish_reason": openAIFinishReason(stopReason),
 					},
 				},
 				"usage": resp.Usage,
 			}
-			addTokenStats(inputTokens, outputTokens)
+			addTokenStats(inputTokens, outputTokens, exactUsage)
+			recordApiKeyUsage(c, inputTokens, outputTokens)
+			recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+			metrics.setResult(accountID, inputTokens, outputTokens)
 			c.JSON(200, respMap)
 		} else {
-			addTokenStats(inputTokens, outputTokens)
+			addTokenStats(inputTokens, outputTokens, exactUsage)
+			recordApiKeyUsage(c, inputTokens, outputTokens)
+			recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+			metrics.setResult(accountID, inputTokens, outputTokens)
 			c.JSON(200, resp)
 		}
 	} else {
@@ -2980,17 +4267,21 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 			ID:         generateID("msg"),
 			Type:       "message",
 			Role:       "assistant",
-			Model:      model,
-			StopReason: "end_turn",
+			Model:      servedModel,
+			StopReason: stopReason,
 			Content:    contentBlocks,
 			Usage: &kiroclient.ClaudeUsage{
 				InputTokens:              inputTokens,
 				OutputTokens:             outputTokens,
 				CacheCreationInputTokens: cacheWriteTokens,
 				CacheReadInputTokens:     cacheReadTokens,
+				ServiceTier:              claudeServiceTier(),
 			},
 		}
-		addTokenStats(inputTokens, outputTokens)
+		addTokenStats(inputTokens, outputTokens, exactUsage)
+		recordApiKeyUsage(c, inputTokens, outputTokens)
+		recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+		metrics.setResult(accountID, inputTokens, outputTokens)
 		c.JSON(200, resp)
 	}
 }
@@ -2998,10 +4289,15 @@ func handleNonStreamResponse(c *gin.Context, messages []kiroclient.ChatMessage,
 // handleStreamResponseWithTools 处理流式响应（支持工具调用）
 // 使用 ChatStreamWithToolsAndUsage 获取 Kiro API 返回的精确 token 使用量
 // 参考 Kiro-account-manager proxyServer.ts 的 handleOpenAIStream/handleClaudeStream
-func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper, toolResults []kiroclient.KiroToolResult, format string, model string, toolNameMap map[string]string) {
+// opts: 由 buildChatOptions 填充的单次调用选项（thinking 格式、辅助事件开关等）
+func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper, toolResults []kiroclient.KiroToolResult, format string, model string, toolNameMap map[string]string, opts kiroclient.ChatOptions) {
 	c.Header("Content-Type", "text/event-stream; charset=utf-8")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
+	metrics := requestMetricsFrom(c.Request.Context())
+	metrics.setModel(model)
+	// 登记为进行中的流，可通过 /api/requests/active 查看和中止
+	defer registerActiveStream(c, model)()
 
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
@@ -3014,7 +4310,7 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 	}
 
 	// 本地估算的 inputTokens（用于 message_start 事件，因为此时还没有 API 返回值）
-	estimatedInputTokens := kiroclient.CountMessagesTokens(messages)
+	estimatedInputTokens, imageEstimate := estimateInputTokens(messages)
 	var outputBuilder strings.Builder
 	msgID := generateID("msg")
 	contentBlockIndex := 0
@@ -3030,9 +4326,10 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 				"type":  "message",
 				"role":  "assistant",
 				"model": model,
-				"usage": map[string]int{
+				"usage": map[string]any{
 					"input_tokens":  estimatedInputTokens,
 					"output_tokens": 0,
+					"service_tier":  claudeServiceTier(),
 				},
 			},
 		}
@@ -3049,11 +4346,38 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 	claudeBlockType := ""       // 当前打开的 block 类型："thinking" 或 "text" 或 ""（未开）
 	claudeBlockStarted := false // 是否有 block 已开启
 
+	// 正在增量转发 input 的 tool_use（nil 表示没有）
+	var streamingTool *toolInputStream
+
+	// claudeSendInputDelta 发送 tool_use 的 input_json_delta 片段
+	claudeSendInputDelta := func(partialJSON string) {
+		if partialJSON == "" {
+			return
+		}
+		inputDelta := map[string]any{
+			"type":  "content_block_delta",
+			"index": contentBlockIndex,
+			"delta": map[string]any{
+				"type":         "input_json_delta",
+				"partial_json": partialJSON,
+			},
+		}
+		data, _ := json.Marshal(inputDelta)
+		_, _ = fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", string(data))
+	}
+
 	// claudeCloseCurrentBlock 关闭当前打开的 Claude content block
 	claudeCloseCurrentBlock := func() {
 		if !claudeBlockStarted {
 			return
 		}
+		// 增量转发中的 tool_use 没等到完成事件就被关闭（如 input 无法解析被跳过），
+		// 先把扣留的尾部发出去，并按截断处理让 stop_reason 变为 max_tokens
+		if streamingTool != nil {
+			claudeSendInputDelta(streamingTool.pending)
+			streamingTool = nil
+			hasTruncatedToolUse = true
+		}
 		blockStop := map[string]any{
 			"type":  "content_block_stop",
 			"index": contentBlockIndex,
@@ -3092,14 +4416,23 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 
 	// 创建 thinking 文本处理器
 	// 参考 Kiro-account-manager proxyServer.ts 的 processText 函数
-	thinkingProcessor := kiroclient.NewThinkingTextProcessor(proxyConfig.ThinkingOutputFormat, func(text string, isThinking bool) {
+	thinkingFormat := opts.ThinkingFormat
+	leadingTrimmer := newStreamLeadingTrimmer() // 开启 TrimResponseWhitespace 时去掉首段空白/BOM
+	// 文本增量先经过合并器（StreamFlushBytes>0 时按字节数/最长等待合并成较大的帧）再输出
+	coalescer := newStreamCoalescerFromConfig(func(text string, isThinking bool) {
 		if text == "" {
 			return
 		}
+		// thinking 内容原样输出，只清理正文开头
+		if !isThinking {
+			if text = leadingTrimmer.trim(text); text == "" {
+				return
+			}
+		}
 
 		outputBuilder.WriteString(text)
 
-		if isThinking && proxyConfig.ThinkingOutputFormat == kiroclient.ThinkingFormatReasoningContent {
+		if isThinking && thinkingFormat == kiroclient.ThinkingFormatReasoningContent {
 			// thinking 内容：确保 thinking block 已打开
 			claudeEnsureBlock("thinking")
 			chunk := map[string]any{
@@ -3128,12 +4461,33 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 		}
 		flusher.Flush()
 	})
+	thinkingProcessor := kiroclient.NewThinkingTextProcessor(thinkingFormat, coalescer.add)
+
+	// Claude 格式开启 tool_use input 增量回调，大体积工具调用边生成边转发
+	streamCtx := c.Request.Context()
+	if format == "claude" {
+		streamCtx = context.WithValue(streamCtx, kiroclient.ToolInputDeltaKey, true)
+	}
+	// reasoning token 增量推送：推理过程中发送流中间的 message_delta，最终值见结束时的 message_delta
+	streamCtx, _ = watchReasoningUsage(streamCtx, func(reasoningTokens int) {
+		defer coalescer.enter()()
+		writeClaudeReasoningUsageDelta(c.Writer, reasoningTokens)
+		flusher.Flush()
+	})
+	streamCtx, maxTokens := watchMaxTokens(streamCtx)
 
 	// 使用 ChatStreamWithToolsAndUsage 获取精确 usage
-	usage, err := client.Chat.ChatStreamWithToolsAndUsage(c.Request.Context(), messages, model, tools, toolResults, func(content string, toolUse *kiroclient.KiroToolUse, done bool, isThinking bool) {
+	streamDone := false // 上游流已正常结束，待发送 message_delta
+	usage, err := client.Chat.ChatStreamWithToolsAndUsage(streamCtx, messages, model, tools, toolResults, opts, func(content string, toolUse *kiroclient.KiroToolUse, done bool, isThinking bool) {
+		// 整个回调持有合并器的锁，避免与 maxWait 计时器同时写响应
+		defer coalescer.enter()()
+		if content != "" || toolUse != nil {
+			metrics.markFirstToken()
+		}
 		if done {
-			// 刷新 thinking 处理器缓冲区
+			// 刷新 thinking 处理器和合并器缓冲区
 			thinkingProcessor.Flush()
+			coalescer.flush()
 
 			// 使用本地估算值发送 SSE 事件（因为此时 usage 还未返回）
 			estimatedOutputTokens = kiroclient.CountTokens(outputBuilder.String())
@@ -3144,68 +4498,17 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 			enabledNotif, notifMsg, notifHashTag := getNotificationMessage()
 			if shouldInject && enabledNotif && notifMsg != "" {
 				noticeText := formatNotificationBlock(notifMsg, notifHashTag)
-				// 先关闭当前 block（可能是 thinking 或 text）
+				// 先关闭当前 block（可能是 thinking 或 text），再开一个新的独立 text block 承载通知
 				claudeCloseCurrentBlock()
-				// 开一个新的独立 text block 承载通知
-				blockStart := map[string]any{
-					"type":          "content_block_start",
-					"index":         contentBlockIndex,
-					"content_block": map[string]any{"type": "text", "text": ""},
-				}
-				bdata, _ := json.Marshal(blockStart)
-				_, _ = fmt.Fprintf(c.Writer, "event: content_block_start\ndata: %s\n\n", string(bdata))
-				// 发送通知内容
-				noticeDelta := map[string]any{
-					"type":  "content_block_delta",
-					"index": contentBlockIndex,
-					"delta": map[string]string{
-						"type": "text_delta",
-						"text": noticeText,
-					},
-				}
-				ndata, _ := json.Marshal(noticeDelta)
-				_, _ = fmt.Fprintf(c.Writer, "event: content_block_delta\ndata: %s\n\n", string(ndata))
-				// 关闭通知 block
-				blockStop := map[string]any{
-					"type":  "content_block_stop",
-					"index": contentBlockIndex,
-				}
-				sdata, _ := json.Marshal(blockStop)
-				_, _ = fmt.Fprintf(c.Writer, "event: content_block_stop\ndata: %s\n\n", string(sdata))
+				writeClaudeNotificationBlock(c.Writer, contentBlockIndex, noticeText)
 				contentBlockIndex++
 				flusher.Flush()
 			}
 
 			// 关闭当前打开的 content block（可能是 thinking/text）
+			// message_delta 等调用返回、拿到精确 usage 后再发送
 			claudeCloseCurrentBlock()
-
-			// 发送 message_delta 事件
-			// 只有真正有工具调用时才返回 tool_use，而不是根据 contentBlockIndex 判断
-			// contentBlockIndex 在文本块开始时就会递增，不能用来判断是否有工具调用
-			// 如果有截断的 tool_use，返回 max_tokens 让客户端知道输出不完整
-			stopReason := "end_turn"
-			if hasTruncatedToolUse {
-				stopReason = "max_tokens"
-			} else if hasToolUse {
-				stopReason = "tool_use"
-			}
-			msgDelta := map[string]any{
-				"type": "message_delta",
-				"delta": map[string]any{
-					"stop_reason":   stopReason,
-					"stop_sequence": nil,
-				},
-				"usage": map[string]int{
-					"output_tokens": estimatedOutputTokens,
-				},
-			}
-			data, _ := json.Marshal(msgDelta)
-			_, _ = fmt.Fprintf(c.Writer, "event: message_delta\ndata: %s\n\n", string(data))
-
-			// 发送 message_stop 事件
-			msgStop := map[string]any{"type": "message_stop"}
-			data, _ = json.Marshal(msgStop)
-			_, _ = fmt.Fprintf(c.Writer, "event: message_stop\ndata: %s\n\n", string(data))
+			streamDone = true
 
 			flusher.Flush()
 			return
@@ -3216,13 +4519,15 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 			if isThinking {
 				// reasoningContentEvent 的思考内容
 				// 根据 thinkingOutputFormat 配置处理
-				switch proxyConfig.ThinkingOutputFormat {
+				switch thinkingFormat {
 				case kiroclient.ThinkingFormatThinking:
 					// 保持原始 <thinking> 标签
 					thinkingProcessor.Callback("<thinking>"+content+"</thinking>", false)
 				case kiroclient.ThinkingFormatThink:
 					// 转换为 <think> 标签
 					thinkingProcessor.Callback("<think>"+content+"</think>", false)
+				case kiroclient.ThinkingFormatNone:
+					// 丢弃 thinking 内容
 				default:
 					// reasoning_content 格式
 					thinkingProcessor.Callback(content, true)
@@ -3233,8 +4538,89 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 			}
 		}
 
+		// 工具调用前先把合并中的文本发出去，保证文本和 tool_use 的顺序
+		if toolUse != nil {
+			coalescer.flush()
+		}
+
+		// 工具调用 input 增量片段：提前打开 tool_use block，边生成边转发
+		if toolUse != nil && toolUse.IsPartial {
+			if streamingTool == nil || streamingTool.ToolUseId != toolUse.ToolUseId {
+				thinkingProcessor.Flush()
+				claudeCloseCurrentBlock()
+
+				toolName := toolUse.Name
+				if originalName, ok := toolNameMap[toolName]; ok {
+					toolName = originalName
+				}
+				blockStart := map[string]any{
+					"type":  "content_block_start",
+					"index": contentBlockIndex,
+					"content_block": map[string]any{
+						"type":  "tool_use",
+						"id":    toolUse.ToolUseId,
+						"name":  toolName,
+						"input": map[string]any{},
+					},
+				}
+				data, _ := json.Marshal(blockStart)
+				_, _ = fmt.Fprintf(c.Writer, "event: content_block_start\ndata: %s\n\n", string(data))
+				claudeBlockStarted = true
+				claudeBlockType = "tool_use"
+				streamingTool = &toolInputStream{ToolUseId: toolUse.ToolUseId}
+			}
+			claudeSendInputDelta(streamingTool.push(toolUse.PartialInput))
+			flusher.Flush()
+			return
+		}
+
 		// 处理工具调用
 		if toolUse != nil {
+			// 已经增量转发过的 tool_use：补发剩余片段后关闭 block
+			if streamingTool != nil && streamingTool.ToolUseId == toolUse.ToolUseId {
+				stream := streamingTool
+				streamingTool = nil
+				if toolUse.Truncated {
+					// block 已经打开无法撤回，发完剩余内容后按 max_tokens 结束
+					hasTruncatedToolUse = true
+					claudeSendInputDelta(stream.pending)
+					if logger != nil {
+						logger.Warn(GetMsgID(c), "tool_use input 被截断，已转发的部分无法撤回", map[string]any{
+							"toolName":  toolUse.Name,
+							"toolUseId": toolUse.ToolUseId,
+						})
+					}
+				} else {
+					missingFields := validateToolUseInput(toolUse.Name, toolUse.Input, tools)
+					if len(missingFields) > 0 {
+						patchMissingFields(toolUse.Input, missingFields, tools, toolUse.Name)
+						if logger != nil {
+							logger.Warn(GetMsgID(c), "tool_use 缺少必填参数，已补齐 content", map[string]any{
+								"toolName":      toolUse.Name,
+								"toolUseId":     toolUse.ToolUseId,
+								"missingFields": missingFields,
+							})
+						}
+					}
+					rest, aligned := stream.finish(toolUse.RawInput, toolUse.Input, missingFields)
+					claudeSendInputDelta(rest)
+					if aligned {
+						hasToolUse = true
+					} else {
+						hasTruncatedToolUse = true
+						if logger != nil {
+							logger.Warn(GetMsgID(c), "tool_use 增量 input 与最终结果不一致", map[string]any{
+								"toolName":  toolUse.Name,
+								"toolUseId": toolUse.ToolUseId,
+							})
+						}
+					}
+				}
+				claudeCloseCurrentBlock()
+				flusher.Flush()
+				return
+			}
+
 			// 截断的 tool_use 不发送给客户端，标记后让 stop_reason 变为 max_tokens
 			if toolUse.Truncated {
 				hasTruncatedToolUse = true
@@ -3311,10 +4697,27 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 			flusher.Flush()
 		}
 	})
+	coalescer.close()
 
-	if err != nil {
+	if streamDone {
+		writeClaudeMessageEnd(c.Writer, computeStopReason(hasToolUse, hasTruncatedToolUse || maxTokens.reached), claudeStreamUsage(usage, estimatedInputTokens, estimatedOutputTokens))
+		flusher.Flush()
+	}
+
+	if err != nil && isClientCancelled(c) {
+		// 客户端中途断开：上游读取已随 context 取消停止，按已消耗的部分 usage 记账，不再向断开的连接写错误帧
+		accountID, email := client.Auth.GetLastSelectedAccountInfo()
+		recordClientCancelled(c, accountID, email)
+		inputTokens, outputTokens := recordCancelledStreamUsage(c, accountID, usage, estimatedInputTokens, outputBuilder.String(), format, model)
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, inputTokens, outputTokens)
+	} else if err != nil {
+		// 请求总时长超限是代理自身的限制，不计入账号失败
+		timedOut := isRequestTimeout(c)
 		accountID, email := client.Auth.GetLastSelectedAccountInfo()
-		if !kiroclient.IsNonCircuitBreakingError(err) {
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, 0, 0)
+		if !timedOut && !kiroclient.IsNonCircuitBreakingError(err) {
 			recordAccountRequest(accountID, email, 500, err.Error())
 		}
 		// 记录流式响应（带工具）错误（与非流式对齐，记录完整错误上下文）
@@ -3328,7 +4731,20 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 				"accountId":  accountID,
 			})
 		}
-		_, _ = fmt.Fprintf(c.Writer, "data: {\"error\": \"%s\"}\n\n", err.Error())
+		// 中途出错时先把已输出的内容收尾：刷新缓冲文本并关闭打开的 block，避免客户端收到悬空的 content_block
+		if !streamDone {
+			thinkingProcessor.Flush()
+			claudeCloseCurrentBlock()
+		}
+		if timedOut {
+			writeStreamTimeoutError(c, format)
+		} else {
+			writeStreamError(c, format, streamErrorType(err), err.Error())
+			// 上游出错时消息仍以 message_delta/message_stop 收尾，usage 按已输出的部分估算
+			if !streamDone {
+				writeClaudeMessageEnd(c.Writer, computeStopReason(hasToolUse, hasTruncatedToolUse), claudeStreamUsage(usage, estimatedInputTokens, kiroclient.CountTokens(outputBuilder.String())))
+			}
+		}
 		flusher.Flush()
 	} else {
 		accountID, email := client.Auth.GetLastSelectedAccountInfo()
@@ -3337,13 +4753,19 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 		// 使用 Kiro API 返回的精确 usage 值（如果有），否则降级使用本地估算
 		inputTokens := estimatedInputTokens
 		outputTokens := estimatedOutputTokens
-		if usage != nil && usage.InputTokens > 0 {
+		recordImageTokenSource(imageEstimate, usage)
+		exactUsage := usage != nil && usage.InputTokens > 0 // 上游返回了有效 usage
+		if exactUsage {
+			recordTokenRatio(model, inputTokens, outputTokens, usage)
 			inputTokens = usage.InputTokens
 			outputTokens = usage.OutputTokens
 		}
 
 		// 累加全局统计（使用精确值）
-		addTokenStats(inputTokens, outputTokens)
+		addTokenStats(inputTokens, outputTokens, exactUsage)
+		recordApiKeyUsage(c, inputTokens, outputTokens)
+		recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+		metrics.setResult(accountID, inputTokens, outputTokens)
 
 		// 【包4】记录返回给客户端的响应内容
 		if logger != nil {
@@ -3357,20 +4779,25 @@ func handleStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMes
 // handleNonStreamResponseWithTools 处理非流式响应（支持工具调用）
 // 使用 ChatStreamWithToolsAndUsage 获取 Kiro API 返回的精确 token 使用量
 // toolNameMap: 净化后的工具名 -> 原始工具名的映射，用于恢复带点的工具名
-func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper, toolResults []kiroclient.KiroToolResult, format string, model string, toolNameMap map[string]string) {
+// opts: 由 buildChatOptions 填充的单次调用选项（thinking 格式、辅助事件开关等）
+func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.ChatMessage, tools []kiroclient.KiroToolWrapper, toolResults []kiroclient.KiroToolResult, format string, model string, toolNameMap map[string]string, opts kiroclient.ChatOptions) {
+	metrics := requestMetricsFrom(c.Request.Context())
+	metrics.setModel(model)
+
 	// 本地估算的 inputTokens（降级使用）
-	estimatedInputTokens := kiroclient.CountMessagesTokens(messages)
+	estimatedInputTokens, imageEstimate := estimateInputTokens(messages)
 
 	var responseText strings.Builder
 	var thinkingText strings.Builder
 	var toolUses []*kiroclient.KiroToolUse
 
 	// 创建 thinking 文本处理器（与流式对齐，检测普通文本中的 <thinking> 标签）
-	thinkingProcessor := kiroclient.NewThinkingTextProcessor(proxyConfig.ThinkingOutputFormat, func(text string, isThinking bool) {
+	thinkingFormat := opts.ThinkingFormat
+	thinkingProcessor := kiroclient.NewThinkingTextProcessor(thinkingFormat, func(text string, isThinking bool) {
 		if text == "" {
 			return
 		}
-		if isThinking && proxyConfig.ThinkingOutputFormat == kiroclient.ThinkingFormatReasoningContent {
+		if isThinking && thinkingFormat == kiroclient.ThinkingFormatReasoningContent {
 			// reasoning_content 格式：thinking 内容单独存储
 			thinkingText.WriteString(text)
 		} else {
@@ -3380,7 +4807,11 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 	})
 
 	// 使用 ChatStreamWithToolsAndUsage 获取精确 usage
-	usage, err := client.Chat.ChatStreamWithToolsAndUsage(c.Request.Context(), messages, model, tools, toolResults, func(content string, toolUse *kiroclient.KiroToolUse, done bool, isThinking bool) {
+	ctx, maxTokens := watchMaxTokens(c.Request.Context())
+	usage, err := client.Chat.ChatStreamWithToolsAndUsage(ctx, messages, model, tools, toolResults, opts, func(content string, toolUse *kiroclient.KiroToolUse, done bool, isThinking bool) {
+		if content != "" || toolUse != nil {
+			metrics.markFirstToken()
+		}
 		if done {
 			// 刷新 thinking 处理器缓冲区
 			thinkingProcessor.Flush()
@@ -3389,11 +4820,13 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 		if content != "" {
 			if isThinking {
 				// reasoningContentEvent 的思考内容，直接通过 callback 处理
-				switch proxyConfig.ThinkingOutputFormat {
+				switch thinkingFormat {
 				case kiroclient.ThinkingFormatThinking:
 					thinkingProcessor.Callback("<thinking>"+content+"</thinking>", false)
 				case kiroclient.ThinkingFormatThink:
 					thinkingProcessor.Callback("<think>"+content+"</think>", false)
+				case kiroclient.ThinkingFormatNone:
+					// 丢弃 thinking 内容
 				default:
 					// reasoning_content 格式
 					thinkingProcessor.Callback(content, true)
@@ -3409,8 +4842,14 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 	})
 
 	if err != nil {
+		// 请求总时长超限是代理自身的限制，不计入账号失败
+		timedOut := isRequestTimeout(c)
 		accountID, email := client.Auth.GetLastSelectedAccountInfo()
-		if !kiroclient.IsNonCircuitBreakingError(err) {
+		recordThinkingVariant(c.Request.Context(), false, 0, 0)
+		metrics.setResult(accountID, 0, 0)
+		if isClientCancelled(c) {
+			recordClientCancelled(c, accountID, email)
+		} else if !timedOut && !kiroclient.IsNonCircuitBreakingError(err) {
 			recordAccountRequest(accountID, email, 500, err.Error())
 		}
 		if logger != nil {
@@ -3423,17 +4862,26 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 				"accountId":  accountID,
 			})
 		}
-		errorJSONWithMsgId(c, 500, err.Error())
+		if timedOut {
+			errorJSONWithMsgId(c, 504, requestTimeoutMessage())
+			return
+		}
+		errorJSONWithMsgId(c, upstreamErrorStatus(err), err.Error())
 		return
 	}
 
 	accountID, email := client.Auth.GetLastSelectedAccountInfo()
 	recordAccountRequest(accountID, email, 200, "")
 
+	response := trimResponseText(responseText.String())
+
 	// 使用 Kiro API 返回的精确 usage 值（如果有），否则降级使用本地估算
 	inputTokens := estimatedInputTokens
-	outputTokens := kiroclient.CountTokens(responseText.String())
-	if usage != nil && usage.InputTokens > 0 {
+	outputTokens := kiroclient.CountTokens(response)
+	recordImageTokenSource(imageEstimate, usage)
+	exactUsage := usage != nil && usage.InputTokens > 0 // 上游返回了有效 usage
+	if exactUsage {
+		recordTokenRatio(model, inputTokens, outputTokens, usage)
 		inputTokens = usage.InputTokens
 		outputTokens = usage.OutputTokens
 	}
@@ -3463,10 +4911,10 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 	}
 
 	// 添加文本块
-	if responseText.Len() > 0 {
+	if response != "" {
 		contentBlocks = append(contentBlocks, map[string]any{
 			"type": "text",
-			"text": responseText.String(),
+			"text": response,
 		})
 	}
 
@@ -3516,25 +4964,19 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 		})
 	}
 
-	// 确定 stop_reason
-	// 如果有截断的 tool_use，返回 max_tokens 让客户端知道输出不完整
-	stopReason := "end_turn"
-	if hasTruncated {
-		stopReason = "max_tokens"
-	} else if len(toolUses) > 0 {
-		stopReason = "tool_use"
-	}
+	stopReason := computeStopReason(len(toolUses) > 0, hasTruncated || maxTokens.reached)
 
 	resp := map[string]any{
 		"id":          generateID("msg"),
 		"type":        "message",
 		"role":        "assistant",
-		"model":       model,
+		"model":       resolveServedModel(c, model, usage),
 		"stop_reason": stopReason,
 		"content":     contentBlocks,
-		"usage": map[string]int{
+		"usage": map[string]any{
 			"input_tokens":  inputTokens,
 			"output_tokens": outputTokens,
+			"service_tier":  claudeServiceTier(),
 		},
 	}
 
@@ -3547,21 +4989,126 @@ func handleNonStreamResponseWithTools(c *gin.Context, messages []kiroclient.Chat
 	}
 
 	// 累加全局统计（使用精确值）
-	addTokenStats(inputTokens, outputTokens)
+	addTokenStats(inputTokens, outputTokens, exactUsage)
+	recordApiKeyUsage(c, inputTokens, outputTokens)
+	recordThinkingVariant(c.Request.Context(), true, inputTokens, outputTokens)
+	metrics.setResult(accountID, inputTokens, outputTokens)
 	c.JSON(200, resp)
 }
 
-// handleModelsList 获取模型列表
+// defaultModelFor 客户端未指定模型时返回 ProxyConfig.DefaultModel（未配置时仍为空）
+func defaultModelFor(model string) string {
+	if strings.TrimSpace(model) == "" {
+		return proxyConfig.DefaultModel
+	}
+	return model
+}
+
+// isModelDisabled 检查模型是否被 ProxyConfig.DisabledModels 全局禁用
+func isModelDisabled(model string) bool {
+	for _, disabled := range proxyConfig.DisabledModels {
+		if disabled == model {
+			return true
+		}
+	}
+	return false
+}
+
+// baseChatOptions 按全局配置填充 ChatOptions（不含请求级生成参数）
+// 必须在 assignThinkingVariant 之后调用，thinking 格式由实验分组决定
+func baseChatOptions(c *gin.Context) kiroclient.ChatOptions {
+	return kiroclient.ChatOptions{
+		ThinkingFormat:   thinkingFormatFor(c.Request.Context()),
+		ForwardedEvents:  proxyConfig.ForwardedEvents,
+		RetryOnEmpty:     proxyConfig.RetryEmptyResponse,
+		MaxRetries:       proxyConfig.MaxRetries,
+		UpstreamHeaders:  proxyConfig.UpstreamHeaders,
+		AgentMode:        agentModeFor(false),
+		PayloadWarnBytes: proxyConfig.PayloadWarnBytes,
+		MaxTokens:        maxTokensFrom(c.Request.Context()),
+		ModelTimeouts:    proxyConfig.ModelTimeouts,
+	}
+}
+
+// agentModeFor 返回本次请求生效的 agent mode：带工具且配置了 ToolsAgentMode 时用它，否则用全局 AgentMode
+func agentModeFor(hasTools bool) string {
+	if hasTools && strings.TrimSpace(proxyConfig.ToolsAgentMode) != "" {
+		return kiroclient.ResolveAgentMode(proxyConfig.ToolsAgentMode)
+	}
+	return kiroclient.ResolveAgentMode(proxyConfig.AgentMode)
+}
+
+// buildChatOptions 按请求和全局配置填充单次调用的 ChatOptions
+func buildChatOptions(c *gin.Context, req *ClaudeChatRequest) kiroclient.ChatOptions {
+	opts := baseChatOptions(c)
+	// 客户端未传 max_tokens 时使用按格式配置的默认值（/anthropic 路由可单独配置）
+	opts.MaxTokens = defaultMaxTokensFor(maxTokensFormat(c, maxTokensFormatClaude), req.MaxTokens)
+	opts.StopSequences = req.StopSequences
+	opts.Temperature = req.Temperature
+	opts.TopP = req.TopP
+	opts.TopK = req.TopK
+	return opts
+}
+
+// handleModelsList 获取模型列表（不包含全局禁用的模型）
 func handleModelsList(c *gin.Context) {
+	models := make([]kiroclient.Model, 0, len(kiroclient.AvailableModels))
+	for _, m := range kiroclient.AvailableModels {
+		if !isModelDisabled(m.ID) {
+			models = append(models, m)
+		}
+	}
 	c.JSON(200, gin.H{
-		"models": kiroclient.AvailableModels,
+		"models": models,
 	})
 }
 
+// modelsCreatedAt /v1/models 中 created 字段的取值
+// Kiro 不提供模型的发布时间，用代理启动时间代替，同一进程内保持不变
+var modelsCreatedAt = time.Now().Unix()
+
+// handleOpenAIModels OpenAI 兼容的模型列表（GET /v1/models），供 OpenAI SDK、LangChain 等客户端发现模型
+// 除 AvailableModels 外，模型映射的别名也作为可选 id 列出；目标无效或被禁用的别名不列出（请求时同样会被拒绝）
+func handleOpenAIModels(c *gin.Context) {
+	data := make([]map[string]any, 0, len(kiroclient.AvailableModels)+len(modelMapping))
+	seen := make(map[string]bool, cap(data))
+	add := func(id string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		data = append(data, map[string]any{
+			"id":       id,
+			"object":   "model",
+			"created":  modelsCreatedAt,
+			"owned_by": "kiro",
+		})
+	}
+
+	for _, m := range kiroclient.AvailableModels {
+		if !isModelDisabled(m.ID) {
+			add(m.ID)
+		}
+	}
+	// 别名按字母序输出，保证每次返回的顺序一致
+	aliases := make([]string, 0, len(modelMapping))
+	for from, to := range modelMapping {
+		if kiroclient.IsValidModel(to) && !isModelDisabled(to) {
+			aliases = append(aliases, from)
+		}
+	}
+	sort.Strings(aliases)
+	for _, alias := range aliases {
+		add(alias)
+	}
+
+	c.JSON(200, gin.H{"object": "list", "data": data})
+}
+
 // loadModelMapping 从文件加载模型映射配置
 func loadModelMapping() {
 	// 尝试从文件加载
-	data, err := os.ReadFile(modelMappingFile)
+	data, err := storage.Get(modelMappingFile)
 	if err != nil {
 		// 文件不存在或读取失败，使用默认映射
 		modelMapping = make(kiroclient.ModelMapping)
@@ -3582,13 +5129,23 @@ func loadModelMapping() {
 		return
 	}
 
+	// 文件里的无效映射目标不会被发往上游（请求时 ResolveModelID 会拒绝），这里只提示
+	for from, to := range mapping {
+		if !kiroclient.IsValidModel(to) && logger != nil {
+			logger.Warn("", "模型映射目标无效，命中该映射的请求将被拒绝", map[string]any{
+				"from": from,
+				"to":   to,
+			})
+		}
+	}
+
 	modelMapping = mapping
 }
 
 // loadProxyConfig 从文件加载代理配置（thinking 模式等）
 // 参考 Kiro-account-manager proxyServer.ts 的 ProxyConfig
 func loadProxyConfig() {
-	data, err := os.ReadFile(proxyConfigFile)
+	data, err := storage.Get(proxyConfigFile)
 	if err != nil {
 		// 文件不存在，使用默认配置
 		proxyConfig = kiroclient.DefaultProxyConfig
@@ -3610,21 +5167,79 @@ func loadProxyConfig() {
 	}
 
 	proxyConfig = cfg
+	applyAuthFailureThreshold()
 	if logger != nil {
 		logger.Info("", "代理配置已加载", map[string]any{
-			"thinkingOutputFormat": cfg.ThinkingOutputFormat,
-			"autoContinueRounds":   cfg.AutoContinueRounds,
+			"thinkingOutputFormat":         cfg.ThinkingOutputFormat,
+			"autoContinueRounds":           cfg.AutoContinueRounds,
+			"maxRequestSeconds":            cfg.MaxRequestSeconds,
+			"modelTimeouts":                cfg.ModelTimeouts,
+			"thinkingABPercent":            cfg.ThinkingABPercent,
+			"disabledModels":               cfg.DisabledModels,
+			"accountStickiness":            cfg.AccountStickiness,
+			"forwardedEvents":              cfg.ForwardedEvents,
+			"retryEmptyResponse":           cfg.RetryEmptyResponse,
+			"maxRetries":                   cfg.MaxRetries,
+			"trimResponseWhitespace":       cfg.TrimResponseWhitespace,
+			"tokenStatsDirectOnFull":       cfg.TokenStatsDirectOnFull,
+			"defaultModel":                 cfg.DefaultModel,
+			"modelMappingBootstrapUrl":     redactURL(cfg.ModelMappingBootstrapURL),
+			"captureRequestBodies":         cfg.CaptureRequestBodies,
+			"requestFingerprint":           cfg.RequestFingerprint,
+			"allowCaptureHeader":           cfg.AllowCaptureHeader,
+			"accountPinApiKeyIds":          cfg.AccountPinApiKeyIds,
+			"hashApiKeys":                  cfg.HashApiKeys,
+			"imageErrorMode":               cfg.ImageErrorMode,
+			"maxImagesPerRequest":          cfg.MaxImagesPerRequest,
+			"imagesWithToolsPolicy":        cfg.ImagesWithToolsPolicy,
+			"systemInjectionMode":          cfg.SystemInjectionMode,
+			"systemAckText":                cfg.SystemAckText,
+			"toolDescriptionOverflow":      cfg.ToolDescriptionOverflow,
+			"slowRequestMs":                cfg.SlowRequestMs,
+			"payloadWarnBytes":             cfg.PayloadWarnBytes,
+			"imageTokenCost":               cfg.ImageTokenCost,
+			"streamFlushBytes":             cfg.StreamFlushBytes,
+			"streamFlushMaxWaitMs":         cfg.StreamFlushMaxWaitMs,
+			"autoDisableAfterAuthFailures": cfg.AutoDisableAfterAuthFailures,
+			"maxTools":                     cfg.MaxTools,
+			"maxTotalToolSchemaBytes":      cfg.MaxTotalToolSchemaBytes,
+			"maxInputTokens":               cfg.MaxInputTokens,
+			"claudeServiceTier":            cfg.ClaudeServiceTier,
+			"defaultMaxTokens":             cfg.DefaultMaxTokens,
+			"maxConcurrentRequests":        cfg.MaxConcurrentRequests,
+			"maxQueuedRequests":            cfg.MaxQueuedRequests,
+			"upstreamHeaders":              upstreamHeaderNames(cfg.UpstreamHeaders),
+			"agentMode":                    kiroclient.ResolveAgentMode(cfg.AgentMode),
+			"toolsAgentMode":               cfg.ToolsAgentMode,
 		})
 	}
 }
 
+// upstreamHeaderNames 上游请求头的名字（已排序），日志只输出名字
+// 为什么：UpstreamHeaders 常用来携带上游凭证，值写进日志就泄露了
+func upstreamHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// applyAuthFailureThreshold 把自动停用阈值同步到 AuthManager
+func applyAuthFailureThreshold() {
+	if client != nil {
+		client.Auth.SetAuthFailureThreshold(proxyConfig.AutoDisableAfterAuthFailures)
+	}
+}
+
 // saveProxyConfig 保存代理配置到文件
 func saveProxyConfig() error {
 	data, err := json.MarshalIndent(proxyConfig, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(proxyConfigFile, data, 0644)
+	return storage.Put(proxyConfigFile, data)
 }
 
 // handleGetProxyConfig 获取代理配置
@@ -3658,12 +5273,140 @@ func handleUpdateProxyConfig(c *gin.Context) {
 		}
 	}
 
+	if req.Config.MaxRequestSeconds < 0 {
+		c.JSON(400, gin.H{"error": "maxRequestSeconds 不能为负数"})
+		return
+	}
+	for model, seconds := range req.Config.ModelTimeouts {
+		if !kiroclient.IsValidModel(model) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("modelTimeouts 包含未知模型: %s", model)})
+			return
+		}
+		if seconds < 1 || seconds > maxModelTimeoutSeconds {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("modelTimeouts[%s] 必须在 1-%d 秒之间，收到 %d", model, maxModelTimeoutSeconds, seconds)})
+			return
+		}
+	}
+	if req.Config.MaxRetries < 0 || req.Config.MaxRetries > maxUpstreamRetries {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("maxRetries 必须在 0-%d 之间，收到 %d", maxUpstreamRetries, req.Config.MaxRetries)})
+		return
+	}
+	if req.Config.MaxImagesPerRequest < 0 {
+		c.JSON(400, gin.H{"error": "maxImagesPerRequest 不能为负数"})
+		return
+	}
+	if req.Config.SlowRequestMs < 0 {
+		c.JSON(400, gin.H{"error": "slowRequestMs 不能为负数"})
+		return
+	}
+	if req.Config.PayloadWarnBytes < 0 {
+		c.JSON(400, gin.H{"error": "payloadWarnBytes 不能为负数"})
+		return
+	}
+	if cost := req.Config.ImageTokenCost; cost.PixelsPerToken < 0 || cost.BytesPerToken < 0 || cost.MaxTokens < 0 {
+		c.JSON(400, gin.H{"error": "imageTokenCost 的各项不能为负数"})
+		return
+	}
+	if req.Config.StreamFlushBytes < 0 || req.Config.StreamFlushMaxWaitMs < 0 {
+		c.JSON(400, gin.H{"error": "streamFlushBytes/streamFlushMaxWaitMs 不能为负数"})
+		return
+	}
+	if req.Config.MaxTools < 0 || req.Config.MaxTotalToolSchemaBytes < 0 {
+		c.JSON(400, gin.H{"error": "maxTools/maxTotalToolSchemaBytes 不能为负数"})
+		return
+	}
+	for format, n := range req.Config.DefaultMaxTokens {
+		if !isValidMaxTokensFormat(format) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("defaultMaxTokens 不支持的格式: %s（可选 openai、claude、anthropic）", format)})
+			return
+		}
+		if n < 0 {
+			c.JSON(400, gin.H{"error": "defaultMaxTokens 不能为负数"})
+			return
+		}
+	}
+	if req.Config.MaxInputTokens < 0 {
+		c.JSON(400, gin.H{"error": "maxInputTokens 不能为负数"})
+		return
+	}
+	if req.Config.AutoDisableAfterAuthFailures < 0 {
+		c.JSON(400, gin.H{"error": "autoDisableAfterAuthFailures 不能为负数"})
+		return
+	}
+	if req.Config.MaxConcurrentRequests < 0 || req.Config.MaxQueuedRequests < 0 {
+		c.JSON(400, gin.H{"error": "maxConcurrentRequests / maxQueuedRequests 不能为负数"})
+		return
+	}
+	if req.Config.ThinkingABPercent < 0 || req.Config.ThinkingABPercent > 100 {
+		c.JSON(400, gin.H{"error": "thinkingABPercent 必须在 0-100 之间"})
+		return
+	}
+	for _, m := range req.Config.DisabledModels {
+		if !kiroclient.IsValidModel(m) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("disabledModels 包含未知模型: %s", m)})
+			return
+		}
+	}
+
+	if req.Config.DefaultModel != "" {
+		if _, err := kiroclient.ResolveModelID(req.Config.DefaultModel, modelMapping); err != nil {
+			c.JSON(400, gin.H{"error": "defaultModel: " + err.Error()})
+			return
+		}
+	}
+
+	for name := range req.Config.UpstreamHeaders {
+		if strings.TrimSpace(name) == "" || kiroclient.IsProtectedUpstreamHeader(name) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("upstreamHeaders 不允许设置该 header: %q", name)})
+			return
+		}
+	}
+
+	switch req.Config.ImageErrorMode {
+	case "", kiroclient.ImageErrorModeLenient, kiroclient.ImageErrorModeStrict:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("imageErrorMode 只支持 lenient、strict，收到 %q", req.Config.ImageErrorMode)})
+		return
+	}
+
+	switch req.Config.ImagesWithToolsPolicy {
+	case "", kiroclient.ImagesWithToolsAllow, kiroclient.ImagesWithToolsWarn, kiroclient.ImagesWithToolsReject:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("imagesWithToolsPolicy 只支持 allow、warn、reject，收到 %q", req.Config.ImagesWithToolsPolicy)})
+		return
+	}
+	if u := req.Config.ModelMappingBootstrapURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		c.JSON(400, gin.H{"error": "modelMappingBootstrapUrl 必须是 http(s) 地址"})
+		return
+	}
+	switch req.Config.ToolDescriptionOverflow {
+	case "", kiroclient.ToolDescriptionTruncate, kiroclient.ToolDescriptionReject:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("toolDescriptionOverflow 只支持 truncate、reject，收到 %q", req.Config.ToolDescriptionOverflow)})
+		return
+	}
+
+	switch req.Config.SystemInjectionMode {
+	case "", kiroclient.SystemInjectionPair, kiroclient.SystemInjectionFirstUser, kiroclient.SystemInjectionLastUser:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("systemInjectionMode 只支持 pair、first_user、last_user，收到 %q", req.Config.SystemInjectionMode)})
+		return
+	}
+
+	for eventType := range req.Config.ForwardedEvents {
+		if !kiroclient.IsAuxiliaryEventType(eventType) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("forwardedEvents 包含不支持的事件类型: %s", eventType)})
+			return
+		}
+	}
+
 	// 确保 ModelThinkingMode 不为 nil
 	if req.Config.ModelThinkingMode == nil {
 		req.Config.ModelThinkingMode = make(map[string]bool)
 	}
 
 	proxyConfig = req.Config
+	applyAuthFailureThreshold()
 	if err := saveProxyConfig(); err != nil {
 		if logger != nil {
 			RecordErrorFromGin(c, logger, err, "")
@@ -3684,7 +5427,7 @@ func saveModelMapping() error {
 		return err
 	}
 
-	return os.WriteFile(modelMappingFile, data, 0644)
+	return storage.Put(modelMappingFile, data)
 }
 
 // handleGetModelMapping 获取当前模型映射配置
@@ -3720,6 +5463,14 @@ func handleUpdateModelMapping(c *gin.Context) {
 		}
 	}
 
+	// 映射目标必须是已知模型，避免任意字符串经映射写进上游请求
+	for from, to := range req.Mapping {
+		if !kiroclient.IsValidModel(to) {
+			c.JSON(400, gin.H{"error": fmt.Sprintf("映射 %q 的目标 %q 不是有效模型", from, to)})
+			return
+		}
+	}
+
 	// 更新映射
 	modelMapping = req.Mapping
 
@@ -3806,6 +5557,27 @@ func handleImportAccount(c *gin.Context) {
 	})
 }
 
+// handleValidateToken 导入前校验 Token（只解析和探测，不保存账号）
+// probe=true 时额外调用上游确认 Token 可用
+func handleValidateToken(c *gin.Context) {
+	var req struct {
+		TokenJSON     string `json:"tokenJson"`
+		ClientRegJSON string `json:"clientRegJson"`
+		Probe         bool   `json:"probe"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.TokenJSON == "" {
+		c.JSON(400, gin.H{"error": "tokenJson 不能为空"})
+		return
+	}
+
+	c.JSON(200, client.Auth.ValidateImportToken(req.TokenJSON, req.ClientRegJSON, req.Probe))
+}
+
 // handlePollLogin 轮询登录状态
 func handlePollLogin(c *gin.Context) {
 	sessionID := c.Param("sessionId")
@@ -3879,8 +5651,17 @@ type AccountWithUsage struct {
 	SubscriptionName string  `json:"subscriptionName"`
 	TokenExpiresAt   string  `json:"tokenExpiresAt"`
 	TokenMinutesLeft int     `json:"tokenMinutesLeft"`
+	UsageFreshness
 }
 
+// accountListUsageTimeout 账号列表查询全部账号额度的总时长上限，超时的账号回落到额度缓存
+// accountListUsageConcurrency 同时查询额度的账号数
+// 为什么：逐个查询时上游故障会让列表等待 账号数 × 重试退避，面板长时间打不开
+const (
+	accountListUsageTimeout     = 10 * time.Second
+	accountListUsageConcurrency = 8
+)
+
 // handleListAccounts 获取账号列表（含额度信息）
 func handleListAccounts(c *gin.Context) {
 	config, err := client.Auth.LoadAccountsConfig()
@@ -3892,9 +5673,42 @@ func handleListAccounts(c *gin.Context) {
 		return
 	}
 
-	// 为每个账号获取额度信息
+	// 并发查询各账号的额度（使用账号的 Token 和 ProfileArn），全部查询共用一个总时长上限
+	ctx, cancel := context.WithTimeout(c.Request.Context(), accountListUsageTimeout)
+	defer cancel()
+	usages := make([]*kiroclient.UsageLimitsResponse, len(config.Accounts))
+	sem := make(chan struct{}, accountListUsageConcurrency)
+	var wg sync.WaitGroup
+	for i, acc := range config.Accounts {
+		if acc.Token == nil || acc.Token.AccessToken == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, acc kiroclient.AccountInfo) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				return
+			}
+			usage, err := client.Auth.GetUsageLimitsWithTokenContext(ctx, acc.Token.AccessToken, acc.Token.Region, acc.ProfileArn)
+			if err != nil {
+				if logger != nil {
+					logger.Warn(GetMsgID(c), "账号获取额度失败", map[string]any{
+						"accountId": acc.ID,
+						"error":     err.Error(),
+					})
+				}
+				return
+			}
+			usages[i] = usage
+		}(i, acc)
+	}
+	wg.Wait()
+
 	result := make([]AccountWithUsage, 0, len(config.Accounts))
-	for _, acc := range config.Accounts {
+	for i, acc := range config.Accounts {
 		item := AccountWithUsage{AccountInfo: acc}
 
 		// 计算 Token 过期时间
@@ -3910,45 +5724,39 @@ func handleListAccounts(c *gin.Context) {
 			}
 		}
 
-		// 尝试获取该账号的额度（使用账号的 Token 和 ProfileArn）
-		if acc.Token != nil && acc.Token.AccessToken != "" {
-			usage, err := client.Auth.GetUsageLimitsWithToken(acc.Token.AccessToken, acc.Token.Region, acc.ProfileArn)
-			if err != nil {
-				if logger != nil {
-					logger.Warn(GetMsgID(c), "账号获取额度失败", map[string]any{
-						"accountId": acc.ID,
-						"error":     err.Error(),
-					})
-				}
-			} else if len(usage.UsageBreakdownList) > 0 {
-				for _, u := range usage.UsageBreakdownList {
-					if u.ResourceType == "CREDIT" {
-						item.UsedCredits = u.CurrentUsageWithPrecision
-						item.TotalCredits = u.UsageLimitWithPrecision
-						break
-					}
-				}
-				if usage.NextDateReset > 0 {
-					resetTime := time.Unix(int64(usage.NextDateReset), 0)
-					days := int(time.Until(resetTime).Hours() / 24)
-					if days < 0 {
-						days = 0
-					}
-					item.DaysUntilReset = days
-					item.NextResetDate = resetTime.Format("2006-01-02")
-				}
-				subName := usage.SubscriptionInfo.SubscriptionTitle
-				if len(subName) > 5 && subName[:5] == "KIRO " {
-					subName = subName[5:]
-				}
-				item.SubscriptionName = subName
-				// 同时更新 userId 和 email（如果原来为空）
-				if item.UserId == "" && usage.UserInfo.UserId != "" {
-					item.UserId = usage.UserInfo.UserId
+		// 额度查询失败或超时时回落到额度缓存
+		item.UsedCredits, item.TotalCredits, item.UsageFreshness = cachedUsageFallback(acc.ID)
+		if usage := usages[i]; usage != nil && len(usage.UsageBreakdownList) > 0 {
+			item.UsedCredits, item.TotalCredits = 0, 0
+			item.UsageFreshness = UsageFreshness{UsageStatus: usageStatusLive}
+			for _, u := range usage.UsageBreakdownList {
+				if u.ResourceType == "CREDIT" {
+					item.UsedCredits = u.CurrentUsageWithPrecision
+					item.TotalCredits = u.UsageLimitWithPrecision
+					client.Auth.RecordUsageLimits(acc.ID, usage)
+					break
 				}
-				if item.Email == "" && usage.UserInfo.Email != "" {
-					item.Email = usage.UserInfo.Email
+			}
+			if usage.NextDateReset > 0 {
+				resetTime := time.Unix(int64(usage.NextDateReset), 0)
+				days := int(time.Until(resetTime).Hours() / 24)
+				if days < 0 {
+					days = 0
 				}
+				item.DaysUntilReset = days
+				item.NextResetDate = resetTime.Format("2006-01-02")
+			}
+			subName := usage.SubscriptionInfo.SubscriptionTitle
+			if len(subName) > 5 && subName[:5] == "KIRO " {
+				subName = subName[5:]
+			}
+			item.SubscriptionName = subName
+			// 同时更新 userId 和 email（如果原来为空）
+			if item.UserId == "" && usage.UserInfo.UserId != "" {
+				item.UserId = usage.UserInfo.UserId
+			}
+			if item.Email == "" && usage.UserInfo.Email != "" {
+				item.Email = usage.UserInfo.Email
 			}
 		}
 		result = append(result, item)
@@ -3971,6 +5779,9 @@ func handleDeleteAccount(c *gin.Context) {
 		return
 	}
 
+	// 同步清理该账号的统计，避免残留在面板里
+	removeAccountStats(accountID)
+
 	c.JSON(200, gin.H{"message": "账号已删除"})
 }
 
@@ -3998,6 +5809,97 @@ func handleRefreshAccount(c *gin.Context) {
 	c.JSON(200, gin.H{"message": "Token 已刷新"})
 }
 
+// handleEnableAccount 重新启用因连续认证失败被自动停用的账号
+func handleEnableAccount(c *gin.Context) {
+	accountID := c.Param("id")
+
+	if err := client.Auth.EnableAccount(accountID); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, accountID)
+		}
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "账号已重新启用", map[string]any{
+			"accountId": accountID,
+		})
+	}
+	c.JSON(200, gin.H{"message": "账号已启用"})
+}
+
+// handleSetAccountReserved 设置账号是否预留给自检诊断（预留账号不承接正常请求）
+func handleSetAccountReserved(c *gin.Context) {
+	accountID := c.Param("id")
+	var req struct {
+		Reserved bool `json:"reserved"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := client.Auth.SetAccountReserved(accountID, req.Reserved); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, accountID)
+		}
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "账号预留状态已更新", map[string]any{
+			"accountId": accountID,
+			"reserved":  req.Reserved,
+		})
+	}
+	c.JSON(200, gin.H{"message": "账号预留状态已更新", "reserved": req.Reserved})
+}
+
+// handleGetAccountWeight 查看账号的调度权重
+func handleGetAccountWeight(c *gin.Context) {
+	accountID := c.Param("id")
+	weight, err := client.Auth.GetAccountWeight(accountID)
+	if err != nil {
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, gin.H{"accountId": accountID, "weight": weight})
+}
+
+// handleSetAccountWeight 设置账号的调度权重（持久化到账号配置文件）
+func handleSetAccountWeight(c *gin.Context) {
+	accountID := c.Param("id")
+	var req struct {
+		Weight int `json:"weight"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Weight < 1 || req.Weight > kiroclient.MaxAccountWeight {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("weight 必须在 1-%d 之间，收到 %d", kiroclient.MaxAccountWeight, req.Weight)})
+		return
+	}
+
+	if err := client.Auth.SetAccountWeight(accountID, req.Weight); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, accountID)
+		}
+		c.JSON(404, gin.H{"error": err.Error()})
+		return
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "账号调度权重已更新", map[string]any{
+			"accountId": accountID,
+			"weight":    req.Weight,
+		})
+	}
+	c.JSON(200, gin.H{"message": "账号调度权重已更新", "accountId": accountID, "weight": req.Weight})
+}
+
 // handleRefreshAllAccounts 刷新所有账号的 Token
 func handleRefreshAllAccounts(c *gin.Context) {
 	client.Auth.RefreshAllAccounts()
@@ -4028,6 +5930,7 @@ type AccountDetailResponse struct {
 	TotalCredits   float64 `json:"totalCredits"`
 	DaysUntilReset int     `json:"daysUntilReset"`
 	NextResetDate  string  `json:"nextResetDate"`
+	UsageFreshness
 
 	// 额度明细（主配额、免费试用、奖励）
 	MainQuota  QuotaDetail `json:"mainQuota"`
@@ -4044,6 +5947,33 @@ type QuotaDetail struct {
 	Total float64 `json:"total"`
 }
 
+// 额度数据来源
+const (
+	usageStatusLive    = "live"    // 实时查询
+	usageStatusCached  = "cached"  // 实时查询失败，使用上次成功查询的缓存
+	usageStatusUnknown = "unknown" // 没有任何可用数据，额度显示为 0 不代表已耗尽
+)
+
+// UsageFreshness 额度数据的来源和新鲜度，用来区分"未知"和"0 额度"
+type UsageFreshness struct {
+	UsageStatus    string `json:"usageStatus"`
+	UsageStale     bool   `json:"usageStale"`               // 额度来自缓存，可能已过时
+	UsageUpdatedAt string `json:"usageUpdatedAt,omitempty"` // 缓存的更新时间（RFC3339）
+}
+
+// cachedUsageFallback 实时查询失败时返回账号缓存的额度；没有缓存时标记为 unknown
+func cachedUsageFallback(accountID string) (used, total float64, freshness UsageFreshness) {
+	cache, ok := client.Auth.GetCachedUsage(accountID)
+	if !ok {
+		return 0, 0, UsageFreshness{UsageStatus: usageStatusUnknown}
+	}
+	return cache.UsedCredits, cache.TotalCredits, UsageFreshness{
+		UsageStatus:    usageStatusCached,
+		UsageStale:     true,
+		UsageUpdatedAt: cache.LastUpdated.Format(time.RFC3339),
+	}
+}
+
 // handleAccountDetail 获取账号详情
 func handleAccountDetail(c *gin.Context) {
 	accountID := c.Param("id")
@@ -4095,9 +6025,17 @@ func handleAccountDetail(c *gin.Context) {
 			resp.MinutesLeft = minLeft
 		}
 
-		// 获取额度信息
-		usage, err := client.Auth.GetUsageLimitsWithToken(account.Token.AccessToken, account.Token.Region, account.ProfileArn)
-		if err == nil && usage != nil {
+		// 获取额度信息，失败时回落到额度缓存
+		usage, err := client.Auth.GetUsageLimitsWithTokenContext(c.Request.Context(), account.Token.AccessToken, account.Token.Region, account.ProfileArn)
+		if err != nil {
+			if logger != nil {
+				logger.Warn(GetMsgID(c), "账号获取额度失败", map[string]any{
+					"accountId": account.ID,
+					"error":     err.Error(),
+				})
+			}
+		} else if usage != nil {
+			resp.UsageStatus = usageStatusLive
 			// 订阅信息
 			subName := usage.SubscriptionInfo.SubscriptionTitle
 			if len(subName) > 5 && subName[:5] == "KIRO " {
@@ -4116,6 +6054,7 @@ func handleAccountDetail(c *gin.Context) {
 						Used:  u.CurrentUsageWithPrecision,
 						Total: u.UsageLimitWithPrecision,
 					}
+					client.Auth.RecordUsageLimits(account.ID, usage)
 				}
 			}
 
@@ -4140,6 +6079,12 @@ func handleAccountDetail(c *gin.Context) {
 		}
 	}
 
+	// 没有实时额度（无 Token 或查询失败）时展示缓存值，并标明来源
+	if resp.UsageStatus != usageStatusLive {
+		resp.UsedCredits, resp.TotalCredits, resp.UsageFreshness = cachedUsageFallback(account.ID)
+		resp.MainQuota = QuotaDetail{Used: resp.UsedCredits, Total: resp.TotalCredits}
+	}
+
 	// 获取可用模型
 	resp.Models = kiroclient.AvailableModels
 
@@ -2,14 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	kiroclient "github.com/jinfeijie/kiro-api-client-go"
 )
@@ -19,6 +33,18 @@ func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// TestMain 把机器 ID 持久化文件指向临时目录（每个 NewKiroClient 都会生成并落盘机器 ID）
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kiro-server-test-")
+	if err != nil {
+		panic(err)
+	}
+	_ = os.Setenv(kiroclient.MachineIDFileEnv, filepath.Join(dir, "kiro-machine-id"))
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 // TestHandleModelsList 测试模型列表接口
 func TestHandleModelsList(t *testing.T) {
 	// 初始化客户端
@@ -362,6 +388,8 @@ func setupCircuitBreakerTestRouter(accountIDs ...string) *gin.Engine {
 	api.GET("/circuit-breaker/status", handleCircuitBreakerStatus)
 	api.POST("/circuit-breaker/trip", handleCircuitBreakerTrip)
 	api.POST("/circuit-breaker/reset", handleCircuitBreakerReset)
+	api.POST("/circuit-breaker/clear-stats", handleCircuitBreakerClearStats)
+	api.POST("/circuit-breaker/half-open", handleCircuitBreakerHalfOpen)
 	return router
 }
 
@@ -421,6 +449,124 @@ func TestCircuitBreakerReset_NotFound(t *testing.T) {
 	}
 }
 
+// TestCircuitBreakerClearStats 只清除错误率统计，熔断器状态保持不变
+func TestCircuitBreakerClearStats(t *testing.T) {
+	router := setupCircuitBreakerTestRouter("acc-1")
+	if err := client.Auth.ManualTrip("acc-1"); err != nil {
+		t.Fatalf("手动熔断失败: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		circuitStats.Record("acc-1", false)
+	}
+
+	clearStats := func(accountID string) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(map[string]string{"accountId": accountID})
+		req, _ := http.NewRequest("POST", "/api/circuit-breaker/clear-stats", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := clearStats("acc-1")
+	if w.Code != 200 {
+		t.Fatalf("期望状态码 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["accountId"] != "acc-1" {
+		t.Errorf("响应应返回被清除的账号, 得到 %v", resp["accountId"])
+	}
+
+	if _, total := circuitStats.GetErrorRate("acc-1", 5); total != 0 {
+		t.Errorf("统计应被清除, 仍有 %d 个请求", total)
+	}
+	if state := client.Auth.GetCircuitBreakerStates()["acc-1"].State; state != kiroclient.CircuitOpen {
+		t.Errorf("熔断器状态不应改变, 得到 %v", state)
+	}
+
+	if w := clearStats("non-existent-account"); w.Code != 404 {
+		t.Errorf("不存在的账号期望 404, 得到 %d", w.Code)
+	}
+}
+
+// TestCircuitBreakerHalfOpen 测试手动半开：Open→HalfOpen，且不清除错误率统计
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	router := setupCircuitBreakerTestRouter("acc-1", "acc-2")
+	if err := client.Auth.ManualTrip("acc-1"); err != nil {
+		t.Fatalf("手动熔断失败: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		circuitStats.Record("acc-1", false)
+	}
+
+	halfOpen := func(accountID string) *httptest.ResponseRecorder {
+		reqBody, _ := json.Marshal(map[string]string{"accountId": accountID})
+		req, _ := http.NewRequest("POST", "/api/circuit-breaker/half-open", bytes.NewReader(reqBody))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := halfOpen("acc-1")
+	if w.Code != 200 {
+		t.Fatalf("期望状态码 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	var resp map[string]interface{}
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["state"] != "half_open" {
+		t.Errorf("期望返回 half_open, 得到 %v", resp["state"])
+	}
+	if state := client.Auth.GetCircuitBreakerStates()["acc-1"].State; state != kiroclient.CircuitHalfOpen {
+		t.Errorf("熔断器应进入半开, 得到 %v", state)
+	}
+	if _, total := circuitStats.GetErrorRate("acc-1", 5); total != 5 {
+		t.Errorf("半开不应清除统计, 剩余 %d 个请求", total)
+	}
+
+	// 未熔断的账号返回 409，状态不变
+	if w := halfOpen("acc-2"); w.Code != 409 {
+		t.Errorf("未熔断账号期望 409, 得到 %d", w.Code)
+	}
+	if w := halfOpen("non-existent-account"); w.Code != 404 {
+		t.Errorf("不存在的账号期望 404, 得到 %d", w.Code)
+	}
+}
+
+// TestCircuitBreakerHalfOpen_ProbeReleasedOnNonCircuitErrors 半开账号的试探请求以 400 等不计入熔断的结果结束时也释放名额
+func TestCircuitBreakerHalfOpen_ProbeReleasedOnNonCircuitErrors(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte(`{"message":"Improperly formed request."}`))
+	})
+	defer cleanup()
+	if err := client.Auth.ManualTrip("mock-account"); err != nil {
+		t.Fatalf("手动熔断失败: %v", err)
+	}
+	if _, err := client.Auth.ManualHalfOpen("mock-account"); err != nil {
+		t.Fatalf("进入半开失败: %v", err)
+	}
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	// 默认只有 1 个试探名额：名额不释放的话第二个请求会因为没有可用账号失败，而不是再次打到上游
+	for i := 0; i < 2; i++ {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if !strings.Contains(w.Body.String(), "Improperly formed") {
+			t.Fatalf("第 %d 个请求应由半开账号处理并返回上游 400, 得到 %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+	state := client.Auth.GetCircuitBreakerStates()["mock-account"]
+	if state.State != kiroclient.CircuitHalfOpen || state.ProbesInFlight != 0 {
+		t.Errorf("400 不计入熔断，账号应保持半开且名额已释放: %+v", state)
+	}
+}
+
 // TestCircuitBreakerStatus_EmptyAccounts 无账号时返回空数组
 // **Validates: Requirements 2.4**
 func TestCircuitBreakerStatus_EmptyAccounts(t *testing.T) {
@@ -933,6 +1079,102 @@ func TestConvertSystemPrompt_EmptyMessages(t *testing.T) {
 	}
 }
 
+// TestConvertSystemPrompt_InjectionMode 验证 SystemInjectionMode 和 SystemAckText 决定 system prompt 的位置和确认语
+func TestConvertSystemPrompt_InjectionMode(t *testing.T) {
+	oldConfig := proxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	messages := []map[string]any{
+		{"role": "user", "content": "Q1"},
+		{"role": "assistant", "content": "A1"},
+		{"role": "user", "content": "Q2"},
+	}
+	system := "SYS"
+
+	tests := []struct {
+		name    string
+		mode    string
+		ackText string
+		want    []string // 按顺序的 role:content
+	}{
+		{"默认 pair", "", "", []string{"user:SYS", "assistant:I will follow these instructions.", "user:Q1", "assistant:A1", "user:Q2"}},
+		{"pair 自定义确认语", kiroclient.SystemInjectionPair, "Understood.", []string{"user:SYS", "assistant:Understood.", "user:Q1", "assistant:A1", "user:Q2"}},
+		{"first_user", kiroclient.SystemInjectionFirstUser, "Understood.", []string{"user:SYS\n\nQ1", "assistant:A1", "user:Q2"}},
+		{"last_user", kiroclient.SystemInjectionLastUser, "", []string{"user:Q1", "assistant:A1", "user:SYS\n\nQ2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyConfig = kiroclient.DefaultProxyConfig
+			proxyConfig.SystemInjectionMode = tt.mode
+			proxyConfig.SystemAckText = tt.ackText
+
+			msgs, _, _, _ := convertToKiroMessagesWithSystem(messages, system, nil)
+			var got []string
+			for _, m := range msgs {
+				got = append(got, m.Role+":"+m.Content)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("期望 %q, 实际 %q", tt.want, got)
+			}
+		})
+	}
+
+	// 找不到可拼接的 user 消息时回落到 pair（无消息时补 Continue）
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.SystemInjectionMode = kiroclient.SystemInjectionFirstUser
+	msgs, _, _, _ := convertToKiroMessagesWithSystem([]map[string]any{}, system, nil)
+	if len(msgs) != 3 || msgs[0].Content != "SYS" || msgs[2].Content != "Continue" {
+		t.Errorf("无 user 消息时应回落到 pair: %+v", msgs)
+	}
+}
+
+// TestClaudeChat_SystemAckTextInHistory 验证自定义确认语出现在发往 Kiro 的 history 中
+func TestClaudeChat_SystemAckTextInHistory(t *testing.T) {
+	var upstreamBody string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		upstreamBody = string(body)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.SystemAckText = "Acknowledged, operator."
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"system":"Be terse.","messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	var payload struct {
+		ConversationState struct {
+			History []map[string]map[string]any `json:"history"`
+		} `json:"conversationState"`
+	}
+	if err := json.Unmarshal([]byte(upstreamBody), &payload); err != nil {
+		t.Fatalf("上游请求解析失败: %v", err)
+	}
+	history := payload.ConversationState.History
+	if len(history) != 2 {
+		t.Fatalf("history 应为 system 配对, 实际 %d 条: %s", len(history), upstreamBody)
+	}
+	if history[0]["userInputMessage"]["content"] != "Be terse." {
+		t.Errorf("history 首条应为 system prompt: %v", history[0])
+	}
+	if history[1]["assistantResponseMessage"]["content"] != "Acknowledged, operator." {
+		t.Errorf("history 第二条应为自定义确认语: %v", history[1])
+	}
+}
+
 // TestConvertSystemPrompt_NoSystem 验证无 system prompt 时行为不变
 func TestConvertSystemPrompt_NoSystem(t *testing.T) {
 	messages := []map[string]any{
@@ -1032,3 +1274,2385 @@ func findSubstr(s, substr string) bool {
 	}
 	return false
 }
+
+// TestToolInputStream_PushHoldsBackTail 测试增量转发时扣留末尾字符
+func TestToolInputStream_PushHoldsBackTail(t *testing.T) {
+	s := &toolInputStream{ToolUseId: "t1"}
+
+	var sent string
+	for _, frag := range []string{`{"path":`, `"a.txt",`, `"content":"hi"}`} {
+		sent += s.push(frag)
+	}
+	if sent != `{"path":"a.txt","content":"hi"` {
+		t.Errorf("已发送片段不对: %q", sent)
+	}
+
+	rest, ok := s.finish(`{"path":"a.txt","content":"hi"}`, map[string]any{"path": "a.txt", "content": "hi"}, nil)
+	if !ok || rest != "}" {
+		t.Errorf("期望补发 '}', got %q ok=%v", rest, ok)
+	}
+}
+
+// TestToolInputStream_FinishWithPatchedFields 测试补齐缺失字段后拼接结果仍是合法 JSON
+func TestToolInputStream_FinishWithPatchedFields(t *testing.T) {
+	s := &toolInputStream{ToolUseId: "t1"}
+	raw := `{"path":"a.txt"}`
+	sent := s.push(raw)
+
+	input := map[string]any{"path": "a.txt", "content": ""}
+	rest, ok := s.finish(raw, input, []string{"content"})
+	if !ok {
+		t.Fatal("应能与已发送片段对齐")
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(sent+rest), &got); err != nil {
+		t.Fatalf("拼接结果不是合法 JSON: %q, err=%v", sent+rest, err)
+	}
+	if got["path"] != "a.txt" || got["content"] != "" {
+		t.Errorf("拼接结果字段不对: %v", got)
+	}
+}
+
+// TestToolInputStream_FinishWithoutPartials 测试没发过片段时直接发完整 input
+func TestToolInputStream_FinishWithoutPartials(t *testing.T) {
+	s := &toolInputStream{ToolUseId: "t1"}
+	rest, ok := s.finish("", map[string]any{}, nil)
+	if !ok || rest != "{}" {
+		t.Errorf("期望 {}, got %q ok=%v", rest, ok)
+	}
+}
+
+// TestToolInputStream_FinishMismatch 测试最终结果与已发送片段不一致
+func TestToolInputStream_FinishMismatch(t *testing.T) {
+	s := &toolInputStream{ToolUseId: "t1"}
+	s.push(`{"a":1,`)
+	rest, ok := s.finish(`{"b":2}`, map[string]any{"b": 2}, nil)
+	if ok {
+		t.Error("不一致时应返回 ok=false")
+	}
+	if rest != "," {
+		t.Errorf("应返回扣留的尾部, got %q", rest)
+	}
+}
+
+// ========== 上游 mock 辅助函数 ==========
+
+// rewriteTransport 把所有上游请求改写到本地 mock 服务
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (rt rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = rt.target.Scheme
+	req.URL.Host = rt.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// setupMockUpstream 初始化一个使用本地 mock 上游的客户端（注入一个有效测试账号）
+// 返回清理函数，调用方需 defer 调用
+func setupMockUpstream(t *testing.T, handler http.HandlerFunc) func() {
+	t.Helper()
+	// 经 handler 的请求会记录账号统计，部分测试还会删除/落盘统计，统一写到临时目录
+	useTempStatsFiles(t)
+	srv := httptest.NewServer(handler)
+	target, _ := url.Parse(srv.URL)
+
+	client = kiroclient.NewKiroClient()
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{
+		Accounts: []kiroclient.AccountInfo{{
+			ID:    "mock-account",
+			Email: "mock@example.com",
+			Token: &kiroclient.KiroAuthToken{
+				AccessToken: "mock-token",
+				ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+			},
+		}},
+	})
+	client.Chat.SetHTTPClientForTest(&http.Client{Transport: rewriteTransport{target: target}})
+	client.MCP.SetHTTPClientForTest(&http.Client{Transport: rewriteTransport{target: target}})
+
+	return srv.Close
+}
+
+// encodeEventStreamMessage 构造一条 AWS EventStream 二进制消息
+func encodeEventStreamMessage(eventType string, payload string) []byte {
+	return encodeEventStreamFrame(payload, ":message-type", "event", ":event-type", eventType)
+}
+
+// encodeEventStreamFrame 按给定的 header（name, value 交替排列）构造一条 AWS EventStream 二进制消息
+func encodeEventStreamFrame(payload string, headerPairs ...string) []byte {
+	var headers bytes.Buffer
+	writeHeader := func(name, value string) {
+		headers.WriteByte(byte(len(name)))
+		headers.WriteString(name)
+		headers.WriteByte(7) // string 类型
+		_ = binary.Write(&headers, binary.BigEndian, uint16(len(value)))
+		headers.WriteString(value)
+	}
+	for i := 0; i+1 < len(headerPairs); i += 2 {
+		writeHeader(headerPairs[i], headerPairs[i+1])
+	}
+
+	var msg bytes.Buffer
+	_ = binary.Write(&msg, binary.BigEndian, uint32(12+headers.Len()+len(payload)+4))
+	_ = binary.Write(&msg, binary.BigEndian, uint32(headers.Len()))
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()[0:8]))
+	msg.Write(headers.Bytes())
+	msg.WriteString(payload)
+	_ = binary.Write(&msg, binary.BigEndian, crc32.ChecksumIEEE(msg.Bytes()))
+	return msg.Bytes()
+}
+
+// TestMaxRequestSeconds_CutsLongStream 测试请求总时长上限会截断长时间的流式响应
+func TestMaxRequestSeconds_CutsLongStream(t *testing.T) {
+	// mock 上游：每 100ms 吐一段文本，持续 10 秒
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+		w.WriteHeader(200)
+		flusher := w.(http.Flusher)
+		for i := 0; i < 100; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"tick tick tick tick tick tick tick tick "}`))
+			flusher.Flush()
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.MaxRequestSeconds = 1
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+
+	body := `{"model":"claude-sonnet-4.5","stream":true,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	router.ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	if elapsed > 3*time.Second {
+		t.Errorf("请求应在约 1 秒后被截断, 实际耗时 %v", elapsed)
+	}
+	respBody := w.Body.String()
+	if !strings.Contains(respBody, "tick") {
+		t.Error("截断前应已转发部分内容")
+	}
+	if !strings.Contains(respBody, "event: error") || !strings.Contains(respBody, "timeout_error") {
+		t.Errorf("应以 timeout_error 错误帧结束, got: %s", respBody)
+	}
+	if strings.Contains(respBody, "message_stop") {
+		t.Error("超时截断时不应发送 message_stop")
+	}
+
+	// 超时不计入账号失败
+	if stats := getAccountStats()["mock-account"]; stats != nil && stats.FailCount > 0 {
+		t.Errorf("超时不应记为账号失败, FailCount=%d", stats.FailCount)
+	}
+}
+
+// TestModelTimeouts_CutsSlowUpstream 按模型配置的上游超时到期后中止慢速流（未配置的模型仍为默认 120 秒）
+func TestModelTimeouts_CutsSlowUpstream(t *testing.T) {
+	// mock 上游：每 100ms 吐一段文本，持续 10 秒
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		flusher := w.(http.Flusher)
+		for i := 0; i < 100; i++ {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"slow slow slow slow slow slow slow slow "}`))
+			flusher.Flush()
+		}
+	})
+	defer cleanup()
+	defer removeAccountStats("mock-account")
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ModelTimeouts = map[string]int{"claude-sonnet-4.5": 5}
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+
+	body := `{"model":"claude-sonnet-4.5","stream":true,"max_tokens":100000,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	start := time.Now()
+	router.ServeHTTP(w, req)
+	elapsed := time.Since(start)
+
+	if elapsed < 4500*time.Millisecond || elapsed > 7*time.Second {
+		t.Errorf("请求应在约 5 秒后被上游超时中止, 实际耗时 %v", elapsed)
+	}
+	respBody := w.Body.String()
+	if !strings.Contains(respBody, "slow") || !strings.Contains(respBody, "上游请求超时") {
+		t.Errorf("应先转发部分内容再以上游超时错误结束, got: %s", respBody)
+	}
+	if stats := getAccountStats()["mock-account"]; stats != nil && stats.FailCount > 0 {
+		t.Errorf("上游超时不应记为账号失败, FailCount=%d", stats.FailCount)
+	}
+}
+
+// TestInvalidMappingTarget_RejectedBeforeUpstream 测试映射目标无效时在调用上游前就返回 400
+func TestInvalidMappingTarget_RejectedBeforeUpstream(t *testing.T) {
+	upstreamCalled := false
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+		w.WriteHeader(200)
+	})
+	defer cleanup()
+
+	oldMapping := modelMapping
+	modelMapping = kiroclient.ModelMapping{"claude-custom": "not-a-real-model\",\"x\":\"y"}
+	defer func() { modelMapping = oldMapping }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		body := `{"model":"claude-custom","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Errorf("%s: 期望状态码 400, 得到 %d", path, w.Code)
+		}
+	}
+	if upstreamCalled {
+		t.Error("无效映射目标不应发往上游")
+	}
+}
+
+// TestImproperlyFormedRequest_Returns400 测试上游报请求格式错误时返回 400 而不是 500
+func TestImproperlyFormedRequest_Returns400(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		_, _ = w.Write([]byte(`{"message":"Improperly formed request."}`))
+	})
+	defer cleanup()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != 400 {
+			t.Errorf("%s: 期望状态码 400, 得到 %d", path, w.Code)
+		}
+	}
+}
+
+// TestUpdateModelMapping_RejectsInvalidTarget 测试更新映射时拒绝无效目标
+func TestUpdateModelMapping_RejectsInvalidTarget(t *testing.T) {
+	oldMapping := modelMapping
+	modelMapping = kiroclient.ModelMapping{}
+	defer func() { modelMapping = oldMapping }()
+
+	router := gin.New()
+	router.POST("/api/model-mapping", handleUpdateModelMapping)
+
+	body := `{"mapping":{"claude-custom":"gpt-4"}}`
+	req, _ := http.NewRequest("POST", "/api/model-mapping", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Errorf("期望状态码 400, 得到 %d", w.Code)
+	}
+	if _, ok := modelMapping["claude-custom"]; ok {
+		t.Error("无效映射不应被保存")
+	}
+}
+
+// TestOpenAIStream_ReasoningContentAcrossChunks 测试 OpenAI 流式输出中 <thinking> 标签跨事件切分时
+// reasoning_content 与 content 增量互不重叠
+func TestOpenAIStream_ReasoningContentAcrossChunks(t *testing.T) {
+	before := strings.Repeat("开场白", 20)
+	thinkingText := "先拆解问题，然后逐条验证"
+	after := "这是最终回答"
+	full := before + "<thinking>" + thinkingText + "</thinking>" + after
+
+	// 把完整文本切成 7 字节左右的事件（按 rune 对齐），让标签必然跨事件
+	var chunks []string
+	for len(full) > 0 {
+		n := 7
+		if n > len(full) {
+			n = len(full)
+		}
+		for n < len(full) && !utf8.RuneStart(full[n]) {
+			n++
+		}
+		chunks = append(chunks, full[:n])
+		full = full[n:]
+	}
+
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for _, chunk := range chunks {
+			payload, _ := json.Marshal(map[string]string{"content": chunk})
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", string(payload)))
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+
+	body := `{"model":"claude-sonnet-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var reasoning, content strings.Builder
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta map[string]string `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err != nil || len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta["reasoning_content"] != "" && delta["content"] != "" {
+			t.Errorf("同一个 delta 不应同时包含 reasoning_content 和 content: %v", delta)
+		}
+		reasoning.WriteString(delta["reasoning_content"])
+		content.WriteString(delta["content"])
+	}
+
+	if reasoning.String() != thinkingText {
+		t.Errorf("reasoning_content 拼接结果错误: %q", reasoning.String())
+	}
+	if content.String() != before+after {
+		t.Errorf("content 拼接结果错误: %q", content.String())
+	}
+}
+
+// TestOpenAIStream_RoleChunkFirst 验证 OpenAI 流式的第一个 chunk 只带 role，不带内容
+func TestOpenAIStream_RoleChunkFirst(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"Hello"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	body := `{"model":"claude-sonnet-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var deltas []map[string]any
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta map[string]any `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &chunk); err == nil && len(chunk.Choices) > 0 {
+			deltas = append(deltas, chunk.Choices[0].Delta)
+		}
+	}
+	if len(deltas) < 2 {
+		t.Fatalf("期望至少 2 个 chunk, 得到: %s", w.Body.String())
+	}
+	if deltas[0]["role"] != "assistant" || deltas[0]["content"] != "" {
+		t.Errorf("第一个 chunk 应只带 role: %v", deltas[0])
+	}
+	for i, d := range deltas[1:] {
+		if _, ok := d["role"]; ok {
+			t.Errorf("chunk %d 不应重复带 role: %v", i+1, d)
+		}
+	}
+	if deltas[1]["content"] != "Hello" {
+		t.Errorf("第二个 chunk 应为内容: %v", deltas[1])
+	}
+}
+
+// setupAccountsFileForTest 在临时目录写入账号配置并切换工作目录（账号配置路径是相对路径）
+// 返回清理函数，恢复工作目录（统计文件路径由 useTempStatsFiles 在测试结束时恢复）
+func setupAccountsFileForTest(t *testing.T, accountIDs ...string) func() {
+	t.Helper()
+	dir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("切换工作目录失败: %v", err)
+	}
+
+	config := kiroclient.AccountsConfig{}
+	for _, id := range accountIDs {
+		config.Accounts = append(config.Accounts, kiroclient.AccountInfo{ID: id, Email: id + "@example.com"})
+	}
+	data, _ := json.Marshal(config)
+	if err := os.WriteFile("kiro-accounts.json", data, 0600); err != nil {
+		t.Fatalf("写入账号配置失败: %v", err)
+	}
+
+	client = kiroclient.NewKiroClient()
+	useTempStatsFiles(t)
+	oldCircuitStats := circuitStats
+	circuitStats = NewCircuitStats()
+
+	return func() {
+		circuitStats.Close()
+		circuitStats = oldCircuitStats
+		_ = os.Chdir(oldWd)
+	}
+}
+
+// TestDeleteAccount_RemovesStats 测试删除账号时同步清理其统计
+func TestDeleteAccount_RemovesStats(t *testing.T) {
+	cleanup := setupAccountsFileForTest(t, "acc-keep", "acc-delete")
+	defer cleanup()
+
+	recordAccountRequest("acc-keep", "", 200, "")
+	recordAccountRequest("acc-delete", "", 500, "boom")
+	defer removeAccountStats("acc-keep")
+
+	router := gin.New()
+	router.DELETE("/api/accounts/:id", handleDeleteAccount)
+
+	req, _ := http.NewRequest("DELETE", "/api/accounts/acc-delete", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("期望状态码 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	stats := getAccountStats()
+	if _, ok := stats["acc-delete"]; ok {
+		t.Error("已删除账号的统计应被清理")
+	}
+	if _, ok := stats["acc-keep"]; !ok {
+		t.Error("其他账号的统计不应被清理")
+	}
+	if _, total := circuitStats.GetErrorRate("acc-delete", 5); total != 0 {
+		t.Errorf("已删除账号的熔断统计应被清理, total=%d", total)
+	}
+}
+
+// TestPruneAccountStats 测试清理不在账号配置中的统计
+func TestPruneAccountStats(t *testing.T) {
+	cleanup := setupAccountsFileForTest(t, "acc-live")
+	defer cleanup()
+
+	recordAccountRequest("acc-live", "", 200, "")
+	recordAccountRequest("acc-ghost", "", 200, "")
+	circuitStats.Record("acc-ghost-circuit", false)
+	defer removeAccountStats("acc-live")
+
+	router := gin.New()
+	router.POST("/api/stats/accounts/prune", handlePruneAccountStats)
+
+	req, _ := http.NewRequest("POST", "/api/stats/accounts/prune", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("期望状态码 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Removed []string `json:"removed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if len(resp.Removed) != 2 || resp.Removed[0] != "acc-ghost" || resp.Removed[1] != "acc-ghost-circuit" {
+		t.Errorf("清理结果不对: %v", resp.Removed)
+	}
+	if _, ok := getAccountStats()["acc-live"]; !ok {
+		t.Error("仍存在的账号统计不应被清理")
+	}
+}
+
+// TestGetAccountStats_StableOrder 测试账号统计按请求数降序、账号 ID 升序输出，多次调用顺序一致
+func TestGetAccountStats_StableOrder(t *testing.T) {
+	accountStatsMutex.Lock()
+	oldStats := accountStats
+	accountStats = map[string]*AccountStats{
+		"acc-b": {RequestCount: 5},
+		"acc-a": {RequestCount: 5},
+		"acc-c": {RequestCount: 9},
+		"acc-d": {RequestCount: 1},
+	}
+	accountStatsMutex.Unlock()
+	defer func() {
+		accountStatsMutex.Lock()
+		accountStats = oldStats
+		accountStatsMutex.Unlock()
+	}()
+
+	router := gin.New()
+	router.GET("/api/stats/accounts", handleGetAccountStats)
+	want := []string{"acc-c", "acc-a", "acc-b", "acc-d"}
+	for i := 0; i < 20; i++ {
+		req, _ := http.NewRequest("GET", "/api/stats/accounts", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var resp struct {
+			Accounts []struct {
+				AccountID string `json:"accountId"`
+			} `json:"accounts"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("解析响应失败: %v", err)
+		}
+		var got []string
+		for _, a := range resp.Accounts {
+			got = append(got, a.AccountID)
+		}
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("第 %d 次调用顺序错误: %v, 期望 %v", i+1, got, want)
+		}
+	}
+}
+
+// TestClaudeStream_NotificationSeparateBlock 测试 Claude 流式响应中系统通知占用独立的 content block
+func TestClaudeStream_NotificationSeparateBlock(t *testing.T) {
+	answer := strings.Repeat("模型的回答", 20)
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		payload, _ := json.Marshal(map[string]string{"content": answer})
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", string(payload)))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	notificationMutex.Lock()
+	oldNotif := notificationConfig
+	notificationConfig = NotificationConfig{Enabled: true, Message: "代理维护通知", Hash: notifHash("代理维护通知")}
+	notificationMutex.Unlock()
+	defer func() {
+		notificationMutex.Lock()
+		notificationConfig = oldNotif
+		notificationMutex.Unlock()
+	}()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+
+	body := `{"model":"claude-sonnet-4.5","stream":true,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// 按 index 收集每个 block 的文本，并校验 start/stop 成对、索引连续
+	texts := map[int]string{}
+	open := -1
+	next := 0
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if !strings.HasPrefix(line, "data: {") {
+			continue
+		}
+		var ev struct {
+			Type  string `json:"type"`
+			Index int    `json:"index"`
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			continue
+		}
+		switch ev.Type {
+		case "content_block_start":
+			if open != -1 || ev.Index != next {
+				t.Fatalf("block 索引不连续或未关闭: open=%d index=%d next=%d", open, ev.Index, next)
+			}
+			open = ev.Index
+		case "content_block_delta":
+			if ev.Index != open {
+				t.Fatalf("delta 索引 %d 与打开的 block %d 不一致", ev.Index, open)
+			}
+			texts[ev.Index] += ev.Delta.Text
+		case "content_block_stop":
+			if ev.Index != open {
+				t.Fatalf("stop 索引 %d 与打开的 block %d 不一致", ev.Index, open)
+			}
+			open = -1
+			next++
+		}
+	}
+
+	if len(texts) != 2 {
+		t.Fatalf("期望 2 个 content block（回答 + 通知），得到 %d: %v", len(texts), texts)
+	}
+	if texts[0] != answer {
+		t.Errorf("第一个 block 应只包含模型回答: %q", texts[0])
+	}
+	if !strings.Contains(texts[1], "代理维护通知") || strings.Contains(texts[1], "模型的回答") {
+		t.Errorf("第二个 block 应只包含通知: %q", texts[1])
+	}
+}
+
+// TestNotification_ModelScoped 测试限定模型的通知只对该模型注入，其他模型不注入
+func TestNotification_ModelScoped(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"回答"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	notificationMutex.Lock()
+	oldNotif := notificationConfig
+	notificationConfig = NotificationConfig{
+		Enabled: true,
+		Message: "Sonnet 专属通知",
+		Hash:    notifHash("Sonnet 专属通知"),
+		Models:  []string{"claude-sonnet-4.5"},
+	}
+	notificationMutex.Unlock()
+	defer func() {
+		notificationMutex.Lock()
+		notificationConfig = oldNotif
+		notificationMutex.Unlock()
+	}()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path, model string) string {
+		body := fmt.Sprintf(`{"model":%q,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`, model)
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		if out := send(path, "claude-sonnet-4.5"); !strings.Contains(out, "Sonnet 专属通知") {
+			t.Errorf("%s: 命中的模型应注入通知: %s", path, out)
+		}
+		if out := send(path, "claude-haiku-4.5"); strings.Contains(out, "Sonnet 专属通知") {
+			t.Errorf("%s: 未命中的模型不应注入通知: %s", path, out)
+		}
+	}
+}
+
+// TestDisabledModels_RejectedWhileOthersPass 测试全局禁用的模型返回 403，其他模型正常
+func TestDisabledModels_RejectedWhileOthersPass(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		payload, _ := json.Marshal(map[string]string{"content": strings.Repeat("正常回答", 20)})
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", string(payload)))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.DisabledModels = []string{"claude-opus-4.5"}
+	defer func() { proxyConfig = oldConfig }()
+
+	oldMapping := modelMapping
+	modelMapping = kiroclient.ModelMapping{"opus-alias": "claude-opus-4.5"}
+	defer func() { modelMapping = oldMapping }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	router.GET("/api/models", handleModelsList)
+
+	send := func(path, model string) int {
+		body := `{"model":"` + model + `","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		// 直接请求和经映射命中禁用模型都被拒绝
+		for _, model := range []string{"claude-opus-4.5", "opus-alias"} {
+			if code := send(path, model); code != 403 {
+				t.Errorf("%s %s: 期望 403, 得到 %d", path, model, code)
+			}
+		}
+		if code := send(path, "claude-sonnet-4.5"); code != 200 {
+			t.Errorf("%s: 未禁用的模型期望 200, 得到 %d", path, code)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/api/models", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), `"claude-opus-4.5"`) {
+		t.Error("模型列表不应包含禁用的模型")
+	}
+	if !strings.Contains(w.Body.String(), `"claude-sonnet-4.5"`) {
+		t.Error("模型列表应包含未禁用的模型")
+	}
+}
+
+// TestOpenAIModels_ListSchema 测试 /v1/models 返回 OpenAI 模型列表结构，映射别名作为可选 id 列出，
+// 禁用的模型和指向禁用/无效模型的别名不列出，且需要 API-KEY
+func TestOpenAIModels_ListSchema(t *testing.T) {
+	router := setupApiKeyRotationTest(t, "sk-models-test")
+	router.GET("/v1/models", apiKeyAuthMiddleware(), handleOpenAIModels)
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.DisabledModels = []string{"claude-opus-4.5"}
+	defer func() { proxyConfig = oldConfig }()
+
+	oldMapping := modelMapping
+	modelMapping = kiroclient.ModelMapping{
+		"gpt-4o":       "claude-sonnet-4.5",
+		"opus-alias":   "claude-opus-4.5",
+		"broken-alias": "not-a-real-model",
+	}
+	defer func() { modelMapping = oldMapping }()
+
+	get := func(key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/v1/models", nil)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != 401 {
+		t.Fatalf("未带 API-KEY 期望 401, 得到 %d", w.Code)
+	}
+	w := get("sk-models-test")
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	// 按 OpenAI models 结构逐字段校验：顶层 object=list，每项 id/object/created/owned_by 类型正确
+	var resp struct {
+		Object string           `json:"object"`
+		Data   []map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if resp.Object != "list" || len(resp.Data) == 0 {
+		t.Fatalf("顶层结构不对: %s", w.Body.String())
+	}
+	ids := map[string]bool{}
+	for _, m := range resp.Data {
+		id, _ := m["id"].(string)
+		created, ok := m["created"].(float64)
+		if id == "" || m["object"] != "model" || m["owned_by"] != "kiro" || !ok || created != float64(int64(created)) || created <= 0 {
+			t.Errorf("模型条目不符合 OpenAI 结构: %v", m)
+		}
+		if ids[id] {
+			t.Errorf("模型 id 重复: %s", id)
+		}
+		ids[id] = true
+	}
+
+	for _, id := range []string{"claude-sonnet-4.5", "gpt-4o"} {
+		if !ids[id] {
+			t.Errorf("列表应包含 %s: %s", id, w.Body.String())
+		}
+	}
+	for _, id := range []string{"claude-opus-4.5", "opus-alias", "broken-alias"} {
+		if ids[id] {
+			t.Errorf("列表不应包含 %s", id)
+		}
+	}
+}
+
+// TestComputeStopReason_TruthTable 测试 stop_reason / finish_reason 的完整真值表
+func TestComputeStopReason_TruthTable(t *testing.T) {
+	cases := []struct {
+		hasTool, hasTruncated bool
+		stopReason, finish    string
+	}{
+		{false, false, "end_turn", "stop"},
+		{true, false, "tool_use", "tool_calls"},
+		{false, true, "max_tokens", "length"},
+		{true, true, "max_tokens", "length"}, // 截断优先于工具调用
+	}
+	for _, tc := range cases {
+		got := computeStopReason(tc.hasTool, tc.hasTruncated)
+		if got != tc.stopReason {
+			t.Errorf("computeStopReason(%v, %v) = %q, 期望 %q", tc.hasTool, tc.hasTruncated, got, tc.stopReason)
+		}
+		if finish := openAIFinishReason(got); finish != tc.finish {
+			t.Errorf("openAIFinishReason(%q) = %q, 期望 %q", got, finish, tc.finish)
+		}
+	}
+}
+
+// TestChatOptions_Propagation 测试请求参数和全局配置经 ChatOptions 传入 client 并生效
+func TestChatOptions_Propagation(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"正常回答"}`))
+		_, _ = w.Write(encodeEventStreamMessage("followupPromptEvent", `{"followupPrompt":{"content":"next?"}}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ForwardedEvents = map[string]bool{"followupPromptEvent": false}
+	defer func() { proxyConfig = oldConfig }()
+
+	// buildChatOptions 填充请求参数、全局事件开关和 thinking 格式
+	temp := 0.3
+	topP, topK := 0.9, 40
+	req := &ClaudeChatRequest{MaxTokens: 256, StopSequences: []string{"END"}, Temperature: &temp, TopP: &topP, TopK: &topK}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request, _ = http.NewRequest("POST", "/v1/messages", nil)
+	opts := buildChatOptions(c, req)
+	if opts.MaxTokens != 256 || len(opts.StopSequences) != 1 || opts.Temperature == nil || *opts.Temperature != 0.3 || opts.TopP == nil || *opts.TopP != 0.9 || opts.TopK == nil || *opts.TopK != 40 {
+		t.Errorf("生成参数未正确填充: %+v", opts)
+	}
+	if opts.ThinkingFormat != kiroclient.ThinkingFormatReasoningContent || opts.ForwardedEvents["followupPromptEvent"] {
+		t.Errorf("thinking 格式或事件开关未正确填充: %+v", opts)
+	}
+
+	// 端到端：关闭的辅助事件不出现在响应中
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+	httpReq, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	httpReq.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httpReq)
+
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "正常回答") || strings.Contains(w.Body.String(), "Suggested follow-up") {
+		t.Errorf("关闭的辅助事件不应注入响应: %s", w.Body.String())
+	}
+}
+
+// TestCircuitBreakerStatus_PoolSummary 测试账号池汇总与逐账号数组一致
+func TestCircuitBreakerStatus_PoolSummary(t *testing.T) {
+	router := setupCircuitBreakerTestRouter("acc-ok", "acc-open", "acc-expired", "acc-broke")
+
+	// acc-expired 的 Token 已过期，acc-broke 额度耗尽，acc-open 手动熔断
+	accounts := []kiroclient.AccountInfo{}
+	for _, id := range []string{"acc-ok", "acc-open", "acc-expired", "acc-broke"} {
+		expiresAt := "2099-12-31T23:59:59Z"
+		if id == "acc-expired" {
+			expiresAt = "2020-01-01T00:00:00Z"
+		}
+		accounts = append(accounts, kiroclient.AccountInfo{
+			ID:    id,
+			Email: id + "@test.com",
+			Token: &kiroclient.KiroAuthToken{AccessToken: "token-" + id, ExpiresAt: expiresAt},
+		})
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: accounts})
+	client.Auth.SetUsageCacheForTest("acc-broke", 100, 100)
+	if err := client.Auth.ManualTrip("acc-open"); err != nil {
+		t.Fatalf("ManualTrip 失败: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/circuit-breaker/status", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp struct {
+		Accounts []struct {
+			AccountID        string `json:"accountId"`
+			State            string `json:"state"`
+			TokenExpired     bool   `json:"tokenExpired"`
+			CreditsExhausted bool   `json:"creditsExhausted"`
+			Eligible         bool   `json:"eligible"`
+		} `json:"accounts"`
+		Summary CircuitPoolSummary `json:"summary"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+
+	// 从逐账号数组重新统计，必须与汇总一致
+	var want CircuitPoolSummary
+	for _, a := range resp.Accounts {
+		want.add(a.State, kiroclient.AccountLoadInfo{TokenExpired: a.TokenExpired, CreditsExhausted: a.CreditsExhausted, Eligible: a.Eligible})
+		if a.Eligible != (a.AccountID == "acc-ok") {
+			t.Errorf("账号 %s 的 eligible 错误: %v", a.AccountID, a.Eligible)
+		}
+	}
+	want.finish(len(resp.Accounts))
+	if resp.Summary != want {
+		t.Errorf("汇总与逐账号数据不一致: got %+v, want %+v", resp.Summary, want)
+	}
+
+	expected := CircuitPoolSummary{Closed: 3, Open: 1, TokenExpired: 1, CreditsExhausted: 1, Eligible: 1, Health: "yellow"}
+	if resp.Summary != expected {
+		t.Errorf("汇总错误: got %+v, want %+v", resp.Summary, expected)
+	}
+}
+
+// TestRetryEmptyResponse 测试空响应换账号重试一次，已有输出时绝不重试
+func TestRetryEmptyResponse(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	respondEmpty := true
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		empty := respondEmpty && len(tokens) == 1
+		mu.Unlock()
+		w.WriteHeader(200)
+		// 第一次返回空流（无内容、无 usage），之后正常返回
+		if empty {
+			return
+		}
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"重试后的回答"}`))
+	})
+	defer cleanup()
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: []kiroclient.AccountInfo{
+		{ID: "acc-1", Token: &kiroclient.KiroAuthToken{AccessToken: "token-1", ExpiresAt: "2099-12-31T23:59:59Z"}},
+		{ID: "acc-2", Token: &kiroclient.KiroAuthToken{AccessToken: "token-2", ExpiresAt: "2099-12-31T23:59:59Z"}},
+	}})
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path string, stream bool) *httptest.ResponseRecorder {
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 未开启：空响应直接返回，不重试
+	proxyConfig.RetryEmptyResponse = false
+	tokens = nil
+	send("/v1/messages", false)
+	if len(tokens) != 1 {
+		t.Fatalf("未开启时不应重试, 上游请求 %d 次", len(tokens))
+	}
+
+	// 开启：四个处理路径都恰好重试一次，且换了账号
+	proxyConfig.RetryEmptyResponse = true
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		for _, stream := range []bool{false, true} {
+			tokens = nil
+			w := send(path, stream)
+			if len(tokens) != 2 {
+				t.Errorf("%s stream=%v: 期望上游请求 2 次, 得到 %d", path, stream, len(tokens))
+				continue
+			}
+			if tokens[0] == tokens[1] {
+				t.Errorf("%s stream=%v: 重试应换一个账号: %v", path, stream, tokens)
+			}
+			if !strings.Contains(w.Body.String(), "重试后的回答") {
+				t.Errorf("%s stream=%v: 响应应包含重试后的内容: %s", path, stream, w.Body.String())
+			}
+		}
+	}
+
+	// 已有输出（即使没有 usage）时不重试
+	mu.Lock()
+	respondEmpty = false
+	mu.Unlock()
+	tokens = nil
+	send("/v1/messages", true)
+	if len(tokens) != 1 {
+		t.Errorf("已有输出时不应重试, 上游请求 %d 次", len(tokens))
+	}
+}
+
+// TestMaxRetries_FailoverToOtherAccount 测试上游失败时换账号重试：已失败的账号不再选择，不触发熔断的错误不重试
+func TestMaxRetries_FailoverToOtherAccount(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	failAll := false
+	failBody := "internal error"
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		fail, body := failAll || len(tokens) == 1, failBody
+		mu.Unlock()
+		// 每个请求的第一次上游调用失败，换账号后成功
+		if fail {
+			w.WriteHeader(500)
+			_, _ = w.Write([]byte(body))
+			return
+		}
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"换账号后的回答"}`))
+	})
+	defer cleanup()
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: []kiroclient.AccountInfo{
+		{ID: "acc-1", Token: &kiroclient.KiroAuthToken{AccessToken: "token-1", ExpiresAt: "2099-12-31T23:59:59Z"}},
+		{ID: "acc-2", Token: &kiroclient.KiroAuthToken{AccessToken: "token-2", ExpiresAt: "2099-12-31T23:59:59Z"}},
+	}})
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path string, stream bool) *httptest.ResponseRecorder {
+		mu.Lock()
+		tokens = nil
+		mu.Unlock()
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 未配置：失败直接返回，不重试
+	send("/v1/messages", false)
+	if len(tokens) != 1 {
+		t.Fatalf("maxRetries=0 时不应重试, 上游请求 %d 次", len(tokens))
+	}
+
+	// 配置后：四个处理路径都换一个账号重试并成功
+	proxyConfig.MaxRetries = 2
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		for _, stream := range []bool{false, true} {
+			w := send(path, stream)
+			if len(tokens) != 2 || tokens[0] == tokens[1] {
+				t.Errorf("%s stream=%v: 期望换账号重试一次, 上游请求: %v", path, stream, tokens)
+				continue
+			}
+			if w.Code != 200 || !strings.Contains(w.Body.String(), "换账号后的回答") {
+				t.Errorf("%s stream=%v: 响应应包含重试后的内容: %d %s", path, stream, w.Code, w.Body.String())
+			}
+		}
+	}
+
+	// 所有账号都失败：每个账号只试一次，不会重新选中已失败的账号
+	mu.Lock()
+	failAll = true
+	mu.Unlock()
+	send("/v1/messages", false)
+	if len(tokens) != 2 || tokens[0] == tokens[1] {
+		t.Errorf("所有账号都失败时每个账号只应请求一次, 上游请求: %v", tokens)
+	}
+
+	// 不触发熔断的错误（请求本身的问题）换账号也无济于事，不重试
+	mu.Lock()
+	failBody = "Improperly formed request"
+	mu.Unlock()
+	send("/v1/messages", false)
+	if len(tokens) != 1 {
+		t.Errorf("不触发熔断的错误不应重试, 上游请求 %d 次", len(tokens))
+	}
+}
+
+// TestClaudeStream_ErrorInSecondRound 测试第二轮上游调用（空响应重试）中途出错时，
+// SSE 流仍然完整：已打开的 block 被关闭，写出 error 事件后以 message_delta/message_stop 结束，
+// 出错的上游请求被取消，不再发起新一轮请求
+func TestClaudeStream_ErrorInSecondRound(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	upstreamCancelled := make(chan bool, 1)
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		round := calls
+		mu.Unlock()
+		w.WriteHeader(200)
+		if round == 1 {
+			return // 第一轮空响应，触发重试
+		}
+		// 第二轮输出一段文本后返回错误帧，连接保持打开，直到代理取消这次上游请求
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"部分回答"}`))
+		_, _ = w.Write(encodeEventStreamFrame("", ":message-type", "error", ":error-message", "upstream broke"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			upstreamCancelled <- true
+		case <-time.After(5 * time.Second):
+			upstreamCancelled <- false
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.RetryEmptyResponse = true
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if !<-upstreamCancelled {
+		t.Error("出错的那一轮上游请求应被取消")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("期望上游请求 2 轮, 实际 %d", calls)
+	}
+	out := w.Body.String()
+	if !strings.Contains(out, "部分回答") {
+		t.Fatalf("应先转发第二轮已生成的内容: %s", out)
+	}
+
+	// 逐个事件校验：data 都是合法 JSON，每个打开的 block 都被关闭，
+	// error 事件之后依次是 message_delta 和 message_stop
+	open := map[float64]bool{}
+	var events []string
+	for _, frame := range strings.Split(strings.TrimSpace(out), "\n\n") {
+		var event, data string
+		for _, line := range strings.Split(frame, "\n") {
+			if v, ok := strings.CutPrefix(line, "event: "); ok {
+				event = v
+			} else if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = v
+			}
+		}
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(data), &payload); err != nil {
+			t.Fatalf("事件 %s 的 data 不是合法 JSON: %q", event, data)
+		}
+		switch event {
+		case "content_block_start":
+			open[payload["index"].(float64)] = true
+		case "content_block_stop":
+			delete(open, payload["index"].(float64))
+		}
+		events = append(events, event)
+	}
+	if len(open) != 0 {
+		t.Errorf("出错后仍有未关闭的 content block: %v\n%s", open, out)
+	}
+	if n := len(events); n < 3 || events[n-3] != "error" || events[n-2] != "message_delta" || events[n-1] != "message_stop" {
+		t.Errorf("流应以 error、message_delta、message_stop 结束, 实际事件序列 %v", events)
+	}
+}
+
+// TestClaudeStream_MessageDeltaUsage 测试 Claude 流式 message_delta 携带完整 usage（精确值优先，缺失时用估算值）
+func TestClaudeStream_MessageDeltaUsage(t *testing.T) {
+	withUsage := true
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"你好"}`))
+		if withUsage {
+			_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent",
+				`{"tokenUsage":{"uncachedInputTokens":100,"cacheReadInputTokens":30,"cacheWriteInputTokens":20,"outputTokens":42}}`))
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+
+	// 提取 message_delta 事件的 usage
+	messageDeltaUsage := func() map[string]int {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		out := w.Body.String()
+		deltaAt := strings.Index(out, "event: message_delta\ndata: ")
+		if deltaAt < 0 {
+			t.Fatalf("缺少 message_delta 事件: %s", out)
+		}
+		if stopAt := strings.Index(out, "event: message_stop"); stopAt < deltaAt {
+			t.Fatalf("message_stop 应在 message_delta 之后: %s", out)
+		}
+		line := out[deltaAt+len("event: message_delta\ndata: "):]
+		line = line[:strings.Index(line, "\n")]
+		var delta struct {
+			Usage map[string]any `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(line), &delta); err != nil {
+			t.Fatalf("解析 message_delta 失败: %v", err)
+		}
+		// 只比较 token 字段（service_tier 是字符串）
+		tokens := make(map[string]int)
+		for k, v := range delta.Usage {
+			if n, ok := v.(float64); ok {
+				tokens[k] = int(n)
+			}
+		}
+		return tokens
+	}
+
+	usage := messageDeltaUsage()
+	want := map[string]int{"input_tokens": 150, "cache_read_input_tokens": 30, "cache_creation_input_tokens": 20, "output_tokens": 42}
+	for k, v := range want {
+		if usage[k] != v {
+			t.Errorf("%s: 期望 %d, 得到 %d (usage=%v)", k, v, usage[k], usage)
+		}
+	}
+
+	// 上游未返回 usage：降级为估算值，字段仍然齐全
+	withUsage = false
+	usage = messageDeltaUsage()
+	for _, k := range []string{"input_tokens", "cache_read_input_tokens", "cache_creation_input_tokens", "output_tokens"} {
+		if _, ok := usage[k]; !ok {
+			t.Errorf("缺少字段 %s: %v", k, usage)
+		}
+	}
+	if usage["input_tokens"] <= 0 || usage["output_tokens"] <= 0 || usage["cache_read_input_tokens"] != 0 {
+		t.Errorf("估算值错误: %v", usage)
+	}
+}
+
+// TestClaudeUsage_ServiceTier Claude 流式（message_start、message_delta）和非流式 usage 都带 service_tier，值可配置
+func TestClaudeUsage_ServiceTier(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+		_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"tokenUsage":{"uncachedInputTokens":10,"outputTokens":2}}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	post := func(stream bool) string {
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":%t,"messages":[{"role":"user","content":"hi"}]}`, stream)
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+	// eventUsage 提取 SSE 事件中的 usage（message_start 在 message 下，message_delta 在顶层）
+	eventUsage := func(out, event string) map[string]any {
+		at := strings.Index(out, "event: "+event+"\ndata: ")
+		if at < 0 {
+			t.Fatalf("缺少 %s 事件: %s", event, out)
+		}
+		line := out[at+len("event: "+event+"\ndata: "):]
+		line = line[:strings.Index(line, "\n")]
+		var data struct {
+			Usage   map[string]any `json:"usage"`
+			Message struct {
+				Usage map[string]any `json:"usage"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &data); err != nil {
+			t.Fatalf("解析 %s 失败: %v", event, err)
+		}
+		if data.Usage != nil {
+			return data.Usage
+		}
+		return data.Message.Usage
+	}
+
+	out := post(true)
+	for _, event := range []string{"message_start", "message_delta"} {
+		if got := eventUsage(out, event)["service_tier"]; got != kiroclient.DefaultClaudeServiceTier {
+			t.Errorf("%s usage.service_tier 期望 %q, 得到 %v", event, kiroclient.DefaultClaudeServiceTier, got)
+		}
+	}
+
+	proxyConfig.ClaudeServiceTier = "priority"
+	var resp struct {
+		Usage kiroclient.ClaudeUsage `json:"usage"`
+	}
+	if err := json.Unmarshal([]byte(post(false)), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if resp.Usage.ServiceTier != "priority" {
+		t.Errorf("非流式 usage.service_tier 应使用配置值, 得到 %q", resp.Usage.ServiceTier)
+	}
+}
+
+// TestUpstreamHeaders 测试自定义 header 出现在上游请求中，且不能覆盖 Authorization
+func TestUpstreamHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var got http.Header
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = r.Header.Clone()
+		mu.Unlock()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.UpstreamHeaders = map[string]string{
+		"x-amzn-kiro-agent-mode": "spec",
+		"X-Feature-Flag":         "beta",
+		"authorization":          "Bearer hijacked",
+	}
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+
+		mu.Lock()
+		if got.Get("x-amzn-kiro-agent-mode") != "spec" || got.Get("X-Feature-Flag") != "beta" {
+			t.Errorf("%s 自定义 header 未生效: %v", path, got)
+		}
+		if got.Get("Authorization") == "Bearer hijacked" {
+			t.Errorf("%s Authorization 不应被覆盖", path)
+		}
+		mu.Unlock()
+	}
+
+	// 配置接口拒绝受保护的 header
+	cfgRouter := gin.New()
+	cfgRouter.POST("/api/proxy-config", handleUpdateProxyConfig)
+	body := `{"config":{"upstreamHeaders":{"Authorization":"Bearer x"}}}`
+	req, _ := http.NewRequest("POST", "/api/proxy-config", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	cfgRouter.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "upstreamHeaders") {
+		t.Errorf("受保护 header 应返回 400, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestLoadProxyConfig_LogsUpstreamHeaderNamesOnly 测试加载代理配置时日志只包含上游请求头的名字，不包含值
+func TestLoadProxyConfig_LogsUpstreamHeaderNamesOnly(t *testing.T) {
+	mem := useMemoryStorage(t)
+	oldConfig, oldLogger := proxyConfig, logger
+	defer func() { proxyConfig, logger = oldConfig, oldLogger }()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger = &StructuredLogger{zap: zap.New(core), level: zap.NewAtomicLevelAt(zapcore.InfoLevel)}
+
+	_ = mem.Put(proxyConfigFile, []byte(`{"upstreamHeaders":{"X-Upstream-Token":"upstream-secret","X-Feature-Flag":"beta"},"modelMappingBootstrapUrl":"https://models.example.com/v1/models?token=url-token"}`))
+	loadProxyConfig()
+
+	if proxyConfig.UpstreamHeaders["X-Upstream-Token"] != "upstream-secret" {
+		t.Fatalf("配置应正常加载: %v", proxyConfig.UpstreamHeaders)
+	}
+	entries := logs.FilterMessage("代理配置已加载").All()
+	if len(entries) != 1 {
+		t.Fatalf("期望 1 条加载日志, 得到 %d", len(entries))
+	}
+	logged := fmt.Sprint(entries[0].ContextMap())
+	for _, secret := range []string{"upstream-secret", "beta", "url-token"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("日志不应包含 %s: %s", secret, logged)
+		}
+	}
+	if !strings.Contains(logged, "X-Upstream-Token") || !strings.Contains(logged, "X-Feature-Flag") {
+		t.Errorf("日志应包含 header 名: %s", logged)
+	}
+}
+
+// TestAgentMode 测试上游 agent mode header 按全局配置和是否带工具决定
+func TestAgentMode(t *testing.T) {
+	var mu sync.Mutex
+	var modes []string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		modes = append(modes, r.Header.Get("x-amzn-kiro-agent-mode"))
+		mu.Unlock()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	const toolsField = `"tools":[{"name":"get_weather","description":"d","input_schema":{"type":"object"}}],`
+	send := func(path, extra string) string {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,` + extra + `"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return modes[len(modes)-1]
+	}
+
+	tests := []struct {
+		name       string
+		agentMode  string
+		toolsMode  string
+		path       string
+		extra      string
+		expectMode string
+	}{
+		{"默认值", "", "", "/v1/messages", "", kiroclient.DefaultAgentMode},
+		{"全局配置", "spec", "", "/v1/chat/completions", "", "spec"},
+		{"带工具未配置工具模式", "spec", "", "/v1/messages", toolsField, "spec"},
+		{"带工具使用工具模式", "chat", "agentic", "/v1/messages", toolsField, "agentic"},
+		{"无工具不使用工具模式", "chat", "agentic", "/v1/messages", "", "chat"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyConfig.AgentMode = tt.agentMode
+			proxyConfig.ToolsAgentMode = tt.toolsMode
+			if got := send(tt.path, tt.extra); got != tt.expectMode {
+				t.Errorf("期望 agent mode %q, 得到 %q", tt.expectMode, got)
+			}
+		})
+	}
+}
+
+// TestToolDescriptionOverflow 测试超长工具描述：默认截断并告警计数，reject 模式返回 400
+func TestToolDescriptionOverflow(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	longDesc := strings.Repeat("a", maxToolDescriptionLength+100)
+	tools := []interface{}{map[string]interface{}{"name": "search", "description": longDesc}}
+
+	// 默认 truncate：告警包含工具名和原始长度，转换时截断并计数
+	warnings, err := validateClaudeTools(tools)
+	if err != nil || len(warnings) != 1 || !strings.Contains(warnings[0], "search") || !strings.Contains(warnings[0], fmt.Sprint(len(longDesc))) {
+		t.Fatalf("truncate 模式应给出告警, warnings=%v err=%v", warnings, err)
+	}
+	before := toolDescriptionTruncations.Load()
+	kiroTools, _ := convertClaudeTools(tools)
+	if got := kiroTools[0].ToolSpecification.Description; len(got) != maxToolDescriptionLength+3 || !strings.HasSuffix(got, "...") {
+		t.Errorf("描述应被截断, 长度 %d", len(got))
+	}
+	if toolDescriptionTruncations.Load() != before+1 {
+		t.Error("截断应计数")
+	}
+
+	// 未超长的描述不告警
+	if warnings, _ := validateClaudeTools([]interface{}{map[string]interface{}{"name": "ok", "description": "short"}}); len(warnings) != 0 {
+		t.Errorf("正常描述不应告警: %v", warnings)
+	}
+
+	// reject：端到端返回 400，不发往上游
+	proxyConfig.ToolDescriptionOverflow = kiroclient.ToolDescriptionReject
+	if _, err := validateClaudeTools(tools); err == nil || !strings.Contains(err.Error(), "tools[0] (search)") {
+		t.Errorf("reject 模式应返回错误, 得到 %v", err)
+	}
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body, _ := json.Marshal(map[string]any{
+		"model": "claude-sonnet-4.5", "max_tokens": 100,
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+		"tools":    tools,
+	})
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "description") {
+		t.Errorf("reject 模式应返回 400, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestToolLimits 测试工具数量和 schema 总大小上限：超出时 400 并给出上限和实际值
+func TestToolLimits(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	makeTools := func(n int, schema map[string]any) []interface{} {
+		tools := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			tools = append(tools, map[string]interface{}{"name": fmt.Sprintf("tool_%d", i), "input_schema": schema})
+		}
+		return tools
+	}
+	schema := map[string]any{"type": "object", "properties": map[string]any{"q": map[string]any{"type": "string"}}}
+	schemaJSON, _ := json.Marshal(schema)
+	schemaSize := len(schemaJSON)
+
+	// 未配置上限时不限制
+	if _, err := validateClaudeTools(makeTools(50, schema)); err != nil {
+		t.Fatalf("未配置上限时不应拒绝: %v", err)
+	}
+
+	// 工具数量超限
+	proxyConfig.MaxTools = 3
+	if _, err := validateClaudeTools(makeTools(3, schema)); err != nil {
+		t.Errorf("等于上限时不应拒绝: %v", err)
+	}
+	_, err := validateClaudeTools(makeTools(4, schema))
+	if err == nil || !strings.Contains(err.Error(), "4") || !strings.Contains(err.Error(), "3") {
+		t.Errorf("超出数量上限应返回包含实际数量和上限的错误, 得到 %v", err)
+	}
+
+	// schema 总大小超限（按序列化后的字节数累计）
+	proxyConfig.MaxTools = 0
+	proxyConfig.MaxTotalToolSchemaBytes = schemaSize * 2
+	if _, err := validateClaudeTools(makeTools(2, schema)); err != nil {
+		t.Errorf("等于上限时不应拒绝: %v", err)
+	}
+	_, err = validateClaudeTools(makeTools(3, schema))
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprint(schemaSize*3)) || !strings.Contains(err.Error(), fmt.Sprint(schemaSize*2)) {
+		t.Errorf("超出大小上限应返回包含实际大小和上限的错误, 得到 %v", err)
+	}
+
+	// 端到端返回 400，不发往上游
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body, _ := json.Marshal(map[string]any{
+		"model": "claude-sonnet-4.5", "max_tokens": 100,
+		"messages": []any{map[string]any{"role": "user", "content": "hi"}},
+		"tools":    makeTools(3, schema),
+	})
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "input_schema") {
+		t.Errorf("超出上限应返回 400, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestValidateClaudeTools 测试工具定义校验：缺失/null 的 input_schema 补默认值，非对象的直接拒绝
+func TestValidateClaudeTools(t *testing.T) {
+	parse := func(s string) any {
+		var v any
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			t.Fatalf("解析 tools 失败: %v", err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name         string
+		tools        string
+		wantErr      bool
+		wantWarnings int
+	}{
+		{"缺失 input_schema", `[{"name":"ping"}]`, false, 0},
+		{"null input_schema", `[{"name":"ping","input_schema":null}]`, false, 0},
+		{"字符串 input_schema", `[{"name":"ping","input_schema":"object"}]`, true, 0},
+		{"数组 input_schema", `[{"name":"ping","input_schema":[]}]`, true, 0},
+		{"缺少 name", `[{"input_schema":{"type":"object"}}]`, true, 0},
+		{"工具不是对象", `["ping"]`, true, 0},
+		{"tools 不是数组", `{"name":"ping"}`, true, 0},
+		{"不规范的 schema", `[{"name":"ping","input_schema":{"type":"string","properties":[],"required":"a"}}]`, false, 3},
+		{"正常", `[{"name":"ping","input_schema":{"type":"object","properties":{},"required":["a"]}}]`, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings, err := validateClaudeTools(parse(tt.tools))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("期望 err=%v, 得到 %v", tt.wantErr, err)
+			}
+			if len(warnings) != tt.wantWarnings {
+				t.Errorf("期望 %d 条警告, 得到 %v", tt.wantWarnings, warnings)
+			}
+		})
+	}
+
+	// 缺失和 null 的 input_schema 转换后都是空 object schema
+	kiroTools, _ := convertClaudeTools(parse(`[{"name":"a"},{"name":"b","input_schema":null}]`))
+	if len(kiroTools) != 2 {
+		t.Fatalf("期望 2 个工具, 得到 %d", len(kiroTools))
+	}
+	for _, kt := range kiroTools {
+		schema := kt.ToolSpecification.InputSchema
+		if schema["type"] != "object" || schema["properties"] == nil {
+			t.Errorf("%s 应补默认 schema, 得到 %v", kt.ToolSpecification.Name, schema)
+		}
+	}
+
+	// 端到端：非对象的 input_schema 返回 400
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"tools":[{"name":"ping","input_schema":"bad"}],"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), "input_schema") {
+		t.Errorf("非对象 input_schema 应返回 400, 得到 %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// TestParallelToolUses 测试一轮中多个 tool_use：流式各占一个 content block，非流式各占一个 content 项，stop_reason 为 tool_use
+func TestParallelToolUses(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"读取两个文件"}`))
+		_, _ = w.Write(encodeEventStreamMessage("toolUseEvent", `{"toolUseId":"toolu_1","name":"Read","input":"{\"file_path\":\"a.txt\"}","stop":true}`))
+		_, _ = w.Write(encodeEventStreamMessage("toolUseEvent", `{"toolUseId":"toolu_2","name":"Read","input":"{\"file_path\":"}`))
+		_, _ = w.Write(encodeEventStreamMessage("toolUseEvent", `{"toolUseId":"toolu_2","name":"Read","input":"\"b.txt\"}","stop":true}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	send := func(stream bool) string {
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":%v,
+			"tools":[{"name":"Read","input_schema":{"type":"object","properties":{"file_path":{"type":"string"}},"required":["file_path"]}}],
+			"messages":[{"role":"user","content":"读取 a.txt 和 b.txt"}]}`, stream)
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	t.Run("流式", func(t *testing.T) {
+		var starts []map[string]any
+		stopReason := ""
+		for _, line := range strings.Split(send(true), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+			var evt map[string]any
+			if json.Unmarshal([]byte(data), &evt) != nil {
+				continue
+			}
+			switch evt["type"] {
+			case "content_block_start":
+				starts = append(starts, evt)
+			case "message_delta":
+				stopReason, _ = evt["delta"].(map[string]any)["stop_reason"].(string)
+			}
+		}
+
+		var toolIDs []string
+		for i, s := range starts {
+			if int(s["index"].(float64)) != i {
+				t.Errorf("content block index 应连续递增: 第 %d 个为 %v", i, s["index"])
+			}
+			if block := s["content_block"].(map[string]any); block["type"] == "tool_use" {
+				toolIDs = append(toolIDs, block["id"].(string))
+			}
+		}
+		if strings.Join(toolIDs, ",") != "toolu_1,toolu_2" {
+			t.Errorf("期望两个独立的 tool_use block, 得到 %v", toolIDs)
+		}
+		if stopReason != stopReasonToolUse {
+			t.Errorf("stop_reason 应为 tool_use, 得到 %q", stopReason)
+		}
+	})
+
+	t.Run("非流式", func(t *testing.T) {
+		var resp struct {
+			StopReason string           `json:"stop_reason"`
+			Content    []map[string]any `json:"content"`
+		}
+		if err := json.Unmarshal([]byte(send(false)), &resp); err != nil {
+			t.Fatalf("解析响应失败: %v", err)
+		}
+		var inputs []string
+		for _, block := range resp.Content {
+			if block["type"] == "tool_use" {
+				inputs = append(inputs, fmt.Sprintf("%s=%v", block["id"], block["input"].(map[string]any)["file_path"]))
+			}
+		}
+		if strings.Join(inputs, ",") != "toolu_1=a.txt,toolu_2=b.txt" {
+			t.Errorf("期望两个独立的 tool_use 项, 得到 %v", inputs)
+		}
+		if resp.StopReason != stopReasonToolUse {
+			t.Errorf("stop_reason 应为 tool_use, 得到 %q", resp.StopReason)
+		}
+	})
+}
+
+// TestHandleChat_Usage 测试内部 /api/chat 接口在流式和非流式响应中都返回 usage
+func TestHandleChat_Usage(t *testing.T) {
+	withUsage := true
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"你好"}`))
+		if withUsage {
+			_, _ = w.Write(encodeEventStreamMessage("meteringEvent", `{"usage":1.5}`))
+			_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"tokenUsage":{"uncachedInputTokens":10,"outputTokens":3,"cacheReadInputTokens":5}}`))
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/api/chat", handleChat)
+	send := func(stream bool) string {
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+		req, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	var resp struct {
+		Content        string               `json:"content"`
+		Usage          kiroclient.KiroUsage `json:"usage"`
+		UsageEstimated bool                 `json:"usageEstimated"`
+	}
+	if err := json.Unmarshal([]byte(send(false)), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if resp.Content != "你好" || resp.UsageEstimated || resp.Usage.OutputTokens != 3 || resp.Usage.Credits != 1.5 {
+		t.Errorf("非流式响应应包含精确 usage: %+v", resp)
+	}
+
+	// 流式：usage 单独一条，位于 [DONE] 之前
+	out := send(true)
+	usageIdx := strings.Index(out, `"usage":{`)
+	doneIdx := strings.Index(out, "data: [DONE]")
+	if usageIdx < 0 || doneIdx < 0 || usageIdx > doneIdx {
+		t.Errorf("流式响应应在 [DONE] 前发送 usage: %s", out)
+	}
+	if !strings.Contains(out, `"outputTokens":3`) {
+		t.Errorf("流式 usage 应为精确值: %s", out)
+	}
+
+	// 上游没有用量信息时返回估算值
+	withUsage = false
+	resp.UsageEstimated = false
+	_ = json.Unmarshal([]byte(send(false)), &resp)
+	if !resp.UsageEstimated || resp.Usage.InputTokens == 0 {
+		t.Errorf("无上游 usage 时应返回估算值: %+v", resp)
+	}
+}
+
+// TestHandleChat_StreamErrorEscaped 测试 /api/chat 流式出错时，错误信息中的引号、换行被正确转义，错误帧可解析为 {"error": ...}
+func TestHandleChat_StreamErrorEscaped(t *testing.T) {
+	errMessage := "bad \"request\"\n"
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"你好"}`))
+		_, _ = w.Write(encodeEventStreamFrame("", ":message-type", "error", ":error-message", errMessage))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/api/chat", handleChat)
+	body := `{"model":"claude-sonnet-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+	req, _ := http.NewRequest("POST", "/api/chat", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	frames := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	data, ok := strings.CutPrefix(frames[len(frames)-1], "data: ")
+	if !ok {
+		t.Fatalf("最后一帧应为 data 帧: %q", w.Body.String())
+	}
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		t.Fatalf("错误帧不是合法 JSON: %q (%v)", data, err)
+	}
+	if !strings.Contains(payload.Error, errMessage) {
+		t.Errorf("错误帧应包含原始错误信息, got %q", payload.Error)
+	}
+}
+
+// TestDefaultModel 测试客户端未指定模型时使用配置的默认模型，未配置时保持为空
+func TestDefaultModel(t *testing.T) {
+	var mu sync.Mutex
+	var lastBody string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		lastBody = string(body)
+		mu.Unlock()
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path, model string) string {
+		body := fmt.Sprintf(`{"model":%q,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`, model)
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return lastBody
+	}
+
+	// 未配置：保持原行为，不带 modelId
+	if body := send("/v1/messages", ""); strings.Contains(body, `"modelId"`) {
+		t.Errorf("未配置默认模型时不应指定 modelId: %s", body)
+	}
+
+	proxyConfig.DefaultModel = "claude-haiku-4.5"
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		if body := send(path, ""); !strings.Contains(body, `"modelId":"claude-haiku-4.5"`) {
+			t.Errorf("%s 未指定模型时应使用默认模型: %s", path, body)
+		}
+		// 客户端显式指定的模型优先
+		if body := send(path, "claude-sonnet-4.5"); !strings.Contains(body, `"modelId":"claude-sonnet-4.5"`) {
+			t.Errorf("%s 显式指定的模型应优先: %s", path, body)
+		}
+	}
+
+	// 默认模型同样受禁用检查约束
+	proxyConfig.DisabledModels = []string{"claude-haiku-4.5"}
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Errorf("被禁用的默认模型应返回 403, 得到 %d", w.Code)
+	}
+}
+
+// TestListAccounts_UsageFallback 测试额度查询失败时返回缓存值并标记为 cached，没有缓存时标记为 unknown 而不是 0
+func TestListAccounts_UsageFallback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer token-ok" {
+			_, _ = w.Write([]byte(`{"usageBreakdownList":[{"resourceType":"CREDIT","currentUsageWithPrecision":5,"usageLimitWithPrecision":50}]}`))
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+
+	oldClient := client
+	defer func() { client = oldClient }()
+	client = kiroclient.NewKiroClient()
+	client.Auth.SetHTTPClientForTest(&http.Client{Transport: rewriteTransport{target: target}})
+	account := func(id, token string) kiroclient.AccountInfo {
+		return kiroclient.AccountInfo{ID: id, ProfileArn: "arn:" + id, Token: &kiroclient.KiroAuthToken{
+			AccessToken: token,
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		}}
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: []kiroclient.AccountInfo{
+		account("live", "token-ok"),
+		account("cached", "token-bad"),
+		account("unknown", "token-bad"),
+	}})
+	client.Auth.SetUsageCacheForTest("cached", 10, 100)
+
+	router := gin.New()
+	router.GET("/api/accounts", handleListAccounts)
+	req, _ := http.NewRequest("GET", "/api/accounts", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp struct {
+		Accounts []AccountWithUsage `json:"accounts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Accounts) != 3 {
+		t.Fatalf("响应解析失败: %s", w.Body.String())
+	}
+	byID := make(map[string]AccountWithUsage)
+	for _, acc := range resp.Accounts {
+		byID[acc.ID] = acc
+	}
+
+	if a := byID["live"]; a.UsageStatus != usageStatusLive || a.UsageStale || a.UsedCredits != 5 || a.TotalCredits != 50 {
+		t.Errorf("实时额度不正确: %+v", a.UsageFreshness)
+	}
+	if a := byID["cached"]; a.UsageStatus != usageStatusCached || !a.UsageStale || a.UsageUpdatedAt == "" || a.UsedCredits != 10 || a.TotalCredits != 100 {
+		t.Errorf("查询失败时应返回缓存值: %+v used=%v total=%v", a.UsageFreshness, a.UsedCredits, a.TotalCredits)
+	}
+	if a := byID["unknown"]; a.UsageStatus != usageStatusUnknown {
+		t.Errorf("没有缓存时应标记为 unknown: %+v", a.UsageFreshness)
+	}
+	if cache, ok := client.Auth.GetCachedUsage("live"); !ok || cache.UsedCredits != 5 {
+		t.Errorf("实时查询成功后应刷新额度缓存: %+v", cache)
+	}
+}
+
+// TestListAccounts_QueriesUsageConcurrently 测试账号列表并发查询各账号额度，总耗时不随账号数线性增长
+func TestListAccounts_QueriesUsageConcurrently(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte(`{"usageBreakdownList":[{"resourceType":"CREDIT","currentUsageWithPrecision":5,"usageLimitWithPrecision":50}]}`))
+	}))
+	defer srv.Close()
+	target, _ := url.Parse(srv.URL)
+
+	oldClient := client
+	defer func() { client = oldClient }()
+	client = kiroclient.NewKiroClient()
+	client.Auth.SetHTTPClientForTest(&http.Client{Transport: rewriteTransport{target: target}})
+	var accounts []kiroclient.AccountInfo
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("acc-%d", i)
+		accounts = append(accounts, kiroclient.AccountInfo{ID: id, ProfileArn: "arn:" + id, Token: &kiroclient.KiroAuthToken{
+			AccessToken: "token-" + id,
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		}})
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: accounts})
+
+	router := gin.New()
+	router.GET("/api/accounts", handleListAccounts)
+	req, _ := http.NewRequest("GET", "/api/accounts", nil)
+	w := httptest.NewRecorder()
+	start := time.Now()
+	router.ServeHTTP(w, req)
+	if elapsed := time.Since(start); elapsed >= 2*delay {
+		t.Errorf("额度查询应并发进行, 4 个账号耗时 %v", elapsed)
+	}
+
+	var resp struct {
+		Accounts []AccountWithUsage `json:"accounts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || len(resp.Accounts) != 4 {
+		t.Fatalf("响应解析失败: %s", w.Body.String())
+	}
+	for i, acc := range resp.Accounts {
+		if acc.ID != accounts[i].ID || acc.UsageStatus != usageStatusLive || acc.UsedCredits != 5 {
+			t.Errorf("第 %d 个账号额度不正确（应保持原顺序）: %+v", i, acc)
+		}
+	}
+}
+
+// TestRateLimit_KeyByAPIKey 按 apiKey 限流时同一 IP 的不同有效 key 各自计数，未带 key 或 key 无效的请求回退到按 IP
+func TestRateLimit_KeyByAPIKey(t *testing.T) {
+	oldConfig, oldCounts, oldKeys := rateLimitConfig, requestCounts, apiKeys
+	rateLimitConfig = RateLimitConfig{Enabled: true, RequestsPerMin: 2, KeyBy: RateLimitKeyByAPIKey}
+	requestCounts = make(map[string]*RequestCounter)
+	apiKeys = []string{"key-aaaa-secret", "key-bbbb-secret"}
+	defer func() { rateLimitConfig, requestCounts, apiKeys = oldConfig, oldCounts, oldKeys }()
+
+	router := gin.New()
+	router.POST("/v1/messages", rateLimitMiddleware(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"ok": true})
+	})
+	send := func(apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/messages", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i, want := range []string{"1", "0"} {
+		w := send("key-aaaa-secret")
+		if w.Code != 200 || w.Header().Get(HeaderXRateLimitRemaining) != want {
+			t.Fatalf("key-a 第 %d 次请求期望 200 且剩余 %s, 得到 %d / %q", i+1, want, w.Code, w.Header().Get(HeaderXRateLimitRemaining))
+		}
+	}
+	if w := send("key-aaaa-secret"); w.Code != 429 || w.Header().Get(HeaderXRateLimitRemaining) != "0" {
+		t.Errorf("key-a 超限应返回 429 且剩余 0, 得到 %d / %q", w.Code, w.Header().Get(HeaderXRateLimitRemaining))
+	}
+	// 同一 IP 的另一个 key 有独立的窗口
+	if w := send("key-bbbb-secret"); w.Code != 200 || w.Header().Get(HeaderXRateLimitRemaining) != "1" {
+		t.Errorf("key-b 应有独立窗口, 得到 %d / %q", w.Code, w.Header().Get(HeaderXRateLimitRemaining))
+	}
+	// 未带 key 的请求按 IP 计数，也不受 key-a 影响
+	if w := send(""); w.Code != 200 {
+		t.Errorf("未带 key 的请求应按 IP 计数, 得到 %d", w.Code)
+	}
+	// 无效 key 不能换一个 key 就拿到新窗口，和未带 key 的请求共用 IP 窗口
+	if w := send("random-1"); w.Code != 200 {
+		t.Errorf("无效 key 应按 IP 计数, 得到 %d", w.Code)
+	}
+	if w := send("random-2"); w.Code != 429 {
+		t.Errorf("换一个无效 key 不应绕过 IP 限流, 得到 %d", w.Code)
+	}
+	// 计数器按 key 标识保存，不留明文 key
+	for key := range requestCounts {
+		if strings.Contains(key, "secret") || strings.Contains(key, "random") {
+			t.Errorf("限流计数器不应以明文 key 为键: %q", key)
+		}
+	}
+
+	// 按 IP 限流时同一 IP 的不同 key 共用窗口
+	rateLimitConfig.KeyBy = RateLimitKeyByIP
+	requestCounts = make(map[string]*RequestCounter)
+	send("key-aaaa-secret")
+	send("key-bbbb-secret")
+	if w := send("random-3"); w.Code != 429 {
+		t.Errorf("按 IP 限流时同一 IP 应共用窗口, 得到 %d", w.Code)
+	}
+}
+
+// TestRateLimit_BucketNoBoundaryBurst 固定窗口在边界前后可放过 2 倍请求，令牌桶不会
+func TestRateLimit_BucketNoBoundaryBurst(t *testing.T) {
+	oldCounts := requestCounts
+	defer func() { requestCounts = oldCounts }()
+
+	const limit = 60
+	start := time.Unix(1_700_000_000, 0)
+	// 从窗口末尾前 1 秒到下一个窗口开头，共 2 秒内连续请求
+	burstWithin := func(take func(now time.Time) bool) int {
+		allowed := 0
+		for i := 0; i < 4*limit; i++ {
+			now := start.Add(59 * time.Second)
+			if i >= 2*limit {
+				now = start.Add(60 * time.Second)
+			}
+			if take(now) {
+				allowed++
+			}
+		}
+		return allowed
+	}
+
+	requestCounts = make(map[string]*RequestCounter)
+	countWindowRequest("ip:1.2.3.4", limit, start) // 窗口从 start 开始
+	windowAllowed := burstWithin(func(now time.Time) bool {
+		ok, _ := countWindowRequest("ip:1.2.3.4", limit, now)
+		return ok
+	})
+	if windowAllowed < 2*limit-1 {
+		t.Fatalf("固定窗口在边界前后应放过约 2 倍请求, 得到 %d", windowAllowed)
+	}
+
+	requestCounts = make(map[string]*RequestCounter)
+	takeBucketToken("ip:1.2.3.4", limit, 0, start)
+	bucketAllowed := burstWithin(func(now time.Time) bool {
+		ok, _ := takeBucketToken("ip:1.2.3.4", limit, 0, now)
+		return ok
+	})
+	// 满桶 limit 个（首个请求消耗的令牌已在 59 秒内补满）+ 边界 1 秒内补充的 1 个
+	if bucketAllowed > limit+1 {
+		t.Errorf("令牌桶在边界前后最多放过 %d 个请求, 得到 %d", limit+1, bucketAllowed)
+	}
+
+	// 自定义突发容量，空桶按 limit/60 每秒补充
+	requestCounts = make(map[string]*RequestCounter)
+	for i := 0; i < 5; i++ {
+		if ok, _ := takeBucketToken("k", limit, 5, start); !ok {
+			t.Fatalf("容量 5 的桶第 %d 个请求应放行", i+1)
+		}
+	}
+	if ok, remaining := takeBucketToken("k", limit, 5, start); ok || remaining != 0 {
+		t.Errorf("桶空后应拒绝, 得到 ok=%v remaining=%d", ok, remaining)
+	}
+	if ok, _ := takeBucketToken("k", limit, 5, start.Add(time.Second)); !ok {
+		t.Error("1 秒后应补充 1 个令牌")
+	}
+}
+
+// TestRateLimit_PruneIdleCounters 窗口已结束或令牌桶已补满的计数器被清理，仍在计数的保留
+func TestRateLimit_PruneIdleCounters(t *testing.T) {
+	oldCounts := requestCounts
+	requestCounts = make(map[string]*RequestCounter)
+	defer func() { requestCounts = oldCounts }()
+
+	now := time.Unix(1_700_000_000, 0)
+	countWindowRequest("ip:window-old", 60, now.Add(-2*time.Minute))
+	countWindowRequest("ip:window-live", 60, now.Add(-10*time.Second))
+	takeBucketToken("ip:bucket-old", 60, 0, now.Add(-2*time.Minute))
+	takeBucketToken("ip:bucket-live", 60, 0, now.Add(-10*time.Second))
+
+	pruneRequestCounts(60, 0, now)
+	for _, key := range []string{"ip:window-old", "ip:bucket-old"} {
+		if _, ok := requestCounts[key]; ok {
+			t.Errorf("空闲计数器 %s 应被清理", key)
+		}
+	}
+	for _, key := range []string{"ip:window-live", "ip:bucket-live"} {
+		if _, ok := requestCounts[key]; !ok {
+			t.Errorf("仍在计数的 %s 不应被清理", key)
+		}
+	}
+}
+
+// TestRateLimit_BucketMiddleware bucket 模式桶空时返回与 window 模式相同的 429
+func TestRateLimit_BucketMiddleware(t *testing.T) {
+	oldConfig, oldCounts := rateLimitConfig, requestCounts
+	rateLimitConfig = RateLimitConfig{Enabled: true, RequestsPerMin: 60, Mode: RateLimitModeBucket, Burst: 2}
+	requestCounts = make(map[string]*RequestCounter)
+	defer func() { rateLimitConfig, requestCounts = oldConfig, oldCounts }()
+
+	router := gin.New()
+	router.POST("/v1/messages", rateLimitMiddleware(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"ok": true})
+	})
+	codes := make([]int, 0, 3)
+	var last *httptest.ResponseRecorder
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("POST", "/v1/messages", nil)
+		last = httptest.NewRecorder()
+		router.ServeHTTP(last, req)
+		codes = append(codes, last.Code)
+	}
+	if codes[0] != 200 || codes[1] != 200 || codes[2] != 429 {
+		t.Fatalf("容量 2 的桶期望 [200 200 429], 得到 %v", codes)
+	}
+	var resp map[string]any
+	_ = json.Unmarshal(last.Body.Bytes(), &resp)
+	if errObj, _ := resp["error"].(map[string]any); errObj["type"] != "rate_limit_error" {
+		t.Errorf("429 应与 window 模式相同的错误结构: %s", last.Body.String())
+	}
+}
+
+// BenchmarkRateLimit_Window 固定窗口模式单次计数开销
+func BenchmarkRateLimit_Window(b *testing.B) {
+	benchmarkRateLimit(b, func(key string, now time.Time) { countWindowRequest(key, 60, now) })
+}
+
+// BenchmarkRateLimit_Bucket 令牌桶模式单次取令牌开销
+func BenchmarkRateLimit_Bucket(b *testing.B) {
+	benchmarkRateLimit(b, func(key string, now time.Time) { takeBucketToken(key, 60, 0, now) })
+}
+
+// benchmarkRateLimit 在持锁的情况下对 100 个 key 轮流计数（与中间件的加锁方式一致）
+func benchmarkRateLimit(b *testing.B, take func(key string, now time.Time)) {
+	oldCounts := requestCounts
+	requestCounts = make(map[string]*RequestCounter)
+	defer func() { requestCounts = oldCounts }()
+
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip:10.0.0.%d", i)
+	}
+	now := time.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		requestCountsMutex.Lock()
+		take(keys[i%len(keys)], now.Add(time.Duration(i)*time.Millisecond))
+		requestCountsMutex.Unlock()
+	}
+}
+
+// TestClientCancelled_Records499 客户端中途断开的请求按 499 计入状态码，不计成功/失败，也不计入熔断统计
+func TestClientCancelled_Records499(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+	})
+	defer cleanup()
+	defer close(release)
+	// 两个账号走加权选择，才会记录最后选中的账号
+	accounts := []kiroclient.AccountInfo{}
+	for _, id := range []string{"cancel-acc-1", "cancel-acc-2"} {
+		accounts = append(accounts, kiroclient.AccountInfo{ID: id, Token: &kiroclient.KiroAuthToken{
+			AccessToken: "mock-token",
+			ExpiresAt:   time.Now().Add(time.Hour).Format(time.RFC3339),
+		}})
+		defer removeAccountStats(id)
+	}
+	client.Auth.SetAccountsCacheForTest(&kiroclient.AccountsConfig{Accounts: accounts})
+	oldCircuitStats := circuitStats
+	circuitStats = NewCircuitStats()
+	defer func() {
+		circuitStats.Close()
+		circuitStats = oldCircuitStats
+	}()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	req, _ := http.NewRequestWithContext(ctx, "POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"claude-sonnet-4.5","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	accountID, _ := client.Auth.GetLastSelectedAccountInfo()
+	stats := getAccountStats()[accountID]
+	if stats == nil {
+		t.Fatalf("断开的请求应记入账号统计: %q", accountID)
+	}
+	if stats.StatusCodes[StatusClientClosedRequest] != 1 {
+		t.Errorf("应记录 1 次 499, 得到 %v", stats.StatusCodes)
+	}
+	if stats.SuccessCount != 0 || stats.FailCount != 0 || stats.RequestCount != 0 {
+		t.Errorf("499 不应计入请求数和成功/失败: %+v", stats)
+	}
+	if _, total := circuitStats.GetErrorRate(accountID, 1); total != 0 {
+		t.Errorf("499 不应计入熔断统计, 得到 %d 次", total)
+	}
+}
+
+// TestIpBlacklist_CIDR 黑名单支持 CIDR 网段：网段内的 IP 被拦截、网段外放行，非法条目被拒绝，乐观锁照常生效
+func TestIpBlacklist_CIDR(t *testing.T) {
+	useMemoryStorage(t)
+	ipBlacklistMutex.Lock()
+	oldList, oldMatcher := ipBlacklist, ipBlacklistMatcher
+	ipBlacklistMutex.Unlock()
+	defer func() {
+		ipBlacklistMutex.Lock()
+		ipBlacklist, ipBlacklistMatcher = oldList, oldMatcher
+		ipBlacklistMutex.Unlock()
+	}()
+
+	router := gin.New()
+	router.Use(ipBlacklistMiddleware())
+	router.GET("/ping", func(c *gin.Context) { c.String(200, "pong") })
+	router.GET("/api/settings/ip-blacklist", handleGetIpBlacklist)
+	router.POST("/api/settings/ip-blacklist", handleUpdateIpBlacklist)
+
+	update := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/settings/ip-blacklist", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = "127.0.0.1:1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	pingFrom := func(ip string) int {
+		req, _ := http.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if w := update(`{"ips":["192.168.1.0/24"," 10.0.0.1 "]}`); w.Code != 200 {
+		t.Fatalf("更新黑名单期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	for ip, want := range map[string]int{
+		"192.168.1.0":   403,
+		"192.168.1.77":  403,
+		"192.168.1.255": 403,
+		"192.168.2.0":   200, // 紧邻网段之外
+		"192.168.0.255": 200,
+		"10.0.0.1":      403,
+		"10.0.0.2":      200,
+	} {
+		if got := pingFrom(ip); got != want {
+			t.Errorf("%s: 期望 %d, 得到 %d", ip, want, got)
+		}
+	}
+
+	// 非法条目整体拒绝，原黑名单不变
+	for _, bad := range []string{"192.168.1.0/33", "not-an-ip", "300.1.1.1"} {
+		if w := update(`{"ips":["` + bad + `"]}`); w.Code != 400 {
+			t.Errorf("%s: 期望 400, 得到 %d", bad, w.Code)
+		}
+	}
+	if got := pingFrom("192.168.1.77"); got != 403 {
+		t.Errorf("拒绝非法更新后原黑名单应保持生效, 得到 %d", got)
+	}
+
+	// 乐观锁：带当前 hash 可更新，过期 hash 返回 409
+	req, _ := http.NewRequest("GET", "/api/settings/ip-blacklist", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var current struct {
+		Hash string `json:"hash"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &current)
+	if w := update(`{"ips":["172.16.0.0/12"],"hash":"` + current.Hash + `"}`); w.Code != 200 {
+		t.Fatalf("带当前 hash 更新期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if w := update(`{"ips":["172.16.0.0/12"],"hash":"` + current.Hash + `"}`); w.Code != 409 {
+		t.Errorf("过期 hash 期望 409, 得到 %d", w.Code)
+	}
+	if got := pingFrom("172.31.255.255"); got != 403 {
+		t.Errorf("新网段应生效, 得到 %d", got)
+	}
+	if got := pingFrom("192.168.1.77"); got != 200 {
+		t.Errorf("旧网段应已移除, 得到 %d", got)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 维护模式 ==========
+// 为什么：上游故障或计划维护期间，与其让每个请求各自超时/失败，不如直接返回统一的友好提示
+// 只拦截 /v1 和 /anthropic 的代理接口，/api 管理接口不受影响，便于随时关闭
+
+// 维护模式默认响应
+const (
+	defaultMaintenanceStatusCode = 503
+	defaultMaintenanceMessage    = "Service is under maintenance, please retry later"
+)
+
+var maintenanceFile = "maintenance.json"
+var maintenanceConfig = defaultMaintenanceConfig()
+var maintenanceMutex sync.RWMutex
+
+// MaintenanceConfig 维护模式配置
+type MaintenanceConfig struct {
+	Enabled           bool     `json:"enabled"`
+	StatusCode        int      `json:"statusCode"`        // 返回的 HTTP 状态码（400-599）
+	Message           string   `json:"message"`           // 返回给客户端的提示
+	RetryAfterSeconds int      `json:"retryAfterSeconds"` // >0 时附带 Retry-After 头
+	BypassApiKeyIds   []string `json:"bypassApiKeyIds"`   // 不受维护模式影响的 API-KEY 标识（前 8 位），用于维护期间自测
+}
+
+// defaultMaintenanceConfig 默认配置（关闭）
+func defaultMaintenanceConfig() MaintenanceConfig {
+	return MaintenanceConfig{
+		StatusCode:      defaultMaintenanceStatusCode,
+		Message:         defaultMaintenanceMessage,
+		BypassApiKeyIds: []string{},
+	}
+}
+
+// validateMaintenanceConfig 校验并规范化维护模式配置：未填写的状态码和提示使用默认值，API-KEY 必须已存在
+func validateMaintenanceConfig(cfg *MaintenanceConfig) (int, error) {
+	if cfg.StatusCode == 0 {
+		cfg.StatusCode = defaultMaintenanceStatusCode
+	}
+	if cfg.StatusCode < 400 || cfg.StatusCode > 599 {
+		return 400, fmt.Errorf("statusCode 必须在 400-599 之间，收到 %d", cfg.StatusCode)
+	}
+	if cfg.Message == "" {
+		cfg.Message = defaultMaintenanceMessage
+	}
+	if cfg.RetryAfterSeconds < 0 {
+		return 400, fmt.Errorf("retryAfterSeconds 不能为负数")
+	}
+	ids := make([]string, 0, len(cfg.BypassApiKeyIds))
+	for _, id := range cfg.BypassApiKeyIds {
+		index, code, msg := findApiKeyIndex(id)
+		if index == -1 {
+			return code, fmt.Errorf("bypassApiKeyIds: %s", msg)
+		}
+		ids = append(ids, apiKeyID(apiKeys[index]))
+	}
+	cfg.BypassApiKeyIds = ids
+	return 0, nil
+}
+
+// loadMaintenanceConfig 加载维护模式配置
+func loadMaintenanceConfig() {
+	data, err := storage.Get(maintenanceFile)
+	if err != nil {
+		return
+	}
+	cfg := defaultMaintenanceConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		if logger != nil {
+			logger.Warn("", "维护模式配置无效，已忽略", map[string]any{"error": err.Error()})
+		}
+		return
+	}
+	maintenanceMutex.Lock()
+	maintenanceConfig = cfg
+	maintenanceMutex.Unlock()
+	if logger != nil {
+		logger.Info("", "维护模式配置已加载", map[string]any{
+			"enabled":    cfg.Enabled,
+			"statusCode": cfg.StatusCode,
+		})
+	}
+}
+
+// saveMaintenanceConfig 保存维护模式配置
+func saveMaintenanceConfig(cfg MaintenanceConfig) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.Put(maintenanceFile, data)
+}
+
+// maintenanceMiddleware 维护模式开启时直接返回固定响应，按请求格式组织错误体
+// 放在 apiKeyAuthMiddleware 之后：需要已验证的 API-KEY 标识来判断是否放行
+func maintenanceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		maintenanceMutex.RLock()
+		cfg := maintenanceConfig
+		maintenanceMutex.RUnlock()
+		if !cfg.Enabled {
+			c.Next()
+			return
+		}
+		if keyID := getAPIKeyID(c); keyID != "" && slices.Contains(cfg.BypassApiKeyIds, keyID) {
+			c.Next()
+			return
+		}
+
+		if cfg.RetryAfterSeconds > 0 {
+			c.Header("Retry-After", strconv.Itoa(cfg.RetryAfterSeconds))
+		}
+		if c.Request.URL.Path == "/v1/chat/completions" {
+			// OpenAI 格式
+			errorJSONWithMsgId(c, cfg.StatusCode, map[string]any{
+				"message": cfg.Message,
+				"type":    "server_error",
+				"code":    "maintenance",
+			})
+		} else {
+			// Claude 格式
+			c.JSON(cfg.StatusCode, gin.H{"type": "error", "error": map[string]any{
+				"type":    "overloaded_error",
+				"message": cfg.Message,
+			}, "msgId": GetMsgID(c)})
+		}
+		c.Abort()
+	}
+}
+
+// handleGetMaintenance 获取维护模式配置
+func handleGetMaintenance(c *gin.Context) {
+	maintenanceMutex.RLock()
+	cfg := maintenanceConfig
+	maintenanceMutex.RUnlock()
+	c.JSON(200, gin.H{"config": cfg})
+}
+
+// handleUpdateMaintenance 更新维护模式配置（开关立即生效）
+func handleUpdateMaintenance(c *gin.Context) {
+	cfg := defaultMaintenanceConfig()
+	if err := c.ShouldBindJSON(&cfg); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if code, err := validateMaintenanceConfig(&cfg); err != nil {
+		c.JSON(code, gin.H{"error": err.Error()})
+		return
+	}
+
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	if err := saveMaintenanceConfig(cfg); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+	maintenanceConfig = cfg
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "维护模式配置已更新", map[string]any{
+			"enabled":    cfg.Enabled,
+			"statusCode": cfg.StatusCode,
+		})
+	}
+	c.JSON(200, gin.H{"message": "维护模式配置已更新", "config": cfg})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupMaintenanceTest 使用临时配置文件和给定的 key 列表，返回挂载了维护模式管理接口和代理接口的路由
+// 代理接口的处理函数直接返回 200，用于判断请求是否被拦截
+func setupMaintenanceTest(t *testing.T, keys ...string) *gin.Engine {
+	t.Helper()
+	oldKeys := apiKeys
+	apiKeys = keys
+	maintenanceMutex.Lock()
+	oldConfig, oldFile := maintenanceConfig, maintenanceFile
+	maintenanceConfig = defaultMaintenanceConfig()
+	maintenanceFile = filepath.Join(t.TempDir(), "maintenance.json")
+	maintenanceMutex.Unlock()
+	t.Cleanup(func() {
+		apiKeys = oldKeys
+		maintenanceMutex.Lock()
+		maintenanceConfig, maintenanceFile = oldConfig, oldFile
+		maintenanceMutex.Unlock()
+	})
+
+	router := gin.New()
+	router.GET("/api/settings/maintenance", handleGetMaintenance)
+	router.POST("/api/settings/maintenance", handleUpdateMaintenance)
+	ok := func(c *gin.Context) { c.JSON(200, gin.H{"ok": true}) }
+	router.POST("/v1/chat/completions", apiKeyAuthMiddleware(), maintenanceMiddleware(), ok)
+	router.POST("/v1/messages", apiKeyAuthMiddleware(), maintenanceMiddleware(), ok)
+	router.POST("/anthropic/v1/messages", apiKeyAuthMiddleware(), maintenanceMiddleware(), ok)
+	return router
+}
+
+// updateMaintenance 调用维护模式配置接口
+func updateMaintenance(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/settings/maintenance", bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// proxyRequest 用指定 key 访问代理接口
+func proxyRequest(router *gin.Engine, path, key string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", path, bytes.NewBufferString(`{}`))
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestMaintenanceMode_Formats 测试开启维护模式后 OpenAI/Claude 接口按各自格式返回配置的状态码和提示
+func TestMaintenanceMode_Formats(t *testing.T) {
+	router := setupMaintenanceTest(t)
+
+	if w := updateMaintenance(router, `{"enabled":true,"statusCode":503,"message":"升级中","retryAfterSeconds":60}`); w.Code != 200 {
+		t.Fatalf("开启维护模式期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	w := proxyRequest(router, "/v1/chat/completions", "")
+	var openai struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	_ = json.Unmarshal(w.Body.Bytes(), &openai)
+	if w.Code != 503 || openai.Error.Message != "升级中" || openai.Error.Code != "maintenance" {
+		t.Errorf("OpenAI 格式错误: %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("应附带 Retry-After, 得到 %q", w.Header().Get("Retry-After"))
+	}
+
+	for _, path := range []string{"/v1/messages", "/anthropic/v1/messages"} {
+		w := proxyRequest(router, path, "")
+		var claude struct {
+			Type  string `json:"type"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &claude)
+		if w.Code != 503 || claude.Type != "error" || claude.Error.Type != "overloaded_error" || claude.Error.Message != "升级中" {
+			t.Errorf("%s Claude 格式错误: %d %s", path, w.Code, w.Body.String())
+		}
+	}
+
+	// 关闭后恢复正常
+	if w := updateMaintenance(router, `{"enabled":false}`); w.Code != 200 {
+		t.Fatalf("关闭维护模式期望 200, 得到 %d", w.Code)
+	}
+	if w := proxyRequest(router, "/v1/messages", ""); w.Code != 200 {
+		t.Errorf("关闭后期望 200, 得到 %d", w.Code)
+	}
+}
+
+// TestMaintenanceMode_BypassApiKeys 测试白名单中的 API-KEY 不受维护模式影响
+func TestMaintenanceMode_BypassApiKeys(t *testing.T) {
+	router := setupMaintenanceTest(t, "sk-aaaa-ops-key", "sk-bbbb-user-key")
+
+	if w := updateMaintenance(router, `{"enabled":true,"statusCode":529,"bypassApiKeyIds":["sk-aaaa-"]}`); w.Code != 200 {
+		t.Fatalf("开启维护模式期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if w := proxyRequest(router, "/v1/messages", "sk-aaaa-ops-key"); w.Code != 200 {
+		t.Errorf("白名单 key 应放行, 得到 %d", w.Code)
+	}
+	if w := proxyRequest(router, "/v1/messages", "sk-bbbb-user-key"); w.Code != 529 {
+		t.Errorf("其他 key 应返回配置的状态码 529, 得到 %d", w.Code)
+	}
+	if w := proxyRequest(router, "/v1/messages", "sk-invalid"); w.Code != 401 {
+		t.Errorf("无效 key 仍应先返回 401, 得到 %d", w.Code)
+	}
+}
+
+// TestMaintenanceMode_Validation 测试非法状态码和不存在的 API-KEY 被拒绝，且配置不变
+func TestMaintenanceMode_Validation(t *testing.T) {
+	router := setupMaintenanceTest(t, "sk-aaaa-ops-key")
+
+	if w := updateMaintenance(router, `{"enabled":true,"statusCode":200}`); w.Code != 400 {
+		t.Errorf("状态码 200 期望 400, 得到 %d", w.Code)
+	}
+	if w := updateMaintenance(router, `{"enabled":true,"bypassApiKeyIds":["sk-zzzz-"]}`); w.Code != 404 {
+		t.Errorf("不存在的 key 期望 404, 得到 %d", w.Code)
+	}
+	if w := proxyRequest(router, "/v1/messages", "sk-aaaa-ops-key"); w.Code != 200 {
+		t.Errorf("校验失败不应开启维护模式, 得到 %d", w.Code)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 按格式的默认 max_tokens ==========
+// 为什么：不同客户端对默认输出上限的预期不同（OpenAI 客户端常常不传 max_tokens），
+// 运维可以按格式给没有设置的客户端一个合理的默认上限；客户端显式传入时总是以客户端为准
+// 生效的值经 ChatOptions.MaxTokens 传给 ChatService，由它在本地截断输出（Kiro API 不接受 max_tokens），
+// 截断时 stop_reason 为 max_tokens（OpenAI finish_reason 为 length）
+
+// 默认 max_tokens 的格式 key（ProxyConfig.DefaultMaxTokens）
+const (
+	maxTokensFormatOpenAI    = "openai"
+	maxTokensFormatClaude    = "claude"
+	maxTokensFormatAnthropic = "anthropic"
+)
+
+// maxTokensFormat 按路由判断请求格式：/anthropic/v1/messages 与 /v1/messages 共用 handler，但可以分别配置
+func maxTokensFormat(c *gin.Context, format string) string {
+	if format == "claude" && strings.HasPrefix(c.Request.URL.Path, "/anthropic/") {
+		return maxTokensFormatAnthropic
+	}
+	return format
+}
+
+// defaultMaxTokensFor 返回生效的 max_tokens：客户端传了正数时原样使用，否则使用该格式的默认值（0=不限制）
+// anthropic 未单独配置时沿用 claude 的默认值
+func defaultMaxTokensFor(format string, requested int) int {
+	if requested > 0 {
+		return requested
+	}
+	defaults := proxyConfig.DefaultMaxTokens
+	if n, ok := defaults[format]; ok {
+		return n
+	}
+	if format == maxTokensFormatAnthropic {
+		return defaults[maxTokensFormatClaude]
+	}
+	return 0
+}
+
+// withMaxTokens 把生效的 max_tokens 记录到请求 context，由 baseChatOptions 带入生成参数
+// OpenAI 格式的 ChatOptions 在响应处理函数内部构建，只能通过 context 传递；Claude 格式由 buildChatOptions 直接计算
+func withMaxTokens(c *gin.Context, format string, requested int) {
+	maxTokens := defaultMaxTokensFor(maxTokensFormat(c, format), requested)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ctxKeyMaxTokens, maxTokens))
+}
+
+// maxTokensFrom 读取本次请求生效的 max_tokens（未记录时为 0）
+func maxTokensFrom(ctx context.Context) int {
+	n, _ := ctx.Value(ctxKeyMaxTokens).(int)
+	return n
+}
+
+// isValidMaxTokensFormat 校验 DefaultMaxTokens 的 key
+func isValidMaxTokensFormat(format string) bool {
+	switch format {
+	case maxTokensFormatOpenAI, maxTokensFormatClaude, maxTokensFormatAnthropic:
+		return true
+	}
+	return false
+}
+
+// maxTokensTracker 记录本次请求的输出是否因 max_tokens 被截断
+type maxTokensTracker struct {
+	reached bool
+}
+
+// watchMaxTokens 给 context 挂上截断回调（kiroclient.MaxTokensObserverKey），截断发生在上游调用的回调链内，调用返回前即可读取
+func watchMaxTokens(ctx context.Context) (context.Context, *maxTokensTracker) {
+	t := &maxTokensTracker{}
+	return context.WithValue(ctx, kiroclient.MaxTokensObserverKey, func() { t.reached = true }), t
+}
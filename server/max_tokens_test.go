@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestDefaultMaxTokens 按格式的默认 max_tokens 只在客户端未传时生效
+func TestDefaultMaxTokens(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	// OpenAI 经 context 传给 baseChatOptions，Claude 由 buildChatOptions 计算
+	effective := func(path, format string, requested int) int {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("POST", path, nil)
+		if format == maxTokensFormatOpenAI {
+			withMaxTokens(c, format, requested)
+			return baseChatOptions(c).MaxTokens
+		}
+		return buildChatOptions(c, &ClaudeChatRequest{MaxTokens: requested}).MaxTokens
+	}
+
+	// 未配置：保持原行为
+	if got := effective("/v1/chat/completions", maxTokensFormatOpenAI, 0); got != 0 {
+		t.Errorf("未配置默认值时应为 0, 得到 %d", got)
+	}
+
+	proxyConfig.DefaultMaxTokens = map[string]int{"openai": 1024, "claude": 4096, "anthropic": 8192}
+	tests := []struct {
+		name      string
+		path      string
+		format    string
+		requested int
+		want      int
+	}{
+		{"openai 未传", "/v1/chat/completions", maxTokensFormatOpenAI, 0, 1024},
+		{"openai 显式", "/v1/chat/completions", maxTokensFormatOpenAI, 200, 200},
+		{"claude 未传", "/v1/messages", maxTokensFormatClaude, 0, 4096},
+		{"claude 显式超过默认值", "/v1/messages", maxTokensFormatClaude, 10000, 10000},
+		{"anthropic 未传", "/anthropic/v1/messages", maxTokensFormatClaude, 0, 8192},
+		{"anthropic 显式", "/anthropic/v1/messages", maxTokensFormatClaude, 64, 64},
+	}
+	for _, tt := range tests {
+		if got := effective(tt.path, tt.format, tt.requested); got != tt.want {
+			t.Errorf("%s: 期望 %d, 得到 %d", tt.name, tt.want, got)
+		}
+	}
+
+	// anthropic 未单独配置时沿用 claude
+	delete(proxyConfig.DefaultMaxTokens, "anthropic")
+	if got := effective("/anthropic/v1/messages", maxTokensFormatClaude, 0); got != 4096 {
+		t.Errorf("anthropic 未配置时应沿用 claude 的默认值, 得到 %d", got)
+	}
+}
+
+// TestMaxTokens_TruncatesOutput 测试生效的 max_tokens 在本地截断输出：上游请求被取消，stop_reason 为 max_tokens
+func TestMaxTokens_TruncatesOutput(t *testing.T) {
+	fullOutput := strings.Repeat("word word word ", 20)
+	upstreamCancelled := make(chan bool, 4)
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for i := 0; i < 20; i++ {
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"word word word "}`))
+		}
+		w.(http.Flusher).Flush()
+		// 不主动结束响应，等待代理截断后取消请求
+		select {
+		case <-r.Context().Done():
+			upstreamCancelled <- true
+		case <-time.After(5 * time.Second):
+			upstreamCancelled <- false
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.DefaultMaxTokens = map[string]int{"openai": 5}
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path, body string) string {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		if !<-upstreamCancelled {
+			t.Errorf("%s 截断后应取消上游请求", path)
+		}
+		return w.Body.String()
+	}
+
+	// Claude 非流式：客户端显式传入的 max_tokens
+	var claudeResp ClaudeChatResponse
+	_ = json.Unmarshal([]byte(send("/v1/messages", `{"model":"claude-sonnet-4.5","max_tokens":5,"messages":[{"role":"user","content":"hi"}]}`)), &claudeResp)
+	if claudeResp.StopReason != stopReasonMaxTokens || len(claudeResp.Content) == 0 || len(claudeResp.Content[0].Text) > len(fullOutput)/4 {
+		t.Errorf("Claude 非流式应截断并返回 max_tokens: %+v", claudeResp)
+	}
+
+	// Claude 流式
+	out := send("/v1/messages", `{"model":"claude-sonnet-4.5","max_tokens":5,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if !strings.Contains(out, `"stop_reason":"max_tokens"`) || !strings.Contains(out, "event: message_stop") {
+		t.Errorf("Claude 流式应以 stop_reason=max_tokens 正常结束: %s", out)
+	}
+	if strings.Contains(out, "event: error") {
+		t.Errorf("截断不应产生 error 事件: %s", out)
+	}
+
+	// OpenAI 未传 max_tokens：使用按格式配置的默认值
+	var openaiResp OpenAIChatResponse
+	_ = json.Unmarshal([]byte(send("/v1/chat/completions", `{"model":"claude-sonnet-4.5","messages":[{"role":"user","content":"hi"}]}`)), &openaiResp)
+	if len(openaiResp.Choices) == 0 || openaiResp.Choices[0].FinishReason != "length" || len(openaiResp.Choices[0].Message.Content) > len(fullOutput)/4 {
+		t.Errorf("OpenAI 非流式应按默认值截断并返回 finish_reason=length: %+v", openaiResp.Choices)
+	}
+	out = send("/v1/chat/completions", `{"model":"claude-sonnet-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if !strings.Contains(out, `"finish_reason":"length"`) || !strings.Contains(out, "data: [DONE]") {
+		t.Errorf("OpenAI 流式应以 finish_reason=length 正常结束: %s", out)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== Prometheus 指标 ==========
+// 为什么：/api/stats 是给管理页面看的 JSON，接入 Prometheus 还得另写转换；
+// 指标数量很少，手写文本格式（0.0.4）即可，不引入 client_golang 依赖
+
+// metricsContentType Prometheus 文本格式的 Content-Type
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metricsWriter 按 Prometheus 文本格式拼接指标
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// family 输出一个指标的 HELP 和 TYPE 行
+func (w *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample 输出一个样本，labels 为 name, value 交替排列
+func (w *metricsWriter) sample(name string, value int64, labels ...string) {
+	w.b.WriteString(name)
+	if len(labels) > 0 {
+		w.b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.b.WriteByte(',')
+			}
+			w.b.WriteString(labels[i])
+			w.b.WriteString(`="`)
+			w.b.WriteString(escapeLabelValue(labels[i+1]))
+			w.b.WriteByte('"')
+		}
+		w.b.WriteByte('}')
+	}
+	w.b.WriteByte(' ')
+	w.b.WriteString(strconv.FormatInt(value, 10))
+	w.b.WriteByte('\n')
+}
+
+// escapeLabelValue 转义 label 值中的反斜杠、双引号和换行
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// circuitStateValue 熔断状态的 gauge 取值：0=closed 1=half_open 2=open
+func circuitStateValue(state kiroclient.CircuitState) int64 {
+	switch state {
+	case kiroclient.CircuitOpen:
+		return 2
+	case kiroclient.CircuitHalfOpen:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// handleMetrics 以 Prometheus 文本格式输出 Token、账号请求和熔断状态指标
+func handleMetrics(c *gin.Context) {
+	w := &metricsWriter{}
+
+	stats := getTokenStats()
+	w.family("kiro_input_tokens_total", "counter", "Input tokens sent to Kiro.")
+	w.sample("kiro_input_tokens_total", stats.InputTokens)
+	w.family("kiro_output_tokens_total", "counter", "Output tokens returned by Kiro.")
+	w.sample("kiro_output_tokens_total", stats.OutputTokens)
+	w.family("kiro_requests_total", "counter", "Chat requests counted in token stats.")
+	w.sample("kiro_requests_total", stats.RequestCount)
+	w.family("kiro_token_stats_dropped_total", "counter", "Token stat deltas dropped because the stats queue was full.")
+	w.sample("kiro_token_stats_dropped_total", droppedTokenDeltas.Load())
+
+	// 按账号 ID 排序，保证每次抓取的输出顺序一致
+	accountStats := getAccountStats()
+	ids := make([]string, 0, len(accountStats))
+	for id := range accountStats {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	w.family("kiro_account_requests_total", "counter", "Upstream requests per account by result.")
+	for _, id := range ids {
+		s := accountStats[id]
+		w.sample("kiro_account_requests_total", s.SuccessCount, "account", id, "status", "success")
+		w.sample("kiro_account_requests_total", s.FailCount, "account", id, "status", "fail")
+	}
+
+	// 以负载分布为基准覆盖所有已配置账号，没有熔断器记录的账号为 closed
+	cbStates := client.Auth.GetCircuitBreakerStates()
+	w.family("kiro_circuit_state", "gauge", "Circuit breaker state per account (0=closed, 1=half_open, 2=open).")
+	for _, info := range client.Auth.GetLoadDistribution() {
+		w.sample("kiro_circuit_state", circuitStateValue(cbStates[info.AccountID].State), "account", info.AccountID)
+	}
+
+	c.Data(200, metricsContentType, []byte(w.b.String()))
+}
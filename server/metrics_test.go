@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestMetrics_Exposition 抓取 /metrics，校验指标名、label 和取值
+func TestMetrics_Exposition(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer cleanup()
+	for i := 0; i < 20; i++ {
+		client.Auth.RecordRequestResult("mock-account", false)
+	}
+
+	tokenStatsMutex.Lock()
+	oldStats := tokenStats
+	tokenStats = TokenStats{InputTokens: 120, OutputTokens: 30, RequestCount: 4}
+	tokenStatsMutex.Unlock()
+	accountStatsMutex.Lock()
+	oldAccountStats := accountStats
+	accountStats = map[string]*AccountStats{
+		"mock-account": {AccountID: "mock-account", RequestCount: 5, SuccessCount: 3, FailCount: 2},
+	}
+	accountStatsMutex.Unlock()
+	defer func() {
+		tokenStatsMutex.Lock()
+		tokenStats = oldStats
+		tokenStatsMutex.Unlock()
+		accountStatsMutex.Lock()
+		accountStats = oldAccountStats
+		accountStatsMutex.Unlock()
+	}()
+
+	router := gin.New()
+	router.GET("/metrics", handleMetrics)
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type 应为 Prometheus 文本格式: %s", ct)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE kiro_input_tokens_total counter",
+		"kiro_input_tokens_total 120\n",
+		"kiro_output_tokens_total 30\n",
+		"kiro_requests_total 4\n",
+		"# TYPE kiro_account_requests_total counter",
+		`kiro_account_requests_total{account="mock-account",status="success"} 3`,
+		`kiro_account_requests_total{account="mock-account",status="fail"} 2`,
+		"# TYPE kiro_circuit_state gauge",
+		`kiro_circuit_state{account="mock-account"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("缺少 %q:\n%s", want, body)
+		}
+	}
+}
+
+// TestEscapeLabelValue label 值中的特殊字符需要转义
+func TestEscapeLabelValue(t *testing.T) {
+	if got := escapeLabelValue("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("转义结果错误: %s", got)
+	}
+}
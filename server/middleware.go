@@ -16,6 +16,8 @@ const (
 	MsgIDKey = "msgId"
 	// RequestBodyKey 请求体的 context key（用于错误记录）
 	RequestBodyKey = "requestBody"
+	// APIKeyIDKey 通过验证的 API-KEY 标识的 context key（key 前 8 位）
+	APIKeyIDKey = "apiKeyId"
 )
 
 // ========== HTTP Header 常量 ==========
@@ -36,7 +38,7 @@ const (
 // 3. 保存请求体到 context（用于错误记录）
 // 4. 记录请求开始日志
 // 5. 在响应 header 中添加 X-Msg-ID
-// 6. 记录请求结束日志（包含状态码和耗时）
+// 6. 记录请求结束日志（包含状态码和耗时），以及超过 SlowRequestMs 的慢请求日志
 func TraceMiddleware(logger *StructuredLogger) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		startTime := time.Now()
@@ -53,6 +55,10 @@ func TraceMiddleware(logger *StructuredLogger) gin.HandlerFunc {
 		c.Set(MsgIDKey, msgID)
 		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), MsgIDKey, msgID))
 
+		// 挂上请求延迟和用量信息，聊天处理函数负责补充，请求结束时用于慢请求日志
+		ctx, metrics := withRequestMetrics(c.Request.Context(), startTime)
+		c.Request = c.Request.WithContext(ctx)
+
 		// 3. 保存请求体到 context（用于错误记录）
 		// 需要读取后重新设置，因为 Body 只能读取一次
 		if c.Request.Body != nil {
@@ -76,10 +82,15 @@ func TraceMiddleware(logger *StructuredLogger) gin.HandlerFunc {
 		c.Next()
 
 		// 6. 请求结束日志已禁用（减少日志噪音）
-		// 只在错误时记录
+		// 只在错误时记录；开启 SlowRequestMs 时额外记录慢请求
+		duration := time.Since(startTime)
+		logSlowRequest(logger, c, msgID, metrics, duration)
+		logRequestTiming(logger, c, metrics, startTime, duration)
 		statusCode := c.Writer.Status()
-		if statusCode >= 400 {
-			duration := time.Since(startTime)
+		if c.GetBool(ClientCancelledKey) {
+			statusCode = StatusClientClosedRequest
+		}
+		if statusCode >= 400 && logger != nil {
 			logData := map[string]any{
 				"method":     c.Request.Method,
 				"path":       c.Request.URL.Path,
@@ -87,8 +98,13 @@ func TraceMiddleware(logger *StructuredLogger) gin.HandlerFunc {
 				"duration":   duration.String(),
 				"durationMs": duration.Milliseconds(),
 			}
+			if fp := c.GetString(RequestFingerprintKey); fp != "" {
+				logData["fingerprint"] = fp
+			}
 			if statusCode >= 500 {
 				logger.Error(msgID, "请求失败", logData)
+			} else if statusCode == StatusClientClosedRequest {
+				logger.Warn(msgID, "客户端已断开，请求中止", logData)
 			} else {
 				logger.Warn(msgID, "请求失败", logData)
 			}
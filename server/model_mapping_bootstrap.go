@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 模型映射初始化 ==========
+// 为什么：上游厂商不断发布带日期的模型 ID（如 claude-sonnet-4-5-20250929），手工维护别名容易遗漏；
+// 管理员提交 {externalId, canonicalId} 列表，或从配置的参考 /v1/models 地址拉取模型 ID 自动推导，
+// 生成映射项、校验目标模型后先预览合并结果，确认后（commit=true）再写入
+
+const (
+	// modelMappingBootstrapTimeout 拉取参考模型列表的超时
+	modelMappingBootstrapTimeout = 10 * time.Second
+	// maxModelMappingBootstrapBody 参考模型列表响应体上限
+	maxModelMappingBootstrapBody = 1 << 20
+)
+
+// datedModelSuffix 模型 ID 末尾的日期后缀（-YYYYMMDD）
+var datedModelSuffix = regexp.MustCompile(`-\d{8}$`)
+
+// modelVersionDash 版本号中的连字符（4-5 → 4.5），只替换末尾的主次版本号
+var modelVersionDash = regexp.MustCompile(`-(\d+)-(\d+)$`)
+
+// ModelMappingPair 一条外部模型 ID 到本代理模型 ID 的对应关系
+type ModelMappingPair struct {
+	ExternalID  string `json:"externalId"`
+	CanonicalID string `json:"canonicalId"`
+}
+
+// ModelMappingChange 合并时目标发生变化的映射项
+type ModelMappingChange struct {
+	From string `json:"from"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// ModelMappingRejection 未通过校验的对应关系
+type ModelMappingRejection struct {
+	ExternalID  string `json:"externalId"`
+	CanonicalID string `json:"canonicalId"`
+	Reason      string `json:"reason"`
+}
+
+// ModelMappingBootstrapResult 合并预览结果
+type ModelMappingBootstrapResult struct {
+	Added     map[string]string       `json:"added"`
+	Changed   []ModelMappingChange    `json:"changed"`
+	Conflicts []ModelMappingChange    `json:"conflicts"` // 已有映射目标不同且未开启 overwrite，保留原值
+	Unchanged int                     `json:"unchanged"`
+	Rejected  []ModelMappingRejection `json:"rejected"`
+	Mapping   map[string]string       `json:"mapping"` // 合并后的完整映射
+}
+
+// deriveCanonicalModelID 从外部模型 ID 推导本代理的模型 ID：去掉日期后缀，末尾版本号的连字符换成点
+// claude-sonnet-4-5-20250929 → claude-sonnet-4.5
+func deriveCanonicalModelID(externalID string) string {
+	id := datedModelSuffix.ReplaceAllString(externalID, "")
+	return modelVersionDash.ReplaceAllString(id, "-$1.$2")
+}
+
+// expandModelMappingPairs 生成映射项：外部 ID 本身，带日期后缀时再加上去掉日期的别名
+// 目标模型必须是已知模型，否则放入 rejected
+func expandModelMappingPairs(pairs []ModelMappingPair) (map[string]string, []ModelMappingRejection) {
+	entries := make(map[string]string)
+	var rejected []ModelMappingRejection
+	for _, pair := range pairs {
+		external := strings.TrimSpace(pair.ExternalID)
+		canonical := strings.TrimSpace(pair.CanonicalID)
+		if canonical == "" {
+			canonical = deriveCanonicalModelID(external)
+		}
+		switch {
+		case external == "":
+			rejected = append(rejected, ModelMappingRejection{ExternalID: external, CanonicalID: canonical, Reason: "externalId 为空"})
+			continue
+		case !kiroclient.IsValidModel(canonical):
+			rejected = append(rejected, ModelMappingRejection{ExternalID: external, CanonicalID: canonical, Reason: "目标不是有效模型"})
+			continue
+		}
+		for _, from := range []string{external, datedModelSuffix.ReplaceAllString(external, "")} {
+			// 与目标相同的 ID 本身就能识别，不需要映射
+			if from != canonical {
+				entries[from] = canonical
+			}
+		}
+	}
+	return entries, rejected
+}
+
+// mergeModelMapping 把生成的映射项合并到当前映射（不修改 current）
+// 已有映射目标不同时：overwrite 为 true 则覆盖并记入 changed，否则保留原值并记入 conflicts
+func mergeModelMapping(current, entries map[string]string, overwrite bool) ModelMappingBootstrapResult {
+	result := ModelMappingBootstrapResult{
+		Added:   make(map[string]string),
+		Mapping: make(map[string]string, len(current)+len(entries)),
+	}
+	for from, to := range current {
+		result.Mapping[from] = to
+	}
+	froms := make([]string, 0, len(entries))
+	for from := range entries {
+		froms = append(froms, from)
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		to := entries[from]
+		old, exists := current[from]
+		switch {
+		case !exists:
+			result.Added[from] = to
+			result.Mapping[from] = to
+		case old == to:
+			result.Unchanged++
+		case overwrite:
+			result.Changed = append(result.Changed, ModelMappingChange{From: from, Old: old, New: to})
+			result.Mapping[from] = to
+		default:
+			result.Conflicts = append(result.Conflicts, ModelMappingChange{From: from, Old: old, New: to})
+		}
+	}
+	return result
+}
+
+// fetchModelMappingPairs 从参考地址拉取模型列表（OpenAI/Anthropic /v1/models 格式：{"data":[{"id":...}]}），
+// 目标模型由 deriveCanonicalModelID 推导
+func fetchModelMappingPairs(url string) ([]ModelMappingPair, error) {
+	httpClient := &http.Client{Timeout: modelMappingBootstrapTimeout}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxModelMappingBootstrapBody)).Decode(&list); err != nil {
+		return nil, fmt.Errorf("解析模型列表失败: %w", err)
+	}
+	pairs := make([]ModelMappingPair, 0, len(list.Data))
+	for _, m := range list.Data {
+		pairs = append(pairs, ModelMappingPair{ExternalID: m.ID})
+	}
+	return pairs, nil
+}
+
+// handleBootstrapModelMapping 根据对应关系列表（或配置的参考地址）生成并合并模型映射
+// 默认只返回预览，commit=true 时写入（可带 hash 做乐观锁）
+func handleBootstrapModelMapping(c *gin.Context) {
+	var req struct {
+		Pairs     []ModelMappingPair `json:"pairs"`
+		Overwrite bool               `json:"overwrite"`
+		Commit    bool               `json:"commit"`
+		Hash      string             `json:"hash"` // 乐观锁 hash
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	pairs := req.Pairs
+	if len(pairs) == 0 {
+		url := proxyConfig.ModelMappingBootstrapURL
+		if url == "" {
+			c.JSON(400, gin.H{"error": "pairs 为空且未配置 modelMappingBootstrapUrl"})
+			return
+		}
+		fetched, err := fetchModelMappingPairs(url)
+		if err != nil {
+			c.JSON(502, gin.H{"error": "拉取参考模型列表失败: " + err.Error()})
+			return
+		}
+		pairs = fetched
+	}
+
+	if req.Commit && req.Hash != "" {
+		currentData, _ := json.Marshal(modelMapping)
+		if req.Hash != computeHash(currentData) {
+			c.JSON(409, gin.H{"error": "配置已被修改，请刷新后重试"})
+			return
+		}
+	}
+
+	entries, rejected := expandModelMappingPairs(pairs)
+	result := mergeModelMapping(modelMapping, entries, req.Overwrite)
+	result.Rejected = rejected
+	if !req.Commit {
+		c.JSON(200, gin.H{"preview": true, "result": result})
+		return
+	}
+
+	modelMapping = result.Mapping
+	if err := saveModelMapping(); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": fmt.Sprintf("保存映射配置失败: %s", err.Error())})
+		return
+	}
+	if logger != nil {
+		logger.Info(GetMsgID(c), "模型映射已按参考列表更新", map[string]any{
+			"added":    len(result.Added),
+			"changed":  len(result.Changed),
+			"rejected": len(result.Rejected),
+		})
+	}
+	newData, _ := json.Marshal(modelMapping)
+	c.JSON(200, gin.H{"preview": false, "result": result, "hash": computeHash(newData)})
+}
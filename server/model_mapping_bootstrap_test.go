@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestDeriveCanonicalModelID 去掉日期后缀，末尾版本号连字符换成点
+func TestDeriveCanonicalModelID(t *testing.T) {
+	cases := map[string]string{
+		"claude-sonnet-4-5-20250929": "claude-sonnet-4.5",
+		"claude-haiku-4-5":           "claude-haiku-4.5",
+		"claude-sonnet-4-20250514":   "claude-sonnet-4",
+		"claude-sonnet-4.5":          "claude-sonnet-4.5",
+	}
+	for in, want := range cases {
+		if got := deriveCanonicalModelID(in); got != want {
+			t.Errorf("deriveCanonicalModelID(%q) = %q, 期望 %q", in, got, want)
+		}
+	}
+}
+
+// TestModelMappingBootstrap_MergeAndValidate 生成带日期和不带日期的映射项，无效目标被拒绝，已有映射冲突时默认保留
+func TestModelMappingBootstrap_MergeAndValidate(t *testing.T) {
+	entries, rejected := expandModelMappingPairs([]ModelMappingPair{
+		{ExternalID: "claude-sonnet-4-5-20250929", CanonicalID: "claude-sonnet-4.5"},
+		{ExternalID: "claude-haiku-4-5-20251001"}, // 目标自动推导
+		{ExternalID: "gpt-5", CanonicalID: "gpt-5"},
+		{ExternalID: "", CanonicalID: "claude-sonnet-4.5"},
+	})
+	if entries["claude-sonnet-4-5-20250929"] != "claude-sonnet-4.5" || entries["claude-sonnet-4-5"] != "claude-sonnet-4.5" {
+		t.Errorf("应生成带日期和去掉日期的映射项: %v", entries)
+	}
+	if entries["claude-haiku-4-5-20251001"] != "claude-haiku-4.5" {
+		t.Errorf("未给 canonicalId 时应自动推导: %v", entries)
+	}
+	if len(rejected) != 2 {
+		t.Errorf("无效目标和空 externalId 应被拒绝: %+v", rejected)
+	}
+
+	current := map[string]string{
+		"claude-sonnet-4-5":         "claude-sonnet-4.5",
+		"claude-haiku-4-5-20251001": "claude-sonnet-4.5",
+		"claude-opus-4-5-20251101":  "claude-opus-4.5",
+	}
+	result := mergeModelMapping(current, entries, false)
+	if result.Unchanged != 1 || len(result.Conflicts) != 1 || len(result.Changed) != 0 {
+		t.Errorf("期望 1 个未变、1 个冲突: %+v", result)
+	}
+	if result.Mapping["claude-haiku-4-5-20251001"] != "claude-sonnet-4.5" {
+		t.Error("未开启 overwrite 时冲突项应保留原值")
+	}
+	if result.Added["claude-sonnet-4-5-20250929"] != "claude-sonnet-4.5" || result.Mapping["claude-opus-4-5-20251101"] != "claude-opus-4.5" {
+		t.Errorf("应新增映射并保留原有映射: %+v", result)
+	}
+	if current["claude-sonnet-4-5-20250929"] != "" {
+		t.Error("合并不应修改当前映射")
+	}
+
+	result = mergeModelMapping(current, entries, true)
+	if len(result.Changed) != 1 || result.Mapping["claude-haiku-4-5-20251001"] != "claude-haiku-4.5" {
+		t.Errorf("开启 overwrite 时应覆盖冲突项: %+v", result)
+	}
+}
+
+// TestModelMappingBootstrap_PreviewThenCommit 默认只预览，commit=true 才写入；未提交 pairs 时从配置的参考地址拉取
+func TestModelMappingBootstrap_PreviewThenCommit(t *testing.T) {
+	reference := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"data":[{"id":"claude-sonnet-4-5-20250929"},{"id":"claude-unknown-9-20300101"}]}`))
+	}))
+	defer reference.Close()
+
+	useMemoryStorage(t)
+	oldConfig, oldMapping := proxyConfig, modelMapping
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ModelMappingBootstrapURL = reference.URL
+	modelMapping = kiroclient.ModelMapping{}
+	defer func() { proxyConfig, modelMapping = oldConfig, oldMapping }()
+
+	router := gin.New()
+	router.POST("/api/model-mapping/bootstrap", handleBootstrapModelMapping)
+	send := func(body string) map[string]any {
+		req, _ := http.NewRequest("POST", "/api/model-mapping/bootstrap", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	resp := send(`{}`)
+	result, _ := resp["result"].(map[string]any)
+	added, _ := result["added"].(map[string]any)
+	if resp["preview"] != true || added["claude-sonnet-4-5-20250929"] != "claude-sonnet-4.5" {
+		t.Fatalf("预览应包含从参考地址推导的映射: %v", resp)
+	}
+	if rejected, _ := result["rejected"].([]any); len(rejected) != 1 {
+		t.Errorf("未知模型应被拒绝: %v", result["rejected"])
+	}
+	if len(modelMapping) != 0 {
+		t.Fatal("预览不应写入映射")
+	}
+
+	resp = send(`{"commit":true}`)
+	if resp["preview"] != false || modelMapping["claude-sonnet-4-5"] != "claude-sonnet-4.5" {
+		t.Errorf("commit 后应写入映射: %v / %v", resp, modelMapping)
+	}
+}
@@ -131,7 +131,7 @@ func TestShouldInjectNotification_ClaudeBlock(t *testing.T) {
 		{"role": "user", "content": "再问一次"},
 	}
 
-	if shouldInjectNotification(messages) {
+	if shouldInjectNotification(messages, notificationScope{}) {
 		t.Errorf("历史中已有通知 block，不应重复注入")
 	}
 }
@@ -155,7 +155,7 @@ func TestShouldInjectNotification_OpenAI(t *testing.T) {
 		{"role": "user", "content": "再问一次"},
 	}
 
-	if shouldInjectNotification(messages) {
+	if shouldInjectNotification(messages, notificationScope{}) {
 		t.Errorf("历史中已有通知文本，不应重复注入")
 	}
 }
@@ -177,7 +177,7 @@ func TestShouldInjectNotification_First(t *testing.T) {
 		{"role": "user", "content": "你好"},
 	}
 
-	if !shouldInjectNotification(messages) {
+	if !shouldInjectNotification(messages, notificationScope{}) {
 		t.Errorf("首次请求应该注入通知")
 	}
 }
@@ -196,7 +196,7 @@ func TestShouldInjectNotification_Disabled(t *testing.T) {
 		{"role": "user", "content": "你好"},
 	}
 
-	if shouldInjectNotification(messages) {
+	if shouldInjectNotification(messages, notificationScope{}) {
 		t.Errorf("通知关闭时不应注入")
 	}
 }
@@ -259,3 +259,41 @@ func TestApiKeyAuth_401WithoutNotification(t *testing.T) {
 		t.Errorf("通知应该是关闭状态")
 	}
 }
+
+// TestShouldInjectNotification_Filters 过滤条件：模型、格式、API-KEY 都需命中，空列表表示不限制
+func TestShouldInjectNotification_Filters(t *testing.T) {
+	notificationMutex.Lock()
+	old := notificationConfig
+	notificationConfig = NotificationConfig{
+		Enabled:   true,
+		Message:   "付费版公告",
+		Hash:      notifHash("付费版公告"),
+		Models:    []string{"claude-sonnet-4.5"},
+		ApiKeyIds: []string{"sk-paid1"},
+	}
+	notificationMutex.Unlock()
+	defer func() {
+		notificationMutex.Lock()
+		notificationConfig = old
+		notificationMutex.Unlock()
+	}()
+
+	messages := []map[string]any{{"role": "user", "content": "你好"}}
+	tests := []struct {
+		name  string
+		scope notificationScope
+		want  bool
+	}{
+		{"模型和 key 都命中", notificationScope{Model: "claude-sonnet-4.5", Format: "claude", ApiKeyID: "sk-paid1"}, true},
+		{"格式不限制", notificationScope{Model: "claude-sonnet-4.5", Format: "openai", ApiKeyID: "sk-paid1"}, true},
+		{"模型不匹配", notificationScope{Model: "claude-haiku-4.5", Format: "claude", ApiKeyID: "sk-paid1"}, false},
+		{"key 不匹配", notificationScope{Model: "claude-sonnet-4.5", Format: "claude", ApiKeyID: "sk-free1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldInjectNotification(messages, tt.scope); got != tt.want {
+				t.Errorf("期望 %v, 得到 %v", tt.want, got)
+			}
+		})
+	}
+}
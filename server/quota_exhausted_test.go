@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestQuotaExhaustedError 上游返回额度耗尽：客户端得到 429，账号暂停选择，不计入熔断
+func TestQuotaExhaustedError(t *testing.T) {
+	calls := 0
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusPaymentRequired)
+		_, _ = w.Write([]byte(`{"message":"You have reached the limit.","reason":"MONTHLY_REQUEST_COUNT"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	send := func() *httptest.ResponseRecorder {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := send(); w.Code != 429 {
+		t.Fatalf("额度耗尽应返回 429, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	quota := client.Auth.GetQuotaExhaustions()["mock-account"]
+	if quota.Hits != 1 || quota.Until.IsZero() {
+		t.Fatalf("账号应被标记为额度耗尽: %+v", quota)
+	}
+	if cb, ok := client.Auth.GetCircuitBreakerStates()["mock-account"]; ok && cb.FailureCount != 0 {
+		t.Errorf("额度耗尽不应计入熔断失败: %+v", cb)
+	}
+	dist := client.Auth.GetLoadDistribution()
+	if len(dist) != 1 || dist[0].Eligible || dist[0].Weight != 0 || dist[0].QuotaExhaustedUntil == "" {
+		t.Errorf("额度耗尽的账号应不可选且标注截止时间: %+v", dist)
+	}
+
+	// 唯一的账号已暂停选择，后续请求不再发往上游
+	send()
+	if calls != 1 {
+		t.Errorf("额度耗尽的账号不应被再次选中, 上游调用 %d 次", calls)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== reasoning token 增量推送 ==========
+// 为什么：thinking 模型的推理阶段可能持续很久，展示实时推理消耗的客户端在流结束前拿不到任何 token 信号；
+// 上游每个 reasoningContentEvent 后回调本地估算的累计值，流式响应据此增量推送，结束时用 messageMetadataEvent 的精确值校正
+
+// reasoningUsageStep 累计值每变化这么多 token 才推送一次，避免每个推理事件都多发一帧
+const reasoningUsageStep = 50
+
+// OpenAIStreamOptions OpenAI 流式选项
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// reasoningUsageTracker 记录 reasoning token 累计值，变化超过 reasoningUsageStep 时调用 emit
+// 回调在上游读取循环中同步调用，与流式回调在同一 goroutine，不需要加锁
+type reasoningUsageTracker struct {
+	total    int
+	reported int
+	emit     func(reasoningTokens int)
+}
+
+// watchReasoningUsage 给 context 挂上 reasoning token 回调；emit 为 nil 时只记录累计值
+func watchReasoningUsage(ctx context.Context, emit func(reasoningTokens int)) (context.Context, *reasoningUsageTracker) {
+	t := &reasoningUsageTracker{emit: emit}
+	return context.WithValue(ctx, kiroclient.ReasoningTokensObserverKey, t.observe), t
+}
+
+func (t *reasoningUsageTracker) observe(reasoningTokens int) {
+	t.total = reasoningTokens
+	if t.emit == nil {
+		return
+	}
+	if diff := t.total - t.reported; diff >= reasoningUsageStep || diff <= -reasoningUsageStep {
+		t.reported = t.total
+		t.emit(t.total)
+	}
+}
+
+// tokens 当前累计值（流结束后为校正后的值）
+func (t *reasoningUsageTracker) tokens() int {
+	return t.total
+}
+
+// includeUsageFrom 从 context 取出 OpenAI stream_options.include_usage
+func includeUsageFrom(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyIncludeUsage).(bool)
+	return v
+}
+
+// writeOpenAIReasoningUsageChunk 写出只带 usage 的 OpenAI chunk（choices 为空，与 include_usage 的最终 usage chunk 形式一致）
+func writeOpenAIReasoningUsageChunk(w io.Writer, id, model string, estimatedInputTokens, reasoningTokens int) {
+	chunk := map[string]any{
+		"id":                 id,
+		"object":             "chat.completion.chunk",
+		"created":            time.Now().Unix(),
+		"model":              model,
+		"system_fingerprint": nil,
+		"choices":            []map[string]any{},
+		"usage": map[string]any{
+			"prompt_tokens":     estimatedInputTokens,
+			"completion_tokens": reasoningTokens,
+			"total_tokens":      estimatedInputTokens + reasoningTokens,
+			"completion_tokens_details": map[string]int{
+				"reasoning_tokens": reasoningTokens,
+			},
+		},
+	}
+	data, _ := json.Marshal(chunk)
+	_, _ = fmt.Fprintf(w, "data: %s\n\n", string(data))
+}
+
+// writeClaudeReasoningUsageDelta 写出流中间的 message_delta（stop_reason 为 null，usage 为累计值）
+// Anthropic 流允许多个 message_delta，客户端按最后一个为准
+func writeClaudeReasoningUsageDelta(w io.Writer, reasoningTokens int) {
+	msgDelta := map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   nil,
+			"stop_sequence": nil,
+		},
+		"usage": map[string]any{
+			"output_tokens":    reasoningTokens,
+			"reasoning_tokens": reasoningTokens,
+		},
+	}
+	data, _ := json.Marshal(msgDelta)
+	_, _ = fmt.Fprintf(w, "event: message_delta\ndata: %s\n\n", string(data))
+}
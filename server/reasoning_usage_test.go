@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reasoningUpstream 两段各约 50 token 的推理内容，messageMetadataEvent 给出精确值 120
+func reasoningUpstream(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+	thinking := strings.Repeat("x", 150)
+	_, _ = w.Write(encodeEventStreamMessage("reasoningContentEvent", `{"text":"`+thinking+`"}`))
+	_, _ = w.Write(encodeEventStreamMessage("reasoningContentEvent", `{"text":"`+thinking+`"}`))
+	_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"answer"}`))
+	_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"tokenUsage":{"uncachedInputTokens":10,"outputTokens":130,"reasoningTokens":120}}`))
+}
+
+// sseDataLines 取出 SSE 响应中所有 data 行的 JSON（跳过 [DONE]）
+func sseDataLines(t *testing.T, body string) []map[string]any {
+	t.Helper()
+	var events []map[string]any
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event map[string]any
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("解析 SSE 数据失败: %v: %s", err, data)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// reasoningTokensOf 取出 usage 中的 reasoning token 数（OpenAI 在 completion_tokens_details 中，Claude 在 usage 顶层）
+func reasoningTokensOf(event map[string]any) (float64, bool) {
+	usage, ok := event["usage"].(map[string]any)
+	if !ok {
+		return 0, false
+	}
+	if details, ok := usage["completion_tokens_details"].(map[string]any); ok {
+		usage = details
+	}
+	n, ok := usage["reasoning_tokens"].(float64)
+	return n, ok
+}
+
+// TestReasoningUsage_OpenAIStream include_usage 时推理过程中增量推送 reasoning_tokens，结束时用精确值校正
+func TestReasoningUsage_OpenAIStream(t *testing.T) {
+	cleanup := setupMockUpstream(t, reasoningUpstream)
+	defer cleanup()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(body string) []map[string]any {
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return sseDataLines(t, w.Body.String())
+	}
+
+	events := send(`{"model":"claude-sonnet-4.5","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`)
+	var counts []float64
+	for _, event := range events {
+		if n, ok := reasoningTokensOf(event); ok {
+			counts = append(counts, n)
+		}
+	}
+	// 两次估算（50、100），校正变化不足 reasoningUsageStep 不单独推送，最终 usage chunk 带精确值 120
+	if want := []float64{50, 100, 120}; len(counts) != len(want) || counts[0] != want[0] || counts[1] != want[1] || counts[2] != want[2] {
+		t.Errorf("reasoning_tokens 序列期望 %v, 得到 %v", want, counts)
+	}
+
+	// 未开启 include_usage 时不增量推送，最终 usage chunk 仍带校正后的值
+	events = send(`{"model":"claude-sonnet-4.5","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	counts = nil
+	for _, event := range events {
+		if n, ok := reasoningTokensOf(event); ok {
+			counts = append(counts, n)
+		}
+	}
+	if len(counts) != 1 || counts[0] != 120 {
+		t.Errorf("未开启 include_usage 时只应在最终 chunk 带 reasoning_tokens=120, 得到 %v", counts)
+	}
+}
+
+// TestReasoningUsage_ClaudeStream 推理过程中发送流中间的 message_delta，最后一个 message_delta 带精确值
+func TestReasoningUsage_ClaudeStream(t *testing.T) {
+	cleanup := setupMockUpstream(t, reasoningUpstream)
+	defer cleanup()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	var deltas []map[string]any
+	for _, event := range sseDataLines(t, w.Body.String()) {
+		if event["type"] == "message_delta" {
+			deltas = append(deltas, event)
+		}
+	}
+	if len(deltas) < 2 {
+		t.Fatalf("推理过程中应有增量 message_delta, 得到 %d 个", len(deltas))
+	}
+	if n, _ := reasoningTokensOf(deltas[0]); n != 50 {
+		t.Errorf("第一个增量 message_delta 期望 reasoning_tokens=50, 得到 %v", n)
+	}
+	if delta, _ := deltas[0]["delta"].(map[string]any); delta["stop_reason"] != nil {
+		t.Errorf("增量 message_delta 的 stop_reason 应为 null: %v", delta)
+	}
+	last := deltas[len(deltas)-1]
+	if n, _ := reasoningTokensOf(last); n != 120 {
+		t.Errorf("最后的 message_delta 应带校正后的 reasoning_tokens=120, 得到 %v", n)
+	}
+	if delta, _ := last["delta"].(map[string]any); delta["stop_reason"] != "end_turn" {
+		t.Errorf("最后的 message_delta 应带 stop_reason: %v", delta)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 请求指纹 ==========
+// 为什么：msgId 每次都不同（时间 + 随机数），无法在日志中关联同一请求的重试，也无法判断重复请求；
+// 指纹只由请求内容决定，与 msgId 相互独立，开启 RequestFingerprint 后通过 X-Request-Fingerprint 返回并写入日志
+
+// HeaderXRequestFingerprint 响应中返回请求指纹的 header
+const HeaderXRequestFingerprint = "X-Request-Fingerprint"
+
+// RequestFingerprintKey Gin context 中请求指纹的 key
+const RequestFingerprintKey = "requestFingerprint"
+
+// fingerprintFields 参与指纹计算的请求字段（模型、消息和生成参数）
+// stream、metadata 等不影响生成内容的字段不参与，同一请求流式和非流式重试得到相同指纹
+var fingerprintFields = []string{
+	"model", "messages", "system", "tools", "tool_choice",
+	"max_tokens", "max_completion_tokens", "temperature", "top_p", "top_k", "stop_sequences", "stop",
+}
+
+// computeRequestFingerprint 计算请求指纹：路径 + 参与字段的规范化 JSON（key 排序、忽略空白）的 SHA-256
+// 请求体不是 JSON 对象时返回空字符串
+func computeRequestFingerprint(path, body string) string {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(body), &raw); err != nil {
+		return ""
+	}
+	normalized := map[string]any{"path": path}
+	for _, field := range fingerprintFields {
+		value, ok := raw[field]
+		if !ok {
+			continue
+		}
+		var v any
+		if err := json.Unmarshal(value, &v); err != nil {
+			return ""
+		}
+		normalized[field] = v
+	}
+	// map 序列化时 key 按字母排序，结果与原始请求的字段顺序和空白无关
+	data, err := json.Marshal(normalized)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "fp_" + hex.EncodeToString(sum[:16])
+}
+
+// requestFingerprintMiddleware 开启 RequestFingerprint 时计算请求指纹（请求体由 TraceMiddleware 预先读取）
+func requestFingerprintMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !proxyConfig.RequestFingerprint {
+			c.Next()
+			return
+		}
+		if fp := computeRequestFingerprint(c.Request.URL.Path, GetRequestBody(c)); fp != "" {
+			c.Set(RequestFingerprintKey, fp)
+			c.Header(HeaderXRequestFingerprint, fp)
+			if logger != nil {
+				logger.Debug(GetMsgID(c), "请求指纹", map[string]any{
+					"fingerprint": fp,
+					"path":        c.Request.URL.Path,
+				})
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestRequestFingerprint_StableAcrossRequests 相同内容的两次请求指纹相同、msgId 不同；内容变化时指纹随之变化
+func TestRequestFingerprint_StableAcrossRequests(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.RequestFingerprint = true
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.Use(TraceMiddleware(nil))
+	router.POST("/v1/messages", requestFingerprintMiddleware(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"fingerprint": c.GetString(RequestFingerprintKey)})
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	first := send(`{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+	// 字段顺序、空白、stream 和 metadata 不影响指纹
+	second := send(`{"messages": [{"content": "hi", "role": "user"}], "stream": true, "metadata": {"user_id": "u1"}, "max_tokens": 100, "model": "claude-sonnet-4.5"}`)
+
+	fp1, fp2 := first.Header().Get(HeaderXRequestFingerprint), second.Header().Get(HeaderXRequestFingerprint)
+	if fp1 == "" || fp1 != fp2 {
+		t.Errorf("相同内容的请求指纹应相同: %q vs %q", fp1, fp2)
+	}
+	if first.Header().Get(HeaderXMsgID) == second.Header().Get(HeaderXMsgID) {
+		t.Error("指纹相同的请求 msgId 仍应不同")
+	}
+
+	third := send(`{"model":"claude-sonnet-4.5","max_tokens":200,"messages":[{"role":"user","content":"hi"}]}`)
+	if third.Header().Get(HeaderXRequestFingerprint) == fp1 {
+		t.Error("生成参数不同时指纹应不同")
+	}
+
+	// 未开启时不返回指纹
+	proxyConfig.RequestFingerprint = false
+	if w := send(`{"model":"claude-sonnet-4.5","messages":[]}`); w.Header().Get(HeaderXRequestFingerprint) != "" {
+		t.Error("未开启 requestFingerprint 时不应返回指纹")
+	}
+}
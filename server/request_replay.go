@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 请求捕获与重放 ==========
+
+const (
+	// HeaderXKiroReplayID 响应中返回的捕获 ID，用于 /api/requests/:id 查看和重放
+	HeaderXKiroReplayID = "X-Kiro-Replay-Id"
+
+	// maxCapturedRequests 内存中最多保留的请求数（超出后淘汰最早的）
+	maxCapturedRequests = 200
+	// maxCapturedBodySize 单个请求体上限，超过的不保存（截断后的请求无法重放）
+	maxCapturedBodySize = 2 * 1024 * 1024
+	// maxCapturedTotalBytes 所有已保存请求体的总大小上限，超出后淘汰最早的
+	// 为什么：只按条数限制时最坏要占 maxCapturedRequests × maxCapturedBodySize（约 400MB）内存
+	maxCapturedTotalBytes = 32 * 1024 * 1024
+	// replayTimeout 单次重放的超时时间
+	replayTimeout = 5 * time.Minute
+)
+
+// CapturedRequest 一条可重放的请求记录
+// 敏感 header（Authorization、x-api-key 等）不保存，请求体按支持包的规则脱敏（密钥字段、图片数据）
+type CapturedRequest struct {
+	ID         string            `json:"id"`
+	MsgID      string            `json:"msgId"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	CapturedAt time.Time         `json:"capturedAt"`
+}
+
+// requestCaptureStore 按捕获 ID 索引的有界请求存储（按条数和总字节数 FIFO 淘汰）
+// 为什么不按 msgId 索引：msgId 可以由客户端通过 X-Request-ID 指定，不同调用方的请求会互相覆盖
+type requestCaptureStore struct {
+	mu    sync.Mutex
+	items map[string]CapturedRequest
+	order []string
+	bytes int
+}
+
+// capturedRequests 全局请求存储
+var capturedRequests = &requestCaptureStore{}
+
+// add 保存一条请求；同一 ID 重复保存时覆盖旧记录
+func (s *requestCaptureStore) add(req CapturedRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.items == nil {
+		s.items = make(map[string]CapturedRequest)
+	}
+	if old, exists := s.items[req.ID]; exists {
+		s.bytes -= len(old.Body)
+	} else {
+		s.order = append(s.order, req.ID)
+	}
+	s.items[req.ID] = req
+	s.bytes += len(req.Body)
+	for len(s.order) > maxCapturedRequests || (s.bytes > maxCapturedTotalBytes && len(s.order) > 1) {
+		s.bytes -= len(s.items[s.order[0]].Body)
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// get 按捕获 ID 查找请求
+func (s *requestCaptureStore) get(id string) (CapturedRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.items[id]
+	return req, ok
+}
+
+// requestCaptureMiddleware 开启 CaptureRequestBodies 时保存聊天请求（请求体由 TraceMiddleware 预先读取）
+// 捕获 ID 由服务端生成，通过 X-Kiro-Replay-Id 返回
+func requestCaptureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !proxyConfig.CaptureRequestBodies {
+			c.Next()
+			return
+		}
+		body := GetRequestBody(c)
+		if body != "" && len(body) <= maxCapturedBodySize {
+			id := generateID("rpl")
+			capturedRequests.add(CapturedRequest{
+				ID:         id,
+				MsgID:      GetMsgID(c),
+				Method:     c.Request.Method,
+				Path:       c.Request.URL.Path,
+				Headers:    replayableHeaders(c.Request.Header),
+				Body:       redactCaptureBody(body),
+				CapturedAt: time.Now(),
+			})
+			c.Header(HeaderXKiroReplayID, id)
+		}
+		c.Next()
+	}
+}
+
+// replayableHeaders 保留影响请求处理的非敏感 header（如 anthropic-beta、X-Collect-Stream）
+func replayableHeaders(headers http.Header) map[string]string {
+	result := make(map[string]string)
+	for key, values := range headers {
+		if isSensitiveHeader(key) || strings.EqualFold(key, "Content-Length") {
+			continue
+		}
+		result[key] = strings.Join(values, ", ")
+	}
+	return result
+}
+
+// newReplayRouter 构造进程内路由，挂载被捕获的聊天 handler
+// 与 /v1 一样经过限流、API-KEY 验证（含 IP 白名单和额度）、维护模式和并发限制，只是不再次捕获
+// 为什么：重放会真实消耗上游额度，不能成为绕过 API-KEY 和额度的后门
+func newReplayRouter(msgID, body string) *gin.Engine {
+	router := gin.New()
+	// 客户端 IP 直接取 RemoteAddr（即发起重放的调用方），不信任任何转发 header
+	_ = router.SetTrustedProxies(nil)
+	// 与 TraceMiddleware 一样注入 msgId 和请求体，handler 的日志和错误记录依赖它们
+	router.Use(func(c *gin.Context) {
+		c.Set(MsgIDKey, msgID)
+		c.Set(RequestBodyKey, body)
+		ctx := context.WithValue(c.Request.Context(), MsgIDKey, msgID)
+		c.Request = c.Request.WithContext(context.WithValue(ctx, RequestBodyKey, body))
+		c.Header(HeaderXMsgID, msgID)
+		c.Next()
+	})
+	router.Use(rateLimitMiddleware(), apiKeyAuthMiddleware(), maintenanceMiddleware(), concurrencyLimitMiddleware())
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/anthropic/v1/messages", handleClaudeChat)
+	return router
+}
+
+// replayRequest 用当前配置（模型映射、代理配置、账号池）重新执行一条已捕获的请求
+// 鉴权 header 取自发起重放的请求，额度和用量计入该调用方的 API-KEY
+func replayRequest(ctx context.Context, captured CapturedRequest, caller *gin.Context) (*httptest.ResponseRecorder, string, error) {
+	req, err := http.NewRequestWithContext(ctx, captured.Method, captured.Path, bytes.NewReader([]byte(captured.Body)))
+	if err != nil {
+		return nil, "", err
+	}
+	for key, value := range captured.Headers {
+		req.Header.Set(key, value)
+	}
+	for _, key := range []string{"Authorization", "X-API-Key"} {
+		if value := caller.GetHeader(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+	req.RemoteAddr = net.JoinHostPort(caller.ClientIP(), "0")
+	// 使用新的 msgId，避免与原始请求的日志混在一起
+	newMsgID := generateID("msg")
+
+	w := httptest.NewRecorder()
+	newReplayRouter(newMsgID, captured.Body).ServeHTTP(w, req)
+	return w, newMsgID, nil
+}
+
+// handleGetCapturedRequest 查看一条已捕获的请求（请求体已脱敏）
+func handleGetCapturedRequest(c *gin.Context) {
+	captured, ok := capturedRequests.get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "未找到该请求（需开启 captureRequestBodies，且只保留最近的请求）"})
+		return
+	}
+	c.JSON(200, captured)
+}
+
+// handleReplayRequest 重放一条已捕获的请求，返回原始请求和新的响应，便于对比排查
+// 调用方需要像调用 /v1 一样携带有效的 API-KEY（Authorization 或 x-api-key）
+func handleReplayRequest(c *gin.Context) {
+	captured, ok := capturedRequests.get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "未找到该请求（需开启 captureRequestBodies，且只保留最近的请求）"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), replayTimeout)
+	defer cancel()
+
+	start := time.Now()
+	w, replayMsgID, err := replayRequest(ctx, captured, c)
+	if err != nil {
+		c.JSON(500, gin.H{"error": "重放失败: " + err.Error()})
+		return
+	}
+
+	if logger != nil {
+		logger.Info(GetMsgID(c), "请求重放完成", map[string]any{
+			"replayId":      captured.ID,
+			"originalMsgId": captured.MsgID,
+			"replayMsgId":   replayMsgID,
+			"path":          captured.Path,
+			"status":        w.Code,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"original": captured,
+		"replay": gin.H{
+			"msgId":       replayMsgID,
+			"status":      w.Code,
+			"contentType": w.Header().Get("Content-Type"),
+			"body":        w.Body.String(),
+			"durationMs":  time.Since(start).Milliseconds(),
+		},
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// setupReplayTest 使用全新的请求存储和默认代理配置
+func setupReplayTest(t *testing.T, capture bool) {
+	t.Helper()
+	oldConfig, oldStore := proxyConfig, capturedRequests
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.CaptureRequestBodies = capture
+	capturedRequests = &requestCaptureStore{}
+	t.Cleanup(func() {
+		proxyConfig, capturedRequests = oldConfig, oldStore
+	})
+}
+
+// sendCapturedRequest 经过 TraceMiddleware + 捕获中间件发送一个请求，返回捕获 ID
+func sendCapturedRequest(t *testing.T, body string, headers map[string]string) string {
+	t.Helper()
+	router := gin.New()
+	router.Use(TraceMiddleware(nil))
+	router.POST("/v1/messages", requestCaptureMiddleware(), func(c *gin.Context) {
+		c.JSON(200, gin.H{"ok": true})
+	})
+	req, _ := http.NewRequest("POST", "/v1/messages", strings.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Header().Get(HeaderXKiroReplayID)
+}
+
+// TestRequestCapture_DisabledByDefault 测试未开启时不保存请求体
+func TestRequestCapture_DisabledByDefault(t *testing.T) {
+	setupReplayTest(t, false)
+
+	id := sendCapturedRequest(t, `{"model":"claude-sonnet-4.5"}`, nil)
+	if id != "" || len(capturedRequests.items) != 0 {
+		t.Error("未开启 captureRequestBodies 时不应保存请求")
+	}
+}
+
+// TestRequestCapture_RedactsSensitiveHeaders 测试敏感 header 不保存，其余 header 保留
+func TestRequestCapture_RedactsSensitiveHeaders(t *testing.T) {
+	setupReplayTest(t, true)
+
+	id := sendCapturedRequest(t, `{"model":"claude-sonnet-4.5"}`, map[string]string{
+		"Authorization":  "Bearer secret",
+		"X-Api-Key":      "secret",
+		"Anthropic-Beta": "interleaved-thinking",
+	})
+	captured, ok := capturedRequests.get(id)
+	if !ok {
+		t.Fatal("开启后应保存请求")
+	}
+	for key := range captured.Headers {
+		if isSensitiveHeader(key) {
+			t.Errorf("敏感 header %s 不应保存", key)
+		}
+	}
+	if captured.Headers["Anthropic-Beta"] != "interleaved-thinking" {
+		t.Errorf("非敏感 header 应保留: %v", captured.Headers)
+	}
+	if captured.Body != `{"model":"claude-sonnet-4.5"}` {
+		t.Errorf("请求体不一致: %s", captured.Body)
+	}
+}
+
+// TestRequestCapture_RedactsBodyAndServerID 测试请求体按支持包规则脱敏，捕获 ID 由服务端生成而不是沿用 X-Request-ID
+func TestRequestCapture_RedactsBodyAndServerID(t *testing.T) {
+	setupReplayTest(t, true)
+
+	body := `{"model":"claude-sonnet-4.5","api_key":"sk-leak","messages":[{"role":"user","content":[{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + strings.Repeat("A", 4096) + `"}}]}]}`
+	first := sendCapturedRequest(t, body, map[string]string{HeaderXRequestID: "client-chosen"})
+	second := sendCapturedRequest(t, body, map[string]string{HeaderXRequestID: "client-chosen"})
+	if first == "" || first == "client-chosen" || first == second {
+		t.Fatalf("捕获 ID 应由服务端为每个请求生成, 得到 %q / %q", first, second)
+	}
+	captured, ok := capturedRequests.get(first)
+	if !ok {
+		t.Fatal("相同 X-Request-ID 的请求不应互相覆盖")
+	}
+	if captured.MsgID != "client-chosen" {
+		t.Errorf("msgId 仍应记录原值便于对照日志: %s", captured.MsgID)
+	}
+	if strings.Contains(captured.Body, "sk-leak") || strings.Contains(captured.Body, strings.Repeat("A", 4096)) {
+		t.Errorf("请求体中的密钥字段和图片数据应脱敏: %s", captured.Body)
+	}
+}
+
+// TestRequestCapture_Bounded 测试超出条数或总字节数上限后淘汰最早的请求
+func TestRequestCapture_Bounded(t *testing.T) {
+	store := &requestCaptureStore{}
+	for i := 0; i < maxCapturedRequests+10; i++ {
+		store.add(CapturedRequest{ID: fmt.Sprintf("rpl_%d", i)})
+	}
+	if len(store.items) != maxCapturedRequests || len(store.order) != maxCapturedRequests {
+		t.Errorf("存储应限制为 %d 条, items=%d order=%d", maxCapturedRequests, len(store.items), len(store.order))
+	}
+	if _, ok := store.get("rpl_0"); ok {
+		t.Error("最早的请求应被淘汰")
+	}
+
+	store = &requestCaptureStore{}
+	big := strings.Repeat("x", maxCapturedBodySize)
+	for i := 0; i < maxCapturedTotalBytes/maxCapturedBodySize+5; i++ {
+		store.add(CapturedRequest{ID: fmt.Sprintf("big_%d", i), Body: big})
+	}
+	if store.bytes > maxCapturedTotalBytes {
+		t.Errorf("总字节数应不超过 %d, 得到 %d", maxCapturedTotalBytes, store.bytes)
+	}
+	if _, ok := store.get("big_0"); ok {
+		t.Error("超出总字节数时最早的请求应被淘汰")
+	}
+}
+
+// TestReplayRequest 测试重放已保存的样例请求，使用当前配置重新执行并返回新响应
+func TestReplayRequest(t *testing.T) {
+	setupReplayTest(t, true)
+	var upstreamBodies []string
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r.Body)
+		upstreamBodies = append(upstreamBodies, buf.String())
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"replayed answer"}`))
+	})
+	defer cleanup()
+
+	oldKeys := apiKeys
+	apiKeys = []string{"sk-replay-test-key"}
+	defer func() { apiKeys = oldKeys }()
+
+	capturedRequests.add(CapturedRequest{
+		ID:      "rpl_sample",
+		MsgID:   "msg_sample",
+		Method:  "POST",
+		Path:    "/v1/messages",
+		Headers: map[string]string{"Content-Type": "application/json"},
+		Body:    `{"model":"claude-sonnet-4.5","max_tokens":64,"messages":[{"role":"user","content":"replay me"}]}`,
+	})
+
+	router := gin.New()
+	router.POST("/api/requests/:id/replay", handleReplayRequest)
+
+	replay := func(apiKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/requests/rpl_sample/replay", nil)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// 重放与 /v1 一样需要有效的 API-KEY，否则不会发往上游
+	for _, apiKey := range []string{"", "sk-wrong"} {
+		w := replay(apiKey)
+		var resp struct {
+			Replay struct {
+				Status int `json:"status"`
+			} `json:"replay"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Replay.Status != 401 {
+			t.Errorf("key=%q 重放应被 API-KEY 验证拒绝, 得到 %s", apiKey, w.Body.String())
+		}
+	}
+	if len(upstreamBodies) != 0 {
+		t.Fatalf("未通过验证的重放不应请求上游: %v", upstreamBodies)
+	}
+
+	w := replay("sk-replay-test-key")
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp struct {
+		Original CapturedRequest `json:"original"`
+		Replay   struct {
+			MsgID  string `json:"msgId"`
+			Status int    `json:"status"`
+			Body   string `json:"body"`
+		} `json:"replay"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if resp.Original.ID != "rpl_sample" || resp.Original.MsgID != "msg_sample" {
+		t.Errorf("应返回原始请求: %+v", resp.Original)
+	}
+	if resp.Replay.Status != 200 || !strings.Contains(resp.Replay.Body, "replayed answer") {
+		t.Errorf("重放应返回新的响应: %+v", resp.Replay)
+	}
+	if resp.Replay.MsgID == "" || resp.Replay.MsgID == "msg_sample" {
+		t.Errorf("重放应使用新的 msgId: %s", resp.Replay.MsgID)
+	}
+	if len(upstreamBodies) != 1 || !strings.Contains(upstreamBodies[0], "replay me") {
+		t.Errorf("应把原始对话重新发往上游: %v", upstreamBodies)
+	}
+}
+
+// TestReplayRequest_NotFound 测试未捕获的 msgId 返回 404
+func TestReplayRequest_NotFound(t *testing.T) {
+	setupReplayTest(t, true)
+
+	router := gin.New()
+	router.POST("/api/requests/:id/replay", handleReplayRequest)
+	req, _ := http.NewRequest("POST", "/api/requests/rpl_missing/replay", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Errorf("期望 404, 得到 %d", w.Code)
+	}
+}
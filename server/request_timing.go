@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== debug 模式耗时分解 ==========
+// 开启 OneDayAI_Start_Debug 的请求在结束时输出【包5】：选账号、上游首字节、上游总耗时、后处理耗时
+// 为什么：【包1-4】只有内容没有时间，排查"慢在哪一段"时只能靠猜
+
+// logRequestTiming debug 模式下输出【包5】耗时分解（其他请求没有挂 RequestTiming，直接跳过）
+// 后处理耗时 = 最后一次上游请求结束到请求完成，包含响应组装、通知注入和写出
+func logRequestTiming(logger *StructuredLogger, c *gin.Context, m *requestMetrics, start time.Time, duration time.Duration) {
+	ctx := c.Request.Context()
+	timing := kiroclient.RequestTimingFrom(ctx)
+	if timing == nil || !kiroclient.IsDebugMode(ctx) || logger == nil {
+		return
+	}
+
+	snap := timing.Snapshot()
+	data := map[string]any{
+		"path":                c.Request.URL.Path,
+		"statusCode":          c.Writer.Status(),
+		"totalMs":             duration.Milliseconds(),
+		"accountSelectMs":     snap.AccountSelect.Milliseconds(),
+		"upstreamFirstByteMs": snap.UpstreamFirstByte.Milliseconds(),
+		"upstreamMs":          snap.Upstream.Milliseconds(),
+		"upstreamAttempts":    snap.Attempts,
+	}
+	if !snap.UpstreamDoneAt.IsZero() {
+		data["postProcessMs"] = start.Add(duration).Sub(snap.UpstreamDoneAt).Milliseconds()
+	}
+	if m != nil {
+		m.mu.Lock()
+		if !m.firstTokenAt.IsZero() {
+			data["ttftMs"] = m.firstTokenAt.Sub(m.start).Milliseconds()
+		}
+		m.mu.Unlock()
+	}
+
+	kiroclient.DebugLog(ctx, logger, "【包5】耗时分解", data)
+}
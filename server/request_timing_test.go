@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestRequestTimingPacket 测试【包5】耗时分解只在 debug 模式输出，且包含各阶段耗时
+func TestRequestTimingPacket(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	// 正常日志级别关闭，ForceDebug 走独立 logger（与线上一致）
+	core, logs := observer.New(zapcore.DebugLevel)
+	testLogger := &StructuredLogger{
+		zap:         zap.NewNop(),
+		level:       zap.NewAtomicLevelAt(zapcore.ErrorLevel),
+		forceLogger: zap.New(core),
+	}
+
+	router := gin.New()
+	router.Use(TraceMiddleware(testLogger))
+	router.POST("/v1/messages", handleClaudeChat)
+	send := func(content string) {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"` + content + `"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	send("hi")
+	if n := logs.FilterMessage("【包5】耗时分解").Len(); n != 0 {
+		t.Fatalf("非 debug 模式不应输出【包5】, 得到 %d 条", n)
+	}
+
+	send("hi OneDayAI_Start_Debug")
+	entries := logs.FilterMessage("【包5】耗时分解").All()
+	if len(entries) != 1 {
+		t.Fatalf("debug 模式应输出 1 条【包5】, 得到 %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	for _, key := range []string{"accountSelectMs", "upstreamFirstByteMs", "upstreamMs", "postProcessMs", "totalMs"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("【包5】缺少字段 %s: %v", key, fields)
+		}
+	}
+	if upstream, _ := fields["upstreamMs"].(int64); upstream < 20 {
+		t.Errorf("upstreamMs 应包含上游延迟: %v", fields["upstreamMs"])
+	}
+	if attempts, _ := fields["upstreamAttempts"].(int64); attempts != 1 {
+		t.Errorf("upstreamAttempts 应为 1: %v", fields["upstreamAttempts"])
+	}
+}
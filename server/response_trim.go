@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// ========== 响应首尾空白/BOM 清理 ==========
+
+// isLeadingJunk 开头需要去掉的字符：空白和 BOM（U+FEFF 不属于 unicode.IsSpace）
+func isLeadingJunk(r rune) bool {
+	return r == '\uFEFF' || unicode.IsSpace(r)
+}
+
+// trimResponseText 去掉完整响应最开头的 BOM/空白和最末尾的空白（ProxyConfig.TrimResponseWhitespace 开启时）
+// 只动绝对首尾，中间的代码块、缩进和换行原样保留
+func trimResponseText(s string) string {
+	if !proxyConfig.TrimResponseWhitespace {
+		return s
+	}
+	return strings.TrimRightFunc(strings.TrimLeftFunc(s, isLeadingJunk), unicode.IsSpace)
+}
+
+// streamLeadingTrimmer 流式输出的首段清理：只去掉第一个非空文本之前的 BOM/空白
+// 只处理正文，thinking 内容（reasoning_content / thinking block）不经过这里，与非流式只清理正文保持一致
+// 为什么不处理结尾：流式无法预知哪一段是最后一段，缓冲会破坏实时性
+type streamLeadingTrimmer struct {
+	enabled bool
+	started bool // 已输出过非空文本，后续内容原样透传
+}
+
+// newStreamLeadingTrimmer 按当前配置创建（请求开始时快照配置，中途修改不影响本次请求）
+func newStreamLeadingTrimmer() *streamLeadingTrimmer {
+	return &streamLeadingTrimmer{enabled: proxyConfig.TrimResponseWhitespace}
+}
+
+// trim 处理一段待输出的文本，返回空串表示整段都是开头的空白，应跳过
+func (t *streamLeadingTrimmer) trim(text string) string {
+	if !t.enabled || t.started {
+		return text
+	}
+	text = strings.TrimLeftFunc(text, isLeadingJunk)
+	if text != "" {
+		t.started = true
+	}
+	return text
+}
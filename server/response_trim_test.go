@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestTrimResponseText 测试只去掉绝对首尾，中间的代码块和缩进保持不变
+func TestTrimResponseText(t *testing.T) {
+	oldConfig := proxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	body := "```go\n    func main() {}\n```"
+	tests := []struct {
+		name   string
+		input  string
+		expect string
+	}{
+		{"BOM", "\uFEFF{\"a\":1}", "{\"a\":1}"},
+		{"首尾空白", " \n\t{\"a\":1}\n\n ", "{\"a\":1}"},
+		{"BOM+空白", "\uFEFF \n" + body + "\n", body},
+		{"中间内容不变", "a\n\n    b  \n c", "a\n\n    b  \n c"},
+		{"全是空白", " \uFEFF\n ", ""},
+	}
+	proxyConfig.TrimResponseWhitespace = true
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimResponseText(tt.input); got != tt.expect {
+				t.Errorf("期望 %q, 得到 %q", tt.expect, got)
+			}
+		})
+	}
+
+	proxyConfig.TrimResponseWhitespace = false
+	if got := trimResponseText(" \uFEFFx "); got != " \uFEFFx " {
+		t.Errorf("关闭时应原样返回, 得到 %q", got)
+	}
+}
+
+// TestStreamLeadingTrimmer 测试流式只清理第一段非空文本之前的内容
+func TestStreamLeadingTrimmer(t *testing.T) {
+	trimmer := &streamLeadingTrimmer{enabled: true}
+	var out []string
+	for _, chunk := range []string{"\uFEFF", " \n", "  Hello", "\n  world ", " "} {
+		out = append(out, trimmer.trim(chunk))
+	}
+	expect := []string{"", "", "Hello", "\n  world ", " "}
+	for i := range expect {
+		if out[i] != expect[i] {
+			t.Errorf("第 %d 段期望 %q, 得到 %q", i, expect[i], out[i])
+		}
+	}
+}
+
+// TestTrimResponseWhitespace_EndToEnd 测试 BOM/空白包裹的上游响应在流式和非流式下都被清理
+func TestTrimResponseWhitespace_EndToEnd(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for _, chunk := range []string{"\uFEFF", "  \n", `{\"ok\":true}`, "\n\n"} {
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", fmt.Sprintf(`{"content":"%s"}`, chunk)))
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.TrimResponseWhitespace = true
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path string, stream bool) string {
+		body := fmt.Sprintf(`{"model":"claude-sonnet-4.5","max_tokens":100,"stream":%v,"messages":[{"role":"user","content":"hi"}]}`, stream)
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		return w.Body.String()
+	}
+
+	// 非流式：首尾都被清理
+	var claudeResp ClaudeChatResponse
+	_ = json.Unmarshal([]byte(send("/v1/messages", false)), &claudeResp)
+	if len(claudeResp.Content) == 0 || claudeResp.Content[0].Text != `{"ok":true}` {
+		t.Errorf("Claude 非流式未清理: %+v", claudeResp.Content)
+	}
+	var openaiResp OpenAIChatResponse
+	_ = json.Unmarshal([]byte(send("/v1/chat/completions", false)), &openaiResp)
+	if len(openaiResp.Choices) == 0 || openaiResp.Choices[0].Message.Content != `{"ok":true}` {
+		t.Errorf("OpenAI 非流式未清理: %+v", openaiResp.Choices)
+	}
+
+	// 流式：第一段文本增量不带 BOM/空白
+	for _, path := range []string{"/v1/messages", "/v1/chat/completions"} {
+		out := send(path, true)
+		if strings.Contains(out, "\uFEFF") {
+			t.Errorf("%s 流式输出不应包含 BOM: %s", path, out)
+		}
+		if !strings.Contains(out, `"text":"{\"ok\"`) && !strings.Contains(out, `"content":"{\"ok\"`) {
+			t.Errorf("%s 第一段文本应以有效内容开头: %s", path, out)
+		}
+	}
+}
+
+// TestTrimResponseWhitespace_StreamKeepsThinking 测试流式清理只作用于正文开头，thinking 内容的空白原样保留
+func TestTrimResponseWhitespace_StreamKeepsThinking(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		// reasoningContentEvent（带工具路径）和正文中的 <thinking> 标签（无工具路径）两种 thinking 来源
+		_, _ = w.Write(encodeEventStreamMessage("reasoningContentEvent", `{"text":"\n  思考一"}`))
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", fmt.Sprintf(`{"content":"%s"}`, "\uFEFF  <thinking>\\n  思考二</thinking>\\n\\n答案")))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.TrimResponseWhitespace = true
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	// stream 返回流中拼接后的 thinking 和正文
+	stream := func(path string) (string, string) {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var thinking, text strings.Builder
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok || data == "[DONE]" {
+				continue
+			}
+			var event struct {
+				Delta struct {
+					Thinking string `json:"thinking"`
+					Text     string `json:"text"`
+				} `json:"delta"`
+				Choices []struct {
+					Delta struct {
+						ReasoningContent string `json:"reasoning_content"`
+						Content          string `json:"content"`
+					} `json:"delta"`
+				} `json:"choices"`
+			}
+			_ = json.Unmarshal([]byte(data), &event)
+			thinking.WriteString(event.Delta.Thinking)
+			text.WriteString(event.Delta.Text)
+			for _, choice := range event.Choices {
+				thinking.WriteString(choice.Delta.ReasoningContent)
+				text.WriteString(choice.Delta.Content)
+			}
+		}
+		return thinking.String(), text.String()
+	}
+
+	thinking, text := stream("/v1/messages")
+	if !strings.HasPrefix(thinking, "\n  思考一") {
+		t.Errorf("Claude 流式 thinking 不应被清理: %q", thinking)
+	}
+	if text != "答案" {
+		t.Errorf("Claude 流式正文开头应被清理: %q", text)
+	}
+
+	thinking, text = stream("/v1/chat/completions")
+	if thinking != "\n  思考二" {
+		t.Errorf("OpenAI 流式 reasoning_content 不应被清理: %q", thinking)
+	}
+	if text != "答案" {
+		t.Errorf("OpenAI 流式正文开头应被清理: %q", text)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 实际提供服务的模型 ==========
+// 为什么：模型映射/默认模型会改写请求的模型，Kiro 在模型不可用时也可能内部替换，
+// 响应里原样回显请求模型会误导客户端；上游在 messageMetadataEvent 中给出实际模型时以它为准
+
+// requestedModelHeader 模型被替换时回显客户端原始请求的模型
+const requestedModelHeader = "X-Requested-Model"
+
+// withRequestedModel 在请求 context 中记录客户端原始请求的模型
+func withRequestedModel(c *gin.Context, requested string) {
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ctxKeyRequestedModel, requested))
+}
+
+// resolveServedModel 返回响应中应使用的模型名
+// 上游给出了实际模型且与发往上游的模型不同时，返回实际模型并设置 X-Requested-Model 头；否则保持原样
+// 只能在写出响应头之前调用（流式响应在拿到 metadata 前已开始输出，不适用）
+func resolveServedModel(c *gin.Context, model string, usage *kiroclient.KiroUsage) string {
+	if usage == nil || usage.ModelID == "" || usage.ModelID == model {
+		return model
+	}
+	requested, _ := c.Request.Context().Value(ctxKeyRequestedModel).(string)
+	if requested == "" {
+		requested = model
+	}
+	c.Header(requestedModelHeader, requested)
+	return usage.ModelID
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestServedModel_Substitution 上游在 metadata 中返回了不同的模型时，响应 model 使用实际模型并回显请求模型
+func TestServedModel_Substitution(t *testing.T) {
+	servedModelID := "claude-sonnet-4"
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+		metadata := `{"tokenUsage":{"uncachedInputTokens":10,"outputTokens":2}}`
+		if servedModelID != "" {
+			metadata = `{"modelId":"` + servedModelID + `","tokenUsage":{"uncachedInputTokens":10,"outputTokens":2}}`
+		}
+		_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", metadata))
+	})
+	defer cleanup()
+
+	oldConfig, oldMapping := proxyConfig, modelMapping
+	proxyConfig = kiroclient.DefaultProxyConfig
+	modelMapping = kiroclient.ModelMapping{"gpt-4o": "claude-sonnet-4.5"}
+	defer func() { proxyConfig, modelMapping = oldConfig, oldMapping }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	modelOf := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Model string `json:"model"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Model
+	}
+
+	// Claude 格式：上游替换了模型
+	w := post("/v1/messages", `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+	if got := modelOf(w); got != servedModelID {
+		t.Errorf("响应 model 应为实际模型 %s, 得到 %s", servedModelID, got)
+	}
+	if got := w.Header().Get(requestedModelHeader); got != "claude-sonnet-4.5" {
+		t.Errorf("%s 应为请求的模型, 得到 %q", requestedModelHeader, got)
+	}
+
+	// OpenAI 格式：经过映射的模型，回显客户端原始请求的模型名
+	w = post("/v1/chat/completions", `{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`)
+	if got := modelOf(w); got != servedModelID {
+		t.Errorf("响应 model 应为实际模型 %s, 得到 %s", servedModelID, got)
+	}
+	if got := w.Header().Get(requestedModelHeader); got != "gpt-4o" {
+		t.Errorf("%s 应为映射前的模型, 得到 %q", requestedModelHeader, got)
+	}
+
+	// 上游没有返回实际模型：保持原行为
+	servedModelID = ""
+	w = post("/v1/messages", `{"model":"claude-sonnet-4.5","max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`)
+	if got := modelOf(w); got != "claude-sonnet-4.5" {
+		t.Errorf("未返回实际模型时应回显请求模型, 得到 %s", got)
+	}
+	if got := w.Header().Get(requestedModelHeader); got != "" {
+		t.Errorf("模型未替换时不应设置 %s, 得到 %q", requestedModelHeader, got)
+	}
+}
+
+// TestServedModel_WithThinkingAB 开启 thinking A/B 实验时仍能回显请求的模型（两者的 context key 不能冲突）
+func TestServedModel_WithThinkingAB(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+		_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"modelId":"claude-sonnet-4","tokenUsage":{"uncachedInputTokens":10,"outputTokens":2}}`))
+	})
+	defer cleanup()
+
+	oldConfig, oldMapping := proxyConfig, modelMapping
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ThinkingABPercent = 100
+	modelMapping = kiroclient.ModelMapping{"gpt-4o": "claude-sonnet-4.5"}
+	defer func() { proxyConfig, modelMapping = oldConfig, oldMapping }()
+
+	router := gin.New()
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(`{"model":"gpt-4o","messages":[{"role":"user","content":"hi"}]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get(requestedModelHeader); got != "gpt-4o" {
+		t.Errorf("%s 应为映射前的模型, 得到 %q", requestedModelHeader, got)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== SLO 告警 ==========
+
+// 为什么：熔断只在错误率很高时才触发，运维希望在成功率缓慢下滑（如 5 分钟低于 95%）时就收到告警
+// 目前只支持基于 circuitStats 的账号成功率；延迟类指标没有统计数据，暂不支持
+
+const (
+	// SLOMetricSuccessRate 账号成功率（窗口内成功请求 / 总请求）
+	SLOMetricSuccessRate = "successRate"
+
+	defaultSLOIntervalSeconds = 60
+	minSLOIntervalSeconds     = 10
+	sloWebhookTimeout         = 10 * time.Second
+)
+
+var sloConfigFile = "slo-config.json"
+
+// SLORule 一条 SLO 规则，对每个账号分别评估
+type SLORule struct {
+	Name          string  `json:"name"`
+	Metric        string  `json:"metric"`        // 目前只支持 successRate
+	Threshold     float64 `json:"threshold"`     // 低于该值视为违反（0-1，如 0.95）
+	WindowMinutes int     `json:"windowMinutes"` // 统计窗口（1-5 分钟，受 circuitStats 保留时长限制）
+	MinRequests   int64   `json:"minRequests"`   // 窗口内请求数少于该值时不评估，避免少量请求误报
+	// RecoveryMargin 迟滞：违反后需回升到 threshold+margin 以上才算恢复，避免在阈值附近反复告警
+	RecoveryMargin float64 `json:"recoveryMargin"`
+}
+
+// SLOConfig SLO 告警配置
+type SLOConfig struct {
+	Enabled         bool      `json:"enabled"`
+	WebhookURL      string    `json:"webhookUrl"`      // 状态变化时 POST JSON 到该地址（空=只记录日志）
+	IntervalSeconds int       `json:"intervalSeconds"` // 评估间隔
+	Rules           []SLORule `json:"rules"`
+}
+
+// SLOStatus 单条规则在单个账号上的当前状态
+type SLOStatus struct {
+	Rule      string  `json:"rule"`
+	AccountID string  `json:"accountId"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Requests  int64   `json:"requests"`
+	Threshold float64 `json:"threshold"`
+	Breached  bool    `json:"breached"`
+	Since     int64   `json:"since"` // 进入当前状态的时间戳
+}
+
+// SLOAlert 发往 webhook 的告警（breached=违反，resolved=恢复）
+type SLOAlert struct {
+	Event     string  `json:"event"`
+	Rule      string  `json:"rule"`
+	AccountID string  `json:"accountId"`
+	Metric    string  `json:"metric"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Requests  int64   `json:"requests"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+// sloEvaluator 保存配置和每个 (规则, 账号) 的状态
+type sloEvaluator struct {
+	mu     sync.Mutex
+	config SLOConfig
+	states map[string]*SLOStatus // rule + "|" + accountID -> 状态
+}
+
+// sloMonitor 全局 SLO 评估器
+var sloMonitor = &sloEvaluator{}
+
+// validateSLOConfig 校验 SLO 配置
+func validateSLOConfig(cfg SLOConfig) error {
+	if cfg.IntervalSeconds != 0 && cfg.IntervalSeconds < minSLOIntervalSeconds {
+		return fmt.Errorf("intervalSeconds 不能小于 %d", minSLOIntervalSeconds)
+	}
+	if cfg.WebhookURL != "" {
+		u, err := url.Parse(cfg.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhookUrl 无效: %s", cfg.WebhookURL)
+		}
+	}
+	names := make(map[string]bool, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("规则名称不能为空")
+		}
+		if names[r.Name] {
+			return fmt.Errorf("规则名称重复: %s", r.Name)
+		}
+		names[r.Name] = true
+		if r.Metric != SLOMetricSuccessRate {
+			return fmt.Errorf("规则 %s: 不支持的指标 %q（目前只支持 %s）", r.Name, r.Metric, SLOMetricSuccessRate)
+		}
+		if r.Threshold <= 0 || r.Threshold > 1 {
+			return fmt.Errorf("规则 %s: threshold 必须在 (0, 1] 之间", r.Name)
+		}
+		if r.WindowMinutes < 1 || r.WindowMinutes > maxWindowSeconds/60 {
+			return fmt.Errorf("规则 %s: windowMinutes 必须在 1-%d 之间", r.Name, maxWindowSeconds/60)
+		}
+		if r.MinRequests < 0 || r.RecoveryMargin < 0 || r.Threshold+r.RecoveryMargin > 1 {
+			return fmt.Errorf("规则 %s: minRequests/recoveryMargin 无效", r.Name)
+		}
+	}
+	return nil
+}
+
+// setConfig 替换配置，并丢弃已删除规则的状态
+func (e *sloEvaluator) setConfig(cfg SLOConfig) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.config = cfg
+	rules := make(map[string]bool, len(cfg.Rules))
+	for _, r := range cfg.Rules {
+		rules[r.Name] = true
+	}
+	for key, st := range e.states {
+		if !rules[st.Rule] {
+			delete(e.states, key)
+		}
+	}
+}
+
+// getConfig 返回当前配置
+func (e *sloEvaluator) getConfig() SLOConfig {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.config
+}
+
+// evaluate 对所有账号评估所有规则，返回本轮状态发生变化的告警
+func (e *sloEvaluator) evaluate(stats *CircuitStats, now time.Time) []SLOAlert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.config.Enabled || stats == nil {
+		return nil
+	}
+	if e.states == nil {
+		e.states = make(map[string]*SLOStatus)
+	}
+
+	var alerts []SLOAlert
+	for _, rule := range e.config.Rules {
+		for _, accountID := range stats.AccountIDs() {
+			errorRate, total := stats.GetErrorRate(accountID, rule.WindowMinutes)
+			if total == 0 || total < rule.MinRequests {
+				continue // 样本不足，保持原状态
+			}
+			value := 1 - errorRate
+
+			key := rule.Name + "|" + accountID
+			st, exists := e.states[key]
+			if !exists {
+				st = &SLOStatus{Rule: rule.Name, AccountID: accountID, Metric: rule.Metric, Since: now.Unix()}
+				e.states[key] = st
+			}
+			st.Value, st.Requests, st.Threshold = value, total, rule.Threshold
+
+			event := ""
+			if !st.Breached && value < rule.Threshold {
+				event = "breached"
+			} else if st.Breached && value >= rule.Threshold+rule.RecoveryMargin {
+				event = "resolved"
+			}
+			if event == "" {
+				continue
+			}
+			st.Breached = event == "breached"
+			st.Since = now.Unix()
+			alerts = append(alerts, SLOAlert{
+				Event:     event,
+				Rule:      rule.Name,
+				AccountID: accountID,
+				Metric:    rule.Metric,
+				Value:     value,
+				Threshold: rule.Threshold,
+				Requests:  total,
+				Timestamp: now.Unix(),
+			})
+		}
+	}
+	return alerts
+}
+
+// statuses 返回当前所有状态（按规则、账号排序）
+func (e *sloEvaluator) statuses() []SLOStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	result := make([]SLOStatus, 0, len(e.states))
+	for _, st := range e.states {
+		result = append(result, *st)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Rule != result[j].Rule {
+			return result[i].Rule < result[j].Rule
+		}
+		return result[i].AccountID < result[j].AccountID
+	})
+	return result
+}
+
+// sendSLOAlerts 记录告警日志并推送到 webhook（失败只记日志，不重试）
+func sendSLOAlerts(webhookURL string, alerts []SLOAlert) {
+	for _, alert := range alerts {
+		if logger != nil {
+			logger.Warn("", "SLO 状态变化", map[string]any{
+				"event":     alert.Event,
+				"rule":      alert.Rule,
+				"accountId": alert.AccountID,
+				"value":     alert.Value,
+				"threshold": alert.Threshold,
+				"requests":  alert.Requests,
+			})
+		}
+	}
+	if webhookURL == "" || len(alerts) == 0 {
+		return
+	}
+	body, _ := json.Marshal(gin.H{"alerts": alerts})
+	httpClient := &http.Client{Timeout: sloWebhookTimeout}
+	resp, err := httpClient.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+	}
+	if err != nil && logger != nil {
+		logger.Warn("", "SLO 告警推送失败", map[string]any{"error": err.Error(), "alerts": len(alerts)})
+	}
+}
+
+// sloWorker 按配置的间隔定期评估 SLO；stop 为 nil 时永不退出
+func sloWorker(stop <-chan struct{}) {
+	for {
+		interval := sloMonitor.getConfig().IntervalSeconds
+		if interval <= 0 {
+			interval = defaultSLOIntervalSeconds
+		}
+		select {
+		case <-time.After(time.Duration(interval) * time.Second):
+			alerts := sloMonitor.evaluate(circuitStats, time.Now())
+			sendSLOAlerts(sloMonitor.getConfig().WebhookURL, alerts)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// loadSLOConfig 加载 SLO 告警配置
+func loadSLOConfig() {
+	data, err := storage.Get(sloConfigFile)
+	if err != nil {
+		return
+	}
+	var cfg SLOConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return
+	}
+	if err := validateSLOConfig(cfg); err != nil {
+		if logger != nil {
+			logger.Warn("", "SLO 配置无效，已忽略", map[string]any{"error": err.Error()})
+		}
+		return
+	}
+	sloMonitor.setConfig(cfg)
+	if logger != nil {
+		logger.Info("", "SLO 配置已加载", map[string]any{
+			"enabled": cfg.Enabled,
+			"rules":   len(cfg.Rules),
+		})
+	}
+}
+
+// handleGetSLOConfig 获取 SLO 告警配置
+func handleGetSLOConfig(c *gin.Context) {
+	c.JSON(200, gin.H{"config": sloMonitor.getConfig()})
+}
+
+// handleUpdateSLOConfig 更新 SLO 告警配置
+func handleUpdateSLOConfig(c *gin.Context) {
+	var req struct {
+		Config SLOConfig `json:"config"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateSLOConfig(req.Config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	data, _ := json.MarshalIndent(req.Config, "", "  ")
+	if err := storage.Put(sloConfigFile, data); err != nil {
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+	sloMonitor.setConfig(req.Config)
+	c.JSON(200, gin.H{"message": "SLO 配置已更新"})
+}
+
+// handleSLOStatus 当前 SLO 状态（供仪表盘展示）
+func handleSLOStatus(c *gin.Context) {
+	statuses := sloMonitor.statuses()
+	breached := 0
+	for _, st := range statuses {
+		if st.Breached {
+			breached++
+		}
+	}
+	cfg := sloMonitor.getConfig()
+	c.JSON(200, gin.H{
+		"enabled":  cfg.Enabled,
+		"rules":    cfg.Rules,
+		"statuses": statuses,
+		"breached": breached,
+	})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordResults 向统计器写入 success 次成功和 failure 次失败
+func recordResults(cs *CircuitStats, accountID string, success, failure int) {
+	for i := 0; i < success; i++ {
+		cs.Record(accountID, true)
+	}
+	for i := 0; i < failure; i++ {
+		cs.Record(accountID, false)
+	}
+}
+
+// newTestSLOEvaluator 构造启用了一条成功率规则的评估器
+func newTestSLOEvaluator(margin float64) *sloEvaluator {
+	e := &sloEvaluator{}
+	e.setConfig(SLOConfig{
+		Enabled: true,
+		Rules: []SLORule{{
+			Name:           "success-95",
+			Metric:         SLOMetricSuccessRate,
+			Threshold:      0.95,
+			WindowMinutes:  5,
+			MinRequests:    10,
+			RecoveryMargin: margin,
+		}},
+	})
+	return e
+}
+
+// TestSLOEvaluate_Breach 测试成功率低于阈值时触发告警，账号之间独立评估
+func TestSLOEvaluate_Breach(t *testing.T) {
+	cs := NewCircuitStats()
+	defer cs.Close()
+	recordResults(cs, "bad", 8, 2)   // 80%
+	recordResults(cs, "good", 10, 0) // 100%
+	recordResults(cs, "quiet", 1, 1) // 样本不足
+
+	e := newTestSLOEvaluator(0)
+	alerts := e.evaluate(cs, time.Now())
+	if len(alerts) != 1 {
+		t.Fatalf("期望 1 条告警, 得到 %d: %+v", len(alerts), alerts)
+	}
+	a := alerts[0]
+	if a.Event != "breached" || a.AccountID != "bad" || a.Value != 0.8 || a.Requests != 10 {
+		t.Errorf("告警内容不正确: %+v", a)
+	}
+
+	// 状态未变化时不重复告警
+	if again := e.evaluate(cs, time.Now()); len(again) != 0 {
+		t.Errorf("持续违反不应重复告警: %+v", again)
+	}
+
+	for _, st := range e.statuses() {
+		if st.AccountID == "quiet" {
+			t.Error("样本不足的账号不应有状态")
+		}
+		if st.AccountID == "bad" && !st.Breached {
+			t.Error("bad 账号应处于违反状态")
+		}
+	}
+}
+
+// TestSLOEvaluate_Hysteresis 测试回升到阈值但未超过迟滞区间时不恢复，超过后才发送恢复告警
+func TestSLOEvaluate_Hysteresis(t *testing.T) {
+	cs := NewCircuitStats()
+	defer cs.Close()
+	e := newTestSLOEvaluator(0.03)
+
+	recordResults(cs, "acc", 18, 2) // 90%
+	if alerts := e.evaluate(cs, time.Now()); len(alerts) != 1 || alerts[0].Event != "breached" {
+		t.Fatalf("应触发违反告警: %+v", alerts)
+	}
+
+	recordResults(cs, "acc", 20, 0) // 38/40 = 95%，达到阈值但未超过 95%+3%
+	if alerts := e.evaluate(cs, time.Now()); len(alerts) != 0 {
+		t.Errorf("处于迟滞区间内不应恢复: %+v", alerts)
+	}
+
+	recordResults(cs, "acc", 60, 0) // 98/100 = 98%
+	alerts := e.evaluate(cs, time.Now())
+	if len(alerts) != 1 || alerts[0].Event != "resolved" {
+		t.Fatalf("超过迟滞区间应恢复: %+v", alerts)
+	}
+	if e.statuses()[0].Breached {
+		t.Error("恢复后状态应为未违反")
+	}
+}
+
+// TestSLOEvaluate_Disabled 测试未启用时不评估
+func TestSLOEvaluate_Disabled(t *testing.T) {
+	cs := NewCircuitStats()
+	defer cs.Close()
+	recordResults(cs, "bad", 0, 20)
+
+	e := newTestSLOEvaluator(0)
+	cfg := e.getConfig()
+	cfg.Enabled = false
+	e.setConfig(cfg)
+	if alerts := e.evaluate(cs, time.Now()); len(alerts) != 0 {
+		t.Errorf("未启用时不应告警: %+v", alerts)
+	}
+}
+
+// TestValidateSLOConfig 测试配置校验
+func TestValidateSLOConfig(t *testing.T) {
+	valid := SLORule{Name: "r", Metric: SLOMetricSuccessRate, Threshold: 0.95, WindowMinutes: 5}
+	tests := []struct {
+		name    string
+		cfg     SLOConfig
+		wantErr bool
+	}{
+		{"合法配置", SLOConfig{Rules: []SLORule{valid}, WebhookURL: "https://hooks.example.com/x"}, false},
+		{"不支持的指标", SLOConfig{Rules: []SLORule{{Name: "r", Metric: "p95Latency", Threshold: 0.9, WindowMinutes: 5}}}, true},
+		{"阈值越界", SLOConfig{Rules: []SLORule{{Name: "r", Metric: SLOMetricSuccessRate, Threshold: 1.5, WindowMinutes: 5}}}, true},
+		{"窗口超出统计保留时长", SLOConfig{Rules: []SLORule{{Name: "r", Metric: SLOMetricSuccessRate, Threshold: 0.9, WindowMinutes: 10}}}, true},
+		{"规则重名", SLOConfig{Rules: []SLORule{valid, valid}}, true},
+		{"webhook 非法", SLOConfig{WebhookURL: "ftp://x"}, true},
+		{"间隔过短", SLOConfig{IntervalSeconds: 1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateSLOConfig(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("wantErr=%v, 得到 %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+// TestSendSLOAlerts_Webhook 测试告警以 JSON 推送到 webhook
+func TestSendSLOAlerts_Webhook(t *testing.T) {
+	var mu sync.Mutex
+	var received struct {
+		Alerts []SLOAlert `json:"alerts"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer srv.Close()
+
+	sendSLOAlerts(srv.URL, []SLOAlert{{Event: "breached", Rule: "success-95", AccountID: "acc", Value: 0.8}})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received.Alerts) != 1 || received.Alerts[0].AccountID != "acc" || received.Alerts[0].Value != 0.8 {
+		t.Errorf("webhook 收到的告警不正确: %+v", received)
+	}
+}
+
+// TestSLOConfigEndpoints 测试配置更新、持久化和状态接口
+func TestSLOConfigEndpoints(t *testing.T) {
+	oldFile, oldMonitor := sloConfigFile, sloMonitor
+	sloConfigFile = filepath.Join(t.TempDir(), "slo-config.json")
+	sloMonitor = &sloEvaluator{}
+	defer func() { sloConfigFile, sloMonitor = oldFile, oldMonitor }()
+
+	router := gin.New()
+	router.POST("/api/slo/config", handleUpdateSLOConfig)
+	router.GET("/api/slo/status", handleSLOStatus)
+
+	post := func(body string) int {
+		req, _ := http.NewRequest("POST", "/api/slo/config", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := post(`{"config":{"rules":[{"name":"r","metric":"p95Latency","threshold":0.9,"windowMinutes":5}]}}`); code != 400 {
+		t.Errorf("非法配置应返回 400, 得到 %d", code)
+	}
+	if code := post(`{"config":{"enabled":true,"rules":[{"name":"r","metric":"successRate","threshold":0.9,"windowMinutes":5}]}}`); code != 200 {
+		t.Fatalf("合法配置应返回 200, 得到 %d", code)
+	}
+
+	sloMonitor = &sloEvaluator{}
+	loadSLOConfig()
+	if cfg := sloMonitor.getConfig(); !cfg.Enabled || len(cfg.Rules) != 1 {
+		t.Errorf("配置应已持久化并可重新加载: %+v", cfg)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/slo/status", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var resp struct {
+		Enabled  bool        `json:"enabled"`
+		Statuses []SLOStatus `json:"statuses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.Enabled {
+		t.Errorf("状态接口响应不正确: %s", w.Body.String())
+	}
+}
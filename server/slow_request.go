@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 慢请求日志 ==========
+// TraceMiddleware 为每个请求挂上 requestMetrics，聊天处理函数补充模型、账号、首 token 时间和 token 数，
+// 请求结束时总耗时超过 ProxyConfig.SlowRequestMs 才输出一条 WARN 日志
+
+// requestMetrics 单个请求的延迟和用量信息（方法均可在 nil 上调用，未经过 TraceMiddleware 时直接忽略）
+type requestMetrics struct {
+	mu           sync.Mutex
+	start        time.Time
+	model        string
+	accountID    string
+	firstTokenAt time.Time
+	inputTokens  int
+	outputTokens int
+}
+
+// withRequestMetrics 创建 requestMetrics 并挂到 context 上
+func withRequestMetrics(ctx context.Context, start time.Time) (context.Context, *requestMetrics) {
+	m := &requestMetrics{start: start}
+	return context.WithValue(ctx, ctxKeyRequestMetrics, m), m
+}
+
+// requestMetricsFrom 从 context 取出 requestMetrics（没有时返回 nil）
+func requestMetricsFrom(ctx context.Context) *requestMetrics {
+	m, _ := ctx.Value(ctxKeyRequestMetrics).(*requestMetrics)
+	return m
+}
+
+// setModel 记录请求的模型
+func (m *requestMetrics) setModel(model string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.model = model
+	m.mu.Unlock()
+}
+
+// markFirstToken 记录收到第一个上游内容的时间（只记第一次）
+func (m *requestMetrics) markFirstToken() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if m.firstTokenAt.IsZero() {
+		m.firstTokenAt = time.Now()
+	}
+	m.mu.Unlock()
+}
+
+// setResult 记录处理请求的账号和 token 数
+func (m *requestMetrics) setResult(accountID string, inputTokens, outputTokens int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.accountID = accountID
+	m.inputTokens = inputTokens
+	m.outputTokens = outputTokens
+	m.mu.Unlock()
+}
+
+// logSlowRequest 总耗时超过 SlowRequestMs 时输出 WARN 日志
+func logSlowRequest(logger *StructuredLogger, c *gin.Context, msgID string, m *requestMetrics, duration time.Duration) {
+	threshold := proxyConfig.SlowRequestMs
+	if threshold <= 0 || duration < time.Duration(threshold)*time.Millisecond {
+		return
+	}
+
+	m.mu.Lock()
+	logData := map[string]any{
+		"method":       c.Request.Method,
+		"path":         c.Request.URL.Path,
+		"statusCode":   c.Writer.Status(),
+		"latencyMs":    duration.Milliseconds(),
+		"thresholdMs":  threshold,
+		"model":        m.model,
+		"accountId":    m.accountID,
+		"inputTokens":  m.inputTokens,
+		"outputTokens": m.outputTokens,
+	}
+	if !m.firstTokenAt.IsZero() {
+		logData["ttftMs"] = m.firstTokenAt.Sub(m.start).Milliseconds()
+	}
+	m.mu.Unlock()
+	if fp := c.GetString(RequestFingerprintKey); fp != "" {
+		logData["fingerprint"] = fp
+	}
+
+	logger.Warn(msgID, "慢请求", logData)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestSlowRequestLog 测试只有总耗时超过 SlowRequestMs 的请求才输出慢请求日志，且日志带模型、账号、TTFT 和 token 数
+func TestSlowRequestLog(t *testing.T) {
+	upstreamDelay := time.Duration(0)
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(upstreamDelay)
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"ok"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.SlowRequestMs = 50
+	defer func() { proxyConfig = oldConfig }()
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	testLogger := &StructuredLogger{zap: zap.New(core), level: zap.NewAtomicLevelAt(zapcore.WarnLevel)}
+
+	router := gin.New()
+	router.Use(TraceMiddleware(testLogger))
+	router.POST("/v1/messages", handleClaudeChat)
+	send := func() int {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := send(); code != 200 {
+		t.Fatalf("期望 200, 得到 %d", code)
+	}
+	if n := logs.FilterMessage("慢请求").Len(); n != 0 {
+		t.Fatalf("快请求不应输出慢请求日志, 得到 %d 条", n)
+	}
+
+	upstreamDelay = 80 * time.Millisecond
+	if code := send(); code != 200 {
+		t.Fatalf("期望 200, 得到 %d", code)
+	}
+	entries := logs.FilterMessage("慢请求").All()
+	if len(entries) != 1 {
+		t.Fatalf("慢请求应输出 1 条日志, 得到 %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["model"] != "claude-sonnet-4.5" {
+		t.Errorf("model 错误: %v", fields["model"])
+	}
+	if latency, _ := fields["latencyMs"].(int64); latency < 50 {
+		t.Errorf("latencyMs 应不小于阈值: %v", fields["latencyMs"])
+	}
+	if ttft, ok := fields["ttftMs"].(int64); !ok || ttft < 50 {
+		t.Errorf("ttftMs 应包含上游延迟: %v", fields["ttftMs"])
+	}
+	for _, key := range []string{"accountId", "inputTokens", "outputTokens"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("日志缺少字段 %s: %v", key, fields)
+		}
+	}
+
+	// 0 表示关闭
+	proxyConfig.SlowRequestMs = 0
+	send()
+	if n := logs.FilterMessage("慢请求").Len(); n != 1 {
+		t.Errorf("关闭后不应再输出慢请求日志, 共 %d 条", n)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ========== 统计持久化 ==========
+// 为什么单独处理：统计文件读写失败时以前静默重置/丢弃，磁盘满或只读时所有统计悄悄丢失
+// 现在写失败记 ERROR 日志并计数（/api/stats 可见），请求照常处理，内存中的统计继续累加
+
+// PersistenceFailure 单个统计文件的持久化失败情况
+type PersistenceFailure struct {
+	Count        int64  `json:"count"`
+	LastError    string `json:"lastError,omitempty"`
+	LastFailedAt int64  `json:"lastFailedAt,omitempty"`
+}
+
+var persistenceFailures = make(map[string]*PersistenceFailure) // 统计名 -> 失败情况
+var persistenceFailuresMutex sync.Mutex
+
+// recordPersistenceFailure 记录一次读写失败并输出 ERROR 日志
+func recordPersistenceFailure(name, op string, err error) {
+	persistenceFailuresMutex.Lock()
+	f, ok := persistenceFailures[name]
+	if !ok {
+		f = &PersistenceFailure{}
+		persistenceFailures[name] = f
+	}
+	f.Count++
+	f.LastError = fmt.Sprintf("%s: %v", op, err)
+	f.LastFailedAt = time.Now().Unix()
+	persistenceFailuresMutex.Unlock()
+
+	if logger != nil {
+		logger.Error("", "统计持久化失败", map[string]any{
+			"stats": name,
+			"op":    op,
+			"error": err.Error(),
+		})
+	}
+}
+
+// getPersistenceFailures 获取各统计文件的持久化失败情况（返回副本）
+func getPersistenceFailures() map[string]PersistenceFailure {
+	persistenceFailuresMutex.Lock()
+	defer persistenceFailuresMutex.Unlock()
+	result := make(map[string]PersistenceFailure, len(persistenceFailures))
+	for k, v := range persistenceFailures {
+		result[k] = *v
+	}
+	return result
+}
+
+// statsBackupSuffix 最后一次成功加载的统计文件副本的后缀
+const statsBackupSuffix = ".bak"
+
+// loadStatsFile 读取统计文件到 v，返回是否成功加载
+// 文件不存在视为全新启动；读取失败或内容损坏时记录失败，损坏的文件改名备份，避免下次落盘时被静默覆盖，
+// 然后尝试从 .bak（最后一次成功加载的副本）恢复；加载成功时刷新 .bak
+func loadStatsFile(name, path string, v any) bool {
+	data, err := storage.Get(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+		recordPersistenceFailure(name, "read", err)
+		return restoreStatsBackup(name, path, v)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		backup := fmt.Sprintf("%s.corrupt-%d", path, time.Now().Unix())
+		recordPersistenceFailure(name, "parse", err)
+		if backupErr := backupStorageKey(path, backup, data); backupErr != nil {
+			recordPersistenceFailure(name, "backup", backupErr)
+		} else if logger != nil {
+			logger.Warn("", "统计文件已损坏，已备份后重新开始", map[string]any{
+				"stats":  name,
+				"backup": backup,
+			})
+		}
+		return restoreStatsBackup(name, path, v)
+	}
+	if err := storage.Put(path+statsBackupSuffix, data); err != nil {
+		recordPersistenceFailure(name, "backup", err)
+	}
+	return true
+}
+
+// restoreStatsBackup 从 .bak 恢复统计到 v，返回是否恢复成功
+func restoreStatsBackup(name, path string, v any) bool {
+	backup := path + statsBackupSuffix
+	data, err := storage.Get(backup)
+	if err != nil {
+		return false
+	}
+	// 主文件解析失败时 v 可能已被部分填充，先清零
+	reflect.ValueOf(v).Elem().SetZero()
+	if err := json.Unmarshal(data, v); err != nil {
+		recordPersistenceFailure(name, "parse backup", err)
+		return false
+	}
+	if logger != nil {
+		logger.Warn("", "统计文件无法加载，已从备份恢复", map[string]any{
+			"stats":  name,
+			"backup": backup,
+		})
+	}
+	return true
+}
+
+// writeStatsFile 写入统计文件，失败时记录并返回错误
+func writeStatsFile(name, path string, data []byte) error {
+	if err := storage.Put(path, data); err != nil {
+		recordPersistenceFailure(name, "write", err)
+		return err
+	}
+	return nil
+}
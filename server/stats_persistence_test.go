@@ -0,0 +1,221 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTempStatsFiles 把统计落盘文件指向临时目录，测试结束后恢复
+// 为什么：统计文件是相对路径，集成测试 Chdir("..") 之后落盘会覆盖仓库根目录下的 account-stats.json
+func useTempStatsFiles(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	oldToken, oldAccount, oldCircuit, oldKeyUsage := tokenStatsFile, accountStatsFile, circuitStatsFile, apiKeyUsageFile
+	tokenStatsFile = filepath.Join(dir, "token-stats.json")
+	accountStatsFile = filepath.Join(dir, "account-stats.json")
+	circuitStatsFile = filepath.Join(dir, "circuit-stats.json")
+	apiKeyUsageFile = filepath.Join(dir, "api-key-usage.json")
+	t.Cleanup(func() {
+		tokenStatsFile, accountStatsFile, circuitStatsFile, apiKeyUsageFile = oldToken, oldAccount, oldCircuit, oldKeyUsage
+	})
+	return dir
+}
+
+// resetPersistenceFailures 清空失败计数，测试结束后恢复
+func resetPersistenceFailures(t *testing.T) {
+	t.Helper()
+	persistenceFailuresMutex.Lock()
+	old := persistenceFailures
+	persistenceFailures = make(map[string]*PersistenceFailure)
+	persistenceFailuresMutex.Unlock()
+	t.Cleanup(func() {
+		persistenceFailuresMutex.Lock()
+		persistenceFailures = old
+		persistenceFailuresMutex.Unlock()
+	})
+}
+
+// TestSaveStats_Unwritable 测试统计文件无法写入时返回错误并计数，内存统计继续累加
+func TestSaveStats_Unwritable(t *testing.T) {
+	resetPersistenceFailures(t)
+	dir := t.TempDir()
+	// 父路径是普通文件，任何用户（包括 root）都无法在其下创建文件，模拟只读/不可写的磁盘
+	blocker := filepath.Join(dir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldTokenFile, oldAccountFile, oldStats := tokenStatsFile, accountStatsFile, tokenStats
+	tokenStatsFile = filepath.Join(blocker, "token-stats.json")
+	accountStatsFile = filepath.Join(blocker, "account-stats.json")
+	tokenStats = TokenStats{}
+	defer func() { tokenStatsFile, accountStatsFile, tokenStats = oldTokenFile, oldAccountFile, oldStats }()
+
+	if err := saveTokenStats(); err == nil {
+		t.Error("不可写时 saveTokenStats 应返回错误")
+	}
+	if err := saveAccountStats(); err == nil {
+		t.Error("不可写时 saveAccountStats 应返回错误")
+	}
+	_ = saveTokenStats()
+
+	failures := getPersistenceFailures()
+	if f := failures["tokenStats"]; f.Count != 2 || f.LastError == "" || f.LastFailedAt == 0 {
+		t.Errorf("tokenStats 失败计数不正确: %+v", f)
+	}
+	if f := failures["accountStats"]; f.Count != 1 {
+		t.Errorf("accountStats 失败计数不正确: %+v", f)
+	}
+
+	applyTokenDelta(TokenDelta{Input: 3, Output: 4})
+	if got := getTokenStats(); got.TotalTokens != 7 {
+		t.Errorf("落盘失败不应影响内存统计: %+v", got)
+	}
+}
+
+// TestLoadStats_CorruptFile 测试损坏的统计文件被备份而不是静默覆盖，且计入失败
+func TestLoadStats_CorruptFile(t *testing.T) {
+	resetPersistenceFailures(t)
+	dir := t.TempDir()
+	oldFile, oldStats := tokenStatsFile, tokenStats
+	tokenStatsFile = filepath.Join(dir, "token-stats.json")
+	defer func() { tokenStatsFile, tokenStats = oldFile, oldStats }()
+
+	corrupt := []byte(`{"inputTokens": 12`)
+	if err := os.WriteFile(tokenStatsFile, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenStats = TokenStats{InputTokens: 99}
+	loadTokenStats()
+
+	if tokenStats != (TokenStats{}) {
+		t.Errorf("损坏文件应从空统计开始: %+v", tokenStats)
+	}
+	if _, err := os.Stat(tokenStatsFile); !os.IsNotExist(err) {
+		t.Error("损坏文件应被改名备份")
+	}
+	backups, _ := filepath.Glob(tokenStatsFile + ".corrupt-*")
+	if len(backups) != 1 {
+		t.Fatalf("应生成 1 个备份文件, 得到 %v", backups)
+	}
+	if data, _ := os.ReadFile(backups[0]); string(data) != string(corrupt) {
+		t.Errorf("备份内容应与原文件一致: %q", data)
+	}
+	if f := getPersistenceFailures()["tokenStats"]; f.Count != 1 {
+		t.Errorf("损坏文件应计入失败: %+v", f)
+	}
+}
+
+// TestLoadStats_RestoreFromBackup 测试加载成功时保留 .bak，主文件损坏时从 .bak 恢复而不是清零
+func TestLoadStats_RestoreFromBackup(t *testing.T) {
+	resetPersistenceFailures(t)
+	dir := t.TempDir()
+	oldTokenFile, oldAccountFile, oldStats := tokenStatsFile, accountStatsFile, tokenStats
+	tokenStatsFile = filepath.Join(dir, "token-stats.json")
+	accountStatsFile = filepath.Join(dir, "account-stats.json")
+	defer func() { tokenStatsFile, accountStatsFile, tokenStats = oldTokenFile, oldAccountFile, oldStats }()
+
+	tokenStats = TokenStats{InputTokens: 12, OutputTokens: 3, TotalTokens: 15}
+	if err := saveTokenStats(); err != nil {
+		t.Fatal(err)
+	}
+	accountStatsMutex.Lock()
+	oldAccountStats := accountStats
+	accountStats = map[string]*AccountStats{"acc-1": {Email: "a@example.com", RequestCount: 7}}
+	accountStatsMutex.Unlock()
+	defer func() {
+		accountStatsMutex.Lock()
+		accountStats = oldAccountStats
+		accountStatsMutex.Unlock()
+	}()
+	if err := saveAccountStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 正常加载后生成 .bak
+	loadTokenStats()
+	loadAccountStats()
+	if _, err := os.Stat(tokenStatsFile + ".bak"); err != nil {
+		t.Fatalf("加载成功后应保留 .bak: %v", err)
+	}
+
+	// 模拟写到一半断电：主文件被截断
+	for _, path := range []string{tokenStatsFile, accountStatsFile} {
+		if err := os.WriteFile(path, []byte(`{"inputTok`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tokenStats = TokenStats{}
+	loadTokenStats()
+	if tokenStats.InputTokens != 12 || tokenStats.TotalTokens != 15 {
+		t.Errorf("主文件损坏时应从 .bak 恢复: %+v", tokenStats)
+	}
+	accountStatsMutex.Lock()
+	accountStats = nil
+	accountStatsMutex.Unlock()
+	loadAccountStats()
+	accountStatsMutex.Lock()
+	restored := accountStats["acc-1"]
+	accountStatsMutex.Unlock()
+	if restored == nil || restored.RequestCount != 7 {
+		t.Errorf("账号统计应从 .bak 恢复: %+v", restored)
+	}
+	if f := getPersistenceFailures()["tokenStats"]; f.Count != 1 {
+		t.Errorf("主文件损坏仍应计入失败: %+v", f)
+	}
+}
+
+// TestLoadStats_MissingFile 测试文件不存在视为全新启动，不计入失败
+func TestLoadStats_MissingFile(t *testing.T) {
+	resetPersistenceFailures(t)
+	oldTokenFile, oldAccountFile, oldStats := tokenStatsFile, accountStatsFile, tokenStats
+	tokenStatsFile = filepath.Join(t.TempDir(), "token-stats.json")
+	accountStatsFile = filepath.Join(t.TempDir(), "account-stats.json")
+	defer func() { tokenStatsFile, accountStatsFile, tokenStats = oldTokenFile, oldAccountFile, oldStats }()
+
+	loadTokenStats()
+	loadAccountStats()
+	if failures := getPersistenceFailures(); len(failures) != 0 {
+		t.Errorf("文件不存在不应计入失败: %+v", failures)
+	}
+}
+
+// TestTokenStats_SourceBuckets 测试精确 usage 和本地估算的增量分别计入 exact/estimated，且随统计一起落盘
+func TestTokenStats_SourceBuckets(t *testing.T) {
+	useMemoryStorage(t)
+	oldStats := tokenStats
+	tokenStats = TokenStats{}
+	defer func() { tokenStats = oldStats }()
+
+	// 先清空其他测试留在通道里的增量（测试中没有启动 tokenStatsWorker）
+	for len(tokenStatsChan) > 0 {
+		<-tokenStatsChan
+	}
+	addTokenStats(100, 20, true)
+	addTokenStats(30, 5, false)
+	addTokenStats(10, 1, true)
+	for i := 0; i < 3; i++ {
+		applyTokenDelta(<-tokenStatsChan)
+	}
+
+	got := getTokenStats()
+	if got.Exact != (TokenSourceStats{InputTokens: 110, OutputTokens: 21, RequestCount: 2}) {
+		t.Errorf("exact 统计错误: %+v", got.Exact)
+	}
+	if got.Estimated != (TokenSourceStats{InputTokens: 30, OutputTokens: 5, RequestCount: 1}) {
+		t.Errorf("estimated 统计错误: %+v", got.Estimated)
+	}
+	if got.TotalTokens != 166 || got.RequestCount != 3 {
+		t.Errorf("总数应包含两种来源: %+v", got)
+	}
+
+	if err := saveTokenStats(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	tokenStats = TokenStats{}
+	loadTokenStats()
+	if tokenStats.Exact != got.Exact || tokenStats.Estimated != got.Estimated {
+		t.Errorf("拆分统计应随文件恢复: %+v", tokenStats)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 统计重置 ==========
+// 为什么：压测或联调结束后需要清空统计，以前只能停服删除 token-stats.json 和 account-stats.json
+
+// 重置范围
+const (
+	statsResetAll      = "all"
+	statsResetTokens   = "tokens"
+	statsResetAccounts = "accounts"
+)
+
+// resetTokenStats 清零全局 Token 统计，返回清零前的值
+// 持锁期间先把通道中已排队的增量并入旧值再清零，避免 tokenStatsWorker 之后把重置前的请求计入新统计
+func resetTokenStats() TokenStats {
+	tokenStatsMutex.Lock()
+	defer tokenStatsMutex.Unlock()
+	for drained := false; !drained; {
+		select {
+		case delta := <-tokenStatsChan:
+			applyTokenDeltaLocked(delta)
+		default:
+			drained = true
+		}
+	}
+	before := tokenStats
+	tokenStats = TokenStats{UpdatedAt: time.Now().Unix()}
+	return before
+}
+
+// resetAccountStats 清空账号统计，返回清空前的统计
+func resetAccountStats() map[string]*AccountStats {
+	accountStatsMutex.Lock()
+	defer accountStatsMutex.Unlock()
+	before := accountStats
+	accountStats = make(map[string]*AccountStats)
+	return before
+}
+
+// handleResetStats 重置统计并立即落盘，返回重置前的值
+// 请求体可选：{"scope":"all"|"tokens"|"accounts"}，默认 all
+func handleResetStats(c *gin.Context) {
+	var req struct {
+		Scope string `json:"scope"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	scope := req.Scope
+	if scope == "" {
+		scope = statsResetAll
+	}
+	switch scope {
+	case statsResetAll, statsResetTokens, statsResetAccounts:
+	default:
+		c.JSON(400, gin.H{"error": fmt.Sprintf("scope 只支持 all、tokens、accounts，收到 %q", scope)})
+		return
+	}
+
+	resp := gin.H{"message": "统计已重置", "scope": scope}
+	var saveErr error
+	if scope != statsResetAccounts {
+		resp["tokens"] = resetTokenStats()
+		saveErr = errors.Join(saveErr, saveTokenStats())
+	}
+	if scope != statsResetTokens {
+		resp["accounts"] = resetAccountStats()
+		saveErr = errors.Join(saveErr, saveAccountStats())
+	}
+
+	if logger != nil {
+		logger.Warn(GetMsgID(c), "统计已重置", map[string]any{"scope": scope})
+	}
+	if saveErr != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, saveErr, "")
+		}
+		// 内存统计已重置，只是落盘失败（下次定时落盘会重试）
+		resp["error"] = "落盘失败: " + saveErr.Error()
+		c.JSON(500, resp)
+		return
+	}
+	c.JSON(200, resp)
+}
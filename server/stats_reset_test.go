@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestResetStats 按 scope 重置统计、立即落盘并返回重置前的值，排队中的增量计入重置前
+func TestResetStats(t *testing.T) {
+	useMemoryStorage(t)
+	oldStats := tokenStats
+	accountStatsMutex.Lock()
+	oldAccountStats := accountStats
+	accountStats = make(map[string]*AccountStats)
+	accountStatsMutex.Unlock()
+	defer func() {
+		tokenStats = oldStats
+		accountStatsMutex.Lock()
+		accountStats = oldAccountStats
+		accountStatsMutex.Unlock()
+	}()
+	for len(tokenStatsChan) > 0 {
+		<-tokenStatsChan
+	}
+
+	router := gin.New()
+	router.POST("/api/stats/reset", handleResetStats)
+	send := func(body string) (int, map[string]any) {
+		req, _ := http.NewRequest("POST", "/api/stats/reset", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp map[string]any
+		_ = json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	tokenStats = TokenStats{InputTokens: 100, OutputTokens: 10, TotalTokens: 110, RequestCount: 1}
+	addTokenStats(5, 5, true) // 还在通道中排队
+	recordAccountRequest("reset-acc", "", 200, "")
+
+	// 只重置账号统计
+	code, resp := send(`{"scope":"accounts"}`)
+	if code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %v", code, resp)
+	}
+	if accounts, _ := resp["accounts"].(map[string]any); accounts["reset-acc"] == nil {
+		t.Errorf("应返回重置前的账号统计: %v", resp)
+	}
+	if len(getAccountStats()) != 0 || getTokenStats().InputTokens != 100 {
+		t.Error("scope=accounts 只应清空账号统计")
+	}
+
+	// 不带请求体时全部重置，排队中的增量计入重置前的值
+	code, resp = send("")
+	if code != 200 {
+		t.Fatalf("期望 200, 得到 %d: %v", code, resp)
+	}
+	if before, _ := resp["tokens"].(map[string]any); before["inputTokens"] != float64(105) || before["requestCount"] != float64(2) {
+		t.Errorf("应返回包含排队增量的重置前统计: %v", resp["tokens"])
+	}
+	if got := getTokenStats(); got.TotalTokens != 0 || got.RequestCount != 0 || len(tokenStatsChan) != 0 {
+		t.Errorf("重置后统计应为 0 且通道已清空: %+v", got)
+	}
+
+	// 重置结果已落盘
+	tokenStats = TokenStats{InputTokens: 1}
+	loadTokenStats()
+	if tokenStats.InputTokens != 0 {
+		t.Errorf("落盘的统计应为重置后的值: %+v", tokenStats)
+	}
+
+	if code, _ := send(`{"scope":"everything"}`); code != 400 {
+		t.Errorf("未知 scope 应返回 400, 得到 %d", code)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ========== 持久化存储后端 ==========
+// 为什么抽象：所有配置和统计都是按名称整体读写的 JSON，统一经过 Storage 后，
+// 多副本部署可以换成 Redis/etcd 等共享后端；默认的文件实现与原来的行为一致，无需任何配置
+
+// Storage 按名称（key）整体读写数据的存储后端
+// 文件实现中 key 就是文件路径（如 proxy-config.json）
+type Storage interface {
+	// Get 读取 key 的内容，不存在时返回的错误满足 errors.Is(err, fs.ErrNotExist)
+	Get(key string) ([]byte, error)
+	// Put 覆盖写入 key 的内容
+	Put(key string, data []byte) error
+	// Delete 删除 key，不存在时不报错
+	Delete(key string) error
+	// Watch 在 key 的内容被（其他副本或外部）修改后回调 onChange，返回停止监听的函数
+	// 删除 key 时以 nil 回调
+	Watch(key string, onChange func(data []byte)) (stop func())
+}
+
+// storage 当前使用的存储后端（默认本地文件）
+var storage Storage = fileStorage{}
+
+// fileStorageWatchInterval 文件实现 Watch 的轮询间隔
+var fileStorageWatchInterval = 2 * time.Second
+
+// fileStorage 本地文件实现（key 为文件路径，相对路径基于工作目录）
+type fileStorage struct{}
+
+// Get 读取文件
+func (fileStorage) Get(key string) ([]byte, error) {
+	return os.ReadFile(key)
+}
+
+// Put 写入文件：先写同目录下的临时文件并刷盘，再 rename 覆盖目标（POSIX 上是原子操作）
+// 为什么：统计文件每 10/30 秒落盘一次，直接写目标文件时崩溃或断电会留下截断的 JSON
+func (fileStorage) Put(key string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(key), filepath.Base(key)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	// rename 成功后临时文件已不存在，Remove 是空操作
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp 创建的文件权限是 0600，与原来 os.WriteFile 的 0644 保持一致
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, key)
+}
+
+// Delete 删除文件
+func (fileStorage) Delete(key string) error {
+	if err := os.Remove(key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Watch 轮询文件修改时间和大小，变化时回调
+func (fileStorage) Watch(key string, onChange func(data []byte)) func() {
+	done := make(chan struct{})
+	stat := func() (time.Time, int64, bool) {
+		info, err := os.Stat(key)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		return info.ModTime(), info.Size(), true
+	}
+	lastMod, lastSize, lastExists := stat()
+
+	go func() {
+		ticker := time.NewTicker(fileStorageWatchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				mod, size, exists := stat()
+				if exists == lastExists && mod.Equal(lastMod) && size == lastSize {
+					continue
+				}
+				lastMod, lastSize, lastExists = mod, size, exists
+				if !exists {
+					onChange(nil)
+					continue
+				}
+				if data, err := os.ReadFile(key); err == nil {
+					onChange(data)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// backupStorageKey 把损坏的内容另存为 backup 后删除原 key，避免下次落盘时被静默覆盖
+func backupStorageKey(key, backup string, data []byte) error {
+	if err := storage.Put(backup, data); err != nil {
+		return err
+	}
+	return storage.Delete(key)
+}
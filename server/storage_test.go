@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStorage 内存实现的 Storage（测试用，模拟共享后端）
+type memoryStorage struct {
+	mu       sync.Mutex
+	data     map[string][]byte
+	watchers map[string][]func([]byte)
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{data: make(map[string][]byte), watchers: make(map[string][]func([]byte))}
+}
+
+func (m *memoryStorage) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.data[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *memoryStorage) Put(key string, data []byte) error {
+	m.mu.Lock()
+	m.data[key] = append([]byte(nil), data...)
+	watchers := m.watchers[key]
+	m.mu.Unlock()
+	for _, fn := range watchers {
+		fn(data)
+	}
+	return nil
+}
+
+func (m *memoryStorage) Delete(key string) error {
+	m.mu.Lock()
+	_, existed := m.data[key]
+	delete(m.data, key)
+	watchers := m.watchers[key]
+	m.mu.Unlock()
+	if existed {
+		for _, fn := range watchers {
+			fn(nil)
+		}
+	}
+	return nil
+}
+
+func (m *memoryStorage) Watch(key string, onChange func([]byte)) func() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers[key] = append(m.watchers[key], onChange)
+	idx := len(m.watchers[key]) - 1
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.watchers[key][idx] = func([]byte) {}
+	}
+}
+
+// useMemoryStorage 测试期间把全局 storage 换成内存实现
+func useMemoryStorage(t *testing.T) *memoryStorage {
+	t.Helper()
+	mem := newMemoryStorage()
+	old := storage
+	storage = mem
+	t.Cleanup(func() { storage = old })
+	return mem
+}
+
+// TestStorage_ConfigRoundTrip 测试配置的 load/save 都经过 Storage，不再直接读写文件
+func TestStorage_ConfigRoundTrip(t *testing.T) {
+	mem := useMemoryStorage(t)
+
+	oldKeys := apiKeys
+	defer func() { apiKeys = oldKeys }()
+	apiKeys = []string{"sk-a", "sk-b"}
+	if err := saveApiKeys(); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	if _, err := os.Stat(apiKeysFile); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("使用内存存储时不应写文件 %s", apiKeysFile)
+	}
+	if data, _ := mem.Get(apiKeysFile); !strings.Contains(string(data), "sk-b") {
+		t.Errorf("内存存储中应有保存的内容: %s", data)
+	}
+
+	apiKeys = nil
+	loadApiKeys()
+	if len(apiKeys) != 2 || apiKeys[1] != "sk-b" {
+		t.Errorf("应从存储加载 API-KEY: %v", apiKeys)
+	}
+
+	oldMaintenance := maintenanceConfig
+	defer func() { maintenanceConfig = oldMaintenance }()
+	cfg := defaultMaintenanceConfig()
+	cfg.Enabled = true
+	cfg.Message = "升级中"
+	if err := saveMaintenanceConfig(cfg); err != nil {
+		t.Fatalf("保存失败: %v", err)
+	}
+	maintenanceConfig = defaultMaintenanceConfig()
+	loadMaintenanceConfig()
+	if !maintenanceConfig.Enabled || maintenanceConfig.Message != "升级中" {
+		t.Errorf("应从存储加载维护模式配置: %+v", maintenanceConfig)
+	}
+}
+
+// TestStorage_CorruptStatsBackup 测试损坏的统计数据在存储中另存备份后删除原 key
+func TestStorage_CorruptStatsBackup(t *testing.T) {
+	mem := useMemoryStorage(t)
+	_ = mem.Put("stats.json", []byte("{broken"))
+
+	var v map[string]int
+	if loadStatsFile("testStats", "stats.json", &v) {
+		t.Fatal("损坏的数据不应加载成功")
+	}
+	if _, err := mem.Get("stats.json"); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("损坏的原 key 应被删除")
+	}
+	mem.mu.Lock()
+	backups := 0
+	for key, data := range mem.data {
+		if strings.HasPrefix(key, "stats.json.corrupt-") && string(data) == "{broken" {
+			backups++
+		}
+	}
+	mem.mu.Unlock()
+	if backups != 1 {
+		t.Errorf("应有 1 个备份, 得到 %d", backups)
+	}
+
+	// 不存在的 key 视为全新启动，不记为失败
+	if loadStatsFile("missingStats", "missing.json", &v) {
+		t.Error("不存在的 key 不应加载成功")
+	}
+	if _, failed := getPersistenceFailures()["missingStats"]; failed {
+		t.Error("不存在的 key 不应记为持久化失败")
+	}
+}
+
+// TestFileStorage 测试文件实现的读写删除和 Watch
+func TestFileStorage(t *testing.T) {
+	oldInterval := fileStorageWatchInterval
+	fileStorageWatchInterval = 10 * time.Millisecond
+	defer func() { fileStorageWatchInterval = oldInterval }()
+
+	fsStorage := fileStorage{}
+	key := filepath.Join(t.TempDir(), "config.json")
+	if _, err := fsStorage.Get(key); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("不存在时应返回 fs.ErrNotExist, 得到 %v", err)
+	}
+
+	// 写入经临时文件 + rename 完成，不留下临时文件，权限与 os.WriteFile 一致
+	if err := fsStorage.Put(key, []byte(`{}`)); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	if leftovers, _ := filepath.Glob(key + ".tmp-*"); len(leftovers) != 0 {
+		t.Errorf("写入后不应留下临时文件: %v", leftovers)
+	}
+	if info, err := os.Stat(key); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("文件权限应为 0644: %v %v", info.Mode(), err)
+	}
+
+	changes := make(chan []byte, 4)
+	stop := fsStorage.Watch(key, func(data []byte) { changes <- data })
+	defer stop()
+
+	if err := fsStorage.Put(key, []byte(`{"a":1}`)); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	select {
+	case data := <-changes:
+		if string(data) != `{"a":1}` {
+			t.Errorf("Watch 回调内容错误: %s", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("写入后应触发 Watch 回调")
+	}
+
+	if err := fsStorage.Delete(key); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	select {
+	case data := <-changes:
+		if data != nil {
+			t.Errorf("删除后应以 nil 回调, 得到 %s", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("删除后应触发 Watch 回调")
+	}
+	if err := fsStorage.Delete(key); err != nil {
+		t.Errorf("重复删除不应报错: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// ========== 流式文本合并 ==========
+
+// defaultStreamFlushMaxWait StreamFlushMaxWaitMs 未配置时缓冲文本的最长等待时间
+const defaultStreamFlushMaxWait = 50 * time.Millisecond
+
+// streamCoalescer 把连续的文本增量合并成较大的 SSE 帧
+// 累计字节数达到阈值或缓冲超过 maxWait 时发送一帧；thinking/text 切换时先发送旧缓冲
+//
+// 并发约定：add/flush 只能在 enter() 返回的临界区内调用（上游回调整段持有锁），
+// maxWait 计时器在自己的 goroutine 里加锁发送，保证与处理器的其他写入互斥；
+// 上游流结束后调用 close()，之后 add 直接透传
+type streamCoalescer struct {
+	mu         sync.Mutex
+	threshold  int
+	maxWait    time.Duration
+	emit       func(text string, isThinking bool)
+	buf        strings.Builder
+	isThinking bool
+	timer      *time.Timer
+	closed     bool
+}
+
+// newStreamCoalescer 创建合并器（threshold<=0 时每个增量立即发送，与不合并时行为一致）
+func newStreamCoalescer(threshold int, maxWait time.Duration, emit func(text string, isThinking bool)) *streamCoalescer {
+	if maxWait <= 0 {
+		maxWait = defaultStreamFlushMaxWait
+	}
+	return &streamCoalescer{threshold: threshold, maxWait: maxWait, emit: emit}
+}
+
+// newStreamCoalescerFromConfig 按 ProxyConfig.StreamFlushBytes / StreamFlushMaxWaitMs 创建合并器
+func newStreamCoalescerFromConfig(emit func(text string, isThinking bool)) *streamCoalescer {
+	return newStreamCoalescer(proxyConfig.StreamFlushBytes, time.Duration(proxyConfig.StreamFlushMaxWaitMs)*time.Millisecond, emit)
+}
+
+// enter 进入临界区，返回解锁函数（用法：defer coalescer.enter()()）
+func (s *streamCoalescer) enter() func() {
+	s.mu.Lock()
+	return s.mu.Unlock
+}
+
+// add 加入一段文本（调用方需持有锁）
+func (s *streamCoalescer) add(text string, isThinking bool) {
+	if text == "" {
+		return
+	}
+	if s.threshold <= 0 || s.closed {
+		s.emit(text, isThinking)
+		return
+	}
+	// thinking/text 边界：先把另一种类型的缓冲发出去，保证 block 顺序正确
+	if s.buf.Len() > 0 && s.isThinking != isThinking {
+		s.flush()
+	}
+	if s.buf.Len() == 0 {
+		s.isThinking = isThinking
+		s.timer = time.AfterFunc(s.maxWait, s.flushOnTimer)
+	}
+	s.buf.WriteString(text)
+	if s.buf.Len() >= s.threshold {
+		s.flush()
+	}
+}
+
+// flush 立即发送缓冲中的文本（调用方需持有锁）
+func (s *streamCoalescer) flush() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.buf.Len() == 0 {
+		return
+	}
+	text := s.buf.String()
+	s.buf.Reset()
+	s.emit(text, s.isThinking)
+}
+
+// flushOnTimer maxWait 到期时发送缓冲（已被 flush 提前发送时缓冲为空，不会重复发送）
+func (s *streamCoalescer) flushOnTimer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.flush()
+}
+
+// close 发送剩余缓冲并停止合并，之后的 add 直接透传（上游调用返回后调用）
+func (s *streamCoalescer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	s.closed = true
+}
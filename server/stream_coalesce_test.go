@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// coalescedFrame 合并器输出的一帧
+type coalescedFrame struct {
+	text       string
+	isThinking bool
+}
+
+// TestStreamCoalescer 测试按字节阈值合并、thinking/text 边界立即发送以及 maxWait 到期发送
+func TestStreamCoalescer(t *testing.T) {
+	var frames []coalescedFrame
+	s := newStreamCoalescer(10, time.Hour, func(text string, isThinking bool) {
+		frames = append(frames, coalescedFrame{text, isThinking})
+	})
+	unlock := s.enter()
+	s.add("abcd", true)
+	s.add("efgh", true)
+	s.add("ijkl", true) // 累计 12 字节，达到阈值
+	s.add("mn", true)
+	s.add("op", false) // 切换到 text，先发出缓冲的 thinking
+	s.flush()
+	unlock()
+
+	want := []coalescedFrame{{"abcdefghijkl", true}, {"mn", true}, {"op", false}}
+	if len(frames) != len(want) {
+		t.Fatalf("期望 %d 帧, 得到 %d: %v", len(want), len(frames), frames)
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Errorf("第 %d 帧期望 %v, 得到 %v", i, want[i], frames[i])
+		}
+	}
+
+	// maxWait 到期时即使没到阈值也会发送
+	emitted := make(chan string, 1)
+	s = newStreamCoalescer(1000, 10*time.Millisecond, func(text string, isThinking bool) { emitted <- text })
+	unlock = s.enter()
+	s.add("hi", false)
+	unlock()
+	select {
+	case text := <-emitted:
+		if text != "hi" {
+			t.Errorf("期望 hi, 得到 %q", text)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("maxWait 到期后应发送缓冲")
+	}
+
+	// threshold=0 每个增量立即发送
+	frames = nil
+	s = newStreamCoalescer(0, 0, func(text string, isThinking bool) {
+		frames = append(frames, coalescedFrame{text, isThinking})
+	})
+	s.add("a", false)
+	s.add("b", false)
+	if len(frames) != 2 {
+		t.Errorf("threshold=0 应逐个发送, 得到 %v", frames)
+	}
+}
+
+// TestStreamFlushBytes_Handler 测试流式响应按 StreamFlushBytes 合并 text_delta 帧，拼接后的文本不变
+func TestStreamFlushBytes_Handler(t *testing.T) {
+	chunk := strings.Repeat("a", 40)
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		for i := 0; i < 10; i++ {
+			_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"`+chunk+`"}`))
+		}
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	deltas := func(flushBytes int) []string {
+		proxyConfig = kiroclient.DefaultProxyConfig
+		proxyConfig.StreamFlushBytes = flushBytes
+		proxyConfig.StreamFlushMaxWaitMs = 60000 // 测试中只按字节阈值合并
+
+		body := `{"model":"claude-sonnet-4.5","stream":true,"max_tokens":100,"messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var texts []string
+		for _, line := range strings.Split(w.Body.String(), "\n") {
+			var ev struct {
+				Type  string `json:"type"`
+				Delta struct {
+					Text string `json:"text"`
+				} `json:"delta"`
+			}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev) == nil && ev.Type == "content_block_delta" {
+				texts = append(texts, ev.Delta.Text)
+			}
+		}
+		return texts
+	}
+
+	// 不合并时 thinking 处理器每次输出都是一帧
+	unmerged := deltas(0)
+	if len(unmerged) != 10 {
+		t.Fatalf("StreamFlushBytes=0 期望 10 帧, 得到 %d: %v", len(unmerged), unmerged)
+	}
+
+	// 阈值 100：除最后一帧外每帧至少 100 字节，拼接后内容不变
+	merged := deltas(100)
+	if len(merged) != 4 {
+		t.Fatalf("StreamFlushBytes=100 期望合并为 4 帧, 得到 %d", len(merged))
+	}
+	for i, text := range merged[:len(merged)-1] {
+		if len(text) < 100 {
+			t.Errorf("第 %d 帧只有 %d 字节, 未达到阈值", i, len(text))
+		}
+	}
+	if strings.Join(merged, "") != strings.Repeat(chunk, 10) {
+		t.Errorf("合并后内容不一致: %v", merged)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 流式请求聚合 ==========
+
+// HeaderXCollectStream 要求把 stream:true 请求聚合成单个非流式响应的请求 header（也可用 ?collect=true）
+// 响应中同名 header 为 true 表示本次响应已被聚合
+const HeaderXCollectStream = "X-Collect-Stream"
+
+// wantsCollectedStream 客户端是否要求聚合流式响应（query 优先于 header）
+func wantsCollectedStream(c *gin.Context) bool {
+	v := c.Query("collect")
+	if v == "" {
+		v = c.GetHeader(HeaderXCollectStream)
+	}
+	collect, _ := strconv.ParseBool(v)
+	return collect
+}
+
+// applyStreamCollect 返回实际是否走流式：stream:true 且要求聚合时改走非流式处理
+// 为什么直接复用非流式路径：上游本来就是 EventStream，非流式处理器已经负责消费完整流并组装响应
+// 用于不支持 SSE 的简易 HTTP 客户端
+func applyStreamCollect(c *gin.Context, stream bool) bool {
+	if !stream || !wantsCollectedStream(c) {
+		return stream
+	}
+	c.Header(HeaderXCollectStream, "true")
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestStreamCollect 测试 stream:true + collect 时返回完整的非流式 JSON 响应
+func TestStreamCollect(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"第一段"}`))
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"第二段"}`))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	router := gin.New()
+	router.POST("/v1/messages", handleClaudeChat)
+	router.POST("/v1/chat/completions", handleOpenAIChat)
+	send := func(path string, header bool) *httptest.ResponseRecorder {
+		body := `{"model":"claude-sonnet-4.5","max_tokens":100,"stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		if !header {
+			path += "?collect=true"
+		}
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		if header {
+			req.Header.Set(HeaderXCollectStream, "true")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s 期望 200, 得到 %d: %s", path, w.Code, w.Body.String())
+		}
+		if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") || w.Header().Get(HeaderXCollectStream) != "true" {
+			t.Errorf("%s 应返回聚合后的 JSON 响应, headers=%v", path, w.Header())
+		}
+		return w
+	}
+
+	var claudeResp ClaudeChatResponse
+	if err := json.Unmarshal(send("/v1/messages", false).Body.Bytes(), &claudeResp); err != nil {
+		t.Fatalf("Claude 响应不是 JSON: %v", err)
+	}
+	if claudeResp.Type != "message" || claudeResp.StopReason != stopReasonEndTurn || len(claudeResp.Content) == 0 || claudeResp.Content[0].Text != "第一段第二段" {
+		t.Errorf("Claude 聚合响应不完整: %+v", claudeResp)
+	}
+
+	var openaiResp OpenAIChatResponse
+	if err := json.Unmarshal(send("/v1/chat/completions", true).Body.Bytes(), &openaiResp); err != nil {
+		t.Fatalf("OpenAI 响应不是 JSON: %v", err)
+	}
+	if openaiResp.Object != "chat.completion" || len(openaiResp.Choices) == 0 || openaiResp.Choices[0].Message.Content != "第一段第二段" {
+		t.Errorf("OpenAI 聚合响应不完整: %+v", openaiResp)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== 支持包捕获 ==========
+// 为什么：用户反馈问题时往往只有一句"回答不对"，缺少原始请求、实际发给 Kiro 的请求体和完整响应，很难复现
+// 开启 allowCaptureHeader 后，客户端带 X-Kiro-Capture: true 的请求会把这三样脱敏后保存在内存中，
+// 响应头 X-Kiro-Capture-Id 返回支持包 ID，管理员通过 /api/captures/:id 取回
+
+const (
+	// HeaderXKiroCapture 请求生成支持包的 header
+	HeaderXKiroCapture = "X-Kiro-Capture"
+	// HeaderXKiroCaptureID 响应中返回的支持包 ID
+	HeaderXKiroCaptureID = "X-Kiro-Capture-Id"
+
+	// maxSupportCaptures 内存中最多保留的支持包数（超出后淘汰最早的）
+	maxSupportCaptures = 50
+	// supportCaptureTTL 支持包保留时长，到期后不可再取回
+	supportCaptureTTL = time.Hour
+	// maxSupportCaptureArtifactSize 单个内容（请求体、上游请求体、响应）的保存上限，超出部分截断
+	maxSupportCaptureArtifactSize = 2 * 1024 * 1024
+)
+
+// redactedValue 密钥类字段脱敏后的值
+const redactedValue = "[REDACTED]"
+
+// supportCaptureSensitiveFields 请求体中需要脱敏的字段名（小写并去掉 - 和 _ 后匹配）
+var supportCaptureSensitiveFields = map[string]bool{
+	"apikey":        true,
+	"xapikey":       true,
+	"authorization": true,
+	"accesstoken":   true,
+	"refreshtoken":  true,
+	"clientsecret":  true,
+	"password":      true,
+	"secret":        true,
+	"profilearn":    true,
+}
+
+// SupportCapture 一个支持包：脱敏后的客户端请求、发往 Kiro 的请求体和返回给客户端的完整响应
+type SupportCapture struct {
+	ID                  string            `json:"id"`
+	MsgID               string            `json:"msgId"`
+	Method              string            `json:"method"`
+	Path                string            `json:"path"`
+	Headers             map[string]string `json:"headers"`
+	RequestBody         string            `json:"requestBody"`
+	UpstreamPayloads    []string          `json:"upstreamPayloads"`
+	ResponseStatus      int               `json:"responseStatus"`
+	ResponseContentType string            `json:"responseContentType"`
+	ResponseBody        string            `json:"responseBody"`
+	ResponseTruncated   bool              `json:"responseTruncated,omitempty"`
+	CapturedAt          time.Time         `json:"capturedAt"`
+	ExpiresAt           time.Time         `json:"expiresAt"`
+}
+
+// supportCaptureStore 按支持包 ID 索引的有界存储（FIFO 淘汰 + 过期清理）
+type supportCaptureStore struct {
+	mu    sync.Mutex
+	items map[string]*SupportCapture
+	order []string
+}
+
+// supportCaptures 全局支持包存储
+var supportCaptures = &supportCaptureStore{}
+
+// add 保存一个支持包，同时清理过期和超出数量的旧记录
+func (s *supportCaptureStore) add(capture *SupportCapture) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.items == nil {
+		s.items = make(map[string]*SupportCapture)
+	}
+	s.items[capture.ID] = capture
+	s.order = append(s.order, capture.ID)
+
+	now := time.Now()
+	for len(s.order) > 0 {
+		oldest := s.items[s.order[0]]
+		if len(s.order) <= maxSupportCaptures && oldest != nil && now.Before(oldest.ExpiresAt) {
+			break
+		}
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// get 按 ID 查找未过期的支持包
+func (s *supportCaptureStore) get(id string) (*SupportCapture, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	capture, ok := s.items[id]
+	if !ok || !time.Now().Before(capture.ExpiresAt) {
+		return nil, false
+	}
+	return capture, true
+}
+
+// captureResponseWriter 在写给客户端的同时保留响应副本（超过上限的部分只写不存）
+type captureResponseWriter struct {
+	gin.ResponseWriter
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (w *captureResponseWriter) Write(data []byte) (int, error) {
+	w.keep(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureResponseWriter) WriteString(s string) (int, error) {
+	w.keep([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// keep 追加到响应副本，超出 maxSupportCaptureArtifactSize 时标记截断
+func (w *captureResponseWriter) keep(data []byte) {
+	room := maxSupportCaptureArtifactSize - w.buf.Len()
+	if len(data) > room {
+		data = data[:max(room, 0)]
+		w.truncated = true
+	}
+	w.buf.Write(data)
+}
+
+// wantsSupportCapture 开启 allowCaptureHeader 且请求带 X-Kiro-Capture: true
+func wantsSupportCapture(c *gin.Context) bool {
+	if !proxyConfig.AllowCaptureHeader {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSpace(c.GetHeader(HeaderXKiroCapture)), "true")
+}
+
+// supportCaptureMiddleware 为请求生成支持包（请求体由 TraceMiddleware 预先读取）
+func supportCaptureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !wantsSupportCapture(c) {
+			c.Next()
+			return
+		}
+
+		id := generateID("cap")
+		ctx, payloads := kiroclient.WithPayloadCapture(c.Request.Context())
+		c.Request = c.Request.WithContext(ctx)
+		writer := &captureResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Header(HeaderXKiroCaptureID, id)
+
+		c.Next()
+
+		now := time.Now()
+		capture := &SupportCapture{
+			ID:                  id,
+			MsgID:               GetMsgID(c),
+			Method:              c.Request.Method,
+			Path:                c.Request.URL.Path,
+			Headers:             sanitizeHeaders(c.Request.Header),
+			RequestBody:         redactCaptureBody(GetRequestBody(c)),
+			ResponseStatus:      writer.Status(),
+			ResponseContentType: writer.Header().Get("Content-Type"),
+			ResponseBody:        writer.buf.String(),
+			ResponseTruncated:   writer.truncated,
+			CapturedAt:          now,
+			ExpiresAt:           now.Add(supportCaptureTTL),
+		}
+		for _, payload := range payloads.Payloads() {
+			capture.UpstreamPayloads = append(capture.UpstreamPayloads, redactCaptureBody(payload))
+		}
+		supportCaptures.add(capture)
+
+		if logger != nil {
+			logger.Info(capture.MsgID, "支持包已生成", map[string]any{
+				"captureId": id,
+				"path":      capture.Path,
+				"status":    capture.ResponseStatus,
+			})
+		}
+	}
+}
+
+// redactCaptureBody 脱敏 JSON 请求体：密钥类字段替换为 [REDACTED]，图片数据替换为字节数说明
+// 不是合法 JSON 时原样保存（只截断长度）
+func redactCaptureBody(body string) string {
+	var v any
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		truncated, _ := TruncateBody(body, maxSupportCaptureArtifactSize)
+		return truncated
+	}
+	data, err := json.Marshal(redactCaptureValue(v))
+	if err != nil {
+		return ""
+	}
+	truncated, _ := TruncateBody(string(data), maxSupportCaptureArtifactSize)
+	return truncated
+}
+
+// redactCaptureValue 递归脱敏，覆盖 Claude（source.data）、OpenAI（data: URL）和 Kiro（images[].source.bytes）三种图片格式
+func redactCaptureValue(v any) any {
+	switch node := v.(type) {
+	case map[string]any:
+		for key, child := range node {
+			normalized := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+			if supportCaptureSensitiveFields[normalized] {
+				node[key] = redactedValue
+				continue
+			}
+			if s, ok := child.(string); ok && isCaptureImageData(key, s, node) {
+				node[key] = fmt.Sprintf("[image omitted: %d bytes]", len(s))
+				continue
+			}
+			node[key] = redactCaptureValue(child)
+		}
+		return node
+	case []any:
+		for i, child := range node {
+			node[i] = redactCaptureValue(child)
+		}
+		return node
+	default:
+		return v
+	}
+}
+
+// isCaptureImageData 判断字段是否为图片数据
+func isCaptureImageData(key, value string, parent map[string]any) bool {
+	switch key {
+	case "data":
+		// Claude: {"type":"base64","media_type":"image/png","data":"..."}
+		return parent["type"] == "base64"
+	case "url":
+		// OpenAI: {"url":"data:image/png;base64,..."}
+		return strings.HasPrefix(value, "data:")
+	case "bytes":
+		// Kiro: {"format":"png","source":{"bytes":"..."}}
+		return true
+	}
+	return false
+}
+
+// handleGetSupportCapture 查看一个支持包
+func handleGetSupportCapture(c *gin.Context) {
+	capture, ok := supportCaptures.get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": "未找到该支持包（需开启 allowCaptureHeader，且只保留最近 1 小时）"})
+		return
+	}
+	c.JSON(200, capture)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestSupportCapture_StoresRedactedArtifacts 带 X-Kiro-Capture 的请求生成支持包，可按 ID 取回且密钥和图片数据已脱敏
+func TestSupportCapture_StoresRedactedArtifacts(t *testing.T) {
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", `{"content":"captured reply"}`))
+		_, _ = w.Write(encodeEventStreamMessage("messageMetadataEvent", `{"tokenUsage":{"uncachedInputTokens":10,"outputTokens":2}}`))
+	})
+	defer cleanup()
+
+	oldConfig, oldStore := proxyConfig, supportCaptures
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.AllowCaptureHeader = true
+	supportCaptures = &supportCaptureStore{}
+	defer func() { proxyConfig, supportCaptures = oldConfig, oldStore }()
+
+	router := gin.New()
+	router.Use(TraceMiddleware(nil))
+	router.POST("/v1/messages", supportCaptureMiddleware(), handleClaudeChat)
+	router.GET("/api/captures/:id", handleGetSupportCapture)
+
+	const secret = "sk-capture-secret"
+	const imageData = "iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNkYPhfDwAChwGA60e6kgAAAABJRU5ErkJggg=="
+	body := `{"model":"claude-sonnet-4.5","max_tokens":100,"metadata":{"api_key":"` + secret + `"},"messages":[{"role":"user","content":[` +
+		`{"type":"text","text":"describe this"},` +
+		`{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` + imageData + `"}}]}]}`
+	send := func(capture string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/v1/messages", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Api-Key", secret)
+		if capture != "" {
+			req.Header.Set(HeaderXKiroCapture, capture)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("期望 200, 得到 %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+
+	w := send("true")
+	id := w.Header().Get(HeaderXKiroCaptureID)
+	if id == "" {
+		t.Fatal("带 X-Kiro-Capture 的请求应返回支持包 ID")
+	}
+
+	req, _ := http.NewRequest("GET", "/api/captures/"+id, nil)
+	got := httptest.NewRecorder()
+	router.ServeHTTP(got, req)
+	if got.Code != 200 {
+		t.Fatalf("按 ID 取回支持包期望 200, 得到 %d: %s", got.Code, got.Body.String())
+	}
+	if strings.Contains(got.Body.String(), secret) || strings.Contains(got.Body.String(), imageData) {
+		t.Errorf("支持包不应包含密钥或图片数据: %s", got.Body.String())
+	}
+
+	var capture SupportCapture
+	if err := json.Unmarshal(got.Body.Bytes(), &capture); err != nil {
+		t.Fatalf("解析支持包失败: %v", err)
+	}
+	if capture.MsgID != w.Header().Get(HeaderXMsgID) {
+		t.Errorf("msgId 应与原请求一致: %s", capture.MsgID)
+	}
+	if !strings.Contains(capture.RequestBody, "describe this") || !strings.Contains(capture.RequestBody, "[image omitted") {
+		t.Errorf("请求体应保留文本并标记省略的图片: %s", capture.RequestBody)
+	}
+	if capture.Headers["X-Api-Key"] != redactedValue {
+		t.Errorf("敏感 header 应脱敏: %v", capture.Headers)
+	}
+	if len(capture.UpstreamPayloads) != 1 || !strings.Contains(capture.UpstreamPayloads[0], "conversationState") {
+		t.Errorf("应保存发往 Kiro 的请求体: %v", capture.UpstreamPayloads)
+	}
+	if capture.ResponseStatus != 200 || capture.ResponseBody != w.Body.String() {
+		t.Errorf("应保存完整响应: status=%d body=%s", capture.ResponseStatus, capture.ResponseBody)
+	}
+
+	// 过期后不可再取回
+	capture.ExpiresAt = time.Now().Add(-time.Second)
+	supportCaptures.items[id].ExpiresAt = capture.ExpiresAt
+	if _, ok := supportCaptures.get(id); ok {
+		t.Error("过期的支持包不应再被取回")
+	}
+
+	// 未开启 allowCaptureHeader 时忽略 header
+	proxyConfig.AllowCaptureHeader = false
+	if w := send("true"); w.Header().Get(HeaderXKiroCaptureID) != "" {
+		t.Error("未开启 allowCaptureHeader 时不应生成支持包")
+	}
+}
+
+// TestSupportCaptureStore_Bounded 支持包数量超过上限时淘汰最早的
+func TestSupportCaptureStore_Bounded(t *testing.T) {
+	store := &supportCaptureStore{}
+	for i := 0; i < maxSupportCaptures+5; i++ {
+		store.add(&SupportCapture{ID: generateID("cap"), ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	if len(store.items) != maxSupportCaptures || len(store.order) != maxSupportCaptures {
+		t.Errorf("应最多保留 %d 个, 得到 %d", maxSupportCaptures, len(store.items))
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 遥测端点配置 ==========
+
+// 遥测配置的取值上限，防止配置失误导致内存占用失控
+const (
+	maxTelemetryRecords      = 1000
+	maxTelemetryPayloadBytes = 1024 * 1024
+	// maxTelemetryTotalBytes 内存中所有记录 payload 的总大小上限，超出后淘汰最早的
+	// 为什么：只按条数和单条大小限制时最坏要占 maxTelemetryRecords × maxTelemetryPayloadBytes（约 1GB）
+	maxTelemetryTotalBytes = 16 * 1024 * 1024
+)
+
+// 遥测日志只输出摘要，完整 payload 只保存在内存记录中
+// 为什么：任何持有 API-KEY 的客户端都能提交任意内容，整条写进 INFO 日志会被用来刷爆日志
+const (
+	telemetryLogPrefixBytes = 200 // 日志中 payload 前缀的最大字节数
+	telemetryLogMaxTypes    = 10  // 日志中最多列出的事件类型数
+)
+
+var telemetryConfigFile = "telemetry-config.json"
+var telemetryConfig = defaultTelemetryConfig()
+var telemetryMutex sync.RWMutex
+var telemetryRecords telemetryRing // 最近的遥测记录（最多 MaxRecords 条，总大小不超过 maxTelemetryTotalBytes）
+
+// TelemetryConfig Claude Code 遥测端点（/api/event_logging/batch）配置
+// 默认行为与之前一致：丢弃 payload，直接返回 200 {"status":"ok"}
+type TelemetryConfig struct {
+	RecordEvents    bool           `json:"recordEvents"`    // 是否记录遥测 payload（完整内容保留在内存中最近若干条，日志只输出事件类型、大小和前缀）
+	MaxRecords      int            `json:"maxRecords"`      // 内存中最多保留的记录条数
+	MaxPayloadBytes int            `json:"maxPayloadBytes"` // 单条 payload 最大记录字节数，超出截断
+	ResponseStatus  int            `json:"responseStatus"`  // 返回给客户端的状态码
+	ResponseBody    map[string]any `json:"responseBody"`    // 返回给客户端的响应体
+}
+
+// TelemetryRecord 一条遥测记录
+type TelemetryRecord struct {
+	Timestamp int64  `json:"timestamp"`
+	MsgID     string `json:"msgId"`
+	ClientIP  string `json:"clientIP"`
+	Payload   string `json:"payload"`
+	Truncated bool   `json:"truncated"`
+}
+
+// defaultTelemetryConfig 默认遥测配置
+func defaultTelemetryConfig() TelemetryConfig {
+	return TelemetryConfig{
+		RecordEvents:    false,
+		MaxRecords:      100,
+		MaxPayloadBytes: MaxBodySize,
+		ResponseStatus:  200,
+		ResponseBody:    map[string]any{"status": "ok"},
+	}
+}
+
+// validateTelemetryConfig 校验遥测配置，零值字段补默认值
+func validateTelemetryConfig(cfg *TelemetryConfig) error {
+	def := defaultTelemetryConfig()
+	if cfg.MaxRecords == 0 {
+		cfg.MaxRecords = def.MaxRecords
+	}
+	if cfg.MaxPayloadBytes == 0 {
+		cfg.MaxPayloadBytes = def.MaxPayloadBytes
+	}
+	if cfg.ResponseStatus == 0 {
+		cfg.ResponseStatus = def.ResponseStatus
+	}
+	if cfg.ResponseBody == nil {
+		cfg.ResponseBody = def.ResponseBody
+	}
+
+	if cfg.MaxRecords < 1 || cfg.MaxRecords > maxTelemetryRecords {
+		return fmt.Errorf("maxRecords 必须在 1-%d 之间", maxTelemetryRecords)
+	}
+	if cfg.MaxPayloadBytes < 1 || cfg.MaxPayloadBytes > maxTelemetryPayloadBytes {
+		return fmt.Errorf("maxPayloadBytes 必须在 1-%d 之间", maxTelemetryPayloadBytes)
+	}
+	if cfg.ResponseStatus < 200 || cfg.ResponseStatus > 599 {
+		return fmt.Errorf("responseStatus 必须在 200-599 之间")
+	}
+	return nil
+}
+
+// loadTelemetryConfig 加载遥测配置
+func loadTelemetryConfig() {
+	data, err := storage.Get(telemetryConfigFile)
+	if err != nil {
+		telemetryConfig = defaultTelemetryConfig()
+		return
+	}
+	var cfg TelemetryConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		telemetryConfig = defaultTelemetryConfig()
+		return
+	}
+	if err := validateTelemetryConfig(&cfg); err != nil {
+		if logger != nil {
+			logger.Warn("", "遥测配置无效，使用默认值", map[string]any{
+				"error": err.Error(),
+			})
+		}
+		cfg = defaultTelemetryConfig()
+	}
+	telemetryConfig = cfg
+	if logger != nil {
+		logger.Info("", "遥测配置已加载", map[string]any{
+			"recordEvents":   cfg.RecordEvents,
+			"responseStatus": cfg.ResponseStatus,
+		})
+	}
+}
+
+// saveTelemetryConfig 保存遥测配置
+func saveTelemetryConfig() error {
+	telemetryMutex.RLock()
+	data, err := json.MarshalIndent(telemetryConfig, "", "  ")
+	telemetryMutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	return storage.Put(telemetryConfigFile, data)
+}
+
+// handleEventLogging Claude Code 遥测端点
+// 默认丢弃 payload 直接返回配置的响应；开启 recordEvents 后记录（有界）用于排查客户端问题
+func handleEventLogging(c *gin.Context) {
+	telemetryMutex.RLock()
+	cfg := telemetryConfig
+	telemetryMutex.RUnlock()
+
+	if cfg.RecordEvents {
+		recordTelemetryEvent(c, cfg)
+	}
+
+	c.JSON(cfg.ResponseStatus, cfg.ResponseBody)
+}
+
+// recordTelemetryEvent 记录一条遥测 payload（截断到 MaxPayloadBytes，只保留最近 MaxRecords 条）
+func recordTelemetryEvent(c *gin.Context, cfg TelemetryConfig) {
+	// 多读 1 字节用于判断是否超长
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, int64(cfg.MaxPayloadBytes)+1))
+	if err != nil {
+		return
+	}
+	truncated := len(body) > cfg.MaxPayloadBytes
+	if truncated {
+		body = body[:cfg.MaxPayloadBytes]
+	}
+
+	record := TelemetryRecord{
+		Timestamp: time.Now().Unix(),
+		MsgID:     GetMsgID(c),
+		ClientIP:  c.ClientIP(),
+		Payload:   string(body),
+		Truncated: truncated,
+	}
+
+	telemetryMutex.Lock()
+	telemetryRecords.add(record, cfg.MaxRecords)
+	telemetryMutex.Unlock()
+
+	if logger != nil {
+		logger.Info(record.MsgID, "遥测事件", map[string]any{
+			"clientIP":   record.ClientIP,
+			"eventTypes": telemetryEventTypes(body),
+			"bytes":      len(body),
+			"prefix":     telemetryLogPrefix(record.Payload),
+			"truncated":  record.Truncated,
+		})
+	}
+}
+
+// telemetryRing 固定容量的遥测记录环形缓冲，同时限制 payload 总字节数
+// 写入是 O(1)：覆盖最旧的槽位，不再每条记录都复制整个切片
+// 调用方持有 telemetryMutex
+type telemetryRing struct {
+	slots []TelemetryRecord // 容量即 MaxRecords，按需分配
+	start int               // 最旧记录所在槽位
+	count int
+	bytes int // 已保存 payload 的总字节数
+}
+
+// add 写入一条记录；条数或总字节数超限时淘汰最旧的记录
+func (r *telemetryRing) add(record TelemetryRecord, maxRecords int) {
+	if len(r.slots) != maxRecords {
+		r.resize(maxRecords)
+	}
+	for r.count > 0 && (r.count == len(r.slots) || r.bytes+len(record.Payload) > maxTelemetryTotalBytes) {
+		r.dropOldest()
+	}
+	r.slots[(r.start+r.count)%len(r.slots)] = record
+	r.count++
+	r.bytes += len(record.Payload)
+}
+
+// dropOldest 淘汰最旧的一条记录
+func (r *telemetryRing) dropOldest() {
+	r.bytes -= len(r.slots[r.start].Payload)
+	r.slots[r.start] = TelemetryRecord{}
+	r.start = (r.start + 1) % len(r.slots)
+	r.count--
+}
+
+// resize 调整容量，保留最近的 maxRecords 条记录
+func (r *telemetryRing) resize(maxRecords int) {
+	records := r.list()
+	if overflow := len(records) - maxRecords; overflow > 0 {
+		records = records[overflow:]
+	}
+	*r = telemetryRing{slots: make([]TelemetryRecord, maxRecords)}
+	for _, record := range records {
+		r.slots[r.count] = record
+		r.count++
+		r.bytes += len(record.Payload)
+	}
+}
+
+// list 按时间顺序返回记录副本
+func (r *telemetryRing) list() []TelemetryRecord {
+	records := make([]TelemetryRecord, r.count)
+	for i := range records {
+		records[i] = r.slots[(r.start+i)%len(r.slots)]
+	}
+	return records
+}
+
+// telemetryEventTypes 提取 payload 中的事件类型（去重，最多 telemetryLogMaxTypes 个），不是 JSON 时返回空
+// Claude Code 格式为 {"events":[{"event_type":...,"event_data":{"event_name":...}}]}，优先取 event_name
+func telemetryEventTypes(body []byte) []string {
+	var batch struct {
+		Events []struct {
+			EventType string `json:"event_type"`
+			Name      string `json:"name"`
+			EventData struct {
+				EventName string `json:"event_name"`
+			} `json:"event_data"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil
+	}
+	types := []string{}
+	seen := make(map[string]bool)
+	for _, e := range batch.Events {
+		name := e.EventData.EventName
+		if name == "" {
+			name = e.Name
+		}
+		if name == "" {
+			name = e.EventType
+		}
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		types = append(types, telemetryLogPrefix(name))
+		if len(types) == telemetryLogMaxTypes {
+			break
+		}
+	}
+	return types
+}
+
+// telemetryLogPrefix 截取前 telemetryLogPrefixBytes 字节（不截断多字节字符），超长时补 ...
+// 按字节而不是 []rune 截取：payload 最大 1MB，不值得为一个日志前缀整体转换
+func telemetryLogPrefix(s string) string {
+	if len(s) <= telemetryLogPrefixBytes {
+		return s
+	}
+	cut := telemetryLogPrefixBytes
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "..."
+}
+
+// handleGetTelemetryConfig 获取遥测配置
+func handleGetTelemetryConfig(c *gin.Context) {
+	telemetryMutex.RLock()
+	cfg := telemetryConfig
+	telemetryMutex.RUnlock()
+	data, _ := json.Marshal(cfg)
+	c.JSON(200, gin.H{
+		"config": cfg,
+		"hash":   computeHash(data),
+	})
+}
+
+// handleUpdateTelemetryConfig 更新遥测配置
+func handleUpdateTelemetryConfig(c *gin.Context) {
+	var req struct {
+		Config TelemetryConfig `json:"config"`
+		Hash   string          `json:"hash"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateTelemetryConfig(&req.Config); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	telemetryMutex.Lock()
+	// 乐观锁校验
+	if req.Hash != "" {
+		currentData, _ := json.Marshal(telemetryConfig)
+		if req.Hash != computeHash(currentData) {
+			telemetryMutex.Unlock()
+			c.JSON(409, gin.H{"error": "配置已被修改，请刷新后重试"})
+			return
+		}
+	}
+	telemetryConfig = req.Config
+	// 关闭记录时清空，调整上限时按新上限保留最近的记录
+	if !req.Config.RecordEvents {
+		telemetryRecords = telemetryRing{}
+	} else {
+		telemetryRecords.resize(req.Config.MaxRecords)
+	}
+	telemetryMutex.Unlock()
+
+	if err := saveTelemetryConfig(); err != nil {
+		if logger != nil {
+			RecordErrorFromGin(c, logger, err, "")
+		}
+		c.JSON(500, gin.H{"error": "保存失败: " + err.Error()})
+		return
+	}
+
+	newData, _ := json.Marshal(req.Config)
+	c.JSON(200, gin.H{"message": "遥测配置已更新", "hash": computeHash(newData)})
+}
+
+// handleGetTelemetryEvents 查看最近记录的遥测事件
+func handleGetTelemetryEvents(c *gin.Context) {
+	telemetryMutex.RLock()
+	records := telemetryRecords.list()
+	telemetryMutex.RUnlock()
+	c.JSON(200, gin.H{"events": records, "count": len(records)})
+}
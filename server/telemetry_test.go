@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// setupTelemetryTest 重置遥测全局状态，返回恢复函数
+func setupTelemetryTest(t *testing.T, cfg TelemetryConfig) func() {
+	t.Helper()
+	oldConfig := telemetryConfig
+	oldRecords := telemetryRecords
+	oldFile := telemetryConfigFile
+	telemetryConfig = cfg
+	telemetryRecords = telemetryRing{}
+	telemetryConfigFile = filepath.Join(t.TempDir(), "telemetry-config.json")
+	return func() {
+		telemetryConfig = oldConfig
+		telemetryRecords = oldRecords
+		telemetryConfigFile = oldFile
+	}
+}
+
+func postTelemetry(router *gin.Engine, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/api/event_logging/batch", bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// TestEventLogging_DefaultDropsPayload 测试默认行为：丢弃 payload 并返回 200 {"status":"ok"}
+func TestEventLogging_DefaultDropsPayload(t *testing.T) {
+	defer setupTelemetryTest(t, defaultTelemetryConfig())()
+
+	router := gin.New()
+	router.POST("/api/event_logging/batch", handleEventLogging)
+
+	w := postTelemetry(router, `{"events":[{"name":"tengu_init"}]}`)
+	if w.Code != 200 {
+		t.Errorf("期望状态码 200, 得到 %d", w.Code)
+	}
+	if strings.TrimSpace(w.Body.String()) != `{"status":"ok"}` {
+		t.Errorf("默认响应体不对: %s", w.Body.String())
+	}
+	if telemetryRecords.count != 0 {
+		t.Error("默认不应记录遥测 payload")
+	}
+}
+
+// TestEventLogging_RecordBounded 测试开启记录后按条数和字节数截断
+func TestEventLogging_RecordBounded(t *testing.T) {
+	cfg := defaultTelemetryConfig()
+	cfg.RecordEvents = true
+	cfg.MaxRecords = 2
+	cfg.MaxPayloadBytes = 8
+	cfg.ResponseStatus = 202
+	cfg.ResponseBody = map[string]any{"accepted": true}
+	defer setupTelemetryTest(t, cfg)()
+
+	router := gin.New()
+	router.POST("/api/event_logging/batch", handleEventLogging)
+
+	var w *httptest.ResponseRecorder
+	for _, body := range []string{"first", "second", "0123456789"} {
+		w = postTelemetry(router, body)
+	}
+
+	if w.Code != 202 {
+		t.Errorf("期望自定义状态码 202, 得到 %d", w.Code)
+	}
+	var resp map[string]any
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["accepted"] != true {
+		t.Errorf("自定义响应体不对: %s", w.Body.String())
+	}
+
+	records := telemetryRecords.list()
+	if len(records) != 2 {
+		t.Fatalf("应只保留最近 2 条记录, 得到 %d", len(records))
+	}
+	if records[0].Payload != "second" {
+		t.Errorf("最旧的记录应被淘汰, 得到 %q", records[0].Payload)
+	}
+	if records[1].Payload != "01234567" || !records[1].Truncated {
+		t.Errorf("超长 payload 应被截断并标记, 得到 %+v", records[1])
+	}
+}
+
+// TestTelemetryRing_TotalBytesAndResize 测试环形缓冲按总字节数淘汰最旧记录，调整容量时保留最近的记录
+func TestTelemetryRing_TotalBytesAndResize(t *testing.T) {
+	var ring telemetryRing
+	payload := strings.Repeat("x", maxTelemetryPayloadBytes)
+	total := maxTelemetryTotalBytes/maxTelemetryPayloadBytes + 5
+	for i := 0; i < total; i++ {
+		ring.add(TelemetryRecord{MsgID: fmt.Sprint(i), Payload: payload}, maxTelemetryRecords)
+	}
+	if ring.bytes > maxTelemetryTotalBytes {
+		t.Errorf("payload 总大小 %d 超过上限 %d", ring.bytes, maxTelemetryTotalBytes)
+	}
+	records := ring.list()
+	if len(records) != maxTelemetryTotalBytes/maxTelemetryPayloadBytes {
+		t.Fatalf("期望保留 %d 条, 得到 %d", maxTelemetryTotalBytes/maxTelemetryPayloadBytes, len(records))
+	}
+	if records[len(records)-1].MsgID != fmt.Sprint(total-1) {
+		t.Errorf("最新的记录应保留, 最后一条是 %s", records[len(records)-1].MsgID)
+	}
+
+	ring.resize(2)
+	records = ring.list()
+	if len(records) != 2 || records[0].MsgID != fmt.Sprint(total-2) || records[1].MsgID != fmt.Sprint(total-1) {
+		t.Errorf("缩小容量后应保留最近 2 条: %d 条", len(records))
+	}
+	if ring.bytes != 2*maxTelemetryPayloadBytes {
+		t.Errorf("缩小容量后字节数应重新统计, 得到 %d", ring.bytes)
+	}
+}
+
+// TestEventLogging_LogsSummaryOnly 测试日志只输出事件类型、大小和前缀，完整 payload 只保存在内存记录中
+func TestEventLogging_LogsSummaryOnly(t *testing.T) {
+	cfg := defaultTelemetryConfig()
+	cfg.RecordEvents = true
+	cfg.MaxPayloadBytes = maxTelemetryPayloadBytes
+	defer setupTelemetryTest(t, cfg)()
+
+	core, logs := observer.New(zapcore.InfoLevel)
+	oldLogger := logger
+	logger = &StructuredLogger{zap: zap.New(core), level: zap.NewAtomicLevelAt(zapcore.InfoLevel)}
+	defer func() { logger = oldLogger }()
+
+	router := gin.New()
+	router.POST("/api/event_logging/batch", handleEventLogging)
+
+	filler := strings.Repeat("中", 5000)
+	body := `{"events":[{"event_type":"ClaudeCodeInternalEvent","event_data":{"event_name":"tengu_init","note":"` + filler + `"}},` +
+		`{"event_type":"ClaudeCodeInternalEvent","event_data":{"event_name":"tengu_exit"}},{"name":"tengu_init"}]}`
+	postTelemetry(router, body)
+
+	if records := telemetryRecords.list(); len(records) != 1 || records[0].Payload != body {
+		t.Fatal("内存记录应保存完整 payload")
+	}
+	entries := logs.FilterMessage("遥测事件").All()
+	if len(entries) != 1 {
+		t.Fatalf("应输出 1 条遥测日志, 得到 %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if _, ok := fields["payload"]; ok {
+		t.Error("日志不应包含完整 payload")
+	}
+	types, _ := fields["eventTypes"].([]any)
+	if len(types) != 2 || types[0] != "tengu_init" || types[1] != "tengu_exit" {
+		t.Errorf("事件类型应去重后按出现顺序列出: %v", fields["eventTypes"])
+	}
+	if fields["bytes"] != int64(len(body)) {
+		t.Errorf("bytes 应为 payload 大小 %d, 得到 %v", len(body), fields["bytes"])
+	}
+	prefix, _ := fields["prefix"].(string)
+	if !strings.HasPrefix(body, strings.TrimSuffix(prefix, "...")) || len(prefix) > telemetryLogPrefixBytes+3 || !utf8.ValidString(prefix) {
+		t.Errorf("前缀应为 payload 开头的有效 UTF-8 且不超过 %d 字节: %q", telemetryLogPrefixBytes, prefix)
+	}
+}
+
+// TestUpdateTelemetryConfig_Validation 测试遥测配置校验
+func TestUpdateTelemetryConfig_Validation(t *testing.T) {
+	defer setupTelemetryTest(t, defaultTelemetryConfig())()
+
+	router := gin.New()
+	router.POST("/api/settings/telemetry", handleUpdateTelemetryConfig)
+
+	tests := []struct {
+		name       string
+		body       string
+		expectCode int
+	}{
+		{"合法配置", `{"config":{"recordEvents":true,"maxRecords":10}}`, 200},
+		{"状态码越界", `{"config":{"responseStatus":100}}`, 400},
+		{"记录条数越界", `{"config":{"maxRecords":100000}}`, 400},
+		{"hash 不匹配", `{"config":{},"hash":"deadbeef"}`, 409},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", "/api/settings/telemetry", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.expectCode {
+				t.Errorf("期望状态码 %d, 得到 %d: %s", tt.expectCode, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	// 零值字段应补默认值
+	if telemetryConfig.ResponseStatus != 200 || telemetryConfig.ResponseBody["status"] != "ok" {
+		t.Errorf("零值字段应补默认值, 得到 %+v", telemetryConfig)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== thinking A/B 实验 ==========
+
+// HeaderXThinkingVariant 响应中返回 thinking 实验分组的 header
+const HeaderXThinkingVariant = "X-Thinking-Variant"
+
+// thinking 实验分组名
+const (
+	thinkingVariantA = "A" // 对照组：使用 ThinkingOutputFormat
+	thinkingVariantB = "B" // 实验组：使用 ThinkingABFormat
+)
+
+// thinkingVariant 单个请求的 thinking 实验分组
+type thinkingVariant struct {
+	Name   string
+	Format kiroclient.ThinkingOutputFormat
+}
+
+// ThinkingVariantStats 单个实验分组的统计
+type ThinkingVariantStats struct {
+	RequestCount int64 `json:"requestCount"`
+	SuccessCount int64 `json:"successCount"`
+	FailCount    int64 `json:"failCount"`
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+}
+
+var thinkingABStats = make(map[string]*ThinkingVariantStats) // 分组名 -> 统计
+var thinkingABStatsMutex sync.RWMutex
+
+// thinkingABBucket 根据 msgId 计算 0-99 的分桶值
+// 用 hash 而不是随机数：同一个 msgId（客户端可通过 X-Request-ID 指定）总是落在同一组，便于复现
+func thinkingABBucket(msgID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(msgID))
+	return int(h.Sum32() % 100)
+}
+
+// assignThinkingVariant 为请求分配 thinking 实验分组
+// 实验关闭时不做任何事，thinkingFormatFor 会回落到全局 ThinkingOutputFormat
+func assignThinkingVariant(c *gin.Context) {
+	percent := proxyConfig.ThinkingABPercent
+	if percent <= 0 {
+		return
+	}
+
+	variant := thinkingVariant{Name: thinkingVariantA, Format: proxyConfig.ThinkingOutputFormat}
+	if thinkingABBucket(GetMsgID(c)) < percent {
+		variant = thinkingVariant{Name: thinkingVariantB, Format: proxyConfig.ThinkingABFormat}
+		if variant.Format == "" {
+			variant.Format = kiroclient.ThinkingFormatNone
+		}
+	}
+
+	c.Header(HeaderXThinkingVariant, variant.Name)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ctxKeyThinkingVariant, variant))
+}
+
+// thinkingFormatFor 返回当前请求应使用的 thinking 输出格式
+func thinkingFormatFor(ctx context.Context) kiroclient.ThinkingOutputFormat {
+	return resolveThinkingDecision(ctx).Format
+}
+
+// ========== 生效的 thinking 决策 ==========
+
+// HeaderXThinkingEffective 响应中返回本次请求实际生效的 thinking 决策的 header
+// 格式：format=<格式>; enabled=<true|false>; source=<来源>
+const HeaderXThinkingEffective = "X-Thinking-Effective"
+
+// thinking 决策来源（按优先级从高到低）
+const (
+	thinkingSourceABPrefix = "ab:"     // A/B 实验分组，如 ab:B
+	thinkingSourceGlobal   = "global"  // 全局 ThinkingOutputFormat
+	thinkingSourceDefault  = "default" // 未配置，使用内置默认 reasoning_content
+)
+
+// thinkingDecision 单个请求最终生效的 thinking 输出决策
+type thinkingDecision struct {
+	Format  kiroclient.ThinkingOutputFormat
+	Enabled bool // 是否向客户端输出 thinking 内容（format 为 none 时为 false）
+	Source  string
+}
+
+// String 用于 header 和日志
+func (d thinkingDecision) String() string {
+	return fmt.Sprintf("format=%s; enabled=%t; source=%s", d.Format, d.Enabled, d.Source)
+}
+
+// resolveThinkingDecision 按优先级解析本次请求的 thinking 决策：A/B 实验分组 > 全局配置 > 内置默认
+// 为什么集中在一处：各层配置互相覆盖，运维需要确认最终到底用了哪一层
+// 注意：ModelThinkingMode 目前只是保存的配置，转发路径不读取它，因此不参与决策
+func resolveThinkingDecision(ctx context.Context) thinkingDecision {
+	var d thinkingDecision
+	if v, ok := ctx.Value(ctxKeyThinkingVariant).(thinkingVariant); ok {
+		d = thinkingDecision{Format: v.Format, Source: thinkingSourceABPrefix + v.Name}
+	} else {
+		d = thinkingDecision{Format: proxyConfig.ThinkingOutputFormat, Source: thinkingSourceGlobal}
+	}
+	// 与 NewThinkingTextProcessor 保持一致：空格式按 reasoning_content 处理
+	if d.Format == "" {
+		d.Format = kiroclient.ThinkingFormatReasoningContent
+		if d.Source == thinkingSourceGlobal {
+			d.Source = thinkingSourceDefault
+		}
+	}
+	d.Enabled = d.Format != kiroclient.ThinkingFormatNone
+	return d
+}
+
+// exposeThinkingDecision 把生效的 thinking 决策写入响应 header 和 debug 日志
+// 必须在 assignThinkingVariant 之后调用
+func exposeThinkingDecision(c *gin.Context) {
+	d := resolveThinkingDecision(c.Request.Context())
+	c.Header(HeaderXThinkingEffective, d.String())
+	if logger != nil {
+		kiroclient.DebugLog(c.Request.Context(), logger, "thinking 决策", map[string]any{
+			"format":  string(d.Format),
+			"enabled": d.Enabled,
+			"source":  d.Source,
+		})
+	}
+}
+
+// recordThinkingVariant 记录请求结果到所属实验分组（未参与实验的请求直接忽略）
+func recordThinkingVariant(ctx context.Context, success bool, inputTokens, outputTokens int) {
+	v, ok := ctx.Value(ctxKeyThinkingVariant).(thinkingVariant)
+	if !ok {
+		return
+	}
+
+	thinkingABStatsMutex.Lock()
+	defer thinkingABStatsMutex.Unlock()
+
+	stats, exists := thinkingABStats[v.Name]
+	if !exists {
+		stats = &ThinkingVariantStats{}
+		thinkingABStats[v.Name] = stats
+	}
+	stats.RequestCount++
+	if success {
+		stats.SuccessCount++
+	} else {
+		stats.FailCount++
+	}
+	stats.InputTokens += int64(inputTokens)
+	stats.OutputTokens += int64(outputTokens)
+}
+
+// getThinkingABStats 获取实验分组统计（返回副本）
+func getThinkingABStats() map[string]ThinkingVariantStats {
+	thinkingABStatsMutex.RLock()
+	defer thinkingABStatsMutex.RUnlock()
+	result := make(map[string]ThinkingVariantStats, len(thinkingABStats))
+	for k, v := range thinkingABStats {
+		result[k] = *v
+	}
+	return result
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// findMsgIDInBucket 找一个分桶值满足条件的 msgId
+func findMsgIDInBucket(t *testing.T, match func(bucket int) bool) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		id := fmt.Sprintf("msg-%d", i)
+		if match(thinkingABBucket(id)) {
+			return id
+		}
+	}
+	t.Fatal("找不到满足条件的 msgId")
+	return ""
+}
+
+// TestThinkingABBucket_Deterministic 同一个 msgId 总是落在同一个桶
+func TestThinkingABBucket_Deterministic(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		b := thinkingABBucket(id)
+		if b < 0 || b >= 100 {
+			t.Fatalf("分桶值越界: %d", b)
+		}
+		if thinkingABBucket(id) != b {
+			t.Fatalf("同一个 msgId 分桶结果不稳定: %s", id)
+		}
+	}
+}
+
+// TestThinkingAB_VariantsAndStats 验证分组 header、B 组丢弃 thinking 以及分组统计
+func TestThinkingAB_VariantsAndStats(t *testing.T) {
+	thinkingText := "先拆解问题，然后逐条验证"
+	answer := strings.Repeat("这是最终回答", 10)
+
+	cleanup := setupMockUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		payload, _ := json.Marshal(map[string]string{"content": "<thinking>" + thinkingText + "</thinking>" + answer})
+		_, _ = w.Write(encodeEventStreamMessage("assistantResponseEvent", string(payload)))
+	})
+	defer cleanup()
+
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ThinkingABPercent = 50
+	defer func() { proxyConfig = oldConfig }()
+
+	thinkingABStatsMutex.Lock()
+	oldStats := thinkingABStats
+	thinkingABStats = make(map[string]*ThinkingVariantStats)
+	thinkingABStatsMutex.Unlock()
+	defer func() {
+		thinkingABStatsMutex.Lock()
+		thinkingABStats = oldStats
+		thinkingABStatsMutex.Unlock()
+	}()
+
+	send := func(msgID string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { c.Set(MsgIDKey, msgID) })
+		router.POST("/v1/chat/completions", handleOpenAIChat)
+		body := `{"model":"claude-sonnet-4.5","messages":[{"role":"user","content":"hi"}]}`
+		req, _ := http.NewRequest("POST", "/v1/chat/completions", bytes.NewBufferString(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// A 组：沿用全局格式，返回 reasoning_content
+	wA := send(findMsgIDInBucket(t, func(b int) bool { return b >= 50 }))
+	if got := wA.Header().Get(HeaderXThinkingVariant); got != thinkingVariantA {
+		t.Fatalf("A 组 header = %q", got)
+	}
+	if !strings.Contains(wA.Body.String(), thinkingText) {
+		t.Errorf("A 组应返回 thinking 内容: %s", wA.Body.String())
+	}
+
+	// B 组：ThinkingABFormat 为空即 none，不返回 thinking
+	wB := send(findMsgIDInBucket(t, func(b int) bool { return b < 50 }))
+	if got := wB.Header().Get(HeaderXThinkingVariant); got != thinkingVariantB {
+		t.Fatalf("B 组 header = %q", got)
+	}
+	if strings.Contains(wB.Body.String(), thinkingText) {
+		t.Errorf("B 组不应返回 thinking 内容: %s", wB.Body.String())
+	}
+	if !strings.Contains(wB.Body.String(), "这是最终回答") {
+		t.Errorf("B 组应返回正文: %s", wB.Body.String())
+	}
+
+	stats := getThinkingABStats()
+	for _, name := range []string{thinkingVariantA, thinkingVariantB} {
+		s := stats[name]
+		if s.RequestCount != 1 || s.SuccessCount != 1 || s.FailCount != 0 {
+			t.Errorf("%s 组统计错误: %+v", name, s)
+		}
+		if s.OutputTokens <= 0 {
+			t.Errorf("%s 组应累计 output tokens: %+v", name, s)
+		}
+	}
+}
+
+// TestThinkingAB_Disabled 实验关闭时不返回分组 header，也不记录统计
+func TestThinkingAB_Disabled(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	proxyConfig.ThinkingOutputFormat = kiroclient.ThinkingFormatThink
+	defer func() { proxyConfig = oldConfig }()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest("POST", "/v1/messages", nil)
+	assignThinkingVariant(c)
+
+	if got := w.Header().Get(HeaderXThinkingVariant); got != "" {
+		t.Errorf("实验关闭时不应返回分组 header: %q", got)
+	}
+	if got := thinkingFormatFor(c.Request.Context()); got != kiroclient.ThinkingFormatThink {
+		t.Errorf("实验关闭时应使用全局格式, got %q", got)
+	}
+}
+
+// TestResolveThinkingDecision_Precedence 测试优先级：A/B 实验分组 > 全局配置 > 内置默认
+func TestResolveThinkingDecision_Precedence(t *testing.T) {
+	oldConfig := proxyConfig
+	proxyConfig = kiroclient.DefaultProxyConfig
+	defer func() { proxyConfig = oldConfig }()
+
+	resolve := func(msgID string) (thinkingDecision, string) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest("POST", "/v1/messages", nil)
+		c.Set(MsgIDKey, msgID)
+		assignThinkingVariant(c)
+		exposeThinkingDecision(c)
+		return resolveThinkingDecision(c.Request.Context()), w.Header().Get(HeaderXThinkingEffective)
+	}
+
+	// 未配置格式：内置默认
+	proxyConfig.ThinkingOutputFormat = ""
+	if d, _ := resolve("msg-x"); d.Format != kiroclient.ThinkingFormatReasoningContent || d.Source != thinkingSourceDefault || !d.Enabled {
+		t.Errorf("未配置时应使用内置默认: %+v", d)
+	}
+
+	// 全局配置覆盖内置默认
+	proxyConfig.ThinkingOutputFormat = kiroclient.ThinkingFormatThink
+	d, header := resolve("msg-x")
+	if d.Format != kiroclient.ThinkingFormatThink || d.Source != thinkingSourceGlobal {
+		t.Errorf("应使用全局配置: %+v", d)
+	}
+	if header != "format=think; enabled=true; source=global" {
+		t.Errorf("header 不正确: %q", header)
+	}
+
+	// A/B 实验分组覆盖全局配置
+	proxyConfig.ThinkingABPercent = 50
+	proxyConfig.ThinkingABFormat = kiroclient.ThinkingFormatNone
+	d, header = resolve(findMsgIDInBucket(t, func(b int) bool { return b < 50 }))
+	if d.Format != kiroclient.ThinkingFormatNone || d.Enabled || d.Source != "ab:B" {
+		t.Errorf("B 组应使用实验格式: %+v", d)
+	}
+	if header != "format=none; enabled=false; source=ab:B" {
+		t.Errorf("header 不正确: %q", header)
+	}
+	if d, _ := resolve(findMsgIDInBucket(t, func(b int) bool { return b >= 50 })); d.Format != kiroclient.ThinkingFormatThink || d.Source != "ab:A" {
+		t.Errorf("A 组应沿用全局格式并标明实验来源: %+v", d)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ========== HTTPS 监听配置 ==========
+
+// 为什么：边缘部署没有独立的 TLS 终结层时，由代理自己提供 HTTPS
+// 未配置证书时保持原来的纯 HTTP 行为
+const (
+	envTLSCert       = "TLS_CERT"
+	envTLSKey        = "TLS_KEY"
+	envTLSMinVersion = "TLS_MIN_VERSION"
+)
+
+// tlsMinVersions TLS_MIN_VERSION 支持的取值（默认 1.2）
+var tlsMinVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// secureCipherSuites TLS 1.2 允许的加密套件：仅 ECDHE 前向保密 + AEAD
+// TLS 1.3 的套件由 Go 固定选择，不受此列表影响
+var secureCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// loadTLSConfig 从环境变量构造 tls.Config
+// 证书和私钥都未配置时返回 nil（使用纯 HTTP）；只配置一个、加载失败或版本非法时返回错误
+// 启动时即加载证书，配置错误直接暴露，而不是等到第一次握手才失败
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := strings.TrimSpace(os.Getenv(envTLSCert))
+	keyFile := strings.TrimSpace(os.Getenv(envTLSKey))
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("%s 和 %s 必须同时配置", envTLSCert, envTLSKey)
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if v := strings.TrimSpace(os.Getenv(envTLSMinVersion)); v != "" {
+		parsed, ok := tlsMinVersions[v]
+		if !ok {
+			return nil, fmt.Errorf("%s 无效: %s（可选 1.2、1.3）", envTLSMinVersion, v)
+		}
+		minVersion = parsed
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载 TLS 证书失败: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		CipherSuites: secureCipherSuites,
+	}, nil
+}
+
+// tlsVersionName TLS 版本号转可读名称（用于启动日志）
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsMinVersions {
+		if v == version {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCert 在临时目录生成自签名证书和私钥，返回文件路径
+func writeSelfSignedCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成私钥失败: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	_ = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	_ = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+// TestLoadTLSConfig_Disabled 测试未配置证书时返回 nil（纯 HTTP）
+func TestLoadTLSConfig_Disabled(t *testing.T) {
+	t.Setenv(envTLSCert, "")
+	t.Setenv(envTLSKey, "")
+
+	cfg, err := loadTLSConfig()
+	if err != nil || cfg != nil {
+		t.Errorf("未配置证书应返回 nil, nil; 得到 %v, %v", cfg, err)
+	}
+}
+
+// TestLoadTLSConfig_Errors 测试配置不完整、证书无法加载、版本非法时启动校验失败
+func TestLoadTLSConfig_Errors(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	tests := []struct {
+		name, cert, key, minVersion string
+	}{
+		{"只配置证书", certFile, "", ""},
+		{"只配置私钥", "", keyFile, ""},
+		{"文件不存在", certFile, filepath.Join(t.TempDir(), "missing.pem"), ""},
+		{"证书与私钥颠倒", keyFile, certFile, ""},
+		{"版本非法", certFile, keyFile, "1.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envTLSCert, tt.cert)
+			t.Setenv(envTLSKey, tt.key)
+			t.Setenv(envTLSMinVersion, tt.minVersion)
+			if _, err := loadTLSConfig(); err == nil {
+				t.Error("期望返回错误")
+			}
+		})
+	}
+}
+
+// TestLoadTLSConfig_Serves 测试默认最低 TLS 1.2，且能完成 HTTPS 握手；低于最低版本的客户端被拒绝
+func TestLoadTLSConfig_Serves(t *testing.T) {
+	certFile, keyFile := writeSelfSignedCert(t)
+	t.Setenv(envTLSCert, certFile)
+	t.Setenv(envTLSKey, keyFile)
+	t.Setenv(envTLSMinVersion, "1.3")
+
+	cfg, err := loadTLSConfig()
+	if err != nil {
+		t.Fatalf("加载失败: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS13 {
+		t.Errorf("期望最低版本 1.3, 得到 %s", tlsVersionName(cfg.MinVersion))
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	newClient := func(maxVersion uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			MaxVersion:         maxVersion,
+		}}}
+	}
+	resp, err := newClient(tls.VersionTLS13).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("TLS 1.3 客户端应握手成功: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := newClient(tls.VersionTLS12).Get(srv.URL); err == nil {
+		t.Error("低于最低版本的客户端应被拒绝")
+	}
+
+	t.Setenv(envTLSMinVersion, "")
+	cfg, err = loadTLSConfig()
+	if err != nil || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("默认最低版本应为 1.2: %v", err)
+	}
+}
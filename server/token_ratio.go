@@ -0,0 +1,166 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// ========== Token 估算校准统计 ==========
+
+// 估算偏差判定：样本数足够且平均比例偏离 1 超过阈值时，认为本地估算系统性偏差
+const (
+	tokenRatioMinSamples    = 20
+	tokenRatioSkewTolerance = 0.2
+)
+
+// ratioAccumulator 累计比例样本（只存和与平方和，内存占用固定）
+type ratioAccumulator struct {
+	Count int64
+	Sum   float64
+	SumSq float64
+	Min   float64
+	Max   float64
+}
+
+// add 加入一个样本
+func (a *ratioAccumulator) add(ratio float64) {
+	if a.Count == 0 || ratio < a.Min {
+		a.Min = ratio
+	}
+	if a.Count == 0 || ratio > a.Max {
+		a.Max = ratio
+	}
+	a.Count++
+	a.Sum += ratio
+	a.SumSq += ratio * ratio
+}
+
+// TokenRatioSummary 精确 token / 估算 token 比例的汇总
+type TokenRatioSummary struct {
+	Samples int64   `json:"samples"`
+	Mean    float64 `json:"mean"`
+	StdDev  float64 `json:"stddev"`
+	Min     float64 `json:"min"`
+	Max     float64 `json:"max"`
+	Skewed  bool    `json:"skewed"` // 本地估算是否系统性偏差（样本充足且平均比例偏离 1 超过 20%）
+}
+
+// summary 计算均值和（总体）标准差
+func (a ratioAccumulator) summary() TokenRatioSummary {
+	if a.Count == 0 {
+		return TokenRatioSummary{}
+	}
+	n := float64(a.Count)
+	mean := a.Sum / n
+	variance := a.SumSq/n - mean*mean
+	if variance < 0 {
+		// 浮点误差可能产生极小的负数
+		variance = 0
+	}
+	return TokenRatioSummary{
+		Samples: a.Count,
+		Mean:    mean,
+		StdDev:  math.Sqrt(variance),
+		Min:     a.Min,
+		Max:     a.Max,
+		Skewed:  a.Count >= tokenRatioMinSamples && math.Abs(mean-1) > tokenRatioSkewTolerance,
+	}
+}
+
+// modelTokenRatio 单个模型的输入/输出比例统计
+type modelTokenRatio struct {
+	Input  ratioAccumulator
+	Output ratioAccumulator
+}
+
+var tokenRatios = make(map[string]*modelTokenRatio) // model -> 比例统计
+var tokenRatiosMutex sync.Mutex
+
+// recordTokenRatio 记录精确 usage 与本地估算的比例（仅在上游返回精确 usage 时调用）
+// 为什么：CountTokens/CountMessagesTokens 是本地近似，按模型积累真实比例后才能校准估算
+func recordTokenRatio(model string, estimatedInput, estimatedOutput int, usage *kiroclient.KiroUsage) {
+	if usage == nil {
+		return
+	}
+
+	tokenRatiosMutex.Lock()
+	defer tokenRatiosMutex.Unlock()
+
+	stats, exists := tokenRatios[model]
+	if !exists {
+		stats = &modelTokenRatio{}
+		tokenRatios[model] = stats
+	}
+	// 估算值为 0 时比例无意义（如空输出），跳过该方向
+	if estimatedInput > 0 && usage.InputTokens > 0 {
+		stats.Input.add(float64(usage.InputTokens) / float64(estimatedInput))
+	}
+	if estimatedOutput > 0 && usage.OutputTokens > 0 {
+		stats.Output.add(float64(usage.OutputTokens) / float64(estimatedOutput))
+	}
+}
+
+// handleGetTokenRatios 按模型汇总精确 token / 估算 token 的比例，附带图片 token 估算统计
+func handleGetTokenRatios(c *gin.Context) {
+	tokenRatiosMutex.Lock()
+	models := make([]map[string]any, 0, len(tokenRatios))
+	for model, stats := range tokenRatios {
+		models = append(models, map[string]any{
+			"model":  model,
+			"input":  stats.Input.summary(),
+			"output": stats.Output.summary(),
+		})
+	}
+	tokenRatiosMutex.Unlock()
+
+	sort.Slice(models, func(i, j int) bool {
+		return models[i]["model"].(string) < models[j]["model"].(string)
+	})
+	c.JSON(200, gin.H{"models": models, "images": getImageTokenStats()})
+}
+
+// ========== 图片 token 估算统计 ==========
+
+// ImageTokenStats 带图片请求的估算情况
+type ImageTokenStats struct {
+	ImagesByDimensions int64 `json:"imagesByDimensions"` // 按尺寸估算的图片数
+	ImagesByBytes      int64 `json:"imagesByBytes"`      // 无法解析尺寸、按字节数估算的图片数
+	RequestsExact      int64 `json:"requestsExact"`      // 带图片且上游返回精确 usage 的请求数
+	RequestsEstimated  int64 `json:"requestsEstimated"`  // 带图片但只能使用本地估算（含图片成本）的请求数
+}
+
+var imageTokenStats ImageTokenStats
+var imageTokenStatsMutex sync.Mutex
+
+// estimateInputTokens 本地估算输入 token（文本 + 按 ProxyConfig.ImageTokenCost 估算的图片）
+func estimateInputTokens(messages []kiroclient.ChatMessage) (int, kiroclient.ImageTokenEstimate) {
+	return kiroclient.CountMessagesTokensWithImages(messages, proxyConfig.ImageTokenCost)
+}
+
+// recordImageTokenSource 记录带图片请求最终使用的是精确 usage 还是本地估算（不带图片的请求忽略）
+func recordImageTokenSource(estimate kiroclient.ImageTokenEstimate, usage *kiroclient.KiroUsage) {
+	if estimate.Images == 0 {
+		return
+	}
+	imageTokenStatsMutex.Lock()
+	defer imageTokenStatsMutex.Unlock()
+	imageTokenStats.ImagesByDimensions += int64(estimate.ByDimensions)
+	imageTokenStats.ImagesByBytes += int64(estimate.Images - estimate.ByDimensions)
+	if usage != nil && usage.InputTokens > 0 {
+		imageTokenStats.RequestsExact++
+	} else {
+		imageTokenStats.RequestsEstimated++
+	}
+}
+
+// getImageTokenStats 获取图片 token 估算统计
+func getImageTokenStats() ImageTokenStats {
+	imageTokenStatsMutex.Lock()
+	defer imageTokenStatsMutex.Unlock()
+	return imageTokenStats
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestTokenRatios_Summary 测试按模型汇总精确/估算比例的均值、标准差和偏差标记
+func TestTokenRatios_Summary(t *testing.T) {
+	tokenRatiosMutex.Lock()
+	oldRatios := tokenRatios
+	tokenRatios = make(map[string]*modelTokenRatio)
+	tokenRatiosMutex.Unlock()
+	defer func() {
+		tokenRatiosMutex.Lock()
+		tokenRatios = oldRatios
+		tokenRatiosMutex.Unlock()
+	}()
+
+	// sonnet：输入比例交替 1.2 / 1.4（均值 1.3，标准差 0.1），输出估算准确
+	for i := 0; i < tokenRatioMinSamples; i++ {
+		input := 120
+		if i%2 == 1 {
+			input = 140
+		}
+		recordTokenRatio("claude-sonnet-4.5", 100, 50, &kiroclient.KiroUsage{InputTokens: input, OutputTokens: 50})
+	}
+	// haiku：样本不足，不标记偏差；估算输出为 0 时不计入输出比例
+	recordTokenRatio("claude-haiku-4.5", 100, 0, &kiroclient.KiroUsage{InputTokens: 200, OutputTokens: 10})
+	recordTokenRatio("claude-haiku-4.5", 100, 10, nil)
+
+	router := gin.New()
+	router.GET("/api/stats/token-ratios", handleGetTokenRatios)
+	req, _ := http.NewRequest("GET", "/api/stats/token-ratios", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var resp struct {
+		Models []struct {
+			Model  string            `json:"model"`
+			Input  TokenRatioSummary `json:"input"`
+			Output TokenRatioSummary `json:"output"`
+		} `json:"models"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("解析响应失败: %v", err)
+	}
+	if len(resp.Models) != 2 || resp.Models[0].Model != "claude-haiku-4.5" || resp.Models[1].Model != "claude-sonnet-4.5" {
+		t.Fatalf("模型列表应按名称排序: %+v", resp.Models)
+	}
+
+	haiku, sonnet := resp.Models[0], resp.Models[1]
+	if haiku.Input.Samples != 1 || haiku.Input.Mean != 2 || haiku.Input.Skewed {
+		t.Errorf("haiku 输入统计错误: %+v", haiku.Input)
+	}
+	if haiku.Output.Samples != 0 {
+		t.Errorf("估算为 0 的输出不应计入: %+v", haiku.Output)
+	}
+
+	if sonnet.Input.Samples != tokenRatioMinSamples || math.Abs(sonnet.Input.Mean-1.3) > 1e-9 || math.Abs(sonnet.Input.StdDev-0.1) > 1e-9 {
+		t.Errorf("sonnet 输入统计错误: %+v", sonnet.Input)
+	}
+	if !sonnet.Input.Skewed {
+		t.Error("样本充足且均值偏离 30% 应标记为系统性偏差")
+	}
+	if sonnet.Output.Mean != 1 || sonnet.Output.StdDev != 0 || sonnet.Output.Skewed {
+		t.Errorf("sonnet 输出统计错误: %+v", sonnet.Output)
+	}
+}
+
+// TestImageTokenStats 测试带图片请求按精确 usage / 本地估算分别计数，纯文本请求不计入
+func TestImageTokenStats(t *testing.T) {
+	imageTokenStatsMutex.Lock()
+	oldStats := imageTokenStats
+	imageTokenStats = ImageTokenStats{}
+	imageTokenStatsMutex.Unlock()
+	defer func() {
+		imageTokenStatsMutex.Lock()
+		imageTokenStats = oldStats
+		imageTokenStatsMutex.Unlock()
+	}()
+
+	recordImageTokenSource(kiroclient.ImageTokenEstimate{}, nil)
+	recordImageTokenSource(kiroclient.ImageTokenEstimate{Images: 2, ByDimensions: 1, Tokens: 150}, &kiroclient.KiroUsage{InputTokens: 300})
+	recordImageTokenSource(kiroclient.ImageTokenEstimate{Images: 1, ByDimensions: 1, Tokens: 100}, nil)
+	recordImageTokenSource(kiroclient.ImageTokenEstimate{Images: 1, Tokens: 50}, &kiroclient.KiroUsage{})
+
+	want := ImageTokenStats{ImagesByDimensions: 2, ImagesByBytes: 2, RequestsExact: 1, RequestsEstimated: 2}
+	if got := getImageTokenStats(); got != want {
+		t.Errorf("期望 %+v, 得到 %+v", want, got)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ========== Token 统计队列 ==========
+// 为什么：addTokenStats 在通道满时丢弃增量，高负载下用量被少计却没有任何迹象；
+// 这里统计丢弃次数、限频告警，并允许调大通道容量或在通道满时直接加锁累加
+
+const (
+	// envTokenStatsQueueSize Token 统计通道容量的环境变量（启动时读取一次）
+	envTokenStatsQueueSize = "TOKEN_STATS_QUEUE_SIZE"
+	// defaultTokenStatsQueueSize 未配置时的通道容量
+	defaultTokenStatsQueueSize = 1000
+	// tokenStatsDropWarnInterval 丢弃告警的最小间隔，每个窗口内只在第一次丢弃时告警
+	tokenStatsDropWarnInterval = 10 * time.Second
+)
+
+var (
+	// droppedTokenDeltas 通道满被丢弃的增量数（进程启动后累计）
+	droppedTokenDeltas atomic.Int64
+	// lastTokenDropWarnAt 上次丢弃告警的时间（UnixNano）
+	lastTokenDropWarnAt atomic.Int64
+	// tokenStatsDirectDirty 通道满时直接累加过、尚未落盘（由 tokenStatsWorker 负责落盘）
+	tokenStatsDirectDirty atomic.Bool
+)
+
+// tokenStatsQueueSize 读取 Token 统计通道容量（环境变量 TOKEN_STATS_QUEUE_SIZE，非法或未设置时用默认值）
+func tokenStatsQueueSize() int {
+	if v := os.Getenv(envTokenStatsQueueSize); v != "" {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			return size
+		}
+	}
+	return defaultTokenStatsQueueSize
+}
+
+// handleTokenStatsQueueFull 通道满时的处理：开启 TokenStatsDirectOnFull 时加锁直接累加，否则丢弃并计数告警
+func handleTokenStatsQueueFull(delta TokenDelta) {
+	if proxyConfig.TokenStatsDirectOnFull {
+		applyTokenDelta(delta)
+		tokenStatsDirectDirty.Store(true)
+		return
+	}
+
+	dropped := droppedTokenDeltas.Add(1)
+	now := time.Now().UnixNano()
+	last := lastTokenDropWarnAt.Load()
+	if now-last < int64(tokenStatsDropWarnInterval) || !lastTokenDropWarnAt.CompareAndSwap(last, now) {
+		return
+	}
+	if logger != nil {
+		logger.Warn("", "Token 统计通道已满，增量被丢弃", map[string]any{
+			"droppedTotal": dropped,
+			"queueSize":    cap(tokenStatsChan),
+			"hint":         "调大 " + envTokenStatsQueueSize + " 或开启 tokenStatsDirectOnFull",
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	kiroclient "github.com/jinfeijie/kiro-api-client-go"
+)
+
+// TestAddTokenStats_QueueFullAccounting 通道满时：默认丢弃并计数，开启 tokenStatsDirectOnFull 时直接累加；
+// 两种情况下 已累加 + 排队中 + 丢弃 都等于调用次数
+func TestAddTokenStats_QueueFullAccounting(t *testing.T) {
+	const workers, perWorker = 10, 10000
+	const calls = workers * perWorker
+
+	oldStats, oldChan, oldConfig := tokenStats, tokenStatsChan, proxyConfig
+	defer func() {
+		tokenStatsMutex.Lock()
+		tokenStats, tokenStatsChan = oldStats, oldChan
+		tokenStatsMutex.Unlock()
+		proxyConfig = oldConfig
+		droppedTokenDeltas.Store(0)
+		tokenStatsDirectDirty.Store(false)
+	}()
+
+	run := func(directOnFull bool) (applied, queued, dropped int64) {
+		tokenStatsMutex.Lock()
+		tokenStats = TokenStats{}
+		tokenStatsMutex.Unlock()
+		tokenStatsChan = make(chan TokenDelta, 100)
+		droppedTokenDeltas.Store(0)
+		proxyConfig = kiroclient.DefaultProxyConfig
+		proxyConfig.TokenStatsDirectOnFull = directOnFull
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perWorker; j++ {
+					addTokenStats(1, 2, true)
+				}
+			}()
+		}
+		wg.Wait()
+
+		stats := getTokenStats()
+		if stats.OutputTokens != 2*stats.InputTokens || stats.RequestCount != stats.InputTokens {
+			t.Errorf("directOnFull=%v: 累加结果不一致: %+v", directOnFull, stats)
+		}
+		return stats.InputTokens, int64(len(tokenStatsChan)), droppedTokenDeltas.Load()
+	}
+
+	applied, queued, dropped := run(false)
+	if applied != 0 || queued != 100 || applied+queued+dropped != calls {
+		t.Errorf("默认丢弃: applied=%d queued=%d dropped=%d, 合计应为 %d", applied, queued, dropped, calls)
+	}
+
+	applied, queued, dropped = run(true)
+	if dropped != 0 || applied+queued != calls {
+		t.Errorf("直接累加: applied=%d queued=%d dropped=%d, 合计应为 %d", applied, queued, dropped, calls)
+	}
+	if !tokenStatsDirectDirty.Load() {
+		t.Error("直接累加后应标记待落盘")
+	}
+}
+
+// TestTokenStatsQueueSize 环境变量配置通道容量，非法值使用默认值
+func TestTokenStatsQueueSize(t *testing.T) {
+	t.Setenv(envTokenStatsQueueSize, "5000")
+	if got := tokenStatsQueueSize(); got != 5000 {
+		t.Errorf("期望 5000, 得到 %d", got)
+	}
+	t.Setenv(envTokenStatsQueueSize, "-1")
+	if got := tokenStatsQueueSize(); got != defaultTokenStatsQueueSize {
+		t.Errorf("非法值应使用默认值, 得到 %d", got)
+	}
+}
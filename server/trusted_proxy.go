@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ========== 可信代理配置 ==========
+
+// 为什么：限流和 IP 黑名单依赖 c.ClientIP()。gin 默认信任所有来源的 X-Forwarded-For，
+// 任何客户端都能伪造 IP；而部署在负载均衡之后时，又需要信任 LB 传来的真实 IP
+const (
+	// envTrustedProxies 可信代理列表，逗号分隔的 IP 或 CIDR（如 10.0.0.0/8,192.168.1.10）
+	// 未配置时不信任任何代理，ClientIP 即 TCP 对端地址
+	envTrustedProxies = "TRUSTED_PROXIES"
+	// envRealIPHeader 读取真实 IP 的 header（如 X-Real-IP、X-Forwarded-For），未配置时依次尝试这两个
+	// X-Forwarded-For 从右往左跳过可信代理，取第一个不可信地址，避免客户端在最左侧伪造
+	envRealIPHeader = "REAL_IP_HEADER"
+)
+
+// parseTrustedProxies 解析并校验可信代理列表（IP 或 CIDR）
+func parseTrustedProxies(value string) ([]string, error) {
+	var proxies []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			if _, _, err := net.ParseCIDR(item); err != nil {
+				return nil, fmt.Errorf("%s 中的 CIDR 无效: %s", envTrustedProxies, item)
+			}
+		} else if net.ParseIP(item) == nil {
+			return nil, fmt.Errorf("%s 中的 IP 无效: %s", envTrustedProxies, item)
+		}
+		proxies = append(proxies, item)
+	}
+	return proxies, nil
+}
+
+// configureTrustedProxies 按环境变量设置 gin 的可信代理和真实 IP header
+func configureTrustedProxies(r *gin.Engine) error {
+	proxies, err := parseTrustedProxies(os.Getenv(envTrustedProxies))
+	if err != nil {
+		return err
+	}
+	// proxies 为 nil 时 gin 不信任任何代理
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		return err
+	}
+	if header := strings.TrimSpace(os.Getenv(envRealIPHeader)); header != "" {
+		r.RemoteIPHeaders = []string{header}
+	}
+
+	if logger != nil {
+		logger.Info("", "可信代理配置已加载", map[string]any{
+			"trustedProxies": proxies,
+			"realIPHeaders":  r.RemoteIPHeaders,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveClientIP 按当前环境变量配置路由，模拟来自 remoteAddr 的请求，返回 ClientIP
+func resolveClientIP(t *testing.T, remoteAddr string, headers map[string]string) string {
+	t.Helper()
+	r := gin.New()
+	if err := configureTrustedProxies(r); err != nil {
+		t.Fatalf("配置可信代理失败: %v", err)
+	}
+	var ip string
+	r.GET("/ip", func(c *gin.Context) {
+		ip = c.ClientIP()
+	})
+	req, _ := http.NewRequest("GET", "/ip", nil)
+	req.RemoteAddr = remoteAddr
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	return ip
+}
+
+// TestTrustedProxies_ClientIP 测试可信代理转发的 XFF 生效，不可信来源伪造的 XFF 被忽略
+func TestTrustedProxies_ClientIP(t *testing.T) {
+	t.Setenv(envTrustedProxies, "10.0.0.0/8, 192.168.1.10")
+	t.Setenv(envRealIPHeader, "")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"可信 LB 转发", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"可信单 IP 转发", "192.168.1.10:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"客户端在最左侧伪造", "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "1.1.1.1, 203.0.113.7"}, "203.0.113.7"},
+		{"不可信来源伪造", "198.51.100.9:5000", map[string]string{"X-Forwarded-For": "1.1.1.1"}, "198.51.100.9"},
+		{"不可信来源伪造 X-Real-IP", "198.51.100.9:5000", map[string]string{"X-Real-IP": "1.1.1.1"}, "198.51.100.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveClientIP(t, tt.remoteAddr, tt.headers); got != tt.want {
+				t.Errorf("期望 %s, 得到 %s", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestTrustedProxies_DefaultTrustsNone 测试未配置时不信任任何代理
+func TestTrustedProxies_DefaultTrustsNone(t *testing.T) {
+	t.Setenv(envTrustedProxies, "")
+	t.Setenv(envRealIPHeader, "")
+
+	got := resolveClientIP(t, "10.1.2.3:5000", map[string]string{"X-Forwarded-For": "1.1.1.1"})
+	if got != "10.1.2.3" {
+		t.Errorf("未配置可信代理时应使用对端地址, 得到 %s", got)
+	}
+}
+
+// TestTrustedProxies_RealIPHeader 测试只读取配置的真实 IP header
+func TestTrustedProxies_RealIPHeader(t *testing.T) {
+	t.Setenv(envTrustedProxies, "10.0.0.0/8")
+	t.Setenv(envRealIPHeader, "X-Real-IP")
+
+	got := resolveClientIP(t, "10.1.2.3:5000", map[string]string{
+		"X-Real-IP":       "203.0.113.7",
+		"X-Forwarded-For": "1.1.1.1",
+	})
+	if got != "203.0.113.7" {
+		t.Errorf("应使用 X-Real-IP, 得到 %s", got)
+	}
+}
+
+// TestParseTrustedProxies_Invalid 测试非法 IP/CIDR 在启动时被拒绝
+func TestParseTrustedProxies_Invalid(t *testing.T) {
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip", "10.0.0.1,abc/8"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("%q 应校验失败", value)
+		}
+	}
+}
@@ -1,6 +1,13 @@
 package kiroclient
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	_ "image/gif"  // 注册 gif 解码器，用于读取图片尺寸
+	_ "image/jpeg" // 注册 jpeg 解码器
+	_ "image/png"  // 注册 png 解码器
 	"sync"
 
 	tiktoken "github.com/pkoukk/tiktoken-go"
@@ -38,16 +45,163 @@ func CountTokens(text string) int {
 	return len(tokens)
 }
 
-// CountMessagesTokens 计算消息列表的 token 数
+// CountMessagesTokens 计算消息列表的 token 数（图片按 DefaultImageTokenCost 估算）
 func CountMessagesTokens(messages []ChatMessage) int {
+	total, _ := CountMessagesTokensWithImages(messages, DefaultImageTokenCost)
+	return total
+}
+
+// CountMessagesTokensWithImages 计算消息列表的 token 数，图片按 cost 估算，同时返回图片估算明细
+func CountMessagesTokensWithImages(messages []ChatMessage, cost ImageTokenCost) (int, ImageTokenEstimate) {
 	total := 0
+	var images ImageTokenEstimate
 	for _, msg := range messages {
 		// 每条消息有格式开销：<|im_start|>role\ncontent<|im_end|>
 		total += 4
 		total += CountTokens(msg.Role)
 		total += CountTokens(msg.Content)
+		for _, img := range msg.Images {
+			tokens, byDimensions := EstimateImageTokens(img, cost)
+			images.Images++
+			images.Tokens += tokens
+			if byDimensions {
+				images.ByDimensions++
+			}
+		}
 	}
+	total += images.Tokens
 	// 回复的 priming tokens
 	total += 3
-	return total
+	return total, images
+}
+
+// EstimatePayloadTokens 估算上游请求体（conversationState）的输入 token 数
+// 图片按 cost 估算后从请求体中剔除，conversationId 不是模型输入也剔除，
+// 其余部分（含工具定义、注入的 system、sanitize 补的占位消息）序列化后计数
+// 为什么：count_tokens 只数原始消息，看不到代理做的转换；JSON 结构符号会略微高估，作为上限参考
+func EstimatePayloadTokens(body []byte, cost ImageTokenCost) (int, ImageTokenEstimate, error) {
+	var payload any
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return 0, ImageTokenEstimate{}, err
+	}
+	var images ImageTokenEstimate
+	stripPayloadImages(payload, cost, &images)
+	text, err := json.Marshal(payload)
+	if err != nil {
+		return 0, images, err
+	}
+	return CountTokens(string(text)) + images.Tokens, images, nil
+}
+
+// stripPayloadImages 递归查找 images 数组，估算每张图片的 token 后删除（base64 数据不按文本计数）
+func stripPayloadImages(v any, cost ImageTokenCost, images *ImageTokenEstimate) {
+	switch node := v.(type) {
+	case map[string]any:
+		delete(node, "conversationId")
+		if list, ok := node["images"].([]any); ok {
+			for _, item := range list {
+				var img ImageBlock
+				if m, ok := item.(map[string]any); ok {
+					img.Format, _ = m["format"].(string)
+					if src, ok := m["source"].(map[string]any); ok {
+						img.Source.Bytes, _ = src["bytes"].(string)
+					}
+				}
+				tokens, byDimensions := EstimateImageTokens(img, cost)
+				images.Images++
+				images.Tokens += tokens
+				if byDimensions {
+					images.ByDimensions++
+				}
+			}
+			delete(node, "images")
+		}
+		for _, child := range node {
+			stripPayloadImages(child, cost, images)
+		}
+	case []any:
+		for _, child := range node {
+			stripPayloadImages(child, cost, images)
+		}
+	}
+}
+
+// ========== 图片 token 估算 ==========
+// 为什么：只数文本时，上游没有返回 usage 的多模态请求会被严重低估
+
+// ImageTokenCost 图片 token 估算参数（字段为 0 时使用 DefaultImageTokenCost 的对应值）
+type ImageTokenCost struct {
+	PixelsPerToken int `json:"pixelsPerToken"` // 能解析尺寸时：宽×高 / PixelsPerToken
+	BytesPerToken  int `json:"bytesPerToken"`  // 无法解析尺寸（如 webp、数据截断）时：解码后字节数 / BytesPerToken
+	MaxTokens      int `json:"maxTokens"`      // 单张图片的估算上限（上游会把大图缩放）
+}
+
+// DefaultImageTokenCost 默认估算参数：宽×高/750，单张最多约 1600 token（与 Anthropic 文档的近似公式一致）
+var DefaultImageTokenCost = ImageTokenCost{
+	PixelsPerToken: 750,
+	BytesPerToken:  100,
+	MaxTokens:      1600,
+}
+
+// ImageTokenEstimate 一组消息的图片 token 估算明细
+type ImageTokenEstimate struct {
+	Images       int // 图片总数
+	ByDimensions int // 按尺寸估算的图片数（其余按字节数估算）
+	Tokens       int // 估算的图片 token 合计
+}
+
+// imageHeaderBase64Len 解析尺寸时最多解码的 base64 前缀长度（图片头部信息都在开头）
+const imageHeaderBase64Len = 64 << 10
+
+// withDefaults 把未设置的字段补为默认值
+func (c ImageTokenCost) withDefaults() ImageTokenCost {
+	if c.PixelsPerToken <= 0 {
+		c.PixelsPerToken = DefaultImageTokenCost.PixelsPerToken
+	}
+	if c.BytesPerToken <= 0 {
+		c.BytesPerToken = DefaultImageTokenCost.BytesPerToken
+	}
+	if c.MaxTokens <= 0 {
+		c.MaxTokens = DefaultImageTokenCost.MaxTokens
+	}
+	return c
+}
+
+// EstimateImageTokens 估算单张图片的 token 数，返回是否根据尺寸估算
+// 能从图片头部解析出宽高（png/jpeg/gif）时按像素数估算，否则按解码后的字节数估算，结果不超过 MaxTokens
+func EstimateImageTokens(img ImageBlock, cost ImageTokenCost) (int, bool) {
+	cost = cost.withDefaults()
+	data := img.Source.Bytes
+
+	tokens := 0
+	byDimensions := false
+	if width, height, ok := imageDimensions(data); ok {
+		tokens = width * height / cost.PixelsPerToken
+		byDimensions = true
+	} else {
+		tokens = base64.StdEncoding.DecodedLen(len(data)) / cost.BytesPerToken
+	}
+	if tokens < 1 {
+		tokens = 1
+	}
+	if tokens > cost.MaxTokens {
+		tokens = cost.MaxTokens
+	}
+	return tokens, byDimensions
+}
+
+// imageDimensions 只解码 base64 前缀，从图片头部读取宽高
+func imageDimensions(data string) (int, int, bool) {
+	if len(data) > imageHeaderBase64Len {
+		data = data[:imageHeaderBase64Len]
+	}
+	header, err := base64.StdEncoding.DecodeString(data[:len(data)/4*4])
+	if err != nil {
+		return 0, 0, false
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 {
+		return 0, 0, false
+	}
+	return cfg.Width, cfg.Height, true
 }
@@ -0,0 +1,122 @@
+package kiroclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+// encodeTestPNG 生成指定尺寸的 PNG 并返回 base64
+func encodeTestPNG(t *testing.T, width, height int) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatalf("编码 PNG 失败: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// TestEstimateImageTokens 测试按尺寸 / 按字节数估算以及上限
+func TestEstimateImageTokens(t *testing.T) {
+	// 300x250 = 75000 像素 / 750 = 100
+	img := ImageBlock{Format: "png", Source: ImageSource{Bytes: encodeTestPNG(t, 300, 250)}}
+	tokens, byDimensions := EstimateImageTokens(img, ImageTokenCost{})
+	if !byDimensions || tokens != 100 {
+		t.Errorf("期望按尺寸估算 100, 得到 %d (byDimensions=%v)", tokens, byDimensions)
+	}
+
+	// 自定义参数
+	tokens, _ = EstimateImageTokens(img, ImageTokenCost{PixelsPerToken: 250})
+	if tokens != 300 {
+		t.Errorf("PixelsPerToken=250 期望 300, 得到 %d", tokens)
+	}
+
+	// 大图受 MaxTokens 限制
+	big := ImageBlock{Format: "png", Source: ImageSource{Bytes: encodeTestPNG(t, 2000, 2000)}}
+	if tokens, _ := EstimateImageTokens(big, ImageTokenCost{}); tokens != DefaultImageTokenCost.MaxTokens {
+		t.Errorf("大图期望上限 %d, 得到 %d", DefaultImageTokenCost.MaxTokens, tokens)
+	}
+	if tokens, _ := EstimateImageTokens(big, ImageTokenCost{MaxTokens: 500}); tokens != 500 {
+		t.Errorf("MaxTokens=500 期望 500, 得到 %d", tokens)
+	}
+
+	// 无法解析尺寸（如 webp）时按字节数估算：5000 字节 / 100 = 50
+	raw := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 5000)))
+	webp := ImageBlock{Format: "webp", Source: ImageSource{Bytes: raw}}
+	tokens, byDimensions = EstimateImageTokens(webp, ImageTokenCost{})
+	if byDimensions || tokens != 50 {
+		t.Errorf("期望按字节数估算 50, 得到 %d (byDimensions=%v)", tokens, byDimensions)
+	}
+}
+
+// TestCountMessagesTokensWithImages 测试带图片的估算比纯文本多出图片成本，并返回明细
+func TestCountMessagesTokensWithImages(t *testing.T) {
+	textOnly := []ChatMessage{{Role: "user", Content: "描述这张图片"}}
+	withImages := []ChatMessage{{
+		Role:    "user",
+		Content: "描述这张图片",
+		Images: []ImageBlock{
+			{Format: "png", Source: ImageSource{Bytes: encodeTestPNG(t, 300, 250)}},
+			{Format: "webp", Source: ImageSource{Bytes: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 5000)))}},
+		},
+	}}
+
+	base, est := CountMessagesTokensWithImages(textOnly, DefaultImageTokenCost)
+	if est.Images != 0 || est.Tokens != 0 {
+		t.Errorf("纯文本不应有图片估算: %+v", est)
+	}
+
+	total, est := CountMessagesTokensWithImages(withImages, DefaultImageTokenCost)
+	if est.Images != 2 || est.ByDimensions != 1 || est.Tokens != 150 {
+		t.Errorf("图片估算明细错误: %+v", est)
+	}
+	if total != base+150 {
+		t.Errorf("期望 %d, 得到 %d", base+150, total)
+	}
+
+	// CountMessagesTokens 使用默认参数
+	if got := CountMessagesTokens(withImages); got != total {
+		t.Errorf("CountMessagesTokens 期望 %d, 得到 %d", total, got)
+	}
+}
+
+// TestEstimatePayloadTokens 测试上游请求体估算：图片按成本估算，base64 和 conversationId 不按文本计数
+func TestEstimatePayloadTokens(t *testing.T) {
+	build := func(conversationID string, images []any) []byte {
+		userMsg := map[string]any{"content": "描述这张图片", "modelId": "claude-sonnet-4.5", "origin": "AI_EDITOR"}
+		if images != nil {
+			userMsg["images"] = images
+		}
+		body, _ := json.Marshal(map[string]any{"conversationState": map[string]any{
+			"conversationId": conversationID,
+			"currentMessage": map[string]any{"userInputMessage": userMsg},
+			"history":        []any{},
+		}})
+		return body
+	}
+
+	base, est, err := EstimatePayloadTokens(build("conv-a", nil), DefaultImageTokenCost)
+	if err != nil || base <= 0 || est.Images != 0 {
+		t.Fatalf("纯文本估算错误: %d %+v %v", base, est, err)
+	}
+	if other, _, _ := EstimatePayloadTokens(build("a-much-longer-conversation-id-0123456789", nil), DefaultImageTokenCost); other != base {
+		t.Errorf("conversationId 不应计入: %d != %d", other, base)
+	}
+
+	img := map[string]any{"format": "png", "source": map[string]any{"bytes": encodeTestPNG(t, 300, 250)}}
+	total, est, err := EstimatePayloadTokens(build("conv-a", []any{img}), DefaultImageTokenCost)
+	if err != nil || est.Images != 1 || est.ByDimensions != 1 || est.Tokens != 100 {
+		t.Fatalf("图片估算明细错误: %+v %v", est, err)
+	}
+	if total != base+100 {
+		t.Errorf("图片应按成本估算而非按 base64 文本计数: 期望 %d, 得到 %d", base+100, total)
+	}
+
+	if _, _, err := EstimatePayloadTokens([]byte("{broken"), DefaultImageTokenCost); err == nil {
+		t.Error("无效请求体应返回错误")
+	}
+}
@@ -1,6 +1,9 @@
 package kiroclient
 
-import "time"
+import (
+	"fmt"
+	"time"
+)
 
 // KiroAuthToken Kiro 认证 Token
 type KiroAuthToken struct {
@@ -232,6 +235,23 @@ func NormalizeModelID(modelID string, mapping ModelMapping) string {
 	return modelID
 }
 
+// ResolveModelID 应用模型映射并校验最终的模型 ID
+// 为什么要在映射之后校验：映射表可以把任意名字映射成任意字符串，
+// 最终写进上游 modelId 字段的值必须为空或属于 AvailableModels，否则直接拒绝
+func ResolveModelID(modelID string, mapping ModelMapping) (string, error) {
+	if modelID == "" {
+		return "", nil
+	}
+	resolved := NormalizeModelID(modelID, mapping)
+	if !IsValidModel(resolved) {
+		if resolved != modelID {
+			return "", fmt.Errorf("无效的模型 ID: %q（由 %q 映射而来）", resolved, modelID)
+		}
+		return "", fmt.Errorf("无效的模型 ID: %q", resolved)
+	}
+	return resolved, nil
+}
+
 // UsageLimitsResponse 额度限制响应
 type UsageLimitsResponse struct {
 	DaysUntilReset     int              `json:"daysUntilReset"`
@@ -276,6 +296,28 @@ type AccountInfo struct {
 	ProfileArn   string         `json:"profileArn"`   // Profile ARN（服务器部署必需）
 	CreatedAt    string         `json:"createdAt"`    // 创建时间
 	LastUsedAt   string         `json:"lastUsedAt"`   // 最后使用时间
+
+	// 停用状态：连续刷新 Token 失败达到阈值后自动停用，不再参与选择，需要管理员手动启用
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabledReason,omitempty"` // 停用原因（最后一次失败信息）
+	DisabledAt     string `json:"disabledAt,omitempty"`     // 停用时间
+
+	// Reserved 预留账号：不参与正常请求选择，只供自检诊断等运维探测使用，避免探测消耗生产额度、干扰统计
+	Reserved bool `json:"reserved,omitempty"`
+
+	// Weight 调度权重（未设置或 0 按 1 处理），与额度权重相乘：权重 3 的账号长期约分到权重 1 账号 3 倍的请求
+	Weight int `json:"weight,omitempty"`
+}
+
+// MaxAccountWeight 账号调度权重上限
+const MaxAccountWeight = 100
+
+// EffectiveWeight 账号的调度权重（未设置时为 1）
+func (a *AccountInfo) EffectiveWeight() int {
+	if a.Weight <= 0 {
+		return 1
+	}
+	return a.Weight
 }
 
 // AccountsConfig 多账号配置
@@ -369,6 +411,10 @@ type CircuitBreaker struct {
 	LastFailureTime time.Time    // 最后失败时间
 	OpenedAt        time.Time    // 熔断开始时间
 	HalfOpenAt      time.Time    // 进入半开状态时间
+
+	// 半开状态下进行中的试探请求（circuitMu 保护）：名额占满时其余请求视同熔断
+	ProbesInFlight int       // 已放行、尚未回报结果的试探请求数
+	LastProbeAt    time.Time // 最近一次放行试探请求的时间（用于回收未回报结果的名额）
 }
 
 // CircuitBreakerConfig 熔断器配置
@@ -377,6 +423,7 @@ type CircuitBreakerConfig struct {
 	FailureWindow      time.Duration // 失败计数窗口（默认5分钟）
 	OpenDuration       time.Duration // 熔断持续时间（默认5分钟）
 	HalfOpenMaxSuccess int           // 半开状态下成功多少次后关闭熔断（默认2次）
+	HalfOpenMaxProbes  int           // 半开状态下同时放行的试探请求数（默认1个，0 按 1 处理）
 	ErrorRateThreshold float64       // 错误率阈值，超过此值自动熔断（默认0.8，即80%）
 	ErrorRateMinReqs   int64         // 错误率检查的最少请求数（默认5，防止样本太少误判）
 }
@@ -387,6 +434,7 @@ var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
 	FailureWindow:      5 * time.Minute,
 	OpenDuration:       5 * time.Minute,
 	HalfOpenMaxSuccess: 5,
+	HalfOpenMaxProbes:  1,
 	ErrorRateThreshold: 0.8,
 	ErrorRateMinReqs:   5,
 }
@@ -395,8 +443,17 @@ var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
 type AccountLoadInfo struct {
 	AccountID string  `json:"accountId"` // 账号唯一标识
 	Email     string  `json:"email"`     // 账号邮箱
-	Weight    int     `json:"weight"`    // 当前权重（0-100）
+	Weight    int     `json:"weight"`    // 当前权重（额度权重 0-100 × 调度权重）
 	Percent   float64 `json:"percent"`   // 负载占比百分比
+
+	TokenExpired     bool `json:"tokenExpired"`     // Token 缺失或已过期
+	Disabled         bool `json:"disabled"`         // 账号已停用（连续认证失败）
+	CreditsExhausted bool `json:"creditsExhausted"` // 额度已耗尽（按额度缓存判断）
+	Reserved         bool `json:"reserved"`         // 预留给诊断探测，不承接正常请求
+	Eligible         bool `json:"eligible"`         // 当前能否被 selectAccount 选中
+
+	// QuotaExhaustedUntil 上游报告额度耗尽后暂停选择的截止时间（RFC3339，未标记时为空）
+	QuotaExhaustedUntil string `json:"quotaExhaustedUntil,omitempty"`
 }
 
 // AccountUsageCache 账号额度缓存
@@ -405,6 +462,8 @@ type AccountUsageCache struct {
 	TotalCredits float64   // 总额度
 	LastUpdated  time.Time // 最后更新时间
 	UpdateFailed bool      // 上次更新是否失败
+	// Limits 最近一次完整的额度响应（通过 RecordUsageLimits 写入时才有，可能为 nil）
+	Limits *UsageLimitsResponse
 }
 
 // GetRemainingCredits 获取剩余额度
@@ -483,6 +542,7 @@ type ClaudeUsage struct {
 	ClaudeCacheCreation5mTokens int                       `json:"claude_cache_creation_5_m_tokens,omitempty"`
 	ClaudeCacheCreation1hTokens int                       `json:"claude_cache_creation_1_h_tokens,omitempty"`
 	ServerToolUse               *ClaudeServerToolUse      `json:"server_tool_use,omitempty"`
+	ServiceTier                 string                    `json:"service_tier,omitempty"`
 }
 
 // Usage 简化版 token 使用量（内部使用）
@@ -496,12 +556,23 @@ type Usage struct {
 // KiroUsage Kiro API 返回的精确 token 使用量
 // 从 messageMetadataEvent 和 meteringEvent 解析
 type KiroUsage struct {
-	InputTokens      int     `json:"inputTokens"`      // 输入 token 数
-	OutputTokens     int     `json:"outputTokens"`     // 输出 token 数
-	CacheReadTokens  int     `json:"cacheReadTokens"`  // 缓存读取 token 数
-	CacheWriteTokens int     `json:"cacheWriteTokens"` // 缓存写入 token 数
-	ReasoningTokens  int     `json:"reasoningTokens"`  // 推理 token 数
-	Credits          float64 `json:"credits"`          // 消耗的 credits
+	InputTokens      int     `json:"inputTokens"`       // 输入 token 数
+	OutputTokens     int     `json:"outputTokens"`      // 输出 token 数
+	CacheReadTokens  int     `json:"cacheReadTokens"`   // 缓存读取 token 数
+	CacheWriteTokens int     `json:"cacheWriteTokens"`  // 缓存写入 token 数
+	ReasoningTokens  int     `json:"reasoningTokens"`   // 推理 token 数
+	Credits          float64 `json:"credits"`           // 消耗的 credits
+	ModelID          string  `json:"modelId,omitempty"` // messageMetadataEvent 中实际提供服务的模型（未返回时为空）
+}
+
+// IsZero 判断 usage 是否全部为零（上游没有返回任何用量信息，ModelID 不算用量）
+func (u *KiroUsage) IsZero() bool {
+	if u == nil {
+		return true
+	}
+	counts := *u
+	counts.ModelID = ""
+	return counts == KiroUsage{}
 }
 
 // ========== Thinking 模式配置 ==========
@@ -517,6 +588,8 @@ const (
 	ThinkingFormatThinking ThinkingOutputFormat = "thinking"
 	// ThinkingFormatThink 转换为 <think> 标签
 	ThinkingFormatThink ThinkingOutputFormat = "think"
+	// ThinkingFormatNone 丢弃 thinking 内容（相当于对客户端关闭 thinking，用于 A/B 对照组）
+	ThinkingFormatNone ThinkingOutputFormat = "none"
 )
 
 // ProxyConfig 代理服务器配置
@@ -528,7 +601,153 @@ type ProxyConfig struct {
 	AutoContinueRounds int `json:"autoContinueRounds"`
 	// ModelThinkingMode 每个模型是否默认启用 thinking 模式
 	ModelThinkingMode map[string]bool `json:"modelThinkingMode"`
-}
+	// MaxRequestSeconds 单个请求的总时长上限（秒，0=不限制）
+	// 与 HTTP 客户端超时、客户端自身的 deadline 相互独立，防止卡住的请求长期占用资源
+	MaxRequestSeconds int `json:"maxRequestSeconds"`
+	// ModelTimeouts 按模型 ID（映射后）配置的上游调用超时（秒），未配置的模型为 120 秒
+	// 为什么：opus 等模型的长篇生成经常超过 120 秒，被统一的超时截断
+	ModelTimeouts map[string]int `json:"modelTimeouts"`
+	// ThinkingABPercent thinking A/B 实验中分到 B 组的请求百分比（0=关闭实验）
+	// 按 msgId hash 分组，同一个 msgId 总是落在同一组，便于复现
+	ThinkingABPercent int `json:"thinkingABPercent"`
+	// ThinkingABFormat B 组使用的 thinking 输出格式（为空时为 none，即不输出 thinking）
+	ThinkingABFormat ThinkingOutputFormat `json:"thinkingABFormat"`
+	// DisabledModels 全局禁用的模型 ID（按映射后的模型 ID 匹配）
+	// 用于成本事故等场景临时停用昂贵模型，无需修改模型列表或逐个调整 API-KEY
+	DisabledModels []string `json:"disabledModels"`
+	// AccountStickiness 会话粘性：同一会话（X-Session-Id 或 metadata.user_id）的请求固定使用同一账号
+	// 关闭时每次请求独立轮询；绑定账号熔断/不可用时自动重新选择
+	AccountStickiness bool `json:"accountStickiness"`
+	// ForwardedEvents 辅助事件（网页链接、引用、后续建议等）是否转成文本注入输出
+	// key 为 EventStream 事件类型（见 AuxiliaryEventTypes），缺省为转发；只要原始模型文本时可全部设为 false
+	ForwardedEvents map[string]bool `json:"forwardedEvents"`
+	// RetryEmptyResponse 上游返回空响应（无输出、无用量）时换一个账号重试一次
+	// 空响应会记为该账号的一次失败；已经向客户端输出过内容时绝不重试
+	RetryEmptyResponse bool `json:"retryEmptyResponse"`
+	// MaxRetries 上游 5xx 等会触发熔断的错误时换账号重试的最多次数（0=不重试）
+	// 只在还没有向客户端输出任何内容时重试，已经失败过的账号不会被再次选中
+	MaxRetries int `json:"maxRetries"`
+	// MaxConcurrentRequests 全局同时处理的聊天请求上限（0=不限制），保护进程不被流量尖峰压垮
+	MaxConcurrentRequests int `json:"maxConcurrentRequests"`
+	// MaxQueuedRequests 并发已满时允许排队等待的请求数（0=不排队，直接返回 503）
+	MaxQueuedRequests int `json:"maxQueuedRequests"`
+	// UpstreamHeaders 追加/覆盖发往 Kiro 的请求头，用于试验新的 agent mode、feature flag 等
+	// 风险：错误的 header 可能导致上游拒绝请求甚至账号被风控，仅建议临时试验使用
+	// Authorization 等关键 header 受保护，不允许覆盖（见 IsProtectedUpstreamHeader）
+	UpstreamHeaders map[string]string `json:"upstreamHeaders"`
+	// AgentMode 发往 Kiro 的 x-amzn-kiro-agent-mode（空=DefaultAgentMode "chat"）
+	AgentMode string `json:"agentMode"`
+	// ToolsAgentMode 请求带工具定义时使用的 agent mode（空=沿用 AgentMode）
+	// 为什么：部分 Kiro 能力（工具调用、agentic 流程）可能需要不同的 mode，便于单独试验
+	ToolsAgentMode string `json:"toolsAgentMode"`
+	// TrimResponseWhitespace 去掉响应最开头的 BOM/空白和最末尾的空白，避免污染严格解析的客户端（如 JSON 模式）
+	// 非流式处理完整文本首尾；流式只处理第一段非空文本之前的内容
+	TrimResponseWhitespace bool `json:"trimResponseWhitespace"`
+	// TokenStatsDirectOnFull Token 统计通道满时直接加锁累加，而不是丢弃增量（会短暂阻塞请求处理）
+	// 通道容量由环境变量 TOKEN_STATS_QUEUE_SIZE 配置
+	TokenStatsDirectOnFull bool `json:"tokenStatsDirectOnFull"`
+	// DefaultModel 客户端未指定模型时使用的模型 ID（空=保持原行为，由 Kiro 自行选择）
+	// 之后照常走模型映射、校验和禁用检查
+	DefaultModel string `json:"defaultModel"`
+	// ModelMappingBootstrapURL 参考模型列表地址（/v1/models 格式），POST /api/model-mapping/bootstrap 未提交 pairs 时从这里拉取
+	ModelMappingBootstrapURL string `json:"modelMappingBootstrapUrl"`
+	// CaptureRequestBodies 在内存中保留最近的聊天请求体（脱敏后），响应头 X-Kiro-Replay-Id 返回捕获 ID，供 /api/requests/:id/replay 调试重放
+	// 为什么默认关闭：请求体包含用户对话内容，涉及隐私，只在排查问题时显式开启（敏感 header 和密钥字段不会保存）
+	CaptureRequestBodies bool `json:"captureRequestBodies"`
+	// RequestFingerprint 按请求内容（模型、消息、生成参数）计算稳定的指纹，通过 X-Request-Fingerprint 返回并写入日志
+	// 为什么：msgId 每次都不同，指纹用于在日志中关联同一请求的多次重试、判断重复请求
+	RequestFingerprint bool `json:"requestFingerprint"`
+	// AllowCaptureHeader 允许客户端用 X-Kiro-Capture: true 生成支持包（脱敏后的请求体、上游请求体和完整响应），通过 /api/captures/:id 查看
+	// 为什么默认关闭：支持包会保留对话内容，只在协助用户排查问题时由管理员临时开启（密钥、图片数据不会保存，到期自动清理）
+	AllowCaptureHeader bool `json:"allowCaptureHeader"`
+	// AccountPinApiKeyIds 允许用 X-Kiro-Account-Id 固定账号的 API-KEY 标识（前 8 位，空=不允许，header 被忽略）
+	// 为什么要白名单：固定账号会绕过负载均衡和熔断回落，只应开放给排查问题的管理员 key
+	AccountPinApiKeyIds []string `json:"accountPinApiKeyIds"`
+	// HashApiKeys 保存 API-KEY 时把明文 key 转成加盐 SHA-256 哈希（已有明文 key 在下一次保存时转换）
+	// 验证时明文和哈希两种格式都接受，关闭后新保存的 key 恢复明文，已哈希的条目保持不变
+	HashApiKeys bool `json:"hashApiKeys"`
+	// ImageErrorMode 图片无法处理（格式不支持、数据损坏）时的行为：lenient（默认）在原位置插入文本标记，strict 直接拒绝请求
+	// 为什么：以前静默丢弃图片，模型只看到文字，回答让人困惑
+	ImageErrorMode string `json:"imageErrorMode"`
+	// MaxImagesPerRequest 单个请求（所有消息合计）最多携带的图片数（0=不限制）
+	// 超出时按 ImageErrorMode 处理：strict 拒绝请求，lenient 保留前 N 张，其余替换为文本标记
+	MaxImagesPerRequest int `json:"maxImagesPerRequest"`
+	// ImagesWithToolsPolicy 请求同时带图片和工具定义时的行为：allow（默认）原样发送，warn 发送但记录告警并返回 X-Kiro-Warning 头，reject 直接返回 400
+	// 为什么：部分模型/agent mode 组合可能不支持图片和工具同时出现，上游的报错很难看懂，运维可以提前拦截
+	ImagesWithToolsPolicy string `json:"imagesWithToolsPolicy"`
+	// SystemInjectionMode Claude system prompt 注入到 Kiro history 的方式（空=pair）
+	// pair：history 最前面插入 user(system)+assistant(确认语) 配对；first_user/last_user：拼到第一条/最后一条 user 消息开头
+	// 为什么可配置：不同位置和措辞可能影响 prompt 缓存命中和模型遵循程度，便于不改代码做对比试验
+	SystemInjectionMode string `json:"systemInjectionMode"`
+	// SystemAckText pair 模式下 assistant 确认语（空=DefaultSystemAckText）
+	SystemAckText string `json:"systemAckText"`
+	// ToolDescriptionOverflow 工具描述超过 Kiro 长度上限时的行为：truncate（默认）截断并记录告警，reject 直接返回 400
+	// 为什么：依赖长描述的工具被静默截断后行为会变差，客户端却无从得知
+	ToolDescriptionOverflow string `json:"toolDescriptionOverflow"`
+	// SlowRequestMs 慢请求阈值（毫秒，0=关闭）：总耗时超过阈值的请求输出一条 WARN 日志（模型、账号、耗时、TTFT、token 数）
+	// 为什么：全量访问日志量太大，排查延迟问题通常只需要看慢的那部分
+	SlowRequestMs int `json:"slowRequestMs"`
+	// PayloadWarnBytes 发往上游的 conversationState 请求体超过该字节数时记录 WARN 日志（0=只在 DEBUG 日志中输出）
+	// 为什么：CONTENT_LENGTH_EXCEEDS_THRESHOLD 之前提前发现超大请求，结合 /api/stats 的 payloadSizes 分布设置裁剪阈值
+	PayloadWarnBytes int `json:"payloadWarnBytes"`
+	// ImageTokenCost 本地估算输入 token 时每张图片的成本参数（字段为 0 时使用 DefaultImageTokenCost）
+	// 只影响上游没有返回 usage 时的降级估算
+	ImageTokenCost ImageTokenCost `json:"imageTokenCost"`
+	// StreamFlushBytes 流式响应的文本合并阈值（字节，0=每个增量立即发送）：累计到该字节数或等待超过 StreamFlushMaxWaitMs 时才发送一帧 SSE
+	// 为什么：高延迟链路上大量很小的帧开销明显，合并后帧数更少；tool_use、thinking/text 切换和结束时总是立即发送
+	StreamFlushBytes int `json:"streamFlushBytes"`
+	// StreamFlushMaxWaitMs 合并时缓冲文本的最长等待时间（毫秒，0=默认 50ms），只在 StreamFlushBytes>0 时生效
+	StreamFlushMaxWaitMs int `json:"streamFlushMaxWaitMs"`
+	// AutoDisableAfterAuthFailures 账号连续刷新 Token 失败（400/401/403）达到该次数后自动停用（0=不自动停用）
+	// 为什么：凭证被吊销的账号会一直被选中并报错，停用后需在管理面板手动启用
+	AutoDisableAfterAuthFailures int `json:"autoDisableAfterAuthFailures"`
+	// MaxTools 单个请求允许的工具数量上限（0=不限制），超出时返回 400
+	// 为什么：部分 Agent 框架会把整个工具目录塞进请求，上游请求体和 token 成本随之膨胀
+	MaxTools int `json:"maxTools"`
+	// MaxTotalToolSchemaBytes 单个请求所有工具 input_schema 序列化后的总字节数上限（0=不限制），超出时返回 400
+	MaxTotalToolSchemaBytes int `json:"maxTotalToolSchemaBytes"`
+	// MaxInputTokens 单个请求估算输入 token 数（消息、图片、工具定义）的硬上限（0=不限制），超出时在调用上游前返回 400
+	// 为什么：防止单个超大请求造成失控的成本；与上下文裁剪不同，不做降级处理
+	MaxInputTokens int `json:"maxInputTokens"`
+	// ClaudeServiceTier Claude 响应 usage.service_tier 的值（空=DefaultClaudeServiceTier "standard"）
+	// 兼容字段：Kiro 没有服务等级的概念，只为读取该字段的新版 Anthropic 客户端提供固定值
+	ClaudeServiceTier string `json:"claudeServiceTier"`
+	// DefaultMaxTokens 客户端未传 max_tokens 时按格式使用的默认值（key：openai、claude、anthropic；0 或缺省=不限制）
+	// anthropic（/anthropic/v1/messages）未单独配置时沿用 claude 的值；客户端显式传入时总是以客户端为准
+	DefaultMaxTokens map[string]int `json:"defaultMaxTokens"`
+}
+
+// 图片处理失败时的行为
+const (
+	ImageErrorModeLenient = "lenient"
+	ImageErrorModeStrict  = "strict"
+)
+
+// 图片与工具同时出现时的行为
+const (
+	ImagesWithToolsAllow  = "allow"
+	ImagesWithToolsWarn   = "warn"
+	ImagesWithToolsReject = "reject"
+)
+
+// system prompt 注入方式
+const (
+	SystemInjectionPair      = "pair"
+	SystemInjectionFirstUser = "first_user"
+	SystemInjectionLastUser  = "last_user"
+)
+
+// 工具描述超长时的行为
+const (
+	ToolDescriptionTruncate = "truncate"
+	ToolDescriptionReject   = "reject"
+)
+
+// DefaultSystemAckText pair 模式下默认的 assistant 确认语
+const DefaultSystemAckText = "I will follow these instructions."
+
+// DefaultClaudeServiceTier 未配置 ClaudeServiceTier 时 usage.service_tier 的值
+const DefaultClaudeServiceTier = "standard"
 
 // DefaultProxyConfig 默认代理配置
 var DefaultProxyConfig = ProxyConfig{
@@ -537,6 +756,35 @@ var DefaultProxyConfig = ProxyConfig{
 	ModelThinkingMode:    make(map[string]bool),
 }
 
+// ChatOptions 单次聊天调用的选项（由调用方按请求填充，零值即默认行为）
+// 为什么不直接读全局配置：client 包不依赖 server 的 proxyConfig，同一进程内不同请求可以使用不同的选项
+type ChatOptions struct {
+	// ThinkingFormat thinking 输出格式，为 none 时不回调 reasoningContentEvent 的内容
+	ThinkingFormat ThinkingOutputFormat `json:"thinkingFormat,omitempty"`
+	// ForwardedEvents 辅助事件转发开关（见 AuxiliaryEventTypes），缺省为转发
+	ForwardedEvents map[string]bool `json:"forwardedEvents,omitempty"`
+	// RetryOnEmpty 上游返回 200 但没有任何输出和用量时，换一个账号重试一次
+	RetryOnEmpty bool `json:"retryOnEmpty,omitempty"`
+	// MaxRetries 上游调用在输出开始前以会触发熔断的错误失败时，换账号重试的最多次数（0=不重试）
+	MaxRetries int `json:"maxRetries,omitempty"`
+	// UpstreamHeaders 追加/覆盖的上游请求头，受保护的 header 会被忽略
+	UpstreamHeaders map[string]string `json:"upstreamHeaders,omitempty"`
+	// AgentMode x-amzn-kiro-agent-mode 的值，空时使用 DefaultAgentMode
+	AgentMode string `json:"agentMode,omitempty"`
+	// PayloadWarnBytes 发往上游的请求体超过该字节数时记录 WARN 日志（0=只在 DEBUG 日志中输出）
+	PayloadWarnBytes int `json:"payloadWarnBytes,omitempty"`
+	// ModelTimeouts 按模型 ID 配置的上游调用超时（秒），未配置的模型使用 DefaultUpstreamTimeout
+	ModelTimeouts map[string]int `json:"modelTimeouts,omitempty"`
+	// MaxTokens 输出上限（估算 token 数），大于 0 时由 ChatService 在本地截断输出（见 output_limit.go）
+	MaxTokens int `json:"maxTokens,omitempty"`
+	// 生成参数：nil 表示客户端未设置。Kiro API 不接受这些参数，不会转发，
+	// 设置了的参数由 ChatService 记一条日志说明已忽略（见 logIgnoredGenerationParams）
+	StopSequences []string `json:"stopSequences,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"topP,omitempty"`
+	TopK          *int     `json:"topK,omitempty"`
+}
+
 // ========== MCP 工具调用相关类型 ==========
 
 // KiroToolWrapper Kiro API 工具包装器
@@ -569,6 +817,11 @@ type KiroToolUse struct {
 	Name      string                 `json:"name"`
 	Input     map[string]interface{} `json:"input"`
 	Truncated bool                   `json:"-"` // 标记 input 是否被截断后修复的，不序列化到 JSON
+
+	// 以下字段仅用于流式转发，不序列化到 JSON
+	IsPartial    bool   `json:"-"` // 是否为增量片段（此时 Input 为空，只有 PartialInput）
+	PartialInput string `json:"-"` // 本次新增的 input JSON 文本片段
+	RawInput     string `json:"-"` // 完成时的原始 input JSON 文本，用于与已转发的片段对齐
 }
 
 // KiroUserInputMessageContext 用户输入消息上下文
@@ -29,3 +29,38 @@ func TestIsValidModel(t *testing.T) {
 		})
 	}
 }
+
+// TestResolveModelID 测试映射后的模型 ID 校验
+func TestResolveModelID(t *testing.T) {
+	mapping := ModelMapping{
+		"claude-sonnet-4-5": "claude-sonnet-4.5",
+		"evil":              "claude-sonnet-4.5\",\"origin\":\"x",
+		"unknown-target":    "gpt-4",
+	}
+
+	tests := []struct {
+		name    string
+		modelID string
+		want    string
+		wantErr bool
+	}{
+		{"空模型放行", "", "", false},
+		{"映射到有效模型", "claude-sonnet-4-5", "claude-sonnet-4.5", false},
+		{"无映射的有效模型", "auto", "auto", false},
+		{"映射目标含注入字符", "evil", "", true},
+		{"映射目标不是已知模型", "unknown-target", "", true},
+		{"无映射的未知模型", "random-model", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ResolveModelID(tt.modelID, mapping)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveModelID(%q) err = %v, wantErr %v", tt.modelID, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ResolveModelID(%q) = %q, want %q", tt.modelID, got, tt.want)
+			}
+		})
+	}
+}